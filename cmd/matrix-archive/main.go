@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/spf13/cobra"
@@ -13,73 +18,1566 @@ import (
 
 func main() {
 	godotenv.Load()
+	if err := archive.ApplyConfig(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	var rootCmd = &cobra.Command{
+		Use:   "matrix-archive",
+		Short: "Matrix Archive Tools - Import and export messages from Matrix rooms",
+		Long: `Matrix Archive Tools allows you to import messages from Matrix rooms
+into a database and export them in various formats for archival and research purposes.
+
+Use this responsibly and ethically. Don't re-publish people's messages
+without their knowledge and consent.`,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			profile, _ := cmd.Flags().GetString("profile")
+			archive.SetActiveProfile(profile)
+			dbPath, _ := cmd.Flags().GetString("db")
+			archive.SetDatabasePath(dbPath)
+			archive.SetCreateDatabase(createsArchive[cmd])
+			output, _ := cmd.Flags().GetString("output")
+			return archive.SetOutputFormat(output)
+		},
+	}
+
+	rootCmd.PersistentFlags().String("db", "", "Archive database file to use (overrides DUCKDB_URL)")
+	rootCmd.RegisterFlagCompletionFunc("db", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"duckdb", "db"}, cobra.ShellCompDirectiveFilterFileExt
+	})
+	rootCmd.PersistentFlags().String("profile", "", "Account profile to use (separate credentials per account/homeserver)")
+	rootCmd.PersistentFlags().StringP("output", "o", archive.OutputText, "Output format for list, status, diff, context, annotate list, bookmark list, emotes list, failed list and analytics commands: text or json")
+	rootCmd.RegisterFlagCompletionFunc("output", fixedCompletions(archive.OutputText, archive.OutputJSON))
+
+	rootCmd.AddCommand(initCmd)
+	rootCmd.AddCommand(listRoomsCmd)
+	rootCmd.AddCommand(estimateCmd)
+	rootCmd.AddCommand(importCmd)
+	rootCmd.AddCommand(watchCmd)
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(downloadImagesCmd)
+	rootCmd.AddCommand(ocrCmd)
+	rootCmd.AddCommand(mediaCmd)
+	rootCmd.AddCommand(emotesCmd)
+	rootCmd.AddCommand(searchCmd)
+	rootCmd.AddCommand(beeperLoginCmd)
+	rootCmd.AddCommand(beeperLogoutCmd)
+	rootCmd.AddCommand(authCmd)
+	rootCmd.AddCommand(keyRecoveryCmd)
+
+	rootCmd.AddCommand(dbCmd)
+	rootCmd.AddCommand(tuiCmd)
+	rootCmd.AddCommand(diffCmd)
+	rootCmd.AddCommand(contextCmd)
+	rootCmd.AddCommand(annotateCmd)
+	rootCmd.AddCommand(bookmarkCmd)
+	rootCmd.AddCommand(sealCmd)
+	rootCmd.AddCommand(verifyCmd)
+	rootCmd.AddCommand(failedCmd)
+	rootCmd.AddCommand(optOutCmd)
+	rootCmd.AddCommand(usersCmd)
+	rootCmd.AddCommand(restoreCmd)
+	rootCmd.AddCommand(appserviceCmd)
+	rootCmd.AddCommand(publishCmd)
+	rootCmd.AddCommand(analyticsCmd)
+	rootCmd.AddCommand(digestCmd)
+	rootCmd.AddCommand(templatesCmd)
+	rootCmd.AddCommand(migrateCmd)
+	importCmd.AddCommand(importStatusCmd)
+	importCmd.AddCommand(importFileCmd)
+	exportCmd.AddCommand(exportHighlightsCmd)
+	exportCmd.AddCommand(exportThreadCmd)
+	exportCmd.AddCommand(exportSampleCmd)
+	exportCmd.AddCommand(exportGDPRCmd)
+	exportCmd.AddCommand(exportModerationLogCmd)
+	exportCmd.AddCommand(exportValidateCmd)
+	exportCmd.AddCommand(exportSchemaCmd)
+	exportCmd.AddCommand(exportUpgradeCmd)
+	dbCmd.AddCommand(dbEncryptCmd)
+	dbCmd.AddCommand(dbCompactCmd)
+	dbCmd.AddCommand(dbMergeCmd)
+	dbCmd.AddCommand(dbBackupCmd)
+	dbCmd.AddCommand(dbSearchSettingsCmd)
+	annotateCmd.AddCommand(annotateListCmd)
+	annotateCmd.AddCommand(annotateRemoveCmd)
+	bookmarkCmd.AddCommand(bookmarkListCmd)
+	bookmarkCmd.AddCommand(bookmarkRemoveCmd)
+	mediaCmd.AddCommand(mediaDownloadCmd)
+	mediaCmd.AddCommand(mediaFindCmd)
+	emotesCmd.AddCommand(emotesDownloadCmd)
+	emotesCmd.AddCommand(emotesListCmd)
+	failedCmd.AddCommand(failedListCmd)
+	failedCmd.AddCommand(failedRetryCmd)
+	optOutCmd.AddCommand(optOutAddCmd)
+	optOutCmd.AddCommand(optOutRemoveCmd)
+	optOutCmd.AddCommand(optOutListCmd)
+	usersCmd.AddCommand(usersMergeCmd)
+	usersCmd.AddCommand(usersUnmergeCmd)
+	usersCmd.AddCommand(usersListCmd)
+	appserviceCmd.AddCommand(appserviceRegisterCmd)
+	appserviceCmd.AddCommand(appserviceRunCmd)
+	analyticsCmd.AddCommand(analyticsCompareCmd)
+	analyticsCmd.AddCommand(analyticsMentionsCmd)
+	analyticsCmd.AddCommand(analyticsTimelineCmd)
+	analyticsCmd.AddCommand(analyticsWordsCmd)
+	analyticsCmd.AddCommand(analyticsLanguagesCmd)
+	templatesCmd.AddCommand(templatesPreviewCmd)
+	templatesCmd.AddCommand(templatesSchemaCmd)
+	migrateCmd.AddCommand(migrateFromMongoCmd)
+	publishCmd.AddCommand(publishMappingCmd)
+	authCmd.AddCommand(authLoginCmd)
+	authCmd.AddCommand(authLogoutCmd)
+	authCmd.AddCommand(authDevicesCmd)
+	authDevicesCmd.AddCommand(authDevicesListCmd)
+	authDevicesCmd.AddCommand(authDevicesLogoutCmd)
+
+	registerCompletions()
+
+	if err := rootCmd.Execute(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Set up the configuration, archive database and media directories",
+	Long: `Set up everything the other commands need: write ~/.matrix-archive/config.yaml
+with the archive database and Beeper domain to use, create the database with
+its tables, create the thumbnails and images directories that media downloads
+and exports use, and optionally log in to Beeper.
+
+In a terminal, init asks for each setting, proposing the flags' values; with
+--yes, or when not run in a terminal, it uses them as they are. Running init
+again is safe: what already exists is kept, and a configuration with different
+settings is only replaced with --force. Environment variables and .env files
+override the configuration file's settings.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		opts := archive.DefaultInitOptions()
+		if dbPath, _ := cmd.Flags().GetString("db"); dbPath != "" {
+			opts.Database = dbPath
+		}
+		if cmd.Flags().Changed("beeper-domain") {
+			opts.BeeperDomain, _ = cmd.Flags().GetString("beeper-domain")
+		}
+		opts.MediaDir, _ = cmd.Flags().GetString("media-dir")
+		opts.MediaLayout, _ = cmd.Flags().GetString("layout")
+		opts.Login, _ = cmd.Flags().GetBool("login")
+		opts.Force, _ = cmd.Flags().GetBool("force")
+		if yes, _ := cmd.Flags().GetBool("yes"); !yes && archive.IsTerminalInteractive() {
+			if err := archive.PromptInitOptions(opts, os.Stdin, os.Stdout); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := archive.InitArchive(opts); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var listRoomsCmd = &cobra.Command{
+	Use:   "list [pattern]",
+	Short: "List rooms with their encryption, bridge and archived messages",
+	Long: `List all Matrix rooms that the user has access to, optionally filtered by a regex pattern.
+
+For each room, the table shows whether it is encrypted, the network it is
+bridged to, how many of its messages are already archived and the time of the
+newest one. Use --sort to order rooms by name (default), messages, last,
+network or encrypted.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		pattern := ""
+		if len(args) > 0 {
+			pattern = args[0]
+		}
+		sortBy, _ := cmd.Flags().GetString("sort")
+		if err := archive.ListRooms(pattern, sortBy); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var estimateCmd = &cobra.Command{
+	Use:   "estimate",
+	Short: "Estimate the size of a room's history before importing it",
+	Long: `Sample a room's history on the homeserver - its first and last events and a
+few windows in between - and estimate how many events importing it would
+archive, the share of them that are encrypted, how many media files they carry
+and how large those are, and how long the import would take. Nothing is
+imported.
+
+Requests are paced and wait out the homeserver's rate limits. Rooms with fewer
+events than a page are read in full, so their counts are exact. Use --windows
+to sample more of a long history for a closer estimate. Homeservers that don't
+support looking up events by timestamp are only sampled at the ends.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opts := archive.EstimateOptions{}
+		opts.RoomID, _ = cmd.Flags().GetString("room")
+		opts.Windows, _ = cmd.Flags().GetInt("windows")
+		if err := archive.EstimateRoom(opts); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import messages from Matrix rooms into the database",
+	Long: `Import messages from Matrix rooms into DuckDB for archival. If no room ID is specified, imports from all joined rooms.
+
+To spread a very large import over several runs, use --max-events-per-run:
+each run stops after fetching that many events, and running the same command
+again resumes where the last run stopped. --pause-every and --pause-secs add
+pauses within a run to go easier on small homeservers.
+
+When a room is the result of a room upgrade, the rooms it replaced are
+imported too, so exports can show its full history. Use
+--follow-upgrades=false to import only the rooms given.
+
+With --rejoin, rooms the account has left are read again before their history
+is fetched: world-readable rooms without joining, others by joining them again.
+Importing all rooms then also imports the archived rooms the account has left.
+Rooms that can't be read, e.g. because they are invite-only or the account was
+banned, are listed with the reason at the end.
+
+--detect-language stores the language of each text message, told from its
+words or script, for "search --lang", "export --message-lang" and "analytics
+languages". Set detect_language: true in ~/.matrix-archive/config.yaml, or
+MATRIX_ARCHIVE_DETECT_LANGUAGE=true, to detect it on every import.
+
+--peek ROOM reads a world-readable room, given by ID or alias, without joining
+it, so public announcement rooms can be archived without joining them. Run the
+same command again to bring its archive up to date.
+
+Room members are lazy-loaded, so the server only sends the membership of the
+senders of each batch. --event-types and --exclude-event-types limit which
+events are fetched, e.g. --exclude-event-types 'm.call.*'; state events such
+as m.room.member and m.room.create are filtered too, so leaving them out also
+leaves out membership history and room upgrades. In encrypted rooms the server
+only sees m.room.encrypted, so --event-types fetches encrypted events too and
+the types are checked again once they are decrypted.
+
+Messages are validated before they are stored, and those that fail are kept in
+a quarantine table rather than dropped. --strict also checks event ID formats,
+content size and timestamps before 2014; --lenient checks only that IDs are
+present and well formed.
+
+The hooks in ~/.matrix-archive/config.yaml run commands before the import,
+after each stored batch and after the import, with JSON on stdin.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opts := &archive.ImportOptions{}
+		opts.Limit, _ = cmd.Flags().GetInt("limit")
+		opts.RoomID, _ = cmd.Flags().GetString("room-id")
+		opts.MaxEventsPerRun, _ = cmd.Flags().GetInt("max-events-per-run")
+		opts.PauseEvery, _ = cmd.Flags().GetInt("pause-every")
+		pauseSecs, _ := cmd.Flags().GetInt("pause-secs")
+		opts.PauseDuration = time.Duration(pauseSecs) * time.Second
+		opts.Moderation, _ = cmd.Flags().GetBool("moderation")
+		opts.FollowUpgrades, _ = cmd.Flags().GetBool("follow-upgrades")
+		opts.Rejoin, _ = cmd.Flags().GetBool("rejoin")
+		if peek, _ := cmd.Flags().GetString("peek"); peek != "" {
+			if opts.RoomID != "" && opts.RoomID != peek {
+				log.Fatal("--peek and --room-id name different rooms")
+			}
+			opts.RoomID, opts.Peek = peek, true
+		}
+		opts.EventTypes, _ = cmd.Flags().GetStringSlice("event-types")
+		opts.ExcludeEventTypes, _ = cmd.Flags().GetStringSlice("exclude-event-types")
+		opts.ContentLimit = contentLimitFromFlags(cmd)
+		opts.Senders.Allow, _ = cmd.Flags().GetStringSlice("allow-senders")
+		opts.Senders.Deny, _ = cmd.Flags().GetStringSlice("deny-senders")
+		opts.Senders.RespectOptOuts, _ = cmd.Flags().GetBool("respect-opt-outs")
+		opts.Validation = validationFromFlags(cmd)
+		opts.AttributionRules, _ = cmd.Flags().GetString("attribution-rules")
+		opts.DetectLanguage, _ = cmd.Flags().GetBool("detect-language")
+		opts.Hooks = hooksFromConfig()
+		if err := archive.ImportMessagesWithOptions(opts); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Archive new messages as they arrive",
+	Long: `Stay connected and archive new events from joined rooms as they arrive, until
+interrupted with Ctrl-C.
+
+With encryption available, room keys sent to this device are handled as they
+arrive, so encrypted messages are stored decrypted. The Olm sessions and the
+sync position are kept in the crypto store, so the next watch continues where
+this one stopped. Messages whose key arrives a little after them are decrypted
+and replaced once it does.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opts := &archive.WatchOptions{}
+		opts.RoomID, _ = cmd.Flags().GetString("room-id")
+		opts.Moderation, _ = cmd.Flags().GetBool("moderation")
+		opts.ContentLimit = contentLimitFromFlags(cmd)
+		opts.Senders.Allow, _ = cmd.Flags().GetStringSlice("allow-senders")
+		opts.Senders.Deny, _ = cmd.Flags().GetStringSlice("deny-senders")
+		opts.Senders.RespectOptOuts, _ = cmd.Flags().GetBool("respect-opt-outs")
+		opts.Validation = validationFromFlags(cmd)
+		opts.AttributionRules, _ = cmd.Flags().GetString("attribution-rules")
+		if dir, _ := cmd.Flags().GetString("backup-dir"); dir != "" {
+			opts.Backup = &archive.BackupOptions{Dir: dir}
+			opts.Backup.Keep, _ = cmd.Flags().GetInt("backup-keep")
+			opts.Backup.Interval, _ = cmd.Flags().GetDuration("backup-interval")
+		}
+		if err := archive.Watch(opts); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var importStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show archive statistics per source account",
+	Long:  "Show how many messages and rooms have been archived through each account, with the time range covered.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := archive.ShowImportStatus(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var importFileCmd = &cobra.Command{
+	Use:   "file <messages.jsonl>",
+	Short: "Import archived messages from a JSON Lines file",
+	Long: `Import messages from a file with one archived message per line, as JSON
+objects with room_id, event_id, sender, type, timestamp and content fields.
+
+Messages go through the same checks as imports from Matrix: sender filters,
+sealed rooms and validation apply, messages failing validation are quarantined,
+and events already in the archive are skipped.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var senders archive.SenderFilter
+		senders.Allow, _ = cmd.Flags().GetStringSlice("allow-senders")
+		senders.Deny, _ = cmd.Flags().GetStringSlice("deny-senders")
+		senders.RespectOptOuts, _ = cmd.Flags().GetBool("respect-opt-outs")
+		if err := archive.ImportFile(args[0], senders, validationFromFlags(cmd), hooksFromConfig()); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Bring archives made by earlier versions into this one",
+}
+
+var migrateFromMongoCmd = &cobra.Command{
+	Use:   "from-mongo",
+	Short: "Copy the messages of a MongoDB archive made by the Python version",
+	Long: `Copy the messages the Python version of matrix-archive stored in MongoDB into
+the archive. Each document's room_id, event_id, sender, timestamp and content
+become an archived m.room.message event.
+
+Messages go through the same checks as imports: sender filters, sealed rooms
+and validation apply, messages failing validation are quarantined, and events
+already in the archive are skipped, so the migration can be run again to pick
+up documents added since. Documents repeating an event ID are migrated once.
+--report writes a JSON account of every document read, including why
+unreadable ones were skipped.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		opts := &archive.MongoMigrationOptions{}
+		opts.URI, _ = cmd.Flags().GetString("uri")
+		opts.Database, _ = cmd.Flags().GetString("database")
+		opts.Collection, _ = cmd.Flags().GetString("collection")
+		opts.ReportPath, _ = cmd.Flags().GetString("report")
+		opts.Senders.Allow, _ = cmd.Flags().GetStringSlice("allow-senders")
+		opts.Senders.Deny, _ = cmd.Flags().GetStringSlice("deny-senders")
+		opts.Senders.RespectOptOuts, _ = cmd.Flags().GetBool("respect-opt-outs")
+		opts.Validation = validationFromFlags(cmd)
+		if opts.URI == "" {
+			log.Fatal("name the MongoDB archive with --uri or MONGODB_URI")
+		}
+		if err := archive.MigrateFromMongo(opts); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export [filename]",
+	Short: "Export messages to various formats",
+	Long: `Export messages from the database to various formats based on file extension:
+- .html: HTML format
+- .txt: Plain text format
+- .json: JSON format
+- .yaml: YAML format
+
+Use --formats html,json,txt to write several formats from one pass: the
+filename is then a base name (archive -> archive.html, archive.json, ...).
+
+Use --format to choose a format regardless of the extension. --format api
+writes a directory of JSON files shaped like a static API (rooms.json,
+users.json, rooms/<room>/messages/page-N.json) for front-end archive viewers.
+
+HTML and text exports can use an alternative template with --template, e.g.
+--template accessible for a screen-reader friendly, keyboard navigable page.
+
+Use --if-changed to skip regenerating files whose inputs (messages, template,
+strings and options) are unchanged since the last export to the same file, so
+export can run after every import without rewriting anything.
+
+HTML exports of rooms with more than --lazy-load messages (default 5000) show
+the first month and load later months from <name>_files/ as they are scrolled
+to, with links to each month, so browsers can open rooms of any size.
+
+Use --dedupe to drop messages that repeat earlier ones under new event IDs,
+as happens when a bridge re-bridges history after a portal is recreated.
+
+Use --message-lang to export only the messages in one language, such as de,
+as detected at import with --detect-language, or from their text when they
+were imported without it.
+
+Use --report to also write a JSON completeness report: the range of events
+covered, counts by type, undecryptable messages, media not downloaded, and
+gaps such as replies to events that aren't archived.
+
+Use --stats to write summary statistics of each run next to the export, as
+<name>.stats.json (archive.html -> archive.stats.json): messages by type,
+senders, date range, decrypt failures, media downloaded and missing, and how
+long the run took. Runs skipped by --if-changed write them too, marked
+skipped, so automation can check every run without parsing output.
+
+Use --conversations in rooms that don't use threads to split messages into
+conversations, marked with separators: a message starts a new one after
+--conversation-gap of silence (default 30m) unless it replies to an earlier
+message, whose conversation it joins. JSON and YAML exports get a
+conversation_id, and --conversation N exports only conversation N.
+
+Use --search-index to give HTML exports a search box that works offline. The
+messages' text, senders and dates are indexed in <page>_files/search.js, which
+is loaded the first time the box is used.
+
+Use --inline-players to play audio and video downloaded by "media download
+--audio-video" in place in HTML exports, with video posters and durations,
+instead of linking to it. The files then go into --zip exports, and with
+--media-links data are embedded whole, so exports grow by their size.
+
+Use --zip to package the export and the downloaded media it links to into one
+zip (room.html or room.zip -> room.zip). Add --password, or set
+MATRIX_ARCHIVE_ZIP_PASSWORD, to encrypt it with AES-256 in the format 7-Zip,
+WinZip and macOS Archive Utility open, for recipients without age or GPG.
+
+Use --all-rooms to export every archived room into the directory given as the
+filename, one file per room named after its room ID, in --format (default
+html) or each of --formats.
+
+The export_templates rules in ~/.matrix-archive/config.yaml give rooms their
+own template and theme, chosen by room ID pattern or room tag, e.g. a minimal
+template for announcement rooms and the enhanced one for social rooms. The
+first matching rule applies; --template and --theme override the rules.
+Its post_export hooks run commands after each export, with JSON on stdin.
+
+Use "export highlights" for a condensed export of only the pinned, bookmarked
+and annotated messages.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		opts := exportOptionsFromFlags(cmd)
+		opts.Format, _ = cmd.Flags().GetString("format")
+		opts.Formats, _ = cmd.Flags().GetStringSlice("formats")
+		opts.PageSize, _ = cmd.Flags().GetInt("page-size")
+		opts.LazyLoad, _ = cmd.Flags().GetInt("lazy-load")
+		opts.SearchIndex, _ = cmd.Flags().GetBool("search-index")
+		opts.Annotations, _ = cmd.Flags().GetBool("annotations")
+		opts.Verifications, _ = cmd.Flags().GetBool("verifications")
+		opts.PlatformHandles, _ = cmd.Flags().GetBool("show-platform-handles")
+		opts.InlinePlayers, _ = cmd.Flags().GetBool("inline-players")
+		opts.ReportPath, _ = cmd.Flags().GetString("report")
+		opts.ReactionsPath, _ = cmd.Flags().GetString("reactions")
+		opts.Stats, _ = cmd.Flags().GetBool("stats")
+		opts.IfChanged, _ = cmd.Flags().GetBool("if-changed")
+		opts.Dedupe, _ = cmd.Flags().GetBool("dedupe")
+		opts.MessageLang, _ = cmd.Flags().GetString("message-lang")
+		opts.Conversations, _ = cmd.Flags().GetBool("conversations")
+		opts.ConversationGap, _ = cmd.Flags().GetDuration("conversation-gap")
+		opts.Conversation, _ = cmd.Flags().GetInt("conversation")
+		opts.Zip, _ = cmd.Flags().GetBool("zip")
+		if password, _ := cmd.Flags().GetString("password"); password != "" {
+			opts.ZipPassword = password
+		}
+		if cmd.Flags().Changed("password") && !opts.Zip {
+			log.Fatal("--password encrypts a zipped export; add --zip")
+		}
+		if allRooms, _ := cmd.Flags().GetBool("all-rooms"); allRooms {
+			if opts.RoomID != "" {
+				log.Fatal("--all-rooms exports every room; leave out --room-id")
+			}
+			if err := archive.ExportAllRooms(args[0], opts); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		if err := archive.ExportMessagesWithOptions(args[0], opts); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var exportHighlightsCmd = &cobra.Command{
+	Use:   "highlights [filename]",
+	Short: "Export only pinned, bookmarked and annotated messages with context",
+	Long: `Write a condensed document of a room's highlights: messages pinned in the room
+(m.room.pinned_events, captured on import), messages bookmarked with
+"bookmark", and messages with curator notes. Each highlight is shown with the
+messages around it (--context), and skipped stretches are marked.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		opts := exportOptionsFromFlags(cmd)
+		contextSize, _ := cmd.Flags().GetInt("context")
+		if err := archive.ExportHighlights(args[0], contextSize, opts); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var exportThreadCmd = &cobra.Command{
+	Use:   "thread <root_event_id|permalink> <filename>",
+	Short: "Export a single thread as a standalone document",
+	Long: `Write one thread: its root message, every reply in the thread, and the
+reactions and edits made to them, for sharing one discussion out of a busy
+room. The event may be the root, any reply in the thread, or a permalink to
+either. The extension selects html, txt, json or yaml.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := archive.ExportThread(args[0], args[1], exportOptionsFromFlags(cmd)); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var exportSampleCmd = &cobra.Command{
+	Use:   "sample <filename>",
+	Short: "Export a reproducible sample of messages from each room and day",
+	Long: `Write at most --per-day messages from each room on each day, picked at random
+but reproducibly: the same --seed picks the same messages on every run, and
+messages added to one day don't change another day's sample. Busy days no
+longer dominate the result, which suits training and evaluation datasets.
+Edits aren't sampled. A .ndjson or .jsonl filename writes one JSON message
+per line, each with its room ID; --room-id limits the sample to one room.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		perDay, _ := cmd.Flags().GetInt("per-day")
+		seed, _ := cmd.Flags().GetInt64("seed")
+		if err := archive.ExportSample(args[0], perDay, seed, exportOptionsFromFlags(cmd)); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var exportModerationLogCmd = &cobra.Command{
+	Use:   "moderation-log [filename]",
+	Short: "Export a room's invites, knocks, kicks and bans in chronological order",
+	Long: `Write a moderation report for a room: every invite, knock, kick, ban and
+unban archived by "import --moderation", with who made it and the reason given.
+A .json or .yaml filename writes a structured document; anything else is text.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		roomID, _ := cmd.Flags().GetString("room-id")
+		if err := archive.ExportModerationLog(args[0], roomID); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var exportGDPRCmd = &cobra.Command{
+	Use:   "gdpr <directory>",
+	Short: "Export everything archived about one user for a subject access request",
+	Long: `Gather a user's messages, the reactions they made, their membership and
+profile changes and moderation actions by or against them across all archived
+rooms into a directory of documented JSON files. Media they posted that was
+downloaded with download-images is copied in as well. A README.txt in the
+package describes each file.
+
+For a user merged into a person with "users merge", or a person ID given as
+--user, the package covers every user ID of the person.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		userID, _ := cmd.Flags().GetString("user")
+		mediaDirs, _ := cmd.Flags().GetStringSlice("media-dir")
+		if err := archive.ExportSubjectAccess(args[0], userID, mediaDirs); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var exportValidateCmd = &cobra.Command{
+	Use:   "validate <file.json>",
+	Short: "Check a JSON or NDJSON export against the export schema",
+	Long: `Validate a JSON export (an array of messages, or the participants and
+messages document written with --participants) or an NDJSON export (.ndjson or
+.jsonl, one message per line) against the published JSON Schema. Exits with an
+error listing the mismatches if the file doesn't conform.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := archive.CheckExport(args[0]); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var exportUpgradeCmd = &cobra.Command{
+	Use:   "upgrade <old.json> [new.json]",
+	Short: "Migrate a JSON or YAML export from an older version of the tool",
+	Long: `Rewrite a JSON or YAML export produced by an older matrix-archive in the
+current export format (see format_version). Without a second argument the file
+is upgraded in place and the original kept with a .bak suffix.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		output := ""
+		if len(args) == 2 {
+			output = args[1]
+		}
+		version, err := archive.UpgradeExport(args[0], output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if version == archive.ExportFormatVersion {
+			fmt.Printf("%s is already at export format version %d\n", args[0], version)
+		} else {
+			fmt.Printf("Upgraded %s from export format version %d to %d\n", args[0], version, archive.ExportFormatVersion)
+		}
+	},
+}
+
+var exportSchemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Print the JSON Schema for JSON and NDJSON exports",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		data, err := archive.ExportSchemaJSON()
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(data)
+	},
+}
+
+// exportOptionsFromFlags reads the rendering flags shared by export and its subcommands
+// contentLimitFromFlags reads the content size limit flags shared by import and watch
+func contentLimitFromFlags(cmd *cobra.Command) archive.ContentLimit {
+	var limit archive.ContentLimit
+	if size, _ := cmd.Flags().GetString("max-content-size"); size != "" {
+		var err error
+		if limit.MaxSize, err = archive.ParseSize(size); err != nil {
+			log.Fatal(err)
+		}
+	}
+	limit.Policy, _ = cmd.Flags().GetString("oversize")
+	limit.Dir, _ = cmd.Flags().GetString("oversize-dir")
+	return limit
+}
+
+// validationFromFlags reads --strict and --lenient, shared by import and watch
+func validationFromFlags(cmd *cobra.Command) string {
+	strict, _ := cmd.Flags().GetBool("strict")
+	lenient, _ := cmd.Flags().GetBool("lenient")
+	switch {
+	case strict && lenient:
+		log.Fatal("--strict and --lenient can't be combined")
+	case strict:
+		return archive.ValidationStrict
+	case lenient:
+		return archive.ValidationLenient
+	}
+	return archive.ValidationStandard
+}
+
+func exportOptionsFromFlags(cmd *cobra.Command) *archive.ExportOptions {
+	opts := archive.DefaultExportOptions()
+	opts.RoomID, _ = cmd.Flags().GetString("room-id")
+	opts.LocalImages, _ = cmd.Flags().GetBool("local-images")
+	if mediaLinks, _ := cmd.Flags().GetString("media-links"); mediaLinks != "" {
+		opts.MediaLinks = mediaLinks
+	}
+	if baseURL, _ := cmd.Flags().GetString("media-base-url"); baseURL != "" {
+		opts.MediaBaseURL = baseURL
+	}
+	opts.Lang, _ = cmd.Flags().GetString("lang")
+	opts.Template, _ = cmd.Flags().GetString("template")
+	opts.HighContrast, _ = cmd.Flags().GetBool("high-contrast")
+	opts.Theme, _ = cmd.Flags().GetString("theme")
+	opts.CSSPath, _ = cmd.Flags().GetString("css")
+	opts.Permalinks, _ = cmd.Flags().GetBool("permalinks")
+	opts.PermalinkBase, _ = cmd.Flags().GetString("permalink-base")
+	opts.Participants, _ = cmd.Flags().GetBool("participants")
+	opts.HistoricalNames, _ = cmd.Flags().GetBool("historical-names")
+	if wrap, _ := cmd.Flags().GetBool("wrap"); wrap || cmd.Flags().Changed("width") {
+		opts.Width, _ = cmd.Flags().GetInt("width")
+	}
+	opts.RoomTemplates = roomTemplatesFromConfig(cmd)
+	opts.Hooks = hooksFromConfig()
+	return opts
+}
+
+// roomTemplatesFromConfig returns the configuration file's per-room export
+// templates, less the settings given on the command line, which apply to
+// every room
+func roomTemplatesFromConfig(cmd *cobra.Command) []archive.RoomTemplate {
+	cfg, err := archive.LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg == nil {
+		return nil
+	}
+	if err := archive.ValidateRoomTemplates(cfg.ExportTemplates); err != nil {
+		log.Fatal(err)
+	}
+	rules := cfg.ExportTemplates
+	for i := range rules {
+		if cmd.Flags().Changed("template") {
+			rules[i].Template = ""
+		}
+		if cmd.Flags().Changed("theme") {
+			rules[i].Theme = ""
+		}
+	}
+	return rules
+}
+
+// hooksFromConfig returns the hook commands set in the configuration file
+func hooksFromConfig() archive.Hooks {
+	cfg, err := archive.LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg == nil {
+		return archive.Hooks{}
+	}
+	return cfg.Hooks
+}
+
+var tuiCmd = &cobra.Command{
+	Use:   "tui",
+	Short: "Interactively select rooms and import them",
+	Long:  "Browse joined rooms with their archived message counts, select rooms, choose a message limit and date range, and import with live progress.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := archive.RunTUI(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var diffCmd = &cobra.Command{
+	Use:   "diff <archive-a.duckdb> <archive-b.duckdb>",
+	Short: "Compare the messages in two archive databases",
+	Long: `Report messages present in one archive but not the other, matching first by
+event ID and then by content hash. Use it to validate a migration between
+machines or to verify that a re-import captured everything.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		roomID, _ := cmd.Flags().GetString("room")
+		if err := archive.DiffArchives(args[0], args[1], roomID); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var contextCmd = &cobra.Command{
+	Use:   "context <event_id|permalink> [filename]",
+	Short: "Show the conversation around an archived event",
+	Long: `Print the messages before and after an archived event, given by its event ID
+or a permalink such as https://matrix.to/#/!room:server/$event. Messages the
+conversation replies to and, for an event in a thread, the rest of the thread
+are included even when they fall outside the window. Given a filename, write
+the context to it instead; the extension selects html, txt, json or yaml.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		before, _ := cmd.Flags().GetInt("before")
+		after, _ := cmd.Flags().GetInt("after")
+		filename := ""
+		if len(args) > 1 {
+			filename = args[1]
+		}
+		opts := archive.DefaultExportOptions()
+		opts.Lang, _ = cmd.Flags().GetString("lang")
+		opts.Template, _ = cmd.Flags().GetString("template")
+		opts.Permalinks = filename != ""
+		if err := archive.ShowEventContext(args[0], before, after, filename, opts); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var annotateCmd = &cobra.Command{
+	Use:   "annotate <event_id> <note>",
+	Short: "Attach a curator note to an archived message",
+	Long: `Store a note about an archived message without editing the message itself.
+Notes are included in exports with --annotations: as footnotes in HTML and text,
+and as an "annotations" field in JSON and YAML.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		author, _ := cmd.Flags().GetString("author")
+		if err := archive.AnnotateMessage(args[0], args[1], author); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var annotateListCmd = &cobra.Command{
+	Use:   "list [event_id]",
+	Short: "List curator notes, optionally for a single message",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		eventID := ""
+		if len(args) > 0 {
+			eventID = args[0]
+		}
+		if err := archive.ListAnnotations(eventID); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var annotateRemoveCmd = &cobra.Command{
+	Use:   "remove <note_id>",
+	Short: "Remove a curator note",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		id, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			log.Fatalf("invalid note ID %q", args[0])
+		}
+		if err := archive.RemoveAnnotation(id); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var bookmarkCmd = &cobra.Command{
+	Use:   "bookmark <event_id> [label]",
+	Short: "Bookmark an archived message",
+	Long: `Bookmark a message so it is included in "export highlights". Bookmarking a
+message again replaces its label.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		label := ""
+		if len(args) > 1 {
+			label = args[1]
+		}
+		if err := archive.BookmarkMessage(args[0], label); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var bookmarkListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List bookmarked messages",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		roomID, _ := cmd.Flags().GetString("room-id")
+		if err := archive.ListBookmarks(roomID); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var bookmarkRemoveCmd = &cobra.Command{
+	Use:   "remove <event_id>",
+	Short: "Remove a bookmark",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := archive.RemoveBookmark(args[0]); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var sealCmd = &cobra.Command{
+	Use:   "seal",
+	Short: "Mark a room's archive as complete and immutable",
+	Long: `Seal the archive of a room that has been shut down. Sealing records the first
+and last archived events and a hash of every archived message, and import and
+watch then refuse to add to the room. --verify checks that the room still
+holds exactly what it held when it was sealed, and --unseal removes the seal.
+Without --room-id, list the sealed rooms.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		roomID, _ := cmd.Flags().GetString("room-id")
+		unseal, _ := cmd.Flags().GetBool("unseal")
+		verify, _ := cmd.Flags().GetBool("verify")
+		var err error
+		switch {
+		case roomID == "" && (unseal || verify):
+			err = fmt.Errorf("name the room with --room-id")
+		case roomID == "":
+			err = archive.ListRoomSeals()
+		case unseal:
+			err = archive.UnsealRoom(roomID)
+		case verify:
+			err = archive.VerifyRoomSeal(roomID)
+		default:
+			err = archive.SealRoom(roomID)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check archived messages against the signed copies on the homeserver",
+	Long: `Fetch the homeserver's copy of archived messages and check that it is the
+archived event, that its content hash is right and that the server it was sent
+from signed it, then record the result for each message: verified, unsigned
+(the copy matches but came without signatures), mismatch (the copy differs
+from the archive), invalid (a hash or signature doesn't check out) or
+unavailable.
+
+Signed copies come from the client API when the homeserver includes signatures,
+otherwise from the sending server's federation API, which many servers only
+answer for other servers. Encrypted messages are checked as they were sent, so
+the signature covers their ciphertext rather than the archived decryption.
+
+Check the messages given with --event-id, or the last --limit messages of a
+room. Export with --verifications to include the results in JSON and YAML.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		roomID, _ := cmd.Flags().GetString("room-id")
+		eventIDs, _ := cmd.Flags().GetStringSlice("event-id")
+		limit, _ := cmd.Flags().GetInt("limit")
+		if err := archive.VerifyMessages(roomID, eventIDs, limit); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var optOutCmd = &cobra.Command{
+	Use:   "opt-out",
+	Short: "Manage the registry of people who declined archiving",
+	Long: `Keep a registry of the people who declined to have their messages archived.
+Every export withholds their messages, summarizing each run of them in a notice,
+and drops their reactions; completeness reports count the messages withheld.
+Imports skip their messages with --respect-opt-outs.`,
+}
+
+var optOutAddCmd = &cobra.Command{
+	Use:   "add <user_id>",
+	Short: "Add a person to the opt-out registry",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		reason, _ := cmd.Flags().GetString("reason")
+		if err := archive.AddOptOut(args[0], reason); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var optOutRemoveCmd = &cobra.Command{
+	Use:   "remove <user_id>",
+	Short: "Remove a person from the opt-out registry",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := archive.RemoveOptOut(args[0]); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var optOutListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the people who opted out",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := archive.ListOptOuts(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var usersCmd = &cobra.Command{
+	Use:   "users",
+	Short: "Merge the user IDs of people who appear under several identities",
+	Long: `The same person often appears under several user IDs, such as a Matrix
+account and the ghosts bridges made for them on Discord or Telegram. Merging
+the user IDs into one person counts them once, under the person's ID, in
+analytics; labels their messages with the person in exports; and gathers all
+of them into the person's subject access package. The archived messages keep
+their original senders.`,
+}
+
+var usersMergeCmd = &cobra.Command{
+	Use:   "merge <user_id> <user_id>...",
+	Short: "Merge user IDs into one person",
+	Long: `Merge user IDs into one person. The person's ID is --as if given, or else the
+person the first user ID already belongs to, or else the first user ID itself.
+User IDs already merged into another person are moved to this one.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		personID, _ := cmd.Flags().GetString("as")
+		if err := archive.MergeUsers(personID, args); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var usersUnmergeCmd = &cobra.Command{
+	Use:   "unmerge <user_id>...",
+	Short: "Separate user IDs from the persons they were merged into",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := archive.UnmergeUsers(args); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var usersListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the merged persons and their user IDs",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := archive.ListPersons(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var failedCmd = &cobra.Command{
+	Use:   "failed",
+	Short: "Review and retry events that imports couldn't archive",
+	Long: `Imports keep the events they couldn't archive as they are instead of dropping
+them: events that couldn't be converted to messages and encrypted events stored
+as placeholders because they couldn't be decrypted are kept raw with the error,
+and messages that failed validation are quarantined.`,
+}
+
+var failedListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List failed events and quarantined messages with their errors",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		roomID, _ := cmd.Flags().GetString("room-id")
+		if err := archive.ListFailedEvents(roomID); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var failedRetryCmd = &cobra.Command{
+	Use:   "retry",
+	Short: "Try again to archive failed events and quarantined messages",
+	Long: `Convert failed events again and store their messages, for example after
+upgrading or once key-recovery has recovered the keys of undecryptable
+messages, whose placeholders are then replaced. Quarantined messages are
+validated again, with --strict or --lenient if given. Events that fail again
+stay listed with their new error, so retrying can be repeated after each fix.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		roomID, _ := cmd.Flags().GetString("room-id")
+		if err := archive.RetryFailedEvents(roomID, validationFromFlags(cmd)); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Recreate archived rooms on another homeserver",
+	Long: `Create a room on another homeserver for each archived room and post its
+history there again, for example to move a community off a server that is
+shutting down. The rooms are created by the account whose access token is
+given, which invites the users --user-map maps the archived users to.
+
+By default that account posts every message itself, starting with the original
+time and sender. With --appservice and an application service's token, messages
+from mapped users are posted as those users at their original times, and
+--batch-send posts them in bulk on homeservers that support /batch_send.
+
+Events already restored to the homeserver are skipped, so an interrupted
+restore can be run again to finish.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		opts := archive.RestoreOptions{}
+		opts.Homeserver, _ = cmd.Flags().GetString("homeserver")
+		opts.AccessToken, _ = cmd.Flags().GetString("token")
+		opts.RoomID, _ = cmd.Flags().GetString("room-id")
+		opts.AppService, _ = cmd.Flags().GetBool("appservice")
+		opts.BatchSend, _ = cmd.Flags().GetBool("batch-send")
+		opts.MediaDir, _ = cmd.Flags().GetString("media-dir")
+		if userMap, _ := cmd.Flags().GetString("user-map"); userMap != "" {
+			var err error
+			if opts.UserMap, err = archive.LoadUserMap(userMap); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := archive.RestoreArchive(opts); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var appserviceCmd = &cobra.Command{
+	Use:   "appservice",
+	Short: "Archive rooms server-side as an application service",
+	Long: `Run as an application service, to which the homeserver pushes every event of
+the rooms to archive as it happens. There is no history to page through and no
+sync, so nothing is rate limited: the scalable way to archive large public
+communities on a homeserver you administer. Events are archived from when the
+homeserver loads the registration on; import earlier history as usual.`,
+}
+
+var appserviceRegisterCmd = &cobra.Command{
+	Use:   "register <registration.yaml>",
+	Short: "Generate the registration file for the homeserver",
+	Long: `Write an application service registration with new tokens, for the
+homeserver's administrator to add to its configuration (app_service_config_files
+in Synapse). --rooms takes room IDs, aliases, or regular expressions of room
+IDs such as '^!.*:example\.org$'.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		serviceURL, _ := cmd.Flags().GetString("url")
+		sender, _ := cmd.Flags().GetString("sender")
+		rooms, _ := cmd.Flags().GetStringSlice("rooms")
+		if err := archive.GenerateAppServiceRegistration(args[0], serviceURL, sender, rooms); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var appserviceRunCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Archive the events the homeserver pushes until interrupted",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		opts := &archive.AppServiceOptions{}
+		opts.Registration, _ = cmd.Flags().GetString("registration")
+		opts.Homeserver, _ = cmd.Flags().GetString("homeserver")
+		opts.Listen, _ = cmd.Flags().GetString("listen")
+		opts.Moderation, _ = cmd.Flags().GetBool("moderation")
+		opts.Senders.Allow, _ = cmd.Flags().GetStringSlice("allow-senders")
+		opts.Senders.Deny, _ = cmd.Flags().GetStringSlice("deny-senders")
+		opts.Senders.RespectOptOuts, _ = cmd.Flags().GetBool("respect-opt-outs")
+		opts.Validation = validationFromFlags(cmd)
+		opts.AttributionRules, _ = cmd.Flags().GetString("attribution-rules")
+		if err := archive.ServeAppService(opts); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var publishCmd = &cobra.Command{
+	Use:   "publish <dir>",
+	Short: "Publish archived rooms as a static site with privacy controls",
+	Long: `Write archived rooms as a static site: an index page, an HTML page per room
+and the static JSON API under api/. Before anything is written, direct chats are
+left out, messages from people who opted out are withheld, the senders to
+anonymize are replaced with pseudonyms and media of the types to strip is
+removed.
+
+The controls are read from a YAML file given with --config, such as
+
+  include_dms: false
+  anonymize: ["@*:bridge.example.org"]
+  strip_media: ["video/*"]
+  opt_out: ["@carol:example.org"]
+  opt_out_file: opt-out.txt
+  mapping_file: ../pseudonyms.json
+  upload_command: rsync -a --delete {dir}/ host:/srv/archive/
+
+and flags add to them. The upload command is run on the directory once the site
+is written.
+
+With a mapping file, the pseudonyms of anonymized senders are written to it
+with the user IDs they stand for, so the people allowed to can tell who wrote
+what later; "publish mapping" reads it. It must be outside the site's
+directory, and --mapping-password encrypts it.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := &archive.PublishConfig{}
+		if config, _ := cmd.Flags().GetString("config"); config != "" {
+			var err error
+			if cfg, err = archive.LoadPublishConfig(config); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if roomID, _ := cmd.Flags().GetString("room-id"); roomID != "" {
+			cfg.Rooms = []string{roomID}
+		}
+		if includeDMs, _ := cmd.Flags().GetBool("include-dms"); includeDMs {
+			cfg.IncludeDMs = true
+		}
+		anonymize, _ := cmd.Flags().GetStringSlice("anonymize")
+		cfg.Anonymize = append(cfg.Anonymize, anonymize...)
+		stripMedia, _ := cmd.Flags().GetStringSlice("strip-media")
+		cfg.StripMedia = append(cfg.StripMedia, stripMedia...)
+		optOut, _ := cmd.Flags().GetStringSlice("opt-out")
+		cfg.OptOut = append(cfg.OptOut, optOut...)
+		if upload, _ := cmd.Flags().GetString("upload"); upload != "" {
+			cfg.UploadCommand = upload
+		}
+		if mappingFile, _ := cmd.Flags().GetString("mapping-file"); mappingFile != "" {
+			cfg.MappingFile = mappingFile
+		}
+		cfg.MappingPassword = os.Getenv(archive.MappingPasswordEnv)
+		if password, _ := cmd.Flags().GetString("mapping-password"); password != "" {
+			cfg.MappingPassword = password
+		}
+		if cfg.MappingFile == "" && cfg.MappingPassword != "" && cmd.Flags().Changed("mapping-password") {
+			log.Fatal("--mapping-password encrypts the mapping file; add --mapping-file")
+		}
+
+		opts := archive.DefaultExportOptions()
+		if mediaLinks, _ := cmd.Flags().GetString("media-links"); mediaLinks != "" {
+			opts.MediaLinks = mediaLinks
+		}
+		if baseURL, _ := cmd.Flags().GetString("media-base-url"); baseURL != "" {
+			opts.MediaBaseURL = baseURL
+		}
+		opts.Lang, _ = cmd.Flags().GetString("lang")
+		opts.Template, _ = cmd.Flags().GetString("template")
+		opts.Theme, _ = cmd.Flags().GetString("theme")
+		opts.Permalinks, _ = cmd.Flags().GetBool("permalinks")
+		opts.PermalinkBase, _ = cmd.Flags().GetString("permalink-base")
+		opts.SearchIndex, _ = cmd.Flags().GetBool("search-index")
+		opts.RoomTemplates = roomTemplatesFromConfig(cmd)
+		if err := archive.PublishArchive(args[0], cfg, opts); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var publishMappingCmd = &cobra.Command{
+	Use:   "mapping <file> [pseudonym...]",
+	Short: "Show who the pseudonyms of a published site stand for",
+	Long: `Read the mapping file written by "publish --mapping-file" and print the user
+ID each pseudonym stands for, or only those of the pseudonyms given, such as
+"Anonymous 3". An encrypted mapping needs its password.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		password := os.Getenv(archive.MappingPasswordEnv)
+		if flag, _ := cmd.Flags().GetString("password"); flag != "" {
+			password = flag
+		}
+		if err := archive.ShowPseudonymMapping(args[0], password, args[1:]); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
 
-	var rootCmd = &cobra.Command{
-		Use:   "matrix-archive",
-		Short: "Matrix Archive Tools - Import and export messages from Matrix rooms",
-		Long: `Matrix Archive Tools allows you to import messages from Matrix rooms
-into a database and export them in various formats for archival and research purposes.
+var analyticsCmd = &cobra.Command{
+	Use:   "analytics",
+	Short: "Analyze archived room activity",
+}
 
-Use this responsibly and ethically. Don't re-publish people's messages
-without their knowledge and consent.`,
-	}
+var analyticsCompareCmd = &cobra.Command{
+	Use:   "compare",
+	Short: "Compare a room's activity in two time periods",
+	Long: `Compare a room's message volume, active users, median response time and
+share of media messages in two periods, with the change between them. A period
+is a year (2023), a month (2023-06), a day (2023-06-15) or an inclusive range
+of them (2023-01..2023-06).
 
-	rootCmd.AddCommand(listRoomsCmd)
-	rootCmd.AddCommand(importCmd)
-	rootCmd.AddCommand(exportCmd)
-	rootCmd.AddCommand(downloadImagesCmd)
-	rootCmd.AddCommand(beeperLoginCmd)
-	rootCmd.AddCommand(beeperLogoutCmd)
-	rootCmd.AddCommand(keyRecoveryCmd)
+The response time is the gap before a different sender posts, ignoring gaps of
+more than 12 hours. Use --html to also write the comparison as an HTML page,
+or -o json for the figures as JSON.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		roomID, _ := cmd.Flags().GetString("room")
+		period1, _ := cmd.Flags().GetString("period1")
+		period2, _ := cmd.Flags().GetString("period2")
+		htmlPath, _ := cmd.Flags().GetString("html")
+		if err := archive.CompareRoom(roomID, period1, period2, htmlPath); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
 
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
+var analyticsMentionsCmd = &cobra.Command{
+	Use:   "mentions",
+	Short: "Show who mentions whom and export the mention network",
+	Long: `Count mentions in a room, or in every archived room without --room: the most
+mentioned users, the pairs of users who mention each other most, and who
+notifies the whole room with @room. Mentions are read from m.mentions, from
+the user pills in formatted bodies and from user IDs in the text; quotes of
+replied-to messages, edits and mentions of oneself aren't counted.
+
+Use --graph to write the mention network for social network analysis, as a
+Graphviz digraph (.dot or .gv) or a JSON edge list (.json). People who opted
+out of archiving are left out.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		roomID, _ := cmd.Flags().GetString("room")
+		top, _ := cmd.Flags().GetInt("top")
+		graphPath, _ := cmd.Flags().GetString("graph")
+		if err := archive.AnalyzeMentions(roomID, top, graphPath); err != nil {
+			log.Fatal(err)
+		}
+	},
 }
 
-var listRoomsCmd = &cobra.Command{
-	Use:   "list [pattern]",
-	Short: "List room IDs and display names",
-	Long:  "List all Matrix rooms that the user has access to, optionally filtered by a regex pattern.",
-	Args:  cobra.MaximumNArgs(1),
+var analyticsTimelineCmd = &cobra.Command{
+	Use:   "timeline FILE",
+	Short: "Chart a room's messages per day as SVG or HTML",
+	Long: `Draw a bar chart of how many messages a room received each day (UTC), from
+its first archived day to its last, and write it to FILE as an SVG image or as
+a standalone HTML page. The format follows FILE's extension unless --format is
+given. Reactions aren't counted.
+
+With --stacked, each day's bar is split between the most active senders, with
+everyone else stacked together. People who opted out of archiving are never
+named. The counts come from the daily statistics, so even large rooms are
+charted quickly.`,
+	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		pattern := ""
+		roomID, _ := cmd.Flags().GetString("room")
+		format, _ := cmd.Flags().GetString("format")
+		stacked, _ := cmd.Flags().GetBool("stacked")
+		senders, _ := cmd.Flags().GetInt("senders")
+		if !stacked {
+			senders = 0
+		} else if senders <= 0 {
+			log.Fatal("--senders must be positive")
+		}
+		if err := archive.ExportRoomTimeline(roomID, args[0], format, senders); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var digestCmd = &cobra.Command{
+	Use:   "digest [filename]",
+	Short: "Write a digest of a room's top messages over a day, week or month",
+	Long: `Pick the messages of a day, week (Monday to Sunday) or month, in UTC, that got
+the most reactions and replies, and write a short digest of them for a
+newsletter or a "message of the week" post: each message with its sender,
+time, reactions, replies and a matrix.to link. A reaction and a reply count
+the same, including those made after the period; replies to a thread's root
+count every message in the thread. Messages nobody reacted or replied to are
+left out, as are people who opted out of archiving.
+
+Without --date the digest covers the last period to have ended, such as last
+week. The digest is written to filename, or printed without one, as Markdown,
+plain text or JSON, chosen by --format or filename's extension.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		roomID, _ := cmd.Flags().GetString("room")
+		period, _ := cmd.Flags().GetString("period")
+		format, _ := cmd.Flags().GetString("format")
+		top, _ := cmd.Flags().GetInt("top")
+		var date time.Time
+		if value, _ := cmd.Flags().GetString("date"); value != "" {
+			var err error
+			if date, err = time.Parse("2006-01-02", value); err != nil {
+				log.Fatalf("invalid --date %q, expected YYYY-MM-DD", value)
+			}
+		}
+		filename := ""
 		if len(args) > 0 {
-			pattern = args[0]
+			filename = args[0]
 		}
-		if err := archive.ListRooms(pattern); err != nil {
+		if err := archive.ExportDigest(roomID, period, date, top, format, filename); err != nil {
 			log.Fatal(err)
 		}
 	},
 }
 
-var importCmd = &cobra.Command{
-	Use:   "import",
-	Short: "Import messages from Matrix rooms into the database",
-	Long:  "Import messages from Matrix rooms into DuckDB for archival. If no room ID is specified, imports from all joined rooms.",
+var analyticsLanguagesCmd = &cobra.Command{
+	Use:   "languages",
+	Short: "Show the languages messages are written in",
+	Long: `Count the text messages of a room, or of every archived room without --room,
+in each language, with the share of messages and the number of people writing
+in it. Languages are those detected at import with --detect-language, or told
+from the messages' text for those imported without it; messages too short to
+tell are counted as und. Edits aren't counted, and people who opted out of
+archiving are left out.`,
+	Args: cobra.NoArgs,
 	Run: func(cmd *cobra.Command, args []string) {
-		limit, _ := cmd.Flags().GetInt("limit")
-		roomID, _ := cmd.Flags().GetString("room-id")
-		if err := archive.ImportMessages(limit, roomID); err != nil {
+		roomID, _ := cmd.Flags().GetString("room")
+		if err := archive.AnalyzeLanguages(roomID); err != nil {
 			log.Fatal(err)
 		}
 	},
 }
 
-var exportCmd = &cobra.Command{
-	Use:   "export [filename]",
-	Short: "Export messages to various formats",
-	Long: `Export messages from the database to various formats based on file extension:
-- .html: HTML format
-- .txt: Plain text format
-- .json: JSON format
-- .yaml: YAML format`,
+var analyticsWordsCmd = &cobra.Command{
+	Use:   "words",
+	Short: "Show the most used words",
+	Long: `Count the words in the text messages of a room, or of every archived room
+without --room, most used first, with the number of messages and people using
+each. Links, Matrix IDs, numbers and the language's stopwords aren't counted;
+Chinese, Japanese and Korean text is split into pairs of characters.
+
+Rooms are analyzed as English unless an analyzer configuration (--analyzers or
+$MATRIX_ARCHIVE_ANALYZERS) gives them another language: en, de, fr, es, or
+none to keep stopwords. --lang analyzes every room in one language. People who
+opted out of archiving are left out.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		roomID, _ := cmd.Flags().GetString("room")
+		top, _ := cmd.Flags().GetInt("top")
+		lang, _ := cmd.Flags().GetString("lang")
+		analyzers, _ := cmd.Flags().GetString("analyzers")
+		cfg, err := archive.LoadAnalyzerConfigOrEnv(analyzers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := archive.AnalyzeWords(roomID, top, cfg, lang); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var templatesCmd = &cobra.Command{
+	Use:   "templates",
+	Short: "Develop export templates",
+}
+
+var templatesPreviewCmd = &cobra.Command{
+	Use:   "preview <template>",
+	Short: "Render a template against a sample of archived messages",
+	Long: `Render an export template against the last --sample messages of a room, with
+their reactions and edits, and print the path of the temporary file it wrote.
+This is much faster than a full export while working on a template; --open
+also opens the file in the browser.
+
+The template is a file such as my.html.tpl, whose name sets the preview's
+format, or the name of a bundled template (default, enhanced, accessible).
+Downloaded media is embedded in the preview unless --media-links says
+otherwise, so images show wherever the file is.`,
 	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		roomID, _ := cmd.Flags().GetString("room-id")
-		localImages, _ := cmd.Flags().GetBool("local-images")
-		if err := archive.ExportMessages(args[0], roomID, localImages); err != nil {
+		opts := archive.DefaultExportOptions()
+		opts.RoomID, _ = cmd.Flags().GetString("room")
+		if mediaLinks, _ := cmd.Flags().GetString("media-links"); mediaLinks != "" {
+			opts.MediaLinks = mediaLinks
+		}
+		opts.Lang, _ = cmd.Flags().GetString("lang")
+		opts.Theme, _ = cmd.Flags().GetString("theme")
+		opts.CSSPath, _ = cmd.Flags().GetString("css")
+		sample, _ := cmd.Flags().GetInt("sample")
+		path, err := archive.PreviewTemplate(args[0], sample, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(path)
+		if open, _ := cmd.Flags().GetBool("open"); open {
+			if err := archive.OpenInBrowser(path); err != nil {
+				log.Fatal(err)
+			}
+		}
+	},
+}
+
+var templatesSchemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "List the fields and functions export templates can use",
+	Long: `List the fields of the data export templates render, as written in a
+template (e.g. .Messages[].Sender for {{range .Messages}}{{.Sender}}{{end}}),
+and the functions templates can call. --output json prints both as JSON.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := archive.PrintTemplateSchema(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "Manage the archive database",
+}
+
+var dbEncryptCmd = &cobra.Command{
+	Use:   "encrypt",
+	Short: "Encrypt message content stored in plaintext",
+	Long: `Encrypt the content of every archived message with a key derived from
+MATRIX_ARCHIVE_PASSPHRASE. Once an archive is encrypted, new messages are
+encrypted on import and the same passphrase is needed to export or analyze it.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := archive.EncryptDatabase(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var dbCompactCmd = &cobra.Command{
+	Use:   "compact",
+	Short: "Drop formatted bodies that only repeat the plain body",
+	Long: `Drop the formatted_body of archived messages whose HTML is just their plain
+body escaped, as many bridges send it, keeping a note of how it was rendered so
+exports rebuild it exactly. Set MATRIX_ARCHIVE_COMPACT=true to store new
+messages compacted as they are imported.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := archive.CompactDatabase(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var dbBackupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Back up the archive database, keeping the newest backups",
+	Long: `Write a consistent copy of the archive database to --dir, named after the
+archive and the time, such as matrix_archive-20240301-120000.duckdb, then delete
+the oldest backups there beyond --keep. The copy is taken in one transaction,
+so it is consistent even while messages are being archived. Each backup is an
+archive itself: open it with --db, or restore it by copying it into place.
+Downloaded media files are not part of the database; back them up separately.
+
+Since only one process can use an archive at a time, back up a running watch
+with its --backup-dir flag instead.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		opts := &archive.BackupOptions{}
+		opts.Dir, _ = cmd.Flags().GetString("dir")
+		opts.Keep, _ = cmd.Flags().GetInt("keep")
+		if err := archive.BackupDatabase(opts); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var dbMergeCmd = &cobra.Command{
+	Use:   "merge <other.duckdb>",
+	Short: "Merge another archive database into this one",
+	Long: `Copy every message from another archive database into the current one,
+for example to consolidate archives made on different machines. Messages whose
+event ID is already archived are left alone unless their content differs, in
+which case --on-conflict decides which copy wins. Downloaded media files are not
+part of the database; copy the image directories separately.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		strategy, _ := cmd.Flags().GetString("on-conflict")
+		if err := archive.MergeArchive(args[0], strategy); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var dbSearchSettingsCmd = &cobra.Command{
+	Use:   "search-settings",
+	Short: "Show or change how the archive's searches match text",
+	Long: `Show or change how "search" and the search box of HTML exports match text.
+Text and queries are always put in Unicode NFKC form, so ligatures and
+full-width letters match their plain forms, and lowercased. --fold-diacritics
+also matches letters with and without accents, so "uber" finds "Über".
+--language gives the language of the archive's messages: Turkish and Azeri
+lowercase I to dotless ı, and folding keeps the letters a language counts as
+letters of their own, such as å, ä and ö in Swedish. The settings are stored in
+the archive; HTML exports written afterwards use them.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var lang *string
+		var fold *bool
+		if cmd.Flags().Changed("language") {
+			value, _ := cmd.Flags().GetString("language")
+			lang = &value
+		}
+		if cmd.Flags().Changed("fold-diacritics") {
+			value, _ := cmd.Flags().GetBool("fold-diacritics")
+			fold = &value
+		}
+		if err := archive.ConfigureSearch(lang, fold); err != nil {
 			log.Fatal(err)
 		}
 	},
@@ -96,7 +1594,165 @@ var downloadImagesCmd = &cobra.Command{
 			outputDir = args[0]
 		}
 		thumbnails, _ := cmd.Flags().GetBool("thumbnails")
-		if err := archive.DownloadImages(outputDir, thumbnails); err != nil {
+		layout, _ := cmd.Flags().GetString("layout")
+		if err := archive.DownloadImages(outputDir, thumbnails, layout); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var mediaCmd = &cobra.Command{
+	Use:   "media",
+	Short: "Manage downloaded media",
+}
+
+var mediaDownloadCmd = &cobra.Command{
+	Use:   "download [output-dir]",
+	Short: "Download images within a size budget",
+	Long: `Download image thumbnails to <output-dir>/thumbnails and full images to
+<output-dir>/images, stopping at --max-total-size. Thumbnails are downloaded
+before any full image, newest first, so a small budget still covers the whole
+archive with previews. Files already downloaded count toward the budget. The
+files that didn't fit are listed at the end. --max-bandwidth caps the download
+rate, for metered or shared connections. --include-mime, --max-size and --since
+fetch only the media matching the type, size and date recorded in its event.
+--audio-video also downloads the files of audio and video messages to
+<output-dir>/recordings, after every image, and video posters with the
+thumbnails, for exports with --inline-players.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		outputDir := ""
+		if len(args) > 0 {
+			outputDir = args[0]
+		}
+		var maxTotalSize int64
+		if size, _ := cmd.Flags().GetString("max-total-size"); size != "" {
+			var err error
+			if maxTotalSize, err = archive.ParseSize(size); err != nil {
+				log.Fatal(err)
+			}
+		}
+		var maxBandwidth int64
+		if rate, _ := cmd.Flags().GetString("max-bandwidth"); rate != "" {
+			var err error
+			if maxBandwidth, err = archive.ParseBandwidth(rate); err != nil {
+				log.Fatal(err)
+			}
+		}
+		filter := &archive.MediaDownloadFilter{}
+		filter.IncludeMIME, _ = cmd.Flags().GetStringSlice("include-mime")
+		filter.AudioVideo, _ = cmd.Flags().GetBool("audio-video")
+		if size, _ := cmd.Flags().GetString("max-size"); size != "" {
+			var err error
+			if filter.MaxSize, err = archive.ParseSize(size); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if since, _ := cmd.Flags().GetString("since"); since != "" {
+			var err error
+			if filter.Since, err = time.ParseInLocation("2006-01-02", since, time.Local); err != nil {
+				log.Fatalf("invalid --since date %q, expected YYYY-MM-DD", since)
+			}
+		}
+		layout, _ := cmd.Flags().GetString("layout")
+		if err := archive.DownloadMediaWithBudget(outputDir, maxTotalSize, maxBandwidth, layout, filter); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var emotesCmd = &cobra.Command{
+	Use:   "emotes",
+	Short: "Manage archived custom emoji and sticker packs",
+}
+
+var emotesDownloadCmd = &cobra.Command{
+	Use:   "download [output-dir]",
+	Short: "Download custom emoji images",
+	Long: `Download the images of the archived emote packs (im.ponies.room_emotes and
+im.ponies.user_emotes), and of the custom emoji used in messages and
+reactions, to <output-dir>/emotes. HTML exports show the downloaded images in
+place of the emoji's :shortcode: text, linked as their other media is.
+Images already downloaded are skipped.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		outputDir := ""
+		if len(args) > 0 {
+			outputDir = args[0]
+		}
+		layout, _ := cmd.Flags().GetString("layout")
+		if err := archive.DownloadEmotes(outputDir, layout); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var emotesListCmd = &cobra.Command{
+	Use:   "list [output-dir]",
+	Short: "List archived emote packs",
+	Long: `List the emote packs archived by import: each room's packs and the user's own,
+with how many of their images were downloaded to <output-dir>/emotes.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		outputDir := ""
+		if len(args) > 0 {
+			outputDir = args[0]
+		}
+		if err := archive.ListEmotePacks(outputDir); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var mediaFindCmd = &cobra.Command{
+	Use:   "find <file-or-sha256>",
+	Short: "Find the messages where a downloaded file was posted",
+	Long: `Trace a saved image back to the conversation it came from. Given a local file
+or the SHA-256 of its content, list the archived messages whose downloaded
+media has the same content, with the room, sender and date. Hashed media
+directories are looked up in their index; files saved flat are hashed.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		mediaDirs, _ := cmd.Flags().GetStringSlice("media-dir")
+		if err := archive.FindMedia(args[0], mediaDirs); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var ocrCmd = &cobra.Command{
+	Use:   "ocr [image-dir]",
+	Short: "Extract text from downloaded images for search",
+	Long: `Run an OCR command over images fetched by download-images and store the text
+so screenshots can be found with "search". The command defaults to tesseract;
+{file} in it is replaced with the image path. Images that already have text are
+skipped.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		imageDir := ""
+		if len(args) > 0 {
+			imageDir = args[0]
+		}
+		thumbnails, _ := cmd.Flags().GetBool("thumbnails")
+		command, _ := cmd.Flags().GetString("command")
+		if err := archive.OCRImages(imageDir, thumbnails, command); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var searchCmd = &cobra.Command{
+	Use:   "search <query>",
+	Short: "Search archived messages and image text",
+	Long: `Find archived messages whose body contains the query, ignoring case. Text
+extracted from images by "ocr" is searched too. "db search-settings" can make
+searches ignore accents as well, for the archive's language. --lang finds only
+messages in one language, such as de (see "import --detect-language").`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		roomID, _ := cmd.Flags().GetString("room-id")
+		lang, _ := cmd.Flags().GetString("lang")
+		if err := archive.SearchArchive(args[0], roomID, lang); err != nil {
 			log.Fatal(err)
 		}
 	},
@@ -108,7 +1764,7 @@ var beeperLoginCmd = &cobra.Command{
 	Long:  "Authenticate with Beeper using email and passcode.",
 	Run: func(cmd *cobra.Command, args []string) {
 		domain, _ := cmd.Flags().GetString("domain")
-		if err := archive.PerformBeeperLogin(domain, false); err != nil {
+		if err := archive.PerformBeeperLogin(domain, false, false); err != nil {
 			log.Fatal(err)
 		}
 	},
@@ -126,6 +1782,121 @@ var beeperLogoutCmd = &cobra.Command{
 	},
 }
 
+var authCmd = &cobra.Command{
+	Use:   "auth",
+	Short: "Manage Beeper credentials",
+}
+
+var authLoginCmd = &cobra.Command{
+	Use:   "login",
+	Short: "Authenticate with Beeper",
+	Long: `Authenticate with Beeper. Without flags this is the interactive email and
+passcode login of beeper-login.
+
+On servers and in automation, where nobody can answer the prompts, pass a
+token from an account that is already logged in instead: --token with a
+Beeper API token, or --matrix-token with a Matrix access token and --user-id
+with the account it belongs to. The token is checked before the credentials
+are saved. Use - as the token to read it from standard input, which keeps it
+out of the process list and shell history.
+
+The archive logs in as the device MATRIXARCH. --new-device gives the profile
+its own device with a random ID instead, named after the profile, so each
+archiver can be told apart and logged out separately.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		domain, _ := cmd.Flags().GetString("domain")
+		token, _ := cmd.Flags().GetString("token")
+		matrixToken, _ := cmd.Flags().GetString("matrix-token")
+		userID, _ := cmd.Flags().GetString("user-id")
+		newDevice, _ := cmd.Flags().GetBool("new-device")
+
+		var err error
+		switch {
+		case token != "" && matrixToken != "":
+			log.Fatal("--token and --matrix-token can't be used together")
+		case token != "":
+			if token, err = readTokenFlag(token); err == nil {
+				err = archive.PerformBeeperTokenLogin(domain, token, newDevice)
+			}
+		case matrixToken != "":
+			if userID == "" {
+				log.Fatal("--matrix-token needs --user-id, the Matrix ID of the account it belongs to")
+			}
+			if newDevice {
+				log.Fatal("--new-device can't be used with --matrix-token, which belongs to a device already")
+			}
+			if matrixToken, err = readTokenFlag(matrixToken); err == nil {
+				err = archive.PerformMatrixTokenLogin(domain, matrixToken, userID)
+			}
+		case userID != "":
+			log.Fatal("--user-id is only used with --matrix-token")
+		default:
+			err = archive.PerformBeeperLogin(domain, false, newDevice)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var authLogoutCmd = &cobra.Command{
+	Use:   "logout",
+	Short: "Clear Beeper credentials",
+	Long:  "Clear stored Beeper credentials.",
+	Run: func(cmd *cobra.Command, args []string) {
+		domain, _ := cmd.Flags().GetString("domain")
+		if err := archive.PerformBeeperLogout(domain); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var authDevicesCmd = &cobra.Command{
+	Use:   "devices",
+	Short: "Manage the devices logged in to the archive's account",
+}
+
+var authDevicesListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the devices logged in to the archive's account",
+	Long: `List the devices logged in to the archive's Matrix account, most recently seen
+first. The device the archive uses is marked with *.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		domain, _ := cmd.Flags().GetString("domain")
+		if err := archive.ListAccountDevices(domain); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var authDevicesLogoutCmd = &cobra.Command{
+	Use:   "logout [device-id...]",
+	Short: "Log devices out of the archive's account",
+	Long: `Log devices out of the archive's Matrix account, such as the archive devices
+earlier versions left behind. Without device IDs, the device the archive uses
+is logged out and its saved credentials are cleared; log in again to archive.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		domain, _ := cmd.Flags().GetString("domain")
+		if err := archive.LogoutAccountDevices(domain, args); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+// readTokenFlag returns a token flag's value, or the first line of standard
+// input if the value is -
+func readTokenFlag(value string) (string, error) {
+	if value != "-" {
+		return value, nil
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read token from standard input: %w", err)
+	}
+	return strings.TrimSpace(line), nil
+}
+
 var keyRecoveryCmd = &cobra.Command{
 	Use:   "key-recovery",
 	Short: "Recover encryption keys using Matrix key backup",
@@ -145,13 +1916,374 @@ var keyRecoveryCmd = &cobra.Command{
 }
 
 func init() {
+	listRoomsCmd.Flags().String("sort", archive.SortRoomsByName, "Order rooms by name, messages, last (newest archived message), network or encrypted")
+
+	estimateCmd.Flags().String("room", "", "Room ID to estimate")
+	estimateCmd.Flags().Int("windows", archive.DefaultEstimateWindows, "Windows of events to sample between the first and last events")
+	estimateCmd.MarkFlagRequired("room")
+
 	importCmd.Flags().Int("limit", 0, "Limit the number of messages to import (0 = no limit)")
 	importCmd.Flags().String("room-id", "", "Import from a specific room (optional, imports all joined rooms if not specified)")
-	exportCmd.Flags().String("room-id", "", "Export from a specific room (optional)")
-	exportCmd.Flags().Bool("local-images", true, "Use local image paths instead of Matrix URLs")
+	importCmd.Flags().Int("max-events-per-run", 0, "Stop after fetching this many events; the next run resumes where this one stopped (0 = no cap)")
+	importCmd.Flags().Int("pause-every", 0, "Pause after every N fetched events (0 = never)")
+	importCmd.Flags().Int("pause-secs", 30, "Seconds to pause with --pause-every")
+	importCmd.Flags().Bool("moderation", false, "Also archive invites, knocks, kicks and bans with their reasons, for export moderation-log")
+	importCmd.Flags().Bool("follow-upgrades", true, "Also import the rooms that upgraded rooms replaced")
+	importCmd.Flags().String("peek", "", "Read this world-readable room (ID or alias) without joining it")
+	importCmd.Flags().Bool("rejoin", false, "Join rooms the account has left again, or read world-readable ones without joining, before importing them")
+	importCmd.Flags().StringSlice("event-types", nil, "Only fetch these event types, e.g. m.room.message,m.reaction (* matches any suffix)")
+	importCmd.Flags().StringSlice("exclude-event-types", nil, "Don't fetch these event types, e.g. m.call.* (* matches any suffix)")
+	importCmd.Flags().String("max-content-size", "", "Truncate messages whose content is larger than this, e.g. 256KB (default no limit)")
+	importCmd.Flags().String("oversize", archive.OversizeTruncate, "What to do with oversized messages: truncate, or external to also write the full content to --oversize-dir")
+	importCmd.Flags().String("oversize-dir", archive.DefaultOversizeDir, "Directory for the full content of oversized messages with --oversize external")
+	importCmd.Flags().StringSlice("allow-senders", nil, "Only archive messages from senders matching these patterns, e.g. '@*:example.org' (or $MATRIX_ARCHIVE_ALLOW_SENDERS)")
+	importCmd.Flags().StringSlice("deny-senders", nil, "Don't archive messages from senders matching these patterns, e.g. '@*bot:*' (or $MATRIX_ARCHIVE_DENY_SENDERS)")
+	importCmd.Flags().String("attribution-rules", "", "YAML file of rules crediting bot- and webhook-relayed messages to their real authors (or $MATRIX_ARCHIVE_ATTRIBUTION_RULES)")
+	importCmd.Flags().Bool("detect-language", false, "Store the language of each text message (or $MATRIX_ARCHIVE_DETECT_LANGUAGE=true)")
+
+	watchCmd.Flags().String("room-id", "", "Archive only this room (optional, watches all joined rooms if not specified)")
+	watchCmd.Flags().Bool("moderation", false, "Also archive invites, knocks, kicks and bans with their reasons")
+	watchCmd.Flags().String("max-content-size", "", "Truncate messages whose content is larger than this, e.g. 256KB (default no limit)")
+	watchCmd.Flags().String("oversize", archive.OversizeTruncate, "What to do with oversized messages: truncate, or external to also write the full content to --oversize-dir")
+	watchCmd.Flags().String("oversize-dir", archive.DefaultOversizeDir, "Directory for the full content of oversized messages with --oversize external")
+	importFileCmd.Flags().StringSlice("allow-senders", nil, "Only import messages from senders matching these patterns, e.g. '@*:example.org' (or $MATRIX_ARCHIVE_ALLOW_SENDERS)")
+	importFileCmd.Flags().StringSlice("deny-senders", nil, "Don't import messages from senders matching these patterns, e.g. '@*bot:*' (or $MATRIX_ARCHIVE_DENY_SENDERS)")
+	migrateFromMongoCmd.Flags().String("uri", os.Getenv("MONGODB_URI"), "MongoDB connection string, e.g. mongodb://localhost:27017/matrix_archive (or $MONGODB_URI)")
+	migrateFromMongoCmd.Flags().String("database", "", "Database holding the messages (default: the connection string's, or "+archive.DefaultMongoDatabase+")")
+	migrateFromMongoCmd.Flags().String("collection", archive.DefaultMongoCollection, "Collection holding the messages")
+	migrateFromMongoCmd.Flags().String("report", "", "Write a JSON migration report to this file")
+	migrateFromMongoCmd.Flags().StringSlice("allow-senders", nil, "Only migrate messages from senders matching these patterns (or $MATRIX_ARCHIVE_ALLOW_SENDERS)")
+	migrateFromMongoCmd.Flags().StringSlice("deny-senders", nil, "Don't migrate messages from senders matching these patterns (or $MATRIX_ARCHIVE_DENY_SENDERS)")
+	watchCmd.Flags().StringSlice("allow-senders", nil, "Only archive messages from senders matching these patterns, e.g. '@*:example.org' (or $MATRIX_ARCHIVE_ALLOW_SENDERS)")
+	watchCmd.Flags().StringSlice("deny-senders", nil, "Don't archive messages from senders matching these patterns, e.g. '@*bot:*' (or $MATRIX_ARCHIVE_DENY_SENDERS)")
+	watchCmd.Flags().String("attribution-rules", "", "YAML file of rules crediting bot- and webhook-relayed messages to their real authors (or $MATRIX_ARCHIVE_ATTRIBUTION_RULES)")
+	watchCmd.Flags().String("backup-dir", "", "Back up the archive to this directory every --backup-interval and when watch stops")
+	watchCmd.Flags().Int("backup-keep", archive.DefaultBackupKeep, "Newest backups to keep in --backup-dir (0 = all)")
+	watchCmd.Flags().Duration("backup-interval", 24*time.Hour, "How often to back up with --backup-dir (0 = only when watch stops)")
+	failedCmd.PersistentFlags().String("room-id", "", "Only list or retry events from this room")
+	restoreCmd.Flags().String("homeserver", "", "URL of the homeserver to restore to (or $"+archive.RestoreHomeserverEnv+")")
+	restoreCmd.Flags().String("token", "", "Access token of the account that restores the rooms (or $"+archive.RestoreTokenEnv+")")
+	restoreCmd.Flags().String("room-id", "", "Restore only this room (optional, restores every archived room if not specified)")
+	restoreCmd.Flags().String("user-map", "", "YAML file mapping archived user IDs to user IDs on the new homeserver")
+	restoreCmd.Flags().Bool("appservice", false, "The token is an application service's: post as the mapped users, at the original times")
+	restoreCmd.Flags().Bool("batch-send", false, "Post history in bulk with /batch_send (needs --appservice)")
+	restoreCmd.Flags().String("media-dir", "", "Directory of downloaded images to upload to the new homeserver")
+	appserviceRegisterCmd.Flags().String("url", "http://localhost:29340", "URL the homeserver reaches the application service at")
+	appserviceRegisterCmd.Flags().String("sender", archive.DefaultAppServiceSender, "Localpart of the application service's user")
+	appserviceRegisterCmd.Flags().StringSlice("rooms", nil, "Rooms to archive: room IDs, aliases or regular expressions of room IDs")
+	appserviceRegisterCmd.MarkFlagRequired("rooms")
+	appserviceRunCmd.Flags().String("registration", "registration.yaml", "Registration file written by appservice register")
+	appserviceRunCmd.Flags().String("homeserver", "", "URL of the homeserver that pushes the events")
+	appserviceRunCmd.Flags().String("listen", "", "Address to listen on (default the port of the registration's URL)")
+	appserviceRunCmd.Flags().Bool("moderation", false, "Also archive invites, knocks, kicks and bans with their reasons")
+	appserviceRunCmd.Flags().StringSlice("allow-senders", nil, "Only archive messages from senders matching these patterns, e.g. '@*:example.org' (or $MATRIX_ARCHIVE_ALLOW_SENDERS)")
+	appserviceRunCmd.Flags().StringSlice("deny-senders", nil, "Don't archive messages from senders matching these patterns, e.g. '@*bot:*' (or $MATRIX_ARCHIVE_DENY_SENDERS)")
+	appserviceRunCmd.Flags().String("attribution-rules", "", "YAML file of rules crediting bot- and webhook-relayed messages to their real authors (or $MATRIX_ARCHIVE_ATTRIBUTION_RULES)")
+	publishCmd.Flags().String("config", "", "YAML file of privacy controls and the upload command")
+	publishCmd.Flags().String("room-id", "", "Publish only this room (optional, publishes every archived room if not specified)")
+	publishCmd.Flags().Bool("include-dms", false, "Also publish direct chats")
+	publishCmd.Flags().StringSlice("anonymize", nil, "Replace senders matching these patterns with pseudonyms, e.g. '@*:bridge.example.org'")
+	publishCmd.Flags().StringSlice("strip-media", nil, "Remove media of these MIME types, e.g. 'video/*'")
+	publishCmd.Flags().StringSlice("opt-out", nil, "Withhold messages from these users")
+	publishCmd.Flags().String("upload", "", "Command to run on the site once it is written, with {dir} for its directory")
+	publishCmd.Flags().String("mapping-file", "", "Write the pseudonyms of anonymized senders and who they stand for to this file, outside the site")
+	publishCmd.Flags().String("mapping-password", "", "Encrypt the mapping file with this password (or $MATRIX_ARCHIVE_MAPPING_PASSWORD)")
+	publishMappingCmd.Flags().String("password", "", "Password of an encrypted mapping file (or $MATRIX_ARCHIVE_MAPPING_PASSWORD)")
+	publishCmd.Flags().String("lang", archive.DefaultLanguage, "Language for template strings (en, de, fr, es)")
+	publishCmd.Flags().String("template", "", "Template name (default, enhanced, accessible) or path to a template file")
+	publishCmd.Flags().String("theme", archive.ThemeLight, "HTML color theme: light, dark or auto")
+	publishCmd.Flags().String("media-links", "", "What media links point to: local, download, s3 or data (or $MATRIX_ARCHIVE_MEDIA_LINKS)")
+	publishCmd.Flags().String("media-base-url", "", "URL the media directories are published under, for --media-links s3 (or $MATRIX_ARCHIVE_MEDIA_BASE_URL)")
+	publishCmd.Flags().Bool("search-index", false, "Give the front page and each room page a search box that works offline")
+	publishCmd.Flags().Bool("permalinks", true, "Link each message to the live event in a Matrix client")
+	publishCmd.Flags().String("permalink-base", archive.DefaultPermalinkBase, "URL prefix for permalinks")
+
+	for _, cmd := range []*cobra.Command{importCmd, watchCmd, importFileCmd, appserviceRunCmd, migrateFromMongoCmd} {
+		cmd.Flags().Bool("respect-opt-outs", false, "Skip messages from everyone in the opt-out registry (or $"+archive.RespectOptOutsEnv+")")
+	}
+	optOutAddCmd.Flags().String("reason", "", "Why or how the person opted out, for the record")
+	usersMergeCmd.Flags().String("as", "", "Person ID to merge the user IDs into, e.g. alice (defaults to the first user ID's person)")
+
+	for _, cmd := range []*cobra.Command{importCmd, watchCmd, importFileCmd, failedRetryCmd, appserviceRunCmd, migrateFromMongoCmd} {
+		cmd.Flags().Bool("strict", false, "Also quarantine messages with malformed event IDs, content over 64 KiB or timestamps before 2014")
+		cmd.Flags().Bool("lenient", false, "Only quarantine messages with missing or malformed room, event or sender IDs")
+	}
+
+	exportCmd.PersistentFlags().String("room-id", "", "Export from a specific room (optional)")
+	exportCmd.PersistentFlags().Bool("local-images", true, "Use local image paths instead of Matrix URLs")
+	exportCmd.PersistentFlags().String("media-links", "", "What media links point to: local, download, s3 or data (default from --local-images, or $MATRIX_ARCHIVE_MEDIA_LINKS)")
+	exportCmd.PersistentFlags().String("media-base-url", "", "URL the media directories are published under, for --media-links s3 (or $MATRIX_ARCHIVE_MEDIA_BASE_URL)")
+	exportCmd.PersistentFlags().String("lang", archive.DefaultLanguage, "Language for template strings (en, de, fr, es)")
+	exportCmd.PersistentFlags().String("template", "", "Template name (default, enhanced, accessible) or path to a template file")
+	exportCmd.PersistentFlags().Bool("high-contrast", false, "Use a high-contrast palette (accessible template)")
+	exportCmd.PersistentFlags().String("theme", archive.ThemeLight, "HTML color theme: light, dark or auto")
+	exportCmd.Flags().String("format", "", "Export format, overriding the file extension (html, txt, json, yaml, ndjson, api)")
+	exportCmd.Flags().StringSlice("formats", nil, "Write several formats from one pass, e.g. html,json,txt; the filename becomes a base name")
+	exportCmd.Flags().Int("page-size", archive.DefaultAPIPageSize, "Messages per page file for --format api")
+	exportCmd.Flags().Int("lazy-load", archive.DefaultLazyLoad, "HTML exports of more messages show the first month and load later months as they're scrolled to (0 = one page)")
+	exportCmd.Flags().Bool("annotations", false, "Include curator notes (footnotes in HTML/text, a field in JSON/YAML)")
+	exportCmd.Flags().Bool("search-index", false, "Give HTML exports a search box, searching an index written next to the page, that works offline")
+	exportCmd.Flags().Bool("inline-players", false, "Play audio and video fetched by 'media download --audio-video' in HTML exports instead of linking to it")
+	exportCmd.Flags().Bool("show-platform-handles", false, "Name bridged senders by the phone number or username their bridge reported, with their platform")
+	exportCmd.Flags().Bool("verifications", false, "Include the results of 'verify' for each checked message (a field in JSON/YAML)")
+	exportCmd.Flags().Bool("if-changed", false, "Skip the export when messages, template and options are unchanged since the last export to this file")
+	exportCmd.Flags().String("message-lang", "", "Export only messages in this language, e.g. de (see import --detect-language)")
+	exportCmd.Flags().Bool("dedupe", false, "Drop messages that repeat an earlier message's sender, time and normalized content, e.g. history re-bridged under new event IDs")
+	exportCmd.Flags().Bool("conversations", false, "Split messages into conversations by time gaps and replies, with separators between them")
+	exportCmd.Flags().Duration("conversation-gap", archive.DefaultConversationGap, "Silence after which a message that isn't a reply starts a new conversation")
+	exportCmd.Flags().Int("conversation", 0, "Export only this conversation, numbered from 1 (implies --conversations)")
+	exportCmd.Flags().Bool("all-rooms", false, "Export every archived room into the directory given as the filename, one file per room")
+	exportCmd.Flags().Bool("zip", false, "Package the export and the downloaded media it links to into a .zip")
+	exportCmd.Flags().String("password", "", "Encrypt the --zip archive with AES-256 using this password (or $MATRIX_ARCHIVE_ZIP_PASSWORD)")
+	exportCmd.Flags().String("report", "", "Write a JSON completeness report for the export to this file")
+	exportCmd.Flags().String("reactions", "", "Also write every reaction in time order (who reacted with what, when, to which message) to this .json or .csv file")
+	exportCmd.Flags().Bool("stats", false, "Also write summary statistics of the run (counts, senders, date range, decrypt failures, media, duration) to <name>.stats.json")
+	exportCmd.PersistentFlags().Bool("wrap", false, "Wrap text export lines to --width columns, indenting continuation lines")
+	exportCmd.PersistentFlags().Int("width", archive.DefaultWrapWidth, "Columns to wrap text export lines to (implies --wrap)")
+	exportCmd.PersistentFlags().String("css", "", "Path to a CSS file appended to the HTML template's styles")
+	exportCmd.PersistentFlags().Bool("permalinks", true, "Link each message to the live event in a Matrix client")
+	exportCmd.PersistentFlags().String("permalink-base", archive.DefaultPermalinkBase, "URL prefix for permalinks, e.g. a self-hosted client's https://chat.example.org/#/room/")
+	exportCmd.PersistentFlags().Bool("participants", false, "Add a participants section with message counts, platforms and join/leave dates")
+	exportCmd.PersistentFlags().Bool("historical-names", false, "Label messages with the display name the sender had at the time instead of their current name")
+	exportHighlightsCmd.Flags().Int("context", archive.DefaultHighlightContext, "Messages to include before and after each highlight")
+	exportSampleCmd.Flags().Int("per-day", archive.DefaultSamplePerDay, "Messages to keep from each room on each day")
+	exportSampleCmd.Flags().Int64("seed", 0, "Seed for picking messages; the same seed picks the same sample")
+	exportGDPRCmd.Flags().String("user", "", "Matrix user ID to export, e.g. @alice:example.org, or the ID of a merged person")
+	exportGDPRCmd.Flags().StringSlice("media-dir", []string{"images", "thumbnails"}, "Directories searched for downloaded copies of the user's media")
+	contextCmd.Flags().Int("before", archive.DefaultEventContext, "Messages to show before the event")
+	contextCmd.Flags().Int("after", archive.DefaultEventContext, "Messages to show after the event")
+	contextCmd.Flags().String("lang", archive.DefaultLanguage, "Language for template strings (en, de, fr, es)")
+	contextCmd.Flags().String("template", "", "Template name (default, enhanced, accessible) or path to a template file")
+	templatesPreviewCmd.Flags().String("room", "", "Room ID or name to take the sample from (defaults to the first archived room)")
+	templatesPreviewCmd.Flags().Int("sample", archive.DefaultPreviewSample, "Messages to render, the room's most recent")
+	templatesPreviewCmd.Flags().Bool("open", false, "Open the preview in the browser")
+	templatesPreviewCmd.Flags().String("lang", archive.DefaultLanguage, "Language for template strings (en, de, fr, es)")
+	templatesPreviewCmd.Flags().String("theme", archive.ThemeLight, "HTML color theme: light, dark or auto")
+	templatesPreviewCmd.Flags().String("css", "", "Path to a CSS file appended to the HTML template's styles")
+	templatesPreviewCmd.Flags().String("media-links", "", "What media links point to: local, download, s3 or data (default data)")
+	initCmd.Flags().String("beeper-domain", "beeper.com", "Beeper domain to log in to (default $BEEPER_DOMAIN or beeper.com)")
+	initCmd.Flags().String("media-dir", ".", "Directory to create the thumbnails and images directories in")
+	initCmd.Flags().String("layout", archive.MediaLayoutFlat, "Media layout: flat, or hashed for content-addressed subdirectories with an index")
+	initCmd.Flags().Bool("login", false, "Log in to Beeper once everything is set up")
+	initCmd.Flags().Bool("force", false, "Replace an existing configuration file with different settings")
+	initCmd.Flags().BoolP("yes", "y", false, "Don't ask; use the flags' values")
 	downloadImagesCmd.Flags().Bool("thumbnails", true, "Download thumbnails instead of full images")
+	downloadImagesCmd.Flags().String("layout", "", "Media layout: flat, or hashed for content-addressed subdirectories with an index (default: the directory's current layout, else flat)")
+	mediaDownloadCmd.Flags().String("max-total-size", "", "Stop downloading once media takes up this much space, e.g. 500MB or 5GB (default no limit)")
+	mediaDownloadCmd.Flags().String("max-bandwidth", "", "Download at most this fast, e.g. 500KB/s or 5MB/s (default no limit)")
+	mediaDownloadCmd.Flags().StringSlice("include-mime", nil, "Only download media of these MIME types, e.g. 'image/*' or image/png,image/jpeg")
+	mediaDownloadCmd.Flags().String("max-size", "", "Skip files larger than this, e.g. 50MB")
+	mediaDownloadCmd.Flags().Bool("audio-video", false, "Also download audio and video files to <output-dir>/recordings, and video posters, for export --inline-players")
+	mediaDownloadCmd.Flags().String("since", "", "Only download media posted on or after this date (YYYY-MM-DD)")
+	mediaDownloadCmd.Flags().String("layout", "", "Media layout: flat, or hashed for content-addressed subdirectories with an index (default: the directory's current layout, else flat)")
+	emotesDownloadCmd.Flags().String("layout", "", "Media layout: flat, or hashed for content-addressed subdirectories with an index (default: the directory's current layout, else flat)")
+	mediaFindCmd.Flags().StringSlice("media-dir", []string{"images", "thumbnails"}, "Directories searched for downloaded media")
+	ocrCmd.Flags().Bool("thumbnails", true, "Read thumbnails instead of full images, matching download-images")
+	ocrCmd.Flags().String("command", "", "OCR command; {file} is replaced with the image path (default $"+archive.OCRCommandEnv+" or \""+archive.DefaultOCRCommand+"\")")
+	searchCmd.Flags().String("room-id", "", "Only search this room")
+	searchCmd.Flags().String("lang", "", "Only find messages in this language, e.g. de")
 	beeperLoginCmd.Flags().String("domain", "beeper.com", "Beeper domain to authenticate with")
 	beeperLogoutCmd.Flags().String("domain", "beeper.com", "Beeper domain to clear credentials for")
+	authLoginCmd.Flags().String("domain", "beeper.com", "Beeper domain to authenticate with")
+	authLoginCmd.Flags().String("token", "", "Beeper API token to log in with instead of email (- reads it from standard input)")
+	authLoginCmd.Flags().String("matrix-token", "", "Matrix access token to log in with instead of email (- reads it from standard input)")
+	authLoginCmd.Flags().String("user-id", "", "Matrix user ID the --matrix-token belongs to, such as @alice:beeper.com")
+	authLoginCmd.Flags().Bool("new-device", false, "Log in as a new device with a random ID instead of MATRIXARCH")
+	authLogoutCmd.Flags().String("domain", "beeper.com", "Beeper domain to clear credentials for")
+	authDevicesListCmd.Flags().String("domain", "beeper.com", "Beeper domain of the account")
+	authDevicesLogoutCmd.Flags().String("domain", "beeper.com", "Beeper domain of the account")
+	dbBackupCmd.Flags().String("dir", "backups", "Directory to write backups to")
+	dbSearchSettingsCmd.Flags().String("language", "", "Language of the archive's messages, e.g. de or sv (\"\" for none)")
+	dbSearchSettingsCmd.Flags().Bool("fold-diacritics", false, "Match letters with and without accents (--fold-diacritics=false to stop)")
+	dbBackupCmd.Flags().Int("keep", archive.DefaultBackupKeep, "Newest backups to keep; older ones are deleted (0 = all)")
+	dbMergeCmd.Flags().String("on-conflict", archive.MergeKeepExisting, "How to resolve messages with the same event ID but different content: keep or replace")
+	annotateCmd.Flags().String("author", os.Getenv("USER"), "Name recorded as the note's author")
+	bookmarkListCmd.Flags().String("room-id", "", "Only list bookmarks in this room")
+
+	sealCmd.Flags().String("room-id", "", "Room to seal, unseal or verify")
+	sealCmd.Flags().Bool("unseal", false, "Remove the room's seal so it can be imported again")
+	sealCmd.Flags().Bool("verify", false, "Check that the room still matches its seal")
+	verifyCmd.Flags().String("room-id", "", "Room whose latest messages to check (defaults to the first archived room)")
+	verifyCmd.Flags().StringSlice("event-id", nil, "Message to check (repeatable); overrides --room-id")
+	verifyCmd.Flags().Int("limit", 20, "How many of the room's latest messages to check (0 = all)")
+	diffCmd.Flags().String("room", "", "Only compare messages from this room ID")
+	analyticsCompareCmd.Flags().String("room", "", "Room ID or name to analyze (defaults to the first archived room)")
+	analyticsCompareCmd.Flags().String("period1", "", "First period: YYYY, YYYY-MM, YYYY-MM-DD or FROM..TO")
+	analyticsCompareCmd.Flags().String("period2", "", "Second period to compare with the first")
+	analyticsCompareCmd.Flags().String("html", "", "Also write the comparison as an HTML report to this file")
+	analyticsCompareCmd.MarkFlagRequired("period1")
+	analyticsCompareCmd.MarkFlagRequired("period2")
+	analyticsMentionsCmd.Flags().String("room", "", "Room ID or name to analyze (defaults to every archived room)")
+	analyticsMentionsCmd.Flags().Int("top", 10, "Rows to show in each table (0 = all)")
+	analyticsMentionsCmd.Flags().String("graph", "", "Write the mention network to this .dot, .gv or .json file")
+	analyticsWordsCmd.Flags().String("room", "", "Room ID or name to analyze (defaults to every archived room)")
+	analyticsLanguagesCmd.Flags().String("room", "", "Room ID or name to analyze (defaults to every archived room)")
+	analyticsWordsCmd.Flags().Int("top", 25, "Words to show (0 = all)")
+	analyticsWordsCmd.Flags().String("lang", "", "Analyze every room in this language: en, de, fr, es or none")
+	analyticsWordsCmd.Flags().String("analyzers", "", "YAML file choosing each room's language and extra stopwords (or $MATRIX_ARCHIVE_ANALYZERS)")
+	analyticsTimelineCmd.Flags().String("room", "", "Room ID or name to chart (defaults to the first archived room)")
+	digestCmd.Flags().String("room", "", "Room ID or name to digest")
+	digestCmd.Flags().String("period", archive.DigestWeek, "Period to digest: day, week or month")
+	digestCmd.Flags().String("date", "", "A day in the period to digest, YYYY-MM-DD (defaults to the last period to have ended)")
+	digestCmd.Flags().String("format", "", "Digest format: md, txt or json (defaults to filename's extension, else md)")
+	digestCmd.Flags().Int("top", archive.DefaultDigestTop, "Messages to pick")
+	digestCmd.MarkFlagRequired("room")
+	analyticsTimelineCmd.Flags().String("format", "", "Chart format: svg or html (defaults to FILE's extension)")
+	analyticsTimelineCmd.Flags().Bool("stacked", false, "Split each day's bar between the most active senders")
+	analyticsTimelineCmd.Flags().Int("senders", archive.DefaultTimelineSenders, "Senders to show separately with --stacked")
 	keyRecoveryCmd.Flags().String("recovery-key", "", "Matrix key backup recovery key (required)")
 	keyRecoveryCmd.Flags().String("room-id", "", "Specific room ID to decrypt messages for (optional)")
 }
+
+// fixedCompletions completes a flag from a fixed list of values
+func fixedCompletions(values ...string) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return values, cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+// completeArchivedRooms completes room IDs from rooms already in the archive
+// createsArchive holds the commands that may create the archive database if
+// it doesn't exist yet. Every other command reports a missing archive rather
+// than creating an empty one.
+var createsArchive = map[*cobra.Command]bool{
+	initCmd:             true,
+	listRoomsCmd:        true,
+	importCmd:           true,
+	importFileCmd:       true,
+	migrateFromMongoCmd: true,
+	watchCmd:            true,
+	tuiCmd:              true,
+	appserviceRunCmd:    true,
+	dbMergeCmd:          true,
+	optOutAddCmd:        true,
+	usersMergeCmd:       true,
+}
+
+func completeArchivedRooms(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	// Completion doesn't run the root command's PersistentPreRunE
+	dbPath, _ := cmd.Flags().GetString("db")
+	archive.SetDatabasePath(dbPath)
+	archive.SetCreateDatabase(false)
+	rooms, err := archive.ArchivedRooms()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	return rooms, cobra.ShellCompDirectiveNoFileComp
+}
+
+// registerCompletions adds shell completion for flag values and arguments.
+// The completion command itself is generated by cobra (matrix-archive completion bash|zsh|fish|powershell).
+func registerCompletions() {
+	exportCmd.ValidArgsFunction = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return archive.ExportExtensions(), cobra.ShellCompDirectiveFilterFileExt
+	}
+	exportCmd.RegisterFlagCompletionFunc("room-id", completeArchivedRooms)
+	exportCmd.RegisterFlagCompletionFunc("lang", fixedCompletions("en", "de", "fr", "es"))
+	exportCmd.RegisterFlagCompletionFunc("template", fixedCompletions("default", "enhanced", "accessible"))
+	exportCmd.RegisterFlagCompletionFunc("message-lang", fixedCompletions(archive.DetectedLanguages()...))
+	contextCmd.RegisterFlagCompletionFunc("lang", fixedCompletions("en", "de", "fr", "es"))
+	contextCmd.RegisterFlagCompletionFunc("template", fixedCompletions("default", "enhanced", "accessible"))
+	exportCmd.RegisterFlagCompletionFunc("format", fixedCompletions(append(archive.ExportFormats(), archive.FormatStaticAPI)...))
+	exportCmd.RegisterFlagCompletionFunc("formats", fixedCompletions(archive.ExportFormats()...))
+	exportCmd.RegisterFlagCompletionFunc("media-links", fixedCompletions(archive.MediaLinksLocal, archive.MediaLinksDownload, archive.MediaLinksS3, archive.MediaLinksDataURI))
+	exportCmd.RegisterFlagCompletionFunc("theme", fixedCompletions(archive.ThemeLight, archive.ThemeDark, archive.ThemeAuto))
+	exportCmd.RegisterFlagCompletionFunc("reactions", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"json", "csv"}, cobra.ShellCompDirectiveFilterFileExt
+	})
+	exportCmd.RegisterFlagCompletionFunc("css", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"css"}, cobra.ShellCompDirectiveFilterFileExt
+	})
+	exportHighlightsCmd.ValidArgsFunction = exportCmd.ValidArgsFunction
+	exportSampleCmd.ValidArgsFunction = exportCmd.ValidArgsFunction
+	exportThreadCmd.ValidArgsFunction = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) == 1 {
+			return exportCmd.ValidArgsFunction(cmd, args, toComplete)
+		}
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	exportModerationLogCmd.ValidArgsFunction = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"txt", "json", "yaml"}, cobra.ShellCompDirectiveFilterFileExt
+	}
+	listRoomsCmd.RegisterFlagCompletionFunc("sort", fixedCompletions(archive.SortRoomsByName, archive.SortRoomsByMessages, archive.SortRoomsByLast, archive.SortRoomsByNetwork, archive.SortRoomsByEncrypted))
+	importCmd.RegisterFlagCompletionFunc("room-id", completeArchivedRooms)
+	watchCmd.RegisterFlagCompletionFunc("room-id", completeArchivedRooms)
+	importCmd.RegisterFlagCompletionFunc("oversize", fixedCompletions(archive.OversizeTruncate, archive.OversizeExternal))
+	watchCmd.RegisterFlagCompletionFunc("oversize", fixedCompletions(archive.OversizeTruncate, archive.OversizeExternal))
+	completeYAML := func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"yaml", "yml"}, cobra.ShellCompDirectiveFilterFileExt
+	}
+	importCmd.RegisterFlagCompletionFunc("attribution-rules", completeYAML)
+	importFileCmd.ValidArgsFunction = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"jsonl"}, cobra.ShellCompDirectiveFilterFileExt
+	}
+	watchCmd.RegisterFlagCompletionFunc("attribution-rules", completeYAML)
+	appserviceRunCmd.RegisterFlagCompletionFunc("attribution-rules", completeYAML)
+	appserviceRunCmd.RegisterFlagCompletionFunc("registration", completeYAML)
+	bookmarkListCmd.RegisterFlagCompletionFunc("room-id", completeArchivedRooms)
+	sealCmd.RegisterFlagCompletionFunc("room-id", completeArchivedRooms)
+	verifyCmd.RegisterFlagCompletionFunc("room-id", completeArchivedRooms)
+	failedCmd.RegisterFlagCompletionFunc("room-id", completeArchivedRooms)
+	restoreCmd.RegisterFlagCompletionFunc("room-id", completeArchivedRooms)
+	restoreCmd.RegisterFlagCompletionFunc("user-map", completeYAML)
+	analyticsCompareCmd.RegisterFlagCompletionFunc("room", completeArchivedRooms)
+	analyticsCompareCmd.RegisterFlagCompletionFunc("html", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"html"}, cobra.ShellCompDirectiveFilterFileExt
+	})
+	analyticsMentionsCmd.RegisterFlagCompletionFunc("room", completeArchivedRooms)
+	analyticsMentionsCmd.RegisterFlagCompletionFunc("graph", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"dot", "gv", "json"}, cobra.ShellCompDirectiveFilterFileExt
+	})
+	analyticsTimelineCmd.RegisterFlagCompletionFunc("room", completeArchivedRooms)
+	templatesPreviewCmd.RegisterFlagCompletionFunc("room", completeArchivedRooms)
+	templatesPreviewCmd.RegisterFlagCompletionFunc("lang", fixedCompletions("en", "de", "fr", "es"))
+	templatesPreviewCmd.RegisterFlagCompletionFunc("theme", fixedCompletions(archive.ThemeLight, archive.ThemeDark, archive.ThemeAuto))
+	templatesPreviewCmd.RegisterFlagCompletionFunc("media-links", fixedCompletions(archive.MediaLinksLocal, archive.MediaLinksDownload, archive.MediaLinksS3, archive.MediaLinksDataURI))
+	templatesPreviewCmd.ValidArgsFunction = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"tpl"}, cobra.ShellCompDirectiveFilterFileExt
+	}
+	initCmd.RegisterFlagCompletionFunc("layout", fixedCompletions(archive.MediaLayoutFlat, archive.MediaLayoutHashed))
+	initCmd.RegisterFlagCompletionFunc("media-dir", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return nil, cobra.ShellCompDirectiveFilterDirs
+	})
+	analyticsWordsCmd.RegisterFlagCompletionFunc("room", completeArchivedRooms)
+	analyticsWordsCmd.RegisterFlagCompletionFunc("lang", fixedCompletions(archive.AnalyzerLanguages()...))
+	analyticsWordsCmd.RegisterFlagCompletionFunc("analyzers", completeYAML)
+	analyticsLanguagesCmd.RegisterFlagCompletionFunc("room", completeArchivedRooms)
+	analyticsTimelineCmd.RegisterFlagCompletionFunc("format", fixedCompletions(archive.TimelineSVG, archive.TimelineHTML))
+	digestCmd.RegisterFlagCompletionFunc("room", completeArchivedRooms)
+	digestCmd.RegisterFlagCompletionFunc("period", fixedCompletions(archive.DigestDay, archive.DigestWeek, archive.DigestMonth))
+	digestCmd.RegisterFlagCompletionFunc("format", fixedCompletions(archive.DigestMarkdown, archive.DigestText, archive.DigestJSON))
+	analyticsTimelineCmd.ValidArgsFunction = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"svg", "html"}, cobra.ShellCompDirectiveFilterFileExt
+	}
+	publishCmd.RegisterFlagCompletionFunc("config", completeYAML)
+	publishCmd.RegisterFlagCompletionFunc("room-id", completeArchivedRooms)
+	publishCmd.RegisterFlagCompletionFunc("media-links", fixedCompletions(archive.MediaLinksLocal, archive.MediaLinksDownload, archive.MediaLinksS3, archive.MediaLinksDataURI))
+	publishCmd.ValidArgsFunction = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return nil, cobra.ShellCompDirectiveFilterDirs
+	}
+	completeDirs := func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return nil, cobra.ShellCompDirectiveFilterDirs
+	}
+	dbBackupCmd.RegisterFlagCompletionFunc("dir", completeDirs)
+	watchCmd.RegisterFlagCompletionFunc("backup-dir", completeDirs)
+	dbMergeCmd.RegisterFlagCompletionFunc("on-conflict", fixedCompletions(archive.MergeKeepExisting, archive.MergeReplace))
+	dbMergeCmd.ValidArgsFunction = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"duckdb"}, cobra.ShellCompDirectiveFilterFileExt
+	}
+	diffCmd.ValidArgsFunction = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"duckdb"}, cobra.ShellCompDirectiveFilterFileExt
+	}
+	keyRecoveryCmd.RegisterFlagCompletionFunc("room-id", completeArchivedRooms)
+	downloadImagesCmd.ValidArgsFunction = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return nil, cobra.ShellCompDirectiveFilterDirs
+	}
+	ocrCmd.ValidArgsFunction = downloadImagesCmd.ValidArgsFunction
+	downloadImagesCmd.RegisterFlagCompletionFunc("layout", fixedCompletions(archive.MediaLayoutFlat, archive.MediaLayoutHashed))
+	mediaDownloadCmd.RegisterFlagCompletionFunc("layout", fixedCompletions(archive.MediaLayoutFlat, archive.MediaLayoutHashed))
+	emotesDownloadCmd.RegisterFlagCompletionFunc("layout", fixedCompletions(archive.MediaLayoutFlat, archive.MediaLayoutHashed))
+	mediaDownloadCmd.ValidArgsFunction = downloadImagesCmd.ValidArgsFunction
+	searchCmd.RegisterFlagCompletionFunc("room-id", completeArchivedRooms)
+	searchCmd.RegisterFlagCompletionFunc("lang", fixedCompletions(archive.DetectedLanguages()...))
+}
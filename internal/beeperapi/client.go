@@ -179,18 +179,30 @@ type MatrixLoginResponse struct {
 
 // MatrixJWTLoginRequest represents the JWT login request to Matrix
 type MatrixJWTLoginRequest struct {
-	Type  string `json:"type"`
-	Token string `json:"token"`
+	Type                     string `json:"type"`
+	Token                    string `json:"token"`
+	DeviceID                 string `json:"device_id,omitempty"`
+	InitialDeviceDisplayName string `json:"initial_device_display_name,omitempty"`
 }
 
 // GetMatrixTokenFromJWT gets a Matrix access token using the Beeper JWT token
 func GetMatrixTokenFromJWT(jwtToken string) (*MatrixLoginResponse, error) {
+	return GetMatrixTokenFromJWTForDevice(jwtToken, "", "")
+}
+
+// GetMatrixTokenFromJWTForDevice gets a Matrix access token for a device
+// using the Beeper JWT token. Logging in with the ID of an existing device
+// reuses it instead of adding a device to the account; a new device is named
+// displayName. Without a device ID the server creates a new device.
+func GetMatrixTokenFromJWTForDevice(jwtToken, deviceID, displayName string) (*MatrixLoginResponse, error) {
 	// Matrix login endpoint for Beeper
 	url := "https://matrix.beeper.com/_matrix/client/v3/login"
 
 	loginReq := MatrixJWTLoginRequest{
-		Type:  "org.matrix.login.jwt",
-		Token: jwtToken,
+		Type:                     "org.matrix.login.jwt",
+		Token:                    jwtToken,
+		DeviceID:                 deviceID,
+		InitialDeviceDisplayName: displayName,
 	}
 
 	// Encode the request
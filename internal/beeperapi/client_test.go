@@ -1,6 +1,7 @@
 package beeperapi
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -88,3 +89,14 @@ func TestGetMatrixTokenFromJWT_EmptyToken(t *testing.T) {
 	_, err := GetMatrixTokenFromJWT("")
 	assert.Error(t, err)
 }
+
+func TestMatrixJWTLoginRequest_Device(t *testing.T) {
+	data, err := json.Marshal(MatrixJWTLoginRequest{Type: "org.matrix.login.jwt", Token: "jwt"})
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "device_id")
+
+	data, err = json.Marshal(MatrixJWTLoginRequest{Type: "org.matrix.login.jwt", Token: "jwt", DeviceID: "MATRIXARCH", InitialDeviceDisplayName: "matrix-archive"})
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"device_id":"MATRIXARCH"`)
+	assert.Contains(t, string(data), `"initial_device_display_name":"matrix-archive"`)
+}
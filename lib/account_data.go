@@ -0,0 +1,115 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// RoomOrganization is how the archiving user organised a room in their
+// client: its tags, and whether it is a direct chat and with whom
+type RoomOrganization struct {
+	RoomID     string   `json:"room_id" yaml:"room_id"`
+	Tags       []string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Direct     bool     `json:"direct,omitempty" yaml:"direct,omitempty"`
+	DirectWith []string `json:"direct_with,omitempty" yaml:"direct_with,omitempty"`
+}
+
+// Labels returns the room's tags and direct chat status as template string
+// keys (room.favourite, room.low_priority, room.direct) or, for the user's
+// own tags, the tag name without its u. prefix
+func (r *RoomOrganization) Labels() []string {
+	if r == nil {
+		return nil
+	}
+	var labels []string
+	if r.Direct {
+		labels = append(labels, "room.direct")
+	}
+	for _, tag := range r.Tags {
+		switch tag {
+		case string(event.RoomTagFavourite):
+			labels = append(labels, "room.favourite")
+		case string(event.RoomTagLowPriority):
+			labels = append(labels, "room.low_priority")
+		default:
+			if name, ok := strings.CutPrefix(tag, "u."); ok && name != "" {
+				labels = append(labels, name)
+			}
+		}
+	}
+	return labels
+}
+
+// GetRoomOrganization reads a room's archived tags and direct chat status.
+// It returns nil if the archive has no account data for the room.
+func GetRoomOrganization(ctx context.Context, db DatabaseInterface, roomID string) (*RoomOrganization, error) {
+	tags, err := db.GetRoomTags(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	direct, err := db.GetDirectRooms(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	room := &RoomOrganization{RoomID: roomID}
+	for _, tag := range tags {
+		room.Tags = append(room.Tags, tag.Tag)
+	}
+	for userID, roomIDs := range direct {
+		for _, directRoomID := range roomIDs {
+			if directRoomID == roomID {
+				room.Direct = true
+				room.DirectWith = append(room.DirectWith, userID)
+			}
+		}
+	}
+	sort.Strings(room.DirectWith)
+
+	if len(room.Tags) == 0 && !room.Direct {
+		return nil, nil
+	}
+	return room, nil
+}
+
+// archiveDirectRooms stores the user's m.direct account data
+func (e *EnhancedMatrixClient) archiveDirectRooms(ctx context.Context) error {
+	var content event.DirectChatsEventContent
+	err := e.GetAccountData(ctx, event.AccountDataDirectChats.Type, &content)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return err
+	}
+
+	// A user who never had a direct chat has no m.direct; store that as none
+	direct := make(map[string][]string, len(content))
+	for userID, roomIDs := range content {
+		for _, roomID := range roomIDs {
+			direct[userID.String()] = append(direct[userID.String()], roomID.String())
+		}
+	}
+	return e.db.SetDirectRooms(ctx, direct)
+}
+
+// archiveRoomTags stores the tags the user gave a room
+func (e *EnhancedMatrixClient) archiveRoomTags(ctx context.Context, roomID id.RoomID) error {
+	content, err := e.GetTags(ctx, roomID)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return err
+	}
+
+	tags := make([]*RoomTag, 0, len(content.Tags))
+	for tag, metadata := range content.Tags {
+		roomTag := &RoomTag{RoomID: roomID.String(), Tag: string(tag)}
+		if order, err := metadata.Order.Float64(); err == nil {
+			roomTag.Order = &order
+		}
+		tags = append(tags, roomTag)
+	}
+	return e.db.SetRoomTags(ctx, roomID.String(), tags)
+}
@@ -0,0 +1,156 @@
+package archive
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"sort"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// BundledAggregations is the homeserver's summary of the relations to an
+// event, from the m.relations it bundled in the event's unsigned data when
+// the event was fetched. It gives reaction counts and edits even when the
+// reactions and edits themselves weren't archived, e.g. with
+// --exclude-event-types m.reaction or when exporting a few messages.
+type BundledAggregations struct {
+	Reactions     map[string]int `json:"reactions,omitempty"`      // Reaction key to the number of reactions with it
+	Edits         []string       `json:"edits,omitempty"`          // Event IDs of the edits the server listed
+	ThreadReplies int            `json:"thread_replies,omitempty"` // Replies in the thread the event starts
+}
+
+// NewBundledAggregations returns the aggregations of an event's bundled
+// relations, or nil if it has none
+func NewBundledAggregations(relations *event.Relations) *BundledAggregations {
+	if relations == nil {
+		return nil
+	}
+	agg := &BundledAggregations{Edits: relations.Replaces.List}
+	for key, count := range relations.Annotations.Map {
+		if count <= 0 {
+			continue
+		}
+		if agg.Reactions == nil {
+			agg.Reactions = make(map[string]int)
+		}
+		agg.Reactions[key] = count
+	}
+	if thread, ok := relations.Raw[event.RelThread]; ok {
+		agg.ThreadReplies = thread.Count
+	}
+	if len(agg.Reactions) == 0 && len(agg.Edits) == 0 && agg.ThreadReplies == 0 {
+		return nil
+	}
+	return agg
+}
+
+// aggregationsForStorage returns the message's bundled aggregations as
+// stored, or NULL in encrypted archives, where reaction keys would give away
+// content
+func (d *DuckDBDatabase) aggregationsForStorage(message *Message) sql.NullString {
+	if d.cipher != nil || message.Aggregations == nil {
+		return sql.NullString{}
+	}
+	data, err := json.Marshal(message.Aggregations)
+	if err != nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: string(data), Valid: true}
+}
+
+// decodeAggregations parses stored bundled aggregations; "" is none
+func decodeAggregations(data string) *BundledAggregations {
+	if data == "" {
+		return nil
+	}
+	agg := &BundledAggregations{}
+	if err := json.Unmarshal([]byte(data), agg); err != nil {
+		log.Printf("Warning: failed to parse bundled aggregations: %v", err)
+		return nil
+	}
+	return agg
+}
+
+// ApplyAggregations fills in the reactions and edits of exported messages.
+// The archived reactions and edits among messages are indexed by the event
+// they relate to in one pass; reactions give who reacted, and a message's
+// bundled aggregations raise the counts to the server's where fewer
+// reactions were archived, mark it edited even if its edits weren't, and
+// count the replies of the thread it starts.
+func ApplyAggregations(exported []ExportMessage, messages []*Message) {
+	type reactionKey struct{ target, key string }
+	reactions := make(map[reactionKey]*MessageReaction)
+	reactionKeys := make(map[string][]string)
+	edits := make(map[string][]EditInfo)
+	bundles := make(map[string]*BundledAggregations)
+
+	for _, msg := range messages {
+		if msg.Aggregations != nil {
+			bundles[msg.EventID] = msg.Aggregations
+		}
+		relatesTo, _ := msg.Content["m.relates_to"].(map[string]interface{})
+		target, _ := relatesTo["event_id"].(string)
+		if target == "" {
+			continue
+		}
+		switch relatesTo["rel_type"] {
+		case "m.annotation":
+			key, _ := relatesTo["key"].(string)
+			if key == "" {
+				continue
+			}
+			rk := reactionKey{target, key}
+			if reaction, ok := reactions[rk]; ok {
+				reaction.Users = append(reaction.Users, msg.Sender)
+				reaction.Count++
+				continue
+			}
+			reactions[rk] = &MessageReaction{Emoji: key, Users: []string{msg.Sender}, Count: 1, EventID: msg.EventID, Timestamp: msg.Timestamp, Shortcode: reactionShortcode(msg.Content)}
+			reactionKeys[target] = append(reactionKeys[target], key)
+		case "m.replace":
+			edit := EditInfo{EventID: msg.EventID, Timestamp: msg.Timestamp}
+			if newContent, ok := msg.Content["m.new_content"].(map[string]interface{}); ok {
+				edit.NewContent, _ = newContent["body"].(string)
+			} else {
+				edit.NewContent, _ = msg.Content["body"].(string)
+			}
+			edits[target] = append(edits[target], edit)
+		}
+	}
+
+	for i := range exported {
+		msg := &exported[i]
+		bundle := bundles[msg.EventID]
+		var result []MessageReaction
+		for _, key := range reactionKeys[msg.EventID] {
+			reaction := *reactions[reactionKey{msg.EventID, key}]
+			if bundle != nil && bundle.Reactions[key] > reaction.Count {
+				reaction.Count = bundle.Reactions[key]
+			}
+			result = append(result, reaction)
+		}
+		if bundle != nil {
+			for key, count := range bundle.Reactions {
+				if _, archived := reactions[reactionKey{msg.EventID, key}]; !archived {
+					result = append(result, MessageReaction{Emoji: key, Users: []string{}, Count: count})
+				}
+			}
+		}
+		sort.SliceStable(result, func(a, b int) bool {
+			if result[a].Count != result[b].Count {
+				return result[a].Count > result[b].Count
+			}
+			return result[a].Emoji < result[b].Emoji
+		})
+		msg.Reactions = result
+
+		history := edits[msg.EventID]
+		sort.SliceStable(history, func(a, b int) bool { return history[a].Timestamp.Before(history[b].Timestamp) })
+		msg.EditHistory = history
+		msg.IsEdited = len(history) > 0 || (bundle != nil && len(bundle.Edits) > 0)
+		if bundle != nil && bundle.ThreadReplies > 0 {
+			msg.ThreadInfo = &ThreadInfo{RootEventID: msg.EventID, ReplyCount: bundle.ThreadReplies, IsRoot: true}
+		}
+	}
+}
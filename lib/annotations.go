@@ -0,0 +1,128 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// ExportAnnotation is a curator note as it appears in exports. Number is the
+// note's footnote number, sequential across the export.
+type ExportAnnotation struct {
+	Number    int    `json:"number" yaml:"number"`
+	Note      string `json:"note" yaml:"note"`
+	Author    string `json:"author,omitempty" yaml:"author,omitempty"`
+	CreatedAt string `json:"created_at" yaml:"created_at"`
+}
+
+// AttachAnnotations adds notes to the exported messages they belong to and
+// numbers them in message order
+func AttachAnnotations(messages []ExportMessage, annotations []*Annotation) {
+	byEvent := make(map[string][]*Annotation)
+	for _, a := range annotations {
+		byEvent[a.EventID] = append(byEvent[a.EventID], a)
+	}
+
+	number := 0
+	for i := range messages {
+		for _, a := range byEvent[messages[i].EventID] {
+			number++
+			messages[i].Annotations = append(messages[i].Annotations, ExportAnnotation{
+				Number:    number,
+				Note:      a.Note,
+				Author:    a.Author,
+				CreatedAt: a.CreatedAt.Format(time.RFC3339),
+			})
+		}
+	}
+}
+
+// attachRoomAnnotations loads a room's notes and attaches them to its
+// exported messages. Further rooms, such as those an upgraded room replaced,
+// are numbered in the same sequence.
+func attachRoomAnnotations(ctx context.Context, roomID string, messages []ExportMessage, moreRoomIDs ...string) error {
+	var annotations []*Annotation
+	for _, roomID := range append([]string{roomID}, moreRoomIDs...) {
+		roomAnnotations, err := GetDatabase().GetRoomAnnotations(ctx, roomID)
+		if err != nil {
+			return fmt.Errorf("failed to load annotations: %w", err)
+		}
+		annotations = append(annotations, roomAnnotations...)
+	}
+	AttachAnnotations(messages, annotations)
+	return nil
+}
+
+// AnnotateMessage attaches a curator note to an archived message
+func AnnotateMessage(eventID, note, author string) error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	ctx := context.Background()
+	if _, err := GetDatabase().GetMessage(ctx, eventID); err != nil {
+		return fmt.Errorf("cannot annotate %s: %w", eventID, err)
+	}
+
+	annotation := &Annotation{EventID: eventID, Note: note, Author: author}
+	if err := GetDatabase().AddAnnotation(ctx, annotation); err != nil {
+		return err
+	}
+
+	fmt.Printf("Added note %d to %s\n", annotation.ID, eventID)
+	return nil
+}
+
+// ListAnnotations prints the notes for an event, or all notes if eventID is empty
+func ListAnnotations(eventID string) error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	annotations, err := GetDatabase().GetAnnotations(context.Background(), eventID)
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput() {
+		if annotations == nil {
+			annotations = []*Annotation{}
+		}
+		return writeJSON(annotations)
+	}
+
+	if len(annotations) == 0 {
+		fmt.Println("No annotations found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tEvent ID\tAuthor\tCreated\tNote")
+	fmt.Fprintln(w, "--\t--------\t------\t-------\t----")
+	for _, a := range annotations {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", a.ID, a.EventID, a.Author, a.CreatedAt.Format(time.RFC3339), a.Note)
+	}
+	return w.Flush()
+}
+
+// RemoveAnnotation deletes a curator note by ID
+func RemoveAnnotation(id int64) error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	if err := GetDatabase().DeleteAnnotation(context.Background(), id); err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed note %d\n", id)
+	return nil
+}
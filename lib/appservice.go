@@ -0,0 +1,389 @@
+package archive
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+// DefaultAppServiceSender is the localpart of the application service's own user
+const DefaultAppServiceSender = "archive"
+
+// AppServiceRegistration is the registration file a homeserver loads to send
+// an application service the events of the rooms in its namespaces
+type AppServiceRegistration struct {
+	ID              string               `yaml:"id" json:"id"`
+	URL             string               `yaml:"url" json:"url"`
+	AppToken        string               `yaml:"as_token" json:"as_token"`
+	ServerToken     string               `yaml:"hs_token" json:"hs_token"`
+	SenderLocalpart string               `yaml:"sender_localpart" json:"sender_localpart"`
+	RateLimited     bool                 `yaml:"rate_limited" json:"rate_limited"`
+	Namespaces      AppServiceNamespaces `yaml:"namespaces" json:"namespaces"`
+}
+
+// AppServiceNamespaces are the users, room aliases and room IDs an
+// application service is interested in
+type AppServiceNamespaces struct {
+	Users   []AppServiceNamespace `yaml:"users" json:"users"`
+	Aliases []AppServiceNamespace `yaml:"aliases" json:"aliases"`
+	Rooms   []AppServiceNamespace `yaml:"rooms" json:"rooms"`
+}
+
+// AppServiceNamespace is a regular expression of IDs in a namespace.
+// Archiving never claims IDs exclusively, so rooms stay usable by everyone.
+type AppServiceNamespace struct {
+	Regex     string `yaml:"regex" json:"regex"`
+	Exclusive bool   `yaml:"exclusive" json:"exclusive"`
+}
+
+// NewAppServiceRegistration creates a registration with new tokens for an
+// application service listening at serviceURL and archiving rooms. Each room
+// is a room ID (!room:example.org), an alias (#room:example.org) or a regular
+// expression of room IDs, such as ^!.*:example\.org$ for every room of a server.
+func NewAppServiceRegistration(serviceURL, senderLocalpart string, rooms []string) (*AppServiceRegistration, error) {
+	if _, err := url.ParseRequestURI(serviceURL); err != nil {
+		return nil, fmt.Errorf("invalid application service URL %s: %w", serviceURL, err)
+	}
+	if len(rooms) == 0 {
+		return nil, fmt.Errorf("an application service needs at least one room to archive")
+	}
+	if senderLocalpart == "" {
+		senderLocalpart = DefaultAppServiceSender
+	}
+
+	reg := &AppServiceRegistration{
+		ID:              "matrix-archive",
+		URL:             serviceURL,
+		SenderLocalpart: senderLocalpart,
+		Namespaces: AppServiceNamespaces{
+			Users:   []AppServiceNamespace{},
+			Aliases: []AppServiceNamespace{},
+			Rooms:   []AppServiceNamespace{},
+		},
+	}
+	for _, room := range rooms {
+		switch {
+		case strings.HasPrefix(room, "#"):
+			reg.Namespaces.Aliases = append(reg.Namespaces.Aliases, AppServiceNamespace{Regex: "^" + regexp.QuoteMeta(room) + "$"})
+		case strings.HasPrefix(room, "!"):
+			reg.Namespaces.Rooms = append(reg.Namespaces.Rooms, AppServiceNamespace{Regex: "^" + regexp.QuoteMeta(room) + "$"})
+		default:
+			if _, err := regexp.Compile(room); err != nil {
+				return nil, fmt.Errorf("invalid room pattern %s: %w", room, err)
+			}
+			reg.Namespaces.Rooms = append(reg.Namespaces.Rooms, AppServiceNamespace{Regex: room})
+		}
+	}
+
+	for _, token := range []*string{&reg.AppToken, &reg.ServerToken} {
+		var err error
+		if *token, err = randomToken(); err != nil {
+			return nil, err
+		}
+	}
+	return reg, nil
+}
+
+// randomToken returns 32 random bytes as hex
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// LoadAppServiceRegistration reads a registration file
+func LoadAppServiceRegistration(filename string) (*AppServiceRegistration, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registration: %w", err)
+	}
+	reg := &AppServiceRegistration{}
+	if err := yaml.Unmarshal(data, reg); err != nil {
+		return nil, fmt.Errorf("failed to parse registration in %s: %w", filename, err)
+	}
+	if reg.AppToken == "" || reg.ServerToken == "" {
+		return nil, fmt.Errorf("%s has no as_token or hs_token", filename)
+	}
+	return reg, nil
+}
+
+// Save writes the registration, readable only by its owner since it holds the tokens
+func (reg *AppServiceRegistration) Save(filename string) error {
+	data, err := yaml.Marshal(reg)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filename, data, 0600); err != nil {
+		return fmt.Errorf("failed to write registration: %w", err)
+	}
+	return nil
+}
+
+// GenerateAppServiceRegistration writes a new registration to filename, for
+// the homeserver's administrator to add to its configuration
+func GenerateAppServiceRegistration(filename, serviceURL, senderLocalpart string, rooms []string) error {
+	if _, err := os.Stat(filename); err == nil {
+		return fmt.Errorf("%s already exists; remove it to generate new tokens", filename)
+	}
+	reg, err := NewAppServiceRegistration(serviceURL, senderLocalpart, rooms)
+	if err != nil {
+		return err
+	}
+	if err := reg.Save(filename); err != nil {
+		return err
+	}
+	fmt.Printf("✓ Wrote %s; add it to the homeserver's app service configuration and restart it\n", filename)
+	return nil
+}
+
+// AppServiceOptions configure archiving as an application service
+type AppServiceOptions struct {
+	Registration string // Registration file, as generated by GenerateAppServiceRegistration
+	Homeserver   string // Base URL of the homeserver that sends the events
+	Listen       string // Address to listen on; empty uses the registration's URL
+	Moderation   bool   // Also archive invites, knocks, kicks and bans with their reasons
+
+	Senders    SenderFilter // Whose messages to archive; empty uses the patterns in the environment
+	Validation string       // Validation mode; messages that fail are quarantined
+
+	// YAML file of rules attributing relayed messages to their real authors;
+	// empty uses the file named by MATRIX_ARCHIVE_ATTRIBUTION_RULES
+	AttributionRules string
+}
+
+// AppServiceHandler receives the transactions of events a homeserver pushes
+// to an application service and archives them
+type AppServiceHandler struct {
+	reg      *AppServiceRegistration
+	enhanced *EnhancedMatrixClient
+
+	mu       sync.Mutex
+	sealed   map[string]bool // Sealed rooms, whose events aren't archived
+	archived int
+}
+
+// NewAppServiceHandler returns a handler that archives the events sent to
+// the application service reg registers through enhanced
+func NewAppServiceHandler(reg *AppServiceRegistration, enhanced *EnhancedMatrixClient, sealed map[string]bool) *AppServiceHandler {
+	if sealed == nil {
+		sealed = make(map[string]bool)
+	}
+	return &AppServiceHandler{reg: reg, enhanced: enhanced, sealed: sealed}
+}
+
+// appServiceTransaction is the body of a transaction a homeserver sends
+type appServiceTransaction struct {
+	Events []*event.Event `json:"events"`
+}
+
+// ServeHTTP implements the application service API. Users and room aliases
+// aren't provided, since archiving doesn't create any.
+func (h *AppServiceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/_matrix/app/v1")
+	if !h.authorized(w, r) {
+		return
+	}
+	switch {
+	case strings.HasPrefix(path, "/transactions/") && r.Method == http.MethodPut:
+		h.handleTransaction(w, r)
+	case path == "/ping" && r.Method == http.MethodPost:
+		writeAppServiceResponse(w, http.StatusOK, map[string]string{})
+	case strings.HasPrefix(path, "/users/"), strings.HasPrefix(path, "/rooms/"):
+		writeAppServiceResponse(w, http.StatusNotFound, mautrix.RespError{ErrCode: "M_NOT_FOUND", Err: "Not provided by this application service"})
+	default:
+		writeAppServiceResponse(w, http.StatusNotFound, mautrix.RespError{ErrCode: "M_UNRECOGNIZED", Err: "Unrecognized request"})
+	}
+}
+
+// authorized checks that a request comes from the homeserver, which proves
+// it with the hs_token, and responds with an error if not
+func (h *AppServiceHandler) authorized(w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		// Homeservers before Matrix 1.4 send the token as a query parameter
+		token = r.URL.Query().Get("access_token")
+	}
+	switch {
+	case token == "":
+		writeAppServiceResponse(w, http.StatusUnauthorized, mautrix.RespError{ErrCode: "M_UNAUTHORIZED", Err: "Missing token"})
+		return false
+	case subtle.ConstantTimeCompare([]byte(token), []byte(h.reg.ServerToken)) != 1:
+		writeAppServiceResponse(w, http.StatusForbidden, mautrix.RespError{ErrCode: "M_FORBIDDEN", Err: "Invalid token"})
+		return false
+	}
+	return true
+}
+
+// handleTransaction archives the events in a transaction. Storing is
+// idempotent, so a transaction the homeserver sends again after a failure is
+// archived once.
+func (h *AppServiceHandler) handleTransaction(w http.ResponseWriter, r *http.Request) {
+	var txn appServiceTransaction
+	if err := json.NewDecoder(r.Body).Decode(&txn); err != nil {
+		writeAppServiceResponse(w, http.StatusBadRequest, mautrix.RespError{ErrCode: "M_NOT_JSON", Err: err.Error()})
+		return
+	}
+
+	// Keep the order of each room's events
+	var rooms []string
+	byRoom := make(map[string][]*event.Event)
+	for _, evt := range txn.Events {
+		roomID := evt.RoomID.String()
+		if roomID == "" {
+			continue
+		}
+		parseEventContent(evt)
+		if _, ok := byRoom[roomID]; !ok {
+			rooms = append(rooms, roomID)
+		}
+		byRoom[roomID] = append(byRoom[roomID], evt)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, roomID := range rooms {
+		if h.sealed[roomID] {
+			continue
+		}
+		count, err := h.enhanced.processEventBatchEnhanced(byRoom[roomID], roomID, 0)
+		h.archived += count
+		if err != nil {
+			// The homeserver retries the transaction until it succeeds
+			log.Printf("Failed to archive events from %s: %v", roomID, err)
+			writeAppServiceResponse(w, http.StatusInternalServerError, mautrix.RespError{ErrCode: "M_UNKNOWN", Err: "Failed to archive events"})
+			return
+		}
+	}
+	writeAppServiceResponse(w, http.StatusOK, map[string]string{})
+}
+
+// Archived returns the number of messages archived so far
+func (h *AppServiceHandler) Archived() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.archived
+}
+
+func writeAppServiceResponse(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// listenAddress returns the address an application service listens on: the
+// host and port of its URL, on every interface
+func listenAddress(serviceURL string) (string, error) {
+	u, err := url.Parse(serviceURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid application service URL %s: %w", serviceURL, err)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort("", port), nil
+}
+
+// ServeAppService archives the events the homeserver pushes to the
+// application service until interrupted. Unlike import and watch, it doesn't
+// page through history or sync, so it isn't rate limited; it archives events
+// from when the homeserver loads the registration on. Encrypted events are
+// stored as placeholders, since the application service has no room keys.
+func ServeAppService(opts *AppServiceOptions) error {
+	if err := CheckValidationMode(opts.Validation); err != nil {
+		return err
+	}
+	opts.Senders = opts.Senders.OrEnv()
+	if err := opts.Senders.Validate(); err != nil {
+		return err
+	}
+	attribution, err := LoadAttributionRulesOrEnv(opts.AttributionRules)
+	if err != nil {
+		return err
+	}
+	if opts.Homeserver == "" {
+		return fmt.Errorf("the application service needs the homeserver's URL (--homeserver)")
+	}
+	reg, err := LoadAppServiceRegistration(opts.Registration)
+	if err != nil {
+		return err
+	}
+	listen := opts.Listen
+	if listen == "" {
+		if listen, err = listenAddress(reg.URL); err != nil {
+			return err
+		}
+	}
+
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+	if err := opts.Senders.DenyOptedOut(context.Background(), GetDatabase()); err != nil {
+		return err
+	}
+
+	client, err := mautrix.NewClient(opts.Homeserver, "", reg.AppToken)
+	if err != nil {
+		return fmt.Errorf("failed to create client for %s: %w", opts.Homeserver, err)
+	}
+	enhanced, err := NewEnhancedMatrixClient(client, GetDatabase())
+	if err != nil {
+		return fmt.Errorf("failed to create enhanced client: %w", err)
+	}
+	enhanced.archiveModeration = opts.Moderation
+	enhanced.senders = opts.Senders
+	enhanced.validation = opts.Validation
+	enhanced.attribution = attribution
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	seals, err := GetDatabase().GetRoomSeals(ctx, "")
+	if err != nil {
+		return err
+	}
+	sealed := make(map[string]bool)
+	for _, seal := range seals {
+		sealed[seal.RoomID] = true
+	}
+	handler := NewAppServiceHandler(reg, enhanced, sealed)
+
+	server := &http.Server{Addr: listen, Handler: handler}
+	go func() {
+		<-ctx.Done()
+		_ = server.Shutdown(context.Background())
+	}()
+
+	fmt.Printf("Archiving events pushed by %s on %s (Ctrl-C to stop)\n", opts.Homeserver, listen)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("application service failed: %w", err)
+	}
+
+	fmt.Printf("\nArchived %d events\n", handler.Archived())
+	enhanced.reportFailures()
+	return nil
+}
@@ -0,0 +1,213 @@
+package archive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// ArchiveDiff describes how the messages of two archives differ
+type ArchiveDiff struct {
+	OnlyInA []*Message `json:"only_in_a"` // Event IDs missing from B, with no content match either
+	OnlyInB []*Message `json:"only_in_b"` // Event IDs missing from A, with no content match either
+
+	// Messages stored under different event IDs but with the same normalized
+	// content, e.g. the same history re-imported through a bridge or another
+	// homeserver, possibly into a new portal room
+	ContentMatches []ContentMatch `json:"content_matches"`
+
+	// Messages with the same event ID whose content differs (e.g. edits applied in one archive only)
+	Changed []ChangedMessage `json:"changed"`
+
+	CommonCount int `json:"common_count"`
+}
+
+// ContentMatch pairs two messages with the same normalized content hash but different event IDs
+type ContentMatch struct {
+	A *Message `json:"a"`
+	B *Message `json:"b"`
+}
+
+// ChangedMessage pairs two versions of the same event
+type ChangedMessage struct {
+	A *Message `json:"a"`
+	B *Message `json:"b"`
+}
+
+// Identical reports whether the archives hold the same messages
+func (d *ArchiveDiff) Identical() bool {
+	return len(d.OnlyInA) == 0 && len(d.OnlyInB) == 0 && len(d.ContentMatches) == 0 && len(d.Changed) == 0
+}
+
+// ContentHash returns a stable hash of a message's room, sender, timestamp and content.
+// It identifies the same message across archives regardless of event ID.
+func ContentHash(message *Message) string {
+	// json.Marshal sorts map keys, so equal content always serializes the same way
+	content, _ := json.Marshal(message.Content)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%d\x00", message.RoomID, message.Sender, message.Timestamp.UnixMilli())
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// DiffMessages compares two sets of messages by event ID and then by
+// normalized content hash
+func DiffMessages(a, b []*Message) *ArchiveDiff {
+	diff := &ArchiveDiff{}
+
+	byEventA := make(map[string]*Message, len(a))
+	for _, m := range a {
+		byEventA[m.EventID] = m
+	}
+	byEventB := make(map[string]*Message, len(b))
+	for _, m := range b {
+		byEventB[m.EventID] = m
+	}
+
+	var missingFromB, missingFromA []*Message
+	for _, m := range a {
+		other, ok := byEventB[m.EventID]
+		if !ok {
+			missingFromB = append(missingFromB, m)
+			continue
+		}
+		diff.CommonCount++
+		if ContentHash(m) != ContentHash(other) {
+			diff.Changed = append(diff.Changed, ChangedMessage{A: m, B: other})
+		}
+	}
+	for _, m := range b {
+		if _, ok := byEventA[m.EventID]; !ok {
+			missingFromA = append(missingFromA, m)
+		}
+	}
+
+	// Pair up the remaining messages that say the same thing
+	unmatchedB := make(map[string][]*Message)
+	for _, m := range missingFromA {
+		hash := m.normalizedHash()
+		unmatchedB[hash] = append(unmatchedB[hash], m)
+	}
+	matchedB := make(map[*Message]bool)
+	for _, m := range missingFromB {
+		hash := m.normalizedHash()
+		if candidates := unmatchedB[hash]; len(candidates) > 0 {
+			diff.ContentMatches = append(diff.ContentMatches, ContentMatch{A: m, B: candidates[0]})
+			matchedB[candidates[0]] = true
+			unmatchedB[hash] = candidates[1:]
+			continue
+		}
+		diff.OnlyInA = append(diff.OnlyInA, m)
+	}
+	for _, m := range missingFromA {
+		if !matchedB[m] {
+			diff.OnlyInB = append(diff.OnlyInB, m)
+		}
+	}
+
+	sortByTimestamp(diff.OnlyInA)
+	sortByTimestamp(diff.OnlyInB)
+	return diff
+}
+
+func sortByTimestamp(messages []*Message) {
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Timestamp.Before(messages[j].Timestamp)
+	})
+}
+
+// openArchive connects to an archive database file other than the default one
+func openArchive(ctx context.Context, path string) (*DuckDBDatabase, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("archive %s not found: %w", path, err)
+	}
+
+	db := NewDuckDBDatabase(&DatabaseConfig{
+		DatabaseURL: path,
+		MaxConns:    10,
+		Debug:       os.Getenv("DB_DEBUG") == "true",
+		Passphrase:  os.Getenv("MATRIX_ARCHIVE_PASSPHRASE"),
+	})
+	if err := db.Connect(ctx); err != nil {
+		return nil, fmt.Errorf("failed to open archive %s: %w", path, err)
+	}
+	return db, nil
+}
+
+// DiffArchives compares the messages in two archive databases, optionally limited to one room
+func DiffArchives(pathA, pathB, roomID string) error {
+	ctx := context.Background()
+
+	dbA, err := openArchive(ctx, pathA)
+	if err != nil {
+		return err
+	}
+	defer dbA.Close()
+
+	dbB, err := openArchive(ctx, pathB)
+	if err != nil {
+		return err
+	}
+	defer dbB.Close()
+
+	filter := &MessageFilter{RoomID: roomID}
+	messagesA, err := dbA.GetMessages(ctx, filter, 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to read messages from %s: %w", pathA, err)
+	}
+	messagesB, err := dbB.GetMessages(ctx, filter, 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to read messages from %s: %w", pathB, err)
+	}
+
+	diff := DiffMessages(messagesA, messagesB)
+
+	if jsonOutput() {
+		return writeJSON(diff)
+	}
+
+	fmt.Printf("A: %s (%d messages)\n", pathA, len(messagesA))
+	fmt.Printf("B: %s (%d messages)\n", pathB, len(messagesB))
+	fmt.Printf("\n%d messages in both, %d changed, %d matched by content only, %d only in A, %d only in B\n",
+		diff.CommonCount, len(diff.Changed), len(diff.ContentMatches), len(diff.OnlyInA), len(diff.OnlyInB))
+
+	if diff.Identical() {
+		fmt.Println("\nThe archives contain the same messages")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	printDiffSection(w, "Only in A", diff.OnlyInA)
+	printDiffSection(w, "Only in B", diff.OnlyInB)
+
+	if len(diff.ContentMatches) > 0 {
+		fmt.Fprintf(w, "\nSame content, different event IDs:\n")
+		for _, match := range diff.ContentMatches {
+			fmt.Fprintf(w, "  %s\t%s\t%s\n", match.A.EventID, match.B.EventID, match.A.Timestamp.Format(time.RFC3339))
+		}
+	}
+	if len(diff.Changed) > 0 {
+		fmt.Fprintf(w, "\nChanged content:\n")
+		for _, changed := range diff.Changed {
+			fmt.Fprintf(w, "  %s\t%s\t%s\n", changed.A.EventID, changed.A.RoomID, changed.A.Timestamp.Format(time.RFC3339))
+		}
+	}
+	return w.Flush()
+}
+
+func printDiffSection(w *tabwriter.Writer, title string, messages []*Message) {
+	if len(messages) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\n%s:\n", title)
+	for _, m := range messages {
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", m.EventID, m.RoomID, m.Sender, m.Timestamp.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,320 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// DefaultEstimateWindows is how many windows between the start and end of a
+// room's history estimate samples
+const DefaultEstimateWindows = 3
+
+const (
+	estimatePageSize          = 100 // Events per sampled window, the same page size imports use
+	estimateRequestsPerSecond = 2   // Pace of the sampling requests
+	estimateRetries           = 5   // Rate-limited requests retried before giving up
+)
+
+// EstimateOptions controls EstimateRoom
+type EstimateOptions struct {
+	RoomID  string
+	Windows int // Windows sampled between the first and last events; 0 = DefaultEstimateWindows
+}
+
+// EstimateWindow summarizes a run of consecutive events sampled from a room
+type EstimateWindow struct {
+	From, To     time.Time // Timestamps of the window's oldest and newest events
+	Events       int
+	Encrypted    int   // Events still encrypted, whose content can't be inspected
+	Media        int   // Events carrying an uploaded file
+	SizedMedia   int   // Media whose info gives the file's size
+	MediaBytes   int64 // Total size of the sized media
+	ContentBytes int64 // Total size of the events' JSON content
+}
+
+// ArchiveEstimate is what importing a room is expected to take, extrapolated
+// from samples of its history
+type ArchiveEstimate struct {
+	RoomID                string    `json:"room_id"`
+	FirstEvent            time.Time `json:"first_event"`
+	LastEvent             time.Time `json:"last_event"`
+	SampledEvents         int       `json:"sampled_events"`
+	Windows               int       `json:"windows"`
+	Complete              bool      `json:"complete"` // The samples cover the whole history, so the counts are exact
+	EstimatedEvents       int64     `json:"estimated_events"`
+	EncryptedShare        float64   `json:"encrypted_share"`
+	EstimatedMedia        int64     `json:"estimated_media"`
+	EstimatedMediaBytes   int64     `json:"estimated_media_bytes"`
+	EstimatedArchiveBytes int64     `json:"estimated_archive_bytes"` // Event content, before compression
+	RequestSeconds        float64   `json:"request_seconds"`         // Average time the homeserver took per sampled page
+	ImportSeconds         float64   `json:"import_seconds"`
+}
+
+// NewEstimateWindow summarizes consecutive events from a room's timeline
+func NewEstimateWindow(events []*event.Event) EstimateWindow {
+	var w EstimateWindow
+	for _, ev := range events {
+		ts := time.UnixMilli(ev.Timestamp)
+		if w.Events == 0 || ts.Before(w.From) {
+			w.From = ts
+		}
+		if w.Events == 0 || ts.After(w.To) {
+			w.To = ts
+		}
+		w.Events++
+		if ev.Type == event.EventEncrypted {
+			w.Encrypted++
+		}
+		if len(ev.Content.VeryRaw) > 0 {
+			w.ContentBytes += int64(len(ev.Content.VeryRaw))
+		} else if data, err := json.Marshal(ev.Content.Raw); err == nil {
+			w.ContentBytes += int64(len(data))
+		}
+		if isMedia(&Message{Content: ev.Content.Raw}) {
+			w.Media++
+			info, _ := ev.Content.Raw["info"].(map[string]interface{})
+			if size := infoSize(info); size > 0 {
+				w.SizedMedia++
+				w.MediaBytes += size
+			}
+		}
+	}
+	return w
+}
+
+// ExtrapolateEstimate estimates a room's history between first and last from
+// windows sampled from it. The stretch of history nearest each window is
+// assumed to be as busy as the window itself. With complete, the windows hold
+// every event and the counts are taken as they are. perRequest is how long
+// the homeserver took to serve each page, to estimate how long an import of
+// the whole history would take.
+func ExtrapolateEstimate(windows []EstimateWindow, first, last time.Time, complete bool, perRequest time.Duration) *ArchiveEstimate {
+	estimate := &ArchiveEstimate{FirstEvent: first, LastEvent: last, Windows: len(windows), Complete: complete}
+	windows = append([]EstimateWindow(nil), windows...)
+	sort.Slice(windows, func(i, j int) bool { return windows[i].From.Before(windows[j].From) })
+
+	var sampled EstimateWindow
+	for _, w := range windows {
+		sampled.Events += w.Events
+		sampled.Encrypted += w.Encrypted
+		sampled.Media += w.Media
+		sampled.SizedMedia += w.SizedMedia
+		sampled.MediaBytes += w.MediaBytes
+		sampled.ContentBytes += w.ContentBytes
+	}
+	estimate.SampledEvents = sampled.Events
+	if sampled.Events == 0 {
+		return estimate
+	}
+
+	total := float64(sampled.Events)
+	if !complete {
+		total = 0
+		for i, w := range windows {
+			lo, hi := first, last
+			if i > 0 {
+				lo = midpoint(windows[i-1].To, w.From)
+			}
+			if i < len(windows)-1 {
+				hi = midpoint(w.To, windows[i+1].From)
+			}
+			total += float64(w.Events)
+			// Events per second in the window, extended over the rest of its stretch
+			if span, gap := w.To.Sub(w.From), hi.Sub(lo)-w.To.Sub(w.From); span > 0 && gap > 0 {
+				total += float64(w.Events) / span.Seconds() * gap.Seconds()
+			}
+		}
+	}
+
+	estimate.EstimatedEvents = int64(total + 0.5)
+	share := func(n int) float64 { return float64(n) / float64(sampled.Events) }
+	estimate.EncryptedShare = share(sampled.Encrypted)
+	estimate.EstimatedMedia = int64(total*share(sampled.Media) + 0.5)
+	if sampled.SizedMedia > 0 {
+		estimate.EstimatedMediaBytes = estimate.EstimatedMedia * sampled.MediaBytes / int64(sampled.SizedMedia)
+	}
+	estimate.EstimatedArchiveBytes = int64(total * float64(sampled.ContentBytes) / float64(sampled.Events))
+	estimate.RequestSeconds = perRequest.Seconds()
+	requests := (estimate.EstimatedEvents + estimatePageSize - 1) / estimatePageSize
+	estimate.ImportSeconds = float64(requests) * perRequest.Seconds()
+	return estimate
+}
+
+// midpoint returns the time halfway between a and b
+func midpoint(a, b time.Time) time.Time {
+	return a.Add(b.Sub(a) / 2)
+}
+
+// estimateSampler fetches pages of a room's history at a pace homeservers
+// tolerate, waiting out rate limits, and collects them as windows
+type estimateSampler struct {
+	client  *mautrix.Client
+	roomID  id.RoomID
+	limiter *RateLimiter
+	seen    map[id.EventID]bool // Events already in a window, as windows can overlap
+
+	windows     []EstimateWindow
+	requests    int
+	requestTime time.Duration
+}
+
+// request makes a request to the homeserver, retrying it when rate-limited
+func (s *estimateSampler) request(what string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		s.limiter.Wait()
+		start := time.Now()
+		err := fn()
+		if delay, limited := RateLimitDelay(err, time.Second<<attempt); limited && attempt < estimateRetries {
+			log.Printf("Warning: %s is rate-limiting requests; retrying %s in %s", s.client.HomeserverURL.Host, what, delay.Round(time.Second))
+			time.Sleep(delay)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to fetch %s: %w", what, err)
+		}
+		s.requests++
+		s.requestTime += time.Since(start)
+		return nil
+	}
+}
+
+// add records the events not already in a window as a new window, and
+// reports whether there were any
+func (s *estimateSampler) add(events []*event.Event) (EstimateWindow, bool) {
+	var fresh []*event.Event
+	for _, ev := range events {
+		if ev != nil && !s.seen[ev.ID] {
+			s.seen[ev.ID] = true
+			fresh = append(fresh, ev)
+		}
+	}
+	if len(fresh) == 0 {
+		return EstimateWindow{}, false
+	}
+	window := NewEstimateWindow(fresh)
+	s.windows = append(s.windows, window)
+	return window, true
+}
+
+// EstimateRoom samples a room's history on the homeserver - its first and
+// last events and a few windows in between - and reports how many events,
+// encrypted events and media files importing it would archive, how much space
+// they'd take, and how long the import would take, without importing anything
+func EstimateRoom(opts EstimateOptions) error {
+	if opts.RoomID == "" {
+		return fmt.Errorf("a room is required")
+	}
+	windows := opts.Windows
+	if windows <= 0 {
+		windows = DefaultEstimateWindows
+	}
+
+	client, err := GetMatrixClient()
+	if err != nil {
+		return fmt.Errorf("failed to get Matrix client: %w", err)
+	}
+	ctx := context.Background()
+	s := &estimateSampler{
+		client:  client,
+		roomID:  id.RoomID(opts.RoomID),
+		limiter: NewRateLimiter(estimateRequestsPerSecond),
+		seen:    make(map[id.EventID]bool),
+	}
+	progress := progressWriter()
+
+	fmt.Fprintf(progress, "Sampling %s\n", opts.RoomID)
+	var latest, earliest *mautrix.RespMessages
+	if err := s.request("the latest events", func() (err error) {
+		latest, err = client.Messages(ctx, s.roomID, "", "", mautrix.DirectionBackward, nil, estimatePageSize)
+		return err
+	}); err != nil {
+		return err
+	}
+	newest, ok := s.add(latest.Chunk)
+	if !ok {
+		return fmt.Errorf("%s has no events visible to this account", opts.RoomID)
+	}
+	last := newest.To
+	first := newest.From
+	complete := latest.End == ""
+
+	if !complete {
+		if err := s.request("the first events", func() (err error) {
+			earliest, err = client.Messages(ctx, s.roomID, "", "", mautrix.DirectionForward, nil, estimatePageSize)
+			return err
+		}); err != nil {
+			return err
+		}
+		gapStart, gapEnd := first, newest.From
+		oldest, ok := s.add(earliest.Chunk)
+		if ok {
+			first, gapStart = oldest.From, oldest.To
+		}
+		// When the first page reaches the latest one, the room has been read in full
+		complete = oldest.Events < len(earliest.Chunk) || earliest.End == ""
+
+		// Windows spread evenly over the history between the first and last pages
+		for i := 1; i <= windows && !complete && gapEnd.After(gapStart); i++ {
+			ts := gapStart.Add(gapEnd.Sub(gapStart) * time.Duration(i) / time.Duration(windows+1))
+			var found *mautrix.RespTimestampToEvent
+			if err := s.request("the event at "+ts.Format(time.RFC3339), func() (err error) {
+				found, err = client.TimestampToEvent(ctx, s.roomID, ts, mautrix.DirectionForward)
+				return err
+			}); err != nil {
+				// Homeservers without timestamp lookups still get an estimate from the ends
+				log.Printf("Warning: could not sample the middle of %s's history: %v", opts.RoomID, err)
+				break
+			}
+			var window *mautrix.RespContext
+			if err := s.request("the events around "+string(found.EventID), func() (err error) {
+				window, err = client.Context(ctx, s.roomID, found.EventID, nil, estimatePageSize)
+				return err
+			}); err != nil {
+				return err
+			}
+			events := append(append(window.EventsBefore, window.Event), window.EventsAfter...)
+			s.add(events)
+		}
+	}
+
+	estimate := ExtrapolateEstimate(s.windows, first, last, complete, s.requestTime/time.Duration(s.requests))
+	estimate.RoomID = opts.RoomID
+	if jsonOutput() {
+		return writeJSON(estimate)
+	}
+	printEstimate(estimate)
+	return nil
+}
+
+// printEstimate prints an estimate as a table
+func printEstimate(estimate *ArchiveEstimate) {
+	approx := "~"
+	if estimate.Complete {
+		approx = ""
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Room\t%s\n", estimate.RoomID)
+	fmt.Fprintf(w, "History\t%s to %s\n", estimate.FirstEvent.Format("2006-01-02"), estimate.LastEvent.Format("2006-01-02"))
+	fmt.Fprintf(w, "Sampled\t%d events in %d windows\n", estimate.SampledEvents, estimate.Windows)
+	fmt.Fprintf(w, "Events\t%s%d\n", approx, estimate.EstimatedEvents)
+	fmt.Fprintf(w, "Encrypted\t%.0f%%\n", estimate.EncryptedShare*100)
+	fmt.Fprintf(w, "Media\t%s%d files, %s%s\n", approx, estimate.EstimatedMedia, approx, FormatSize(estimate.EstimatedMediaBytes))
+	fmt.Fprintf(w, "Archive size\t%s%s\n", approx, FormatSize(estimate.EstimatedArchiveBytes))
+	fmt.Fprintf(w, "Import time\t~%s at %s per page\n",
+		(time.Duration(estimate.ImportSeconds * float64(time.Second))).Round(time.Second),
+		(time.Duration(estimate.RequestSeconds * float64(time.Second))).Round(time.Millisecond))
+	w.Flush()
+	if estimate.EncryptedShare > 0 {
+		fmt.Println("\nMedia in encrypted events isn't counted, as it can't be seen until they're decrypted.")
+	}
+}
@@ -0,0 +1,177 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// Conflict strategies for merging archives, applied when both archives hold
+// the same event ID with different content
+const (
+	MergeKeepExisting = "keep"    // keep the message already in this archive
+	MergeReplace      = "replace" // overwrite it with the other archive's copy
+)
+
+// mergeBatchSize is the number of new messages inserted per batch during a merge
+const mergeBatchSize = 1000
+
+// MergeResult summarizes a merge
+type MergeResult struct {
+	Added      int `json:"added"`      // Messages new to this archive
+	Unchanged  int `json:"unchanged"`  // Messages already present with identical content
+	Conflicts  int `json:"conflicts"`  // Same event ID, different content
+	Replaced   int `json:"replaced"`   // Conflicts resolved in favor of the other archive
+	Duplicates int `json:"duplicates"` // New event IDs for messages already archived, e.g. after a re-bridge
+	Collisions int `json:"collisions"` // Event IDs archived in another room, whose messages weren't merged
+	Rooms      int `json:"rooms"`      // Rooms in the other archive
+}
+
+// MergeMessages copies all messages from src into dst. Event IDs already in dst
+// are resolved with the given strategy; messages under new event IDs whose
+// normalized content hash is already in dst are skipped as duplicates.
+func MergeMessages(ctx context.Context, dst, src DatabaseInterface, strategy string) (*MergeResult, error) {
+	if strategy == "" {
+		strategy = MergeKeepExisting
+	}
+	if strategy != MergeKeepExisting && strategy != MergeReplace {
+		return nil, fmt.Errorf("unsupported conflict strategy %s, supported strategies: [%s %s]", strategy, MergeKeepExisting, MergeReplace)
+	}
+
+	result := &MergeResult{}
+
+	rooms, err := src.GetRooms(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rooms: %w", err)
+	}
+	result.Rooms = len(rooms)
+
+	hashes, err := dst.GetContentHashes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read content hashes: %w", err)
+	}
+
+	for _, roomID := range rooms {
+		incoming, err := src.GetMessages(ctx, &MessageFilter{RoomID: roomID}, 0, 0)
+		if err != nil {
+			return result, fmt.Errorf("failed to read messages for room %s: %w", roomID, err)
+		}
+
+		existing, err := dst.GetMessages(ctx, &MessageFilter{RoomID: roomID}, 0, 0)
+		if err != nil {
+			return result, fmt.Errorf("failed to read existing messages for room %s: %w", roomID, err)
+		}
+		existingByEvent := make(map[string]*Message, len(existing))
+		for _, m := range existing {
+			existingByEvent[m.EventID] = m
+		}
+
+		var batch []*Message
+		for _, message := range incoming {
+			current, ok := existingByEvent[message.EventID]
+			if !ok {
+				hash := message.normalizedHash()
+				if eventID, dup := hashes[hash]; dup && eventID != message.EventID {
+					result.Duplicates++
+					continue
+				}
+				hashes[hash] = message.EventID
+				batch = append(batch, message)
+				if len(batch) >= mergeBatchSize {
+					if err := insertMergeBatch(ctx, dst, batch, result); err != nil {
+						return result, err
+					}
+					batch = batch[:0]
+				}
+				continue
+			}
+
+			if ContentHash(current) == ContentHash(message) {
+				result.Unchanged++
+				continue
+			}
+
+			result.Conflicts++
+			if strategy == MergeReplace {
+				if err := dst.DeleteMessage(ctx, message.EventID); err != nil {
+					return result, fmt.Errorf("failed to replace message %s: %w", message.EventID, err)
+				}
+				if err := dst.InsertMessage(ctx, message); err != nil {
+					return result, fmt.Errorf("failed to replace message %s: %w", message.EventID, err)
+				}
+				result.Replaced++
+			}
+		}
+
+		if err := insertMergeBatch(ctx, dst, batch, result); err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+func insertMergeBatch(ctx context.Context, dst DatabaseInterface, batch []*Message, result *MergeResult) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	inserted, err := dst.InsertMessageBatch(ctx, batch)
+	collisions := 0
+	var collided *EventIDCollisionError
+	if errors.As(err, &collided) {
+		for _, c := range collided.Collisions {
+			log.Printf("Warning: not merging %s of room %s: its event ID is archived in room %s", c.Message.EventID, c.Message.RoomID, c.ExistingRoomID)
+		}
+		collisions = len(collided.Collisions)
+	} else if err != nil {
+		return fmt.Errorf("failed to insert messages: %w", err)
+	}
+	result.Added += inserted
+	result.Collisions += collisions
+	// Anything else the batch skipped was stored meanwhile
+	result.Unchanged += len(batch) - inserted - collisions
+	return nil
+}
+
+// MergeArchive merges the archive database at path into the current archive
+func MergeArchive(path, strategy string) error {
+	ctx := context.Background()
+
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	other, err := openArchive(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer other.Close()
+
+	result, err := MergeMessages(ctx, GetDatabase(), other, strategy)
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput() {
+		return writeJSON(result)
+	}
+
+	fmt.Printf("Merged %s: %d rooms, %d messages added, %d already present\n", path, result.Rooms, result.Added, result.Unchanged)
+	if result.Duplicates > 0 {
+		fmt.Printf("%d messages skipped as duplicates of archived messages with other event IDs\n", result.Duplicates)
+	}
+	if result.Collisions > 0 {
+		fmt.Printf("%d messages not merged because their event IDs are archived in other rooms\n", result.Collisions)
+	}
+	if result.Conflicts > 0 {
+		if strategy == MergeReplace {
+			fmt.Printf("%d conflicting messages replaced with the merged archive's copy\n", result.Replaced)
+		} else {
+			fmt.Printf("%d conflicting messages kept as they were (use --on-conflict replace to take the merged copy)\n", result.Conflicts)
+		}
+	}
+	return nil
+}
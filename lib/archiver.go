@@ -0,0 +1,109 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+)
+
+// Archiver gives Go programs access to an archive without the global
+// database and account the commands use, so that one process can work on
+// several archives, or archive several accounts, at once:
+//
+//	a, err := archive.OpenArchiver(ctx, archive.DefaultDatabaseConfig())
+//	if err != nil {
+//		return err
+//	}
+//	defer a.Close()
+//	for msg, err := range a.Messages(ctx, &archive.MessageFilter{RoomID: roomID}) {
+//		if err != nil {
+//			return err
+//		}
+//		fmt.Println(msg.Sender, msg.Content["body"])
+//	}
+type Archiver struct {
+	db      DatabaseInterface
+	account *Account // Where Import reads from; nil until SetAccount
+}
+
+// OpenArchiver connects to the archive database described by config. A nil
+// config uses DefaultDatabaseConfig.
+func OpenArchiver(ctx context.Context, config *DatabaseConfig) (*Archiver, error) {
+	if config == nil {
+		config = DefaultDatabaseConfig()
+	}
+	db := NewDuckDBDatabase(config)
+	if err := db.Connect(ctx); err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	return &Archiver{db: db}, nil
+}
+
+// NewArchiver returns an Archiver reading from a connected database, which
+// the caller closes
+func NewArchiver(db DatabaseInterface) *Archiver {
+	return &Archiver{db: db}
+}
+
+// Close closes the archive's database
+func (a *Archiver) Close() error {
+	return a.db.Close()
+}
+
+// SetAccount sets the Matrix account Import reads from
+func (a *Archiver) SetAccount(account *Account) {
+	a.account = account
+}
+
+// Import imports messages from the Matrix account's rooms into the archive,
+// as the import command does with opts
+func (a *Archiver) Import(ctx context.Context, opts *ImportOptions) error {
+	if a.account == nil {
+		return errors.New("the archiver has no Matrix account to import from; set one with SetAccount")
+	}
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	attribution, err := prepareImport(opts)
+	if err != nil {
+		return err
+	}
+	return importMessages(ctx, a.db, a.account, opts, attribution)
+}
+
+// errStopMessages ends EachMessage when the consumer of Messages stops early
+var errStopMessages = errors.New("stop")
+
+// Messages returns the messages matching filter, oldest first, read from the
+// database as the loop consumes them so that archives of any size can be
+// processed in constant memory. A nil filter yields every message. If the
+// query fails, the sequence yields the error and ends. Content is decrypted
+// when the archive is encrypted.
+//
+// The database connection reading the messages stays busy until the loop
+// ends, so with a single-connection config (MaxConns 1) the loop must not
+// make other queries on the same archive.
+func (a *Archiver) Messages(ctx context.Context, filter *MessageFilter) iter.Seq2[*Message, error] {
+	return func(yield func(*Message, error) bool) {
+		err := a.db.EachMessage(ctx, filter, func(msg *Message) error {
+			if !yield(msg, nil) {
+				return errStopMessages
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStopMessages) {
+			yield(nil, err)
+		}
+	}
+}
+
+// Rooms returns the IDs of the rooms with archived messages
+func (a *Archiver) Rooms(ctx context.Context) ([]string, error) {
+	return a.db.GetRooms(ctx)
+}
+
+// MessageCount returns the number of messages matching filter
+func (a *Archiver) MessageCount(ctx context.Context, filter *MessageFilter) (int64, error) {
+	return a.db.GetMessageCount(ctx, filter)
+}
@@ -0,0 +1,253 @@
+package archive
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AttributionRulesEnv names a rules file used when import and watch aren't given one
+const AttributionRulesEnv = "MATRIX_ARCHIVE_ATTRIBUTION_RULES"
+
+// AttributionRule recognizes messages a bot or webhook relayed for someone
+// else, such as "**alice**: hi" posted by a Discord relay bot, and recovers
+// their real author. The Sender and Body patterns are regular expressions;
+// the author's name comes from a (?P<name>...) group in either, and their
+// platform from a (?P<platform>...) group or the fixed Platform.
+type AttributionRule struct {
+	Room          string `yaml:"room,omitempty" json:"room,omitempty"`                     // Room ID, or a pattern with * such as !*:discord.example; empty matches every room
+	Sender        string `yaml:"sender,omitempty" json:"sender,omitempty"`                 // Regular expression matching the relaying user ID
+	Body          string `yaml:"body,omitempty" json:"body,omitempty"`                     // Regular expression matching the start of the body
+	FormattedBody string `yaml:"formatted_body,omitempty" json:"formatted_body,omitempty"` // Regular expression matching the start of the formatted body
+	Platform      string `yaml:"platform,omitempty" json:"platform,omitempty"`             // Platform when the patterns don't capture one
+	Strip         bool   `yaml:"strip,omitempty" json:"strip,omitempty"`                   // Remove the matched prefix from the body and formatted body
+
+	sender, body, formattedBody *regexp.Regexp
+}
+
+// AttributionRules are tried in order; the first that matches a message attributes it
+type AttributionRules []*AttributionRule
+
+// LoadAttributionRules reads a YAML list of rules, such as
+//
+//   - room: "!relay:example.org"
+//     sender: "^@discordbot:example.org$"
+//     body: '^\*\*(?P<name>[^*]+)\*\*: '
+//     platform: Discord
+//     strip: true
+func LoadAttributionRules(filename string) (AttributionRules, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attribution rules: %w", err)
+	}
+	var rules AttributionRules
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse attribution rules in %s: %w", filename, err)
+	}
+	if err := rules.Compile(); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return rules, nil
+}
+
+// LoadAttributionRulesOrEnv loads the rules in filename, or in the file named
+// by MATRIX_ARCHIVE_ATTRIBUTION_RULES if filename is empty. It returns no
+// rules if neither is set.
+func LoadAttributionRulesOrEnv(filename string) (AttributionRules, error) {
+	if filename == "" {
+		filename = os.Getenv(AttributionRulesEnv)
+	}
+	if filename == "" {
+		return nil, nil
+	}
+	return LoadAttributionRules(filename)
+}
+
+// Compile checks and compiles each rule's patterns
+func (rules AttributionRules) Compile() error {
+	for i, rule := range rules {
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("attribution rule %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (r *AttributionRule) compile() error {
+	if r.Room != "" {
+		if _, err := path.Match(r.Room, ""); err != nil {
+			return fmt.Errorf("invalid room pattern %q: %w", r.Room, err)
+		}
+	}
+	if r.Sender == "" && r.Body == "" {
+		return fmt.Errorf("a rule needs a sender or body pattern")
+	}
+	var err error
+	compile := func(field, pattern string) *regexp.Regexp {
+		if pattern == "" || err != nil {
+			return nil
+		}
+		var re *regexp.Regexp
+		if re, err = regexp.Compile(pattern); err != nil {
+			err = fmt.Errorf("invalid %s pattern: %w", field, err)
+		}
+		return re
+	}
+	r.sender = compile("sender", r.Sender)
+	r.body = compile("body", r.Body)
+	r.formattedBody = compile("formatted_body", r.FormattedBody)
+	if err != nil {
+		return err
+	}
+	if !hasGroup(r.sender, "name") && !hasGroup(r.body, "name") {
+		return fmt.Errorf("the sender or body pattern needs a (?P<name>...) group")
+	}
+	return nil
+}
+
+func hasGroup(re *regexp.Regexp, name string) bool {
+	return re != nil && re.SubexpIndex(name) >= 0
+}
+
+// Apply attributes msg to the author named by the first rule that matches it,
+// stripping the prefix naming them from its content if the rule says to. It
+// reports whether a rule matched.
+func (rules AttributionRules) Apply(msg *Message) bool {
+	for _, rule := range rules {
+		if rule.apply(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *AttributionRule) apply(msg *Message) bool {
+	if r.Room != "" {
+		if matched, _ := path.Match(r.Room, msg.RoomID); !matched {
+			return false
+		}
+	}
+	groups := make(map[string]string)
+	match := func(re *regexp.Regexp, s string) []int {
+		loc := re.FindStringSubmatchIndex(s)
+		for i, name := range re.SubexpNames() {
+			if name != "" && loc != nil && loc[2*i] >= 0 {
+				groups[name] = strings.TrimSpace(s[loc[2*i]:loc[2*i+1]])
+			}
+		}
+		return loc
+	}
+
+	if r.sender != nil && match(r.sender, msg.Sender) == nil {
+		return false
+	}
+	body, _ := msg.Content["body"].(string)
+	var bodyMatch []int
+	if r.body != nil {
+		// Only the start of the body names the author
+		if bodyMatch = match(r.body, body); bodyMatch == nil || bodyMatch[0] != 0 {
+			return false
+		}
+	}
+	if groups["name"] == "" {
+		return false
+	}
+
+	msg.AuthorName = groups["name"]
+	msg.AuthorPlatform = groups["platform"]
+	if msg.AuthorPlatform == "" {
+		msg.AuthorPlatform = r.Platform
+	}
+	if r.Strip && bodyMatch != nil {
+		r.strip(msg, body[bodyMatch[1]:])
+	}
+	return true
+}
+
+// strip replaces the body with the text after the author's name. The
+// formatted body, which names the author in markup, loses its own prefix if
+// the rule's formatted body pattern matches it, and is dropped otherwise.
+func (r *AttributionRule) strip(msg *Message, body string) {
+	content := make(map[string]interface{}, len(msg.Content))
+	for key, value := range msg.Content {
+		content[key] = value
+	}
+	content["body"] = body
+	if formatted, ok := content["formatted_body"].(string); ok {
+		if loc := r.matchFormatted(formatted); loc != nil {
+			content["formatted_body"] = formatted[loc[1]:]
+		} else {
+			delete(content, "formatted_body")
+			delete(content, "format")
+		}
+	}
+	msg.Content = content
+}
+
+func (r *AttributionRule) matchFormatted(formatted string) []int {
+	if r.formattedBody == nil {
+		return nil
+	}
+	if loc := r.formattedBody.FindStringIndex(formatted); loc != nil && loc[0] == 0 {
+		return loc
+	}
+	return nil
+}
+
+// attributeExport credits an exported message to its real author, if
+// attribution rules found one at import
+func (m *Message) attributeExport(msg *ExportMessage) {
+	if m.AuthorName == "" {
+		return
+	}
+	msg.DisplayName = m.AuthorName
+	msg.Platform = m.AuthorPlatform
+	msg.Relayed = true
+}
+
+// storedAuthorKey holds a message's attributed author inside its content in
+// encrypted archives, where the author columns are left empty
+const storedAuthorKey = "mxa.author"
+
+// authorForStorage returns the message's author columns, or NULLs in
+// encrypted archives, where a stripped body leaves them the only copy of the
+// author's name; encodeContent keeps the author in the encrypted content
+func (d *DuckDBDatabase) authorForStorage(message *Message) (name, platform sql.NullString) {
+	if d.cipher != nil {
+		return sql.NullString{}, sql.NullString{}
+	}
+	return sql.NullString{String: message.AuthorName, Valid: message.AuthorName != ""},
+		sql.NullString{String: message.AuthorPlatform, Valid: message.AuthorPlatform != ""}
+}
+
+// withStoredAuthor returns content with the attributed author added under
+// storedAuthorKey, or content itself if there is none
+func withStoredAuthor(content map[string]interface{}, name, platform string) map[string]interface{} {
+	if name == "" {
+		return content
+	}
+	stored := copyContent(content)
+	author := map[string]interface{}{"name": name}
+	if platform != "" {
+		author["platform"] = platform
+	}
+	stored[storedAuthorKey] = author
+	return stored
+}
+
+// takeStoredAuthor moves the author kept in a message's content by
+// withStoredAuthor back to its author fields
+func takeStoredAuthor(message *Message) {
+	author, ok := message.Content[storedAuthorKey].(map[string]interface{})
+	if !ok {
+		return
+	}
+	delete(message.Content, storedAuthorKey)
+	message.AuthorName, _ = author["name"].(string)
+	message.AuthorPlatform, _ = author["platform"].(string)
+}
@@ -0,0 +1,168 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultBackupKeep is how many backups db backup keeps by default
+const DefaultBackupKeep = 7
+
+// backupTimeFormat stamps backup file names, so they sort by age
+const backupTimeFormat = "20060102-150405"
+
+// BackupOptions configures backups of the archive database
+type BackupOptions struct {
+	Dir      string        // Directory the backups are written to
+	Keep     int           // Newest backups to keep; older ones are deleted, 0 keeps all
+	Interval time.Duration // How often watch backs up; 0 only backs up when watch stops
+}
+
+// Backup writes a consistent copy of the database to path while it stays
+// open: the copy is made in one transaction, so messages archived meanwhile
+// are either wholly in it or not at all
+func (d *DuckDBDatabase) Backup(ctx context.Context, path string) error {
+	conn, err := d.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+
+	var current string
+	if err := conn.QueryRowContext(ctx, "SELECT current_database()").Scan(&current); err != nil {
+		return fmt.Errorf("failed to get database name: %w", err)
+	}
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("ATTACH '%s' AS backup", strings.ReplaceAll(path, "'", "''"))); err != nil {
+		return fmt.Errorf("failed to create backup %s: %w", path, err)
+	}
+	_, copyErr := conn.ExecContext(ctx, fmt.Sprintf(`COPY FROM DATABASE "%s" TO backup`, strings.ReplaceAll(current, `"`, `""`)))
+	if _, err := conn.ExecContext(ctx, "DETACH backup"); err != nil && copyErr == nil {
+		return fmt.Errorf("failed to close backup %s: %w", path, err)
+	}
+	if copyErr != nil {
+		return fmt.Errorf("failed to copy the archive to %s: %w", path, copyErr)
+	}
+	return nil
+}
+
+// BackupName returns the file name of a backup of the archive at dbPath taken
+// at t, such as matrix_archive-20240301-120000.duckdb
+func BackupName(dbPath string, t time.Time) string {
+	base := strings.TrimSuffix(filepath.Base(dbPath), filepath.Ext(dbPath))
+	return fmt.Sprintf("%s-%s.duckdb", base, t.UTC().Format(backupTimeFormat))
+}
+
+// RotateBackups deletes all but the newest keep backups of the archive at
+// dbPath in dir, returning the files it deleted. Other files are left alone.
+func RotateBackups(dir, dbPath string, keep int) ([]string, error) {
+	if keep <= 0 {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	prefix := strings.TrimSuffix(filepath.Base(dbPath), filepath.Ext(dbPath)) + "-"
+	var backups []string
+	for _, entry := range entries {
+		name := entry.Name()
+		stamp, ok := strings.CutPrefix(name, prefix)
+		if !ok || entry.IsDir() || !strings.HasSuffix(stamp, ".duckdb") {
+			continue
+		}
+		if _, err := time.Parse(backupTimeFormat, strings.TrimSuffix(stamp, ".duckdb")); err != nil {
+			continue
+		}
+		backups = append(backups, name)
+	}
+	// Time stamps sort chronologically, so the newest backups come last
+	sort.Strings(backups)
+
+	var deleted []string
+	for len(backups) > keep {
+		path := filepath.Join(dir, backups[0])
+		if err := os.Remove(path); err != nil {
+			return deleted, fmt.Errorf("failed to delete old backup: %w", err)
+		}
+		deleted = append(deleted, path)
+		backups = backups[1:]
+	}
+	return deleted, nil
+}
+
+// backupArchive backs up the open archive into opts.Dir and rotates the
+// backups there, returning the new backup's path
+func backupArchive(ctx context.Context, opts *BackupOptions) (string, error) {
+	db, ok := GetDatabase().(*DuckDBDatabase)
+	if !ok || dbConfig == nil || dbConfig.IsInMemory {
+		return "", fmt.Errorf("only archives stored in a file can be backed up")
+	}
+	dbPath, _, _ := strings.Cut(dbConfig.DatabaseURL, "?")
+	if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	// Write under a temporary name, so an interrupted backup isn't mistaken
+	// for a complete one and rotated in place of a good one
+	path := filepath.Join(opts.Dir, BackupName(dbPath, time.Now()))
+	partial := path + ".partial"
+	os.Remove(partial)
+	if err := db.Backup(ctx, partial); err != nil {
+		os.Remove(partial)
+		return "", err
+	}
+	if err := os.Rename(partial, path); err != nil {
+		return "", fmt.Errorf("failed to finish backup: %w", err)
+	}
+
+	deleted, err := RotateBackups(opts.Dir, dbPath, opts.Keep)
+	for _, old := range deleted {
+		fmt.Printf("Deleted old backup %s\n", old)
+	}
+	return path, err
+}
+
+// BackupDatabase writes a backup of the archive to opts.Dir, deleting the
+// oldest backups there beyond opts.Keep. The backup is itself an archive,
+// readable with --db or restorable by copying it into place.
+func BackupDatabase(opts *BackupOptions) error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	path, err := backupArchive(context.Background(), opts)
+	if path != "" {
+		fmt.Printf("✓ Backed up the archive to %s\n", path)
+	}
+	return err
+}
+
+// runBackups backs up the archive every opts.Interval until ctx is done.
+// Failed backups are logged, so they don't stop the archiving they protect.
+func runBackups(ctx context.Context, opts *BackupOptions) {
+	if opts.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if path, err := backupArchive(ctx, opts); err != nil {
+				log.Printf("Warning: backup failed: %v", err)
+			} else {
+				fmt.Printf("Backed up the archive to %s\n", path)
+			}
+		}
+	}
+}
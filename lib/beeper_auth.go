@@ -2,21 +2,35 @@ package archive
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"go.mau.fi/util/random"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/id"
 
 	"github.com/osteele/matrix-archive/internal/beeperapi"
 )
 
+// beeperMatrixHost is the Matrix homeserver of Beeper accounts
+const beeperMatrixHost = "https://matrix.beeper.com"
+
+// beeperDeviceID is the device ID used with Beeper's Matrix access unless a
+// profile has its own device. It stays the same across sessions, so the
+// crypto store keeps working for E2EE.
+const beeperDeviceID = "MATRIXARCH"
+
+// archiveDevicePrefix starts the IDs of the random devices NewDevice creates
+const archiveDevicePrefix = "ARCHIVE"
+
 // BeeperAuth handles Beeper authentication
 type BeeperAuth struct {
 	BaseDomain     string
+	Profile        string // Named account profile; empty for the default account
 	Email          string
 	Token          string
 	Whoami         *beeperapi.RespWhoami
@@ -28,6 +42,7 @@ type BeeperAuth struct {
 // BeeperCredentials represents saved credentials
 type BeeperCredentials struct {
 	BaseDomain     string                `json:"base_domain"`
+	Profile        string                `json:"profile,omitempty"`
 	Email          string                `json:"email"`
 	Token          string                `json:"token"`
 	Username       string                `json:"username"`
@@ -47,6 +62,14 @@ func NewBeeperAuth(baseDomain string) *BeeperAuth {
 	}
 }
 
+// NewBeeperAuthForProfile creates a BeeperAuth instance for a named account profile,
+// so several accounts on the same domain can keep separate credentials
+func NewBeeperAuthForProfile(baseDomain, profile string) *BeeperAuth {
+	auth := NewBeeperAuth(baseDomain)
+	auth.Profile = profile
+	return auth
+}
+
 // Login performs the Beeper authentication flow
 func (b *BeeperAuth) Login() error {
 	// Check if we're in an interactive terminal early
@@ -106,21 +129,115 @@ func (b *BeeperAuth) Login() error {
 
 // GetMatrixClientWithCrypto creates a Matrix client with crypto using the helper approach
 func (b *BeeperAuth) GetMatrixClientWithCrypto() (*mautrix.Client, error) {
+	return b.GetMatrixClient()
+}
+
+// LoginWithToken authenticates with a Beeper API token (JWT) obtained
+// elsewhere, such as from a logged-in Beeper client, without prompting. The
+// token is checked with Beeper and exchanged for Matrix access before it is
+// accepted.
+func (b *BeeperAuth) LoginWithToken(token string) error {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return fmt.Errorf("Beeper token is empty")
+	}
+
+	whoami, err := beeperapi.Whoami(b.BaseDomain, token)
+	if err != nil {
+		return fmt.Errorf("Beeper rejected the token: %w", err)
+	}
+	b.Token = token
+	b.Whoami = whoami
+	b.Email = whoami.UserInfo.Email
+
+	if _, err := b.GetMatrixClient(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Successfully logged in as %s (%s)\n",
+		b.Whoami.UserInfo.Username,
+		b.Whoami.UserInfo.Email)
+	return nil
+}
+
+// LoginWithMatrixToken authenticates with a Matrix access token for a Beeper
+// account, without prompting. The token is checked with the homeserver and
+// must belong to userID. Without a Beeper token, a token that expires can't
+// be renewed; log in again to replace it.
+func (b *BeeperAuth) LoginWithMatrixToken(accessToken, userID string) error {
+	accessToken = strings.TrimSpace(accessToken)
+	if accessToken == "" {
+		return fmt.Errorf("Matrix access token is empty")
+	}
+	if _, _, err := id.UserID(userID).ParseAndValidate(); err != nil {
+		return fmt.Errorf("invalid user ID %q: %w", userID, err)
+	}
+
+	client, err := mautrix.NewClient(beeperMatrixHost, "", accessToken)
+	if err != nil {
+		return fmt.Errorf("failed to create Matrix client: %w", err)
+	}
+	whoami, err := client.Whoami(context.Background())
+	if err != nil {
+		return fmt.Errorf("%s rejected the access token: %w", beeperMatrixHost, err)
+	}
+	if whoami.UserID != id.UserID(userID) {
+		return fmt.Errorf("the access token belongs to %s, not %s", whoami.UserID, userID)
+	}
+
+	b.Token = ""
+	b.Whoami = nil
+	b.MatrixToken = accessToken
+	b.MatrixUserID = userID
+	// The token belongs to a device, which the crypto store must use
+	b.MatrixDeviceID = whoami.DeviceID.String()
+	if b.MatrixDeviceID == "" {
+		b.MatrixDeviceID = beeperDeviceID
+	}
+
+	fmt.Printf("Successfully logged in as %s\n", b.MatrixUserID)
+	return b.SaveCredentialsToFile()
+}
+
+// GetMatrixClient creates a Matrix client authenticated with the Beeper
+// credentials: from the Beeper token if there is one, otherwise from a Matrix
+// access token given to LoginWithMatrixToken
+func (b *BeeperAuth) GetMatrixClient() (*mautrix.Client, error) {
+	if b.Token == "" && b.MatrixToken != "" && b.MatrixUserID != "" {
+		client, err := mautrix.NewClient(beeperMatrixHost, id.UserID(b.MatrixUserID), b.MatrixToken)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Matrix client: %w", err)
+		}
+		client.DeviceID = id.DeviceID(b.MatrixDeviceID)
+		fmt.Fprintf(progressWriter(), "Using saved Matrix access token. User ID: %s, Device ID: %s\n", client.UserID, client.DeviceID)
+		return client, nil
+	}
 	if b.Token == "" || b.Whoami == nil {
 		return nil, fmt.Errorf("not authenticated - call Login() first")
 	}
+	deviceID := b.DeviceID()
 
-	// The correct Matrix server for Beeper
-	matrixHost := "https://matrix.beeper.com"
+	// Reuse the saved access token while it works: logging in again to the
+	// same device would end the session of any other running command
+	if b.MatrixToken != "" && b.MatrixUserID != "" {
+		client, err := mautrix.NewClient(beeperMatrixHost, id.UserID(b.MatrixUserID), b.MatrixToken)
+		if err == nil {
+			if whoami, err := client.Whoami(context.Background()); err == nil && whoami.DeviceID == deviceID {
+				client.DeviceID = deviceID
+				return client, nil
+			}
+		}
+	}
 
 	// Create a basic client first
-	client, err := mautrix.NewClient(matrixHost, "", "")
+	client, err := mautrix.NewClient(beeperMatrixHost, "", "")
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Matrix client: %w", err)
 	}
 
-	// Get Matrix credentials from Beeper JWT
-	matrixLogin, err := beeperapi.GetMatrixTokenFromJWT(b.Token)
+	// Get Matrix credentials from Beeper JWT, for the same device each time so
+	// devices don't pile up on the account
+	matrixLogin, err := beeperapi.GetMatrixTokenFromJWTForDevice(b.Token, deviceID.String(), DeviceDisplayName(b.Profile))
 	if err != nil {
 		return nil, fmt.Errorf("failed to get Matrix access token from Beeper JWT: %w", err)
 	}
@@ -128,26 +245,52 @@ func (b *BeeperAuth) GetMatrixClientWithCrypto() (*mautrix.Client, error) {
 	// Cache the Matrix credentials
 	b.MatrixToken = matrixLogin.AccessToken
 	b.MatrixUserID = matrixLogin.UserID
-
-	// Use a deterministic device ID for consistency with crypto store
-	// This ensures the same device ID is used across sessions for E2EE
-	deterministic_device_id := "MATRIXARCH"
-	b.MatrixDeviceID = deterministic_device_id
+	b.MatrixDeviceID = deviceID.String()
 
 	// Set the credentials on the client
 	client.AccessToken = matrixLogin.AccessToken
 	client.UserID = id.UserID(matrixLogin.UserID)
-	client.DeviceID = id.DeviceID(deterministic_device_id)
+	client.DeviceID = deviceID
+
+	// Name the device, so it can be recognized in the account's device list
+	if err := client.SetDeviceInfo(context.Background(), deviceID, &mautrix.ReqDeviceInfo{DisplayName: DeviceDisplayName(b.Profile)}); err != nil {
+		fmt.Fprintf(progressWriter(), "Warning: Failed to name device %s: %v\n", deviceID, err)
+	}
 
 	// Save updated credentials to file
 	if err := b.SaveCredentialsToFile(); err != nil {
-		fmt.Printf("Warning: Failed to save updated credentials: %v\n", err)
+		fmt.Fprintf(progressWriter(), "Warning: Failed to save updated credentials: %v\n", err)
 	}
 
-	fmt.Printf("Matrix credentials obtained. User ID: %s, Device ID: %s\n", client.UserID, client.DeviceID)
+	fmt.Fprintf(progressWriter(), "Matrix credentials obtained. User ID: %s, Device ID: %s\n", client.UserID, client.DeviceID)
 	return client, nil
 }
 
+// DeviceID returns the ID of the Matrix device the archive uses: the
+// profile's own device if it has one, or MATRIXARCH
+func (b *BeeperAuth) DeviceID() id.DeviceID {
+	if b.MatrixDeviceID != "" {
+		return id.DeviceID(b.MatrixDeviceID)
+	}
+	return beeperDeviceID
+}
+
+// NewDevice switches to a new device with a random ID, which the next login
+// creates. Its access token is dropped, since it belongs to the old device.
+func (b *BeeperAuth) NewDevice() {
+	b.MatrixDeviceID = archiveDevicePrefix + strings.ToUpper(random.String(8))
+	b.MatrixToken = ""
+}
+
+// DeviceDisplayName returns the name the archive gives its device on the
+// account, so it can be recognized in a client's device list
+func DeviceDisplayName(profile string) string {
+	if profile == "" {
+		return "matrix-archive"
+	}
+	return fmt.Sprintf("matrix-archive (%s)", profile)
+}
+
 // promptEmail prompts the user for their email address
 func (b *BeeperAuth) promptEmail() (string, error) {
 	// Check if we're in an interactive terminal
@@ -198,15 +341,18 @@ func IsTerminalInteractive() bool {
 
 // SaveCredentials saves the authentication credentials to both environment variables and file
 func (b *BeeperAuth) SaveCredentials() {
-	// Save to environment variables (for current session)
-	if b.Token != "" {
-		os.Setenv("BEEPER_TOKEN", b.Token)
-	}
-	if b.Email != "" {
-		os.Setenv("BEEPER_EMAIL", b.Email)
-	}
-	if b.Whoami != nil {
-		os.Setenv("BEEPER_USERNAME", b.Whoami.UserInfo.Username)
+	// Save to environment variables (for current session). These are the
+	// default account's; named profiles only read their file.
+	if b.Profile == "" {
+		if b.Token != "" {
+			os.Setenv("BEEPER_TOKEN", b.Token)
+		}
+		if b.Email != "" {
+			os.Setenv("BEEPER_EMAIL", b.Email)
+		}
+		if b.Whoami != nil {
+			os.Setenv("BEEPER_USERNAME", b.Whoami.UserInfo.Username)
+		}
 	}
 
 	// Save to file (for persistent storage)
@@ -219,9 +365,13 @@ func (b *BeeperAuth) SaveCredentials() {
 
 // LoadCredentials loads authentication credentials from file and environment variables
 func (b *BeeperAuth) LoadCredentials() bool {
-	// First try to load from environment variables
+	// First try to load from environment variables (default profile only)
 	envToken := os.Getenv("BEEPER_TOKEN")
 	envEmail := os.Getenv("BEEPER_EMAIL")
+	if b.Profile != "" {
+		envToken = ""
+		envEmail = ""
+	}
 
 	// Then try to load from file
 	fileLoaded := b.LoadCredentialsFromFile()
@@ -247,25 +397,26 @@ func (b *BeeperAuth) LoadCredentials() bool {
 		return true
 	}
 
-	return fileLoaded && b.Token != ""
+	// A Matrix access token from LoginWithMatrixToken works without a Beeper token
+	return fileLoaded && (b.Token != "" || (b.MatrixToken != "" && b.MatrixUserID != ""))
 }
 
 // getCredentialsFilePath returns the path to the credentials file
 func (b *BeeperAuth) GetCredentialsFilePath() (string, error) {
-	// Get user's home directory
-	homeDir, err := os.UserHomeDir()
+	// Create .matrix-archive directory if it doesn't exist
+	configDir, err := ConfigDir()
 	if err != nil {
-		return "", fmt.Errorf("failed to get home directory: %w", err)
+		return "", err
 	}
-
-	// Create .matrix-archive directory if it doesn't exist
-	configDir := filepath.Join(homeDir, ".matrix-archive")
 	if err := os.MkdirAll(configDir, 0700); err != nil {
 		return "", fmt.Errorf("failed to create config directory: %w", err)
 	}
 
 	// Return path to credentials file
 	filename := fmt.Sprintf("beeper-credentials-%s.json", b.BaseDomain)
+	if b.Profile != "" {
+		filename = fmt.Sprintf("beeper-credentials-%s-%s.json", b.BaseDomain, b.Profile)
+	}
 	return filepath.Join(configDir, filename), nil
 }
 
@@ -278,6 +429,7 @@ func (b *BeeperAuth) SaveCredentialsToFile() error {
 
 	creds := BeeperCredentials{
 		BaseDomain:     b.BaseDomain,
+		Profile:        b.Profile,
 		Email:          b.Email,
 		Token:          b.Token,
 		Whoami:         b.Whoami,
@@ -319,18 +471,18 @@ func (b *BeeperAuth) LoadCredentialsFromFile() bool {
 
 	data, err := os.ReadFile(filePath)
 	if err != nil {
-		fmt.Printf("Warning: Failed to read credentials file: %v\n", err)
+		fmt.Fprintf(progressWriter(), "Warning: Failed to read credentials file: %v\n", err)
 		return false
 	}
 
 	var creds BeeperCredentials
 	if err := json.Unmarshal(data, &creds); err != nil {
-		fmt.Printf("Warning: Failed to parse credentials file: %v\n", err)
+		fmt.Fprintf(progressWriter(), "Warning: Failed to parse credentials file: %v\n", err)
 		return false
 	}
 
-	// Only load if the domain matches
-	if creds.BaseDomain != b.BaseDomain {
+	// Only load if the domain and profile match
+	if creds.BaseDomain != b.BaseDomain || creds.Profile != b.Profile {
 		return false
 	}
 
@@ -341,7 +493,7 @@ func (b *BeeperAuth) LoadCredentialsFromFile() bool {
 	b.MatrixUserID = creds.MatrixUserID
 	b.MatrixDeviceID = creds.MatrixDeviceID
 
-	fmt.Printf("Loaded credentials for %s from file\n", creds.Email)
+	fmt.Fprintf(progressWriter(), "Loaded credentials for %s from file\n", creds.Email)
 	return true
 }
 
@@ -352,7 +504,6 @@ func (b *BeeperAuth) clearInvalidCredentials() {
 	b.Whoami = nil
 	b.MatrixToken = ""
 	b.MatrixUserID = ""
-	b.MatrixDeviceID = ""
 
 	// Clear environment variables
 	os.Unsetenv("BEEPER_TOKEN")
@@ -372,8 +523,9 @@ func (b *BeeperAuth) clearInvalidCredentials() {
 func (b *BeeperAuth) ClearCredentials() error {
 	b.clearInvalidCredentials()
 
-	// Also clear email since we're doing a full logout
+	// Also clear email and device since we're doing a full logout
 	b.Email = ""
+	b.MatrixDeviceID = ""
 	os.Unsetenv("BEEPER_EMAIL")
 
 	fmt.Println("All Beeper credentials cleared")
@@ -385,22 +537,60 @@ func (b *BeeperAuth) GetMatrixDeviceID() string {
 	return b.MatrixDeviceID
 }
 
-// PerformBeeperLogin performs Beeper authentication with the given domain
-func PerformBeeperLogin(domain string, interactive bool) error {
-	auth := NewBeeperAuth(domain)
+// loginAuth returns the credentials to log in to the active profile with. The
+// profile keeps its device, or switches to a new random one with newDevice.
+func loginAuth(domain string, newDevice bool) *BeeperAuth {
+	auth := NewBeeperAuthForProfile(domain, ActiveProfile())
+	if saved := NewBeeperAuthForProfile(domain, ActiveProfile()); saved.LoadCredentialsFromFile() {
+		auth.MatrixDeviceID = saved.MatrixDeviceID
+	}
+	if newDevice {
+		auth.NewDevice()
+		fmt.Printf("Using new device %s\n", auth.MatrixDeviceID)
+	}
+	return auth
+}
+
+// PerformBeeperLogin performs Beeper authentication with the given domain.
+// newDevice gives the profile its own device with a random ID instead of
+// MATRIXARCH.
+func PerformBeeperLogin(domain string, interactive, newDevice bool) error {
+	auth := loginAuth(domain, newDevice)
 
 	if !interactive && !IsTerminalInteractive() {
 		return fmt.Errorf("cannot perform interactive login in non-interactive mode - please run 'matrix-archive beeper-login' in a terminal")
 	}
 
 	fmt.Printf("Starting Beeper authentication for domain: %s\n", domain)
+	if auth.Profile != "" {
+		fmt.Printf("Using account profile: %s\n", auth.Profile)
+	}
+
+	if err := auth.Login(); err != nil {
+		return err
+	}
+
+	auth.SaveCredentials()
+	return nil
+}
+
+// PerformBeeperTokenLogin logs in to Beeper with a Beeper API token without
+// prompting, for servers and automation where the email login can't be used
+func PerformBeeperTokenLogin(domain, token string, newDevice bool) error {
+	auth := loginAuth(domain, newDevice)
+	return auth.LoginWithToken(token)
+}
 
-	return auth.Login()
+// PerformMatrixTokenLogin logs in to a Beeper account with a Matrix access
+// token and user ID without prompting
+func PerformMatrixTokenLogin(domain, accessToken, userID string) error {
+	auth := NewBeeperAuthForProfile(domain, ActiveProfile())
+	return auth.LoginWithMatrixToken(accessToken, userID)
 }
 
 // PerformBeeperLogout clears Beeper credentials for the given domain
 func PerformBeeperLogout(domain string) error {
-	auth := NewBeeperAuth(domain)
+	auth := NewBeeperAuthForProfile(domain, ActiveProfile())
 
 	if err := auth.ClearCredentials(); err != nil {
 		return fmt.Errorf("failed to clear credentials: %w", err)
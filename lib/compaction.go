@@ -0,0 +1,223 @@
+package archive
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// CompactEnv, set to true, stores new messages compacted; see CompactFormattedBody
+const CompactEnv = "MATRIX_ARCHIVE_COMPACT"
+
+// CompactedFormatField replaces a formatted_body that CompactFormattedBody
+// dropped, with the code of the rendering of the plain body that rebuilds it.
+// It is kept short, since it is stored in place of short formatted bodies too.
+const CompactedFormatField = "mxa.fb"
+
+// legacyCompactedFormatField is the field earlier versions stored, naming the
+// rendering in full
+const legacyCompactedFormatField = "com.github.osteele.matrix_archive.formatted_body"
+
+// plainRenderings are the ways bridges render a plain body as HTML, by code
+// and by the name earlier versions stored. A formatted_body that is one of
+// these adds nothing to the plain body.
+var plainRenderings = []struct {
+	code   string
+	name   string
+	render func(body string) string
+}{
+	{"e", "escaped", func(body string) string { return renderPlain(body, htmlTextEscaper.Replace, "<br>") }},
+	{"e/", "escaped-br/", func(body string) string { return renderPlain(body, htmlTextEscaper.Replace, "<br/>") }},
+	{"q", "escaped-quotes", func(body string) string { return renderPlain(body, html.EscapeString, "<br>") }},
+	{"p", "paragraph", func(body string) string { return "<p>" + renderPlain(body, htmlTextEscaper.Replace, "<br>") + "</p>" }},
+}
+
+// htmlTextEscaper escapes the characters that are markup in HTML text, but
+// not quotes, which only need escaping in attributes
+var htmlTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// renderPlain escapes a plain body as HTML and breaks its lines with br
+func renderPlain(body string, escape func(string) string, br string) string {
+	return strings.ReplaceAll(escape(body), "\n", br)
+}
+
+// CompactFormattedBody returns content without its formatted_body if that is
+// only the plain body rendered as HTML, as many bridges send it, and reports
+// whether it dropped one. Content is only compacted if that makes it smaller. The formatted_body of an edit's m.new_content is
+// compacted too. ExpandFormattedBody rebuilds exactly what was dropped.
+func CompactFormattedBody(content map[string]interface{}) (map[string]interface{}, bool) {
+	compacted, changed := compactFormattedBody(content)
+	if newContent, ok := content["m.new_content"].(map[string]interface{}); ok {
+		if compactedNew, ok := compactFormattedBody(newContent); ok {
+			if !changed {
+				compacted = copyContent(content)
+			}
+			compacted["m.new_content"] = compactedNew
+			changed = true
+		}
+	}
+	return compacted, changed
+}
+
+func compactFormattedBody(content map[string]interface{}) (map[string]interface{}, bool) {
+	body, ok := content["body"].(string)
+	if !ok {
+		return content, false
+	}
+	formatted, ok := content["formatted_body"].(string)
+	if !ok {
+		return content, false
+	}
+	for _, rendering := range plainRenderings {
+		if rendering.render(body) == formatted {
+			compacted := copyContent(content)
+			delete(compacted, "formatted_body")
+			compacted[CompactedFormatField] = rendering.code
+			return compacted, contentSize(compacted) < contentSize(content)
+		}
+	}
+	return content, false
+}
+
+// contentSize returns the length of content serialized as JSON
+func contentSize(content map[string]interface{}) int {
+	data, err := json.Marshal(content)
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
+
+// ExpandFormattedBody rebuilds in place the formatted_body that
+// CompactFormattedBody dropped from content, and from its m.new_content
+func ExpandFormattedBody(content map[string]interface{}) {
+	expandFormattedBody(content)
+	if newContent, ok := content["m.new_content"].(map[string]interface{}); ok {
+		expandFormattedBody(newContent)
+	}
+}
+
+func expandFormattedBody(content map[string]interface{}) {
+	for _, field := range []string{CompactedFormatField, legacyCompactedFormatField} {
+		code, ok := content[field].(string)
+		if !ok {
+			continue
+		}
+		body, _ := content["body"].(string)
+		for _, rendering := range plainRenderings {
+			if code == rendering.code || code == rendering.name {
+				content["formatted_body"] = rendering.render(body)
+				delete(content, field)
+				return
+			}
+		}
+	}
+}
+
+func copyContent(content map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(content))
+	for key, value := range content {
+		copied[key] = value
+	}
+	return copied
+}
+
+// compactFromEnv reports whether MATRIX_ARCHIVE_COMPACT asks for new messages
+// to be stored compacted
+func compactFromEnv() bool {
+	compact, _ := strconv.ParseBool(os.Getenv(CompactEnv))
+	return compact
+}
+
+// CompactExistingContent drops the redundant formatted_body of archived
+// messages. It returns the number of messages compacted and the bytes of
+// content saved. Content encrypted without the passphrase at hand
+// is left alone.
+func (d *DuckDBDatabase) CompactExistingContent(ctx context.Context) (int, int64, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT event_id, content::VARCHAR FROM messages WHERE content IS NOT NULL")
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to query messages: %w", err)
+	}
+
+	pending := make(map[string]string)
+	var saved int64
+	for rows.Next() {
+		var eventID string
+		var contentJSON sql.NullString
+		if err := rows.Scan(&eventID, &contentJSON); err != nil {
+			rows.Close()
+			return 0, 0, fmt.Errorf("failed to scan message: %w", err)
+		}
+		message := &Message{EventID: eventID}
+		if err := d.decodeContent(message, contentJSON.String); err != nil {
+			continue
+		}
+		compacted, ok := CompactFormattedBody(message.Content)
+		if !ok {
+			continue
+		}
+		message.Content = compacted
+		compactedJSON, err := d.encodeContent(message)
+		if err != nil {
+			rows.Close()
+			return 0, 0, fmt.Errorf("failed to serialize message %s: %w", eventID, err)
+		}
+		// Compare what is stored, which may be encrypted, to what is replaced
+		if len(compactedJSON) < len(contentJSON.String) {
+			saved += int64(len(contentJSON.String) - len(compactedJSON))
+			pending[eventID] = compactedJSON
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for eventID, contentJSON := range pending {
+		if _, err := tx.ExecContext(ctx, "UPDATE messages SET content = ? WHERE event_id = ?", contentJSON, eventID); err != nil {
+			return 0, 0, fmt.Errorf("failed to update message %s: %w", eventID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	// Write the smaller rows out so the file can shrink
+	if _, err := d.db.ExecContext(ctx, "CHECKPOINT"); err != nil {
+		return 0, 0, fmt.Errorf("failed to checkpoint database: %w", err)
+	}
+
+	return len(pending), saved, nil
+}
+
+// CompactDatabase drops the formatted_body of archived messages that only
+// repeats their plain body as HTML
+func CompactDatabase() error {
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	count, saved, err := GetDatabase().CompactExistingContent(context.Background())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Compacted %d messages, saving %s of content\n", count, FormatSize(saved))
+	if !compactFromEnv() {
+		fmt.Printf("Set %s=true to store new messages compacted too\n", CompactEnv)
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Kinds of gap reported in a CompletenessReport
+const (
+	GapUnimportedHistory = "unimported_history" // a throttled import stopped before reaching the start of the room
+	GapMissingEvent      = "missing_event"      // a reply, reaction or edit refers to an event that isn't archived
+)
+
+// CompletenessReport describes what an export covers and what it is missing, so
+// downstream consumers don't have to guess whether an archive is whole
+type CompletenessReport struct {
+	RoomID        string         `json:"room_id"`
+	GeneratedAt   time.Time      `json:"generated_at"`
+	FirstEvent    *ReportEvent   `json:"first_event,omitempty"`
+	LastEvent     *ReportEvent   `json:"last_event,omitempty"`
+	EventCount    int            `json:"event_count"`
+	CountsByType  map[string]int `json:"counts_by_type"`
+	Undecryptable int            `json:"undecryptable"`
+	MediaCount    int            `json:"media_count"`
+	MediaMissing  int            `json:"media_not_downloaded"`
+	OptedOut      int            `json:"opted_out"` // Messages the export withheld because their senders opted out
+	Gaps          []ReportGap    `json:"gaps"`
+	Complete      bool           `json:"complete"`
+}
+
+// ReportEvent identifies one end of the range of events in a report
+type ReportEvent struct {
+	EventID   string    `json:"event_id"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ReportGap is something known to be missing from an export
+type ReportGap struct {
+	Kind    string `json:"kind"`
+	EventID string `json:"event_id,omitempty"`
+	Detail  string `json:"detail"`
+
+	// For missing events, the relation that refers to the event and, if an
+	// import recorded it, when the relation was first found unresolved
+	RelType         string     `json:"rel_type,omitempty"`
+	UnresolvedSince *time.Time `json:"unresolved_since,omitempty"`
+}
+
+// BuildCompletenessReport summarizes a room's archived events. mediaDirs are the
+// directories download-images saves to; state is the room's saved import
+// position, or nil if it has none.
+func BuildCompletenessReport(roomID string, messages []*Message, mediaDirs []string, state *ImportState) *CompletenessReport {
+	report := &CompletenessReport{
+		RoomID:       roomID,
+		GeneratedAt:  time.Now().UTC(),
+		EventCount:   len(messages),
+		CountsByType: make(map[string]int),
+		Gaps:         []ReportGap{},
+	}
+
+	archived := make(map[string]bool, len(messages))
+	for _, msg := range messages {
+		archived[msg.EventID] = true
+	}
+
+	for _, msg := range messages {
+		if report.FirstEvent == nil || msg.Timestamp.Before(report.FirstEvent.Timestamp) {
+			report.FirstEvent = &ReportEvent{EventID: msg.EventID, Timestamp: msg.Timestamp}
+		}
+		if report.LastEvent == nil || msg.Timestamp.After(report.LastEvent.Timestamp) {
+			report.LastEvent = &ReportEvent{EventID: msg.EventID, Timestamp: msg.Timestamp}
+		}
+
+		report.CountsByType[reportEventType(msg)]++
+
+		if isUndecryptable(msg) {
+			report.Undecryptable++
+		}
+
+		if isMedia(msg) {
+			report.MediaCount++
+			if !mediaDownloaded(msg, mediaDirs) {
+				report.MediaMissing++
+			}
+		}
+
+		for _, rel := range eventRelations(msg) {
+			if !archived[rel.target] {
+				report.Gaps = append(report.Gaps, ReportGap{
+					Kind:    GapMissingEvent,
+					EventID: rel.target,
+					Detail:  fmt.Sprintf("referenced by %s", msg.EventID),
+					RelType: rel.relType,
+				})
+			}
+		}
+	}
+
+	if state != nil && !state.Complete && state.NextBatch != "" {
+		report.Gaps = append([]ReportGap{{
+			Kind:   GapUnimportedHistory,
+			Detail: "history before the first archived event has not been imported; run import again to continue",
+		}}, report.Gaps...)
+	}
+
+	report.Complete = report.Undecryptable == 0 && report.MediaMissing == 0 && len(report.Gaps) == 0
+	return report
+}
+
+// AddUnresolvedSince notes on each missing-event gap when an import first
+// recorded the relation that refers to the event as unresolved
+func (r *CompletenessReport) AddUnresolvedSince(relations []*UnresolvedRelation) {
+	firstSeen := make(map[string]time.Time, len(relations))
+	for _, rel := range relations {
+		if seen, ok := firstSeen[rel.TargetEventID]; !ok || rel.FirstSeen.Before(seen) {
+			firstSeen[rel.TargetEventID] = rel.FirstSeen
+		}
+	}
+	for i := range r.Gaps {
+		if seen, ok := firstSeen[r.Gaps[i].EventID]; ok && r.Gaps[i].Kind == GapMissingEvent {
+			r.Gaps[i].UnresolvedSince = &seen
+		}
+	}
+}
+
+// reportEventType is the msgtype of a message, or the event type of other events
+func reportEventType(msg *Message) string {
+	eventType := msg.MessageType
+	if eventType == "" {
+		eventType = inferEventType(msg.Content)
+	}
+	if eventType == EventTypeMessage {
+		if msgtype := msg.msgTypeForStorage(); msgtype != "" {
+			return msgtype
+		}
+	}
+	return eventType
+}
+
+// isUndecryptable reports whether a message was stored as an encrypted placeholder
+func isUndecryptable(msg *Message) bool {
+	return msg.MessageType == EventTypeEncrypted || inferEventType(msg.Content) == EventTypeEncrypted
+}
+
+// isMedia reports whether a message carries an uploaded file
+func isMedia(msg *Message) bool {
+	if url, _ := msg.Content["url"].(string); url != "" {
+		return true
+	}
+	_, encrypted := msg.Content["file"]
+	return encrypted
+}
+
+// mediaDownloaded reports whether download-images saved the message's file to
+// one of dirs. Only images are downloaded, so other media always count as missing.
+func mediaDownloaded(msg *Message, dirs []string) bool {
+	if !msg.IsImage() {
+		return false
+	}
+	for _, dir := range dirs {
+		for _, thumbnails := range []bool{true, false} {
+			stem := GetDownloadStem(*msg, thumbnails)
+			if stem != "" && findDownloadedImage(dir, stem) != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// relatedEventIDs returns the events a message replies to, reacts to or edits
+func relatedEventIDs(msg *Message) []string {
+	relatesTo, ok := msg.Content["m.relates_to"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	var ids []string
+	if eventID, _ := relatesTo["event_id"].(string); eventID != "" {
+		ids = append(ids, eventID)
+	}
+	if reply, ok := relatesTo["m.in_reply_to"].(map[string]interface{}); ok {
+		if eventID, _ := reply["event_id"].(string); eventID != "" {
+			ids = append(ids, eventID)
+		}
+	}
+	return ids
+}
+
+// writeCompletenessReport writes the completeness report for an exported room
+// as JSON. messages are the room's archived messages, of which the export
+// withheld optedOut.
+func writeCompletenessReport(ctx context.Context, path, roomID string, messages []*Message, optedOut int) error {
+	state, err := GetDatabase().GetImportState(ctx, roomID)
+	if err != nil {
+		return err
+	}
+
+	report := BuildCompletenessReport(roomID, messages, exportMediaDirs, state)
+	report.OptedOut = optedOut
+	relations, err := GetDatabase().GetUnresolvedRelations(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	report.AddUnresolvedSince(relations)
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode completeness report: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write completeness report: %w", err)
+	}
+
+	fmt.Printf("Wrote completeness report to %q\n", path)
+	return nil
+}
@@ -0,0 +1,128 @@
+package archive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFile is the name of the settings file in the configuration directory
+const ConfigFile = "config.yaml"
+
+// Config holds the settings in ~/.matrix-archive/config.yaml, which init
+// writes. Each setting stands in for an environment variable; a variable
+// that is set, in the shell or in a .env file, wins over the file.
+type Config struct {
+	Database     string `yaml:"database,omitempty"`      // Archive database file, as DUCKDB_URL
+	BeeperDomain string `yaml:"beeper_domain,omitempty"` // Beeper domain, as BEEPER_DOMAIN
+
+	// Detect the language of messages as they're imported, as
+	// MATRIX_ARCHIVE_DETECT_LANGUAGE
+	DetectLanguage bool `yaml:"detect_language,omitempty"`
+
+	// Template and theme of HTML and text exports of particular rooms, the
+	// first matching rule applying. --template and --theme override them.
+	ExportTemplates []RoomTemplate `yaml:"export_templates,omitempty"`
+
+	// External commands run before and after imports and exports
+	Hooks Hooks `yaml:"hooks,omitempty"`
+}
+
+// RoomTemplate sets the template and theme of exports of the rooms matching
+// Room or carrying Tag. Empty fields keep the export's own settings.
+type RoomTemplate struct {
+	Room     string `yaml:"room,omitempty"`     // Room ID, or a pattern with * such as !*:example.org
+	Tag      string `yaml:"tag,omitempty"`      // Room tag, such as m.favourite or u.announcements
+	Template string `yaml:"template,omitempty"` // Template name (default, enhanced, accessible) or path
+	Theme    string `yaml:"theme,omitempty"`    // light, dark or auto
+}
+
+// env returns the environment variables the settings stand in for
+func (c *Config) env() map[string]string {
+	env := map[string]string{
+		"DUCKDB_URL":    c.Database,
+		"BEEPER_DOMAIN": c.BeeperDomain,
+	}
+	if c.DetectLanguage {
+		env[DetectLanguageEnv] = "true"
+	}
+	return env
+}
+
+// ConfigDir returns the directory that holds the configuration file and
+// Beeper credentials, ~/.matrix-archive
+func ConfigDir() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	return filepath.Join(homeDir, ".matrix-archive"), nil
+}
+
+// ConfigPath returns the path of the configuration file
+func ConfigPath() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, ConfigFile), nil
+}
+
+// LoadConfig reads the configuration file, or returns nil if there is none
+func LoadConfig() (*Config, error) {
+	path, err := ConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration: %w", err)
+	}
+	cfg := &Config{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse configuration in %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Save writes the configuration file, creating its directory if needed
+func (c *Config) Save() error {
+	path, err := ConfigPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("failed to encode configuration: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write configuration: %w", err)
+	}
+	return nil
+}
+
+// ApplyConfig sets the environment variables that the configuration file's
+// settings stand in for, leaving those that are already set alone
+func ApplyConfig() error {
+	cfg, err := LoadConfig()
+	if err != nil || cfg == nil {
+		return err
+	}
+	for name, value := range cfg.env() {
+		if value == "" {
+			continue
+		}
+		if _, set := os.LookupEnv(name); !set {
+			os.Setenv(name, value)
+		}
+	}
+	return nil
+}
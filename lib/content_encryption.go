@@ -0,0 +1,406 @@
+package archive
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// encryptedContentKey marks a content column holding an encrypted payload
+// instead of the event content itself
+const encryptedContentKey = "$encrypted_v1"
+
+// encryptionVerifierPlaintext is encrypted with the archive key so a wrong
+// passphrase is detected on connect instead of on the first message read
+const encryptionVerifierPlaintext = "matrix-archive"
+
+// Settings keys used for content encryption
+const (
+	settingEncryptionSalt     = "encryption_salt"
+	settingEncryptionVerifier = "encryption_verifier"
+)
+
+// ErrContentEncrypted is returned when reading encrypted content without a passphrase
+var ErrContentEncrypted = errors.New("message content is encrypted; set MATRIX_ARCHIVE_PASSPHRASE to read it")
+
+// ErrPassphraseRequired is returned when writing content to an encrypted
+// archive opened without its passphrase, which would store it in plaintext
+var ErrPassphraseRequired = errors.New("the archive is encrypted; set MATRIX_ARCHIVE_PASSPHRASE to add to it")
+
+// contentCipher encrypts message content with AES-256-GCM using a key derived
+// from the archive passphrase
+type contentCipher struct {
+	aead cipher.AEAD
+}
+
+// newContentCipher derives the content key from a passphrase and salt
+func newContentCipher(passphrase string, salt []byte) (*contentCipher, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive encryption key: %w", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+
+	return &contentCipher{aead: aead}, nil
+}
+
+// seal encrypts plaintext and returns base64(nonce || ciphertext)
+func (c *contentCipher) seal(plaintext []byte) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := c.aead.Seal(nonce, nonce, plaintext, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open reverses seal
+func (c *contentCipher) open(encoded string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encrypted payload: %w", err)
+	}
+	nonceSize := c.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, fmt.Errorf("invalid encrypted payload: too short")
+	}
+	plaintext, err := c.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt content (wrong passphrase?): %w", err)
+	}
+	return plaintext, nil
+}
+
+// encryptContentJSON wraps serialized content in an encrypted envelope that is
+// still valid JSON, so the content column keeps its type
+func (c *contentCipher) encryptContentJSON(contentJSON string) (string, error) {
+	payload, err := c.seal([]byte(contentJSON))
+	if err != nil {
+		return "", err
+	}
+	envelope, err := json.Marshal(map[string]string{encryptedContentKey: payload})
+	if err != nil {
+		return "", err
+	}
+	return string(envelope), nil
+}
+
+// encryptedPayload returns the payload of an encrypted envelope, if contentJSON is one
+func encryptedPayload(contentJSON string) (string, bool) {
+	var envelope map[string]interface{}
+	if err := json.Unmarshal([]byte(contentJSON), &envelope); err != nil || len(envelope) != 1 {
+		return "", false
+	}
+	payload, ok := envelope[encryptedContentKey].(string)
+	return payload, ok
+}
+
+// sealText encrypts text derived from message content, such as OCR text, in
+// the same envelope as content when a passphrase is configured
+func (d *DuckDBDatabase) sealText(text string) (string, error) {
+	if d.locked {
+		return "", ErrPassphraseRequired
+	}
+	if d.cipher == nil {
+		return text, nil
+	}
+	return d.cipher.encryptContentJSON(text)
+}
+
+// openText reverses sealText, returning plaintext values as they are
+func (d *DuckDBDatabase) openText(stored string) (string, error) {
+	payload, ok := encryptedPayload(stored)
+	if !ok {
+		return stored, nil
+	}
+	if d.cipher == nil {
+		return "", ErrContentEncrypted
+	}
+	plaintext, err := d.cipher.open(payload)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// IsEncryptedContent reports whether a stored content value is an encrypted envelope
+func IsEncryptedContent(contentJSON string) bool {
+	_, ok := encryptedPayload(contentJSON)
+	return ok
+}
+
+// setupEncryption loads or creates the archive's key salt and checks the passphrase
+func (d *DuckDBDatabase) setupEncryption(ctx context.Context) error {
+	salt, err := d.getSetting(ctx, settingEncryptionSalt)
+	if err != nil {
+		return err
+	}
+
+	if salt == "" {
+		saltBytes := make([]byte, 16)
+		if _, err := rand.Read(saltBytes); err != nil {
+			return fmt.Errorf("failed to generate salt: %w", err)
+		}
+		salt = base64.StdEncoding.EncodeToString(saltBytes)
+
+		c, err := newContentCipher(d.config.Passphrase, saltBytes)
+		if err != nil {
+			return err
+		}
+		verifier, err := c.seal([]byte(encryptionVerifierPlaintext))
+		if err != nil {
+			return err
+		}
+
+		if err := d.setSetting(ctx, settingEncryptionSalt, salt); err != nil {
+			return err
+		}
+		if err := d.setSetting(ctx, settingEncryptionVerifier, verifier); err != nil {
+			return err
+		}
+		d.cipher = c
+		return nil
+	}
+
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return fmt.Errorf("invalid encryption salt in database: %w", err)
+	}
+	c, err := newContentCipher(d.config.Passphrase, saltBytes)
+	if err != nil {
+		return err
+	}
+
+	verifier, err := d.getSetting(ctx, settingEncryptionVerifier)
+	if err != nil {
+		return err
+	}
+	if plaintext, err := c.open(verifier); err != nil || string(plaintext) != encryptionVerifierPlaintext {
+		return fmt.Errorf("incorrect passphrase for encrypted archive")
+	}
+
+	d.cipher = c
+	return nil
+}
+
+// encodeContent serializes message content for storage, encrypting it when a passphrase is configured
+func (d *DuckDBDatabase) encodeContent(message *Message) (string, error) {
+	if d.locked {
+		return "", ErrPassphraseRequired
+	}
+	if d.config.Compact {
+		if compacted, ok := CompactFormattedBody(message.Content); ok {
+			stored := *message
+			stored.Content = compacted
+			message = &stored
+		}
+	}
+	if d.cipher != nil && message.AuthorName != "" {
+		stored := *message
+		stored.Content = withStoredAuthor(message.Content, message.AuthorName, message.AuthorPlatform)
+		message = &stored
+	}
+	contentJSON, err := message.ContentJSON()
+	if err != nil {
+		return "", err
+	}
+	if d.cipher == nil {
+		return contentJSON, nil
+	}
+	return d.cipher.encryptContentJSON(contentJSON)
+}
+
+// contentHashForStorage returns the message's normalized content hash, or NULL
+// when content is encrypted, since a hash of short messages would reveal them
+func (d *DuckDBDatabase) contentHashForStorage(message *Message) sql.NullString {
+	if d.cipher != nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: NormalizedContentHash(message), Valid: true}
+}
+
+// decodeContent restores message content from its stored form, decrypting it if needed
+func (d *DuckDBDatabase) decodeContent(message *Message, contentJSON string) error {
+	if payload, ok := encryptedPayload(contentJSON); ok {
+		if d.cipher == nil {
+			return ErrContentEncrypted
+		}
+		plaintext, err := d.cipher.open(payload)
+		if err != nil {
+			return err
+		}
+		contentJSON = string(plaintext)
+	}
+	if err := message.SetContentFromJSON(contentJSON); err != nil {
+		return err
+	}
+	ExpandFormattedBody(message.Content)
+	takeStoredAuthor(message)
+	return nil
+}
+
+// EncryptExistingContent encrypts any message content still stored in plaintext.
+// It returns the number of messages encrypted.
+func (d *DuckDBDatabase) EncryptExistingContent(ctx context.Context) (int, error) {
+	if d.cipher == nil {
+		return 0, fmt.Errorf("no passphrase configured; set MATRIX_ARCHIVE_PASSPHRASE")
+	}
+
+	rows, err := d.db.QueryContext(ctx, "SELECT event_id, content::VARCHAR, COALESCE(author_name, ''), COALESCE(author_platform, '') FROM messages WHERE content IS NOT NULL")
+	if err != nil {
+		return 0, fmt.Errorf("failed to query messages: %w", err)
+	}
+
+	pending := make(map[string]string)
+	for rows.Next() {
+		var eventID, contentJSON, authorName, authorPlatform string
+		if err := rows.Scan(&eventID, &contentJSON, &authorName, &authorPlatform); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan message: %w", err)
+		}
+		if IsEncryptedContent(contentJSON) {
+			continue
+		}
+		if authorName != "" {
+			// The author columns are cleared, so the content keeps the author
+			message := &Message{EventID: eventID}
+			if err := message.SetContentFromJSON(contentJSON); err != nil {
+				rows.Close()
+				return 0, fmt.Errorf("failed to parse message %s: %w", eventID, err)
+			}
+			message.Content = withStoredAuthor(message.Content, authorName, authorPlatform)
+			if contentJSON, err = message.ContentJSON(); err != nil {
+				rows.Close()
+				return 0, fmt.Errorf("failed to serialize message %s: %w", eventID, err)
+			}
+		}
+		pending[eventID] = contentJSON
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for eventID, contentJSON := range pending {
+		encrypted, err := d.cipher.encryptContentJSON(contentJSON)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encrypt message %s: %w", eventID, err)
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE messages SET content = ?, content_hash = NULL, forwarded_from = NULL, forwarded_platform = NULL, file_name = NULL, file_mimetype = NULL, file_size = NULL, author_name = NULL, author_platform = NULL, aggregations = NULL, lang = NULL WHERE event_id = ?", encrypted, eventID); err != nil {
+			return 0, fmt.Errorf("failed to update message %s: %w", eventID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	if err := d.encryptExistingMediaText(ctx); err != nil {
+		return 0, err
+	}
+
+	return len(pending), nil
+}
+
+// encryptExistingMediaText encrypts OCR text stored before a passphrase was set
+func (d *DuckDBDatabase) encryptExistingMediaText(ctx context.Context) error {
+	rows, err := d.db.QueryContext(ctx, "SELECT event_id, text FROM media_text")
+	if err != nil {
+		return fmt.Errorf("failed to query media text: %w", err)
+	}
+
+	pending := make(map[string]string)
+	for rows.Next() {
+		var eventID, text string
+		if err := rows.Scan(&eventID, &text); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan media text: %w", err)
+		}
+		if !IsEncryptedContent(text) {
+			pending[eventID] = text
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating media text: %w", err)
+	}
+
+	for eventID, text := range pending {
+		sealed, err := d.sealText(text)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt media text %s: %w", eventID, err)
+		}
+		if _, err := d.db.ExecContext(ctx, "UPDATE media_text SET text = ? WHERE event_id = ?", sealed, eventID); err != nil {
+			return fmt.Errorf("failed to update media text %s: %w", eventID, err)
+		}
+	}
+	return nil
+}
+
+// getSetting reads a value from the archive_settings table, returning "" if unset
+func (d *DuckDBDatabase) getSetting(ctx context.Context, key string) (string, error) {
+	var value string
+	err := d.db.QueryRowContext(ctx, "SELECT value FROM archive_settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read setting %s: %w", key, err)
+	}
+	return value, nil
+}
+
+// setSetting stores a value in the archive_settings table
+func (d *DuckDBDatabase) setSetting(ctx context.Context, key, value string) error {
+	_, err := d.db.ExecContext(ctx,
+		"INSERT INTO archive_settings (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value",
+		key, value)
+	if err != nil {
+		return fmt.Errorf("failed to write setting %s: %w", key, err)
+	}
+	return nil
+}
+
+// EncryptDatabase encrypts the content of messages archived before a passphrase was set
+func EncryptDatabase() error {
+	if os.Getenv("MATRIX_ARCHIVE_PASSPHRASE") == "" {
+		return fmt.Errorf("MATRIX_ARCHIVE_PASSPHRASE must be set to encrypt the archive")
+	}
+
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	count, err := GetDatabase().EncryptExistingContent(context.Background())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Encrypted content of %d messages\n", count)
+	return nil
+}
@@ -0,0 +1,116 @@
+package archive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// NormalizedContentHash returns a hash of what a message says rather than how
+// it was delivered. Unlike ContentHash, it leaves out the room, the event's
+// own ID, media URLs, HTML formatting, reply fallbacks and bridge metadata,
+// and compares timestamps to the second, so the same message re-bridged into
+// a new portal room or under a new event ID hashes the same. The event a
+// reply, reaction or edit relates to is kept: the same reaction to two events
+// is two messages.
+func NormalizedContentHash(message *Message) string {
+	content := message.Content
+	if message.MessageType != EventTypeEncrypted {
+		content = normalizeContent(message.Content)
+	}
+	// json.Marshal sorts map keys, so equal content always serializes the same way
+	data, _ := json.Marshal(content)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%s\x00", message.Sender, message.Timestamp.Unix(), message.MessageType)
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// normalizedHash returns the message's stored content hash, computing it if
+// the archive doesn't store one
+func (m *Message) normalizedHash() string {
+	if m.ContentHash != "" {
+		return m.ContentHash
+	}
+	return NormalizedContentHash(m)
+}
+
+// DedupeMessages drops every message whose normalized content hash matches an
+// earlier one, keeping the first copy of re-bridged history
+func DedupeMessages(messages []*Message) []*Message {
+	seen := make(map[string]bool, len(messages))
+	deduped := make([]*Message, 0, len(messages))
+	for _, message := range messages {
+		hash := message.normalizedHash()
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		deduped = append(deduped, message)
+	}
+	return deduped
+}
+
+// normalizeContent keeps the parts of message content that carry its meaning
+func normalizeContent(content map[string]interface{}) map[string]interface{} {
+	normalized := make(map[string]interface{})
+	for _, key := range []string{"msgtype", "geo_uri"} {
+		if value, ok := content[key].(string); ok && value != "" {
+			normalized[key] = value
+		}
+	}
+
+	relatesTo, _ := content["m.relates_to"].(map[string]interface{})
+	_, isReply := relatesTo["m.in_reply_to"]
+	if body, ok := content["body"].(string); ok {
+		normalized["body"] = normalizeBody(body, isReply)
+	}
+
+	// Relations are kept by kind, reaction key and target event
+	if relType, _ := relatesTo["rel_type"].(string); relType != "" {
+		normalized["rel_type"] = relType
+	}
+	if target, _ := relatesTo["event_id"].(string); target != "" {
+		normalized["relates_to"] = target
+	}
+	if inReplyTo, ok := relatesTo["m.in_reply_to"].(map[string]interface{}); ok {
+		if target, _ := inReplyTo["event_id"].(string); target != "" {
+			normalized["in_reply_to"] = target
+		}
+	}
+	if key, _ := relatesTo["key"].(string); key != "" {
+		normalized["key"] = key
+	}
+	if newContent, ok := content["m.new_content"].(map[string]interface{}); ok {
+		normalized["new_content"] = normalizeContent(newContent)
+	}
+
+	// Media is identified by what was uploaded, not where it is stored
+	if info, ok := content["info"].(map[string]interface{}); ok {
+		for _, key := range []string{"mimetype", "size"} {
+			if value, ok := info[key]; ok {
+				normalized[key] = value
+			}
+		}
+	}
+	return normalized
+}
+
+// normalizeBody strips a reply's quoted fallback and collapses whitespace
+func normalizeBody(body string, isReply bool) string {
+	if isReply {
+		// Reply fallbacks quote the parent as "> " lines followed by a blank line
+		lines := strings.Split(body, "\n")
+		i := 0
+		for i < len(lines) && strings.HasPrefix(lines[i], ">") {
+			i++
+		}
+		if i > 0 && i < len(lines) && strings.TrimSpace(lines[i]) == "" {
+			body = strings.Join(lines[i+1:], "\n")
+		}
+	}
+	return strings.Join(strings.Fields(body), " ")
+}
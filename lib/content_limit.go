@@ -0,0 +1,164 @@
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+)
+
+// What to do with messages whose content is larger than the content size limit
+const (
+	// Store the message truncated, marked with its original size
+	OversizeTruncate = "truncate"
+	// Also write the full content to a file, and mark the message with its path
+	OversizeExternal = "external"
+)
+
+// DefaultOversizeDir is where the external policy writes full content
+const DefaultOversizeDir = "oversized"
+
+// ContentTruncatedKey marks truncated content with the ContentTruncation
+// that describes it
+const ContentTruncatedKey = "org.osteele.matrix-archive.truncated"
+
+// ContentLimit caps the size of the content stored for each message. Some
+// bridges send messages with megabytes of formatted_body, which bloat the
+// database and make exports unwieldy.
+type ContentLimit struct {
+	MaxSize int64  // Largest content to store, as JSON bytes; 0 = no limit
+	Policy  string // OversizeTruncate or OversizeExternal
+	Dir     string // Directory for the external policy's files
+}
+
+// ContentTruncation describes content that was stored truncated
+type ContentTruncation struct {
+	OriginalSize int64  `json:"original_size" yaml:"original_size"`
+	Path         string `json:"path,omitempty" yaml:"path,omitempty"` // The full content, with the external policy
+}
+
+// Validate checks the policy and fills in the external policy's default directory
+func (l *ContentLimit) Validate() error {
+	switch l.Policy {
+	case "":
+		l.Policy = OversizeTruncate
+	case OversizeTruncate, OversizeExternal:
+	default:
+		return fmt.Errorf("unknown oversize policy %q; use %s or %s", l.Policy, OversizeTruncate, OversizeExternal)
+	}
+	if l.Policy == OversizeExternal {
+		if os.Getenv("MATRIX_ARCHIVE_PASSPHRASE") != "" {
+			return fmt.Errorf("the %s policy would write message content unencrypted; use %s with an encrypted archive", OversizeExternal, OversizeTruncate)
+		}
+		if l.Dir == "" {
+			l.Dir = DefaultOversizeDir
+		}
+	}
+	return nil
+}
+
+// Apply truncates msg's content if it is larger than the limit, first
+// writing the full content to the limit's directory with the external
+// policy. It reports whether the content was truncated.
+func (l *ContentLimit) Apply(msg *Message) (bool, error) {
+	if l == nil || l.MaxSize <= 0 {
+		return false, nil
+	}
+	data, err := json.Marshal(msg.Content)
+	if err != nil {
+		return false, fmt.Errorf("failed to measure content of %s: %w", msg.EventID, err)
+	}
+	if int64(len(data)) <= l.MaxSize {
+		return false, nil
+	}
+
+	truncation := ContentTruncation{OriginalSize: int64(len(data))}
+	if l.Policy == OversizeExternal {
+		if err := os.MkdirAll(l.Dir, 0755); err != nil {
+			return false, fmt.Errorf("failed to create %s: %w", l.Dir, err)
+		}
+		truncation.Path = filepath.Join(l.Dir, staticAPIRoomPath(msg.EventID)+".json")
+		if err := os.WriteFile(truncation.Path, data, 0644); err != nil {
+			return false, fmt.Errorf("failed to write content of %s: %w", msg.EventID, err)
+		}
+	}
+	msg.Content = TruncateContent(msg.Content, l.MaxSize, truncation)
+	return true, nil
+}
+
+// TruncateContent returns a copy of content that fits in maxSize bytes of
+// JSON, marked with truncation. It drops the formatted body first, then
+// shortens the plain body if that is enough, and otherwise keeps only the
+// message type, body and relations, shortening the body if still needed.
+func TruncateContent(content map[string]interface{}, maxSize int64, truncation ContentTruncation) map[string]interface{} {
+	truncated := make(map[string]interface{}, len(content)+1)
+	for key, value := range content {
+		truncated[key] = value
+	}
+	truncated[ContentTruncatedKey] = truncation
+	over := func() int64 {
+		data, _ := json.Marshal(truncated)
+		return int64(len(data)) - maxSize
+	}
+	// shortenBody shortens the body until the content fits, and reports
+	// false if the body isn't long enough for that
+	shortenBody := func() bool {
+		body, _ := truncated["body"].(string)
+		excess := over()
+		if excess <= 0 {
+			return true
+		}
+		if int64(len(body)) <= excess {
+			return false
+		}
+		truncated["body"] = truncateString(body, len(body)-int(excess)-len("…"))
+		return true
+	}
+
+	delete(truncated, "formatted_body")
+	delete(truncated, "format")
+	if shortenBody() {
+		return truncated
+	}
+
+	for key := range truncated {
+		switch key {
+		case "msgtype", "body", "m.relates_to", ContentTruncatedKey:
+		default:
+			delete(truncated, key)
+		}
+	}
+	if !shortenBody() {
+		truncated["body"] = "…"
+	}
+	return truncated
+}
+
+// truncateString shortens s to at most n bytes, cutting at a character
+// boundary, and appends an ellipsis
+func truncateString(s string, n int) string {
+	if n <= 0 {
+		return "…"
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + "…"
+}
+
+// contentTruncation returns the truncation marked in content, if any
+func contentTruncation(content map[string]interface{}) *ContentTruncation {
+	switch marker := content[ContentTruncatedKey].(type) {
+	case ContentTruncation:
+		return &marker
+	case map[string]interface{}: // Decoded from JSON
+		truncation := &ContentTruncation{}
+		if size, ok := marker["original_size"].(float64); ok {
+			truncation.OriginalSize = int64(size)
+		}
+		truncation.Path, _ = marker["path"].(string)
+		return truncation
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package archive
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultConversationGap is the silence after which the next message starts
+// a new conversation, unless it replies to an earlier one
+const DefaultConversationGap = 30 * time.Minute
+
+// SegmentConversations groups messages, in time order, into conversations
+// for rooms that don't use threads. A message replying to a message, or
+// posted in a thread, joins that message's conversation; otherwise it
+// continues the previous message's conversation unless more than gap has
+// passed since it. Conversations are numbered from 1 in the order they start.
+func SegmentConversations(messages []ExportMessage, gap time.Duration) {
+	conversationOf := make(map[string]int, len(messages))
+	conversations := 0
+	var previous time.Time
+	for i := range messages {
+		msg := &messages[i]
+		t, err := time.Parse(time.RFC3339, msg.Timestamp)
+		if err != nil {
+			t = previous
+		}
+
+		related := ""
+		if msg.RepliesTo != nil {
+			related = msg.RepliesTo.EventID
+		} else if msg.ThreadInfo != nil && !msg.ThreadInfo.IsRoot {
+			related = msg.ThreadInfo.RootEventID
+		}
+
+		conversation, ok := conversationOf[related]
+		switch {
+		case ok && related != "":
+		case i == 0 || t.Sub(previous) > gap:
+			conversations++
+			conversation = conversations
+			msg.ConversationStart = true
+		default:
+			conversation = messages[i-1].ConversationID
+		}
+		msg.ConversationID = conversation
+		conversationOf[msg.EventID] = conversation
+		previous = t
+	}
+}
+
+// FilterConversation returns the messages of one conversation
+func FilterConversation(messages []ExportMessage, conversation int) ([]ExportMessage, error) {
+	var filtered []ExportMessage
+	for _, msg := range messages {
+		if msg.ConversationID == conversation {
+			filtered = append(filtered, msg)
+		}
+	}
+	if len(filtered) == 0 {
+		return nil, fmt.Errorf("conversation %d not found", conversation)
+	}
+	return filtered, nil
+}
@@ -44,9 +44,10 @@ func (s *SimpleStateStore) FindSharedRooms(ctx context.Context, userID id.UserID
 }
 
 func NewCryptoManager(client *mautrix.Client, dbPath string) (*CryptoManager, error) {
-	// Override device ID to be deterministic before creating crypto helper
-	deterministic_device_id := "MATRIXARCH"
-	client.DeviceID = id.DeviceID(deterministic_device_id)
+	// Fall back to the deterministic device ID before creating crypto helper
+	if client.DeviceID == "" {
+		client.DeviceID = beeperDeviceID
+	}
 
 	// Create SQL crypto store like gomuks
 	cryptoDBPath := dbPath + "_crypto.db"
@@ -65,8 +66,12 @@ func NewCryptoManager(client *mautrix.Client, dbPath string) (*CryptoManager, er
 
 	cryptoStore := crypto.NewSQLCryptoStore(cryptoDB, dbutil.ZeroLogger(zerolog.New(log.Writer())), "", "", []byte("matrix-archive-crypto"))
 
-	// Set the account info on the crypto store
+	// Set the account info on the crypto store. A profile's own device keeps
+	// its keys apart from those of the MATRIXARCH device in the same store.
 	cryptoStore.AccountID = client.UserID.String()
+	if client.DeviceID != beeperDeviceID {
+		cryptoStore.AccountID += "/" + client.DeviceID.String()
+	}
 	cryptoStore.DeviceID = client.DeviceID
 
 	// Upgrade the crypto store schema
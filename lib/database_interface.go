@@ -16,16 +16,128 @@ type DatabaseInterface interface {
 	InsertMessageBatch(ctx context.Context, messages []*Message) (int, error)
 	GetMessage(ctx context.Context, eventID string) (*Message, error)
 	GetMessages(ctx context.Context, filter *MessageFilter, limit int, offset int) ([]*Message, error)
+	EachMessage(ctx context.Context, filter *MessageFilter, fn func(*Message) error) error
 	GetMessageCount(ctx context.Context, filter *MessageFilter) (int64, error)
 	DeleteMessage(ctx context.Context, eventID string) error
+	GetContentHashes(ctx context.Context) (map[string]string, error)
 
 	// Room operations
 	GetRooms(ctx context.Context) ([]string, error)
 	GetRoomMessageCount(ctx context.Context, roomID string) (int64, error)
+	GetRoomStats(ctx context.Context) ([]*RoomStats, error)
+	GetDailyStats(ctx context.Context, roomID string) ([]*DailyStats, error)
+	RebuildDailyStats(ctx context.Context) error
+
+	// Account operations
+	GetAccountStats(ctx context.Context) ([]*AccountStats, error)
+
+	// Annotation operations
+	AddAnnotation(ctx context.Context, annotation *Annotation) error
+	GetAnnotations(ctx context.Context, eventID string) ([]*Annotation, error)
+	GetRoomAnnotations(ctx context.Context, roomID string) ([]*Annotation, error)
+	DeleteAnnotation(ctx context.Context, id int64) error
+
+	// Highlight operations
+	SetPinnedEvents(ctx context.Context, roomID string, eventIDs []string) error
+	GetPinnedEvents(ctx context.Context, roomID string) ([]string, error)
+	AddBookmark(ctx context.Context, bookmark *Bookmark) error
+	GetBookmarks(ctx context.Context, roomID string) ([]*Bookmark, error)
+	DeleteBookmark(ctx context.Context, eventID string) error
+
+	// Membership operations
+	InsertMembershipEvents(ctx context.Context, events []*MembershipEvent) (int, error)
+	GetMembershipEvents(ctx context.Context, roomID string) ([]*MembershipEvent, error)
+
+	// Moderation operations
+	InsertModerationEvents(ctx context.Context, events []*ModerationEvent) (int, error)
+	GetModerationEvents(ctx context.Context, roomID string) ([]*ModerationEvent, error)
+
+	// Account data operations
+	SetRoomTags(ctx context.Context, roomID string, tags []*RoomTag) error
+	GetRoomTags(ctx context.Context, roomID string) ([]*RoomTag, error)
+	SetDirectRooms(ctx context.Context, direct map[string][]string) error
+	GetDirectRooms(ctx context.Context) (map[string][]string, error)
+	SaveEmotePack(ctx context.Context, pack *EmotePack) error
+	GetEmotePacks(ctx context.Context) ([]*EmotePack, error)
+
+	// Room version operations
+	SaveRoomVersion(ctx context.Context, version *RoomVersion) error
+	GetRoomVersion(ctx context.Context, roomID string) (*RoomVersion, error)
+
+	// Room profile operations
+	SaveRoomProfile(ctx context.Context, profile *RoomProfile) error
+	GetRoomProfile(ctx context.Context, roomID string) (*RoomProfile, error)
+
+	// Room seal operations
+	SealRoom(ctx context.Context, seal *RoomSeal) error
+	GetRoomSeal(ctx context.Context, roomID string) (*RoomSeal, error)
+	GetRoomSeals(ctx context.Context, roomID string) ([]*RoomSeal, error)
+	UnsealRoom(ctx context.Context, roomID string) error
+
+	// Import state operations
+	GetImportState(ctx context.Context, roomID string) (*ImportState, error)
+	SaveImportState(ctx context.Context, state *ImportState) error
+	ClearImportState(ctx context.Context, roomID string) error
+
+	// Media text operations
+	SaveMediaText(ctx context.Context, mediaText *MediaText) error
+	GetMediaTextEventIDs(ctx context.Context) (map[string]bool, error)
+	SearchMediaText(ctx context.Context, query, roomID string) ([]*MediaText, error)
+
+	// Relation operations
+	SaveUnresolvedRelations(ctx context.Context, roomID string, relations []*UnresolvedRelation) error
+	GetUnresolvedRelations(ctx context.Context, roomID string) ([]*UnresolvedRelation, error)
+
+	// Media file operations
+	SaveMediaFile(ctx context.Context, file *MediaFile) error
+	GetMediaFiles(ctx context.Context, roomID string) ([]*MediaFile, error)
+
+	// User operations
+	SaveRoomUsers(ctx context.Context, users []*RoomUser) error
+	GetRoomUsers(ctx context.Context, roomID string) ([]*RoomUser, error)
+
+	// Quarantine operations
+	QuarantineMessage(ctx context.Context, q *QuarantinedMessage) error
+	GetQuarantinedMessages(ctx context.Context, roomID string) ([]*QuarantinedMessage, error)
+	DeleteQuarantinedMessage(ctx context.Context, eventID string) error
+	SaveFailedEvent(ctx context.Context, failed *FailedEvent) error
+	GetFailedEvents(ctx context.Context, roomID string) ([]*FailedEvent, error)
+	DeleteFailedEvent(ctx context.Context, eventID string) error
+
+	// Restore operations
+	GetRestoredRoom(ctx context.Context, homeserver, sourceRoomID string) (*RestoredRoom, error)
+	SaveRestoredRoom(ctx context.Context, room *RestoredRoom) error
+	SaveRestoredEvents(ctx context.Context, events []*RestoredEvent) error
+	GetRestoredEvents(ctx context.Context, homeserver, sourceRoomID string) (map[string]string, error)
+
+	// Opt-out operations
+	SaveOptOut(ctx context.Context, optOut *OptOut) error
+	GetOptOuts(ctx context.Context) ([]*OptOut, error)
+	DeleteOptOut(ctx context.Context, userID string) error
+
+	// Person alias operations
+	SavePersonAlias(ctx context.Context, alias *PersonAlias) error
+	GetPersonAliases(ctx context.Context) ([]*PersonAlias, error)
+	DeletePersonAlias(ctx context.Context, userID string) error
+
+	// Event verification operations
+	SaveEventVerification(ctx context.Context, verification *EventVerification) error
+	GetEventVerifications(ctx context.Context, roomID string) (map[string]*EventVerification, error)
+
+	// Search setting operations
+	GetSearchNormalization(ctx context.Context) (*SearchNormalization, error)
+	SaveSearchNormalization(ctx context.Context, n *SearchNormalization) error
+
+	// Export state operations
+	GetExportHash(ctx context.Context, target string) (string, error)
+	SaveExportHash(ctx context.Context, target, hash string) error
 
 	// Utility operations
 	CreateTables(ctx context.Context) error
 	Migrate(ctx context.Context) error
+	EncryptExistingContent(ctx context.Context) (int, error)
+	CompactExistingContent(ctx context.Context) (int, int64, error)
+	Backup(ctx context.Context, path string) error
 
 	// Analytics operations (for advanced analytics)
 	ExecuteQuery(ctx context.Context, query string, args ...interface{}) ([]map[string]interface{}, error)
@@ -37,6 +149,9 @@ type DatabaseConfig struct {
 	IsInMemory  bool
 	MaxConns    int
 	Debug       bool
+	Passphrase  string // Encrypts message content at rest when set
+	Compact     bool   // Drops formatted_body that only repeats the plain body
+	MustExist   bool   // Fails rather than creating the database file if it doesn't exist
 }
 
 // MessageFilter represents filters for querying messages (already defined in models.go but extending for SQL)
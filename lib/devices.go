@@ -0,0 +1,179 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// jwtAuthType is the interactive authentication stage Beeper completes with
+// its login token
+const jwtAuthType mautrix.AuthType = "org.matrix.login.jwt"
+
+// AccountDevice is a device logged in to the archive's Matrix account
+type AccountDevice struct {
+	DeviceID    string     `json:"device_id"`
+	DisplayName string     `json:"display_name,omitempty"`
+	LastSeenIP  string     `json:"last_seen_ip,omitempty"`
+	LastSeen    *time.Time `json:"last_seen,omitempty"`
+	Archive     bool       `json:"archive"` // The device this archive uses
+}
+
+// deviceClient returns a Matrix client for the active profile's saved
+// credentials, without starting encryption, and the credentials it uses
+func deviceClient(domain string) (*mautrix.Client, *BeeperAuth, error) {
+	auth := NewBeeperAuthForProfile(domain, ActiveProfile())
+	if !auth.LoadCredentials() {
+		return nil, nil, fmt.Errorf("not logged in to %s; run 'matrix-archive auth login' first", domain)
+	}
+	client, err := auth.GetMatrixClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, auth, nil
+}
+
+// ListAccountDevices prints the devices logged in to the archive's account,
+// most recently seen first, marking the one the archive uses
+func ListAccountDevices(domain string) error {
+	client, auth, err := deviceClient(domain)
+	if err != nil {
+		return err
+	}
+	resp, err := client.GetDevicesInfo(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to list devices: %w", err)
+	}
+
+	devices := make([]AccountDevice, 0, len(resp.Devices))
+	for _, info := range resp.Devices {
+		device := AccountDevice{
+			DeviceID:    info.DeviceID.String(),
+			DisplayName: info.DisplayName,
+			LastSeenIP:  info.LastSeenIP,
+			Archive:     info.DeviceID == auth.DeviceID(),
+		}
+		if info.LastSeenTS > 0 {
+			lastSeen := time.UnixMilli(info.LastSeenTS)
+			device.LastSeen = &lastSeen
+		}
+		devices = append(devices, device)
+	}
+	sort.SliceStable(devices, func(i, j int) bool {
+		if devices[i].LastSeen == nil || devices[j].LastSeen == nil {
+			return devices[j].LastSeen == nil && devices[i].LastSeen != nil
+		}
+		return devices[i].LastSeen.After(*devices[j].LastSeen)
+	})
+	if jsonOutput() {
+		return writeJSON(devices)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\tDEVICE\tNAME\tLAST SEEN\tIP")
+	for _, device := range devices {
+		marker, lastSeen := "", "-"
+		if device.Archive {
+			marker = "*"
+		}
+		if device.LastSeen != nil {
+			lastSeen = device.LastSeen.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", marker, device.DeviceID, device.DisplayName, lastSeen, device.LastSeenIP)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("\n* is the device this archive uses (%s)\n", auth.DeviceID())
+	return nil
+}
+
+// LogoutAccountDevices logs devices out of the archive's account. Without
+// device IDs, or if they include the device the archive uses, the archive's
+// own device is logged out and its saved credentials are cleared, so the
+// next login starts afresh. Other devices are removed with the Beeper login
+// token when the homeserver asks to confirm.
+func LogoutAccountDevices(domain string, deviceIDs []string) error {
+	client, auth, err := deviceClient(domain)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	own := len(deviceIDs) == 0
+	var others []id.DeviceID
+	for _, deviceID := range deviceIDs {
+		if id.DeviceID(deviceID) == auth.DeviceID() {
+			own = true
+		} else {
+			others = append(others, id.DeviceID(deviceID))
+		}
+	}
+
+	if len(others) > 0 {
+		if err := deleteDevices(ctx, client, auth, others); err != nil {
+			return err
+		}
+		for _, deviceID := range others {
+			fmt.Printf("✓ Logged out device %s\n", deviceID)
+		}
+	}
+	if own {
+		if _, err := client.Logout(ctx); err != nil {
+			return fmt.Errorf("failed to log out device %s: %w", auth.DeviceID(), err)
+		}
+		fmt.Printf("✓ Logged out device %s\n", auth.DeviceID())
+		return auth.ClearCredentials()
+	}
+	return nil
+}
+
+// deleteDevices removes devices from the account. The homeserver usually
+// asks to confirm with interactive authentication, which is completed with
+// the Beeper login token when the credentials have one.
+func deleteDevices(ctx context.Context, client *mautrix.Client, auth *BeeperAuth, deviceIDs []id.DeviceID) error {
+	req := &mautrix.ReqDeleteDevices{Devices: deviceIDs}
+	content, err := client.MakeFullRequest(ctx, mautrix.FullRequest{
+		Method:      http.MethodPost,
+		URL:         client.BuildClientURL("v3", "delete_devices"),
+		RequestJSON: req,
+	})
+	var httpErr mautrix.HTTPError
+	if err == nil {
+		return nil
+	} else if !errors.As(err, &httpErr) || !httpErr.IsStatus(http.StatusUnauthorized) {
+		return fmt.Errorf("failed to log out devices: %w", err)
+	}
+
+	var uia mautrix.RespUserInteractive
+	if err := json.Unmarshal(content, &uia); err != nil {
+		return fmt.Errorf("failed to decode authentication request: %w", err)
+	}
+	if auth.Token == "" || !uia.HasSingleStageFlow(jwtAuthType) {
+		return fmt.Errorf("the homeserver asks to confirm removing devices in a way matrix-archive can't answer; remove them from a Beeper client instead")
+	}
+	req.Auth = map[string]interface{}{
+		"type":    jwtAuthType,
+		"token":   auth.Token,
+		"session": uia.Session,
+	}
+	_, err = client.MakeFullRequest(ctx, mautrix.FullRequest{
+		Method:           http.MethodPost,
+		URL:              client.BuildClientURL("v3", "delete_devices"),
+		RequestJSON:      req,
+		SensitiveContent: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to log out devices: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,367 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Digest periods, each starting at midnight UTC
+const (
+	DigestDay   = "day"
+	DigestWeek  = "week" // Monday to Sunday
+	DigestMonth = "month"
+)
+
+// Digest formats
+const (
+	DigestMarkdown = "md"
+	DigestText     = "txt"
+	DigestJSON     = "json"
+)
+
+// supportedDigestPeriods and supportedDigestFormats list the accepted values
+var (
+	supportedDigestPeriods = []string{DigestDay, DigestWeek, DigestMonth}
+	supportedDigestFormats = []string{DigestMarkdown, DigestText, DigestJSON}
+)
+
+// DefaultDigestTop is how many messages a digest picks
+const DefaultDigestTop = 5
+
+// Digest is a room's most reacted to and replied to messages over a period,
+// for newsletters and "message of the week" posts
+type Digest struct {
+	RoomID   string        `json:"room_id"`
+	Period   string        `json:"period"`
+	Start    time.Time     `json:"start"`
+	End      time.Time     `json:"end"`      // Exclusive
+	Messages int           `json:"messages"` // Messages sent in the period
+	Senders  int           `json:"senders"`  // People who sent them
+	Top      []DigestEntry `json:"top"`
+}
+
+// DigestEntry is one of a digest's top messages with what it scored
+type DigestEntry struct {
+	Message   ExportMessage `json:"message"`
+	Reactions int           `json:"reactions"` // Reactions of any key, whenever they were made
+	Replies   int           `json:"replies"`   // Replies to it and, if it starts a thread, the thread's messages
+}
+
+// DigestPeriod returns the day, week or month containing date, in UTC, or
+// the last one to have ended if date is zero
+func DigestPeriod(period string, date time.Time) (start, end time.Time, err error) {
+	if date.IsZero() {
+		if start, _, err = DigestPeriod(period, time.Now()); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		return DigestPeriod(period, start.AddDate(0, 0, -1))
+	}
+	date = date.UTC()
+	day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	switch period {
+	case DigestDay:
+		return day, day.AddDate(0, 0, 1), nil
+	case DigestWeek:
+		start = day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+		return start, start.AddDate(0, 0, 7), nil
+	case DigestMonth:
+		start = time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0), nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("unsupported digest period %s, supported periods: %v", period, supportedDigestPeriods)
+}
+
+// RankDigestMessages scores the messages sent in [start, end) by the
+// reactions and replies among messages, which may come later, and returns
+// those with any, highest score first and earlier first among equals. A
+// message's bundled aggregations raise its counts to the server's where
+// fewer reactions or thread replies were archived. Edits aren't ranked.
+func RankDigestMessages(messages []*Message, start, end time.Time) []DigestScore {
+	reactions := make(map[string]int)
+	replies := make(map[string]int)
+	threadReplies := make(map[string]int)
+	for _, msg := range messages {
+		relatesTo, _ := msg.Content["m.relates_to"].(map[string]interface{})
+		if relatesTo == nil {
+			continue
+		}
+		if relatesTo["rel_type"] == "m.annotation" {
+			if target, _ := relatesTo["event_id"].(string); target != "" {
+				reactions[target]++
+			}
+			continue
+		}
+		replyTo, root := messageRelations(msg.Content)
+		if root != "" {
+			threadReplies[root]++
+		}
+		// Thread messages fall back to replying to the previous message
+		// in the thread, which the thread count already covers
+		if replyTo != "" && replyTo != root && !isThreadFallback(relatesTo) {
+			replies[replyTo]++
+		}
+	}
+
+	var ranked []DigestScore
+	for _, msg := range messages {
+		if msg.MessageType != EventTypeMessage || isEdit(msg) || msg.Timestamp.Before(start) || !msg.Timestamp.Before(end) {
+			continue
+		}
+		score := DigestScore{Message: msg, Reactions: reactions[msg.EventID], Replies: replies[msg.EventID]}
+		thread := threadReplies[msg.EventID]
+		if bundle := msg.Aggregations; bundle != nil {
+			bundled := 0
+			for _, count := range bundle.Reactions {
+				bundled += count
+			}
+			score.Reactions = max(score.Reactions, bundled)
+			thread = max(thread, bundle.ThreadReplies)
+		}
+		score.Replies += thread
+		if score.Score() > 0 {
+			ranked = append(ranked, score)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if a, b := ranked[i].Score(), ranked[j].Score(); a != b {
+			return a > b
+		}
+		return ranked[i].Message.Timestamp.Before(ranked[j].Message.Timestamp)
+	})
+	return ranked
+}
+
+// DigestScore is a message's reactions and replies, as RankDigestMessages counts them
+type DigestScore struct {
+	Message   *Message
+	Reactions int
+	Replies   int
+}
+
+// Score is what a digest ranks messages by: a reaction and a reply count the same
+func (s DigestScore) Score() int {
+	return s.Reactions + s.Replies
+}
+
+// isThreadFallback reports whether a thread message's m.in_reply_to is only
+// the fallback for clients without threads
+func isThreadFallback(relatesTo map[string]interface{}) bool {
+	fallback, _ := relatesTo["is_falling_back"].(bool)
+	return relatesTo["rel_type"] == "m.thread" && fallback
+}
+
+// BuildDigest picks a room's top messages for the day, week or month
+// containing date, or the last to have ended if date is zero. People who
+// opted out of archiving are left out.
+func BuildDigest(ctx context.Context, roomID, period string, date time.Time, top int) (*Digest, error) {
+	start, end, err := DigestPeriod(period, date)
+	if err != nil {
+		return nil, err
+	}
+	if top <= 0 {
+		top = DefaultDigestTop
+	}
+
+	// Reactions and replies to the period's messages may come after it
+	messages, err := GetDatabase().GetMessages(ctx, &MessageFilter{RoomID: roomID, StartTime: &start}, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %w", err)
+	}
+	if messages, _, err = withholdOptedOut(ctx, messages); err != nil {
+		return nil, err
+	}
+
+	digest := &Digest{RoomID: roomID, Period: period, Start: start, End: end, Top: []DigestEntry{}}
+	senders := make(map[string]bool)
+	for _, msg := range messages {
+		if msg.MessageType == EventTypeMessage && !isEdit(msg) && msg.Timestamp.Before(end) {
+			digest.Messages++
+			senders[msg.Sender] = true
+		}
+	}
+	digest.Senders = len(senders)
+
+	ranked := RankDigestMessages(messages, start, end)
+	if len(ranked) > top {
+		ranked = ranked[:top]
+	}
+	if len(ranked) == 0 {
+		return digest, nil
+	}
+
+	picked := make([]*Message, len(ranked))
+	for i, score := range ranked {
+		picked[i] = score.Message
+	}
+	exportMessages, err := convertToExportMessages(picked, roomID, downloadMediaLinks{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert messages: %w", err)
+	}
+	ApplyAggregations(exportMessages, messages)
+	AttachPermalinks(exportMessages, roomID, "")
+	for i, score := range ranked {
+		digest.Top = append(digest.Top, DigestEntry{Message: exportMessages[i], Reactions: score.Reactions, Replies: score.Replies})
+	}
+	return digest, nil
+}
+
+// WriteDigest writes a digest as Markdown, plain text or JSON
+func WriteDigest(w io.Writer, digest *Digest, format string) error {
+	switch format {
+	case DigestMarkdown, "markdown":
+		return writeDigestText(w, digest, true)
+	case DigestText:
+		return writeDigestText(w, digest, false)
+	case DigestJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(digest)
+	}
+	return fmt.Errorf("unsupported digest format %s, supported formats: %v", format, supportedDigestFormats)
+}
+
+// writeDigestText writes a digest as Markdown, or as plain text without its markup
+func writeDigestText(w io.Writer, digest *Digest, markdown bool) error {
+	last := digest.End.AddDate(0, 0, -1)
+	title := fmt.Sprintf("Digest of %s, %s", digest.RoomID, digestPeriodName(digest.Period, digest.Start))
+	if markdown {
+		fmt.Fprintf(w, "# %s\n\n", title)
+	} else {
+		fmt.Fprintf(w, "%s\n%s\n\n", title, strings.Repeat("=", len([]rune(title))))
+	}
+	fmt.Fprintf(w, "%d messages from %d people, %s to %s.\n", digest.Messages, digest.Senders, digest.Start.Format("2006-01-02"), last.Format("2006-01-02"))
+	if len(digest.Top) == 0 {
+		fmt.Fprintln(w, "\nNo message got a reaction or a reply.")
+		return nil
+	}
+
+	for i, entry := range digest.Top {
+		msg := entry.Message
+		name := msg.DisplayName
+		if name == "" {
+			name = msg.Sender
+		}
+		when := msg.Timestamp
+		if t, err := time.Parse(time.RFC3339, msg.Timestamp); err == nil {
+			when = t.UTC().Format("Mon 2006-01-02 15:04")
+		}
+		if markdown {
+			fmt.Fprintf(w, "\n## %d. %s, %s\n\n", i+1, name, when)
+		} else {
+			fmt.Fprintf(w, "\n%d. %s, %s\n\n", i+1, name, when)
+		}
+
+		body, _ := msg.Content["body"].(string)
+		if msgtype, _ := msg.Content["msgtype"].(string); msgtype != "" && msgtype != "m.text" && msgtype != "m.notice" && msgtype != "m.emote" {
+			body = fmt.Sprintf("[%s] %s", strings.TrimPrefix(msgtype, "m."), body)
+		}
+		prefix, indent := "   ", "   "
+		if markdown {
+			prefix, indent = "> ", ""
+		}
+		for _, line := range strings.Split(strings.TrimRight(body, "\n"), "\n") {
+			fmt.Fprintln(w, strings.TrimRight(prefix+line, " "))
+		}
+
+		var summary []string
+		for _, reaction := range msg.Reactions {
+			key := reaction.Emoji
+			if strings.HasPrefix(key, "mxc://") {
+				key = ":" + reaction.Shortcode + ":"
+				if reaction.Shortcode == "" {
+					key = "(custom emoji)"
+				}
+			}
+			summary = append(summary, fmt.Sprintf("%s %d", key, reaction.Count))
+		}
+		if entry.Replies > 0 {
+			noun := "replies"
+			if entry.Replies == 1 {
+				noun = "reply"
+			}
+			summary = append(summary, fmt.Sprintf("%d %s", entry.Replies, noun))
+		}
+		if msg.Permalink != "" {
+			if markdown {
+				summary = append(summary, fmt.Sprintf("[link](%s)", msg.Permalink))
+			} else {
+				summary = append(summary, msg.Permalink)
+			}
+		}
+		fmt.Fprintf(w, "\n%s%s\n", indent, strings.Join(summary, " · "))
+	}
+	return nil
+}
+
+// digestPeriodName names the period starting at start, as in "week of 2024-01-01"
+func digestPeriodName(period string, start time.Time) string {
+	switch period {
+	case DigestDay:
+		return start.Format("Monday 2006-01-02")
+	case DigestMonth:
+		return start.Format("January 2006")
+	}
+	return "week of " + start.Format("2006-01-02")
+}
+
+// ExportDigest writes the digest of a room's day, week or month containing
+// date (the last to have ended if date is zero) to filename, or to standard
+// output if filename is empty. Without a format, filename's extension
+// chooses one, and Markdown is the default.
+func ExportDigest(roomID, period string, date time.Time, top int, format, filename string) error {
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+		if format == "" {
+			format = DigestMarkdown
+		}
+	}
+	if format == "markdown" {
+		format = DigestMarkdown
+	}
+	if !slices.Contains(supportedDigestFormats, format) {
+		return fmt.Errorf("unsupported digest format %s, supported formats: %v", format, supportedDigestFormats)
+	}
+	if _, _, err := DigestPeriod(period, date); err != nil {
+		return err
+	}
+
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	roomID, err := resolveExportRoom(roomID)
+	if err != nil {
+		return err
+	}
+	digest, err := BuildDigest(context.Background(), roomID, period, date, top)
+	if err != nil {
+		return err
+	}
+
+	if filename == "" {
+		return WriteDigest(os.Stdout, digest, format)
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create digest file: %w", err)
+	}
+	if err := WriteDigest(file, digest, format); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write digest: %w", err)
+	}
+	fmt.Fprintf(progressWriter(), "Wrote a digest of %d messages to %q\n", len(digest.Top), filename)
+	return nil
+}
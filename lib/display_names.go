@@ -0,0 +1,234 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// userCacheTTL is how long profiles in the users table are trusted before a
+// room's members are fetched again
+const userCacheTTL = 24 * time.Hour
+
+// displayNameWorkers bounds the concurrent per-user lookups made for senders
+// missing from the room's member list
+const displayNameWorkers = 8
+
+// RoomUserFetcher fetches member profiles from a homeserver
+type RoomUserFetcher interface {
+	// FetchRoomUsers returns the profiles of a room's members in one request
+	FetchRoomUsers(ctx context.Context, roomID string) ([]*RoomUser, error)
+	// FetchRoomUser returns a single member's profile
+	FetchRoomUser(ctx context.Context, roomID, userID string) (*RoomUser, error)
+}
+
+// matrixUserFetcher fetches profiles with the Matrix client-server API
+type matrixUserFetcher struct {
+	client *mautrix.Client
+}
+
+// FetchRoomUsers uses /members, which includes members who have left, and
+// falls back to /joined_members
+func (f *matrixUserFetcher) FetchRoomUsers(ctx context.Context, roomID string) ([]*RoomUser, error) {
+	members, err := f.client.Members(ctx, id.RoomID(roomID))
+	if err == nil {
+		var users []*RoomUser
+		for _, evt := range members.Chunk {
+			if m := convertMemberEvent(evt, roomID); m != nil {
+				user := &RoomUser{RoomID: roomID, UserID: m.UserID, DisplayName: m.DisplayName, AvatarURL: m.AvatarURL,
+					Platform: ParsePlatformIdentity(evt.Content.Raw)}
+				if m.Membership == string(event.MembershipLeave) && m.DisplayName == "" {
+					user.Deactivated = f.deactivated(ctx, m.UserID)
+				}
+				users = append(users, user)
+			}
+		}
+		return users, nil
+	}
+
+	joined, joinedErr := f.client.JoinedMembers(ctx, id.RoomID(roomID))
+	if joinedErr != nil {
+		return nil, errors.Join(err, joinedErr)
+	}
+	users := make([]*RoomUser, 0, len(joined.Joined))
+	for userID, member := range joined.Joined {
+		users = append(users, &RoomUser{RoomID: roomID, UserID: userID.String(), DisplayName: member.DisplayName, AvatarURL: member.AvatarURL})
+	}
+	return users, nil
+}
+
+// FetchRoomUser reads the user's m.room.member state event, or their global
+// profile if they have none in the room
+func (f *matrixUserFetcher) FetchRoomUser(ctx context.Context, roomID, userID string) (*RoomUser, error) {
+	var content struct {
+		event.MemberEventContent
+		event.BeeperProfileExtra
+	}
+	if err := f.client.StateEvent(ctx, id.RoomID(roomID), event.StateMember, userID, &content); err != nil {
+		profile, profileErr := f.client.GetProfile(ctx, id.UserID(userID))
+		switch {
+		case profileErr == nil:
+			return &RoomUser{RoomID: roomID, UserID: userID, DisplayName: profile.DisplayName, AvatarURL: profile.AvatarURL.String(),
+				Platform: ParsePlatformIdentity(profile.Extra)}, nil
+		case isDeactivatedError(profileErr):
+			return &RoomUser{RoomID: roomID, UserID: userID, Deactivated: true}, nil
+		}
+		return nil, err
+	}
+	user := &RoomUser{RoomID: roomID, UserID: userID, DisplayName: content.Displayname, AvatarURL: string(content.AvatarURL),
+		Platform: platformIdentity(&content.BeeperProfileExtra)}
+	if content.Membership == event.MembershipLeave && content.Displayname == "" {
+		user.Deactivated = f.deactivated(ctx, userID)
+	}
+	return user, nil
+}
+
+// deactivated reports whether a user's account is deactivated. Deactivating
+// an account makes it leave its rooms without a display name, and its profile
+// can no longer be looked up.
+func (f *matrixUserFetcher) deactivated(ctx context.Context, userID string) bool {
+	_, err := f.client.GetProfile(ctx, id.UserID(userID))
+	return isDeactivatedError(err)
+}
+
+// isDeactivatedError reports whether a profile lookup failed because the
+// account is gone: Synapse answers M_NOT_FOUND for deactivated accounts, and
+// other homeservers M_USER_DEACTIVATED
+func isDeactivatedError(err error) bool {
+	return errors.Is(err, mautrix.MUserDeactivated) || errors.Is(err, mautrix.MNotFound)
+}
+
+// deactivatedName is how exports name a deactivated user: by their last known
+// display name, or else their ID's localpart, marked as deactivated
+func deactivatedName(user *RoomUser) string {
+	name := user.DisplayName
+	if name == "" {
+		name, _, _ = id.UserID(user.UserID).Parse()
+	}
+	if name == "" {
+		name = user.UserID
+	}
+	return name + " (deactivated)"
+}
+
+// ResolveDisplayNames returns the display names of userIDs in a room. Profiles
+// cached in the users table are used while fresh; otherwise the room's members
+// are fetched in one request, and senders not among them (e.g. members of an
+// upgraded room's predecessor) are looked up concurrently. Deactivated users
+// are named as such, and since accounts stay deactivated they aren't looked
+// up again. Users without a display name are absent from the result.
+func ResolveDisplayNames(ctx context.Context, fetcher RoomUserFetcher, roomID string, userIDs []string) map[string]string {
+	names := make(map[string]string)
+	known := make(map[string]bool)
+
+	cached, err := GetDatabase().GetRoomUsers(ctx, roomID)
+	if err != nil {
+		log.Printf("Warning: Could not read cached users for room %s: %v", roomID, err)
+	}
+	cachedUsers := make(map[string]*RoomUser, len(cached))
+	for _, u := range cached {
+		cachedUsers[u.UserID] = u
+		switch {
+		case u.Deactivated:
+			known[u.UserID] = true
+			names[u.UserID] = deactivatedName(u)
+		case time.Since(u.UpdatedAt) < userCacheTTL:
+			known[u.UserID] = true
+			if u.DisplayName != "" {
+				names[u.UserID] = u.DisplayName
+			}
+		}
+	}
+
+	missing := unknownUsers(userIDs, known)
+	if len(missing) == 0 {
+		return names
+	}
+
+	var fetched []*RoomUser
+	users, err := fetcher.FetchRoomUsers(ctx, roomID)
+	if err != nil {
+		log.Printf("Warning: Could not fetch members of room %s: %v", roomID, err)
+	}
+	for _, u := range users {
+		known[u.UserID] = true
+		fetched = append(fetched, u)
+	}
+
+	fetched = append(fetched, lookupRoomUsers(ctx, fetcher, roomID, unknownUsers(missing, known))...)
+	for _, u := range fetched {
+		if c := cachedUsers[u.UserID]; c != nil && (u.Deactivated || c.Deactivated) {
+			// Keep the name they had before their account was deactivated
+			u.Deactivated = true
+			if u.DisplayName == "" {
+				u.DisplayName = c.DisplayName
+			}
+		}
+		switch {
+		case u.Deactivated:
+			names[u.UserID] = deactivatedName(u)
+		case u.DisplayName != "":
+			names[u.UserID] = u.DisplayName
+		}
+	}
+
+	if err := GetDatabase().SaveRoomUsers(ctx, fetched); err != nil {
+		log.Printf("Warning: Could not cache users for room %s: %v", roomID, err)
+	}
+	return names
+}
+
+// unknownUsers returns the distinct user IDs not in known, skipping the empty
+// sender of notices such as those summarizing withheld messages
+func unknownUsers(userIDs []string, known map[string]bool) []string {
+	seen := make(map[string]bool)
+	var unknown []string
+	for _, userID := range userIDs {
+		if userID != "" && !known[userID] && !seen[userID] {
+			seen[userID] = true
+			unknown = append(unknown, userID)
+		}
+	}
+	return unknown
+}
+
+// lookupRoomUsers fetches profiles one user at a time, displayNameWorkers at once
+func lookupRoomUsers(ctx context.Context, fetcher RoomUserFetcher, roomID string, userIDs []string) []*RoomUser {
+	results := make([]*RoomUser, len(userIDs))
+	sem := make(chan struct{}, displayNameWorkers)
+	var wg sync.WaitGroup
+
+	for i, userID := range userIDs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, userID string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			lookupCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+
+			user, err := fetcher.FetchRoomUser(lookupCtx, roomID, userID)
+			if err != nil {
+				log.Printf("Warning: Could not get member info for %s in room %s: %v", userID, roomID, err)
+				return
+			}
+			results[i] = user
+		}(i, userID)
+	}
+	wg.Wait()
+
+	var users []*RoomUser
+	for _, user := range results {
+		if user != nil {
+			users = append(users, user)
+		}
+	}
+	return users
+}
@@ -1,18 +1,22 @@
 package archive
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 )
 
-// downloadImages downloads images from messages to a local directory
-func DownloadImages(outputDir string, thumbnails bool) error {
+// DownloadImages downloads images from messages to a local directory, in the
+// given media layout ("" keeps the directory's current layout), and records
+// each download in the media table
+func DownloadImages(outputDir string, thumbnails bool, layout string) error {
 	// Initialize database connection with DuckDB
 	if err := InitDuckDB(); err != nil {
 		return fmt.Errorf("failed to initialize database: %w", err)
@@ -28,9 +32,9 @@ func DownloadImages(outputDir string, thumbnails bool) error {
 		}
 	}
 
-	// Create output directory
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		return fmt.Errorf("failed to create output directory: %w", err)
+	dir, err := OpenMediaDir(outputDir, layout)
+	if err != nil {
+		return err
 	}
 
 	// Query all messages from DuckDB
@@ -58,6 +62,12 @@ func DownloadImages(outputDir string, thumbnails bool) error {
 		return fmt.Errorf("failed to get existing files: %w", err)
 	}
 
+	ctx := context.Background()
+	recorded, err := downloadedMedia(ctx)
+	if err != nil {
+		return err
+	}
+
 	// Filter messages to only download new ones
 	var newMessages []*Message
 	for _, msg := range imageMessages {
@@ -67,6 +77,11 @@ func DownloadImages(outputDir string, thumbnails bool) error {
 		}
 		if _, exists := existingStemSet[stem]; !exists {
 			newMessages = append(newMessages, msg)
+			continue
+		}
+		kind := mediaKind(msg, thumbnails)
+		if err := recordStoredMedia(ctx, recorded, msg.EventID, kind, mediaURL(msg, kind), dir, stem); err != nil {
+			return err
 		}
 	}
 
@@ -91,10 +106,11 @@ func DownloadImages(outputDir string, thumbnails bool) error {
 	fmt.Printf("Downloading %d new %s...\n", len(newMessages), noun)
 
 	// Download new images
-	return runDownloads(newMessages, outputDir, thumbnails)
+	return runDownloads(newMessages, dir, thumbnails)
 }
 
-// GetExistingFilesMap returns a map of existing file stems in the directory
+// GetExistingFilesMap returns a map of the file stems downloaded to the
+// directory, including media IDs in a hashed layout's index
 func GetExistingFilesMap(dir string) (map[string]bool, error) {
 	stemSet := make(map[string]bool)
 
@@ -113,6 +129,15 @@ func GetExistingFilesMap(dir string) (map[string]bool, error) {
 		}
 	}
 
+	// Media stored in the hashed layout is listed in the index
+	index, err := loadMediaIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+	for stem := range index {
+		stemSet[stem] = true
+	}
+
 	return stemSet, nil
 }
 
@@ -140,93 +165,120 @@ func GetDownloadStem(msg Message, preferThumbnails bool) string {
 	return strings.TrimPrefix(u.Path, "/")
 }
 
-// runDownloads downloads images from the message list
-func runDownloads(messages []*Message, downloadDir string, preferThumbnails bool) error {
+// errOverBudget is returned by downloadImage when a file is larger than the space left
+var errOverBudget = errors.New("over budget")
+
+// runDownloads downloads images from the message list and records the
+// outcome of each download
+func runDownloads(messages []*Message, dir *MediaDir, preferThumbnails bool) error {
 	client := &http.Client{}
+	ctx := context.Background()
 
 	for _, msg := range messages {
-		var imageURL string
-		if preferThumbnails {
-			imageURL = msg.ThumbnailURL()
-		}
-		if imageURL == "" {
-			imageURL = msg.ImageURL()
-		}
-
+		kind := mediaKind(msg, preferThumbnails)
+		imageURL := mediaURL(msg, kind)
 		if imageURL == "" {
 			continue
 		}
 
-		// Convert mxc URL to download URL
-		downloadURL, err := GetDownloadURL(imageURL)
+		stem := GetDownloadStem(*msg, preferThumbnails)
+		file, err := downloadImage(client, imageURL, dir, stem, 0)
 		if err != nil {
-			fmt.Printf("Failed to get download URL for %s: %v. Skipping...\n", imageURL, err)
-			continue
+			fmt.Printf("Skipping %s: %v\n", imageURL, err)
 		}
-
-		// Get content type and validate it's an image
-		resp, err := client.Head(downloadURL)
-		if err != nil {
-			fmt.Printf("Failed to check %s: %v. Skipping...\n", imageURL, err)
-			continue
+		if err := recordMedia(ctx, msg.EventID, kind, imageURL, file, err); err != nil {
+			return err
 		}
-		resp.Body.Close()
+	}
 
-		contentType := resp.Header.Get("Content-Type")
-		if !strings.HasPrefix(contentType, "image/") {
-			fmt.Printf("Skipping %s: %s\n", imageURL, contentType)
-			continue
-		}
+	return nil
+}
 
-		// Extract file extension from content type
-		parts := strings.Split(contentType, "/")
-		var ext string
-		if len(parts) == 2 {
-			ext = "." + parts[1]
-		} else {
-			ext = ".jpg" // fallback
-		}
+// downloadImage saves an mxc image to dir under stem, with an extension taken
+// from its content type as sniffed from its first bytes, and returns the saved file's path, hash and size. If
+// maxBytes is positive, larger files are not kept and errOverBudget is
+// returned.
+func downloadImage(client *http.Client, imageURL string, dir *MediaDir, stem string, maxBytes int64) (*MediaFile, error) {
+	return downloadMedia(client, imageURL, dir, stem, maxBytes, MediaKindImage)
+}
 
-		// Download the image
-		resp, err = client.Get(downloadURL)
-		if err != nil {
-			fmt.Printf("Failed to download %s: %v. Skipping...\n", imageURL, err)
-			continue
-		}
-		defer resp.Body.Close()
+// mediaContentTypes lists the content type prefixes accepted for each kind of
+// media file, with what to call other content
+var mediaContentTypes = map[string]struct {
+	prefixes []string
+	noun     string
+}{
+	MediaKindThumbnail: {[]string{"image/"}, "an image"},
+	MediaKindImage:     {[]string{"image/"}, "an image"},
+	MediaKindRecording: {[]string{"audio/", "video/"}, "audio or video"},
+	MediaKindEmote:     {[]string{"image/"}, "an image"},
+}
 
-		if resp.StatusCode != http.StatusOK {
-			fmt.Printf("Failed to download %s: HTTP %d. Skipping...\n", imageURL, resp.StatusCode)
-			continue
-		}
+// downloadMedia saves an mxc file of the given kind as downloadImage does,
+// rejecting content whose type doesn't suit the kind
+func downloadMedia(client *http.Client, imageURL string, dir *MediaDir, stem string, maxBytes int64, kind string) (*MediaFile, error) {
+	// Convert mxc URL to download URL
+	downloadURL, err := GetDownloadURL(imageURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get download URL: %w", err)
+	}
 
-		// Create filename
-		stem := GetDownloadStem(*msg, preferThumbnails)
-		filename := filepath.Join(downloadDir, stem+ext)
+	resp, err := client.Get(downloadURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download: %w", err)
+	}
+	defer resp.Body.Close()
 
-		// Create directory for file if needed
-		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
-			fmt.Printf("Failed to create directory for %s: %v. Skipping...\n", filename, err)
-			continue
-		}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download: HTTP %d", resp.StatusCode)
+	}
 
-		// Create file
-		file, err := os.Create(filename)
-		if err != nil {
-			fmt.Printf("Failed to create file %s: %v. Skipping...\n", filename, err)
-			continue
+	// Judge the file by its content, since bridges often upload media with
+	// a missing or wrong type, and take its extension from what it is
+	claimed := mediaType(resp.Header.Get("Content-Type"))
+	body := bufio.NewReaderSize(resp.Body, sniffLength)
+	head, _ := body.Peek(sniffLength)
+	detected := SniffMediaType(head)
+	contentType := detected
+	if contentType == "" {
+		contentType = claimed
+	}
+	accepted := mediaContentTypes[kind]
+	if !slices.ContainsFunc(accepted.prefixes, func(prefix string) bool { return strings.HasPrefix(contentType, prefix) }) {
+		if detected != "" && detected != claimed {
+			return nil, fmt.Errorf("not %s: %s, served as %s", accepted.noun, detected, claimed)
 		}
+		return nil, fmt.Errorf("not %s: %s", accepted.noun, contentType)
+	}
+	ext := MediaExtension(contentType)
+	if ext == "" {
+		ext = ".jpg" // fallback
+	}
 
-		// Copy data
-		fmt.Printf("Downloading %s -> %s\n", imageURL, filename)
-		_, err = io.Copy(file, resp.Body)
-		file.Close()
+	if maxBytes > 0 && resp.ContentLength > maxBytes {
+		return nil, errOverBudget
+	}
 
-		if err != nil {
-			fmt.Printf("Failed to write %s: %v\n", filename, err)
-			os.Remove(filename) // Clean up partial file
-		}
+	target := filepath.Join(dir.path, stem+ext)
+	if dir.Hashed() {
+		target = dir.path
 	}
+	fmt.Fprintf(progressWriter(), "Downloading %s -> %s\n", imageURL, target)
+	if detected != "" && detected != claimed {
+		fmt.Fprintf(progressWriter(), "  Served as %s, but is %s\n", orUnknown(claimed), detected)
+	}
+	file, err := dir.save(stem, ext, claimed, detected, body, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	file.ClaimedType, file.DetectedType = claimed, detected
+	return file, nil
+}
 
-	return nil
+// orUnknown returns a content type, or "no type" if there is none
+func orUnknown(contentType string) string {
+	if contentType == "" {
+		return "no type"
+	}
+	return contentType
 }
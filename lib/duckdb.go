@@ -3,7 +3,10 @@ package archive
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"strings"
@@ -16,6 +19,8 @@ import (
 type DuckDBDatabase struct {
 	db     *sql.DB
 	config *DatabaseConfig
+	cipher *contentCipher // set when the archive content is encrypted at rest
+	locked bool           // set when it is, but no passphrase was given
 }
 
 // NewDuckDBDatabase creates a new DuckDB database instance
@@ -74,6 +79,40 @@ func (d *DuckDBDatabase) Connect(ctx context.Context) error {
 		return fmt.Errorf("failed to create tables: %w", err)
 	}
 
+	// Bring tables created by older versions up to date
+	if err := d.Migrate(ctx); err != nil {
+		return fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	// Derive the content encryption key when a passphrase is configured;
+	// without one, an encrypted archive can be read but not written to
+	if d.config.Passphrase != "" {
+		if err := d.setupEncryption(ctx); err != nil {
+			return fmt.Errorf("failed to set up content encryption: %w", err)
+		}
+	} else {
+		salt, err := d.getSetting(ctx, settingEncryptionSalt)
+		if err != nil {
+			return fmt.Errorf("failed to read encryption settings: %w", err)
+		}
+		d.locked = salt != ""
+	}
+
+	// Record event types for rows archived before they were stored; this reads
+	// content, so it runs once the encryption key is available
+	if err := d.migrateEventTypes(ctx); err != nil {
+		return fmt.Errorf("failed to migrate event types: %w", err)
+	}
+	if err := d.migrateContentHashes(ctx); err != nil {
+		return fmt.Errorf("failed to migrate content hashes: %w", err)
+	}
+	if err := d.migrateFileMetadata(ctx); err != nil {
+		return fmt.Errorf("failed to migrate file metadata: %w", err)
+	}
+	if err := d.migrateDailyStats(ctx); err != nil {
+		return fmt.Errorf("failed to migrate daily stats: %w", err)
+	}
+
 	if d.config.Debug {
 		log.Printf("Connected to DuckDB at: %s", connStr)
 	}
@@ -108,15 +147,331 @@ func (d *DuckDBDatabase) CreateTables(ctx context.Context) error {
 			sender VARCHAR NOT NULL,
 			user_id VARCHAR,
 			message_type VARCHAR NOT NULL,
+			msgtype VARCHAR,
 			timestamp TIMESTAMP NOT NULL,
 			content JSON,
+			account VARCHAR,
+			forwarded_from VARCHAR,
+			forwarded_platform VARCHAR,
+			content_hash VARCHAR,
+			file_name VARCHAR,
+			file_mimetype VARCHAR,
+			file_size BIGINT,
+			author_name VARCHAR,
+			author_platform VARCHAR,
+			aggregations JSON,
+			lang VARCHAR,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+	`
+
+	// Key/value settings for the archive itself (e.g. encryption salt)
+	createSettingsTable := `
+		CREATE TABLE IF NOT EXISTS archive_settings (
+			key VARCHAR PRIMARY KEY,
+			value VARCHAR NOT NULL
+		);
+	`
+
+	// Curator notes on archived messages
+	createAnnotationsTable := `
+		CREATE TABLE IF NOT EXISTS annotations (
+			id INTEGER PRIMARY KEY,
+			event_id VARCHAR NOT NULL,
+			note VARCHAR NOT NULL,
+			author VARCHAR,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+	`
+
+	// Pinned events from each room's m.room.pinned_events state, replaced on every import
+	createPinnedEventsTable := `
+		CREATE TABLE IF NOT EXISTS pinned_events (
+			room_id VARCHAR NOT NULL,
+			event_id VARCHAR NOT NULL,
+			position INTEGER NOT NULL,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+	`
+
+	// Messages bookmarked locally by the archive's curator
+	createBookmarksTable := `
+		CREATE TABLE IF NOT EXISTS bookmarks (
+			event_id VARCHAR PRIMARY KEY,
+			label VARCHAR,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+	`
+
+	// m.room.member events from room timelines (joins, leaves, profile changes)
+	createMembershipEventsTable := `
+		CREATE TABLE IF NOT EXISTS membership_events (
+			event_id VARCHAR PRIMARY KEY,
+			room_id VARCHAR NOT NULL,
+			user_id VARCHAR NOT NULL,
+			membership VARCHAR NOT NULL,
+			display_name VARCHAR,
+			avatar_url VARCHAR,
+			timestamp TIMESTAMP NOT NULL
+		);
+	`
+
+	// Invites, knocks, kicks and bans, archived with --moderation
+	createModerationEventsTable := `
+		CREATE TABLE IF NOT EXISTS moderation_events (
+			event_id VARCHAR PRIMARY KEY,
+			room_id VARCHAR NOT NULL,
+			action VARCHAR NOT NULL,
+			actor VARCHAR NOT NULL,
+			target VARCHAR NOT NULL,
+			reason VARCHAR,
+			timestamp TIMESTAMP NOT NULL
+		);
+	`
+
+	// The archiving user's room tags and direct chats (m.tag and m.direct account data)
+	createRoomTagsTable := `
+		CREATE TABLE IF NOT EXISTS room_tags (
+			room_id VARCHAR NOT NULL,
+			tag VARCHAR NOT NULL,
+			tag_order DOUBLE,
+			PRIMARY KEY (room_id, tag)
+		);
+	`
+
+	createDirectRoomsTable := `
+		CREATE TABLE IF NOT EXISTS direct_rooms (
+			user_id VARCHAR NOT NULL,
+			room_id VARCHAR NOT NULL,
+			PRIMARY KEY (user_id, room_id)
+		);
+	`
+
+	// Emote packs (MSC2545): rooms' im.ponies.room_emotes state, and the
+	// user's im.ponies.user_emotes account data under an empty room ID
+	createEmotePacksTable := `
+		CREATE TABLE IF NOT EXISTS emote_packs (
+			room_id VARCHAR NOT NULL,
+			state_key VARCHAR NOT NULL,
+			content JSON,
+			updated_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (room_id, state_key)
+		);
+	`
+
+	// Each room's version and its neighbours in a chain of room upgrades
+	// (m.room.create predecessor and m.room.tombstone replacement)
+	createRoomVersionsTable := `
+		CREATE TABLE IF NOT EXISTS room_versions (
+			room_id VARCHAR PRIMARY KEY,
+			room_version VARCHAR,
+			predecessor_id VARCHAR,
+			successor_id VARCHAR,
+			upgraded_at TIMESTAMP
+		);
+	`
+
+	// Each room's name, topic, canonical alias and creation time, from its
+	// state when it was last imported, for export headers
+	createRoomsTable := `
+		CREATE TABLE IF NOT EXISTS rooms (
+			room_id VARCHAR PRIMARY KEY,
+			name VARCHAR,
+			topic VARCHAR,
+			canonical_alias VARCHAR,
+			created_at TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+	`
+
+	// Messages per room, day (UTC), sender and event type, kept up to date as
+	// messages are inserted and deleted so statistics don't scan every message
+	createDailyStatsTable := `
+		CREATE TABLE IF NOT EXISTS daily_stats (
+			room_id VARCHAR NOT NULL,
+			day DATE NOT NULL,
+			sender VARCHAR NOT NULL,
+			message_type VARCHAR NOT NULL,
+			message_count BIGINT NOT NULL,
+			first_message TIMESTAMP NOT NULL,
+			last_message TIMESTAMP NOT NULL,
+			PRIMARY KEY (room_id, day, sender, message_type)
+		);
+	`
+
+	// Rooms whose archive was sealed as complete, with the range and hash of
+	// the messages it held then
+	createRoomSealsTable := `
+		CREATE TABLE IF NOT EXISTS room_seals (
+			room_id VARCHAR PRIMARY KEY,
+			sealed_at TIMESTAMP NOT NULL,
+			first_event_id VARCHAR NOT NULL,
+			first_timestamp TIMESTAMP NOT NULL,
+			last_event_id VARCHAR NOT NULL,
+			last_timestamp TIMESTAMP NOT NULL,
+			message_count BIGINT NOT NULL,
+			hash VARCHAR NOT NULL
+		);
+	`
+
+	// Resume positions for imports spread over several runs
+	createImportStateTable := `
+		CREATE TABLE IF NOT EXISTS import_state (
+			room_id VARCHAR PRIMARY KEY,
+			next_batch VARCHAR,
+			complete BOOLEAN NOT NULL DEFAULT false,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+	`
+
+	// Text extracted from downloaded images by OCR
+	createMediaTextTable := `
+		CREATE TABLE IF NOT EXISTS media_text (
+			event_id VARCHAR PRIMARY KEY,
+			room_id VARCHAR NOT NULL,
+			path VARCHAR NOT NULL,
+			text VARCHAR NOT NULL,
+			engine VARCHAR,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		);
 	`
 
+	// Reactions, edits and replies whose target event isn't archived yet,
+	// recorded after each import
+	createUnresolvedRelationsTable := `
+		CREATE TABLE IF NOT EXISTS unresolved_relations (
+			event_id VARCHAR NOT NULL,
+			target_event_id VARCHAR NOT NULL,
+			room_id VARCHAR NOT NULL,
+			rel_type VARCHAR NOT NULL,
+			first_seen TIMESTAMP NOT NULL,
+			PRIMARY KEY (event_id, target_event_id)
+		);
+	`
+
+	// Local copies of messages' media, kept up to date by the downloaders.
+	// event_id refers to messages(event_id); it isn't declared a foreign key
+	// because DuckDB then refuses the ALTER TABLE migrations of messages.
+	createMediaTable := `
+		CREATE TABLE IF NOT EXISTS media (
+			event_id VARCHAR NOT NULL,
+			kind VARCHAR NOT NULL,
+			mxc VARCHAR NOT NULL,
+			path VARCHAR,
+			status VARCHAR NOT NULL,
+			sha256 VARCHAR,
+			size BIGINT,
+			error VARCHAR,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (event_id, kind)
+		);
+	`
+
+	// Room members' display names and avatars, cached for exports
+	createUsersTable := `
+		CREATE TABLE IF NOT EXISTS users (
+			room_id VARCHAR NOT NULL,
+			user_id VARCHAR NOT NULL,
+			display_name VARCHAR,
+			avatar_url VARCHAR,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (room_id, user_id)
+		);
+	`
+
+	// Input hash of each export target's last run, for export --if-changed
+	createExportStateTable := `
+		CREATE TABLE IF NOT EXISTS export_state (
+			target VARCHAR PRIMARY KEY,
+			input_hash VARCHAR NOT NULL,
+			exported_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+	`
+
+	// Messages that imports rejected as invalid, kept whole for review
+	createQuarantinedMessagesTable := `
+		CREATE TABLE IF NOT EXISTS quarantined_messages (
+			event_id VARCHAR PRIMARY KEY,
+			room_id VARCHAR,
+			sender VARCHAR,
+			message JSON NOT NULL,
+			reason VARCHAR NOT NULL,
+			validation VARCHAR NOT NULL,
+			quarantined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+	`
+
+	// Raw events imports couldn't convert, or could only store as
+	// placeholders because they couldn't be decrypted
+	createFailedEventsTable := `
+		CREATE TABLE IF NOT EXISTS failed_events (
+			event_id VARCHAR PRIMARY KEY,
+			room_id VARCHAR NOT NULL,
+			stage VARCHAR NOT NULL,
+			error VARCHAR NOT NULL,
+			event JSON NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 1,
+			failed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+	`
+
+	// Rooms and events "restore" recreated on another homeserver
+	createRestoredRoomsTable := `
+		CREATE TABLE IF NOT EXISTS restored_rooms (
+			source_room_id VARCHAR NOT NULL,
+			homeserver VARCHAR NOT NULL,
+			target_room_id VARCHAR NOT NULL,
+			restored_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (source_room_id, homeserver)
+		);
+	`
+
+	createRestoredEventsTable := `
+		CREATE TABLE IF NOT EXISTS restored_events (
+			source_event_id VARCHAR NOT NULL,
+			source_room_id VARCHAR NOT NULL,
+			homeserver VARCHAR NOT NULL,
+			target_event_id VARCHAR NOT NULL,
+			PRIMARY KEY (source_event_id, homeserver)
+		);
+	`
+
+	// People who declined to have their messages archived
+	createOptOutsTable := `
+		CREATE TABLE IF NOT EXISTS opt_outs (
+			user_id VARCHAR PRIMARY KEY,
+			reason VARCHAR,
+			opted_out_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+	`
+
+	// The person each merged user ID belongs to
+	createPersonAliasesTable := `
+		CREATE TABLE IF NOT EXISTS person_aliases (
+			user_id VARCHAR PRIMARY KEY,
+			person_id VARCHAR NOT NULL,
+			merged_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+	`
+
+	// Results of checking archived messages against their homeserver's signed copies
+	createEventVerificationsTable := `
+		CREATE TABLE IF NOT EXISTS event_verifications (
+			event_id VARCHAR PRIMARY KEY,
+			room_id VARCHAR NOT NULL,
+			status VARCHAR NOT NULL,
+			source VARCHAR,
+			origin VARCHAR,
+			key_id VARCHAR,
+			detail VARCHAR,
+			checked_at TIMESTAMP NOT NULL
+		);
+	`
+
 	// Create sequence for auto-incrementing ID (DuckDB specific)
 	createSequence := `
 		CREATE SEQUENCE IF NOT EXISTS seq_messages_id START 1;
+		CREATE SEQUENCE IF NOT EXISTS seq_annotations_id START 1;
 	`
 
 	// Create indexes for better query performance
@@ -126,6 +481,9 @@ func (d *DuckDBDatabase) CreateTables(ctx context.Context) error {
 		"CREATE INDEX IF NOT EXISTS idx_messages_sender ON messages(sender);",
 		"CREATE INDEX IF NOT EXISTS idx_messages_timestamp ON messages(timestamp);",
 		"CREATE INDEX IF NOT EXISTS idx_messages_room_timestamp ON messages(room_id, timestamp);",
+		"CREATE INDEX IF NOT EXISTS idx_annotations_event_id ON annotations(event_id);",
+		"CREATE INDEX IF NOT EXISTS idx_pinned_events_room_id ON pinned_events(room_id);",
+		"CREATE INDEX IF NOT EXISTS idx_membership_events_room_user ON membership_events(room_id, user_id, timestamp);",
 	}
 
 	// Execute sequence creation first
@@ -138,6 +496,110 @@ func (d *DuckDBDatabase) CreateTables(ctx context.Context) error {
 		return fmt.Errorf("failed to create messages table: %w", err)
 	}
 
+	if _, err := d.db.ExecContext(ctx, createSettingsTable); err != nil {
+		return fmt.Errorf("failed to create settings table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createAnnotationsTable); err != nil {
+		return fmt.Errorf("failed to create annotations table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createPinnedEventsTable); err != nil {
+		return fmt.Errorf("failed to create pinned events table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createBookmarksTable); err != nil {
+		return fmt.Errorf("failed to create bookmarks table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createMembershipEventsTable); err != nil {
+		return fmt.Errorf("failed to create membership events table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createModerationEventsTable); err != nil {
+		return fmt.Errorf("failed to create moderation events table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createRoomTagsTable); err != nil {
+		return fmt.Errorf("failed to create room tags table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createDirectRoomsTable); err != nil {
+		return fmt.Errorf("failed to create direct rooms table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createEmotePacksTable); err != nil {
+		return fmt.Errorf("failed to create emote packs table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createRoomVersionsTable); err != nil {
+		return fmt.Errorf("failed to create room versions table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createRoomsTable); err != nil {
+		return fmt.Errorf("failed to create rooms table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createDailyStatsTable); err != nil {
+		return fmt.Errorf("failed to create daily stats table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createRoomSealsTable); err != nil {
+		return fmt.Errorf("failed to create room seals table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createImportStateTable); err != nil {
+		return fmt.Errorf("failed to create import state table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createMediaTextTable); err != nil {
+		return fmt.Errorf("failed to create media text table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createMediaTable); err != nil {
+		return fmt.Errorf("failed to create media table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createUnresolvedRelationsTable); err != nil {
+		return fmt.Errorf("failed to create unresolved relations table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createUsersTable); err != nil {
+		return fmt.Errorf("failed to create users table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createExportStateTable); err != nil {
+		return fmt.Errorf("failed to create export state table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createQuarantinedMessagesTable); err != nil {
+		return fmt.Errorf("failed to create quarantined messages table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createFailedEventsTable); err != nil {
+		return fmt.Errorf("failed to create failed events table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createRestoredRoomsTable); err != nil {
+		return fmt.Errorf("failed to create restored rooms table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createRestoredEventsTable); err != nil {
+		return fmt.Errorf("failed to create restored events table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createOptOutsTable); err != nil {
+		return fmt.Errorf("failed to create opt-outs table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createPersonAliasesTable); err != nil {
+		return fmt.Errorf("failed to create person aliases table: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, createEventVerificationsTable); err != nil {
+		return fmt.Errorf("failed to create event verifications table: %w", err)
+	}
+
 	// Execute index creation
 	for _, indexSQL := range createIndexes {
 		if _, err := d.db.ExecContext(ctx, indexSQL); err != nil {
@@ -150,11 +612,229 @@ func (d *DuckDBDatabase) CreateTables(ctx context.Context) error {
 
 // Migrate applies any necessary database migrations
 func (d *DuckDBDatabase) Migrate(ctx context.Context) error {
-	// For now, this is a no-op as we're starting fresh
-	// In the future, we could add version-based migrations
+	// Each migration is idempotent so it can run on every connect
+	migrations := []string{
+		// Source account per message (multi-homeserver archives)
+		"ALTER TABLE messages ADD COLUMN IF NOT EXISTS account VARCHAR;",
+		"CREATE INDEX IF NOT EXISTS idx_messages_account ON messages(account);",
+		// Forwarding provenance parsed from bridge hints
+		"ALTER TABLE messages ADD COLUMN IF NOT EXISTS forwarded_from VARCHAR;",
+		"ALTER TABLE messages ADD COLUMN IF NOT EXISTS forwarded_platform VARCHAR;",
+		// msgtype alongside the real event type; NULL marks rows awaiting migrateEventTypes.
+		// Not indexed: DuckDB can't update indexed columns of rows under a primary key.
+		"ALTER TABLE messages ADD COLUMN IF NOT EXISTS msgtype VARCHAR;",
+		// Normalized content hash for spotting re-bridged duplicates; NULL marks
+		// rows awaiting migrateContentHashes, and every row of an encrypted archive
+		"ALTER TABLE messages ADD COLUMN IF NOT EXISTS content_hash VARCHAR;",
+		// Name, type and size of m.file attachments; a NULL file_name on an
+		// m.file row marks it as awaiting migrateFileMetadata
+		"ALTER TABLE messages ADD COLUMN IF NOT EXISTS file_name VARCHAR;",
+		"ALTER TABLE messages ADD COLUMN IF NOT EXISTS file_mimetype VARCHAR;",
+		"ALTER TABLE messages ADD COLUMN IF NOT EXISTS file_size BIGINT;",
+		// Real author of messages a bot or webhook relayed, from attribution rules
+		"ALTER TABLE messages ADD COLUMN IF NOT EXISTS author_name VARCHAR;",
+		"ALTER TABLE messages ADD COLUMN IF NOT EXISTS author_platform VARCHAR;",
+		// The server's bundled aggregations of each event when it was fetched
+		"ALTER TABLE messages ADD COLUMN IF NOT EXISTS aggregations JSON;",
+		// Language of each message, when detected at import
+		"ALTER TABLE messages ADD COLUMN IF NOT EXISTS lang VARCHAR;",
+		// Users whose accounts were deactivated, so their profiles aren't looked up again
+		"ALTER TABLE users ADD COLUMN IF NOT EXISTS deactivated BOOLEAN DEFAULT false;",
+		// Bridged users' identities on their own networks, from their member events
+		"ALTER TABLE users ADD COLUMN IF NOT EXISTS platform JSON;",
+		// Downloaded media's content type as served and as sniffed from the file
+		"ALTER TABLE media ADD COLUMN IF NOT EXISTS claimed_type VARCHAR;",
+		"ALTER TABLE media ADD COLUMN IF NOT EXISTS detected_type VARCHAR;",
+	}
+
+	for _, migrationSQL := range migrations {
+		if _, err := d.db.ExecContext(ctx, migrationSQL); err != nil {
+			return fmt.Errorf("failed to apply migration %q: %w", migrationSQL, err)
+		}
+	}
+
+	return nil
+}
+
+// migrateEventTypes fills in message_type and msgtype for messages archived when
+// every row was stored as m.room.message. Rows whose content is encrypted and
+// can't be read yet are left for a later connect with the passphrase.
+func (d *DuckDBDatabase) migrateEventTypes(ctx context.Context) error {
+	rows, err := d.db.QueryContext(ctx, "SELECT event_id, content::VARCHAR FROM messages WHERE msgtype IS NULL")
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %w", err)
+	}
+
+	pending := make(map[string]*Message)
+	for rows.Next() {
+		var eventID string
+		var contentJSON sql.NullString
+		if err := rows.Scan(&eventID, &contentJSON); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan message: %w", err)
+		}
+		message := &Message{EventID: eventID}
+		if err := d.decodeContent(message, contentJSON.String); err != nil {
+			continue
+		}
+		pending[eventID] = message
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for eventID, message := range pending {
+		eventType := inferEventType(message.Content)
+		if _, err := tx.ExecContext(ctx, "UPDATE messages SET message_type = ?, msgtype = ? WHERE event_id = ?",
+			eventType, contentMsgType(message.Content), eventID); err != nil {
+			return fmt.Errorf("failed to update message %s: %w", eventID, err)
+		}
+	}
+	// The statistics count messages by their old type; migrateDailyStats rebuilds them
+	if _, err := tx.ExecContext(ctx, "DELETE FROM daily_stats"); err != nil {
+		return fmt.Errorf("failed to clear daily stats: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// contentHashVersion is recorded in archive_settings and changes whenever
+// NormalizedContentHash does, so hashes stored by older versions are redone
+const (
+	contentHashVersion        = "2" // Relation targets are hashed
+	settingContentHashVersion = "content_hash_version"
+)
+
+// migrateContentHashes stores normalized content hashes for messages archived
+// before they were recorded, or by a version that hashed them differently.
+// Encrypted archives don't store hashes, so it does nothing for them.
+func (d *DuckDBDatabase) migrateContentHashes(ctx context.Context) error {
+	if d.cipher != nil || d.locked {
+		return nil
+	}
+
+	version, err := d.getSetting(ctx, settingContentHashVersion)
+	if err != nil {
+		return err
+	}
+	if version != contentHashVersion {
+		// Only relations hash differently in version 2
+		if _, err := d.db.ExecContext(ctx, "UPDATE messages SET content_hash = NULL WHERE content_hash IS NOT NULL AND content::VARCHAR LIKE '%m.relates_to%'"); err != nil {
+			return fmt.Errorf("failed to clear outdated content hashes: %w", err)
+		}
+	}
+
+	rows, err := d.db.QueryContext(ctx, "SELECT event_id, sender, message_type, timestamp, content::VARCHAR FROM messages WHERE content_hash IS NULL")
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %w", err)
+	}
+
+	var pending []*Message
+	for rows.Next() {
+		message := &Message{}
+		var contentJSON sql.NullString
+		if err := rows.Scan(&message.EventID, &message.Sender, &message.MessageType, &message.Timestamp, &contentJSON); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan message: %w", err)
+		}
+		if err := d.decodeContent(message, contentJSON.String); err != nil {
+			continue
+		}
+		pending = append(pending, message)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	if len(pending) > 0 {
+		tx, err := d.db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer tx.Rollback()
+
+		for _, message := range pending {
+			if _, err := tx.ExecContext(ctx, "UPDATE messages SET content_hash = ? WHERE event_id = ?",
+				NormalizedContentHash(message), message.EventID); err != nil {
+				return fmt.Errorf("failed to update message %s: %w", message.EventID, err)
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	if version != contentHashVersion {
+		return d.setSetting(ctx, settingContentHashVersion, contentHashVersion)
+	}
 	return nil
 }
 
+// migrateFileMetadata stores the name, type and size of m.file attachments
+// archived before they were recorded. Like content hashes, they aren't stored
+// in encrypted archives.
+func (d *DuckDBDatabase) migrateFileMetadata(ctx context.Context) error {
+	if d.cipher != nil || d.locked {
+		return nil
+	}
+
+	rows, err := d.db.QueryContext(ctx, "SELECT event_id, content::VARCHAR FROM messages WHERE msgtype = 'm.file' AND file_name IS NULL")
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %w", err)
+	}
+
+	var pending []*Message
+	for rows.Next() {
+		message := &Message{}
+		var contentJSON sql.NullString
+		if err := rows.Scan(&message.EventID, &contentJSON); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan message: %w", err)
+		}
+		if err := d.decodeContent(message, contentJSON.String); err != nil {
+			continue
+		}
+		pending = append(pending, message)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, message := range pending {
+		name, mimeType, size := d.fileColumnsForStorage(message)
+		if _, err := tx.ExecContext(ctx, "UPDATE messages SET file_name = ?, file_mimetype = ?, file_size = ? WHERE event_id = ?",
+			name, mimeType, size, message.EventID); err != nil {
+			return fmt.Errorf("failed to update message %s: %w", message.EventID, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
 // ExecuteQuery executes a raw SQL query and returns results as map slices
 func (d *DuckDBDatabase) ExecuteQuery(ctx context.Context, query string, args ...interface{}) ([]map[string]interface{}, error) {
 	if d.db == nil {
@@ -205,14 +885,17 @@ func (d *DuckDBDatabase) ExecuteQuery(ctx context.Context, query string, args ..
 // InsertMessage inserts a single message into the database
 func (d *DuckDBDatabase) InsertMessage(ctx context.Context, message *Message) error {
 	insertSQL := `
-		INSERT INTO messages (id, room_id, event_id, sender, user_id, message_type, timestamp, content)
-		VALUES (nextval('seq_messages_id'), ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO messages (id, room_id, event_id, sender, user_id, message_type, msgtype, timestamp, content, account, forwarded_from, forwarded_platform, content_hash, file_name, file_mimetype, file_size, author_name, author_platform, aggregations, lang)
+		VALUES (nextval('seq_messages_id'), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
-	contentJSON, err := message.ContentJSON()
+	contentJSON, err := d.encodeContent(message)
 	if err != nil {
 		return fmt.Errorf("failed to serialize content: %w", err)
 	}
+	fileName, fileMimeType, fileSize := d.fileColumnsForStorage(message)
+	forwardedFrom, forwardedPlatform := d.forwardingForStorage(message)
+	authorName, authorPlatform := d.authorForStorage(message)
 
 	result, err := d.db.ExecContext(ctx, insertSQL,
 		message.RoomID,
@@ -220,13 +903,28 @@ func (d *DuckDBDatabase) InsertMessage(ctx context.Context, message *Message) er
 		message.Sender,
 		message.UserID,
 		message.MessageType,
+		message.msgTypeForStorage(),
 		message.Timestamp,
 		contentJSON,
+		message.Account,
+		forwardedFrom,
+		forwardedPlatform,
+		d.contentHashForStorage(message),
+		fileName,
+		fileMimeType,
+		fileSize,
+		authorName,
+		authorPlatform,
+		d.aggregationsForStorage(message),
+		d.langForStorage(message),
 	)
 
 	if err != nil {
 		return fmt.Errorf("failed to insert message: %w", err)
 	}
+	if err := countDailyStats(ctx, d.db, message, 1); err != nil {
+		return err
+	}
 
 	// Get the inserted ID
 	id, err := result.LastInsertId()
@@ -242,11 +940,16 @@ func (d *DuckDBDatabase) InsertMessageBatch(ctx context.Context, messages []*Mes
 	if len(messages) == 0 {
 		return 0, nil
 	}
+	if d.locked {
+		return 0, ErrPassphraseRequired
+	}
 
-	// Prepare batch insert statement
+	// Prepare batch insert statement. Events already archived (possibly
+	// through another account) are skipped rather than failing the batch.
 	insertSQL := `
-		INSERT INTO messages (id, room_id, event_id, sender, user_id, message_type, timestamp, content)
-		VALUES (nextval('seq_messages_id'), ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO messages (id, room_id, event_id, sender, user_id, message_type, msgtype, timestamp, content, account, forwarded_from, forwarded_platform, content_hash, file_name, file_mimetype, file_size, author_name, author_platform, aggregations, lang)
+		VALUES (nextval('seq_messages_id'), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (event_id) DO NOTHING
 	`
 
 	stmt, err := d.db.PrepareContext(ctx, insertSQL)
@@ -263,21 +966,37 @@ func (d *DuckDBDatabase) InsertMessageBatch(ctx context.Context, messages []*Mes
 	defer tx.Rollback()
 
 	insertedCount := 0
+	var skipped []*Message
 	for _, message := range messages {
-		contentJSON, err := message.ContentJSON()
+		contentJSON, err := d.encodeContent(message)
 		if err != nil {
 			log.Printf("Warning: failed to serialize content for message %s: %v", message.EventID, err)
 			continue
 		}
+		fileName, fileMimeType, fileSize := d.fileColumnsForStorage(message)
+		forwardedFrom, forwardedPlatform := d.forwardingForStorage(message)
+		authorName, authorPlatform := d.authorForStorage(message)
 
-		_, err = tx.StmtContext(ctx, stmt).ExecContext(ctx,
+		result, err := tx.StmtContext(ctx, stmt).ExecContext(ctx,
 			message.RoomID,
 			message.EventID,
 			message.Sender,
 			message.UserID,
 			message.MessageType,
+			message.msgTypeForStorage(),
 			message.Timestamp,
 			contentJSON,
+			message.Account,
+			forwardedFrom,
+			forwardedPlatform,
+			d.contentHashForStorage(message),
+			fileName,
+			fileMimeType,
+			fileSize,
+			authorName,
+			authorPlatform,
+			d.aggregationsForStorage(message),
+			d.langForStorage(message),
 		)
 
 		if err != nil {
@@ -285,6 +1004,14 @@ func (d *DuckDBDatabase) InsertMessageBatch(ctx context.Context, messages []*Mes
 			log.Printf("Warning: failed to insert message %s: %v", message.EventID, err)
 			continue
 		}
+
+		if rowsAffected, err := result.RowsAffected(); err == nil && rowsAffected == 0 {
+			skipped = append(skipped, message)
+			continue
+		}
+		if err := countDailyStats(ctx, tx, message, 1); err != nil {
+			return insertedCount, err
+		}
 		insertedCount++
 	}
 
@@ -292,13 +1019,62 @@ func (d *DuckDBDatabase) InsertMessageBatch(ctx context.Context, messages []*Mes
 		return insertedCount, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	return insertedCount, nil
+	var collisions []*EventIDCollision
+	for _, message := range skipped {
+		if collision := d.eventIDCollision(ctx, message); collision != nil {
+			collisions = append(collisions, collision)
+		}
+	}
+	if len(collisions) > 0 {
+		return insertedCount, &EventIDCollisionError{Collisions: collisions}
+	}
+
+	return insertedCount, nil
+}
+
+// EventIDCollision is a message that wasn't stored because an event of
+// another room was archived under the same ID, which means two homeservers
+// issued the same ID for unrelated events
+type EventIDCollision struct {
+	Message         *Message
+	ExistingRoomID  string
+	ExistingAccount string
+}
+
+// EventIDCollisionError is returned by InsertMessageBatch for the messages of
+// a batch that collided with events of other rooms. The rest of the batch
+// was stored.
+type EventIDCollisionError struct {
+	Collisions []*EventIDCollision
+}
+
+func (e *EventIDCollisionError) Error() string {
+	c := e.Collisions[0]
+	msg := fmt.Sprintf("event ID %s of room %s is already archived in room %s", c.Message.EventID, c.Message.RoomID, c.ExistingRoomID)
+	if len(e.Collisions) > 1 {
+		msg += fmt.Sprintf(", and %d more event IDs collide", len(e.Collisions)-1)
+	}
+	return msg
+}
+
+// eventIDCollision returns the collision, if a skipped message's event ID
+// belongs to an event of a different room
+func (d *DuckDBDatabase) eventIDCollision(ctx context.Context, message *Message) *EventIDCollision {
+	var existingRoomID, existingAccount string
+	row := d.db.QueryRowContext(ctx, "SELECT room_id, COALESCE(account, '') FROM messages WHERE event_id = ?", message.EventID)
+	if err := row.Scan(&existingRoomID, &existingAccount); err != nil {
+		return nil
+	}
+	if existingRoomID == message.RoomID {
+		return nil
+	}
+	return &EventIDCollision{Message: message, ExistingRoomID: existingRoomID, ExistingAccount: existingAccount}
 }
 
 // GetMessage retrieves a single message by event ID
 func (d *DuckDBDatabase) GetMessage(ctx context.Context, eventID string) (*Message, error) {
 	selectSQL := `
-		SELECT id, room_id, event_id, sender, user_id, message_type, timestamp, content::VARCHAR as content_json
+		SELECT id, room_id, event_id, sender, user_id, message_type, COALESCE(msgtype, ''), timestamp, content::VARCHAR as content_json, COALESCE(account, ''), COALESCE(forwarded_from, ''), COALESCE(forwarded_platform, ''), COALESCE(content_hash, ''), COALESCE(file_name, ''), COALESCE(file_mimetype, ''), COALESCE(file_size, 0), COALESCE(author_name, ''), COALESCE(author_platform, ''), COALESCE(aggregations::VARCHAR, ''), COALESCE(lang, '')
 		FROM messages 
 		WHERE event_id = ?
 	`
@@ -306,7 +1082,7 @@ func (d *DuckDBDatabase) GetMessage(ctx context.Context, eventID string) (*Messa
 	row := d.db.QueryRowContext(ctx, selectSQL, eventID)
 
 	message := &Message{}
-	var contentJSON string
+	var contentJSON, aggregationsJSON string
 	var id int64
 
 	err := row.Scan(
@@ -316,8 +1092,20 @@ func (d *DuckDBDatabase) GetMessage(ctx context.Context, eventID string) (*Messa
 		&message.Sender,
 		&message.UserID,
 		&message.MessageType,
+		&message.MsgType,
 		&message.Timestamp,
 		&contentJSON,
+		&message.Account,
+		&message.ForwardedFrom,
+		&message.ForwardedPlatform,
+		&message.ContentHash,
+		&message.FileName,
+		&message.FileMimeType,
+		&message.FileSize,
+		&message.AuthorName,
+		&message.AuthorPlatform,
+		&aggregationsJSON,
+		&message.Lang,
 	)
 
 	if err != nil {
@@ -328,9 +1116,10 @@ func (d *DuckDBDatabase) GetMessage(ctx context.Context, eventID string) (*Messa
 	}
 
 	message.ID = id
-	if err := message.SetContentFromJSON(contentJSON); err != nil {
+	if err := d.decodeContent(message, contentJSON); err != nil {
 		return nil, fmt.Errorf("failed to deserialize content: %w", err)
 	}
+	message.Aggregations = decodeAggregations(aggregationsJSON)
 
 	return message, nil
 }
@@ -339,16 +1128,37 @@ func (d *DuckDBDatabase) GetMessage(ctx context.Context, eventID string) (*Messa
 func (d *DuckDBDatabase) GetMessages(ctx context.Context, filter *MessageFilter, limit int, offset int) ([]*Message, error) {
 	query, args := d.buildSelectQuery(filter, limit, offset)
 
+	var messages []*Message
+	err := d.eachMessage(ctx, query, args, func(message *Message) error {
+		messages = append(messages, message)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// EachMessage calls fn with each message matching filter, oldest first,
+// reading them from the database one at a time. It stops at the first error
+// fn returns and returns that error.
+func (d *DuckDBDatabase) EachMessage(ctx context.Context, filter *MessageFilter, fn func(*Message) error) error {
+	query, args := d.buildSelectQuery(filter, 0, 0)
+	return d.eachMessage(ctx, query, args, fn)
+}
+
+// eachMessage runs a query built by buildSelectQuery and calls fn with each
+// message it returns. Messages whose content can't be decoded are skipped.
+func (d *DuckDBDatabase) eachMessage(ctx context.Context, query string, args []interface{}, fn func(*Message) error) error {
 	rows, err := d.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query messages: %w", err)
+		return fmt.Errorf("failed to query messages: %w", err)
 	}
 	defer rows.Close()
 
-	var messages []*Message
 	for rows.Next() {
 		message := &Message{}
-		var contentJSON string
+		var contentJSON, aggregationsJSON string
 		var id int64
 
 		err := rows.Scan(
@@ -358,28 +1168,43 @@ func (d *DuckDBDatabase) GetMessages(ctx context.Context, filter *MessageFilter,
 			&message.Sender,
 			&message.UserID,
 			&message.MessageType,
+			&message.MsgType,
 			&message.Timestamp,
 			&contentJSON,
+			&message.Account,
+			&message.ForwardedFrom,
+			&message.ForwardedPlatform,
+			&message.ContentHash,
+			&message.FileName,
+			&message.FileMimeType,
+			&message.FileSize,
+			&message.AuthorName,
+			&message.AuthorPlatform,
+			&aggregationsJSON,
+			&message.Lang,
 		)
 
 		if err != nil {
-			return nil, fmt.Errorf("failed to scan message: %w", err)
+			return fmt.Errorf("failed to scan message: %w", err)
 		}
 
 		message.ID = id
-		if err := message.SetContentFromJSON(contentJSON); err != nil {
+		if err := d.decodeContent(message, contentJSON); err != nil {
 			log.Printf("Warning: failed to deserialize content for message %s: %v", message.EventID, err)
 			continue
 		}
+		message.Aggregations = decodeAggregations(aggregationsJSON)
 
-		messages = append(messages, message)
+		if err := fn(message); err != nil {
+			return err
+		}
 	}
 
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating rows: %w", err)
+		return fmt.Errorf("error iterating rows: %w", err)
 	}
 
-	return messages, nil
+	return nil
 }
 
 // GetMessageCount returns the total count of messages matching the filter
@@ -399,23 +1224,35 @@ func (d *DuckDBDatabase) GetMessageCount(ctx context.Context, filter *MessageFil
 
 // DeleteMessage deletes a message by event ID
 func (d *DuckDBDatabase) DeleteMessage(ctx context.Context, eventID string) error {
-	deleteSQL := "DELETE FROM messages WHERE event_id = ?"
-
-	result, err := d.db.ExecContext(ctx, deleteSQL, eventID)
-	if err != nil {
-		return fmt.Errorf("failed to delete message: %w", err)
+	message := &Message{}
+	row := d.db.QueryRowContext(ctx, "SELECT room_id, sender, message_type, timestamp FROM messages WHERE event_id = ?", eventID)
+	if err := row.Scan(&message.RoomID, &message.Sender, &message.MessageType, &message.Timestamp); err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("message not found: %s", eventID)
+		}
+		return fmt.Errorf("failed to get message: %w", err)
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	tx, err := d.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to get rows affected: %w", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	if rowsAffected == 0 {
-		return fmt.Errorf("message not found: %s", eventID)
+	if _, err := tx.ExecContext(ctx, "DELETE FROM media WHERE event_id = ?", eventID); err != nil {
+		return fmt.Errorf("failed to delete message media: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM unresolved_relations WHERE event_id = ?", eventID); err != nil {
+		return fmt.Errorf("failed to delete message relations: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM messages WHERE event_id = ?", eventID); err != nil {
+		return fmt.Errorf("failed to delete message: %w", err)
+	}
+	if err := countDailyStats(ctx, tx, message, -1); err != nil {
+		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
 // GetRooms returns a list of unique room IDs in the database
@@ -446,7 +1283,7 @@ func (d *DuckDBDatabase) GetRooms(ctx context.Context) ([]string, error) {
 
 // GetRoomMessageCount returns the number of messages in a specific room
 func (d *DuckDBDatabase) GetRoomMessageCount(ctx context.Context, roomID string) (int64, error) {
-	selectSQL := "SELECT COUNT(*) FROM messages WHERE room_id = ?"
+	selectSQL := "SELECT COALESCE(SUM(message_count), 0) FROM daily_stats WHERE room_id = ?"
 
 	row := d.db.QueryRowContext(ctx, selectSQL, roomID)
 
@@ -459,10 +1296,309 @@ func (d *DuckDBDatabase) GetRoomMessageCount(ctx context.Context, roomID string)
 	return count, nil
 }
 
+// GetAccountStats returns per-account message and room counts
+func (d *DuckDBDatabase) GetAccountStats(ctx context.Context) ([]*AccountStats, error) {
+	selectSQL := `
+		SELECT COALESCE(account, '') AS account, COUNT(*), COUNT(DISTINCT room_id), MIN(timestamp), MAX(timestamp)
+		FROM messages
+		GROUP BY COALESCE(account, '')
+		ORDER BY account
+	`
+
+	rows, err := d.db.QueryContext(ctx, selectSQL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query account stats: %w", err)
+	}
+	defer rows.Close()
+
+	var stats []*AccountStats
+	for rows.Next() {
+		s := &AccountStats{}
+		if err := rows.Scan(&s.Account, &s.MessageCount, &s.RoomCount, &s.FirstMessage, &s.LastMessage); err != nil {
+			return nil, fmt.Errorf("failed to scan account stats: %w", err)
+		}
+		stats = append(stats, s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating account stats: %w", err)
+	}
+
+	return stats, nil
+}
+
+// AddAnnotation stores a curator note for an archived message
+func (d *DuckDBDatabase) AddAnnotation(ctx context.Context, annotation *Annotation) error {
+	insertSQL := `
+		INSERT INTO annotations (id, event_id, note, author)
+		VALUES (nextval('seq_annotations_id'), ?, ?, ?)
+		RETURNING id, created_at
+	`
+
+	row := d.db.QueryRowContext(ctx, insertSQL, annotation.EventID, annotation.Note, annotation.Author)
+	if err := row.Scan(&annotation.ID, &annotation.CreatedAt); err != nil {
+		return fmt.Errorf("failed to insert annotation: %w", err)
+	}
+
+	return nil
+}
+
+// GetAnnotations returns the notes for an event, or all notes if eventID is empty
+func (d *DuckDBDatabase) GetAnnotations(ctx context.Context, eventID string) ([]*Annotation, error) {
+	selectSQL := "SELECT id, event_id, note, COALESCE(author, ''), created_at FROM annotations"
+	var args []interface{}
+	if eventID != "" {
+		selectSQL += " WHERE event_id = ?"
+		args = append(args, eventID)
+	}
+	selectSQL += " ORDER BY created_at, id"
+
+	return d.queryAnnotations(ctx, selectSQL, args...)
+}
+
+// GetRoomAnnotations returns the notes on messages in a room, in message order
+func (d *DuckDBDatabase) GetRoomAnnotations(ctx context.Context, roomID string) ([]*Annotation, error) {
+	selectSQL := `
+		SELECT a.id, a.event_id, a.note, COALESCE(a.author, ''), a.created_at
+		FROM annotations a
+		JOIN messages m ON m.event_id = a.event_id
+		WHERE m.room_id = ?
+		ORDER BY m.timestamp, a.created_at, a.id
+	`
+
+	return d.queryAnnotations(ctx, selectSQL, roomID)
+}
+
+func (d *DuckDBDatabase) queryAnnotations(ctx context.Context, query string, args ...interface{}) ([]*Annotation, error) {
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query annotations: %w", err)
+	}
+	defer rows.Close()
+
+	var annotations []*Annotation
+	for rows.Next() {
+		a := &Annotation{}
+		if err := rows.Scan(&a.ID, &a.EventID, &a.Note, &a.Author, &a.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan annotation: %w", err)
+		}
+		annotations = append(annotations, a)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating annotations: %w", err)
+	}
+
+	return annotations, nil
+}
+
+// DeleteAnnotation removes a note by ID
+func (d *DuckDBDatabase) DeleteAnnotation(ctx context.Context, id int64) error {
+	result, err := d.db.ExecContext(ctx, "DELETE FROM annotations WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete annotation: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("annotation not found: %d", id)
+	}
+
+	return nil
+}
+
+// SetPinnedEvents replaces a room's pinned events with eventIDs, kept in pin order
+func (d *DuckDBDatabase) SetPinnedEvents(ctx context.Context, roomID string, eventIDs []string) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM pinned_events WHERE room_id = ?", roomID); err != nil {
+		return fmt.Errorf("failed to clear pinned events: %w", err)
+	}
+
+	for i, eventID := range eventIDs {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO pinned_events (room_id, event_id, position) VALUES (?, ?, ?)", roomID, eventID, i); err != nil {
+			return fmt.Errorf("failed to insert pinned event: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit pinned events: %w", err)
+	}
+
+	return nil
+}
+
+// GetPinnedEvents returns the event IDs pinned in a room, in pin order
+func (d *DuckDBDatabase) GetPinnedEvents(ctx context.Context, roomID string) ([]string, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT event_id FROM pinned_events WHERE room_id = ? ORDER BY position", roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pinned events: %w", err)
+	}
+	defer rows.Close()
+
+	var eventIDs []string
+	for rows.Next() {
+		var eventID string
+		if err := rows.Scan(&eventID); err != nil {
+			return nil, fmt.Errorf("failed to scan pinned event: %w", err)
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating pinned events: %w", err)
+	}
+
+	return eventIDs, nil
+}
+
+// AddBookmark bookmarks a message, updating the label if it is already bookmarked
+func (d *DuckDBDatabase) AddBookmark(ctx context.Context, bookmark *Bookmark) error {
+	insertSQL := `
+		INSERT INTO bookmarks (event_id, label)
+		VALUES (?, ?)
+		ON CONFLICT (event_id) DO UPDATE SET label = excluded.label
+	`
+
+	if _, err := d.db.ExecContext(ctx, insertSQL, bookmark.EventID, bookmark.Label); err != nil {
+		return fmt.Errorf("failed to insert bookmark: %w", err)
+	}
+
+	return nil
+}
+
+// GetBookmarks returns the bookmarks on messages in a room, or all bookmarks if roomID is empty
+func (d *DuckDBDatabase) GetBookmarks(ctx context.Context, roomID string) ([]*Bookmark, error) {
+	selectSQL := "SELECT b.event_id, COALESCE(b.label, ''), b.created_at FROM bookmarks b"
+	var args []interface{}
+	if roomID != "" {
+		selectSQL += " JOIN messages m ON m.event_id = b.event_id WHERE m.room_id = ? ORDER BY m.timestamp"
+		args = append(args, roomID)
+	} else {
+		selectSQL += " ORDER BY b.created_at, b.event_id"
+	}
+
+	rows, err := d.db.QueryContext(ctx, selectSQL, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query bookmarks: %w", err)
+	}
+	defer rows.Close()
+
+	var bookmarks []*Bookmark
+	for rows.Next() {
+		b := &Bookmark{}
+		if err := rows.Scan(&b.EventID, &b.Label, &b.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan bookmark: %w", err)
+		}
+		bookmarks = append(bookmarks, b)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating bookmarks: %w", err)
+	}
+
+	return bookmarks, nil
+}
+
+// DeleteBookmark removes the bookmark on a message
+func (d *DuckDBDatabase) DeleteBookmark(ctx context.Context, eventID string) error {
+	result, err := d.db.ExecContext(ctx, "DELETE FROM bookmarks WHERE event_id = ?", eventID)
+	if err != nil {
+		return fmt.Errorf("failed to delete bookmark: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("bookmark not found: %s", eventID)
+	}
+
+	return nil
+}
+
+// InsertMembershipEvents stores membership events, skipping ones already archived
+func (d *DuckDBDatabase) InsertMembershipEvents(ctx context.Context, events []*MembershipEvent) (int, error) {
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	insertSQL := `
+		INSERT INTO membership_events (event_id, room_id, user_id, membership, display_name, avatar_url, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (event_id) DO NOTHING
+	`
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	insertedCount := 0
+	for _, evt := range events {
+		result, err := tx.ExecContext(ctx, insertSQL, evt.EventID, evt.RoomID, evt.UserID, evt.Membership, evt.DisplayName, evt.AvatarURL, evt.Timestamp)
+		if err != nil {
+			log.Printf("Warning: failed to insert membership event %s: %v", evt.EventID, err)
+			continue
+		}
+		if rowsAffected, err := result.RowsAffected(); err == nil && rowsAffected > 0 {
+			insertedCount++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return insertedCount, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return insertedCount, nil
+}
+
+// GetMembershipEvents returns a room's membership events, oldest first
+func (d *DuckDBDatabase) GetMembershipEvents(ctx context.Context, roomID string) ([]*MembershipEvent, error) {
+	selectSQL := `
+		SELECT event_id, room_id, user_id, membership, COALESCE(display_name, ''), COALESCE(avatar_url, ''), timestamp
+		FROM membership_events
+		WHERE room_id = ?
+		ORDER BY timestamp, event_id
+	`
+
+	rows, err := d.db.QueryContext(ctx, selectSQL, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query membership events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []*MembershipEvent
+	for rows.Next() {
+		evt := &MembershipEvent{}
+		if err := rows.Scan(&evt.EventID, &evt.RoomID, &evt.UserID, &evt.Membership, &evt.DisplayName, &evt.AvatarURL, &evt.Timestamp); err != nil {
+			return nil, fmt.Errorf("failed to scan membership event: %w", err)
+		}
+		events = append(events, evt)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating membership events: %w", err)
+	}
+
+	return events, nil
+}
+
 // buildSelectQuery constructs a SELECT query with WHERE clauses based on the filter
 func (d *DuckDBDatabase) buildSelectQuery(filter *MessageFilter, limit int, offset int) (string, []interface{}) {
 	baseQuery := `
-		SELECT id, room_id, event_id, sender, user_id, message_type, timestamp, content::VARCHAR as content_json
+		SELECT id, room_id, event_id, sender, user_id, message_type, COALESCE(msgtype, ''), timestamp, content::VARCHAR as content_json, COALESCE(account, ''), COALESCE(forwarded_from, ''), COALESCE(forwarded_platform, ''), COALESCE(content_hash, ''), COALESCE(file_name, ''), COALESCE(file_mimetype, ''), COALESCE(file_size, 0), COALESCE(author_name, ''), COALESCE(author_platform, ''), COALESCE(aggregations::VARCHAR, ''), COALESCE(lang, '')
 		FROM messages
 	`
 
@@ -514,6 +1650,21 @@ func (d *DuckDBDatabase) buildWhereClause(filter *MessageFilter) (string, []inte
 		args = append(args, filter.Sender)
 	}
 
+	if filter.Account != "" {
+		conditions = append(conditions, "account = ?")
+		args = append(args, filter.Account)
+	}
+
+	if filter.EventType != "" {
+		conditions = append(conditions, "message_type = ?")
+		args = append(args, filter.EventType)
+	}
+
+	if filter.MsgType != "" {
+		conditions = append(conditions, "msgtype = ?")
+		args = append(args, filter.MsgType)
+	}
+
 	if filter.StartTime != nil {
 		conditions = append(conditions, "timestamp >= ?")
 		args = append(args, *filter.StartTime)
@@ -537,8 +1688,34 @@ var (
 	dbConfig *DatabaseConfig
 )
 
+// Overrides of the default database configuration, set by the command line
+var (
+	databasePath   string // Archive to open instead of DUCKDB_URL's
+	createDatabase = true // Whether InitDuckDB may create a missing archive
+)
+
+// SetDatabasePath makes InitDuckDB open the archive at path rather than the
+// one DUCKDB_URL names. An empty path goes back to DUCKDB_URL.
+func SetDatabasePath(path string) {
+	databasePath = path
+}
+
+// SetCreateDatabase sets whether InitDuckDB may create the archive when its
+// file doesn't exist. Commands that only read an archive turn this off, so a
+// mistyped path is reported instead of opening a new, empty archive.
+func SetCreateDatabase(create bool) {
+	createDatabase = create
+}
+
 // InitDatabase initializes the database connection using the provided config
 func InitDatabase(config *DatabaseConfig) error {
+	if config.MustExist && !config.IsInMemory {
+		path, _, _ := strings.Cut(config.DatabaseURL, "?")
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("archive %s not found; use --db or DUCKDB_URL to choose an existing archive, or import into it first", path)
+		}
+	}
+
 	// Create DuckDB instance
 	duckDB := NewDuckDBDatabase(config)
 
@@ -559,20 +1736,31 @@ func InitDatabase(config *DatabaseConfig) error {
 
 // InitDuckDB initializes DuckDB with default configuration (for backward compatibility)
 func InitDuckDB() error {
-	// Get database URL from environment, default to file-based
-	dbURL := os.Getenv("DUCKDB_URL")
+	return InitDatabase(DefaultDatabaseConfig())
+}
+
+// DefaultDatabaseConfig returns the configuration the commands use, read
+// from DUCKDB_URL, DB_DEBUG and MATRIX_ARCHIVE_PASSPHRASE. A path set with
+// SetDatabasePath takes precedence over DUCKDB_URL.
+func DefaultDatabaseConfig() *DatabaseConfig {
+	// Get database URL from the command line or environment, default to file-based
+	dbURL := databasePath
+	if dbURL == "" {
+		dbURL = os.Getenv("DUCKDB_URL")
+	}
 	if dbURL == "" {
 		dbURL = "matrix_archive.duckdb"
 	}
 
-	config := &DatabaseConfig{
+	return &DatabaseConfig{
 		DatabaseURL: dbURL,
 		IsInMemory:  dbURL == ":memory:",
 		MaxConns:    10,
 		Debug:       os.Getenv("DB_DEBUG") == "true",
+		Passphrase:  os.Getenv("MATRIX_ARCHIVE_PASSPHRASE"),
+		Compact:     compactFromEnv(),
+		MustExist:   !createDatabase,
 	}
-
-	return InitDatabase(config)
 }
 
 // GetDatabase returns the global database instance
@@ -587,3 +1775,1445 @@ func CloseDatabase() error {
 	}
 	return nil
 }
+
+// GetImportState returns a room's saved import position, or nil if there is none
+func (d *DuckDBDatabase) GetImportState(ctx context.Context, roomID string) (*ImportState, error) {
+	state := &ImportState{RoomID: roomID}
+	row := d.db.QueryRowContext(ctx, "SELECT COALESCE(next_batch, ''), complete, updated_at FROM import_state WHERE room_id = ?", roomID)
+	if err := row.Scan(&state.NextBatch, &state.Complete, &state.UpdatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get import state: %w", err)
+	}
+	return state, nil
+}
+
+// SaveImportState records a room's import position, replacing any earlier one
+func (d *DuckDBDatabase) SaveImportState(ctx context.Context, state *ImportState) error {
+	upsertSQL := `
+		INSERT INTO import_state (room_id, next_batch, complete, updated_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (room_id) DO UPDATE SET
+			next_batch = excluded.next_batch,
+			complete = excluded.complete,
+			updated_at = excluded.updated_at
+	`
+
+	if _, err := d.db.ExecContext(ctx, upsertSQL, state.RoomID, state.NextBatch, state.Complete); err != nil {
+		return fmt.Errorf("failed to save import state: %w", err)
+	}
+	return nil
+}
+
+// ClearImportState forgets a room's import position, or every room's if roomID is empty
+func (d *DuckDBDatabase) ClearImportState(ctx context.Context, roomID string) error {
+	var err error
+	if roomID == "" {
+		_, err = d.db.ExecContext(ctx, "DELETE FROM import_state")
+	} else {
+		_, err = d.db.ExecContext(ctx, "DELETE FROM import_state WHERE room_id = ?", roomID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to clear import state: %w", err)
+	}
+	return nil
+}
+
+// SaveMediaText stores the OCR text for an image, replacing any earlier result.
+// The text is encrypted like message content when a passphrase is configured.
+func (d *DuckDBDatabase) SaveMediaText(ctx context.Context, mediaText *MediaText) error {
+	text, err := d.sealText(mediaText.Text)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt media text: %w", err)
+	}
+
+	upsertSQL := `
+		INSERT INTO media_text (event_id, room_id, path, text, engine, created_at)
+		VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (event_id) DO UPDATE SET
+			room_id = excluded.room_id,
+			path = excluded.path,
+			text = excluded.text,
+			engine = excluded.engine,
+			created_at = excluded.created_at
+	`
+
+	if _, err := d.db.ExecContext(ctx, upsertSQL, mediaText.EventID, mediaText.RoomID, mediaText.Path, text, mediaText.Engine); err != nil {
+		return fmt.Errorf("failed to save media text: %w", err)
+	}
+	return nil
+}
+
+// GetMediaTextEventIDs returns the set of image events that already have OCR text
+func (d *DuckDBDatabase) GetMediaTextEventIDs(ctx context.Context) (map[string]bool, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT event_id FROM media_text")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query media text: %w", err)
+	}
+	defer rows.Close()
+
+	eventIDs := make(map[string]bool)
+	for rows.Next() {
+		var eventID string
+		if err := rows.Scan(&eventID); err != nil {
+			return nil, fmt.Errorf("failed to scan media text: %w", err)
+		}
+		eventIDs[eventID] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating media text: %w", err)
+	}
+
+	return eventIDs, nil
+}
+
+// SearchMediaText returns OCR text containing query (case-insensitive),
+// optionally limited to a room. In encrypted archives the text is matched
+// after it is decrypted.
+func (d *DuckDBDatabase) SearchMediaText(ctx context.Context, query, roomID string) ([]*MediaText, error) {
+	selectSQL := "SELECT event_id, room_id, path, text, COALESCE(engine, ''), created_at FROM media_text WHERE 1=1"
+	var args []interface{}
+	if d.cipher == nil {
+		selectSQL += " AND text ILIKE ?"
+		args = append(args, "%"+query+"%")
+	}
+	if roomID != "" {
+		selectSQL += " AND room_id = ?"
+		args = append(args, roomID)
+	}
+
+	rows, err := d.db.QueryContext(ctx, selectSQL, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search media text: %w", err)
+	}
+	defer rows.Close()
+
+	var results []*MediaText
+	for rows.Next() {
+		m := &MediaText{}
+		if err := rows.Scan(&m.EventID, &m.RoomID, &m.Path, &m.Text, &m.Engine, &m.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan media text: %w", err)
+		}
+		if m.Text, err = d.openText(m.Text); err != nil {
+			return nil, err
+		}
+		if d.cipher != nil && !strings.Contains(strings.ToLower(m.Text), strings.ToLower(query)) {
+			continue
+		}
+		results = append(results, m)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating media text: %w", err)
+	}
+
+	return results, nil
+}
+
+// SaveUnresolvedRelations replaces the relations recorded as unresolved in a
+// room. Only the changes are written, since DuckDB can't insert a key deleted
+// earlier in the same transaction.
+func (d *DuckDBDatabase) SaveUnresolvedRelations(ctx context.Context, roomID string, relations []*UnresolvedRelation) error {
+	existing, err := d.GetUnresolvedRelations(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	type relationKey struct{ eventID, targetEventID string }
+	stored := make(map[relationKey]*UnresolvedRelation, len(existing))
+	for _, r := range existing {
+		stored[relationKey{r.EventID, r.TargetEventID}] = r
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	kept := make(map[relationKey]bool, len(relations))
+	for _, r := range relations {
+		key := relationKey{r.EventID, r.TargetEventID}
+		if kept[key] {
+			continue
+		}
+		kept[key] = true
+		old, ok := stored[key]
+		switch {
+		case !ok:
+			if _, err := tx.ExecContext(ctx,
+				"INSERT INTO unresolved_relations (event_id, target_event_id, room_id, rel_type, first_seen) VALUES (?, ?, ?, ?, ?) ON CONFLICT DO NOTHING",
+				r.EventID, r.TargetEventID, roomID, r.RelType, r.FirstSeen); err != nil {
+				return fmt.Errorf("failed to save unresolved relation: %w", err)
+			}
+		case old.RelType != r.RelType || !old.FirstSeen.Equal(r.FirstSeen):
+			if _, err := tx.ExecContext(ctx,
+				"UPDATE unresolved_relations SET rel_type = ?, first_seen = ? WHERE event_id = ? AND target_event_id = ?",
+				r.RelType, r.FirstSeen, r.EventID, r.TargetEventID); err != nil {
+				return fmt.Errorf("failed to update unresolved relation: %w", err)
+			}
+		}
+	}
+	for key := range stored {
+		if kept[key] {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM unresolved_relations WHERE event_id = ? AND target_event_id = ?", key.eventID, key.targetEventID); err != nil {
+			return fmt.Errorf("failed to clear unresolved relation: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetUnresolvedRelations returns the relations recorded as unresolved in a
+// room, or in every room if roomID is empty, oldest first
+func (d *DuckDBDatabase) GetUnresolvedRelations(ctx context.Context, roomID string) ([]*UnresolvedRelation, error) {
+	selectSQL := "SELECT event_id, target_event_id, room_id, rel_type, first_seen FROM unresolved_relations"
+	var args []interface{}
+	if roomID != "" {
+		selectSQL += " WHERE room_id = ?"
+		args = append(args, roomID)
+	}
+	selectSQL += " ORDER BY first_seen, event_id, target_event_id"
+
+	rows, err := d.db.QueryContext(ctx, selectSQL, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query unresolved relations: %w", err)
+	}
+	defer rows.Close()
+
+	var relations []*UnresolvedRelation
+	for rows.Next() {
+		r := &UnresolvedRelation{}
+		if err := rows.Scan(&r.EventID, &r.TargetEventID, &r.RoomID, &r.RelType, &r.FirstSeen); err != nil {
+			return nil, fmt.Errorf("failed to scan unresolved relation: %w", err)
+		}
+		relations = append(relations, r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating unresolved relations: %w", err)
+	}
+
+	return relations, nil
+}
+
+// SaveMediaFile records the outcome of downloading a message's media,
+// replacing the earlier record of the same event and kind
+func (d *DuckDBDatabase) SaveMediaFile(ctx context.Context, file *MediaFile) error {
+	upsertSQL := `
+		INSERT INTO media (event_id, kind, mxc, path, status, sha256, size, claimed_type, detected_type, error, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (event_id, kind) DO UPDATE SET
+			mxc = excluded.mxc,
+			path = excluded.path,
+			status = excluded.status,
+			sha256 = excluded.sha256,
+			size = excluded.size,
+			claimed_type = excluded.claimed_type,
+			detected_type = excluded.detected_type,
+			error = excluded.error,
+			updated_at = excluded.updated_at
+	`
+
+	if _, err := d.db.ExecContext(ctx, upsertSQL, file.EventID, file.Kind, file.MXC, file.Path, file.Status, file.SHA256, file.Size,
+		file.ClaimedType, file.DetectedType, file.Error); err != nil {
+		return fmt.Errorf("failed to save media file: %w", err)
+	}
+	return nil
+}
+
+// GetMediaFiles returns the recorded media of a room's messages, or of every
+// archived message if roomID is empty, in message order
+func (d *DuckDBDatabase) GetMediaFiles(ctx context.Context, roomID string) ([]*MediaFile, error) {
+	selectSQL := `
+		SELECT m.event_id, msg.room_id, m.kind, m.mxc, COALESCE(m.path, ''), m.status, COALESCE(m.sha256, ''), COALESCE(m.size, 0),
+			COALESCE(m.claimed_type, ''), COALESCE(m.detected_type, ''), COALESCE(m.error, ''), m.updated_at
+		FROM media m
+		JOIN messages msg ON msg.event_id = m.event_id
+	`
+	var args []interface{}
+	if roomID != "" {
+		selectSQL += " WHERE msg.room_id = ?"
+		args = append(args, roomID)
+	}
+	selectSQL += " ORDER BY msg.timestamp, m.event_id, m.kind"
+
+	rows, err := d.db.QueryContext(ctx, selectSQL, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query media files: %w", err)
+	}
+	defer rows.Close()
+
+	var files []*MediaFile
+	for rows.Next() {
+		f := &MediaFile{}
+		if err := rows.Scan(&f.EventID, &f.RoomID, &f.Kind, &f.MXC, &f.Path, &f.Status, &f.SHA256, &f.Size, &f.ClaimedType, &f.DetectedType, &f.Error, &f.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan media file: %w", err)
+		}
+		files = append(files, f)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating media files: %w", err)
+	}
+
+	return files, nil
+}
+
+// SaveRoomUsers caches room members' profiles, replacing earlier entries
+func (d *DuckDBDatabase) SaveRoomUsers(ctx context.Context, users []*RoomUser) error {
+	if len(users) == 0 {
+		return nil
+	}
+
+	upsertSQL := `
+		INSERT INTO users (room_id, user_id, display_name, avatar_url, deactivated, platform, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (room_id, user_id) DO UPDATE SET
+			display_name = excluded.display_name,
+			avatar_url = excluded.avatar_url,
+			deactivated = excluded.deactivated,
+			platform = excluded.platform,
+			updated_at = excluded.updated_at
+	`
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, u := range users {
+		var platform interface{}
+		if u.Platform != nil {
+			data, err := json.Marshal(u.Platform)
+			if err != nil {
+				return fmt.Errorf("failed to encode platform of user %s: %w", u.UserID, err)
+			}
+			platform = string(data)
+		}
+		if _, err := tx.ExecContext(ctx, upsertSQL, u.RoomID, u.UserID, u.DisplayName, u.AvatarURL, u.Deactivated, platform); err != nil {
+			return fmt.Errorf("failed to save user %s: %w", u.UserID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// GetRoomUsers returns the cached profiles of a room's members
+func (d *DuckDBDatabase) GetRoomUsers(ctx context.Context, roomID string) ([]*RoomUser, error) {
+	selectSQL := `
+		SELECT room_id, user_id, COALESCE(display_name, ''), COALESCE(avatar_url, ''), COALESCE(deactivated, false), updated_at, COALESCE(platform::VARCHAR, '')
+		FROM users
+		WHERE room_id = ?
+		ORDER BY user_id
+	`
+
+	rows, err := d.db.QueryContext(ctx, selectSQL, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []*RoomUser
+	for rows.Next() {
+		u := &RoomUser{}
+		var platform string
+		if err := rows.Scan(&u.RoomID, &u.UserID, &u.DisplayName, &u.AvatarURL, &u.Deactivated, &u.UpdatedAt, &platform); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		if platform != "" {
+			u.Platform = &PlatformIdentity{}
+			if err := json.Unmarshal([]byte(platform), u.Platform); err != nil {
+				return nil, fmt.Errorf("failed to decode platform of user %s: %w", u.UserID, err)
+			}
+		}
+		users = append(users, u)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating users: %w", err)
+	}
+
+	return users, nil
+}
+
+// GetExportHash returns the input hash recorded for an export target, or "" if it was never exported
+func (d *DuckDBDatabase) GetExportHash(ctx context.Context, target string) (string, error) {
+	var hash string
+	err := d.db.QueryRowContext(ctx, "SELECT input_hash FROM export_state WHERE target = ?", target).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get export state: %w", err)
+	}
+	return hash, nil
+}
+
+// SaveExportHash records the input hash of an export target's latest run
+func (d *DuckDBDatabase) SaveExportHash(ctx context.Context, target, hash string) error {
+	upsertSQL := `
+		INSERT INTO export_state (target, input_hash, exported_at)
+		VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (target) DO UPDATE SET
+			input_hash = excluded.input_hash,
+			exported_at = excluded.exported_at
+	`
+
+	if _, err := d.db.ExecContext(ctx, upsertSQL, target, hash); err != nil {
+		return fmt.Errorf("failed to save export state: %w", err)
+	}
+	return nil
+}
+
+// InsertModerationEvents stores moderation events, skipping ones already archived
+func (d *DuckDBDatabase) InsertModerationEvents(ctx context.Context, events []*ModerationEvent) (int, error) {
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	insertSQL := `
+		INSERT INTO moderation_events (event_id, room_id, action, actor, target, reason, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (event_id) DO NOTHING
+	`
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	insertedCount := 0
+	for _, evt := range events {
+		result, err := tx.ExecContext(ctx, insertSQL, evt.EventID, evt.RoomID, evt.Action, evt.Actor, evt.Target, evt.Reason, evt.Timestamp)
+		if err != nil {
+			log.Printf("Warning: failed to insert moderation event %s: %v", evt.EventID, err)
+			continue
+		}
+		if rowsAffected, err := result.RowsAffected(); err == nil && rowsAffected > 0 {
+			insertedCount++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return insertedCount, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return insertedCount, nil
+}
+
+// GetModerationEvents returns a room's moderation events, oldest first
+func (d *DuckDBDatabase) GetModerationEvents(ctx context.Context, roomID string) ([]*ModerationEvent, error) {
+	selectSQL := `
+		SELECT event_id, room_id, action, actor, target, COALESCE(reason, ''), timestamp
+		FROM moderation_events
+		WHERE room_id = ?
+		ORDER BY timestamp, event_id
+	`
+
+	rows, err := d.db.QueryContext(ctx, selectSQL, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query moderation events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []*ModerationEvent
+	for rows.Next() {
+		evt := &ModerationEvent{}
+		if err := rows.Scan(&evt.EventID, &evt.RoomID, &evt.Action, &evt.Actor, &evt.Target, &evt.Reason, &evt.Timestamp); err != nil {
+			return nil, fmt.Errorf("failed to scan moderation event: %w", err)
+		}
+		events = append(events, evt)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating moderation events: %w", err)
+	}
+
+	return events, nil
+}
+
+// SetRoomTags replaces the tags recorded for a room. Only the tags that
+// changed are written: DuckDB rejects inserting keys deleted earlier in the
+// same transaction, so unchanged tags are left in place.
+func (d *DuckDBDatabase) SetRoomTags(ctx context.Context, roomID string, tags []*RoomTag) error {
+	existing, err := d.GetRoomTags(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	stored := make(map[string]*RoomTag, len(existing))
+	for _, tag := range existing {
+		stored[tag.Tag] = tag
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	kept := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		kept[tag.Tag] = true
+		old, ok := stored[tag.Tag]
+		switch {
+		case !ok:
+			if _, err := tx.ExecContext(ctx, "INSERT INTO room_tags (room_id, tag, tag_order) VALUES (?, ?, ?)", roomID, tag.Tag, tag.Order); err != nil {
+				return fmt.Errorf("failed to insert room tag: %w", err)
+			}
+		case !sameTagOrder(old.Order, tag.Order):
+			if _, err := tx.ExecContext(ctx, "UPDATE room_tags SET tag_order = ? WHERE room_id = ? AND tag = ?", tag.Order, roomID, tag.Tag); err != nil {
+				return fmt.Errorf("failed to update room tag: %w", err)
+			}
+		}
+	}
+	for tag := range stored {
+		if kept[tag] {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM room_tags WHERE room_id = ? AND tag = ?", roomID, tag); err != nil {
+			return fmt.Errorf("failed to delete room tag: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit room tags: %w", err)
+	}
+
+	return nil
+}
+
+// sameTagOrder reports whether two tag orders, either of which may be unset, are equal
+func sameTagOrder(a, b *float64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// GetRoomTags returns a room's tags, ordered tags first
+func (d *DuckDBDatabase) GetRoomTags(ctx context.Context, roomID string) ([]*RoomTag, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT room_id, tag, tag_order FROM room_tags WHERE room_id = ? ORDER BY tag_order NULLS LAST, tag", roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query room tags: %w", err)
+	}
+	defer rows.Close()
+
+	var tags []*RoomTag
+	for rows.Next() {
+		tag := &RoomTag{}
+		var order sql.NullFloat64
+		if err := rows.Scan(&tag.RoomID, &tag.Tag, &order); err != nil {
+			return nil, fmt.Errorf("failed to scan room tag: %w", err)
+		}
+		if order.Valid {
+			tag.Order = &order.Float64
+		}
+		tags = append(tags, tag)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating room tags: %w", err)
+	}
+
+	return tags, nil
+}
+
+// SetDirectRooms replaces the recorded direct chats, given as m.direct
+// content: each user ID maps to the rooms that are direct chats with them.
+// As with SetRoomTags, only the chats that changed are written.
+func (d *DuckDBDatabase) SetDirectRooms(ctx context.Context, direct map[string][]string) error {
+	existing, err := d.GetDirectRooms(ctx)
+	if err != nil {
+		return err
+	}
+	type directRoom struct{ userID, roomID string }
+	stored := make(map[directRoom]bool)
+	for userID, roomIDs := range existing {
+		for _, roomID := range roomIDs {
+			stored[directRoom{userID, roomID}] = true
+		}
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	kept := make(map[directRoom]bool)
+	for userID, roomIDs := range direct {
+		for _, roomID := range roomIDs {
+			key := directRoom{userID, roomID}
+			if kept[key] {
+				continue
+			}
+			kept[key] = true
+			if stored[key] {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, "INSERT INTO direct_rooms (user_id, room_id) VALUES (?, ?)", userID, roomID); err != nil {
+				return fmt.Errorf("failed to insert direct room: %w", err)
+			}
+		}
+	}
+	for key := range stored {
+		if kept[key] {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM direct_rooms WHERE user_id = ? AND room_id = ?", key.userID, key.roomID); err != nil {
+			return fmt.Errorf("failed to delete direct room: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit direct rooms: %w", err)
+	}
+
+	return nil
+}
+
+// GetDirectRooms returns the recorded direct chats in m.direct form
+func (d *DuckDBDatabase) GetDirectRooms(ctx context.Context) (map[string][]string, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT user_id, room_id FROM direct_rooms ORDER BY user_id, room_id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query direct rooms: %w", err)
+	}
+	defer rows.Close()
+
+	direct := make(map[string][]string)
+	for rows.Next() {
+		var userID, roomID string
+		if err := rows.Scan(&userID, &roomID); err != nil {
+			return nil, fmt.Errorf("failed to scan direct room: %w", err)
+		}
+		direct[userID] = append(direct[userID], roomID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating direct rooms: %w", err)
+	}
+
+	return direct, nil
+}
+
+// SaveEmotePack records a room's or the user's emote pack, replacing what
+// was archived of it before
+func (d *DuckDBDatabase) SaveEmotePack(ctx context.Context, pack *EmotePack) error {
+	content, err := json.Marshal(pack.Content)
+	if err != nil {
+		return fmt.Errorf("failed to encode emote pack: %w", err)
+	}
+	if pack.UpdatedAt.IsZero() {
+		pack.UpdatedAt = time.Now().UTC()
+	}
+
+	upsertSQL := `
+		INSERT INTO emote_packs (room_id, state_key, content, updated_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (room_id, state_key) DO UPDATE SET
+			content = excluded.content,
+			updated_at = excluded.updated_at`
+	if _, err := d.db.ExecContext(ctx, upsertSQL, pack.RoomID, pack.StateKey, string(content), pack.UpdatedAt); err != nil {
+		return fmt.Errorf("failed to save emote pack: %w", err)
+	}
+	return nil
+}
+
+// GetEmotePacks returns the archived emote packs, the user's first, then by
+// room and state key
+func (d *DuckDBDatabase) GetEmotePacks(ctx context.Context) ([]*EmotePack, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT room_id, state_key, content, updated_at FROM emote_packs ORDER BY room_id, state_key")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query emote packs: %w", err)
+	}
+	defer rows.Close()
+
+	var packs []*EmotePack
+	for rows.Next() {
+		var roomID, stateKey string
+		var contentJSON sql.NullString
+		var updatedAt time.Time
+		if err := rows.Scan(&roomID, &stateKey, &contentJSON, &updatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan emote pack: %w", err)
+		}
+		var content map[string]interface{}
+		if contentJSON.Valid {
+			if err := json.Unmarshal([]byte(contentJSON.String), &content); err != nil {
+				return nil, fmt.Errorf("failed to decode emote pack: %w", err)
+			}
+		}
+		pack := NewEmotePack(roomID, stateKey, content)
+		pack.UpdatedAt = updatedAt
+		packs = append(packs, pack)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating emote packs: %w", err)
+	}
+
+	return packs, nil
+}
+
+// SaveRoomVersion records what is known about a room's place in a chain of
+// upgrades. Empty fields keep the values recorded earlier, so a room seen
+// only as another room's predecessor can be filled in later.
+func (d *DuckDBDatabase) SaveRoomVersion(ctx context.Context, version *RoomVersion) error {
+	upsertSQL := `
+		INSERT INTO room_versions (room_id, room_version, predecessor_id, successor_id, upgraded_at)
+		VALUES (?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), ?)
+		ON CONFLICT (room_id) DO UPDATE SET
+			room_version = COALESCE(excluded.room_version, room_versions.room_version),
+			predecessor_id = COALESCE(excluded.predecessor_id, room_versions.predecessor_id),
+			successor_id = COALESCE(excluded.successor_id, room_versions.successor_id),
+			upgraded_at = COALESCE(excluded.upgraded_at, room_versions.upgraded_at)
+	`
+
+	var upgradedAt interface{}
+	if version.UpgradedAt != nil {
+		upgradedAt = *version.UpgradedAt
+	}
+	_, err := d.db.ExecContext(ctx, upsertSQL, version.RoomID, version.RoomVersion, version.PredecessorID, version.SuccessorID, upgradedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save room version: %w", err)
+	}
+	return nil
+}
+
+// GetRoomVersion returns what is recorded about a room's upgrades, or nil if nothing is
+func (d *DuckDBDatabase) GetRoomVersion(ctx context.Context, roomID string) (*RoomVersion, error) {
+	version := &RoomVersion{RoomID: roomID}
+	var upgradedAt sql.NullTime
+	row := d.db.QueryRowContext(ctx, `
+		SELECT COALESCE(room_version, ''), COALESCE(predecessor_id, ''), COALESCE(successor_id, ''), upgraded_at
+		FROM room_versions WHERE room_id = ?`, roomID)
+	if err := row.Scan(&version.RoomVersion, &version.PredecessorID, &version.SuccessorID, &upgradedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get room version: %w", err)
+	}
+	if upgradedAt.Valid {
+		version.UpgradedAt = &upgradedAt.Time
+	}
+	return version, nil
+}
+
+// SaveRoomProfile records a room's name, topic, canonical alias and creation
+// time, replacing what an earlier import recorded, since the room's state
+// is current
+func (d *DuckDBDatabase) SaveRoomProfile(ctx context.Context, profile *RoomProfile) error {
+	upsertSQL := `
+		INSERT INTO rooms (room_id, name, topic, canonical_alias, created_at, updated_at)
+		VALUES (?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (room_id) DO UPDATE SET
+			name = excluded.name,
+			topic = excluded.topic,
+			canonical_alias = excluded.canonical_alias,
+			created_at = COALESCE(excluded.created_at, rooms.created_at),
+			updated_at = excluded.updated_at
+	`
+
+	var createdAt interface{}
+	if profile.CreatedAt != nil {
+		createdAt = *profile.CreatedAt
+	}
+	_, err := d.db.ExecContext(ctx, upsertSQL, profile.RoomID, profile.Name, profile.Topic, profile.CanonicalAlias, createdAt)
+	if err != nil {
+		return fmt.Errorf("failed to save room profile: %w", err)
+	}
+	return nil
+}
+
+// GetRoomProfile returns a room's recorded name, topic, canonical alias and
+// creation time, or nil if none was recorded
+func (d *DuckDBDatabase) GetRoomProfile(ctx context.Context, roomID string) (*RoomProfile, error) {
+	profile := &RoomProfile{RoomID: roomID}
+	var createdAt sql.NullTime
+	row := d.db.QueryRowContext(ctx, `
+		SELECT COALESCE(name, ''), COALESCE(topic, ''), COALESCE(canonical_alias, ''), created_at
+		FROM rooms WHERE room_id = ?`, roomID)
+	if err := row.Scan(&profile.Name, &profile.Topic, &profile.CanonicalAlias, &createdAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get room profile: %w", err)
+	}
+	if createdAt.Valid {
+		profile.CreatedAt = &createdAt.Time
+	}
+	return profile, nil
+}
+
+// GetContentHashes maps the normalized content hash of every archived message
+// to the event ID of its earliest copy. Encrypted archives don't store hashes, so their messages
+// are decrypted and hashed instead.
+func (d *DuckDBDatabase) GetContentHashes(ctx context.Context) (map[string]string, error) {
+	hashes := make(map[string]string)
+	if d.cipher != nil {
+		messages, err := d.GetMessages(ctx, nil, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, message := range messages {
+			if hash := NormalizedContentHash(message); hashes[hash] == "" {
+				hashes[hash] = message.EventID
+			}
+		}
+		return hashes, nil
+	}
+
+	rows, err := d.db.QueryContext(ctx, "SELECT content_hash, event_id FROM messages WHERE content_hash IS NOT NULL ORDER BY timestamp ASC")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query content hashes: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash, eventID string
+		if err := rows.Scan(&hash, &eventID); err != nil {
+			return nil, fmt.Errorf("failed to scan content hash: %w", err)
+		}
+		if hashes[hash] == "" {
+			hashes[hash] = eventID
+		}
+	}
+	return hashes, rows.Err()
+}
+
+// GetRoomStats returns the number and time range of archived messages per
+// room, from the daily statistics
+func (d *DuckDBDatabase) GetRoomStats(ctx context.Context) ([]*RoomStats, error) {
+	selectSQL := `
+		SELECT room_id, SUM(message_count), MIN(first_message), MAX(last_message)
+		FROM daily_stats
+		GROUP BY room_id
+		ORDER BY room_id
+	`
+
+	rows, err := d.db.QueryContext(ctx, selectSQL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query room stats: %w", err)
+	}
+	defer rows.Close()
+
+	var stats []*RoomStats
+	for rows.Next() {
+		s := &RoomStats{}
+		if err := rows.Scan(&s.RoomID, &s.MessageCount, &s.FirstMessage, &s.LastMessage); err != nil {
+			return nil, fmt.Errorf("failed to scan room stats: %w", err)
+		}
+		stats = append(stats, s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating room stats: %w", err)
+	}
+
+	return stats, nil
+}
+
+// sqlExecer is a database or transaction that statements can be run in
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// countDailyStats adds delta messages to the statistics of message's room,
+// day, sender and type. Deleting a day's earliest or latest message leaves
+// its time range as it was.
+func countDailyStats(ctx context.Context, db sqlExecer, message *Message, delta int64) error {
+	day := message.Timestamp.UTC().Format("2006-01-02")
+	upsertSQL := `
+		INSERT INTO daily_stats (room_id, day, sender, message_type, message_count, first_message, last_message)
+		VALUES (?, CAST(? AS DATE), ?, ?, ?, ?, ?)
+		ON CONFLICT (room_id, day, sender, message_type) DO UPDATE SET
+			message_count = daily_stats.message_count + excluded.message_count,
+			first_message = LEAST(daily_stats.first_message, excluded.first_message),
+			last_message = GREATEST(daily_stats.last_message, excluded.last_message)
+	`
+	if _, err := db.ExecContext(ctx, upsertSQL, message.RoomID, day, message.Sender, message.MessageType, delta, message.Timestamp, message.Timestamp); err != nil {
+		return fmt.Errorf("failed to update daily stats: %w", err)
+	}
+	if delta < 0 {
+		if _, err := db.ExecContext(ctx, "DELETE FROM daily_stats WHERE message_count <= 0"); err != nil {
+			return fmt.Errorf("failed to update daily stats: %w", err)
+		}
+	}
+	return nil
+}
+
+// migrateDailyStats rebuilds the daily statistics from the messages table
+// when they don't account for every message, as in archives created before
+// the statistics were kept
+func (d *DuckDBDatabase) migrateDailyStats(ctx context.Context) error {
+	var messages, counted int64
+	row := d.db.QueryRowContext(ctx, "SELECT (SELECT COUNT(*) FROM messages), (SELECT COALESCE(SUM(message_count), 0) FROM daily_stats)")
+	if err := row.Scan(&messages, &counted); err != nil {
+		return fmt.Errorf("failed to count messages: %w", err)
+	}
+	if messages == counted {
+		return nil
+	}
+	return d.RebuildDailyStats(ctx)
+}
+
+// RebuildDailyStats recomputes the daily statistics from every archived message
+func (d *DuckDBDatabase) RebuildDailyStats(ctx context.Context) error {
+	// Cleared outside the transaction: DuckDB rejects inserting keys deleted
+	// earlier in the same transaction
+	if _, err := d.db.ExecContext(ctx, "DELETE FROM daily_stats"); err != nil {
+		return fmt.Errorf("failed to clear daily stats: %w", err)
+	}
+	rebuildSQL := `
+		INSERT INTO daily_stats (room_id, day, sender, message_type, message_count, first_message, last_message)
+		SELECT room_id, CAST(timestamp AS DATE), sender, message_type, COUNT(*), MIN(timestamp), MAX(timestamp)
+		FROM messages
+		GROUP BY room_id, CAST(timestamp AS DATE), sender, message_type
+	`
+	if _, err := d.db.ExecContext(ctx, rebuildSQL); err != nil {
+		return fmt.Errorf("failed to rebuild daily stats: %w", err)
+	}
+	return nil
+}
+
+// GetDailyStats returns the daily statistics of a room, or of every room if
+// roomID is empty, ordered by day
+func (d *DuckDBDatabase) GetDailyStats(ctx context.Context, roomID string) ([]*DailyStats, error) {
+	selectSQL := `
+		SELECT room_id, day, sender, message_type, message_count, first_message, last_message
+		FROM daily_stats
+	`
+	var args []interface{}
+	if roomID != "" {
+		selectSQL += " WHERE room_id = ?"
+		args = append(args, roomID)
+	}
+	selectSQL += " ORDER BY day, room_id, sender, message_type"
+
+	rows, err := d.db.QueryContext(ctx, selectSQL, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query daily stats: %w", err)
+	}
+	defer rows.Close()
+
+	var stats []*DailyStats
+	for rows.Next() {
+		s := &DailyStats{}
+		if err := rows.Scan(&s.RoomID, &s.Day, &s.Sender, &s.MessageType, &s.MessageCount, &s.FirstMessage, &s.LastMessage); err != nil {
+			return nil, fmt.Errorf("failed to scan daily stats: %w", err)
+		}
+		stats = append(stats, s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating daily stats: %w", err)
+	}
+
+	return stats, nil
+}
+
+// SealRoom records a room's seal, failing if the room is already sealed
+func (d *DuckDBDatabase) SealRoom(ctx context.Context, seal *RoomSeal) error {
+	insertSQL := `
+		INSERT INTO room_seals (room_id, sealed_at, first_event_id, first_timestamp, last_event_id, last_timestamp, message_count, hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	if _, err := d.db.ExecContext(ctx, insertSQL, seal.RoomID, seal.SealedAt, seal.FirstEventID, seal.FirstTimestamp,
+		seal.LastEventID, seal.LastTimestamp, seal.MessageCount, seal.Hash); err != nil {
+		return fmt.Errorf("failed to seal room: %w", err)
+	}
+
+	return nil
+}
+
+// GetRoomSeals returns the seal of a room, or of every sealed room if roomID is empty
+func (d *DuckDBDatabase) GetRoomSeals(ctx context.Context, roomID string) ([]*RoomSeal, error) {
+	selectSQL := `
+		SELECT room_id, sealed_at, first_event_id, first_timestamp, last_event_id, last_timestamp, message_count, hash
+		FROM room_seals
+	`
+	var args []interface{}
+	if roomID != "" {
+		selectSQL += " WHERE room_id = ?"
+		args = append(args, roomID)
+	}
+	selectSQL += " ORDER BY room_id"
+
+	rows, err := d.db.QueryContext(ctx, selectSQL, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query room seals: %w", err)
+	}
+	defer rows.Close()
+
+	var seals []*RoomSeal
+	for rows.Next() {
+		s := &RoomSeal{}
+		if err := rows.Scan(&s.RoomID, &s.SealedAt, &s.FirstEventID, &s.FirstTimestamp, &s.LastEventID, &s.LastTimestamp, &s.MessageCount, &s.Hash); err != nil {
+			return nil, fmt.Errorf("failed to scan room seal: %w", err)
+		}
+		seals = append(seals, s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating room seals: %w", err)
+	}
+
+	return seals, nil
+}
+
+// GetRoomSeal returns a room's seal, or nil if the room isn't sealed
+func (d *DuckDBDatabase) GetRoomSeal(ctx context.Context, roomID string) (*RoomSeal, error) {
+	seals, err := d.GetRoomSeals(ctx, roomID)
+	if err != nil || len(seals) == 0 {
+		return nil, err
+	}
+	return seals[0], nil
+}
+
+// UnsealRoom removes a room's seal
+func (d *DuckDBDatabase) UnsealRoom(ctx context.Context, roomID string) error {
+	result, err := d.db.ExecContext(ctx, "DELETE FROM room_seals WHERE room_id = ?", roomID)
+	if err != nil {
+		return fmt.Errorf("failed to unseal room: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("room is not sealed: %s", roomID)
+	}
+
+	return nil
+}
+
+// QuarantineMessage keeps a message that failed validation, replacing an
+// earlier copy of it. The message is encrypted like content in encrypted
+// archives.
+func (d *DuckDBDatabase) QuarantineMessage(ctx context.Context, q *QuarantinedMessage) error {
+	messageJSON, err := quarantineJSON(q.Message)
+	if err != nil {
+		return fmt.Errorf("failed to serialize message: %w", err)
+	}
+	if messageJSON, err = d.sealStoredJSON(messageJSON); err != nil {
+		return err
+	}
+
+	upsertSQL := `
+		INSERT INTO quarantined_messages (event_id, room_id, sender, message, reason, validation, quarantined_at)
+		VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (event_id) DO UPDATE SET
+			room_id = excluded.room_id,
+			sender = excluded.sender,
+			message = excluded.message,
+			reason = excluded.reason,
+			validation = excluded.validation,
+			quarantined_at = excluded.quarantined_at
+	`
+
+	// DuckDB refuses invalid UTF-8, which may be why the message was quarantined
+	valid := func(s string) string { return strings.ToValidUTF8(s, "\uFFFD") }
+	if _, err := d.db.ExecContext(ctx, upsertSQL, valid(q.Message.EventID), valid(q.Message.RoomID), valid(q.Message.Sender),
+		messageJSON, q.Reason, q.Validation); err != nil {
+		return fmt.Errorf("failed to quarantine message: %w", err)
+	}
+	return nil
+}
+
+// GetQuarantinedMessages returns the quarantined messages of a room, or of
+// every room if roomID is empty, oldest quarantine first
+func (d *DuckDBDatabase) GetQuarantinedMessages(ctx context.Context, roomID string) ([]*QuarantinedMessage, error) {
+	selectSQL := "SELECT message::VARCHAR, reason, validation, quarantined_at FROM quarantined_messages"
+	var args []interface{}
+	if roomID != "" {
+		selectSQL += " WHERE room_id = ?"
+		args = append(args, roomID)
+	}
+	selectSQL += " ORDER BY quarantined_at, event_id"
+
+	rows, err := d.db.QueryContext(ctx, selectSQL, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query quarantined messages: %w", err)
+	}
+	defer rows.Close()
+
+	var quarantined []*QuarantinedMessage
+	for rows.Next() {
+		q := &QuarantinedMessage{Message: &Message{}}
+		var messageJSON string
+		if err := rows.Scan(&messageJSON, &q.Reason, &q.Validation, &q.QuarantinedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan quarantined message: %w", err)
+		}
+		messageJSON, err := d.openStoredJSON(messageJSON)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(messageJSON), q.Message); err != nil {
+			return nil, fmt.Errorf("failed to deserialize quarantined message: %w", err)
+		}
+		quarantined = append(quarantined, q)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating quarantined messages: %w", err)
+	}
+
+	return quarantined, nil
+}
+
+// DeleteQuarantinedMessage releases a message from quarantine
+func (d *DuckDBDatabase) DeleteQuarantinedMessage(ctx context.Context, eventID string) error {
+	if _, err := d.db.ExecContext(ctx, "DELETE FROM quarantined_messages WHERE event_id = ?", eventID); err != nil {
+		return fmt.Errorf("failed to delete quarantined message: %w", err)
+	}
+	return nil
+}
+
+// sealStoredJSON encrypts a JSON document stored outside the messages table
+// the way message content is encrypted, when the archive is encrypted
+func (d *DuckDBDatabase) sealStoredJSON(data string) (string, error) {
+	if d.cipher == nil {
+		return data, nil
+	}
+	return d.cipher.encryptContentJSON(data)
+}
+
+// openStoredJSON decrypts a JSON document sealed by sealStoredJSON
+func (d *DuckDBDatabase) openStoredJSON(data string) (string, error) {
+	payload, ok := encryptedPayload(data)
+	if !ok {
+		return data, nil
+	}
+	if d.cipher == nil {
+		return "", ErrContentEncrypted
+	}
+	plaintext, err := d.cipher.open(payload)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// SaveFailedEvent records an event that failed to convert or decrypt. An
+// event that failed before has its error replaced and its attempts counted.
+func (d *DuckDBDatabase) SaveFailedEvent(ctx context.Context, failed *FailedEvent) error {
+	eventJSON, err := d.sealStoredJSON(string(failed.Event))
+	if err != nil {
+		return err
+	}
+
+	upsertSQL := `
+		INSERT INTO failed_events (event_id, room_id, stage, error, event, attempts, failed_at)
+		VALUES (?, ?, ?, ?, ?, 1, CURRENT_TIMESTAMP)
+		ON CONFLICT (event_id) DO UPDATE SET
+			stage = excluded.stage,
+			error = excluded.error,
+			event = excluded.event,
+			attempts = failed_events.attempts + 1,
+			failed_at = excluded.failed_at
+	`
+
+	if _, err := d.db.ExecContext(ctx, upsertSQL, failed.EventID, failed.RoomID, failed.Stage, failed.Error, eventJSON); err != nil {
+		return fmt.Errorf("failed to save failed event: %w", err)
+	}
+	return nil
+}
+
+// GetFailedEvents returns the failed events of a room, or of every room if
+// roomID is empty, earliest failure first
+func (d *DuckDBDatabase) GetFailedEvents(ctx context.Context, roomID string) ([]*FailedEvent, error) {
+	selectSQL := "SELECT event_id, room_id, stage, error, event::VARCHAR, attempts, failed_at FROM failed_events"
+	var args []interface{}
+	if roomID != "" {
+		selectSQL += " WHERE room_id = ?"
+		args = append(args, roomID)
+	}
+	selectSQL += " ORDER BY failed_at, event_id"
+
+	rows, err := d.db.QueryContext(ctx, selectSQL, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query failed events: %w", err)
+	}
+	defer rows.Close()
+
+	var failed []*FailedEvent
+	for rows.Next() {
+		f := &FailedEvent{}
+		var eventJSON string
+		if err := rows.Scan(&f.EventID, &f.RoomID, &f.Stage, &f.Error, &eventJSON, &f.Attempts, &f.FailedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan failed event: %w", err)
+		}
+		if eventJSON, err = d.openStoredJSON(eventJSON); err != nil {
+			return nil, err
+		}
+		f.Event = json.RawMessage(eventJSON)
+		failed = append(failed, f)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating failed events: %w", err)
+	}
+
+	return failed, nil
+}
+
+// DeleteFailedEvent forgets a failed event once it has been archived
+func (d *DuckDBDatabase) DeleteFailedEvent(ctx context.Context, eventID string) error {
+	if _, err := d.db.ExecContext(ctx, "DELETE FROM failed_events WHERE event_id = ?", eventID); err != nil {
+		return fmt.Errorf("failed to delete failed event: %w", err)
+	}
+	return nil
+}
+
+// GetRestoredRoom returns the room an archived room was restored to on a
+// homeserver, or nil if it hasn't been
+func (d *DuckDBDatabase) GetRestoredRoom(ctx context.Context, homeserver, sourceRoomID string) (*RestoredRoom, error) {
+	room := &RestoredRoom{SourceRoomID: sourceRoomID, Homeserver: homeserver}
+	row := d.db.QueryRowContext(ctx, "SELECT target_room_id, restored_at FROM restored_rooms WHERE source_room_id = ? AND homeserver = ?", sourceRoomID, homeserver)
+	if err := row.Scan(&room.TargetRoomID, &room.RestoredAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get restored room: %w", err)
+	}
+	return room, nil
+}
+
+// SaveRestoredRoom records the room an archived room was restored to
+func (d *DuckDBDatabase) SaveRestoredRoom(ctx context.Context, room *RestoredRoom) error {
+	upsertSQL := `
+		INSERT INTO restored_rooms (source_room_id, homeserver, target_room_id, restored_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (source_room_id, homeserver) DO UPDATE SET
+			target_room_id = excluded.target_room_id,
+			restored_at = excluded.restored_at
+	`
+
+	if _, err := d.db.ExecContext(ctx, upsertSQL, room.SourceRoomID, room.Homeserver, room.TargetRoomID); err != nil {
+		return fmt.Errorf("failed to save restored room: %w", err)
+	}
+	return nil
+}
+
+// SaveRestoredEvents records the events posted for archived events
+func (d *DuckDBDatabase) SaveRestoredEvents(ctx context.Context, events []*RestoredEvent) error {
+	upsertSQL := `
+		INSERT INTO restored_events (source_event_id, source_room_id, homeserver, target_event_id)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (source_event_id, homeserver) DO UPDATE SET
+			target_event_id = excluded.target_event_id
+	`
+
+	for _, e := range events {
+		if _, err := d.db.ExecContext(ctx, upsertSQL, e.SourceEventID, e.SourceRoomID, e.Homeserver, e.TargetEventID); err != nil {
+			return fmt.Errorf("failed to save restored event: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetRestoredEvents returns the IDs of the events posted on a homeserver for
+// an archived room's events, keyed by archived event ID
+func (d *DuckDBDatabase) GetRestoredEvents(ctx context.Context, homeserver, sourceRoomID string) (map[string]string, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT source_event_id, target_event_id FROM restored_events WHERE homeserver = ? AND source_room_id = ?", homeserver, sourceRoomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query restored events: %w", err)
+	}
+	defer rows.Close()
+
+	restored := make(map[string]string)
+	for rows.Next() {
+		var source, target string
+		if err := rows.Scan(&source, &target); err != nil {
+			return nil, fmt.Errorf("failed to scan restored event: %w", err)
+		}
+		restored[source] = target
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating restored events: %w", err)
+	}
+
+	return restored, nil
+}
+
+// SaveOptOut records that a person declined archiving, replacing the reason
+// of an earlier opt-out
+func (d *DuckDBDatabase) SaveOptOut(ctx context.Context, optOut *OptOut) error {
+	upsertSQL := `
+		INSERT INTO opt_outs (user_id, reason, opted_out_at)
+		VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (user_id) DO UPDATE SET
+			reason = excluded.reason
+	`
+
+	if _, err := d.db.ExecContext(ctx, upsertSQL, optOut.UserID, optOut.Reason); err != nil {
+		return fmt.Errorf("failed to save opt-out: %w", err)
+	}
+	return nil
+}
+
+// GetOptOuts returns everyone who opted out, by user ID
+func (d *DuckDBDatabase) GetOptOuts(ctx context.Context) ([]*OptOut, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT user_id, COALESCE(reason, ''), opted_out_at FROM opt_outs ORDER BY user_id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query opt-outs: %w", err)
+	}
+	defer rows.Close()
+
+	var optOuts []*OptOut
+	for rows.Next() {
+		o := &OptOut{}
+		if err := rows.Scan(&o.UserID, &o.Reason, &o.OptedOutAt); err != nil {
+			return nil, fmt.Errorf("failed to scan opt-out: %w", err)
+		}
+		optOuts = append(optOuts, o)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating opt-outs: %w", err)
+	}
+
+	return optOuts, nil
+}
+
+// DeleteOptOut removes a person's opt-out
+func (d *DuckDBDatabase) DeleteOptOut(ctx context.Context, userID string) error {
+	result, err := d.db.ExecContext(ctx, "DELETE FROM opt_outs WHERE user_id = ?", userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete opt-out: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("%s has not opted out", userID)
+	}
+	return nil
+}
+
+// SavePersonAlias assigns a user ID to a person, replacing the person it
+// was merged into before
+func (d *DuckDBDatabase) SavePersonAlias(ctx context.Context, alias *PersonAlias) error {
+	upsertSQL := `
+		INSERT INTO person_aliases (user_id, person_id, merged_at)
+		VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (user_id) DO UPDATE SET
+			person_id = excluded.person_id,
+			merged_at = excluded.merged_at
+	`
+
+	if _, err := d.db.ExecContext(ctx, upsertSQL, alias.UserID, alias.PersonID); err != nil {
+		return fmt.Errorf("failed to save person alias: %w", err)
+	}
+	return nil
+}
+
+// GetPersonAliases returns every merged user ID, by person and user ID
+func (d *DuckDBDatabase) GetPersonAliases(ctx context.Context) ([]*PersonAlias, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT user_id, person_id, merged_at FROM person_aliases ORDER BY person_id, user_id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query person aliases: %w", err)
+	}
+	defer rows.Close()
+
+	var aliases []*PersonAlias
+	for rows.Next() {
+		a := &PersonAlias{}
+		if err := rows.Scan(&a.UserID, &a.PersonID, &a.MergedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan person alias: %w", err)
+		}
+		aliases = append(aliases, a)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating person aliases: %w", err)
+	}
+
+	return aliases, nil
+}
+
+// DeletePersonAlias separates a user ID from the person it was merged into
+func (d *DuckDBDatabase) DeletePersonAlias(ctx context.Context, userID string) error {
+	result, err := d.db.ExecContext(ctx, "DELETE FROM person_aliases WHERE user_id = ?", userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete person alias: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("%s has not been merged into a person", userID)
+	}
+	return nil
+}
+
+// SaveEventVerification records the result of checking an event, replacing
+// that of an earlier check
+func (d *DuckDBDatabase) SaveEventVerification(ctx context.Context, v *EventVerification) error {
+	upsertSQL := `
+		INSERT INTO event_verifications (event_id, room_id, status, source, origin, key_id, detail, checked_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (event_id) DO UPDATE SET
+			room_id = excluded.room_id,
+			status = excluded.status,
+			source = excluded.source,
+			origin = excluded.origin,
+			key_id = excluded.key_id,
+			detail = excluded.detail,
+			checked_at = excluded.checked_at
+	`
+
+	if _, err := d.db.ExecContext(ctx, upsertSQL, v.EventID, v.RoomID, v.Status, v.Source, v.Origin, v.KeyID, v.Detail, v.CheckedAt); err != nil {
+		return fmt.Errorf("failed to save event verification: %w", err)
+	}
+	return nil
+}
+
+// GetEventVerifications returns the latest check of each event in a room, by
+// event ID
+func (d *DuckDBDatabase) GetEventVerifications(ctx context.Context, roomID string) (map[string]*EventVerification, error) {
+	selectSQL := `
+		SELECT event_id, room_id, status, COALESCE(source, ''), COALESCE(origin, ''), COALESCE(key_id, ''), COALESCE(detail, ''), checked_at
+		FROM event_verifications
+		WHERE room_id = ?
+	`
+
+	rows, err := d.db.QueryContext(ctx, selectSQL, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query event verifications: %w", err)
+	}
+	defer rows.Close()
+
+	verifications := make(map[string]*EventVerification)
+	for rows.Next() {
+		v := &EventVerification{}
+		if err := rows.Scan(&v.EventID, &v.RoomID, &v.Status, &v.Source, &v.Origin, &v.KeyID, &v.Detail, &v.CheckedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan event verification: %w", err)
+		}
+		verifications[v.EventID] = v
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating event verifications: %w", err)
+	}
+
+	return verifications, nil
+}
@@ -0,0 +1,410 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Event types of MSC2545 emote packs, as sent by Cinny, FluffyChat and Nheko
+const (
+	EventTypeRoomEmotes = "im.ponies.room_emotes" // A room's packs, one state event per state key
+	EventTypeUserEmotes = "im.ponies.user_emotes" // The user's own pack, in account data
+	EventTypeEmoteRooms = "im.ponies.emote_rooms" // Account data naming the room packs the user enabled everywhere
+)
+
+// EmotesDir is where "emotes download" saves emote images, next to the
+// thumbnails and images directories
+const EmotesDir = "emotes"
+
+// MediaKindEmote is the kind of media file "emotes download" saves
+const MediaKindEmote = "emote"
+
+// roomEmotesType is EventTypeRoomEmotes as a state event type
+var roomEmotesType = event.Type{Type: EventTypeRoomEmotes, Class: event.StateEventType}
+
+// EmoteImage is one custom emoji or sticker of an emote pack
+type EmoteImage struct {
+	Shortcode string   `json:"shortcode"` // Without colons
+	URL       string   `json:"url"`
+	Body      string   `json:"body,omitempty"`
+	Usage     []string `json:"usage,omitempty"` // emoticon, sticker or both; the pack's usage if empty
+}
+
+// NewEmotePack reads an emote pack from its event content: the current
+// "pack" and "images" format, or the older "short" map of :shortcode: to
+// mxc URL
+func NewEmotePack(roomID, stateKey string, content map[string]interface{}) *EmotePack {
+	pack := &EmotePack{RoomID: roomID, StateKey: stateKey, Content: content}
+	if info, ok := content["pack"].(map[string]interface{}); ok {
+		pack.DisplayName, _ = info["display_name"].(string)
+		pack.Usage = stringList(info["usage"])
+	}
+
+	if images, ok := content["images"].(map[string]interface{}); ok {
+		for shortcode, value := range images {
+			image, _ := value.(map[string]interface{})
+			mxcURL, _ := image["url"].(string)
+			if !strings.HasPrefix(mxcURL, "mxc://") {
+				continue
+			}
+			emote := EmoteImage{Shortcode: shortcode, URL: mxcURL, Usage: stringList(image["usage"])}
+			emote.Body, _ = image["body"].(string)
+			pack.Images = append(pack.Images, emote)
+		}
+	} else if short, ok := content["short"].(map[string]interface{}); ok {
+		for shortcode, value := range short {
+			if mxcURL, _ := value.(string); strings.HasPrefix(mxcURL, "mxc://") {
+				pack.Images = append(pack.Images, EmoteImage{Shortcode: strings.Trim(shortcode, ":"), URL: mxcURL})
+			}
+		}
+	}
+	sort.Slice(pack.Images, func(i, j int) bool { return pack.Images[i].Shortcode < pack.Images[j].Shortcode })
+	return pack
+}
+
+// stringList reads a JSON array of strings, skipping anything else
+func stringList(value interface{}) []string {
+	items, _ := value.([]interface{})
+	var result []string
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// archiveUserEmotePacks stores the user's own emote pack and the room packs
+// they enabled in every room, which may be in rooms that aren't imported
+func (e *EnhancedMatrixClient) archiveUserEmotePacks(ctx context.Context) error {
+	var content map[string]interface{}
+	err := e.GetAccountData(ctx, EventTypeUserEmotes, &content)
+	switch {
+	case err == nil:
+		if err := e.db.SaveEmotePack(ctx, NewEmotePack("", "", content)); err != nil {
+			return err
+		}
+	case !errors.Is(err, mautrix.MNotFound):
+		return err
+	}
+
+	var enabled struct {
+		Rooms map[id.RoomID]map[string]interface{} `json:"rooms"`
+	}
+	err = e.GetAccountData(ctx, EventTypeEmoteRooms, &enabled)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return err
+	}
+	for roomID, stateKeys := range enabled.Rooms {
+		for stateKey := range stateKeys {
+			var content map[string]interface{}
+			err := e.StateEvent(ctx, roomID, roomEmotesType, stateKey, &content)
+			if err != nil {
+				if !errors.Is(err, mautrix.MNotFound) {
+					log.Printf("Warning: Could not archive emote pack %q of %s: %v", stateKey, roomID, err)
+				}
+				continue
+			}
+			if err := e.db.SaveEmotePack(ctx, NewEmotePack(roomID.String(), stateKey, content)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// archiveRoomEmotePacks stores every emote pack in a room's state. A room
+// may have any number of packs, under different state keys, so this reads
+// the whole state rather than one event.
+func (e *EnhancedMatrixClient) archiveRoomEmotePacks(ctx context.Context, roomID id.RoomID) error {
+	state, err := e.StateAsArray(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	for _, evt := range state {
+		if evt.Type.Type != EventTypeRoomEmotes || evt.StateKey == nil {
+			continue
+		}
+		if err := e.db.SaveEmotePack(ctx, NewEmotePack(roomID.String(), *evt.StateKey, evt.Content.Raw)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	// htmlImgTag matches an <img> tag in a formatted body
+	htmlImgTag = regexp.MustCompile(`(?i)<img\b[^>]*>`)
+	// mxcSrcAttr matches an img tag's src attribute holding an mxc URL
+	mxcSrcAttr = regexp.MustCompile(`(?i)\bsrc\s*=\s*["'](mxc://[^"']+)["']`)
+)
+
+// emoticonURLs returns the mxc URLs of the custom emoji in a formatted
+// body: its <img data-mx-emoticon src="mxc://..."> tags
+func emoticonURLs(body string) []string {
+	var urls []string
+	for _, tag := range htmlImgTag.FindAllString(body, -1) {
+		if !strings.Contains(tag, "data-mx-emoticon") {
+			continue
+		}
+		if match := mxcSrcAttr.FindStringSubmatch(tag); match != nil {
+			urls = append(urls, match[1])
+		}
+	}
+	return urls
+}
+
+// rewriteEmoticons points the custom emoji in a formatted body at their
+// images, as EmoteLink links them. Emoji it has no link for keep their mxc
+// URL, which browsers show as the alt text, the emoji's :shortcode:.
+func rewriteEmoticons(body string, resolver MediaLinkResolver) string {
+	if !strings.Contains(body, "data-mx-emoticon") {
+		return body
+	}
+	return htmlImgTag.ReplaceAllStringFunc(body, func(tag string) string {
+		if !strings.Contains(tag, "data-mx-emoticon") {
+			return tag
+		}
+		return mxcSrcAttr.ReplaceAllStringFunc(tag, func(attr string) string {
+			link := EmoteLink(mxcSrcAttr.FindStringSubmatch(attr)[1], resolver)
+			if link == "" {
+				return attr
+			}
+			return `src="` + html.EscapeString(link) + `"`
+		})
+	})
+}
+
+// EmoteLink returns what a custom emoji's image links to in an export: the
+// file "emotes download" saved to ./emotes, linked as the resolver links
+// downloaded media, or else the homeserver's download URL if the resolver
+// links there. It returns "" for an emoji that can't be shown.
+func EmoteLink(mxcURL string, resolver MediaLinkResolver) string {
+	if path := localMediaPath(EmotesDir, mxcMediaStem(mxcURL)); path != "" {
+		return downloadedMediaLink(resolver, mxcURL, path)
+	}
+	if _, ok := resolver.(downloadMediaLinks); ok {
+		if link, err := GetDownloadURL(mxcURL); err == nil {
+			return link
+		}
+	}
+	return ""
+}
+
+// AttachEmotes gives the custom emoji reactions of exported messages, whose
+// key is an mxc URL, their image and, if the reaction didn't name it, the
+// shortcode an archived pack gives the image
+func AttachEmotes(exportMessages []ExportMessage, packs []*EmotePack, resolver MediaLinkResolver) {
+	shortcodes := make(map[string]string)
+	for _, pack := range packs {
+		for _, image := range pack.Images {
+			if _, ok := shortcodes[image.URL]; !ok {
+				shortcodes[image.URL] = image.Shortcode
+			}
+		}
+	}
+
+	for i := range exportMessages {
+		for j := range exportMessages[i].Reactions {
+			reaction := &exportMessages[i].Reactions[j]
+			if !strings.HasPrefix(reaction.Emoji, "mxc://") {
+				continue
+			}
+			reaction.Image = EmoteLink(reaction.Emoji, resolver)
+			if reaction.Shortcode == "" {
+				reaction.Shortcode = shortcodes[reaction.Emoji]
+			}
+		}
+	}
+}
+
+// attachEmotes attaches the images of custom emoji reactions, naming them
+// with the archived emote packs
+func attachEmotes(ctx context.Context, exportMessages []ExportMessage, resolver MediaLinkResolver) error {
+	packs, err := GetDatabase().GetEmotePacks(ctx)
+	if err != nil {
+		return err
+	}
+	AttachEmotes(exportMessages, packs, resolver)
+	return nil
+}
+
+// reactionShortcode returns the shortcode a custom emoji reaction names its
+// image with, without colons, or "" if it names none
+func reactionShortcode(content map[string]interface{}) string {
+	for _, key := range []string{"shortcode", "com.beeper.reaction.shortcode"} {
+		if shortcode, ok := content[key].(string); ok && shortcode != "" {
+			return strings.Trim(shortcode, ":")
+		}
+	}
+	return ""
+}
+
+// emoteURLs returns the mxc URLs of every archived custom emoji: the images
+// of the archived packs, the emoji used in formatted messages and custom
+// emoji reactions, each once
+func emoteURLs(ctx context.Context, db DatabaseInterface) ([]string, error) {
+	packs, err := db.GetEmotePacks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := db.GetMessages(ctx, nil, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	var urls []string
+	add := func(mxcURL string) {
+		if strings.HasPrefix(mxcURL, "mxc://") && !seen[mxcURL] {
+			seen[mxcURL] = true
+			urls = append(urls, mxcURL)
+		}
+	}
+	for _, pack := range packs {
+		for _, image := range pack.Images {
+			add(image.URL)
+		}
+	}
+	for _, msg := range messages {
+		if body, ok := msg.Content["formatted_body"].(string); ok {
+			for _, mxcURL := range emoticonURLs(body) {
+				add(mxcURL)
+			}
+		}
+		if relatesTo, ok := msg.Content["m.relates_to"].(map[string]interface{}); ok && relatesTo["rel_type"] == "m.annotation" {
+			key, _ := relatesTo["key"].(string)
+			add(key)
+		}
+	}
+	return urls, nil
+}
+
+// DownloadEmotes downloads the images of the archived emote packs, and of
+// the custom emoji used in messages and reactions, to outputDir/emotes in
+// the given media layout ("" keeps the directory's current layout), so
+// exports show them instead of their :shortcode:
+func DownloadEmotes(outputDir, layout string) error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	if outputDir == "" {
+		outputDir = "."
+	}
+	dirPath := filepath.Join(outputDir, EmotesDir)
+	dir, err := OpenMediaDir(dirPath, layout)
+	if err != nil {
+		return err
+	}
+
+	urls, err := emoteURLs(context.Background(), GetDatabase())
+	if err != nil {
+		return err
+	}
+	if len(urls) == 0 {
+		fmt.Println("No custom emoji found")
+		return nil
+	}
+
+	existing, err := GetExistingFilesMap(dirPath)
+	if err != nil {
+		return fmt.Errorf("failed to get existing files: %w", err)
+	}
+	var missing []string
+	for _, mxcURL := range urls {
+		if stem := mxcMediaStem(mxcURL); stem != "" && !existing[stem] {
+			missing = append(missing, mxcURL)
+		}
+	}
+	if skipped := len(urls) - len(missing); skipped > 0 {
+		fmt.Printf("Skipping %d already-downloaded emotes\n", skipped)
+	}
+	if len(missing) == 0 {
+		fmt.Println("Nothing to do")
+		return nil
+	}
+
+	fmt.Printf("Downloading %d new emotes...\n", len(missing))
+	client := &http.Client{}
+	for _, mxcURL := range missing {
+		if _, err := downloadMedia(client, mxcURL, dir, mxcMediaStem(mxcURL), 0, MediaKindEmote); err != nil {
+			fmt.Printf("Skipping %s: %v\n", mxcURL, err)
+		}
+	}
+	return nil
+}
+
+// ListEmotePacks prints the archived emote packs with how many of their
+// images were downloaded to outputDir/emotes
+func ListEmotePacks(outputDir string) error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	packs, err := GetDatabase().GetEmotePacks(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput() {
+		if packs == nil {
+			packs = []*EmotePack{}
+		}
+		return writeJSON(packs)
+	}
+
+	if len(packs) == 0 {
+		fmt.Println("No emote packs found")
+		return nil
+	}
+
+	if outputDir == "" {
+		outputDir = "."
+	}
+	existing, err := GetExistingFilesMap(filepath.Join(outputDir, EmotesDir))
+	if err != nil {
+		return fmt.Errorf("failed to get existing files: %w", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Room\tPack\tEmotes\tDownloaded\tUpdated")
+	fmt.Fprintln(w, "----\t----\t------\t----------\t-------")
+	for _, pack := range packs {
+		downloaded := 0
+		for _, image := range pack.Images {
+			if existing[mxcMediaStem(image.URL)] {
+				downloaded++
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", orUserPack(pack.RoomID), pack.Name(), len(pack.Images), downloaded, pack.UpdatedAt.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+// orUserPack names where a pack is: its room, or the user's account data
+func orUserPack(roomID string) string {
+	if roomID == "" {
+		return "(user)"
+	}
+	return roomID
+}
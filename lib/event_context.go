@@ -0,0 +1,265 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// DefaultEventContext is the number of messages the context command shows
+// before and after the requested event
+const DefaultEventContext = 20
+
+// Reasons a message is included in an event context besides being near the
+// requested event. They share the Highlights field with highlights exports.
+const (
+	ContextTarget    = "target"
+	ContextRepliedTo = "replied_to"
+	ContextThread    = "thread"
+)
+
+// ParseEventReference accepts an event ID or a permalink to an event
+// (https://matrix.to/#/!room:server/$event?via=..., a client link with the
+// same path, or matrix:roomid/room:server/e/event) and returns the event ID
+// and, if the reference names one, the room ID or alias
+func ParseEventReference(ref string) (roomID, eventID string, err error) {
+	ref = strings.TrimSpace(ref)
+	if strings.HasPrefix(ref, "$") {
+		return "", ref, nil
+	}
+
+	if rest, ok := strings.CutPrefix(ref, "matrix:"); ok {
+		rest, _, _ = strings.Cut(rest, "?")
+		parts := strings.Split(rest, "/")
+		if len(parts) == 4 && parts[2] == "e" {
+			sigils := map[string]string{"roomid": "!", "r": "#"}
+			if sigil, ok := sigils[parts[0]]; ok {
+				room, roomErr := url.PathUnescape(parts[1])
+				event, eventErr := url.PathUnescape(parts[3])
+				if roomErr == nil && eventErr == nil {
+					return sigil + room, "$" + event, nil
+				}
+			}
+		}
+		return "", "", fmt.Errorf("%q is not a link to an event", ref)
+	}
+
+	// matrix.to and client links put the room and event after the fragment's /
+	_, fragment, ok := strings.Cut(ref, "#/")
+	if !ok {
+		return "", "", fmt.Errorf("%q is neither an event ID nor a permalink", ref)
+	}
+	fragment, _, _ = strings.Cut(fragment, "?")
+	fragment = strings.TrimPrefix(fragment, "room/")
+	room, event, ok := strings.Cut(fragment, "/")
+	if !ok {
+		return "", "", fmt.Errorf("%q links to a room, not an event", ref)
+	}
+	if roomID, err = url.QueryUnescape(room); err != nil {
+		return "", "", fmt.Errorf("invalid room in %q: %w", ref, err)
+	}
+	if eventID, err = url.QueryUnescape(event); err != nil {
+		return "", "", fmt.Errorf("invalid event in %q: %w", ref, err)
+	}
+	if !strings.HasPrefix(eventID, "$") {
+		return "", "", fmt.Errorf("%q links to a room, not an event", ref)
+	}
+	return roomID, eventID, nil
+}
+
+// messageRelations returns the event a message replies to and the root of
+// the thread it is in, if any
+func messageRelations(content map[string]interface{}) (replyTo, threadRoot string) {
+	relatesTo, ok := content["m.relates_to"].(map[string]interface{})
+	if !ok {
+		return "", ""
+	}
+	if reply, ok := relatesTo["m.in_reply_to"].(map[string]interface{}); ok {
+		replyTo, _ = reply["event_id"].(string)
+	}
+	if relatesTo["rel_type"] == "m.thread" {
+		threadRoot, _ = relatesTo["event_id"].(string)
+	}
+	return replyTo, threadRoot
+}
+
+// ResolveRelations fills in RepliesTo and ThreadInfo for messages whose reply
+// parent or thread root is among messages
+func ResolveRelations(messages []ExportMessage) {
+	byID := make(map[string]int, len(messages))
+	threadReplies := make(map[string]int)
+	for i, msg := range messages {
+		byID[msg.EventID] = i
+		if _, root := messageRelations(msg.Content); root != "" {
+			threadReplies[root]++
+		}
+	}
+
+	for i := range messages {
+		replyTo, root := messageRelations(messages[i].Content)
+		if j, ok := byID[replyTo]; ok && replyTo != "" {
+			parent := messages[j]
+			body, _ := parent.Content["body"].(string)
+			messages[i].RepliesTo = &ReplyInfo{
+				EventID:     parent.EventID,
+				Sender:      parent.Sender,
+				DisplayName: parent.DisplayName,
+				Content:     body,
+				Timestamp:   parent.Timestamp,
+			}
+		}
+		if root != "" {
+			messages[i].ThreadInfo = &ThreadInfo{RootEventID: root, ReplyCount: threadReplies[root]}
+		} else if count := threadReplies[messages[i].EventID]; count > 0 {
+			// The server's count from the root's bundled aggregations also
+			// covers replies that aren't among messages
+			if info := messages[i].ThreadInfo; info != nil && info.IsRoot && info.ReplyCount > count {
+				count = info.ReplyCount
+			}
+			messages[i].ThreadInfo = &ThreadInfo{RootEventID: messages[i].EventID, ReplyCount: count, IsRoot: true}
+		}
+	}
+}
+
+// SelectEventContext returns the message with eventID together with up to
+// before and after messages around it, the messages its replies lead back
+// to, and, if it is part of a thread, the whole thread. Messages are in
+// chronological order; the first message after a gap is marked with
+// ContextBreak, and messages outside the window say why they are included.
+func SelectEventContext(messages []ExportMessage, eventID string, before, after int) ([]ExportMessage, error) {
+	target := -1
+	byID := make(map[string]int, len(messages))
+	for i, msg := range messages {
+		byID[msg.EventID] = i
+		if msg.EventID == eventID {
+			target = i
+		}
+	}
+	if target < 0 {
+		return nil, fmt.Errorf("event %s is not in the archive", eventID)
+	}
+
+	keep := make([]bool, len(messages))
+	reasons := map[string][]string{eventID: {ContextTarget}}
+	for i := max(0, target-before); i <= min(len(messages)-1, target+after); i++ {
+		keep[i] = true
+	}
+
+	// The whole thread, whether the event is its root or one of its replies
+	_, root := messageRelations(messages[target].Content)
+	if root == "" {
+		root = eventID
+	}
+	for i, msg := range messages {
+		if _, msgRoot := messageRelations(msg.Content); msgRoot == root || (msg.EventID == root && msgRoot == "" && i != target) {
+			if !keep[i] {
+				keep[i] = true
+				reasons[msg.EventID] = append(reasons[msg.EventID], ContextThread)
+			}
+		}
+	}
+
+	// Follow each kept message's replies back to the start of the conversation
+	for i := range messages {
+		if !keep[i] {
+			continue
+		}
+		for replyTo, _ := messageRelations(messages[i].Content); replyTo != ""; {
+			j, ok := byID[replyTo]
+			if !ok || keep[j] {
+				break
+			}
+			keep[j] = true
+			reasons[replyTo] = append(reasons[replyTo], ContextRepliedTo)
+			replyTo, _ = messageRelations(messages[j].Content)
+		}
+	}
+
+	selected := []ExportMessage{}
+	for i, msg := range messages {
+		if !keep[i] {
+			continue
+		}
+		msg.Highlights = reasons[msg.EventID]
+		msg.ContextBreak = len(selected) > 0 && !keep[i-1]
+		selected = append(selected, msg)
+	}
+	return selected, nil
+}
+
+// ShowEventContext prints the conversation around an archived event as text,
+// or writes it to filename in the format its extension selects. ref is an
+// event ID or a permalink.
+func ShowEventContext(ref string, before, after int, filename string, opts *ExportOptions) error {
+	if opts == nil {
+		opts = DefaultExportOptions()
+	}
+
+	linkedRoom, eventID, err := ParseEventReference(ref)
+	if err != nil {
+		return err
+	}
+
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	ext := "txt"
+	if filename != "" {
+		if ext, err = exportFormat(filename, opts); err != nil {
+			return err
+		}
+		if ext == FormatStaticAPI {
+			return fmt.Errorf("the context of an event can't be written as a static API")
+		}
+	}
+
+	ctx := context.Background()
+	msg, err := GetDatabase().GetMessage(ctx, eventID)
+	if err != nil {
+		return fmt.Errorf("event %s is not in the archive: %w", eventID, err)
+	}
+	roomID := msg.RoomID
+	if strings.HasPrefix(linkedRoom, "!") && linkedRoom != roomID {
+		return fmt.Errorf("event %s is archived in %s, not %s", eventID, roomID, linkedRoom)
+	}
+
+	messages, err := GetDatabase().GetMessages(ctx, &MessageFilter{RoomID: roomID}, 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %w", err)
+	}
+	if messages, _, err = withholdOptedOut(ctx, messages); err != nil {
+		return err
+	}
+	mediaLinks, err := opts.mediaLinkResolver()
+	if err != nil {
+		return err
+	}
+	exportMessages, err := convertToExportMessages(messages, roomID, mediaLinks)
+	if err != nil {
+		return fmt.Errorf("failed to convert messages: %w", err)
+	}
+	if opts.Permalinks {
+		AttachPermalinks(exportMessages, roomID, opts.PermalinkBase)
+	}
+	ResolveRelations(exportMessages)
+
+	selected, err := SelectEventContext(exportMessages, eventID, before, after)
+	if err != nil {
+		return err
+	}
+
+	if filename == "" {
+		if jsonOutput() {
+			return writeJSON(exportDocument{FormatVersion: ExportFormatVersion, Messages: selected})
+		}
+		return ExportWithTemplateOptions(os.Stdout, ResolveTemplatePath(opts.Template, "txt"), selected, opts)
+	}
+
+	fmt.Printf("Writing %d messages around %s to %q\n", len(selected), eventID, filename)
+	return writeExportFile(filename, ext, selected, opts)
+}
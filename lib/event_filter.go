@@ -0,0 +1,81 @@
+package archive
+
+import (
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+// EventFilter returns the filter for /messages and /sync requests. Members
+// are always lazy-loaded, so the server only sends the member state of the
+// events' senders rather than that of every member of the room, which is
+// most of the response in rooms with tens of thousands of members. types,
+// if not empty, limits the events to those types, and notTypes leaves out
+// the types it names; both accept * wildcards. The server only sees the
+// outer type of encrypted events, so when types are given m.room.encrypted
+// is asked for too, and decrypted events are checked with EventFilterIncludes.
+func EventFilter(types, notTypes []string) *mautrix.FilterPart {
+	filter := &mautrix.FilterPart{LazyLoadMembers: true}
+	for _, t := range types {
+		filter.Types = append(filter.Types, event.NewEventType(t))
+	}
+	for _, t := range notTypes {
+		filter.NotTypes = append(filter.NotTypes, event.NewEventType(t))
+	}
+	if len(filter.Types) > 0 && !EventFilterIncludes(filter, EventTypeEncrypted) && !matchesEventTypes(filter.NotTypes, EventTypeEncrypted) {
+		filter.Types = append(filter.Types, event.EventEncrypted)
+	}
+	return filter
+}
+
+// EventFilterIncludes reports whether filter selects events of type evtType,
+// as the server would. A nil filter selects every event.
+func EventFilterIncludes(filter *mautrix.FilterPart, evtType string) bool {
+	if filter == nil {
+		return true
+	}
+	if len(filter.Types) > 0 && !matchesEventTypes(filter.Types, evtType) {
+		return false
+	}
+	return !matchesEventTypes(filter.NotTypes, evtType)
+}
+
+// matchesEventTypes reports whether evtType matches any of the patterns, in
+// which * matches any sequence of characters
+func matchesEventTypes(patterns []event.Type, evtType string) bool {
+	for _, pattern := range patterns {
+		if matchesWildcard(pattern.Type, evtType) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesWildcard matches s against a pattern whose * match any sequence
+func matchesWildcard(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+// syncFilter returns the /sync filter: mautrix's default timeline limit of
+// 50, with members lazy-loaded in each room's state and timeline
+func syncFilter() *mautrix.Filter {
+	timeline := EventFilter(nil, nil)
+	timeline.Limit = 50
+	return &mautrix.Filter{Room: &mautrix.RoomFilter{State: EventFilter(nil, nil), Timeline: timeline}}
+}
@@ -0,0 +1,498 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/canonicaljson"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/federation"
+	"maunium.net/go/mautrix/id"
+)
+
+// Results of checking an archived message against its homeserver
+const (
+	VerificationVerified    = "verified"    // Signed by its origin server, and the archive holds the signed content
+	VerificationInvalid     = "invalid"     // Its content hash, signature or event ID doesn't check out
+	VerificationMismatch    = "mismatch"    // The homeserver's copy differs from the archived one
+	VerificationUnsigned    = "unsigned"    // The homeserver's copy matches, but its signatures couldn't be checked
+	VerificationUnavailable = "unavailable" // The homeserver wouldn't return the event
+)
+
+// Where the copy of an event that was checked came from
+const (
+	VerificationSourceClient     = "client"     // The client-server API's event endpoint
+	VerificationSourceFederation = "federation" // The origin server's federation event endpoint
+)
+
+// SigningKeyFunc returns the public key a server signs events with
+type SigningKeyFunc func(serverName string, keyID id.KeyID) (id.SigningKey, error)
+
+// redactionKeys are the top-level keys redaction keeps, which signatures and
+// event IDs cover, before room version 11 and from it on
+var (
+	redactionKeysV1 = []string{"event_id", "type", "room_id", "sender", "state_key", "content", "hashes", "signatures",
+		"depth", "prev_events", "prev_state", "auth_events", "origin", "origin_server_ts", "membership"}
+	redactionKeysV11 = []string{"event_id", "type", "room_id", "sender", "state_key", "content", "hashes", "signatures",
+		"depth", "prev_events", "auth_events", "origin_server_ts"}
+)
+
+// roomVersionNumber returns a room version as a number, treating versions
+// that aren't numbers, such as experimental ones, as the newest rules
+func roomVersionNumber(roomVersion string) int {
+	if n, err := strconv.Atoi(roomVersion); err == nil {
+		return n
+	}
+	return 11
+}
+
+// redactedContentKeys returns the content keys redaction keeps for an event
+// type in a room version, or nil to keep all of them
+func redactedContentKeys(eventType string, version int) ([]string, bool) {
+	switch eventType {
+	case "m.room.member":
+		keys := []string{"membership"}
+		if version >= 9 {
+			keys = append(keys, "join_authorised_via_users_server")
+		}
+		return keys, false
+	case "m.room.create":
+		if version >= 11 {
+			return nil, true
+		}
+		return []string{"creator"}, false
+	case "m.room.join_rules":
+		if version >= 8 {
+			return []string{"join_rule", "allow"}, false
+		}
+		return []string{"join_rule"}, false
+	case "m.room.power_levels":
+		keys := []string{"ban", "events", "events_default", "kick", "redact", "state_default", "users", "users_default"}
+		if version >= 11 {
+			keys = append(keys, "invite")
+		}
+		return keys, false
+	case "m.room.history_visibility":
+		return []string{"history_visibility"}, false
+	case "m.room.aliases":
+		if version <= 5 {
+			return []string{"aliases"}, false
+		}
+	case "m.room.redaction":
+		if version >= 11 {
+			return []string{"redacts"}, false
+		}
+	}
+	return []string{}, false
+}
+
+// redactEvent returns the parts of an event that its signatures and event ID
+// cover: the keys redaction keeps, without signatures and unsigned data
+func redactEvent(event map[string]interface{}, roomVersion string) map[string]interface{} {
+	version := roomVersionNumber(roomVersion)
+	keep := redactionKeysV1
+	if version >= 11 {
+		keep = redactionKeysV11
+	}
+	redacted := make(map[string]interface{})
+	for _, key := range keep {
+		if value, ok := event[key]; ok {
+			redacted[key] = value
+		}
+	}
+	delete(redacted, "signatures")
+	if version >= 3 {
+		// Event IDs of later room versions are hashes, not part of the event
+		delete(redacted, "event_id")
+	}
+
+	content, _ := event["content"].(map[string]interface{})
+	eventType, _ := event["type"].(string)
+	keys, all := redactedContentKeys(eventType, version)
+	if !all {
+		kept := make(map[string]interface{})
+		for _, key := range keys {
+			if value, ok := content[key]; ok {
+				kept[key] = value
+			}
+		}
+		if eventType == "m.room.member" && version >= 11 {
+			if invite, ok := content["third_party_invite"].(map[string]interface{}); ok {
+				if signed, ok := invite["signed"]; ok {
+					kept["third_party_invite"] = map[string]interface{}{"signed": signed}
+				}
+			}
+		}
+		content = kept
+	}
+	redacted["content"] = content
+	return redacted
+}
+
+// canonicalEventJSON encodes an event as Matrix canonical JSON
+func canonicalEventJSON(event map[string]interface{}) ([]byte, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	return canonicaljson.CanonicalJSON(data)
+}
+
+// decodeUnpaddedBase64 decodes the unpadded base64 Matrix uses for hashes
+// and signatures, accepting padding too
+func decodeUnpaddedBase64(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// VerifyEventJSON checks an event as a homeserver returned it against the
+// archived message: that it is the same event with the same content, that
+// its content hash is right, that its origin server signed it with a key
+// getKey returns, and, in room versions with hashed event IDs, that its event
+// ID is the hash of what was signed. Encrypted events are checked as sent,
+// so an archived decryption can only be matched by event ID and sender.
+// Which of these apply, and how, depends on the room version; if that is
+// unknown, a matching copy is reported as unsigned rather than checked under
+// the wrong rules.
+func VerifyEventJSON(raw []byte, archived *Message, roomVersion string, getKey SigningKeyFunc) *EventVerification {
+	result := &EventVerification{EventID: archived.EventID, RoomID: archived.RoomID, CheckedAt: time.Now().UTC()}
+	fail := func(status, format string, args ...interface{}) *EventVerification {
+		result.Status, result.Detail = status, fmt.Sprintf(format, args...)
+		return result
+	}
+
+	var event map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&event); err != nil {
+		return fail(VerificationInvalid, "the homeserver's copy isn't valid JSON: %v", err)
+	}
+
+	// The homeserver's copy must be the archived event
+	sender, _ := event["sender"].(string)
+	eventType, _ := event["type"].(string)
+	if eventID, ok := event["event_id"].(string); ok && eventID != archived.EventID {
+		return fail(VerificationMismatch, "the homeserver returned event %s", eventID)
+	}
+	if sender != archived.Sender {
+		return fail(VerificationMismatch, "sent by %s, archived as sent by %s", sender, archived.Sender)
+	}
+	if ts, ok := event["origin_server_ts"].(json.Number); ok {
+		if ms, err := ts.Int64(); err == nil && ms != archived.Timestamp.UnixMilli() {
+			return fail(VerificationMismatch, "sent at %s, archived as sent at %s",
+				time.UnixMilli(ms).UTC().Format(time.RFC3339), archived.Timestamp.UTC().Format(time.RFC3339))
+		}
+	}
+	encrypted := eventType == "m.room.encrypted" && archived.MessageType != eventType
+	if !encrypted {
+		if eventType != archived.MessageType {
+			return fail(VerificationMismatch, "a %s event, archived as %s", eventType, archived.MessageType)
+		}
+		content, _ := json.Marshal(event["content"])
+		archivedContent, _ := json.Marshal(archived.Content)
+		var a, b interface{}
+		json.Unmarshal(content, &a)
+		json.Unmarshal(archivedContent, &b)
+		if !jsonEqual(a, b) {
+			return fail(VerificationMismatch, "the homeserver's content differs from the archived content")
+		}
+	}
+	note := ""
+	if encrypted {
+		note = "; the event is encrypted, so the signature covers its ciphertext, not the archived decryption"
+	}
+
+	hashes, _ := event["hashes"].(map[string]interface{})
+	signatures, _ := event["signatures"].(map[string]interface{})
+	if hashes == nil || signatures == nil {
+		return fail(VerificationUnsigned, "the homeserver's copy matches but has no hashes or signatures to check%s", note)
+	}
+	if roomVersion == "" {
+		return fail(VerificationUnsigned, "the homeserver's copy matches, but the room's version is unknown, so its hashes and signatures can't be checked%s", note)
+	}
+
+	// The content hash covers the whole event but its signatures and unsigned data
+	hashed := make(map[string]interface{}, len(event))
+	for key, value := range event {
+		hashed[key] = value
+	}
+	delete(hashed, "signatures")
+	delete(hashed, "unsigned")
+	delete(hashed, "hashes")
+	if roomVersionNumber(roomVersion) >= 3 {
+		delete(hashed, "event_id")
+	}
+	hashedJSON, err := canonicalEventJSON(hashed)
+	if err != nil {
+		return fail(VerificationInvalid, "failed to encode the event: %v", err)
+	}
+	wantHash, _ := hashes["sha256"].(string)
+	gotHash := sha256.Sum256(hashedJSON)
+	if decoded, err := decodeUnpaddedBase64(wantHash); err != nil || !bytes.Equal(decoded, gotHash[:]) {
+		return fail(VerificationInvalid, "the content hash doesn't match the event's content")
+	}
+
+	// Signatures and the event ID cover the redacted event
+	signedJSON, err := canonicalEventJSON(redactEvent(event, roomVersion))
+	if err != nil {
+		return fail(VerificationInvalid, "failed to encode the redacted event: %v", err)
+	}
+	if version := roomVersionNumber(roomVersion); version >= 3 {
+		reference := sha256.Sum256(signedJSON)
+		encoding := base64.RawURLEncoding
+		if version == 3 {
+			encoding = base64.RawStdEncoding
+		}
+		if want := "$" + encoding.EncodeToString(reference[:]); want != archived.EventID {
+			return fail(VerificationInvalid, "the event ID isn't the hash of the event; expected %s", want)
+		}
+	}
+
+	origin := id.UserID(sender).Homeserver()
+	result.Origin = origin
+	serverSignatures, _ := signatures[origin].(map[string]interface{})
+	if len(serverSignatures) == 0 {
+		return fail(VerificationInvalid, "not signed by %s, the sender's server", origin)
+	}
+	for keyID, value := range serverSignatures {
+		if !strings.HasPrefix(keyID, "ed25519:") {
+			continue
+		}
+		signature, _ := value.(string)
+		result.KeyID = keyID
+		key, err := getKey(origin, id.KeyID(keyID))
+		if err != nil {
+			return fail(VerificationUnsigned, "couldn't get signing key %s of %s to check the signature: %v%s", keyID, origin, err, note)
+		}
+		publicKey, err := decodeUnpaddedBase64(string(key))
+		if err != nil || len(publicKey) != ed25519.PublicKeySize {
+			return fail(VerificationInvalid, "signing key %s of %s is malformed", keyID, origin)
+		}
+		decoded, err := decodeUnpaddedBase64(signature)
+		if err != nil || !ed25519.Verify(publicKey, signedJSON, decoded) {
+			return fail(VerificationInvalid, "the signature with key %s of %s is wrong", keyID, origin)
+		}
+		result.Status = VerificationVerified
+		checked := "content hash and signature"
+		if roomVersionNumber(roomVersion) >= 3 {
+			checked = "content hash, event ID and signature"
+		}
+		result.Detail = fmt.Sprintf("%s with %s of %s check out%s", checked, keyID, origin, note)
+		return result
+	}
+	return fail(VerificationInvalid, "%s signed with no ed25519 key", origin)
+}
+
+// jsonEqual reports whether two decoded JSON values are equal
+func jsonEqual(a, b interface{}) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return bytes.Equal(x, y)
+}
+
+// signingKeys fetches servers' signing keys from the servers themselves, for
+// VerifyEventJSON, keeping them for the other events they signed
+type signingKeys struct {
+	client *federation.Client
+	keys   map[string]*federation.ServerKeyResponse
+	errs   map[string]error
+}
+
+func newSigningKeys() *signingKeys {
+	return &signingKeys{
+		client: federation.NewClient("", nil, nil),
+		keys:   make(map[string]*federation.ServerKeyResponse),
+		errs:   make(map[string]error),
+	}
+}
+
+// get returns a server's key, current or expired, checking that the server
+// signed the list of keys it came in
+func (s *signingKeys) get(serverName string, keyID id.KeyID) (id.SigningKey, error) {
+	resp, fetched := s.keys[serverName]
+	if !fetched && s.errs[serverName] == nil {
+		var err error
+		if resp, err = s.client.ServerKeys(context.Background(), serverName); err == nil {
+			err = resp.VerifySelfSignature()
+		}
+		if err != nil {
+			s.errs[serverName] = err
+		} else {
+			s.keys[serverName] = resp
+		}
+	}
+	if err := s.errs[serverName]; err != nil {
+		return "", err
+	}
+	if key, ok := resp.VerifyKeys[keyID]; ok {
+		return key.Key, nil
+	}
+	if key, ok := resp.OldVerifyKeys[keyID]; ok {
+		return key.Key, nil
+	}
+	return "", fmt.Errorf("%s doesn't publish key %s", serverName, keyID)
+}
+
+// fetchSignedEvent returns the homeserver's copy of an event: from the
+// client-server API if it comes with hashes and signatures, otherwise from
+// the federation API of the sender's server, which only answers servers it
+// trusts, so the client copy is used without signatures if that fails
+func fetchSignedEvent(ctx context.Context, client *mautrix.Client, fed *federation.Client, msg *Message) ([]byte, string, error) {
+	var raw json.RawMessage
+	_, clientErr := client.MakeRequest(ctx, "GET", client.BuildClientURL("v3", "rooms", msg.RoomID, "event", msg.EventID), nil, &raw)
+	if clientErr == nil && bytes.Contains(raw, []byte(`"signatures"`)) {
+		return raw, VerificationSourceClient, nil
+	}
+
+	var resp federation.RespBackfill
+	origin := id.UserID(msg.Sender).Homeserver()
+	fedErr := fed.MakeRequest(ctx, origin, false, "GET", federation.URLPath{"v1", "event", msg.EventID}, nil, &resp)
+	if fedErr == nil && len(resp.PDUs) > 0 {
+		return resp.PDUs[0], VerificationSourceFederation, nil
+	}
+
+	if clientErr != nil {
+		return nil, "", clientErr
+	}
+	return raw, VerificationSourceClient, nil
+}
+
+// attachRoomVerifications adds to exported messages the latest results of
+// checking them against the homeserver, for messages that were checked
+func attachRoomVerifications(ctx context.Context, messages []ExportMessage, roomIDs ...string) error {
+	verifications := make(map[string]*EventVerification)
+	for _, roomID := range roomIDs {
+		roomVerifications, err := GetDatabase().GetEventVerifications(ctx, roomID)
+		if err != nil {
+			return err
+		}
+		for eventID, v := range roomVerifications {
+			verifications[eventID] = v
+		}
+	}
+	for i := range messages {
+		messages[i].Verification = verifications[messages[i].EventID]
+	}
+	return nil
+}
+
+// verificationRoomVersion returns a room's version as archived or, for rooms
+// archived without it, from the room's create event, recording it; it
+// returns "" if neither has it
+func verificationRoomVersion(ctx context.Context, client *mautrix.Client, roomID string) string {
+	db := GetDatabase()
+	if stored, err := db.GetRoomVersion(ctx, roomID); err == nil && stored != nil && stored.RoomVersion != "" {
+		return stored.RoomVersion
+	}
+	var create event.CreateEventContent
+	if err := client.StateEvent(ctx, id.RoomID(roomID), event.StateCreate, "", &create); err != nil {
+		log.Printf("Warning: Could not get the version of room %s: %v", roomID, err)
+		return ""
+	}
+	// Rooms created before versions existed have none in their create event
+	version := string(create.RoomVersion)
+	if version == "" {
+		version = "1"
+	}
+	if err := db.SaveRoomVersion(ctx, &RoomVersion{RoomID: roomID, RoomVersion: version}); err != nil {
+		log.Printf("Warning: Could not record the version of room %s: %v", roomID, err)
+	}
+	return version
+}
+
+// VerifyMessages checks archived messages against the homeserver and records
+// the result of each, for the events given or, without any, the last limit
+// messages of the room. See VerifyEventJSON for what is checked.
+func VerifyMessages(roomID string, eventIDs []string, limit int) error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	ctx := context.Background()
+	db := GetDatabase()
+	var messages []*Message
+	if len(eventIDs) > 0 {
+		for _, eventID := range eventIDs {
+			msg, err := db.GetMessage(ctx, eventID)
+			if err != nil {
+				return err
+			}
+			messages = append(messages, msg)
+		}
+	} else {
+		var err error
+		if roomID, err = resolveExportRoom(roomID); err != nil {
+			return err
+		}
+		if messages, err = db.GetMessages(ctx, &MessageFilter{RoomID: roomID}, 0, 0); err != nil {
+			return fmt.Errorf("failed to query messages: %w", err)
+		}
+		if limit > 0 && len(messages) > limit {
+			messages = messages[len(messages)-limit:]
+		}
+	}
+	if len(messages) == 0 {
+		return fmt.Errorf("no archived messages to verify")
+	}
+
+	client, err := GetMatrixClient()
+	if err != nil {
+		return err
+	}
+	fed := federation.NewClient("", nil, nil)
+	keys := newSigningKeys()
+	roomVersions := make(map[string]string)
+
+	counts := make(map[string]int)
+	var results []*EventVerification
+	for _, msg := range messages {
+		version, ok := roomVersions[msg.RoomID]
+		if !ok {
+			version = verificationRoomVersion(ctx, client, msg.RoomID)
+			roomVersions[msg.RoomID] = version
+		}
+
+		var result *EventVerification
+		raw, source, err := fetchSignedEvent(ctx, client, fed, msg)
+		if err != nil {
+			result = &EventVerification{EventID: msg.EventID, RoomID: msg.RoomID, CheckedAt: time.Now().UTC(),
+				Status: VerificationUnavailable, Detail: err.Error()}
+		} else {
+			result = VerifyEventJSON(raw, msg, version, keys.get)
+			result.Source = source
+		}
+		if err := db.SaveEventVerification(ctx, result); err != nil {
+			return err
+		}
+		counts[result.Status]++
+		results = append(results, result)
+	}
+
+	if jsonOutput() {
+		return writeJSON(results)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "EVENT\tSTATUS\tSOURCE\tDETAIL")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.EventID, r.Status, r.Source, r.Detail)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("\n%d verified, %d unsigned, %d mismatched, %d invalid, %d unavailable\n", counts[VerificationVerified],
+		counts[VerificationUnsigned], counts[VerificationMismatch], counts[VerificationInvalid], counts[VerificationUnavailable])
+	return nil
+}
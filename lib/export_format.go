@@ -0,0 +1,241 @@
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ExportFormatVersion is the layout version written to JSON and YAML exports
+// as format_version. It is bumped whenever a change could break a consumer
+// (a removed, renamed or retyped field); adding an optional field doesn't
+// change it. Exports written by older versions of the tool can be brought up
+// to date with UpgradeExport.
+//
+// Version 1 exports have no format_version: they are a bare array of
+// messages, or an object holding participants and messages.
+const ExportFormatVersion = 2
+
+// exportDocument is the JSON/YAML layout of an export
+type exportDocument struct {
+	FormatVersion int             `json:"format_version" yaml:"format_version"`
+	Room          *ExportRoom     `json:"room,omitempty" yaml:"room,omitempty"`
+	Participants  []Participant   `json:"participants,omitempty" yaml:"participants,omitempty"`
+	Messages      []ExportMessage `json:"messages" yaml:"messages"`
+}
+
+// encodeExportDocument writes document as JSON or YAML
+func encodeExportDocument(w io.Writer, ext string, document exportDocument) error {
+	if document.Messages == nil {
+		document.Messages = []ExportMessage{}
+	}
+	switch ext {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(document)
+	case "yaml":
+		encoder := yaml.NewEncoder(w)
+		defer encoder.Close()
+		return encoder.Encode(document)
+	}
+	return fmt.Errorf("unsupported format: %s", ext)
+}
+
+// exportMigrations[i] upgrades a decoded export from format version i+1 to
+// i+2, in place. A new format version adds its step here.
+var exportMigrations = []func(document map[string]interface{}) error{
+	migrateExportV1,
+}
+
+// ExportFormatVersionOf returns the format version of a decoded JSON or
+// YAML export
+func ExportFormatVersionOf(document interface{}) (int, error) {
+	switch document := document.(type) {
+	case []interface{}:
+		return 1, nil
+	case map[string]interface{}:
+		version, ok := document["format_version"]
+		if !ok {
+			if _, ok := document["messages"]; ok {
+				return 1, nil
+			}
+			return 0, fmt.Errorf("not an export: no messages or format_version")
+		}
+		n, err := json.Number(fmt.Sprint(version)).Int64()
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("invalid format_version %v", version)
+		}
+		return int(n), nil
+	}
+	return 0, fmt.Errorf("not an export: expected an object or an array of messages")
+}
+
+// UpgradeExportDocument migrates a decoded export to ExportFormatVersion and
+// returns it with the version it started at
+func UpgradeExportDocument(document interface{}) (map[string]interface{}, int, error) {
+	version, err := ExportFormatVersionOf(document)
+	if err != nil {
+		return nil, 0, err
+	}
+	if version > ExportFormatVersion {
+		return nil, version, fmt.Errorf("export format version %d is newer than this tool supports (%d); upgrade matrix-archive", version, ExportFormatVersion)
+	}
+
+	upgraded, ok := document.(map[string]interface{})
+	if !ok {
+		upgraded = map[string]interface{}{"messages": document}
+	}
+	for v := version; v < ExportFormatVersion; v++ {
+		if err := exportMigrations[v-1](upgraded); err != nil {
+			return nil, version, fmt.Errorf("failed to upgrade from format version %d: %w", v, err)
+		}
+		upgraded["format_version"] = v + 1
+	}
+	return upgraded, version, nil
+}
+
+// migrateExportV1 adds format_version and fills in message fields that
+// version 1 exports could leave out: message_type (from content.msgtype),
+// user_id (from a Matrix ID sender), and millisecond timestamps, which are
+// converted to RFC 3339
+func migrateExportV1(document map[string]interface{}) error {
+	messages, ok := document["messages"].([]interface{})
+	if !ok {
+		if document["messages"] != nil {
+			return fmt.Errorf("messages is not a list")
+		}
+		messages = []interface{}{}
+	}
+	for i, item := range messages {
+		message, ok := item.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("message %d is not an object", i)
+		}
+		content, _ := message["content"].(map[string]interface{})
+		if content == nil {
+			content = map[string]interface{}{}
+			message["content"] = content
+		}
+		if _, ok := message["message_type"]; !ok {
+			msgtype, _ := content["msgtype"].(string)
+			message["message_type"] = msgtype
+		}
+		sender, _ := message["sender"].(string)
+		if _, ok := message["user_id"]; !ok {
+			if strings.HasPrefix(sender, "@") {
+				message["user_id"] = sender
+			} else {
+				message["user_id"] = ""
+			}
+		}
+		for _, field := range []string{"sender", "display_name", "event_id"} {
+			if _, ok := message[field]; !ok {
+				message[field] = ""
+			}
+		}
+		switch timestamp := message["timestamp"].(type) {
+		case nil:
+			message["timestamp"] = ""
+		case json.Number, float64, int, int64:
+			ms, err := json.Number(fmt.Sprint(timestamp)).Int64()
+			if err != nil {
+				return fmt.Errorf("message %d: invalid timestamp %v", i, timestamp)
+			}
+			message["timestamp"] = time.UnixMilli(ms).UTC().Format(time.RFC3339)
+		}
+	}
+	document["messages"] = messages
+	return nil
+}
+
+// UpgradeExport migrates a JSON or YAML export written by an older version of
+// the tool to the current format and writes it to outputPath. When outputPath
+// is empty the file is rewritten in place and the original kept with a .bak
+// suffix. It returns the version the file started at; a file that is already
+// current is left alone.
+func UpgradeExport(path, outputPath string) (int, error) {
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	if ext == "yml" {
+		ext = "yaml"
+	}
+	if ext != "json" && ext != "yaml" {
+		return 0, fmt.Errorf("%s: only JSON and YAML exports have a format version", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	document, err := decodeExport(data, ext)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	upgraded, version, err := UpgradeExportDocument(document)
+	if err != nil {
+		return version, fmt.Errorf("%s: %w", path, err)
+	}
+	if version == ExportFormatVersion && outputPath == "" {
+		return version, nil
+	}
+
+	encoded, err := json.Marshal(upgraded)
+	if err != nil {
+		return version, err
+	}
+	check, err := decodeJSONValue(encoded)
+	if err != nil {
+		return version, err
+	}
+	if problems := ValidateExport(ExportSchema(), check); len(problems) > 0 {
+		return version, fmt.Errorf("%s: upgraded export doesn't match the schema: %w", path, problems[0])
+	}
+	var result exportDocument
+	if err := json.Unmarshal(encoded, &result); err != nil {
+		return version, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if outputPath == "" {
+		outputPath = path
+		if err := os.WriteFile(path+".bak", data, 0644); err != nil {
+			return version, fmt.Errorf("failed to back up %s: %w", path, err)
+		}
+	}
+	outExt := strings.TrimPrefix(strings.ToLower(filepath.Ext(outputPath)), ".")
+	if outExt == "yml" {
+		outExt = "yaml"
+	}
+	if outExt != "json" && outExt != "yaml" {
+		outExt = ext
+	}
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return version, fmt.Errorf("failed to create file: %w", err)
+	}
+	defer file.Close()
+	return version, encodeExportDocument(file, outExt, result)
+}
+
+// decodeExport decodes a JSON or YAML export into the generic form that
+// the schema validator and migrations work on
+func decodeExport(data []byte, ext string) (interface{}, error) {
+	if ext == "yaml" {
+		var document interface{}
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return nil, fmt.Errorf("invalid YAML: %w", err)
+		}
+		// Round trip through JSON so values have the types a JSON export has
+		encoded, err := json.Marshal(document)
+		if err != nil {
+			return nil, err
+		}
+		data = encoded
+	}
+	return decodeJSONValue(data)
+}
@@ -0,0 +1,192 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultLazyLoad is the number of messages above which HTML exports load
+// their later sections lazily
+const DefaultLazyLoad = 5000
+
+// LazySection is one part of a lazily loaded HTML export. The first section
+// is rendered in the page; the others are loaded from a fragment script when
+// they are scrolled to, their month is linked to, or their button is clicked.
+type LazySection struct {
+	ID       string          // Element the section's messages are rendered into
+	Month    string          // Anchor of the month the section starts; empty when it continues the previous section's month
+	Label    string          // The section's month, e.g. "January 2024"
+	Count    int             // Number of messages in the section
+	Src      string          // Fragment script, relative to the page; empty for the section rendered in the page
+	Messages []ExportMessage // The messages rendered in the page; nil for sections loaded later
+}
+
+// lazyLoadScript loads the fragment script of a lazy section. Fragments are
+// scripts rather than HTML fetched with XMLHttpRequest so that the export
+// also works when opened from disk.
+const lazyLoadScript = `(function () {
+  function load(section) {
+    if (!section || !section.dataset.src || section.dataset.loading) return;
+    section.dataset.loading = "true";
+    var script = document.createElement("script");
+    script.src = section.dataset.src;
+    document.body.appendChild(script);
+  }
+  window.archiveFragment = function (id, html) {
+    var section = document.getElementById(id);
+    section.innerHTML = html;
+    section.classList.add("loaded");
+  };
+  var sections = document.querySelectorAll(".lazy-section[data-src]");
+  sections.forEach(function (section) {
+    var button = section.querySelector("button");
+    if (button) button.addEventListener("click", function () { load(section); });
+  });
+  if ("IntersectionObserver" in window) {
+    var observer = new IntersectionObserver(function (entries) {
+      entries.forEach(function (entry) {
+        if (entry.isIntersecting) {
+          observer.unobserve(entry.target);
+          load(entry.target);
+        }
+      });
+    }, { rootMargin: "1000px" });
+    sections.forEach(function (section) { observer.observe(section); });
+  }
+  function loadLinkedMonth() {
+    var anchor = location.hash && document.getElementById(location.hash.slice(1));
+    if (anchor && anchor.classList.contains("month-anchor")) load(anchor.nextElementSibling);
+  }
+  window.addEventListener("hashchange", loadLinkedMonth);
+  loadLinkedMonth();
+})();`
+
+// lazyLoads reports whether an HTML export of count messages loads lazily
+func (opts *ExportOptions) lazyLoads(count int) bool {
+	return opts.LazyLoad > 0 && count > opts.LazyLoad
+}
+
+// LazySections splits messages into sections by month, each at most size
+// messages long. Only the first section keeps its messages.
+func LazySections(messages []ExportMessage, size int, fragmentDir string) []LazySection {
+	var sections []LazySection
+	var start int
+	month := ""
+	flush := func(end int, startsMonth bool) {
+		if end == start {
+			return
+		}
+		section := LazySection{ID: fmt.Sprintf("section-%d", len(sections)+1), Count: end - start, Label: monthLabel(month)}
+		if startsMonth {
+			section.Month = "month-" + month
+		}
+		if len(sections) == 0 {
+			section.Messages = messages[start:end]
+		} else {
+			section.Src = fragmentDir + "/" + section.ID + ".js"
+		}
+		sections = append(sections, section)
+		start = end
+	}
+
+	startsMonth := true
+	for i, msg := range messages {
+		msgMonth := messageMonth(msg)
+		switch {
+		case i == 0:
+			month = msgMonth
+		case msgMonth != month:
+			flush(i, startsMonth)
+			month, startsMonth = msgMonth, true
+		case i-start >= size:
+			flush(i, startsMonth)
+			startsMonth = false
+		}
+	}
+	flush(len(messages), startsMonth)
+	return sections
+}
+
+// messageMonth returns the year and month of a message, e.g. "2024-01"
+func messageMonth(msg ExportMessage) string {
+	if t, err := time.Parse(time.RFC3339, msg.Timestamp); err == nil {
+		return t.Format("2006-01")
+	}
+	if len(msg.Timestamp) >= 7 {
+		return msg.Timestamp[:7]
+	}
+	return "unknown"
+}
+
+// monthLabel formats a "2006-01" month for section buttons and the month index
+func monthLabel(month string) string {
+	if t, err := time.Parse("2006-01", month); err == nil {
+		return t.Format("January 2006")
+	}
+	return month
+}
+
+// writeLazyHTML writes an HTML export whose first section is in the page and
+// whose other sections are written as fragment scripts to a directory next to
+// it, named after the page with a _files suffix. Templates without a
+// "messages" block can't render sections and are written as a single page.
+func writeLazyHTML(filename, templatePath string, messages []ExportMessage, opts *ExportOptions) error {
+	fragmentDir := exportFilesDir(filename)
+	sections := LazySections(messages, opts.LazyLoad, filepath.Base(fragmentDir))
+
+	tmpl, err := parseExportTemplate(templatePath, messages, opts, sections)
+	if err != nil {
+		return err
+	}
+	if tmpl.Lookup("messages") == nil {
+		log.Printf("Warning: template %s has no \"messages\" block for lazy loading; writing all %d messages to one page", templatePath, len(messages))
+		sections = nil
+	}
+	if opts.searchIndex != "" {
+		if err := writeSearchIndex(filepath.Join(fragmentDir, searchIndexFile), BuildSearchIndex(messages, "", sections)); err != nil {
+			return err
+		}
+	}
+	if sections == nil {
+		return executeExportTemplate(filename, tmpl)
+	}
+
+	if err := os.MkdirAll(fragmentDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", fragmentDir, err)
+	}
+	var start int
+	for _, section := range sections {
+		end := start + section.Count
+		if section.Src != "" {
+			var buf bytes.Buffer
+			if err := tmpl.ExecuteTemplate(&buf, "messages", messages[start:end]); err != nil {
+				return fmt.Errorf("failed to render %s: %w", section.ID, err)
+			}
+			// JSON string escaping also escapes <, > and &, so the fragment
+			// can't close its script
+			html, _ := json.Marshal(buf.String())
+			script := fmt.Sprintf("archiveFragment(%q, %s);\n", section.ID, html)
+			if err := os.WriteFile(filepath.Join(fragmentDir, section.ID+".js"), []byte(script), 0644); err != nil {
+				return fmt.Errorf("failed to write %s: %w", section.ID, err)
+			}
+		}
+		start = end
+	}
+
+	return executeExportTemplate(filename, tmpl)
+}
+
+// executeExportTemplate renders a parsed export template to filename
+func executeExportTemplate(filename string, tmpl *exportTemplate) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer file.Close()
+	return tmpl.render(file)
+}
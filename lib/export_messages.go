@@ -2,23 +2,22 @@ package archive
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"time"
-
-	"gopkg.in/yaml.v3"
-	"maunium.net/go/mautrix"
-	"maunium.net/go/mautrix/event"
-	"maunium.net/go/mautrix/id"
 )
 
-var supportedFormats = []string{"txt", "html", "json", "yaml"}
+// senderLocalpartPattern extracts the localpart of a user ID (@username:server.com -> username)
+var senderLocalpartPattern = regexp.MustCompile(`@(.+):.+`)
 
 // ExportMessage represents a message for export with rich metadata
 type ExportMessage struct {
@@ -31,22 +30,83 @@ type ExportMessage struct {
 	MessageType string                 `json:"message_type" yaml:"message_type"`
 	
 	// Rich metadata
-	Reactions   []MessageReaction `json:"reactions,omitempty" yaml:"reactions,omitempty"`
-	RepliesTo   *ReplyInfo        `json:"replies_to,omitempty" yaml:"replies_to,omitempty"`
-	IsEdited    bool              `json:"is_edited,omitempty" yaml:"is_edited,omitempty"`
-	EditHistory []EditInfo        `json:"edit_history,omitempty" yaml:"edit_history,omitempty"`
-	ThreadInfo  *ThreadInfo       `json:"thread_info,omitempty" yaml:"thread_info,omitempty"`
-	UserAvatar  string            `json:"user_avatar,omitempty" yaml:"user_avatar,omitempty"`
-	Platform    string            `json:"platform,omitempty" yaml:"platform,omitempty"`
+	Reactions   []MessageReaction  `json:"reactions,omitempty" yaml:"reactions,omitempty"`
+	RepliesTo   *ReplyInfo         `json:"replies_to,omitempty" yaml:"replies_to,omitempty"`
+	IsEdited    bool               `json:"is_edited,omitempty" yaml:"is_edited,omitempty"`
+	EditHistory []EditInfo         `json:"edit_history,omitempty" yaml:"edit_history,omitempty"`
+	ThreadInfo  *ThreadInfo        `json:"thread_info,omitempty" yaml:"thread_info,omitempty"`
+	UserAvatar  string             `json:"user_avatar,omitempty" yaml:"user_avatar,omitempty"`
+	Platform    string             `json:"platform,omitempty" yaml:"platform,omitempty"`
+	// Phone number or username of a bridged sender on their own network,
+	// when exported with platform handles
+	PlatformHandle string `json:"platform_handle,omitempty" yaml:"platform_handle,omitempty"`
+	// Person the sender was merged into with "users merge", when they
+	// appear under several user IDs
+	Person string `json:"person,omitempty" yaml:"person,omitempty"`
+	Annotations []ExportAnnotation `json:"annotations,omitempty" yaml:"annotations,omitempty"`
+	Permalink   string             `json:"permalink,omitempty" yaml:"permalink,omitempty"`
+	AvatarURL   string             `json:"avatar_url,omitempty" yaml:"avatar_url,omitempty"`
+
+	// Original author and platform of forwarded or relayed content
+	ForwardedFrom     string `json:"forwarded_from,omitempty" yaml:"forwarded_from,omitempty"`
+	ForwardedPlatform string `json:"forwarded_platform,omitempty" yaml:"forwarded_platform,omitempty"`
+
+	// Set when DisplayName and Platform are those of the real author of a
+	// message a bot or webhook relayed, and UserID is the relay's
+	Relayed bool `json:"relayed,omitempty" yaml:"relayed,omitempty"`
+
+	// Name, type and size of an m.file attachment
+	File *FileMetadata `json:"file,omitempty" yaml:"file,omitempty"`
+
+	// ISO 639-1 code of the message's language, when detected at import
+	Lang string `json:"lang,omitempty" yaml:"lang,omitempty"`
+
+	// The downloaded file of an audio or video message, when exported with
+	// inline players
+	Player *MediaPlayer `json:"player,omitempty" yaml:"player,omitempty"`
+
+	// Set when the content was too large to archive whole
+	Truncated *ContentTruncation `json:"truncated,omitempty" yaml:"truncated,omitempty"`
+
+	// Set on the first message from a room's replacement when an export
+	// follows a room through its upgrades
+	RoomUpgrade *RoomUpgradeInfo `json:"room_upgrade,omitempty" yaml:"room_upgrade,omitempty"`
+
+	// Result of checking the message against its homeserver's signed copy,
+	// when exported with verifications
+	Verification *EventVerification `json:"verification,omitempty" yaml:"verification,omitempty"`
+
+	// Set in sample exports, which can span rooms
+	RoomID string `json:"room_id,omitempty" yaml:"room_id,omitempty"`
+
+	// Set when an export is split into conversations: the conversation the
+	// message belongs to, and whether it starts it
+	ConversationID    int  `json:"conversation_id,omitempty" yaml:"conversation_id,omitempty"`
+	ConversationStart bool `json:"conversation_start,omitempty" yaml:"conversation_start,omitempty"`
+
+	// Set in highlights exports: why the message was selected, and whether
+	// messages were skipped between it and the previous one
+	Highlights   []string `json:"highlights,omitempty" yaml:"highlights,omitempty"`
+	ContextBreak bool     `json:"context_break,omitempty" yaml:"context_break,omitempty"`
+}
+
+// RoomUpgradeInfo marks where an export continues in the room that replaced
+// the previous one
+type RoomUpgradeInfo struct {
+	RoomID         string `json:"room_id" yaml:"room_id"`
+	RoomVersion    string `json:"room_version,omitempty" yaml:"room_version,omitempty"`
+	PreviousRoomID string `json:"previous_room_id" yaml:"previous_room_id"`
 }
 
 // MessageReaction represents a reaction to a message
 type MessageReaction struct {
-	Emoji     string    `json:"emoji"`
+	Emoji     string    `json:"emoji"` // The reaction key: an emoji, text, or a custom emoji's mxc URL
 	Users     []string  `json:"users"`
 	Count     int       `json:"count"`
 	EventID   string    `json:"event_id"`
 	Timestamp time.Time `json:"timestamp"`
+	Shortcode string    `json:"shortcode,omitempty"` // A custom emoji's shortcode, without colons
+	Image     string    `json:"image,omitempty"`     // A custom emoji's image, linked as the export's media links are
 }
 
 // ReplyInfo represents reply relationship information
@@ -73,52 +133,157 @@ type ThreadInfo struct {
 	IsRoot      bool   `json:"is_root"`
 }
 
+// ExportOptions controls how messages are rendered by ExportMessagesWithOptions
+type ExportOptions struct {
+	RoomID          string   // Room to export; empty selects the first archived room
+	LocalImages     bool     // Use local image paths instead of Matrix URLs, unless MediaLinks is set
+	MediaLinks      string   // What media URLs link to: local, download, s3 or data (see MediaLinkResolver)
+	MediaBaseURL    string   // Where the media directories are published, for s3 media links
+	InlinePlayers   bool     // Play downloaded audio and video in HTML exports instead of linking to it (embedded whole with data media links)
+	Lang            string   // Language of template strings (see templates/locales)
+	Template        string   // Template name (e.g. "accessible") or path; empty selects the default
+	HighContrast    bool     // Render templates that support it with a high-contrast palette
+	Theme           string   // HTML color theme: light, dark or auto (follows the reader's system setting)
+	CSSPath         string   // Stylesheet appended to the HTML template's built-in styles
+	Format          string   // Overrides the format implied by the file extension (e.g. "api")
+	PageSize        int      // Messages per page file for the static API format
+	Annotations     bool     // Include curator notes (footnotes in HTML, a field in JSON/YAML)
+	Verifications   bool     // Include the results of "verify" for each message (a field in JSON/YAML)
+	PlatformHandles bool     // Name bridged senders by the handle their bridge reported, with their platform, instead of their Matrix ID's localpart
+	Permalinks      bool     // Link each message to the live event in a Matrix client
+	PermalinkBase   string   // URL prefix for permalinks; empty uses matrix.to
+	Participants    bool     // Add a participants section with each sender's message count and membership dates
+	HistoricalNames bool     // Label messages with the sender's display name at the time, not their current one
+	Formats         []string // Write several formats from one conversion; the filename is then a base name
+	ReportPath      string   // Where to write a JSON completeness report after the export; empty skips it
+	ReactionsPath   string   // Where to write the room's reactions in time order, as .json or .csv; empty skips it
+	Stats           bool     // Write summary statistics of the run to <name>.stats.json next to the export
+	Hooks           Hooks    // Hooks' post_export commands are run after the export is written
+	IfChanged       bool     // Skip writing when messages, template and options are unchanged since the last export
+	Dedupe          bool     // Drop messages with the same normalized content as an earlier one (re-bridged history)
+	MessageLang     string   // Export only messages in this language (ISO 639-1, see DetectLanguage); empty exports all
+	LazyLoad        int      // HTML exports of more messages render the first section and load later months as they're reached; 0 renders one page
+	SearchIndex     bool     // Give HTML exports a search box, searching an index written to their _files directory
+	Zip             bool     // Package the export and the local media it links to into a zip named after the filename
+	ZipPassword     string   // Encrypt the zip's files with AES-256 using this password; empty writes a plain zip
+	Width           int      // Wrap text export lines to this many columns; 0 leaves them as they are
+
+	// Per-room template and theme, from the configuration file's
+	// export_templates; the first rule matching the room replaces Template
+	// and Theme (see ForRoom)
+	RoomTemplates []RoomTemplate
+
+	// Conversation segmentation, for rooms that don't use threads
+	Conversations   bool          // Split messages into conversations by time gaps and replies, shown with separators
+	ConversationGap time.Duration // Silence that starts a new conversation; 0 uses DefaultConversationGap
+	Conversation    int           // Export only this conversation (numbered from 1, implies Conversations); 0 exports all
+
+	// Membership history for participants and historical names, loaded by the export functions
+	memberships []*MembershipEvent
+
+	// The room's tags and direct chat status, if the archive has them
+	room *RoomOrganization
+
+	// The room's name, topic, canonical alias and creation time, if recorded
+	profile *RoomProfile
+
+	// Totals over the room's whole archive, from its daily statistics
+	activity *RoomActivity
+
+	// Search index of the HTML export being written, relative to the page
+	searchIndex string
+}
+
+// HTML export color themes
+const (
+	ThemeLight = "light"
+	ThemeDark  = "dark"
+	ThemeAuto  = "auto"
+)
+
+// supportedThemes lists the values accepted by ExportOptions.Theme
+var supportedThemes = []string{ThemeLight, ThemeDark, ThemeAuto}
+
+// DefaultExportOptions returns the options used when none are given
+func DefaultExportOptions() *ExportOptions {
+	return &ExportOptions{
+		LocalImages:  true,
+		MediaLinks:   os.Getenv("MATRIX_ARCHIVE_MEDIA_LINKS"),
+		MediaBaseURL: os.Getenv("MATRIX_ARCHIVE_MEDIA_BASE_URL"),
+		Lang:         DefaultLanguage,
+		Theme:        ThemeLight,
+		PageSize:     DefaultAPIPageSize,
+		Permalinks:   true,
+		LazyLoad:     DefaultLazyLoad,
+		ZipPassword:  os.Getenv(ZipPasswordEnv),
+	}
+}
+
 // exportMessages exports messages to a file in various formats
 func ExportMessages(filename, roomID string, localImages bool) error {
+	opts := DefaultExportOptions()
+	opts.RoomID = roomID
+	opts.LocalImages = localImages
+	return ExportMessagesWithOptions(filename, opts)
+}
+
+// ExportMessagesWithOptions exports messages to a file using the given options
+func ExportMessagesWithOptions(filename string, opts *ExportOptions) error {
+	if opts == nil {
+		opts = DefaultExportOptions()
+	}
+	roomID := opts.RoomID
+	start := time.Now()
+
+	// The static API format writes a directory rather than a single file
+	if opts.Format == FormatStaticAPI {
+		if err := ExportStaticAPI(filename, opts); err != nil {
+			return err
+		}
+		return opts.Hooks.Run(&HookEvent{Hook: HookPostExport, Outputs: []string{filename}})
+	}
+
+	mediaLinks, err := opts.mediaLinkResolver()
+	if err != nil {
+		return err
+	}
+
 	// Initialize database connection with DuckDB
 	if err := InitDuckDB(); err != nil {
 		return fmt.Errorf("failed to initialize database: %w", err)
 	}
 	defer CloseDatabase()
 
-	// Determine format from file extension
-	ext := strings.TrimPrefix(filepath.Ext(filename), ".")
-	if ext == "" {
-		ext = "html"
+	// A zipped export is rendered as if to the filename without .zip
+	var zipPath string
+	if opts.Zip {
+		zipPath, filename = zipExportPaths(filename)
 	}
 
-	if !IsValidFormat(ext) {
-		return fmt.Errorf("unsupported format %s, supported formats: %v", ext, supportedFormats)
-	}
-
-	// Determine room ID
-	if roomID == "" {
-		// Get all rooms from database
-		db := GetDatabase()
-		rooms, err := db.GetRooms(context.Background())
-		if err != nil {
-			return fmt.Errorf("failed to get rooms from database: %w", err)
+	var ext string
+	if len(opts.Formats) > 0 {
+		if err := validateExportFormats(opts); err != nil {
+			return err
 		}
-		if len(rooms) == 0 {
-			return fmt.Errorf("no rooms found in database")
-		}
-		roomID = rooms[0]
-		fmt.Printf("No room ID specified, using first room found: %s\n", roomID)
-	} else if !strings.HasPrefix(roomID, "!") {
-		// If roomID doesn't look like a room ID, try to find it by name
-		foundRoomID, err := findRoomByName(roomID)
-		if err != nil {
-			return fmt.Errorf("failed to find room by name: %w", err)
+	} else if ext, err = exportFormat(filename, opts); err != nil {
+		return err
+	}
+	if opts.ReactionsPath != "" {
+		if _, err := reactionTimelineFormat(opts.ReactionsPath); err != nil {
+			return err
 		}
-		roomID = foundRoomID
 	}
 
-	// Query messages from DuckDB
-	filter := &MessageFilter{
-		RoomID: roomID,
+	roomID, err = resolveExportRoom(roomID)
+	if err != nil {
+		return err
+	}
+	if opts, err = roomExportOptions(context.Background(), roomID, opts); err != nil {
+		return err
 	}
 
-	messages, err := GetDatabase().GetMessages(context.Background(), filter, 0, 0)
+	// Query messages from DuckDB, following the room through its upgrades
+	messages, chain, err := getRoomChainMessages(context.Background(), GetDatabase(), roomID)
 	if err != nil {
 		return fmt.Errorf("failed to query messages: %w", err)
 	}
@@ -135,53 +300,361 @@ func ExportMessages(filename, roomID string, localImages bool) error {
 		}
 
 		// Query again after import
-		messages, err = GetDatabase().GetMessages(context.Background(), filter, 0, 0)
+		messages, chain, err = getRoomChainMessages(context.Background(), GetDatabase(), roomID)
 		if err != nil {
 			return fmt.Errorf("failed to query messages after import: %w", err)
 		}
 	}
 
-	fmt.Printf("Writing %d messages to %q\n", len(messages), filename)
+	if opts.Dedupe {
+		deduped := DedupeMessages(messages)
+		if dropped := len(messages) - len(deduped); dropped > 0 {
+			fmt.Printf("Dropped %d duplicate messages\n", dropped)
+		}
+		messages = deduped
+	}
+	if opts.MessageLang != "" {
+		messages = FilterMessagesByLanguage(messages, opts.MessageLang)
+	}
+
+	archived := messages
+	messages, withheld, err := withholdOptedOut(context.Background(), messages)
+	if err != nil {
+		return err
+	}
+
+	var chainRoomIDs []string
+	for _, room := range chain {
+		if room.RoomID != roomID {
+			chainRoomIDs = append(chainRoomIDs, room.RoomID)
+		}
+	}
+	if err := loadMemberships(context.Background(), roomID, opts); err != nil {
+		return err
+	}
+	if opts.room, err = GetRoomOrganization(context.Background(), GetDatabase(), roomID); err != nil {
+		return err
+	}
+	if err := loadRoomProfile(context.Background(), roomID, opts); err != nil {
+		return err
+	}
+	if err := loadRoomActivity(context.Background(), roomID, opts); err != nil {
+		return err
+	}
+
+	formats, outputs := []string{ext}, []string{filename}
+	if len(opts.Formats) > 0 {
+		formats, outputs = opts.Formats, nil
+		for _, format := range opts.Formats {
+			outputs = append(outputs, exportFileName(exportBaseName(filename), format))
+		}
+	}
+	target := exportTarget(filename)
+	if opts.Zip {
+		outputs, target = []string{zipPath}, exportTarget(zipPath)
+	}
+
+	switch {
+	case opts.Zip:
+		fmt.Printf("Writing %d messages to %q\n", len(messages), zipPath)
+	case len(opts.Formats) > 0:
+		fmt.Printf("Writing %d messages to %q as %s\n", len(messages), exportBaseName(filename), strings.Join(opts.Formats, ", "))
+	default:
+		fmt.Printf("Writing %d messages to %q\n", len(messages), filename)
+	}
+
+	// Check the inputs before converting messages, which fetches display names
+	var inputHash string
+	if opts.IfChanged {
+		state, err := loadExportArchiveState(context.Background(), chain, append([]string{roomID}, chainRoomIDs...), opts)
+		if err != nil {
+			return err
+		}
+		if inputHash, err = exportInputHash(messages, formats, opts, state); err != nil {
+			return err
+		}
+		upToDate, err := exportUpToDate(context.Background(), target, inputHash, outputs)
+		if err != nil {
+			return err
+		}
+		if upToDate {
+			fmt.Printf("Nothing changed since the last export to %q, skipping\n", filename)
+			if !opts.Stats {
+				return nil
+			}
+			exported, err := skippedExportMessages(messages, mediaLinks, opts)
+			if err != nil {
+				return err
+			}
+			stats := BuildExportStats(roomID, exported, exportMediaDirs)
+			stats.Skipped, stats.Withheld = true, withheld
+			stats.finish(outputs, start)
+			return writeExportStats(filename, stats)
+		}
+	}
 
 	// Convert messages to export format with enhanced user information
-	exportMessages, err := convertToExportMessages(messages, roomID, localImages)
+	exportMessages, err := convertToExportMessages(messages, roomID, mediaLinks)
 	if err != nil {
 		return fmt.Errorf("failed to convert messages: %w", err)
 	}
 
-	// Export based on format
-	file, err := os.Create(filename)
-	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+	if len(chain) > 1 {
+		roomOf := make(map[string]string, len(messages))
+		for _, msg := range messages {
+			roomOf[msg.EventID] = msg.RoomID
+		}
+		MarkRoomUpgrades(exportMessages, roomOf, chain)
+	}
+
+	if opts.Annotations {
+		if err := attachRoomAnnotations(context.Background(), roomID, exportMessages, chainRoomIDs...); err != nil {
+			return err
+		}
+	}
+
+	if opts.Verifications {
+		if err := attachRoomVerifications(context.Background(), exportMessages, append([]string{roomID}, chainRoomIDs...)...); err != nil {
+			return err
+		}
 	}
-	defer file.Close()
 
-	switch ext {
-	case "json":
-		encoder := json.NewEncoder(file)
-		encoder.SetIndent("", "  ")
-		return encoder.Encode(exportMessages)
+	if opts.PlatformHandles {
+		if err := attachPlatformHandles(context.Background(), exportMessages, append([]string{roomID}, chainRoomIDs...)...); err != nil {
+			return err
+		}
+	}
+
+	if err := attachPersons(context.Background(), exportMessages); err != nil {
+		return err
+	}
+
+	if err := attachEmotes(context.Background(), exportMessages, mediaLinks); err != nil {
+		return err
+	}
 
-	case "yaml":
-		encoder := yaml.NewEncoder(file)
-		defer encoder.Close()
-		return encoder.Encode(exportMessages)
+	if opts.InlinePlayers {
+		AttachMediaPlayers(exportMessages, messages, mediaLinks)
+	}
 
-	case "html":
-		templatePath := "templates/default.html.tpl"
-		return ExportWithTemplate(file, templatePath, exportMessages)
+	if opts.Permalinks {
+		AttachPermalinks(exportMessages, roomID, opts.PermalinkBase)
+	}
 
-	case "txt":
-		templatePath := "templates/default.txt.tpl"
-		return ExportWithTemplate(file, templatePath, exportMessages)
+	if opts.HistoricalNames {
+		ApplyHistoricalNames(exportMessages, opts.memberships)
+	}
+	if opts.Conversations || opts.Conversation > 0 {
+		gap := opts.ConversationGap
+		if gap <= 0 {
+			gap = DefaultConversationGap
+		}
+		SegmentConversations(exportMessages, gap)
+		if opts.Conversation > 0 {
+			if exportMessages, err = FilterConversation(exportMessages, opts.Conversation); err != nil {
+				return err
+			}
+		}
+	}
 
+	switch {
+	case opts.Zip:
+		err = writeZipExport(zipPath, exportBaseName(filename), formats, exportMessages, opts)
+	case len(opts.Formats) > 0:
+		err = WriteExportFiles(exportBaseName(filename), opts.Formats, exportMessages, opts)
 	default:
-		return fmt.Errorf("unsupported format: %s", ext)
+		err = writeExportFile(filename, ext, exportMessages, opts)
+	}
+	if err != nil {
+		return err
+	}
+	// Without --if-changed the hash is cleared, since the files written may
+	// no longer match the inputs it was computed from
+	if err := GetDatabase().SaveExportHash(context.Background(), target, inputHash); err != nil {
+		return err
+	}
+	if opts.ReactionsPath != "" {
+		if err := WriteReactionTimeline(opts.ReactionsPath, BuildReactionTimeline(messages)); err != nil {
+			return err
+		}
+	}
+	if opts.ReportPath != "" {
+		if err := writeCompletenessReport(context.Background(), opts.ReportPath, roomID, archived, withheld); err != nil {
+			return err
+		}
 	}
+	if !opts.Stats && len(opts.Hooks.PostExport) == 0 {
+		return nil
+	}
+	stats := BuildExportStats(roomID, exportedMessages(messages, exportMessages), exportMediaDirs)
+	stats.Withheld = withheld
+	stats.finish(outputs, start)
+	if opts.Stats {
+		if err := writeExportStats(filename, stats); err != nil {
+			return err
+		}
+	}
+	return opts.Hooks.Run(&HookEvent{Hook: HookPostExport, RoomID: roomID, Outputs: outputs, Stats: stats})
+}
+
+// skippedExportMessages returns the messages an export skipped by --if-changed
+// would have written, for its statistics. Only a --conversation export
+// writes fewer, and those are found without fetching display names.
+func skippedExportMessages(messages []*Message, mediaLinks MediaLinkResolver, opts *ExportOptions) ([]*Message, error) {
+	if opts.Conversation <= 0 {
+		return messages, nil
+	}
+	exportMessages, err := convertToExportMessagesWithBridgeMapping(messages, mediaLinks, nil)
+	if err != nil {
+		return nil, err
+	}
+	gap := opts.ConversationGap
+	if gap <= 0 {
+		gap = DefaultConversationGap
+	}
+	SegmentConversations(exportMessages, gap)
+	if exportMessages, err = FilterConversation(exportMessages, opts.Conversation); err != nil {
+		return nil, err
+	}
+	return exportedMessages(messages, exportMessages), nil
+}
+
+// validateExportFormats checks the formats requested with opts.Formats
+func validateExportFormats(opts *ExportOptions) error {
+	for _, format := range opts.Formats {
+		if !IsValidFormat(format) {
+			return unsupportedFormatError(format)
+		}
+	}
+	if opts.Theme != "" && !IsValidTheme(opts.Theme) {
+		return fmt.Errorf("unsupported theme %s, supported themes: %v", opts.Theme, supportedThemes)
+	}
+	_, err := opts.mediaLinkResolver()
+	return err
+}
+
+// exportBaseName strips a format extension from a multi-format export's
+// filename, so "archive.html" and "archive" both write archive.<format>
+func exportBaseName(filename string) string {
+	if ext := strings.TrimPrefix(filepath.Ext(filename), "."); exporterForExtension(ext) != nil {
+		return strings.TrimSuffix(filename, "."+ext)
+	}
+	return filename
+}
+
+// WriteExportFiles writes the same converted messages to base.<format> for
+// each format concurrently
+func WriteExportFiles(base string, formats []string, exportMessages []ExportMessage, opts *ExportOptions) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(formats))
+	for i, format := range formats {
+		wg.Add(1)
+		go func(i int, format string) {
+			defer wg.Done()
+			filename := exportFileName(base, format)
+			if err := writeExportFile(filename, format, exportMessages, opts); err != nil {
+				errs[i] = fmt.Errorf("failed to write %s: %w", filename, err)
+			}
+		}(i, format)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// exportFormat determines the output format from the file extension, or from
+// opts.Format when set, and validates the theme
+func exportFormat(filename string, opts *ExportOptions) (string, error) {
+	format := opts.Format
+	if format == "" {
+		ext := strings.TrimPrefix(filepath.Ext(filename), ".")
+		if ext == "" {
+			format = "html"
+		} else if e := exporterForExtension(ext); e != nil {
+			format = e.Name()
+		} else {
+			return "", unsupportedFormatError(ext)
+		}
+	}
+
+	if !IsValidFormat(format) {
+		return "", unsupportedFormatError(format)
+	}
+
+	if opts.Theme != "" && !IsValidTheme(opts.Theme) {
+		return "", fmt.Errorf("unsupported theme %s, supported themes: %v", opts.Theme, supportedThemes)
+	}
+
+	return format, nil
+}
+
+// resolveExportRoom turns the room given to an export into a room ID. An empty
+// room selects the first archived room; anything that isn't a room ID is looked
+// up by display name.
+func resolveExportRoom(roomID string) (string, error) {
+	if roomID == "" {
+		// Get all rooms from database
+		db := GetDatabase()
+		rooms, err := db.GetRooms(context.Background())
+		if err != nil {
+			return "", fmt.Errorf("failed to get rooms from database: %w", err)
+		}
+		if len(rooms) == 0 {
+			return "", fmt.Errorf("no rooms found in database")
+		}
+		fmt.Printf("No room ID specified, using first room found: %s\n", rooms[0])
+		return rooms[0], nil
+	}
+
+	if !strings.HasPrefix(roomID, "!") {
+		// If roomID doesn't look like a room ID, try to find it by name
+		foundRoomID, err := findRoomByName(roomID)
+		if err != nil {
+			return "", fmt.Errorf("failed to find room by name: %w", err)
+		}
+		return foundRoomID, nil
+	}
+
+	return roomID, nil
+}
+
+// writeExportFile writes exported messages to filename with the exporter
+// registered for format
+func writeExportFile(filename, format string, exportMessages []ExportMessage, opts *ExportOptions) error {
+	if format == "html" && opts.SearchIndex {
+		// Formats can be written concurrently, so the page's index goes in a copy
+		htmlOpts := *opts
+		htmlOpts.searchIndex = filepath.Base(exportFilesDir(filename)) + "/" + searchIndexFile
+		opts = &htmlOpts
+	}
+
+	// Lazy HTML writes fragment files next to the page, so it can't go
+	// through a single writer
+	if format == "html" && opts.lazyLoads(len(exportMessages)) {
+		return writeLazyHTML(filename, ResolveTemplatePath(opts.Template, format), exportMessages, opts)
+	}
+	if opts.searchIndex != "" {
+		index := BuildSearchIndex(exportMessages, "", nil)
+		if err := writeSearchIndex(filepath.Join(exportFilesDir(filename), searchIndexFile), index); err != nil {
+			return err
+		}
+	}
+
+	exporter := LookupExporter(format)
+	if exporter == nil {
+		return unsupportedFormatError(format)
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer file.Close()
+
+	return exporter.Export(context.Background(), file, slices.Values(exportMessages), opts)
 }
 
 // convertToExportMessages converts messages to export format with enhanced user information
-func convertToExportMessages(messages []*Message, roomID string, localImages bool) ([]ExportMessage, error) {
+func convertToExportMessages(messages []*Message, roomID string, mediaLinks MediaLinkResolver) ([]ExportMessage, error) {
 	if len(messages) == 0 {
 		return []ExportMessage{}, nil
 	}
@@ -194,17 +667,33 @@ func convertToExportMessages(messages []*Message, roomID string, localImages boo
 	if err != nil {
 		log.Printf("Warning: Could not get Matrix client for user info: %v", err)
 		// Fall back to basic conversion without display names
-		return convertToExportMessagesWithBridgeMapping(messages, localImages, bridgeUserMap)
+		exportMessages, err := convertToExportMessagesWithBridgeMapping(messages, mediaLinks, bridgeUserMap)
+		if err != nil {
+			return nil, err
+		}
+		ApplyAggregations(exportMessages, messages)
+		return exportMessages, nil
 	}
 
-	// Create a cache for user display names to avoid repeated API calls
-	userDisplayNameCache := make(map[string]string)
+	// Resolve every sender's display name up front: cached users first, then one
+	// member list fetch for the room, then concurrent lookups for the rest
+	senders := make([]string, len(messages))
+	for i, msg := range messages {
+		senders[i] = msg.Sender
+	}
+	displayNames := ResolveDisplayNames(context.Background(), &matrixUserFetcher{client: client}, roomID, senders)
 	
 	exportMessages := make([]ExportMessage, len(messages))
 	
 	for i, msg := range messages {
 		// Get display name for the user - try bridge mapping first
-		displayName := getUserDisplayName(client, roomID, msg.Sender, userDisplayNameCache)
+		displayName, ok := displayNames[msg.Sender]
+		if !ok {
+			displayName = msg.Sender
+			if matches := senderLocalpartPattern.FindStringSubmatch(msg.Sender); len(matches) > 1 {
+				displayName = matches[1]
+			}
+		}
 		
 		// If we have a real username from bridge mapping, use that instead
 		if realUsername, exists := bridgeUserMap[msg.Sender]; exists {
@@ -212,9 +701,8 @@ func convertToExportMessages(messages []*Message, roomID string, localImages boo
 		}
 		
 		// Extract username from sender (@username:server.com -> username)
-		senderRegex := regexp.MustCompile(`@(.+):.+`)
 		username := msg.Sender
-		if matches := senderRegex.FindStringSubmatch(msg.Sender); len(matches) > 1 {
+		if matches := senderLocalpartPattern.FindStringSubmatch(msg.Sender); len(matches) > 1 {
 			username = matches[1]
 		}
 
@@ -226,18 +714,8 @@ func convertToExportMessages(messages []*Message, roomID string, localImages boo
 		// Convert timestamp to ISO format
 		timestamp := msg.Timestamp.Format(time.RFC3339)
 
-		// Process content
-		content := make(map[string]interface{})
-		for k, v := range msg.Content {
-			content[k] = v
-		}
-
-		// Handle image URLs
-		if localImages {
-			content = convertToLocalImages(content)
-		} else {
-			content = convertToDownloadURLs(content)
-		}
+		// Process content, pointing media URLs where the export wants them
+		content := RewriteMediaLinks(msg.Content, mediaLinks)
 
 		exportMessages[i] = ExportMessage{
 			Sender:      username,
@@ -248,7 +726,13 @@ func convertToExportMessages(messages []*Message, roomID string, localImages boo
 			EventID:     msg.EventID,
 			MessageType: msg.MessageType,
 		}
+		exportMessages[i].ForwardedFrom, exportMessages[i].ForwardedPlatform = msg.Forwarding()
+		exportMessages[i].File = msg.File()
+		exportMessages[i].Lang = msg.Lang
+		exportMessages[i].Truncated = contentTruncation(msg.Content)
+		msg.attributeExport(&exportMessages[i])
 	}
+	ApplyAggregations(exportMessages, messages)
 
 	return exportMessages, nil
 }
@@ -653,14 +1137,13 @@ func max(a, b int) int {
 }
 
 // convertToExportMessagesWithBridgeMapping converts messages with bridge user mapping fallback
-func convertToExportMessagesWithBridgeMapping(messages []*Message, localImages bool, bridgeUserMap map[string]string) ([]ExportMessage, error) {
+func convertToExportMessagesWithBridgeMapping(messages []*Message, mediaLinks MediaLinkResolver, bridgeUserMap map[string]string) ([]ExportMessage, error) {
 	exportMessages := make([]ExportMessage, len(messages))
 	
 	for i, msg := range messages {
 		// Extract username from sender (@username:server.com -> username)
-		senderRegex := regexp.MustCompile(`@(.+):.+`)
 		username := msg.Sender
-		if matches := senderRegex.FindStringSubmatch(msg.Sender); len(matches) > 1 {
+		if matches := senderLocalpartPattern.FindStringSubmatch(msg.Sender); len(matches) > 1 {
 			username = matches[1]
 		}
 
@@ -674,18 +1157,8 @@ func convertToExportMessagesWithBridgeMapping(messages []*Message, localImages b
 		// Convert timestamp to ISO format
 		timestamp := msg.Timestamp.Format(time.RFC3339)
 
-		// Process content
-		content := make(map[string]interface{})
-		for k, v := range msg.Content {
-			content[k] = v
-		}
-
-		// Handle image URLs
-		if localImages {
-			content = convertToLocalImages(content)
-		} else {
-			content = convertToDownloadURLs(content)
-		}
+		// Process content, pointing media URLs where the export wants them
+		content := RewriteMediaLinks(msg.Content, mediaLinks)
 
 		exportMessages[i] = ExportMessage{
 			Sender:      username,
@@ -696,13 +1169,18 @@ func convertToExportMessagesWithBridgeMapping(messages []*Message, localImages b
 			EventID:     msg.EventID,
 			MessageType: msg.MessageType,
 		}
+		exportMessages[i].ForwardedFrom, exportMessages[i].ForwardedPlatform = msg.Forwarding()
+		exportMessages[i].File = msg.File()
+		exportMessages[i].Lang = msg.Lang
+		exportMessages[i].Truncated = contentTruncation(msg.Content)
+		msg.attributeExport(&exportMessages[i])
 	}
 
 	return exportMessages, nil
 }
 
 // convertToExportMessagesBasic converts messages without enhanced user info (fallback)
-func convertToExportMessagesBasic(messages []*Message, localImages bool) ([]ExportMessage, error) {
+func convertToExportMessagesBasic(messages []*Message, mediaLinks MediaLinkResolver) ([]ExportMessage, error) {
 	// Build bridge user mapping even in basic mode to get real usernames
 	bridgeUserMap := buildBridgeUserMapping(messages)
 	
@@ -710,9 +1188,8 @@ func convertToExportMessagesBasic(messages []*Message, localImages bool) ([]Expo
 	
 	for i, msg := range messages {
 		// Extract username from sender (@username:server.com -> username)
-		senderRegex := regexp.MustCompile(`@(.+):.+`)
 		username := msg.Sender
-		if matches := senderRegex.FindStringSubmatch(msg.Sender); len(matches) > 1 {
+		if matches := senderLocalpartPattern.FindStringSubmatch(msg.Sender); len(matches) > 1 {
 			username = matches[1]
 		}
 
@@ -726,18 +1203,8 @@ func convertToExportMessagesBasic(messages []*Message, localImages bool) ([]Expo
 		// Convert timestamp to ISO format
 		timestamp := msg.Timestamp.Format(time.RFC3339)
 
-		// Process content
-		content := make(map[string]interface{})
-		for k, v := range msg.Content {
-			content[k] = v
-		}
-
-		// Handle image URLs
-		if localImages {
-			content = convertToLocalImages(content)
-		} else {
-			content = convertToDownloadURLs(content)
-		}
+		// Process content, pointing media URLs where the export wants them
+		content := RewriteMediaLinks(msg.Content, mediaLinks)
 
 		exportMessages[i] = ExportMessage{
 			Sender:      username,
@@ -748,100 +1215,16 @@ func convertToExportMessagesBasic(messages []*Message, localImages bool) ([]Expo
 			EventID:     msg.EventID,
 			MessageType: msg.MessageType,
 		}
+		exportMessages[i].ForwardedFrom, exportMessages[i].ForwardedPlatform = msg.Forwarding()
+		exportMessages[i].File = msg.File()
+		exportMessages[i].Lang = msg.Lang
+		exportMessages[i].Truncated = contentTruncation(msg.Content)
+		msg.attributeExport(&exportMessages[i])
 	}
 	
 	return exportMessages, nil
 }
 
-// getUserDisplayName gets the display name for a user in a room
-func getUserDisplayName(client *mautrix.Client, roomID, userID string, cache map[string]string) string {
-	// Check cache first
-	if displayName, exists := cache[userID]; exists {
-		return displayName
-	}
-	
-	// Default fallback
-	senderRegex := regexp.MustCompile(`@(.+):.+`)
-	defaultName := userID
-	if matches := senderRegex.FindStringSubmatch(userID); len(matches) > 1 {
-		defaultName = matches[1]
-	}
-	
-	// Try to get user display name from room member state
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	
-	// Query the room member state for this user
-	stateKey := userID
-	var memberEvent event.Event
-	err := client.StateEvent(ctx, id.RoomID(roomID), event.StateMember, stateKey, &memberEvent)
-	if err != nil {
-		log.Printf("Warning: Could not get member info for %s in room %s: %v", userID, roomID, err)
-		cache[userID] = defaultName
-		return defaultName
-	}
-	
-	// Extract display name from member event
-	if memberEvent.Content.Raw != nil {
-		if displayNameRaw, exists := memberEvent.Content.Raw["displayname"]; exists {
-			if displayName, ok := displayNameRaw.(string); ok && displayName != "" {
-				cache[userID] = displayName
-				return displayName
-			}
-		}
-	}
-	
-	// Cache and return the default name
-	cache[userID] = defaultName
-	return defaultName
-}
-
-// convertToDownloadURLs converts mxc URLs to download URLs
-func convertToDownloadURLs(content map[string]interface{}) map[string]interface{} {
-	result := make(map[string]interface{})
-	for k, v := range content {
-		if k == "url" {
-			if urlStr, ok := v.(string); ok {
-				if strings.HasPrefix(urlStr, "mxc://") {
-					if downloadURL, err := GetDownloadURL(urlStr); err == nil {
-						result[k] = downloadURL
-					} else {
-						result[k] = urlStr
-					}
-				} else {
-					result[k] = urlStr
-				}
-			} else {
-				result[k] = v
-			}
-		} else if subMap, ok := v.(map[string]interface{}); ok {
-			result[k] = convertToDownloadURLs(subMap)
-		} else {
-			result[k] = v
-		}
-	}
-	return result
-}
-
-// convertToLocalImages converts image URLs to local file paths
-func convertToLocalImages(content map[string]interface{}) map[string]interface{} {
-	result := make(map[string]interface{})
-	for k, v := range content {
-		if k == "url" && IsImageContent(content) {
-			if urlStr, ok := v.(string); ok {
-				result[k] = convertMXCToLocalPath(urlStr, content)
-			} else {
-				result[k] = v
-			}
-		} else if subMap, ok := v.(map[string]interface{}); ok {
-			result[k] = convertToLocalImages(subMap)
-		} else {
-			result[k] = v
-		}
-	}
-	return result
-}
-
 // isImageContent checks if content represents an image message
 func IsImageContent(content map[string]interface{}) bool {
 	if msgtype, ok := content["msgtype"].(string); ok {
@@ -878,24 +1261,164 @@ func convertMXCToLocalPath(mxcURL string, content map[string]interface{}) string
 			if strings.HasPrefix(thumbURL, "mxc://") {
 				thumbParts := strings.Split(strings.TrimPrefix(thumbURL, "mxc://"), "/")
 				if len(thumbParts) >= 2 {
-					return "thumbnails/" + strings.Join(thumbParts[1:], "/") + ext
+					return localThumbnailPath(strings.Join(thumbParts[1:], "/"), ext)
 				}
 			}
 		}
 	}
 
-	return "thumbnails/" + strings.Join(parts[1:], "/") + ext
+	return localThumbnailPath(strings.Join(parts[1:], "/"), ext)
+}
+
+// localThumbnailPath returns the path of a downloaded thumbnail relative to the
+// export, following the index if ./thumbnails uses the hashed media layout
+func localThumbnailPath(stem, ext string) string {
+	if entry, ok := lookupMediaIndex("thumbnails", stem); ok {
+		return "thumbnails/" + entry.Path
+	}
+	return "thumbnails/" + stem + ext
+}
+
+// ResolveTemplatePath maps a template name to its file for the given format.
+// Names such as "accessible" resolve to templates/<name>.<ext>.tpl; anything
+// that looks like a path is used as-is.
+func ResolveTemplatePath(name, ext string) string {
+	if name == "" {
+		name = "default"
+	}
+	if strings.ContainsRune(name, filepath.Separator) || strings.Contains(name, "/") || strings.HasSuffix(name, ".tpl") {
+		return name
+	}
+	return filepath.Join("templates", name+"."+ext+".tpl")
 }
 
 // exportWithTemplate exports messages using a template
 func ExportWithTemplate(file *os.File, templatePath string, messages []ExportMessage) error {
+	return ExportWithTemplateOptions(file, templatePath, messages, DefaultExportOptions())
+}
+
+// ExportWithTemplateOptions exports messages using a template rendered with the given options
+func ExportWithTemplateOptions(w io.Writer, templatePath string, messages []ExportMessage, opts *ExportOptions) error {
+	if opts == nil {
+		opts = DefaultExportOptions()
+	}
+
+	tmpl, err := parseExportTemplate(templatePath, messages, opts, nil)
+	if err != nil {
+		return err
+	}
+	return tmpl.render(w)
+}
+
+// exportTemplate is a parsed export template with the data it renders
+type exportTemplate struct {
+	*template.Template
+	data interface{} // A *TemplateContext, or the messages for templates that range over them as "."
+}
+
+// render executes the template with its data
+func (t *exportTemplate) render(w io.Writer) error {
+	return t.Execute(w, t.data)
+}
+
+// parseExportTemplate parses an export template with the functions it can
+// call. sections are the parts of a lazily loaded HTML export, or nil.
+func parseExportTemplate(templatePath string, messages []ExportMessage, opts *ExportOptions, sections []LazySection) (*exportTemplate, error) {
 	templateContent, err := os.ReadFile(templatePath)
 	if err != nil {
-		return fmt.Errorf("failed to read template %s: %w", templatePath, err)
+		return nil, fmt.Errorf("failed to read template %s: %w", templatePath, err)
+	}
+
+	catalog, err := LoadCatalog(opts.Lang)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load template strings: %w", err)
 	}
 
-	// Create template with custom functions
-	funcMap := template.FuncMap{
+	theme := opts.Theme
+	if theme == "" {
+		theme = ThemeLight
+	}
+	if !IsValidTheme(theme) {
+		return nil, fmt.Errorf("unsupported theme %s, supported themes: %v", theme, supportedThemes)
+	}
+
+	var customCSS template.CSS
+	if opts.CSSPath != "" {
+		css, err := os.ReadFile(opts.CSSPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read custom CSS %s: %w", opts.CSSPath, err)
+		}
+		customCSS = template.CSS(css)
+	}
+
+	context := newTemplateContext(messages, opts, catalog, theme)
+	tmpl, err := template.New("export").Funcs(exportTemplateFuncs(context, opts, catalog, customCSS, sections)).Parse(string(templateContent))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template: %w", err)
+	}
+	if rangesOverMessages(tmpl.Tree) {
+		log.Printf("Warning: template %s uses the messages as \".\"; templates now get a TemplateContext with them in .Messages (see \"templates schema\")", templatePath)
+		return &exportTemplate{Template: tmpl, data: messages}, nil
+	}
+	return &exportTemplate{Template: tmpl, data: context}, nil
+}
+
+// exportTemplateFuncs returns the functions export templates can call
+func exportTemplateFuncs(context *TemplateContext, opts *ExportOptions, catalog *Catalog, customCSS template.CSS, sections []LazySection) template.FuncMap {
+	return template.FuncMap{
+		"t": func(key string, args ...interface{}) string {
+			return catalog.T(key, args...)
+		},
+		"lang": func() string {
+			return catalog.Lang
+		},
+		"highContrast": func() bool {
+			return context.Archive.HighContrast
+		},
+		"theme": func() string {
+			return context.Archive.Theme
+		},
+		"customCSS": func() template.CSS {
+			return customCSS
+		},
+		"formatSize":    FormatSize,
+		"mediaDuration": MediaDuration,
+		"mediaURL":      trustedMediaURL,
+		"inc": func(i int) int {
+			return i + 1
+		},
+		// roomLabels, searchIndex, roomActivity and participants predate
+		// TemplateContext and return the same as its fields
+		"roomLabels": func() []string {
+			return context.Room.Labels
+		},
+		"lazySections": func() []LazySection {
+			return sections
+		},
+		"lazyLoadScript": func() template.JS {
+			return template.JS(lazyLoadScript)
+		},
+		"searchIndex": func() string {
+			return context.Archive.SearchIndex
+		},
+		"searchScript": func() template.JS {
+			return template.JS(searchScript)
+		},
+		"messageAnchor": MessageAnchor,
+		"roomActivity": func() *RoomActivity {
+			return context.Room.Activity
+		},
+		"participants": func() []Participant {
+			return context.Participants
+		},
+		"hasAnnotations": func(messages []ExportMessage) bool {
+			for _, msg := range messages {
+				if len(msg.Annotations) > 0 {
+					return true
+				}
+			}
+			return false
+		},
 		"formatTime": func(timeStr string) string {
 			if timeStr == "" {
 				return ""
@@ -931,29 +1454,9 @@ func ExportWithTemplate(file *os.File, templatePath string, messages []ExportMes
 		"safeHTML": func(s string) template.HTML {
 			return template.HTML(s)
 		},
-		"countUniqueUsers": func(messages []ExportMessage) int {
-			users := make(map[string]bool)
-			for _, msg := range messages {
-				users[msg.DisplayName] = true
-			}
-			return len(users)
-		},
-		"countPlatforms": func(messages []ExportMessage) int {
-			platforms := make(map[string]bool)
-			for _, msg := range messages {
-				if msg.Platform != "" {
-					platforms[msg.Platform] = true
-				}
-			}
-			return len(platforms)
-		},
-		"countReactions": func(messages []ExportMessage) int {
-			total := 0
-			for _, msg := range messages {
-				total += len(msg.Reactions)
-			}
-			return total
-		},
+		"countUniqueUsers": countUniqueUsers,
+		"countPlatforms":   countPlatforms,
+		"countReactions":   countReactions,
 		"countBridgeUsers": func(messages []ExportMessage) int {
 			bridgeUsers := make(map[string]bool)
 			for _, msg := range messages {
@@ -963,7 +1466,8 @@ func ExportWithTemplate(file *os.File, templatePath string, messages []ExportMes
 			}
 			return len(bridgeUsers)
 		},
-		"truncate": func(s string, length int) string {
+		// Used in pipelines ({{.Content | truncate 100}}), which pass the string last
+		"truncate": func(length int, s string) string {
 			if len(s) <= length {
 				return s
 			}
@@ -972,15 +1476,15 @@ func ExportWithTemplate(file *os.File, templatePath string, messages []ExportMes
 		"lower": func(s string) string {
 			return strings.ToLower(s)
 		},
+		// Wrap text export lines to opts.Width; wrapHanging indents the
+		// continuation lines past a label such as "Caption: "
+		"wrap": func(s interface{}) string {
+			return WrapText(fmt.Sprint(s), opts.Width)
+		},
+		"wrapHanging": func(prefix string, s interface{}) string {
+			return WrapTextHanging(prefix, fmt.Sprint(s), opts.Width)
+		},
 	}
-
-	tmpl, err := template.New("export").Funcs(funcMap).Parse(string(templateContent))
-	if err != nil {
-		return fmt.Errorf("failed to parse template: %w", err)
-	}
-
-	// Pass messages directly to template (not wrapped in a map)
-	return tmpl.Execute(file, messages)
 }
 
 // findRoomByName finds a room ID by display name
@@ -1009,55 +1513,19 @@ func findRoomByName(roomName string) (string, error) {
 	return "", fmt.Errorf("room not found: %s", roomName)
 }
 
-// isValidFormat checks if a format is supported
+// IsValidFormat checks if an exporter is registered for a format
 func IsValidFormat(format string) bool {
-	for _, f := range supportedFormats {
-		if f == format {
-			return true
-		}
-	}
-	return false
+	return LookupExporter(format) != nil
 }
 
-// extractReactions finds all reactions to a specific message
-func extractReactions(messages []*Message, eventID string) []MessageReaction {
-	var reactions []MessageReaction
-	reactionMap := make(map[string]*MessageReaction)
-	
-	for _, msg := range messages {
-		if relatesTo, exists := msg.Content["m.relates_to"]; exists {
-			if relatesMap, ok := relatesTo.(map[string]interface{}); ok {
-				if relType, exists := relatesMap["rel_type"]; exists && relType == "m.annotation" {
-					if targetEvent, exists := relatesMap["event_id"]; exists && targetEvent == eventID {
-						if emoji, exists := relatesMap["key"]; exists {
-							if emojiStr, ok := emoji.(string); ok {
-								if existing, found := reactionMap[emojiStr]; found {
-									existing.Users = append(existing.Users, msg.Sender)
-									existing.Count++
-								} else {
-									reaction := &MessageReaction{
-										Emoji:     emojiStr,
-										Users:     []string{msg.Sender},
-										Count:     1,
-										EventID:   msg.EventID,
-										Timestamp: msg.Timestamp,
-									}
-									reactionMap[emojiStr] = reaction
-								}
-							}
-						}
-					}
-				}
-			}
+// IsValidTheme checks if the HTML color theme is supported
+func IsValidTheme(theme string) bool {
+	for _, t := range supportedThemes {
+		if t == theme {
+			return true
 		}
 	}
-	
-	// Convert map to slice
-	for _, reaction := range reactionMap {
-		reactions = append(reactions, *reaction)
-	}
-	
-	return reactions
+	return false
 }
 
 // extractReplyInfo extracts reply information from message content
@@ -1095,34 +1563,6 @@ func isMessageEdited(content map[string]interface{}) bool {
 	return false
 }
 
-// extractEditHistory finds edit history for a message
-func extractEditHistory(messages []*Message, eventID string) []EditInfo {
-	var edits []EditInfo
-	
-	for _, msg := range messages {
-		if relatesTo, exists := msg.Content["m.relates_to"]; exists {
-			if relatesMap, ok := relatesTo.(map[string]interface{}); ok {
-				if relType, exists := relatesMap["rel_type"]; exists && relType == "m.replace" {
-					if targetEvent, exists := relatesMap["event_id"]; exists && targetEvent == eventID {
-						edit := EditInfo{
-							EventID:   msg.EventID,
-							Timestamp: msg.Timestamp,
-						}
-						if body, exists := msg.Content["body"]; exists {
-							if bodyStr, ok := body.(string); ok {
-								edit.NewContent = bodyStr
-							}
-						}
-						edits = append(edits, edit)
-					}
-				}
-			}
-		}
-	}
-	
-	return edits
-}
-
 // generateUserAvatar creates a simple avatar from display name
 func generateUserAvatar(displayName string) string {
 	if displayName == "" {
@@ -0,0 +1,123 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+)
+
+// Matches reports whether a rule applies to a room with the given tags
+func (r RoomTemplate) Matches(roomID string, tags []string) bool {
+	if r.Room == "" && r.Tag == "" {
+		return false
+	}
+	if r.Room != "" {
+		if matched, _ := path.Match(r.Room, roomID); !matched {
+			return false
+		}
+	}
+	return r.Tag == "" || slices.Contains(tags, r.Tag)
+}
+
+// ValidateRoomTemplates checks the rules' room patterns and themes
+func ValidateRoomTemplates(rules []RoomTemplate) error {
+	for i, rule := range rules {
+		if rule.Room == "" && rule.Tag == "" {
+			return fmt.Errorf("export template rule %d: needs a room or a tag", i+1)
+		}
+		if _, err := path.Match(rule.Room, ""); err != nil {
+			return fmt.Errorf("export template rule %d: invalid room pattern %q", i+1, rule.Room)
+		}
+		if rule.Theme != "" && !IsValidTheme(rule.Theme) {
+			return fmt.Errorf("export template rule %d: unsupported theme %s, supported themes: %v", i+1, rule.Theme, supportedThemes)
+		}
+	}
+	return nil
+}
+
+// ForRoom returns the options for exporting a room: a copy with the template
+// and theme of the first of RoomTemplates that matches it, or the options
+// themselves if none does
+func (opts *ExportOptions) ForRoom(roomID string, organization *RoomOrganization) *ExportOptions {
+	var tags []string
+	if organization != nil {
+		tags = organization.Tags
+	}
+	for _, rule := range opts.RoomTemplates {
+		if !rule.Matches(roomID, tags) {
+			continue
+		}
+		roomOpts := *opts
+		if rule.Template != "" {
+			roomOpts.Template = rule.Template
+		}
+		if rule.Theme != "" {
+			roomOpts.Theme = rule.Theme
+		}
+		return &roomOpts
+	}
+	return opts
+}
+
+// roomExportOptions applies the room's export template rule, if any
+func roomExportOptions(ctx context.Context, roomID string, opts *ExportOptions) (*ExportOptions, error) {
+	if len(opts.RoomTemplates) == 0 {
+		return opts, nil
+	}
+	organization, err := GetRoomOrganization(ctx, GetDatabase(), roomID)
+	if err != nil {
+		return nil, err
+	}
+	return opts.ForRoom(roomID, organization), nil
+}
+
+// ExportAllRooms exports every archived room into dir, one file per room
+// named after its room ID, in opts.Format (default html) or in each of
+// opts.Formats. Each room gets the template and theme of its export template
+// rule, if it has one.
+func ExportAllRooms(dir string, opts *ExportOptions) error {
+	if opts == nil {
+		opts = DefaultExportOptions()
+	}
+	if opts.Format == FormatStaticAPI {
+		return fmt.Errorf("--format api already covers every room; export it without --all-rooms")
+	}
+
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	roomIDs, err := GetDatabase().GetRooms(context.Background())
+	CloseDatabase()
+	if err != nil {
+		return fmt.Errorf("failed to get rooms from database: %w", err)
+	}
+	if len(roomIDs) == 0 {
+		return fmt.Errorf("no rooms found in database")
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	format := opts.Format
+	if format == "" {
+		format = "html"
+	}
+	for _, roomID := range roomIDs {
+		base := filepath.Join(dir, staticAPIRoomPath(roomID))
+		filename := base
+		if len(opts.Formats) == 0 {
+			filename = exportFileName(base, format)
+		}
+		roomOpts := *opts
+		roomOpts.RoomID = roomID
+		if err := ExportMessagesWithOptions(filename, &roomOpts); err != nil {
+			return fmt.Errorf("failed to export room %s: %w", roomID, err)
+		}
+	}
+	fmt.Printf("Exported %d rooms to %q\n", len(roomIDs), dir)
+	return nil
+}
@@ -0,0 +1,153 @@
+package archive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// DefaultSamplePerDay is how many messages export sample keeps from each
+// room on each day
+const DefaultSamplePerDay = 100
+
+// sampleKey identifies the room and UTC day a message is sampled within
+type sampleKey struct {
+	roomID string
+	day    string
+}
+
+// sampleRank orders a message within its room and day. It depends only on
+// the seed and the event ID, so a message is picked the same way however the
+// archive grows, and other days' samples don't shift when a day gets new
+// messages.
+func sampleRank(seed int64, eventID string) uint64 {
+	h := sha256.New()
+	h.Write([]byte(strconv.FormatInt(seed, 10)))
+	h.Write([]byte{0})
+	h.Write([]byte(eventID))
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
+// SampleMessages returns at most perDay messages from each room on each UTC
+// day, chosen pseudo-randomly but deterministically from seed, in time order.
+// Days with fewer messages are kept whole.
+func SampleMessages(messages []*Message, perDay int, seed int64) []*Message {
+	groups := make(map[sampleKey][]*Message)
+	for _, msg := range messages {
+		key := sampleKey{roomID: msg.RoomID, day: msg.Timestamp.UTC().Format("2006-01-02")}
+		groups[key] = append(groups[key], msg)
+	}
+
+	var sampled []*Message
+	for _, group := range groups {
+		if len(group) > perDay {
+			sort.Slice(group, func(i, j int) bool {
+				ri, rj := sampleRank(seed, group[i].EventID), sampleRank(seed, group[j].EventID)
+				if ri != rj {
+					return ri < rj
+				}
+				return group[i].EventID < group[j].EventID
+			})
+			group = group[:perDay]
+		}
+		sampled = append(sampled, group...)
+	}
+	sort.SliceStable(sampled, func(i, j int) bool {
+		a, b := sampled[i], sampled[j]
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp)
+		}
+		if a.RoomID != b.RoomID {
+			return a.RoomID < b.RoomID
+		}
+		return a.EventID < b.EventID
+	})
+	return sampled
+}
+
+// ExportSample writes a balanced sample of the archive to filename: at most
+// perDay messages from each room on each day, picked deterministically from
+// seed. opts.RoomID limits it to one room; otherwise every archived room is
+// sampled. Edits and reactions aren't sampled, and people who opted out are
+// withheld as in every export.
+func ExportSample(filename string, perDay int, seed int64, opts *ExportOptions) error {
+	if opts == nil {
+		opts = DefaultExportOptions()
+	}
+	if perDay <= 0 {
+		return fmt.Errorf("messages per day must be positive, got %d", perDay)
+	}
+	format, err := exportFormat(filename, opts)
+	if err != nil {
+		return err
+	}
+	mediaLinks, err := opts.mediaLinkResolver()
+	if err != nil {
+		return err
+	}
+
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	ctx := context.Background()
+	var roomIDs []string
+	if opts.RoomID != "" {
+		roomID, err := resolveExportRoom(opts.RoomID)
+		if err != nil {
+			return err
+		}
+		roomIDs = []string{roomID}
+	} else if roomIDs, err = GetDatabase().GetRooms(ctx); err != nil {
+		return fmt.Errorf("failed to get rooms from database: %w", err)
+	}
+
+	optedOut, err := optedOutUsers(ctx, GetDatabase())
+	if err != nil {
+		return err
+	}
+
+	var exportMessages []ExportMessage
+	total := 0
+	for _, roomID := range roomIDs {
+		messages, err := GetDatabase().GetMessages(ctx, &MessageFilter{RoomID: roomID, EventType: EventTypeMessage}, 0, 0)
+		if err != nil {
+			return fmt.Errorf("failed to query messages for room %s: %w", roomID, err)
+		}
+		// The notices that stand in for withheld messages have no sender and
+		// aren't sampled
+		kept, _ := WithholdOptedOut(messages, optedOut)
+		var originals []*Message
+		for _, msg := range kept {
+			if msg.Sender != "" && !isEdit(msg) {
+				originals = append(originals, msg)
+			}
+		}
+		total += len(originals)
+
+		sampled := SampleMessages(originals, perDay, seed)
+		converted, err := convertToExportMessages(sampled, roomID, mediaLinks)
+		if err != nil {
+			return fmt.Errorf("failed to convert messages for room %s: %w", roomID, err)
+		}
+		for i := range converted {
+			converted[i].RoomID = roomID
+		}
+		exportMessages = append(exportMessages, converted...)
+	}
+	sort.SliceStable(exportMessages, func(i, j int) bool {
+		ti, _ := time.Parse(time.RFC3339, exportMessages[i].Timestamp)
+		tj, _ := time.Parse(time.RFC3339, exportMessages[j].Timestamp)
+		return ti.Before(tj)
+	})
+
+	fmt.Printf("Writing %d of %d messages from %d rooms to %q (at most %d per room per day, seed %d)\n",
+		len(exportMessages), total, len(roomIDs), filename, perDay, seed)
+	return writeExportFile(filename, format, exportMessages, opts)
+}
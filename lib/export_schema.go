@@ -0,0 +1,483 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExportSchemaFile is where the published copy of ExportSchema lives in the
+// repository; regenerate it with "matrix-archive export schema". Earlier
+// versions stay alongside it.
+var ExportSchemaFile = fmt.Sprintf("schemas/export-v%d.schema.json", ExportFormatVersion)
+
+// ExportSchemaID identifies the published schema for the current version
+var ExportSchemaID = "https://github.com/osteele/matrix-archive/blob/main/" + ExportSchemaFile
+
+// maxSchemaErrors caps how many problems ValidateExportFile reports
+const maxSchemaErrors = 50
+
+// schema is a JSON Schema document or subschema
+type schema = map[string]interface{}
+
+// ExportSchema returns a JSON Schema (draft 2020-12) for the JSON export
+// formats. It is generated from exportDocument, ExportMessage and the types
+// they embed, so it can't drift from what the exporter writes. Each line of an
+// NDJSON export is a single message, matching $defs.ExportMessage.
+func ExportSchema() map[string]interface{} {
+	defs := make(schema)
+	root := structSchema(reflect.TypeOf(exportDocument{}), defs)
+	properties := root["properties"].(schema)
+	properties["format_version"] = schema{"type": "integer", "const": ExportFormatVersion}
+	properties["messages"] = schema{"type": "array", "items": schemaForType(reflect.TypeOf(ExportMessage{}), defs)}
+
+	root["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	root["$id"] = ExportSchemaID
+	root["title"] = "matrix-archive export"
+	root["description"] = fmt.Sprintf("Messages exported by matrix-archive (format version %d)", ExportFormatVersion)
+	root["$defs"] = defs
+	return root
+}
+
+// ExportSchemaJSON returns ExportSchema as indented JSON, in the form
+// published at ExportSchemaFile
+func ExportSchemaJSON() ([]byte, error) {
+	data, err := json.MarshalIndent(ExportSchema(), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaForType returns the schema for values of t as encoding/json writes
+// them. Structs are added to defs and referenced by name.
+func schemaForType(t reflect.Type, defs schema) schema {
+	if t == timeType {
+		return schema{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaForType(t.Elem(), defs)
+	case reflect.String:
+		return schema{"type": "string"}
+	case reflect.Bool:
+		return schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return schema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return schema{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return schema{"type": "array", "items": schemaForType(t.Elem(), defs)}
+	case reflect.Map:
+		if t.Elem().Kind() == reflect.Interface {
+			return schema{"type": "object"}
+		}
+		return schema{"type": "object", "additionalProperties": schemaForType(t.Elem(), defs)}
+	case reflect.Struct:
+		name := t.Name()
+		if _, ok := defs[name]; !ok {
+			defs[name] = nil // placeholder, in case the type refers to itself
+			defs[name] = structSchema(t, defs)
+		}
+		return schema{"$ref": "#/$defs/" + name}
+	}
+	return schema{}
+}
+
+// structSchema lists a struct's JSON fields. Fields without omitempty are
+// always written and so are required; nil slices, maps and pointers among
+// them are written as null.
+func structSchema(t reflect.Type, defs schema) schema {
+	properties := make(schema)
+	var required []interface{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, omitEmpty := jsonFieldName(field)
+		if name == "-" {
+			continue
+		}
+		property := schemaForType(field.Type, defs)
+		if !omitEmpty {
+			required = append(required, name)
+			switch field.Type.Kind() {
+			case reflect.Slice, reflect.Map, reflect.Ptr:
+				property = nullable(property)
+			}
+		}
+		properties[name] = property
+	}
+	s := schema{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+func jsonFieldName(field reflect.StructField) (string, bool) {
+	tag := field.Tag.Get("json")
+	name, options, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = field.Name
+	}
+	return name, strings.Contains(","+options+",", ",omitempty,")
+}
+
+func nullable(s schema) schema {
+	if typ, ok := s["type"].(string); ok {
+		copied := make(schema, len(s))
+		for k, v := range s {
+			copied[k] = v
+		}
+		copied["type"] = []interface{}{typ, "null"}
+		return copied
+	}
+	return schema{"anyOf": []interface{}{s, schema{"type": "null"}}}
+}
+
+// SchemaError is a value that doesn't match the export schema
+type SchemaError struct {
+	Path    string `json:"path"`    // Location in the document, e.g. $.messages[3].reactions[0].count
+	Message string `json:"message"` // What is wrong with the value there
+}
+
+func (e SchemaError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// ValidateExport checks a decoded JSON document against schema s and returns
+// the mismatches, if any
+func ValidateExport(s map[string]interface{}, document interface{}) []SchemaError {
+	v := &schemaValidator{root: s}
+	v.validate(s, document, "$")
+	return v.errors
+}
+
+// ValidateExportFile checks a JSON or NDJSON (.ndjson or .jsonl) export
+// against ExportSchema. It returns the number of messages in the file and
+// the first mismatches found.
+func ValidateExportFile(path string) (int, []SchemaError, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	root := ExportSchema()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ndjson", ".jsonl":
+		message := schema{"$ref": "#/$defs/ExportMessage"}
+		v := &schemaValidator{root: root}
+		count := 0
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			value, err := decodeJSONValue(scanner.Bytes())
+			if err != nil {
+				return count, nil, fmt.Errorf("%s line %d: %w", path, line, err)
+			}
+			count++
+			v.validate(message, value, fmt.Sprintf("line %d", line))
+			if len(v.errors) >= maxSchemaErrors {
+				break
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return count, nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		return count, v.errors, nil
+	}
+
+	value, err := decodeJSONValue(data)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	count := 0
+	switch doc := value.(type) {
+	case []interface{}:
+		count = len(doc)
+	case map[string]interface{}:
+		if messages, ok := doc["messages"].([]interface{}); ok {
+			count = len(messages)
+		}
+	}
+	// An export from another version fails in many places at once; report
+	// the version mismatch instead
+	if version, err := ExportFormatVersionOf(value); err == nil && version != ExportFormatVersion {
+		hint := `migrate it with "matrix-archive export upgrade"`
+		if version > ExportFormatVersion {
+			hint = "it was written by a newer matrix-archive"
+		}
+		return count, []SchemaError{{Path: "$", Message: fmt.Sprintf("export format version %d, expected %d; %s", version, ExportFormatVersion, hint)}}, nil
+	}
+	return count, ValidateExport(root, value), nil
+}
+
+// CheckExport validates an export file and prints the outcome: a summary
+// line, or each mismatch followed by an error
+func CheckExport(path string) error {
+	count, problems, err := ValidateExportFile(path)
+	if err != nil {
+		return err
+	}
+	if jsonOutput() {
+		if problems == nil {
+			problems = []SchemaError{}
+		}
+		if err := writeJSON(map[string]interface{}{
+			"file":           path,
+			"format_version": ExportFormatVersion,
+			"messages":       count,
+			"valid":          len(problems) == 0,
+			"errors":         problems,
+		}); err != nil {
+			return err
+		}
+	} else {
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, problem)
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s does not match export format version %d (%d problems)", path, ExportFormatVersion, len(problems))
+	}
+	if !jsonOutput() {
+		fmt.Printf("%s is valid: %d messages, export format version %d\n", path, count, ExportFormatVersion)
+	}
+	return nil
+}
+
+// decodeJSONValue decodes a single JSON value, keeping numbers as
+// json.Number so integers can be told apart from fractions
+func decodeJSONValue(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("invalid JSON: unexpected data after the top-level value")
+	}
+	return value, nil
+}
+
+// schemaValidator implements the subset of JSON Schema that ExportSchema
+// uses: type, const, format date-time, properties, required, additionalProperties,
+// items, oneOf, anyOf and local $refs
+type schemaValidator struct {
+	root   schema
+	errors []SchemaError
+}
+
+func (v *schemaValidator) fail(path, format string, args ...interface{}) {
+	if len(v.errors) < maxSchemaErrors {
+		v.errors = append(v.errors, SchemaError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+// matches reports whether value matches s, without recording errors
+func (v *schemaValidator) matches(s schema, value interface{}) bool {
+	probe := &schemaValidator{root: v.root}
+	probe.validate(s, value, "")
+	return len(probe.errors) == 0
+}
+
+func (v *schemaValidator) validate(s schema, value interface{}, path string) {
+	if ref, ok := s["$ref"].(string); ok {
+		target, err := v.resolve(ref)
+		if err != nil {
+			v.fail(path, "%v", err)
+			return
+		}
+		v.validate(target, value, path)
+		return
+	}
+
+	if branches, ok := s["oneOf"].([]interface{}); ok {
+		v.validateBranches(branches, value, path, true)
+		return
+	}
+	if branches, ok := s["anyOf"].([]interface{}); ok {
+		v.validateBranches(branches, value, path, false)
+		return
+	}
+
+	if typ, ok := s["type"]; ok {
+		types := schemaTypes(typ)
+		actual := jsonType(value)
+		if !typeAllowed(types, actual) {
+			v.fail(path, "expected %s, got %s", strings.Join(types, " or "), actual)
+			return
+		}
+	}
+	if expected, ok := s["const"]; ok && fmt.Sprint(value) != fmt.Sprint(expected) {
+		v.fail(path, "expected %v, got %v", expected, value)
+		return
+	}
+
+	switch value := value.(type) {
+	case string:
+		if s["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, value); err != nil {
+				v.fail(path, "expected an RFC 3339 date-time, got %q", value)
+			}
+		}
+	case []interface{}:
+		if items, ok := s["items"].(schema); ok {
+			for i, item := range value {
+				v.validate(items, item, fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+	case map[string]interface{}:
+		v.validateObject(s, value, path)
+	}
+}
+
+func (v *schemaValidator) validateObject(s schema, value map[string]interface{}, path string) {
+	properties, _ := s["properties"].(schema)
+	if required, ok := s["required"].([]interface{}); ok {
+		for _, name := range required {
+			if _, present := value[name.(string)]; !present {
+				v.fail(path, "missing required property %q", name)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(value))
+	for name := range value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		propertyPath := path + "." + name
+		if property, ok := properties[name].(schema); ok {
+			v.validate(property, value[name], propertyPath)
+			continue
+		}
+		switch additional := s["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				v.fail(propertyPath, "unknown property")
+			}
+		case schema:
+			v.validate(additional, value[name], propertyPath)
+		}
+	}
+}
+
+func (v *schemaValidator) validateBranches(branches []interface{}, value interface{}, path string, exactlyOne bool) {
+	matched := 0
+	for _, branch := range branches {
+		if v.matches(branch.(schema), value) {
+			matched++
+		}
+	}
+	switch {
+	case matched == 0 && len(branches) > 0:
+		// Report against the branch whose type fits, so the errors point
+		// at the offending field rather than at the whole document
+		for _, branch := range branches {
+			b := v.deref(branch.(schema))
+			if typ, ok := b["type"]; ok && typeAllowed(schemaTypes(typ), jsonType(value)) {
+				v.validate(b, value, path)
+				return
+			}
+		}
+		v.fail(path, "doesn't match any of the allowed forms")
+	case matched > 1 && exactlyOne:
+		v.fail(path, "matches more than one of the allowed forms")
+	}
+}
+
+func (v *schemaValidator) deref(s schema) schema {
+	if ref, ok := s["$ref"].(string); ok {
+		if target, err := v.resolve(ref); err == nil {
+			return target
+		}
+	}
+	return s
+}
+
+func (v *schemaValidator) resolve(ref string) (schema, error) {
+	name, ok := strings.CutPrefix(ref, "#/$defs/")
+	if !ok {
+		return nil, fmt.Errorf("unsupported schema reference %q", ref)
+	}
+	defs, _ := v.root["$defs"].(schema)
+	target, ok := defs[name].(schema)
+	if !ok {
+		return nil, fmt.Errorf("unknown schema reference %q", ref)
+	}
+	return target, nil
+}
+
+func schemaTypes(typ interface{}) []string {
+	switch typ := typ.(type) {
+	case string:
+		return []string{typ}
+	case []interface{}:
+		types := make([]string, 0, len(typ))
+		for _, t := range typ {
+			types = append(types, fmt.Sprint(t))
+		}
+		return types
+	}
+	return nil
+}
+
+func typeAllowed(types []string, actual string) bool {
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonType names the JSON Schema type of a value decoded with UseNumber
+func jsonType(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case int, int64:
+		return "integer"
+	case json.Number:
+		if _, err := value.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case float64:
+		if value == float64(int64(value)) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
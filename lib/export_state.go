@@ -0,0 +1,160 @@
+package archive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// exportInputs is everything an export's output depends on, serialized for hashing
+type exportInputs struct {
+	Formats     []string            `json:"formats"`
+	Options     *ExportOptions      `json:"options"`
+	Memberships []*MembershipEvent  `json:"memberships,omitempty"`
+	Room        *ExportRoom         `json:"room,omitempty"`
+	Messages    []*Message          `json:"messages"`
+	Archive     *exportArchiveState `json:"archive,omitempty"`
+}
+
+// exportArchiveState is the archived state besides messages that an export
+// reads while converting them. Refresh times are left out, so refreshing a
+// profile that didn't change doesn't make the export run again.
+type exportArchiveState struct {
+	Chain         []*RoomVersion                  `json:"chain,omitempty"`
+	Annotations   []*Annotation                   `json:"annotations,omitempty"`
+	Verifications []map[string]*EventVerification `json:"verifications,omitempty"`
+	Users         []RoomUser                      `json:"users,omitempty"`
+	Persons       []*PersonAlias                  `json:"persons,omitempty"`
+	EmotePacks    []EmotePack                     `json:"emote_packs,omitempty"`
+}
+
+// loadExportArchiveState reads the archived state an export of the rooms in
+// chain reads besides their messages
+func loadExportArchiveState(ctx context.Context, chain []*RoomVersion, roomIDs []string, opts *ExportOptions) (*exportArchiveState, error) {
+	db := GetDatabase()
+	state := &exportArchiveState{Chain: chain}
+	for _, roomID := range roomIDs {
+		if opts.Annotations {
+			annotations, err := db.GetRoomAnnotations(ctx, roomID)
+			if err != nil {
+				return nil, err
+			}
+			state.Annotations = append(state.Annotations, annotations...)
+		}
+		if opts.Verifications {
+			verifications, err := db.GetEventVerifications(ctx, roomID)
+			if err != nil {
+				return nil, err
+			}
+			state.Verifications = append(state.Verifications, verifications)
+		}
+		users, err := db.GetRoomUsers(ctx, roomID)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			u := *user
+			u.UpdatedAt = time.Time{}
+			state.Users = append(state.Users, u)
+		}
+	}
+
+	var err error
+	if state.Persons, err = db.GetPersonAliases(ctx); err != nil {
+		return nil, err
+	}
+	packs, err := db.GetEmotePacks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, pack := range packs {
+		p := *pack
+		p.UpdatedAt = time.Time{}
+		state.EmotePacks = append(state.EmotePacks, p)
+	}
+	return state, nil
+}
+
+// ExportInputHash hashes the inputs of an export: the archived messages with
+// their media links resolved, the options, and for HTML and text the
+// template, string catalog and custom stylesheet. Exports with the same hash
+// write the same files. It reads nothing from the homeserver, so an
+// unchanged export is skipped before any display names are fetched.
+func ExportInputHash(messages []*Message, formats []string, opts *ExportOptions) (string, error) {
+	return exportInputHash(messages, formats, opts, nil)
+}
+
+// exportInputHash is ExportInputHash that also covers the archived state
+// read during conversion
+func exportInputHash(messages []*Message, formats []string, opts *ExportOptions, state *exportArchiveState) (string, error) {
+	h := sha256.New()
+
+	mediaLinks, err := opts.mediaLinkResolver()
+	if err != nil {
+		return "", err
+	}
+	linked := make([]*Message, len(messages))
+	for i, msg := range messages {
+		m := *msg
+		m.Content = RewriteMediaLinks(msg.Content, mediaLinks)
+		linked[i] = &m
+	}
+
+	// Options that don't change the exported files are left out
+	options := *opts
+	options.IfChanged, options.ReportPath, options.ReactionsPath, options.Stats = false, "", "", false
+	options.Hooks = Hooks{}
+
+	inputs := exportInputs{Formats: formats, Options: &options, Memberships: opts.memberships, Room: newExportRoom(opts.profile, opts.room), Messages: linked, Archive: state}
+	if err := json.NewEncoder(h).Encode(inputs); err != nil {
+		return "", fmt.Errorf("failed to hash export inputs: %w", err)
+	}
+
+	files := []string{filepath.Join(localesDir, opts.Lang+".yaml")}
+	for _, format := range formats {
+		if format == "html" || format == "txt" {
+			files = append(files, ResolveTemplatePath(opts.Template, format))
+		}
+	}
+	if opts.CSSPath != "" {
+		files = append(files, opts.CSSPath)
+	}
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to hash %s: %w", path, err)
+		}
+		fmt.Fprintf(h, "%s\n%d\n", path, len(data))
+		h.Write(data)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// exportTarget identifies an export by the absolute path of its output
+func exportTarget(filename string) string {
+	if abs, err := filepath.Abs(filename); err == nil {
+		return abs
+	}
+	return filename
+}
+
+// exportUpToDate reports whether target was last exported from inputs with the
+// given hash and all of its output files still exist
+func exportUpToDate(ctx context.Context, target, hash string, outputs []string) (bool, error) {
+	previous, err := GetDatabase().GetExportHash(ctx, target)
+	if err != nil || previous != hash {
+		return false, err
+	}
+	for _, output := range outputs {
+		if _, err := os.Stat(output); err != nil {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,293 @@
+package archive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FormatStaticAPI is the export format that writes a directory of JSON files
+// laid out like a static REST API
+const FormatStaticAPI = "api"
+
+// DefaultAPIPageSize is the number of messages per page file
+const DefaultAPIPageSize = 500
+
+// StaticAPIRoom is a room to include in a static API export
+type StaticAPIRoom struct {
+	RoomID   string
+	Name     string
+	Profile  *RoomProfile // The room's recorded topic, canonical alias and creation time; may be nil
+	Messages []ExportMessage
+}
+
+// apiRoomEntry is an entry in rooms.json
+type apiRoomEntry struct {
+	RoomID         string `json:"room_id"`
+	Name           string `json:"name"`
+	Topic          string `json:"topic,omitempty"`
+	CanonicalAlias string `json:"canonical_alias,omitempty"`
+	CreatedAt      string `json:"created_at,omitempty"`
+	Path           string `json:"path"`
+	MessageCount   int    `json:"message_count"`
+	PageCount      int    `json:"page_count"`
+	FirstMessage   string `json:"first_message,omitempty"`
+	LastMessage    string `json:"last_message,omitempty"`
+	MessagesURL    string `json:"messages_url"`
+}
+
+// apiMessagePage is the content of rooms/<room>/messages/page-N.json
+type apiMessagePage struct {
+	RoomID    string          `json:"room_id"`
+	Page      int             `json:"page"`
+	PageCount int             `json:"page_count"`
+	PageSize  int             `json:"page_size"`
+	Total     int             `json:"total"`
+	Prev      *string         `json:"prev"`
+	Next      *string         `json:"next"`
+	Messages  []ExportMessage `json:"messages"`
+}
+
+// apiUserEntry is an entry in users.json
+type apiUserEntry struct {
+	UserID       string   `json:"user_id"`
+	DisplayName  string   `json:"display_name"`
+	Platform     string   `json:"platform,omitempty"`
+	Avatar       string   `json:"avatar,omitempty"`
+	MessageCount int      `json:"message_count"`
+	Rooms        []string `json:"rooms"`
+}
+
+var unsafePathChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// staticAPIRoomPath turns a room ID into a portable directory name
+// ("!abc123:matrix.org" -> "abc123_matrix.org-c0db7915"). IDs that had to be
+// changed get a short hash of the ID, so that "!a_b:x" and "!a:b_x" don't
+// share a directory.
+func staticAPIRoomPath(roomID string) string {
+	name := strings.TrimPrefix(roomID, "!")
+	safe := unsafePathChars.ReplaceAllString(name, "_")
+	if safe == name {
+		return safe
+	}
+	sum := sha256.Sum256([]byte(roomID))
+	return safe + "-" + hex.EncodeToString(sum[:4])
+}
+
+// WriteStaticAPI writes rooms.json, users.json and paginated message files
+// for each room into dir. Paths inside the JSON are relative to dir.
+func WriteStaticAPI(dir string, rooms []StaticAPIRoom, pageSize int) error {
+	if pageSize <= 0 {
+		pageSize = DefaultAPIPageSize
+	}
+
+	roomEntries := make([]apiRoomEntry, 0, len(rooms))
+	users := make(map[string]*apiUserEntry)
+
+	for _, room := range rooms {
+		roomPath := path.Join("rooms", staticAPIRoomPath(room.RoomID))
+		pageCount := (len(room.Messages) + pageSize - 1) / pageSize
+		if pageCount == 0 {
+			pageCount = 1
+		}
+
+		entry := apiRoomEntry{
+			RoomID:       room.RoomID,
+			Name:         room.Name,
+			Path:         roomPath,
+			MessageCount: len(room.Messages),
+			PageCount:    pageCount,
+			MessagesURL:  path.Join(roomPath, "messages", "page-1.json"),
+		}
+		if profile := room.Profile; profile != nil {
+			entry.Topic, entry.CanonicalAlias = profile.Topic, profile.CanonicalAlias
+			if profile.CreatedAt != nil {
+				entry.CreatedAt = profile.CreatedAt.UTC().Format(time.RFC3339)
+			}
+		}
+		if len(room.Messages) > 0 {
+			entry.FirstMessage = room.Messages[0].Timestamp
+			entry.LastMessage = room.Messages[len(room.Messages)-1].Timestamp
+		}
+		roomEntries = append(roomEntries, entry)
+
+		for page := 1; page <= pageCount; page++ {
+			start := (page - 1) * pageSize
+			end := start + pageSize
+			if end > len(room.Messages) {
+				end = len(room.Messages)
+			}
+
+			messages := room.Messages[start:end]
+			if messages == nil {
+				messages = []ExportMessage{}
+			}
+			pageFile := apiMessagePage{
+				RoomID:    room.RoomID,
+				Page:      page,
+				PageCount: pageCount,
+				PageSize:  pageSize,
+				Total:     len(room.Messages),
+				Messages:  messages,
+			}
+			if page > 1 {
+				prev := fmt.Sprintf("page-%d.json", page-1)
+				pageFile.Prev = &prev
+			}
+			if page < pageCount {
+				next := fmt.Sprintf("page-%d.json", page+1)
+				pageFile.Next = &next
+			}
+
+			pagePath := filepath.Join(dir, filepath.FromSlash(roomPath), "messages", fmt.Sprintf("page-%d.json", page))
+			if err := writeJSONFile(pagePath, pageFile); err != nil {
+				return err
+			}
+		}
+
+		for _, msg := range room.Messages {
+			user, ok := users[msg.UserID]
+			if !ok {
+				user = &apiUserEntry{
+					UserID:      msg.UserID,
+					DisplayName: msg.DisplayName,
+					Platform:    msg.Platform,
+					Avatar:      msg.UserAvatar,
+				}
+				users[msg.UserID] = user
+			}
+			user.MessageCount++
+			if len(user.Rooms) == 0 || user.Rooms[len(user.Rooms)-1] != room.RoomID {
+				user.Rooms = append(user.Rooms, room.RoomID)
+			}
+		}
+	}
+
+	userEntries := make([]*apiUserEntry, 0, len(users))
+	for _, user := range users {
+		userEntries = append(userEntries, user)
+	}
+	sort.Slice(userEntries, func(i, j int) bool {
+		return userEntries[i].UserID < userEntries[j].UserID
+	})
+
+	if err := writeJSONFile(filepath.Join(dir, "rooms.json"), roomEntries); err != nil {
+		return err
+	}
+	return writeJSONFile(filepath.Join(dir, "users.json"), userEntries)
+}
+
+// writeJSONFile writes v as indented JSON, creating parent directories
+func writeJSONFile(filename string, v interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", filename, err)
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", filename, err)
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		return fmt.Errorf("failed to write %s: %w", filename, err)
+	}
+	return nil
+}
+
+// ExportStaticAPI exports archived rooms as a static JSON API into outputDir.
+// All rooms are exported unless opts.RoomID is set.
+func ExportStaticAPI(outputDir string, opts *ExportOptions) error {
+	if opts == nil {
+		opts = DefaultExportOptions()
+	}
+
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	ctx := context.Background()
+	roomIDs := []string{opts.RoomID}
+	if opts.RoomID == "" {
+		var err error
+		roomIDs, err = GetDatabase().GetRooms(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get rooms from database: %w", err)
+		}
+	}
+
+	client, err := GetMatrixClient()
+	if err != nil {
+		log.Printf("Warning: Could not get Matrix client for room names: %v", err)
+		client = nil
+	}
+
+	mediaLinks, err := opts.mediaLinkResolver()
+	if err != nil {
+		return err
+	}
+
+	var rooms []StaticAPIRoom
+	for _, roomID := range roomIDs {
+		messages, err := GetDatabase().GetMessages(ctx, &MessageFilter{RoomID: roomID}, 0, 0)
+		if err != nil {
+			return fmt.Errorf("failed to query messages for room %s: %w", roomID, err)
+		}
+		if messages, _, err = withholdOptedOut(ctx, messages); err != nil {
+			return err
+		}
+
+		exportMessages, err := convertToExportMessages(messages, roomID, mediaLinks)
+		if err != nil {
+			return fmt.Errorf("failed to convert messages for room %s: %w", roomID, err)
+		}
+
+		if opts.Annotations {
+			if err := attachRoomAnnotations(ctx, roomID, exportMessages); err != nil {
+				return err
+			}
+		}
+
+		if opts.Permalinks {
+			AttachPermalinks(exportMessages, roomID, opts.PermalinkBase)
+		}
+
+		if opts.HistoricalNames {
+			memberships, err := GetDatabase().GetMembershipEvents(ctx, roomID)
+			if err != nil {
+				return fmt.Errorf("failed to load membership events for room %s: %w", roomID, err)
+			}
+			ApplyHistoricalNames(exportMessages, memberships)
+		}
+
+		profile, err := GetDatabase().GetRoomProfile(ctx, roomID)
+		if err != nil {
+			return err
+		}
+		name := roomDisplayName(profile, client, roomID)
+
+		rooms = append(rooms, StaticAPIRoom{RoomID: roomID, Name: name, Profile: profile, Messages: exportMessages})
+		fmt.Printf("Exported %d messages from %s\n", len(exportMessages), name)
+	}
+
+	if err := WriteStaticAPI(outputDir, rooms, opts.PageSize); err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote static API for %d rooms to %s\n", len(rooms), outputDir)
+	return nil
+}
@@ -0,0 +1,114 @@
+package archive
+
+import (
+	"fmt"
+	"time"
+)
+
+// ExportStatsVersion is the version of the export statistics format
+const ExportStatsVersion = 1
+
+// exportMediaDirs are the directories exports look for downloaded media in
+var exportMediaDirs = []string{"thumbnails", "images"}
+
+// ExportStats summarizes an export run, written next to the export with
+// --stats so that automation can check runs and dashboards can follow an
+// archive's growth without parsing logs
+type ExportStats struct {
+	Version         int            `json:"version"`
+	RoomID          string         `json:"room_id"`
+	Outputs         []string       `json:"outputs"`
+	StartedAt       time.Time      `json:"started_at"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	Skipped         bool           `json:"skipped,omitempty"` // Nothing had changed since the last export with --if-changed
+	Messages        int            `json:"messages"`
+	CountsByType    map[string]int `json:"counts_by_type"`
+	Senders         int            `json:"senders"`
+	FirstMessage    *time.Time     `json:"first_message,omitempty"`
+	LastMessage     *time.Time     `json:"last_message,omitempty"`
+	DecryptFailures int            `json:"decrypt_failures"` // Messages still encrypted because their keys were missing
+	MediaResolved   int            `json:"media_resolved"`   // Media files downloaded, which the export links to locally
+	MediaMissing    int            `json:"media_missing"`    // Media files not downloaded
+	Withheld        int            `json:"withheld"`         // Messages withheld because their senders opted out
+}
+
+// BuildExportStats counts the messages of an export. mediaDirs are the
+// directories downloaded media is looked for in.
+func BuildExportStats(roomID string, messages []*Message, mediaDirs []string) *ExportStats {
+	stats := &ExportStats{
+		Version:      ExportStatsVersion,
+		RoomID:       roomID,
+		Outputs:      []string{},
+		Messages:     len(messages),
+		CountsByType: make(map[string]int),
+	}
+	senders := make(map[string]bool)
+	for _, msg := range messages {
+		ts := msg.Timestamp.UTC()
+		if stats.FirstMessage == nil || ts.Before(*stats.FirstMessage) {
+			stats.FirstMessage = &ts
+		}
+		if stats.LastMessage == nil || ts.After(*stats.LastMessage) {
+			stats.LastMessage = &ts
+		}
+		stats.CountsByType[reportEventType(msg)]++
+		if msg.Sender != "" {
+			senders[msg.Sender] = true
+		}
+		if isUndecryptable(msg) {
+			stats.DecryptFailures++
+		}
+		if isMedia(msg) {
+			if mediaDownloaded(msg, mediaDirs) {
+				stats.MediaResolved++
+			} else {
+				stats.MediaMissing++
+			}
+		}
+	}
+	stats.Senders = len(senders)
+	return stats
+}
+
+// exportedMessages returns the messages that made it into exported, which
+// leaves out the rest of the room when a single conversation is exported
+func exportedMessages(messages []*Message, exported []ExportMessage) []*Message {
+	if len(exported) == len(messages) {
+		return messages
+	}
+	included := make(map[string]bool, len(exported))
+	for _, msg := range exported {
+		included[msg.EventID] = true
+	}
+	var result []*Message
+	for _, msg := range messages {
+		if included[msg.EventID] {
+			result = append(result, msg)
+		}
+	}
+	return result
+}
+
+// ExportStatsPath returns where the statistics of an export to filename go:
+// next to it, named after it without its extension, e.g. room.stats.json for
+// room.html, or for room.html and room.json written with --formats
+func ExportStatsPath(filename string) string {
+	return exportBaseName(filename) + ".stats.json"
+}
+
+// finish records the outputs of an export that started at start
+func (stats *ExportStats) finish(outputs []string, start time.Time) {
+	stats.Outputs = outputs
+	stats.StartedAt = start.UTC()
+	stats.DurationSeconds = time.Since(start).Seconds()
+}
+
+// writeExportStats writes the statistics of an export next to filename
+func writeExportStats(filename string, stats *ExportStats) error {
+	path := ExportStatsPath(filename)
+	if err := writeJSONFile(path, stats); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote export statistics to %q\n", path)
+	return nil
+}
@@ -0,0 +1,297 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ZipPasswordEnv supplies the password for zipped exports when --password
+// isn't given, keeping it out of shell history
+const ZipPasswordEnv = "MATRIX_ARCHIVE_ZIP_PASSWORD"
+
+// WinZip AES encryption (AE-2), which 7-Zip, WinZip, macOS Archive Utility
+// and most other unzip tools can open
+const (
+	zipMethodAES      = 99
+	zipExtraAES       = 0x9901
+	zipAESVersion     = 2 // AE-2 leaves out the CRC; the authentication code covers the data
+	zipAESStrength256 = 3
+	zipAESKeySize     = 32
+	zipAESSaltSize    = 16
+	zipAESIterations  = 1000
+	zipAESAuthSize    = 10
+)
+
+// zipFlagEncrypted and zipFlagUTF8 are general purpose flags of a zip entry
+const (
+	zipFlagEncrypted = 0x1
+	zipFlagUTF8      = 0x800
+)
+
+// ZipFile is a file to package into a zip
+type ZipFile struct {
+	Name string // Slash-separated path inside the zip
+	Path string // File on disk
+}
+
+// zipExportPaths splits the filename given to a zipped export into the zip
+// to write and the filename the export inside it is named after, so
+// "room.zip" and "room.html" both write room.zip containing room.html
+func zipExportPaths(filename string) (zipPath, inner string) {
+	ext := filepath.Ext(filename)
+	if strings.EqualFold(ext, ".zip") {
+		inner = strings.TrimSuffix(filename, ext)
+		return filename, inner
+	}
+	return strings.TrimSuffix(filename, ext) + ".zip", filename
+}
+
+// writeZipExport renders the export into a staging directory and packages
+// it, with the downloaded media its messages link to, into the zip at
+// zipPath. The files are encrypted when opts.ZipPassword is set.
+func writeZipExport(zipPath, base string, formats []string, exportMessages []ExportMessage, opts *ExportOptions) error {
+	staging, err := os.MkdirTemp("", "matrix-archive-export-")
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	if err := WriteExportFiles(filepath.Join(staging, filepath.Base(base)), formats, exportMessages, opts); err != nil {
+		return err
+	}
+
+	var files []ZipFile
+	err = filepath.WalkDir(staging, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(staging, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, ZipFile{Name: filepath.ToSlash(rel), Path: path})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to collect export files: %w", err)
+	}
+	files = append(files, ExportedMediaFiles(exportMessages)...)
+
+	if err := WriteZip(zipPath, files, opts.ZipPassword); err != nil {
+		return err
+	}
+	if opts.ZipPassword != "" {
+		fmt.Printf("Packaged %d files into %q, encrypted with AES-256\n", len(files), zipPath)
+	} else {
+		fmt.Printf("Packaged %d files into %q\n", len(files), zipPath)
+	}
+	return nil
+}
+
+// ExportedMediaFiles returns the downloaded media that exported messages
+// link to by relative path, such as thumbnails written by download-images and
+// the files of inline players. Media that wasn't downloaded, and links to
+// other sites, are left out.
+func ExportedMediaFiles(messages []ExportMessage) []ZipFile {
+	seen := make(map[string]bool)
+	var files []ZipFile
+	add := func(link string) {
+		if strings.Contains(link, ":") || !filepath.IsLocal(filepath.FromSlash(link)) {
+			return
+		}
+		name := path.Clean(link)
+		if seen[name] {
+			return
+		}
+		if info, err := os.Stat(filepath.FromSlash(name)); err != nil || info.IsDir() {
+			return
+		}
+		seen[name] = true
+		files = append(files, ZipFile{Name: name, Path: filepath.FromSlash(name)})
+	}
+	var walk func(content map[string]interface{})
+	walk = func(content map[string]interface{}) {
+		for k, v := range content {
+			if sub, ok := v.(map[string]interface{}); ok {
+				walk(sub)
+				continue
+			}
+			if link, ok := v.(string); ok && k == "url" {
+				add(link)
+			}
+		}
+	}
+	for _, msg := range messages {
+		walk(msg.Content)
+		if msg.Player != nil {
+			add(msg.Player.URL)
+			if msg.Player.Poster != "" {
+				add(msg.Player.Poster)
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files
+}
+
+// WriteZip packages files into a zip at filename. With a password every
+// file is encrypted with WinZip AES-256, so the zip opens with the password
+// in common unzip tools without age or GPG.
+func WriteZip(filename string, files []ZipFile, password string) error {
+	out, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	zw := zip.NewWriter(out)
+	for _, file := range files {
+		if err := writeZipFile(zw, file, password); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to write %s: %w", filename, err)
+	}
+	return out.Close()
+}
+
+// writeZipFile deflates one file into zw, encrypting it if password is set
+func writeZipFile(zw *zip.Writer, file ZipFile, password string) error {
+	info, err := os.Stat(file.Path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", file.Path, err)
+	}
+	data, err := os.ReadFile(file.Path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", file.Path, err)
+	}
+
+	if password == "" {
+		fh := &zip.FileHeader{Name: file.Name, Method: zip.Deflate, Modified: info.ModTime()}
+		w, err := zw.CreateHeader(fh)
+		if err == nil {
+			_, err = w.Write(data)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to add %s: %w", file.Name, err)
+		}
+		return nil
+	}
+
+	var compressed bytes.Buffer
+	fw, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := fw.Write(data); err != nil {
+		return fmt.Errorf("failed to compress %s: %w", file.Name, err)
+	}
+	if err := fw.Close(); err != nil {
+		return fmt.Errorf("failed to compress %s: %w", file.Name, err)
+	}
+	encrypted, err := zipAESEncrypt(compressed.Bytes(), password)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt %s: %w", file.Name, err)
+	}
+
+	// The actual compression method moves into the AES extra field
+	extra := make([]byte, 11)
+	binary.LittleEndian.PutUint16(extra[0:], zipExtraAES)
+	binary.LittleEndian.PutUint16(extra[2:], 7)
+	binary.LittleEndian.PutUint16(extra[4:], zipAESVersion)
+	copy(extra[6:], "AE")
+	extra[8] = zipAESStrength256
+	binary.LittleEndian.PutUint16(extra[9:], zip.Deflate)
+
+	fh := &zip.FileHeader{
+		Name:               file.Name,
+		Method:             zipMethodAES,
+		Flags:              zipFlagEncrypted | zipFlagUTF8,
+		Extra:              extra,
+		CompressedSize64:   uint64(len(encrypted)),
+		UncompressedSize64: uint64(len(data)),
+	}
+	fh.ModifiedDate, fh.ModifiedTime = msDosTime(info.ModTime())
+	w, err := zw.CreateRaw(fh)
+	if err == nil {
+		_, err = w.Write(encrypted)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to add %s: %w", file.Name, err)
+	}
+	return nil
+}
+
+// zipAESEncrypt encrypts a compressed zip entry as WinZip AES-256: the salt
+// and password verifier, the data encrypted with AES-CTR, and a truncated
+// HMAC-SHA1 authentication code
+func zipAESEncrypt(data []byte, password string) ([]byte, error) {
+	salt := make([]byte, zipAESSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	keys, err := pbkdf2.Key(sha1.New, password, salt, zipAESIterations, 2*zipAESKeySize+2)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(keys[:zipAESKeySize])
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := make([]byte, len(data))
+	zipAESCTR(block, encrypted, data)
+	mac := hmac.New(sha1.New, keys[zipAESKeySize:2*zipAESKeySize])
+	mac.Write(encrypted)
+
+	out := make([]byte, 0, len(salt)+2+len(encrypted)+zipAESAuthSize)
+	out = append(out, salt...)
+	out = append(out, keys[2*zipAESKeySize:]...)
+	out = append(out, encrypted...)
+	return append(out, mac.Sum(nil)[:zipAESAuthSize]...), nil
+}
+
+// zipAESCTR applies AES in counter mode as WinZip does: a little-endian
+// counter starting at 1, which crypto/cipher's big-endian CTR can't produce
+func zipAESCTR(block cipher.Block, dst, src []byte) {
+	var counter, stream [aes.BlockSize]byte
+	for i := 0; i < len(src); i += aes.BlockSize {
+		for j := range counter {
+			counter[j]++
+			if counter[j] != 0 {
+				break
+			}
+		}
+		block.Encrypt(stream[:], counter[:])
+		end := min(i+aes.BlockSize, len(src))
+		subtle.XORBytes(dst[i:end], src[i:end], stream[:end-i])
+	}
+}
+
+// msDosTime converts t to the date and time fields of a zip header
+func msDosTime(t time.Time) (date, clock uint16) {
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, t.Location())
+	}
+	date = uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	clock = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+	return date, clock
+}
@@ -0,0 +1,169 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Exporter writes converted messages in one export format. Built-in formats
+// are exporters too; Go programs embedding the library can add their own
+// with RegisterExporter, and export, export thread, export highlights and
+// context then accept them like the built-in ones.
+type Exporter interface {
+	// Name is the format's name, as given to --format and --formats
+	Name() string
+	// Extensions are the file extensions, without the dot, that select the
+	// format. The first is used for files named after a base name.
+	Extensions() []string
+	// Export writes messages, oldest first, to w
+	Export(ctx context.Context, w io.Writer, messages iter.Seq[ExportMessage], opts *ExportOptions) error
+}
+
+var exporters struct {
+	sync.RWMutex
+	list []Exporter // In registration order
+}
+
+// RegisterExporter adds an export format. It panics if the format's name or
+// one of its extensions is already taken, like database/sql.Register.
+func RegisterExporter(e Exporter) {
+	if e.Name() == FormatStaticAPI {
+		panic(fmt.Sprintf("archive: exporter name %s is reserved for the static API", FormatStaticAPI))
+	}
+	exporters.Lock()
+	defer exporters.Unlock()
+	for _, existing := range exporters.list {
+		if existing.Name() == e.Name() {
+			panic(fmt.Sprintf("archive: exporter %s is registered twice", e.Name()))
+		}
+		for _, ext := range e.Extensions() {
+			if slices.Contains(existing.Extensions(), ext) {
+				panic(fmt.Sprintf("archive: extension .%s of exporter %s is already used by %s", ext, e.Name(), existing.Name()))
+			}
+		}
+	}
+	exporters.list = append(exporters.list, e)
+}
+
+// ExportFormats returns the names of the registered export formats, in the
+// order they were registered
+func ExportFormats() []string {
+	exporters.RLock()
+	defer exporters.RUnlock()
+	names := make([]string, len(exporters.list))
+	for i, e := range exporters.list {
+		names[i] = e.Name()
+	}
+	return names
+}
+
+// ExportExtensions returns the file extensions of every registered format
+func ExportExtensions() []string {
+	exporters.RLock()
+	defer exporters.RUnlock()
+	var extensions []string
+	for _, e := range exporters.list {
+		extensions = append(extensions, e.Extensions()...)
+	}
+	return extensions
+}
+
+// LookupExporter returns the exporter for a format name, or nil
+func LookupExporter(name string) Exporter {
+	exporters.RLock()
+	defer exporters.RUnlock()
+	for _, e := range exporters.list {
+		if e.Name() == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// exporterForExtension returns the exporter a file extension (without the
+// dot) selects, or nil
+func exporterForExtension(ext string) Exporter {
+	ext = strings.ToLower(ext)
+	exporters.RLock()
+	defer exporters.RUnlock()
+	for _, e := range exporters.list {
+		if slices.Contains(e.Extensions(), ext) {
+			return e
+		}
+	}
+	return nil
+}
+
+// exportFileName returns the file a multi-format export writes a format to
+func exportFileName(base, format string) string {
+	if e := LookupExporter(format); e != nil && len(e.Extensions()) > 0 {
+		return base + "." + e.Extensions()[0]
+	}
+	return base + "." + format
+}
+
+// unsupportedFormatError reports a format no exporter handles
+func unsupportedFormatError(format string) error {
+	return fmt.Errorf("unsupported format %s, supported formats: %v", format, ExportFormats())
+}
+
+// templateExporter renders messages with the format's HTML or text template
+type templateExporter struct {
+	name       string
+	extensions []string
+}
+
+func (e templateExporter) Name() string         { return e.name }
+func (e templateExporter) Extensions() []string { return e.extensions }
+
+func (e templateExporter) Export(ctx context.Context, w io.Writer, messages iter.Seq[ExportMessage], opts *ExportOptions) error {
+	return ExportWithTemplateOptions(w, ResolveTemplatePath(opts.Template, e.name), slices.Collect(messages), opts)
+}
+
+// documentExporter writes messages as a JSON or YAML export document
+type documentExporter struct {
+	name       string
+	extensions []string
+}
+
+func (e documentExporter) Name() string         { return e.name }
+func (e documentExporter) Extensions() []string { return e.extensions }
+
+func (e documentExporter) Export(ctx context.Context, w io.Writer, messages iter.Seq[ExportMessage], opts *ExportOptions) error {
+	document := exportDocument{FormatVersion: ExportFormatVersion, Room: newExportRoom(opts.profile, opts.room), Messages: slices.Collect(messages)}
+	if opts.Participants {
+		document.Participants = ParticipantSummary(document.Messages, opts.memberships)
+	}
+	return encodeExportDocument(w, e.name, document)
+}
+
+// ndjsonExporter writes one JSON message per line, as ValidateExportFile
+// expects of .ndjson files, so large exports can be streamed and split
+type ndjsonExporter struct{}
+
+func (ndjsonExporter) Name() string         { return "ndjson" }
+func (ndjsonExporter) Extensions() []string { return []string{"ndjson", "jsonl"} }
+
+func (ndjsonExporter) Export(ctx context.Context, w io.Writer, messages iter.Seq[ExportMessage], opts *ExportOptions) error {
+	encoder := json.NewEncoder(w)
+	for msg := range messages {
+		if err := encoder.Encode(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	RegisterExporter(templateExporter{name: "txt", extensions: []string{"txt"}})
+	RegisterExporter(templateExporter{name: "html", extensions: []string{"html", "htm"}})
+	RegisterExporter(documentExporter{name: "json", extensions: []string{"json"}})
+	RegisterExporter(documentExporter{name: "yaml", extensions: []string{"yaml", "yml"}})
+	RegisterExporter(ndjsonExporter{})
+}
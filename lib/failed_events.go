@@ -0,0 +1,220 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// recordFailure keeps an event the client couldn't archive as it is, so it
+// can be retried with "failed retry"
+func (e *EnhancedMatrixClient) recordFailure(ctx context.Context, evt *event.Event, roomID, stage string, cause error) {
+	raw, err := json.Marshal(evt)
+	if err != nil {
+		log.Printf("Warning: could not record failed event %s: %v", evt.ID, err)
+		return
+	}
+	failed := &FailedEvent{EventID: evt.ID.String(), RoomID: roomID, Stage: stage, Error: cause.Error(), Event: raw}
+	if err := e.db.SaveFailedEvent(ctx, failed); err != nil {
+		log.Printf("Warning: could not record failed event %s: %v", evt.ID, err)
+		return
+	}
+	e.failed++
+}
+
+// reportFailures tells the user how many events the client quarantined or
+// couldn't convert or decrypt
+func (e *EnhancedMatrixClient) reportFailures() {
+	reportQuarantined(e.quarantined)
+	if e.failed > 0 {
+		fmt.Printf("%d events couldn't be converted or decrypted; see \"failed list\"\n", e.failed)
+	}
+}
+
+// ParseFailedEvent decodes the raw event kept with a failed event
+func ParseFailedEvent(failed *FailedEvent) (*event.Event, error) {
+	evt := &event.Event{}
+	if err := json.Unmarshal(failed.Event, evt); err != nil {
+		return nil, fmt.Errorf("failed to decode event %s: %w", failed.EventID, err)
+	}
+	parseEventContent(evt)
+	return evt, nil
+}
+
+// parseEventContent parses the content of an event decoded from its JSON,
+// which leaves the content raw. Content that doesn't parse is converted from
+// its raw form, as on import.
+func parseEventContent(evt *event.Event) {
+	evt.Type.Class = evt.Type.GuessClass()
+	_ = evt.Content.ParseRaw(evt.Type)
+}
+
+// retryFailedEvent converts a failed event again and stores its message,
+// reporting whether it was archived this time. An event that fails again is
+// recorded again with the new error.
+func (e *EnhancedMatrixClient) retryFailedEvent(ctx context.Context, failed *FailedEvent) (bool, error) {
+	evt, err := ParseFailedEvent(failed)
+	if err != nil {
+		return false, err
+	}
+
+	failures := e.failed
+	messages := e.messagesFromEvents(ctx, []*event.Event{evt}, failed.RoomID)
+	if e.failed > failures {
+		return false, nil
+	}
+
+	// Replace the placeholder stored when the event couldn't be decrypted
+	if placeholder, err := e.db.GetMessage(ctx, failed.EventID); err == nil && placeholder.MessageType == EventTypeEncrypted {
+		if err := e.db.DeleteMessage(ctx, failed.EventID); err != nil {
+			return false, err
+		}
+	}
+
+	pipeline := e.importPipeline(0)
+	err = pipeline.Store(ctx, messages)
+	e.quarantined += pipeline.Quarantined
+	if err != nil {
+		return false, err
+	}
+	return true, e.db.DeleteFailedEvent(ctx, failed.EventID)
+}
+
+// failureRow is a line of "failed list": a failed event or a quarantined message
+type failureRow struct {
+	EventID  string
+	RoomID   string
+	Stage    string
+	Error    string
+	Attempts int
+	FailedAt time.Time
+}
+
+// ListFailedEvents prints the events that failed to convert or decrypt and
+// the quarantined messages, in a room or in every room if roomID is empty
+func ListFailedEvents(roomID string) error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	ctx := context.Background()
+	failed, err := GetDatabase().GetFailedEvents(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	quarantined, err := GetDatabase().GetQuarantinedMessages(ctx, roomID)
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput() {
+		if failed == nil {
+			failed = []*FailedEvent{}
+		}
+		if quarantined == nil {
+			quarantined = []*QuarantinedMessage{}
+		}
+		return writeJSON(map[string]interface{}{"failed_events": failed, "quarantined": quarantined})
+	}
+
+	if len(failed) == 0 && len(quarantined) == 0 {
+		fmt.Println("No failed events")
+		return nil
+	}
+
+	var rows []failureRow
+	for _, f := range failed {
+		rows = append(rows, failureRow{f.EventID, f.RoomID, f.Stage, f.Error, f.Attempts, f.FailedAt})
+	}
+	for _, q := range quarantined {
+		rows = append(rows, failureRow{q.Message.EventID, q.Message.RoomID, FailureValidation, q.Reason, 1, q.QuarantinedAt})
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Event ID\tRoom ID\tStage\tAttempts\tFailed\tError")
+	fmt.Fprintln(w, "--------\t-------\t-----\t--------\t------\t-----")
+	for _, r := range rows {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", r.EventID, r.RoomID, r.Stage, r.Attempts, r.FailedAt.Format(time.RFC3339), r.Error)
+	}
+	return w.Flush()
+}
+
+// RetryFailedEvents tries again to archive the events that failed to convert
+// or decrypt, after a fix or a key recovery, and the quarantined messages,
+// validating them in the given mode. Events that fail again stay listed with
+// their new error.
+func RetryFailedEvents(roomID, validation string) error {
+	if err := CheckValidationMode(validation); err != nil {
+		return err
+	}
+
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	ctx := context.Background()
+	db := GetDatabase()
+	failed, err := db.GetFailedEvents(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	quarantined, err := db.GetQuarantinedMessages(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	if len(failed) == 0 && len(quarantined) == 0 {
+		fmt.Println("No failed events to retry")
+		return nil
+	}
+
+	archived := 0
+	if len(failed) > 0 {
+		// Converting events needs the account, and decrypting them its keys
+		client, err := GetMatrixClient()
+		if err != nil {
+			return fmt.Errorf("failed to get Matrix client: %w", err)
+		}
+		enhanced, err := NewEnhancedMatrixClient(client, db)
+		if err != nil {
+			return fmt.Errorf("failed to create enhanced client: %w", err)
+		}
+		enhanced.validation = validation
+		for _, f := range failed {
+			ok, err := enhanced.retryFailedEvent(ctx, f)
+			if err != nil {
+				log.Printf("Failed to retry %s: %v", f.EventID, err)
+			} else if ok {
+				archived++
+			}
+		}
+	}
+
+	pipeline := &ImportPipeline{DB: db, Validation: validation}
+	released := 0
+	for _, q := range quarantined {
+		before := pipeline.Quarantined
+		if err := pipeline.Store(ctx, []*Message{q.Message}); err != nil {
+			return err
+		}
+		if pipeline.Quarantined > before {
+			continue
+		}
+		if err := db.DeleteQuarantinedMessage(ctx, q.Message.EventID); err != nil {
+			return err
+		}
+		released++
+	}
+
+	fmt.Printf("✓ Archived %d of %d failed events and released %d of %d quarantined messages\n", archived, len(failed), released, len(quarantined))
+	return nil
+}
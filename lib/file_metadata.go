@@ -0,0 +1,62 @@
+package archive
+
+import "database/sql"
+
+// FileMetadata describes the file attached to an m.file message
+type FileMetadata struct {
+	Name     string `json:"name" yaml:"name"`
+	MimeType string `json:"mimetype,omitempty" yaml:"mimetype,omitempty"`
+	Size     int64  `json:"size,omitempty" yaml:"size,omitempty"`
+}
+
+// FileMetadataFromContent reads the file name, type and size of m.file
+// content, or returns nil for other messages. The name comes from "filename"
+// when the sender set one, since "body" is then a caption.
+func FileMetadataFromContent(content map[string]interface{}) *FileMetadata {
+	if contentMsgType(content) != "m.file" {
+		return nil
+	}
+	file := &FileMetadata{}
+	if name, _ := content["filename"].(string); name != "" {
+		file.Name = name
+	} else {
+		file.Name, _ = content["body"].(string)
+	}
+	if info, ok := content["info"].(map[string]interface{}); ok {
+		file.MimeType, _ = info["mimetype"].(string)
+		switch size := info["size"].(type) {
+		case float64: // Decoded from JSON
+			file.Size = int64(size)
+		case int:
+			file.Size = int64(size)
+		case int64:
+			file.Size = size
+		}
+	}
+	return file
+}
+
+// File returns the message's stored file metadata, falling back to reading
+// its content for messages archived before the metadata was recorded
+func (m *Message) File() *FileMetadata {
+	if m.FileName != "" || m.FileSize > 0 {
+		return &FileMetadata{Name: m.FileName, MimeType: m.FileMimeType, Size: m.FileSize}
+	}
+	return FileMetadataFromContent(m.Content)
+}
+
+// fileColumnsForStorage returns the file_name, file_mimetype and file_size
+// columns of an m.file message. They are NULL for other messages and when
+// content is encrypted, since file names say as much as the messages do.
+func (d *DuckDBDatabase) fileColumnsForStorage(message *Message) (name, mimeType sql.NullString, size sql.NullInt64) {
+	if d.cipher != nil {
+		return
+	}
+	file := FileMetadataFromContent(message.Content)
+	if file == nil {
+		return
+	}
+	return sql.NullString{String: file.Name, Valid: true},
+		sql.NullString{String: file.MimeType, Valid: file.MimeType != ""},
+		sql.NullInt64{Int64: file.Size, Valid: file.Size > 0}
+}
@@ -0,0 +1,62 @@
+package archive
+
+import (
+	"database/sql"
+	"regexp"
+	"strings"
+)
+
+// perMessageProfileKey is the content key bridges use to relay a message under
+// someone else's name, e.g. Discord webhooks bridged by mautrix-discord
+const perMessageProfileKey = "com.beeper.per_message_profile"
+
+// forwardedBodyPattern matches the "Forwarded from X:" line bridges such as
+// mautrix-telegram put before forwarded content
+var forwardedBodyPattern = regexp.MustCompile(`^Forwarded (?:message )?from ([^\n]+):[ \t]*\n`)
+
+// DetectForward parses a bridged message's provenance hints. It returns who the
+// content originally came from and on which platform, or empty strings if the
+// message wasn't forwarded or relayed.
+func DetectForward(sender string, content map[string]interface{}) (from, platform string) {
+	platform = detectPlatform(sender)
+	if platform == "Unknown" {
+		platform = ""
+	}
+
+	if profile, ok := content[perMessageProfileKey].(map[string]interface{}); ok {
+		if name, _ := profile["displayname"].(string); name != "" {
+			return name, platform
+		}
+	}
+
+	body, _ := content["body"].(string)
+	if matches := forwardedBodyPattern.FindStringSubmatch(body); matches != nil {
+		from = strings.TrimSpace(matches[1])
+		if formatted, _ := content["formatted_body"].(string); strings.Contains(formatted, "<tg-forward>") {
+			platform = "Telegram"
+		}
+		return from, platform
+	}
+
+	return "", ""
+}
+
+// Forwarding returns the message's stored provenance, falling back to parsing
+// its content for messages archived before provenance was recorded
+func (m *Message) Forwarding() (from, platform string) {
+	if m.ForwardedFrom != "" {
+		return m.ForwardedFrom, m.ForwardedPlatform
+	}
+	return DetectForward(m.Sender, m.Content)
+}
+
+// forwardingForStorage returns the message's provenance columns, or NULLs in
+// encrypted archives, where the original author is read from the decrypted
+// content instead
+func (d *DuckDBDatabase) forwardingForStorage(message *Message) (from, platform sql.NullString) {
+	if d.cipher != nil {
+		return sql.NullString{}, sql.NullString{}
+	}
+	return sql.NullString{String: message.ForwardedFrom, Valid: message.ForwardedFrom != ""},
+		sql.NullString{String: message.ForwardedPlatform, Valid: message.ForwardedPlatform != ""}
+}
@@ -0,0 +1,232 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// Reasons a message is included in a highlights export
+const (
+	HighlightPinned     = "pinned"
+	HighlightBookmarked = "bookmarked"
+	HighlightAnnotated  = "annotated"
+)
+
+// DefaultHighlightContext is the number of messages shown before and after each highlight
+const DefaultHighlightContext = 2
+
+// SelectHighlights returns the highlighted messages together with up to
+// contextSize messages on either side. reasons maps event IDs to why they are
+// highlighted. Overlapping windows are merged; the first message after a gap
+// is marked with ContextBreak.
+func SelectHighlights(messages []ExportMessage, reasons map[string][]string, contextSize int) []ExportMessage {
+	if contextSize < 0 {
+		contextSize = 0
+	}
+
+	keep := make([]bool, len(messages))
+	for i, msg := range messages {
+		if len(reasons[msg.EventID]) == 0 {
+			continue
+		}
+		for j := max(0, i-contextSize); j <= min(len(messages)-1, i+contextSize); j++ {
+			keep[j] = true
+		}
+	}
+
+	selected := []ExportMessage{}
+	for i, msg := range messages {
+		if !keep[i] {
+			continue
+		}
+		msg.Highlights = reasons[msg.EventID]
+		msg.ContextBreak = i > 0 && !keep[i-1]
+		selected = append(selected, msg)
+	}
+	return selected
+}
+
+// highlightReasons collects the pinned, bookmarked and annotated messages in a room
+func highlightReasons(ctx context.Context, roomID string) (map[string][]string, error) {
+	db := GetDatabase()
+	reasons := make(map[string][]string)
+
+	pinned, err := db.GetPinnedEvents(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	for _, eventID := range pinned {
+		reasons[eventID] = append(reasons[eventID], HighlightPinned)
+	}
+
+	bookmarks, err := db.GetBookmarks(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range bookmarks {
+		reasons[b.EventID] = append(reasons[b.EventID], HighlightBookmarked)
+	}
+
+	annotations, err := db.GetRoomAnnotations(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range annotations {
+		if r := reasons[a.EventID]; len(r) == 0 || r[len(r)-1] != HighlightAnnotated {
+			reasons[a.EventID] = append(r, HighlightAnnotated)
+		}
+	}
+
+	return reasons, nil
+}
+
+// ExportHighlights writes a condensed export of a room's pinned, bookmarked and
+// annotated messages, each with contextSize messages before and after it
+func ExportHighlights(filename string, contextSize int, opts *ExportOptions) error {
+	if opts == nil {
+		opts = DefaultExportOptions()
+	}
+
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	ext, err := exportFormat(filename, opts)
+	if err != nil {
+		return err
+	}
+
+	roomID, err := resolveExportRoom(opts.RoomID)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	reasons, err := highlightReasons(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	if len(reasons) == 0 {
+		return fmt.Errorf("room %s has no pinned, bookmarked or annotated messages", roomID)
+	}
+
+	messages, err := GetDatabase().GetMessages(ctx, &MessageFilter{RoomID: roomID}, 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %w", err)
+	}
+	if messages, _, err = withholdOptedOut(ctx, messages); err != nil {
+		return err
+	}
+
+	mediaLinks, err := opts.mediaLinkResolver()
+	if err != nil {
+		return err
+	}
+	exportMessages, err := convertToExportMessages(messages, roomID, mediaLinks)
+	if err != nil {
+		return fmt.Errorf("failed to convert messages: %w", err)
+	}
+
+	// Notes are what make annotated messages interesting, so always include them
+	if err := attachRoomAnnotations(ctx, roomID, exportMessages); err != nil {
+		return err
+	}
+
+	if opts.Permalinks {
+		AttachPermalinks(exportMessages, roomID, opts.PermalinkBase)
+	}
+
+	if err := loadMemberships(ctx, roomID, opts); err != nil {
+		return err
+	}
+	if opts.HistoricalNames {
+		ApplyHistoricalNames(exportMessages, opts.memberships)
+	}
+	if opts.room, err = GetRoomOrganization(ctx, GetDatabase(), roomID); err != nil {
+		return err
+	}
+	if err := loadRoomProfile(ctx, roomID, opts); err != nil {
+		return err
+	}
+
+	highlights := SelectHighlights(exportMessages, reasons, contextSize)
+	fmt.Printf("Writing %d highlights with context (%d messages) to %q\n", len(reasons), len(highlights), filename)
+
+	return writeExportFile(filename, ext, highlights, opts)
+}
+
+// BookmarkMessage bookmarks an archived message, with an optional label
+func BookmarkMessage(eventID, label string) error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	ctx := context.Background()
+	if _, err := GetDatabase().GetMessage(ctx, eventID); err != nil {
+		return fmt.Errorf("cannot bookmark %s: %w", eventID, err)
+	}
+
+	if err := GetDatabase().AddBookmark(ctx, &Bookmark{EventID: eventID, Label: label}); err != nil {
+		return err
+	}
+
+	fmt.Printf("Bookmarked %s\n", eventID)
+	return nil
+}
+
+// ListBookmarks prints the bookmarks in a room, or all bookmarks if roomID is empty
+func ListBookmarks(roomID string) error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	bookmarks, err := GetDatabase().GetBookmarks(context.Background(), roomID)
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput() {
+		if bookmarks == nil {
+			bookmarks = []*Bookmark{}
+		}
+		return writeJSON(bookmarks)
+	}
+
+	if len(bookmarks) == 0 {
+		fmt.Println("No bookmarks found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Event ID\tCreated\tLabel")
+	fmt.Fprintln(w, "--------\t-------\t-----")
+	for _, b := range bookmarks {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", b.EventID, b.CreatedAt.Format(time.RFC3339), b.Label)
+	}
+	return w.Flush()
+}
+
+// RemoveBookmark deletes the bookmark on a message
+func RemoveBookmark(eventID string) error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	if err := GetDatabase().DeleteBookmark(context.Background(), eventID); err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed bookmark on %s\n", eventID)
+	return nil
+}
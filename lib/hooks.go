@@ -0,0 +1,113 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Hook names, as given to hook commands in HookEvent.Hook and the
+// MATRIX_ARCHIVE_HOOK environment variable
+const (
+	HookPreImport  = "pre_import"
+	HookPostBatch  = "post_batch"
+	HookPostImport = "post_import"
+	HookPostExport = "post_export"
+)
+
+// HookEnv names the hook being run in a hook command's environment
+const HookEnv = "MATRIX_ARCHIVE_HOOK"
+
+// Hooks are external commands run at points of imports and exports, set in
+// the configuration file's hooks section, to scan media, enrich messages or
+// send notifications without changing the archiver. Each command gets a
+// HookEvent as JSON on stdin; one that exits with an error stops the run.
+type Hooks struct {
+	PreImport  []string `yaml:"pre_import,omitempty"`  // Before an import fetches anything
+	PostBatch  []string `yaml:"post_batch,omitempty"`  // After each batch of messages is stored
+	PostImport []string `yaml:"post_import,omitempty"` // After an import finishes
+	PostExport []string `yaml:"post_export,omitempty"` // After an export is written
+}
+
+// HookEvent is what a hook command reads on stdin
+type HookEvent struct {
+	Hook    string    `json:"hook"`
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source,omitempty"` // What an import reads: matrix or a file name
+	RoomID  string    `json:"room_id,omitempty"`
+	RoomIDs []string  `json:"room_ids,omitempty"` // post_import: the rooms imported
+
+	Imported int        `json:"imported,omitempty"` // Messages imported so far
+	Messages []*Message `json:"messages,omitempty"` // post_batch: the batch's messages
+
+	Outputs []string     `json:"outputs,omitempty"` // post_export: the files written
+	Stats   *ExportStats `json:"stats,omitempty"`   // post_export: what was exported
+}
+
+// HookError is a hook command failing. Imports stop at it rather than going
+// on to the next room.
+type HookError struct {
+	Hook    string
+	Command string
+	Err     error
+}
+
+func (e *HookError) Error() string {
+	return fmt.Sprintf("%s hook failed: %s: %v", e.Hook, e.Command, e.Err)
+}
+
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// commands returns the commands of a hook
+func (h Hooks) commands(hook string) []string {
+	switch hook {
+	case HookPreImport:
+		return h.PreImport
+	case HookPostBatch:
+		return h.PostBatch
+	case HookPostImport:
+		return h.PostImport
+	case HookPostExport:
+		return h.PostExport
+	}
+	return nil
+}
+
+// Run runs the commands of evt.Hook in order, each with evt as JSON on
+// stdin, stopping with a HookError at the first that fails. Commands are
+// split on spaces and run without a shell; their output goes to the
+// progress output.
+func (h Hooks) Run(evt *HookEvent) error {
+	commands := h.commands(evt.Hook)
+	if len(commands) == 0 {
+		return nil
+	}
+	if evt.Time.IsZero() {
+		evt.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s hook input: %w", evt.Hook, err)
+	}
+
+	for _, command := range commands {
+		fields := strings.Fields(command)
+		if len(fields) == 0 {
+			continue
+		}
+		cmd := exec.Command(fields[0], fields[1:]...)
+		cmd.Stdin = bytes.NewReader(data)
+		cmd.Stdout, cmd.Stderr = progressWriter(), os.Stderr
+		cmd.Env = append(os.Environ(), HookEnv+"="+evt.Hook)
+		if err := cmd.Run(); err != nil {
+			return &HookError{Hook: evt.Hook, Command: fields[0], Err: err}
+		}
+	}
+	return nil
+}
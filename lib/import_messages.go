@@ -2,6 +2,7 @@ package archive
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -43,60 +44,313 @@ func (rl *RateLimiter) Wait() {
 	rl.lastCall = time.Now()
 }
 
+// ImportOptions controls ImportMessagesWithOptions
+type ImportOptions struct {
+	Limit  int    // Maximum messages per room (0 = no limit)
+	RoomID string // Room to import; empty imports all joined rooms
+
+	// Throttling for large imports against small homeservers. With
+	// MaxEventsPerRun set, each run stops after fetching that many events and
+	// the next run resumes where it left off.
+	MaxEventsPerRun int           // 0 = no cap
+	PauseEvery      int           // Pause after every N fetched events (0 = never)
+	PauseDuration   time.Duration // Length of each pause
+
+	Moderation bool // Also archive invites, knocks, kicks and bans with their reasons
+
+	// Event types to fetch, and to leave out, e.g. m.room.message or m.call.*.
+	// Empty fetches every type.
+	EventTypes        []string
+	ExcludeEventTypes []string
+
+	ContentLimit ContentLimit // Truncates messages with oversized content
+
+	// Whose messages to archive; empty uses the patterns in the environment
+	Senders SenderFilter
+
+	// How strictly messages are validated before they're stored; messages
+	// that fail are quarantined. Empty is ValidationStandard.
+	Validation string
+
+	// YAML file of rules attributing relayed messages to their real authors;
+	// empty uses the file named by MATRIX_ARCHIVE_ATTRIBUTION_RULES
+	AttributionRules string
+
+	// Detect and store the language of each text message; also turned on
+	// by MATRIX_ARCHIVE_DETECT_LANGUAGE
+	DetectLanguage bool
+
+	// Also import the rooms that upgraded rooms replaced, following each
+	// room's m.room.create predecessor back to the original room
+	FollowUpgrades bool
+
+	// Read RoomID, a room ID or alias, without joining it. The room has to
+	// be world-readable, like many public announcement rooms; the rooms it
+	// replaced are read the same way.
+	Peek bool
+
+	// Get back into rooms the account has left before fetching their
+	// history: world-readable rooms are read without joining, others are
+	// joined again (see RejoinRoom). Importing all rooms then also imports
+	// the archived rooms the account has left.
+	Rejoin bool
+
+	// External commands run before the import, after each batch and after
+	// the import, from the configuration file
+	Hooks Hooks
+}
+
 // ImportMessages imports messages from Matrix rooms into the database
 // If roomID is empty, imports from all joined rooms
 func ImportMessages(limit int, roomID string) error {
+	return ImportMessagesWithOptions(&ImportOptions{Limit: limit, RoomID: roomID})
+}
+
+// ImportMessagesWithOptions imports messages from Matrix rooms into the database using the given options
+func ImportMessagesWithOptions(opts *ImportOptions) error {
+	attribution, err := prepareImport(opts)
+	if err != nil {
+		return err
+	}
+
 	// Initialize database connection with DuckDB
 	if err := InitDuckDB(); err != nil {
 		return fmt.Errorf("failed to initialize database: %w", err)
 	}
 	defer CloseDatabase()
 
+	return importMessages(context.Background(), GetDatabase(), currentAccount(), opts, attribution)
+}
+
+// prepareImport checks an import's options, loads its attribution rules and
+// runs its pre_import hooks
+func prepareImport(opts *ImportOptions) (AttributionRules, error) {
+	if err := opts.ContentLimit.Validate(); err != nil {
+		return nil, err
+	}
+	if err := CheckValidationMode(opts.Validation); err != nil {
+		return nil, err
+	}
+	opts.Senders = opts.Senders.OrEnv()
+	if err := opts.Senders.Validate(); err != nil {
+		return nil, err
+	}
+	attribution, err := LoadAttributionRulesOrEnv(opts.AttributionRules)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Peek && opts.RoomID == "" {
+		return nil, fmt.Errorf("peeking needs a room to read")
+	}
+	if err := opts.Hooks.Run(&HookEvent{Hook: HookPreImport, Source: "matrix", RoomID: opts.RoomID}); err != nil {
+		return nil, err
+	}
+	return attribution, nil
+}
+
+// importMessages imports messages from an account's Matrix rooms into db,
+// once opts are checked
+func importMessages(ctx context.Context, db DatabaseInterface, account *Account, opts *ImportOptions, attribution AttributionRules) error {
+	if err := opts.Senders.DenyOptedOut(ctx, db); err != nil {
+		return err
+	}
+
 	// Get Matrix client
-	client, err := GetMatrixClient()
+	client, err := account.Client()
 	if err != nil {
 		return fmt.Errorf("failed to get Matrix client: %w", err)
 	}
 
 	// Use enhanced client for better mautrix-go integration
-	enhanced, err := NewEnhancedMatrixClient(client, GetDatabase())
+	enhanced, err := NewEnhancedMatrixClient(client, db)
 	if err != nil {
 		return fmt.Errorf("failed to create enhanced client: %w", err)
 	}
+	enhanced.maxEvents = opts.MaxEventsPerRun
+	enhanced.pauseEvery = opts.PauseEvery
+	enhanced.pauseDuration = opts.PauseDuration
+	enhanced.archiveModeration = opts.Moderation
+	enhanced.filter = EventFilter(opts.EventTypes, opts.ExcludeEventTypes)
+	enhanced.contentLimit = &opts.ContentLimit
+	enhanced.senders = opts.Senders
+	enhanced.validation = opts.Validation
+	enhanced.attribution = attribution
+	if opts.DetectLanguage {
+		enhanced.detectLanguage = true
+	}
+	enhanced.hooks = opts.Hooks
+
+	if err := enhanced.archiveDirectRooms(ctx); err != nil {
+		log.Printf("Warning: could not archive direct chats: %v", err)
+	}
+	if err := enhanced.archiveUserEmotePacks(ctx); err != nil {
+		log.Printf("Warning: could not archive emote packs: %v", err)
+	}
+
+	if opts.Peek {
+		if opts.RoomID, err = resolveRoom(ctx, client, opts.RoomID); err != nil {
+			return err
+		}
+	}
+
+	// Rooms the account is in, to tell rooms it has left apart; nil if
+	// the server couldn't say
+	var joined map[string]bool
+	resp, err := client.JoinedRooms(ctx)
+	if err != nil && opts.RoomID == "" {
+		return fmt.Errorf("failed to get joined rooms: %w", err)
+	} else if err != nil {
+		log.Printf("Warning: could not get joined rooms: %v", err)
+	} else {
+		joined = make(map[string]bool, len(resp.JoinedRooms))
+		for _, rid := range resp.JoinedRooms {
+			joined[string(rid)] = true
+		}
+	}
 
 	// Get room IDs to process
 	var roomIDs []string
-	if roomID != "" {
+	if opts.RoomID != "" {
+		if seal, err := db.GetRoomSeal(ctx, opts.RoomID); err != nil {
+			return err
+		} else if seal != nil {
+			return sealedRoomError(seal)
+		}
 		// Import from specific room
-		roomIDs = []string{roomID}
+		roomIDs = []string{opts.RoomID}
 	} else {
 		// Import from all joined rooms
-		resp, err := client.JoinedRooms(context.Background())
-		if err != nil {
-			return fmt.Errorf("failed to get joined rooms: %w", err)
-		}
 		for _, rid := range resp.JoinedRooms {
 			roomIDs = append(roomIDs, string(rid))
 		}
+		fmt.Printf("Found %d joined rooms to import from\n", len(roomIDs))
+		if opts.Rejoin {
+			left, err := leftArchivedRooms(ctx, db, joined)
+			if err != nil {
+				return err
+			}
+			roomIDs = append(roomIDs, left...)
+			if len(left) > 0 {
+				fmt.Printf("Found %d archived rooms the account has left\n", len(left))
+			}
+		}
 		if len(roomIDs) == 0 {
 			return fmt.Errorf("no rooms found to import from")
 		}
-		fmt.Printf("Found %d joined rooms to import from\n", len(roomIDs))
 	}
 
+	throttled := opts.MaxEventsPerRun > 0
+	pending := false // a throttled session has rooms left for the next run
 	totalImported := 0
+	var inaccessible []error // rooms the account isn't in and couldn't read
+
+	// Rooms already queued, so a predecessor that is also joined is imported once
+	queued := make(map[string]bool, len(roomIDs))
+	for _, roomID := range roomIDs {
+		queued[roomID] = true
+	}
+	queuePredecessor := func(roomID, predecessor string) {
+		if !opts.FollowUpgrades || predecessor == "" || queued[predecessor] {
+			return
+		}
+		queued[predecessor] = true
+		roomIDs = append(roomIDs, predecessor)
+		fmt.Printf("  Room %s replaced %s; queued its history\n", roomID, predecessor)
+	}
+
+	// Import from each room using enhanced client. Predecessors found along
+	// the way are appended to roomIDs, so the list can grow.
+	for i := 0; i < len(roomIDs); i++ {
+		roomID := roomIDs[i]
+		if enhanced.budgetExhausted() {
+			pending = true
+			break
+		}
+
+		if seal, err := db.GetRoomSeal(ctx, roomID); err != nil {
+			log.Printf("Warning: could not check whether %s is sealed: %v", roomID, err)
+		} else if seal != nil {
+			fmt.Printf("\n[%d/%d] Skipping room %s, sealed on %s\n", i+1, len(roomIDs), roomID, seal.SealedAt.Format(time.RFC3339))
+			continue
+		}
+
+		// Rooms whose import stopped partway, whether a throttled run ended or
+		// an import crashed, continue from the last committed batch
+		from := ""
+		state, err := db.GetImportState(ctx, roomID)
+		if err != nil {
+			log.Printf("Warning: could not read import state for %s: %v", roomID, err)
+		}
+		if throttled && state != nil && state.Complete {
+			fmt.Printf("\n[%d/%d] Skipping room %s, already imported in this session\n", i+1, len(roomIDs), roomID)
+			if version, err := db.GetRoomVersion(ctx, roomID); err == nil && version != nil {
+				queuePredecessor(roomID, version.PredecessorID)
+			}
+			continue
+		}
+		if state != nil && !state.Complete {
+			from = state.NextBatch
+		}
 
-	// Import from each room using enhanced client
-	for i, roomID := range roomIDs {
 		fmt.Printf("\n[%d/%d] Processing room: %s\n", i+1, len(roomIDs), roomID)
+		if from != "" {
+			fmt.Printf("  Resuming from the previous run's position\n")
+		}
+
+		left := joined != nil && !joined[roomID]
+		if left && opts.Peek {
+			if err := PeekRoom(ctx, client, roomID); err != nil {
+				log.Printf("Error importing from room %s: %v", roomID, err)
+				inaccessible = append(inaccessible, err)
+				continue
+			}
+			fmt.Printf("  Reading the world-readable room without joining\n")
+		} else if left && opts.Rejoin {
+			access, err := RejoinRoom(ctx, client, roomID)
+			if err != nil {
+				log.Printf("Error importing from room %s: %v", roomID, err)
+				inaccessible = append(inaccessible, err)
+				continue
+			}
+			if access == RoomAccessPeek {
+				fmt.Printf("  The account has left this world-readable room; reading it without joining\n")
+			} else {
+				fmt.Printf("  The account had left this room; joined it again\n")
+				left = false
+			}
+		}
 
-		count, err := enhanced.importEventsFromRoom(roomID, limit)
+		result, err := enhanced.importRoomHistory(roomID, opts.Limit, from)
+		queuePredecessor(roomID, result.Predecessor)
+		var hookErr *HookError
+		if errors.As(err, &hookErr) {
+			return err
+		}
+		if err != nil && left {
+			err = roomAccessError(roomID, err, opts.Rejoin)
+		}
+		var accessErr *RoomAccessError
+		if errors.As(err, &accessErr) {
+			inaccessible = append(inaccessible, err)
+		}
 		if err != nil {
 			log.Printf("Error importing from room %s: %v", roomID, err)
+			if result.NextBatch != "" {
+				// Let the next run retry from the failed page rather than from the start
+				saveImportState(ctx, db, &ImportState{RoomID: roomID, NextBatch: result.NextBatch})
+				pending = pending || throttled
+			}
 			continue
 		}
-		totalImported += count
-		fmt.Printf("✓ Imported %d messages from room %s\n", count, roomID)
+		totalImported += result.Imported
+		fmt.Printf("✓ Imported %d messages from room %s\n", result.Imported, roomID)
+
+		if throttled {
+			saveImportState(ctx, db, &ImportState{RoomID: roomID, NextBatch: result.NextBatch, Complete: !result.Interrupted})
+			pending = pending || result.Interrupted
+		} else if err := db.ClearImportState(ctx, roomID); err != nil {
+			log.Printf("Warning: %v", err)
+		}
 
 		// Show progress
 		if len(roomIDs) > 1 {
@@ -104,15 +358,58 @@ func ImportMessages(limit int, roomID string) error {
 		}
 	}
 
+	if throttled {
+		if pending {
+			fmt.Printf("\nStopped after fetching %d events (--max-events-per-run). Run the same import again to continue.\n", enhanced.eventsFetched)
+		} else {
+			if err := db.ClearImportState(ctx, ""); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+			fmt.Printf("\nAll rooms imported; the throttled import is complete.\n")
+		}
+	}
+
+	if len(inaccessible) > 0 {
+		fmt.Printf("\nCould not read %d rooms the account isn't in:\n", len(inaccessible))
+		for _, err := range inaccessible {
+			fmt.Printf("  %v\n", err)
+		}
+	}
+
+	enhanced.reportFailures()
+
 	// Get total message count
-	totalCount, err := GetDatabase().GetMessageCount(context.Background(), nil)
+	totalCount, err := db.GetMessageCount(ctx, nil)
 	if err != nil {
 		log.Printf("Failed to count total messages: %v", err)
 	} else {
 		fmt.Printf("The database now has %d total messages\n", totalCount)
 	}
 
-	return nil
+	return opts.Hooks.Run(&HookEvent{Hook: HookPostImport, Source: "matrix", RoomID: opts.RoomID, RoomIDs: roomIDs, Imported: totalImported})
+}
+
+// leftArchivedRooms returns the rooms with archived messages that aren't
+// among the joined rooms, in the order the archive lists them
+func leftArchivedRooms(ctx context.Context, db DatabaseInterface, joined map[string]bool) ([]string, error) {
+	archived, err := db.GetRooms(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list archived rooms: %w", err)
+	}
+	var left []string
+	for _, roomID := range archived {
+		if !joined[roomID] {
+			left = append(left, roomID)
+		}
+	}
+	return left, nil
+}
+
+// saveImportState records a room's import position, logging failures
+func saveImportState(ctx context.Context, db DatabaseInterface, state *ImportState) {
+	if err := db.SaveImportState(ctx, state); err != nil {
+		log.Printf("Warning: could not save import position for %s: %v", state.RoomID, err)
+	}
 }
 
 // ImportMessagesFromSpecificRoom imports messages from a specific room
@@ -193,10 +490,12 @@ func convertEventToMessage(evt *event.Event, roomID string) (*Message, error) {
 		RoomID:      roomID,
 		EventID:     evt.ID.String(),
 		Sender:      evt.Sender.String(),
-		MessageType: "m.room.message",
+		MessageType: evt.Type.Type,
+		MsgType:     contentMsgType(content),
 		Timestamp:   time.Unix(evt.Timestamp/1000, (evt.Timestamp%1000)*1000000),
 		Content:     content,
 	}
+	message.ForwardedFrom, message.ForwardedPlatform = DetectForward(message.Sender, message.Content)
 
 	return message, nil
 }
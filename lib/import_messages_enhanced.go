@@ -2,7 +2,9 @@ package archive
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"strings"
 	"time"
@@ -27,6 +29,62 @@ type EnhancedMatrixClient struct {
 	enableRetries bool
 	maxRetries    int
 	backoffTime   time.Duration
+
+	// Optional date range; zero values leave that side unbounded
+	since time.Time
+	until time.Time
+
+	// Also archive invites, knocks, kicks and bans to moderation_events
+	archiveModeration bool
+
+	// Filter for /messages requests; see EventFilter
+	filter *mautrix.FilterPart
+
+	// Truncates oversized content before it is stored; nil stores it whole
+	contentLimit *ContentLimit
+
+	// Whose messages are archived
+	senders SenderFilter
+
+	// How strictly messages are validated, and how many failed so far
+	validation  string
+	quarantined int
+
+	// Events recorded in failed_events so far
+	failed int
+
+	// Recover the real authors of messages bots and webhooks relay
+	attribution AttributionRules
+
+	// Store the language of each text message; see DetectMessageLanguage
+	detectLanguage bool
+
+	// onProgress, if set, is called after each batch with the room's running total
+	onProgress func(roomID string, imported int)
+
+	// post_batch hook commands, run after each stored batch
+	hooks Hooks
+
+	// Throttling: stop after maxEvents fetched events this run (0 = no cap),
+	// and sleep for pauseDuration after every pauseEvery events
+	maxEvents     int
+	pauseEvery    int
+	pauseDuration time.Duration
+	eventsFetched int
+	sincePause    int
+}
+
+// roomImportResult is the outcome of importing part of a room's history
+type roomImportResult struct {
+	Imported int
+
+	// The room this one replaced, if it is the result of a room upgrade
+	Predecessor string
+
+	// Set when the run's event budget ran out before the room's history did;
+	// NextBatch is where to continue from
+	Interrupted bool
+	NextBatch   string
 }
 
 // NewEnhancedMatrixClient creates a new enhanced Matrix client from an existing client
@@ -53,6 +111,9 @@ func NewEnhancedMatrixClient(client *mautrix.Client, db DatabaseInterface) (*Enh
 		enableRetries: true,
 		maxRetries:    3,
 		backoffTime:   2 * time.Second,
+		filter:        EventFilter(nil, nil),
+
+		detectLanguage: detectLanguageFromEnv(),
 	}
 
 	// Check if the client has crypto enabled
@@ -65,12 +126,35 @@ func NewEnhancedMatrixClient(client *mautrix.Client, db DatabaseInterface) (*Enh
 	return enhanced, nil
 }
 
-// importEventsFromRoom imports events from a specific room using enhanced mautrix-go features
-
-// importEventsFromRoom imports events from a specific room using enhanced features
+// importEventsFromRoom imports events from a specific room using enhanced
+// features, continuing an earlier import of the room that didn't finish
 func (e *EnhancedMatrixClient) importEventsFromRoom(roomID string, limit int) (int, error) {
+	ctx := context.Background()
+	from := ""
+	if state, err := e.db.GetImportState(ctx, roomID); err != nil {
+		log.Printf("Warning: could not read import state for %s: %v", roomID, err)
+	} else if state != nil && !state.Complete {
+		from = state.NextBatch
+	}
+	if from != "" {
+		fmt.Printf("  Resuming from where an interrupted import stopped\n")
+	}
+
+	result, err := e.importRoomHistory(roomID, limit, from)
+	if err == nil {
+		if err := e.db.ClearImportState(ctx, roomID); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	return result.Imported, err
+}
+
+// importRoomHistory paginates backward through a room's history starting at
+// from ("" = the latest events), stopping early if the run's event budget runs out
+func (e *EnhancedMatrixClient) importRoomHistory(roomID string, limit int, from string) (roomImportResult, error) {
 	ctx := context.Background()
 	roomIDTyped := id.RoomID(roomID)
+	result := roomImportResult{}
 
 	// Get room state information using mautrix state store
 	_, err := e.StateStore.GetRoomJoinedOrInvitedMembers(ctx, roomIDTyped)
@@ -78,66 +162,238 @@ func (e *EnhancedMatrixClient) importEventsFromRoom(roomID string, limit int) (i
 		log.Printf("Warning: Could not get room members for %s: %v", roomID, err)
 	}
 
-	// Use mautrix built-in pagination for message history
-	importCount := 0
-	var nextBatch string
+	if err := e.archivePinnedEvents(ctx, roomIDTyped); err != nil {
+		log.Printf("Warning: Could not archive pinned events for %s: %v", roomID, err)
+	}
 
-	for {
-		// Check if we've reached the limit
-		if limit > 0 && importCount >= limit {
-			break
-		}
+	if err := e.archiveRoomTags(ctx, roomIDTyped); err != nil {
+		log.Printf("Warning: Could not archive room tags for %s: %v", roomID, err)
+	}
 
-		// Calculate how many messages to fetch in this batch
-		batchLimit := 100 // Default batch size
-		if limit > 0 && limit-importCount < batchLimit {
-			batchLimit = limit - importCount
-		}
+	if err := e.archiveRoomEmotePacks(ctx, roomIDTyped); err != nil {
+		log.Printf("Warning: Could not archive emote packs for %s: %v", roomID, err)
+	}
 
-		// Get messages using mautrix built-in pagination
-		messages, err := e.Messages(ctx, roomIDTyped, nextBatch, "", mautrix.DirectionBackward, nil, batchLimit)
-		if err != nil {
-			return importCount, fmt.Errorf("failed to fetch messages: %w", err)
-		}
+	if err := e.archiveRoomProfile(ctx, roomIDTyped); err != nil {
+		log.Printf("Warning: Could not archive room profile for %s: %v", roomID, err)
+	}
 
-		if len(messages.Chunk) == 0 {
-			break
-		}
+	if version, err := e.archiveRoomVersion(ctx, roomIDTyped); err != nil {
+		log.Printf("Warning: Could not archive room version for %s: %v", roomID, err)
+	} else {
+		result.Predecessor = version.PredecessorID
+	}
 
-		// Process the batch using enhanced event processing
-		batchCount, err := e.processEventBatchEnhanced(messages.Chunk, roomID, limit-importCount)
-		if err != nil {
-			log.Printf("Error processing event batch: %v", err)
-		} else {
-			importCount += batchCount
+	// Use mautrix built-in pagination for message history
+	source := &roomHistorySource{e: e, roomID: roomID, nextBatch: from, stored: from}
+	pipeline := e.importPipeline(limit)
+	source.pipeline = pipeline
+	pipeline.OnBatch = func(imported int) {
+		if e.onProgress != nil {
+			e.onProgress(roomID, imported)
 		}
-
-		// Update next batch token
-		nextBatch = messages.End
-		if nextBatch == "" {
-			break
+		if source.fetched > 0 && source.nextBatch != "" {
+			fmt.Printf("  Processed batch of %d events, total imported: %d\n", source.fetched, imported)
 		}
+	}
+
+	result.Imported, err = pipeline.Run(ctx, source)
+	e.quarantined += pipeline.Quarantined
+	result.Interrupted = source.interrupted
+	if err != nil || source.interrupted {
+		result.NextBatch = source.stored
+	}
+	return result, err
+}
 
-		// Log progress
-		fmt.Printf("  Processed batch of %d events, total imported: %d\n", len(messages.Chunk), importCount)
+// importPipeline returns a pipeline storing messages with the client's
+// sender filter, date range and validation mode
+func (e *EnhancedMatrixClient) importPipeline(limit int) *ImportPipeline {
+	return &ImportPipeline{DB: e.db, Senders: e.senders, Since: e.since, Until: e.until, Limit: limit, Validation: e.validation,
+		Hooks: e.hooks, Source: "matrix"}
+}
+
+// roomHistorySource is the ImportSource of a room's history on the
+// homeserver, paginating backward from nextBatch ("" = the latest events)
+type roomHistorySource struct {
+	e        *EnhancedMatrixClient
+	roomID   string
+	pipeline *ImportPipeline // Sizes requests to the messages still wanted
+
+	nextBatch   string
+	stored      string // Where the pages not yet stored start
+	fetched     int    // Events in the last page
+	done        bool   // The last page reached the start of the history or of the date range
+	interrupted bool   // The run's event budget ran out before the room's history did
+	rateLimited int    // Consecutive rate-limited requests
+}
+
+// NextBatch fetches the next page of the room's history and returns its messages
+func (s *roomHistorySource) NextBatch(ctx context.Context) ([]*Message, error) {
+	e := s.e
+	if s.done {
+		return nil, io.EOF
+	}
+	if e.budgetExhausted() {
+		s.interrupted = true
+		return nil, io.EOF
+	}
+
+	// Calculate how many messages to fetch in this batch
+	batchLimit := 100 // Default batch size
+	if remaining := s.pipeline.remaining(); remaining > 0 && remaining < batchLimit {
+		batchLimit = remaining
+	}
+	if e.maxEvents > 0 && e.maxEvents-e.eventsFetched < batchLimit {
+		batchLimit = e.maxEvents - e.eventsFetched
 	}
 
-	return importCount, nil
+	// Get messages using mautrix built-in pagination
+	messages, err := e.Messages(ctx, id.RoomID(s.roomID), s.nextBatch, "", mautrix.DirectionBackward, e.filter, batchLimit)
+	if delay, limited := RateLimitDelay(err, e.backoffTime<<s.rateLimited); limited && e.enableRetries && s.rateLimited < e.maxRetries {
+		// Ask for the same batch again once the server allows it
+		s.rateLimited++
+		s.fetched = 0
+		log.Printf("Warning: %s is rate-limiting requests; retrying %s in %s", e.HomeserverURL.Host, s.roomID, delay.Round(time.Second))
+		time.Sleep(delay)
+		return nil, nil
+	}
+	s.rateLimited = 0
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch messages: %w", err)
+	}
+
+	if len(messages.Chunk) == 0 {
+		return nil, io.EOF
+	}
+	s.fetched = len(messages.Chunk)
+	batch := e.messagesFromEvents(ctx, messages.Chunk, s.roomID)
+	e.throttle(len(messages.Chunk))
+
+	// Update next batch token
+	s.nextBatch = messages.End
+	oldest := messages.Chunk[len(messages.Chunk)-1]
+	// Paginating backward, so once the oldest event precedes the range we're done
+	if s.nextBatch == "" || (!e.since.IsZero() && time.UnixMilli(oldest.Timestamp).Before(e.since)) {
+		s.done = true
+	}
+	return batch, nil
 }
 
-// processEventBatchEnhanced processes events using mautrix built-in parsers
+// BatchStored checkpoints after every committed batch, so an import that
+// crashes partway through a large room resumes from the following page
+func (s *roomHistorySource) BatchStored(ctx context.Context) {
+	s.stored = s.nextBatch
+	if s.nextBatch != "" {
+		s.e.saveCheckpoint(ctx, s.roomID, s.nextBatch)
+	}
+}
+
+// saveCheckpoint records the token to continue a room's import from
+func (e *EnhancedMatrixClient) saveCheckpoint(ctx context.Context, roomID, nextBatch string) {
+	if err := e.db.SaveImportState(ctx, &ImportState{RoomID: roomID, NextBatch: nextBatch}); err != nil {
+		log.Printf("Warning: could not save import position for %s: %v", roomID, err)
+	}
+}
+
+// RateLimitDelay reports whether err is the homeserver rejecting a request
+// with M_LIMIT_EXCEEDED, and how long to wait before retrying it: the
+// retry_after_ms the server asked for, or fallback if it gave none
+func RateLimitDelay(err error, fallback time.Duration) (time.Duration, bool) {
+	var respErr mautrix.RespError
+	if !errors.As(err, &respErr) || respErr.ErrCode != mautrix.MLimitExceeded.ErrCode {
+		return 0, false
+	}
+	if ms, ok := respErr.ExtraData["retry_after_ms"].(float64); ok && ms > 0 {
+		return time.Duration(ms) * time.Millisecond, true
+	}
+	return fallback, true
+}
+
+// budgetExhausted reports whether this run has fetched as many events as allowed
+func (e *EnhancedMatrixClient) budgetExhausted() bool {
+	return e.maxEvents > 0 && e.eventsFetched >= e.maxEvents
+}
+
+// throttle counts fetched events toward the run's budget and pauses every
+// pauseEvery events to spread the load on the homeserver
+func (e *EnhancedMatrixClient) throttle(fetched int) {
+	e.eventsFetched += fetched
+	e.sincePause += fetched
+	if e.pauseEvery > 0 && e.sincePause >= e.pauseEvery && !e.budgetExhausted() {
+		fmt.Printf("  Pausing for %s after %d events\n", e.pauseDuration, e.sincePause)
+		time.Sleep(e.pauseDuration)
+		e.sincePause = 0
+	}
+}
+
+// archivePinnedEvents stores the room's current m.room.pinned_events state
+func (e *EnhancedMatrixClient) archivePinnedEvents(ctx context.Context, roomID id.RoomID) error {
+	var content event.PinnedEventsEventContent
+	err := e.StateEvent(ctx, roomID, event.StatePinnedEvents, "", &content)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return err
+	}
+
+	// A room that never pinned anything has no state event; store that as no pins
+	eventIDs := make([]string, 0, len(content.Pinned))
+	for _, eventID := range content.Pinned {
+		eventIDs = append(eventIDs, eventID.String())
+	}
+	return e.db.SetPinnedEvents(ctx, roomID.String(), eventIDs)
+}
+
+// inDateRange reports whether a timestamp falls within the client's import date range
+func (e *EnhancedMatrixClient) inDateRange(ts time.Time) bool {
+	if !e.since.IsZero() && ts.Before(e.since) {
+		return false
+	}
+	if !e.until.IsZero() && !ts.Before(e.until) {
+		return false
+	}
+	return true
+}
+
+// processEventBatchEnhanced stores a batch of events through the import
+// pipeline, returning the number of messages stored
 func (e *EnhancedMatrixClient) processEventBatchEnhanced(events []*event.Event, roomID string, remainingLimit int) (int, error) {
 	ctx := context.Background()
-	importCount := 0
+	pipeline := e.importPipeline(remainingLimit)
+	err := pipeline.Store(ctx, e.messagesFromEvents(ctx, events, roomID))
+	e.quarantined += pipeline.Quarantined
+	return pipeline.Imported, err
+}
 
-	// Use smaller batch sizes for database operations
-	const dbBatchSize = 100
-	var messageBatch []*Message
+// messagesFromEvents converts a page of events to messages using mautrix
+// built-in parsers. Membership changes, moderation actions and tombstones are
+// stored as they are found; the messages are left to the import pipeline.
+func (e *EnhancedMatrixClient) messagesFromEvents(ctx context.Context, events []*event.Event, roomID string) []*Message {
+	var messages []*Message
+	var membershipBatch []*MembershipEvent
+	var moderationBatch []*ModerationEvent
 
 	for _, evt := range events {
-		// Check limit
-		if remainingLimit > 0 && importCount >= remainingLimit {
-			break
+		// A tombstone records when the room was upgraded, and to which room
+		if evt.Type == event.StateTombstone {
+			if version := convertTombstoneEvent(evt, roomID); version != nil {
+				if err := e.db.SaveRoomVersion(ctx, version); err != nil {
+					log.Printf("Failed to save room upgrade: %v", err)
+				}
+			}
+			continue
+		}
+
+		// Membership changes are kept separately and don't count toward the limit
+		if evt.Type == event.StateMember {
+			if membership := convertMemberEvent(evt, roomID); membership != nil && e.inDateRange(membership.Timestamp) {
+				membershipBatch = append(membershipBatch, membership)
+			}
+			if e.archiveModeration {
+				if moderation := convertModerationEvent(evt, roomID); moderation != nil && e.inDateRange(moderation.Timestamp) {
+					moderationBatch = append(moderationBatch, moderation)
+				}
+			}
+			continue
 		}
 
 		// Filter for supported message events using mautrix built-in type checking
@@ -150,46 +406,59 @@ func (e *EnhancedMatrixClient) processEventBatchEnhanced(events []*event.Event,
 			continue
 		}
 
+		// Skip messages the pipeline would drop before converting them, since
+		// conversion may write oversized content to a file
+		if !e.senders.Archives(evt.Sender.String()) || !e.inDateRange(time.UnixMilli(evt.Timestamp)) {
+			continue
+		}
+
 		// Convert event to Message struct using enhanced parsing
 		message, err := e.convertEventToMessageEnhanced(evt, roomID)
 		if err != nil {
 			log.Printf("Failed to convert event %s: %v", evt.ID, err)
+			e.recordFailure(ctx, evt, roomID, FailureConversion, err)
 			continue
 		}
 
-		// Validate message
-		if err := message.Validate(); err != nil {
-			log.Printf("Invalid message %s: %v", evt.ID, err)
+		// The server filtered encrypted events by their outer type; check
+		// the type they turned out to have
+		if evt.Type == event.EventEncrypted && message.MessageType != EventTypeEncrypted && !EventFilterIncludes(e.filter, message.MessageType) {
 			continue
 		}
+		messages = append(messages, message)
+	}
 
-		// Add to batch
-		messageBatch = append(messageBatch, message)
+	if _, err := e.db.InsertMembershipEvents(ctx, membershipBatch); err != nil {
+		log.Printf("Failed to insert membership events: %v", err)
+	}
+	if _, err := e.db.InsertModerationEvents(ctx, moderationBatch); err != nil {
+		log.Printf("Failed to insert moderation events: %v", err)
+	}
 
-		// Process batch when it reaches the limit
-		if len(messageBatch) >= dbBatchSize || (remainingLimit > 0 && importCount+len(messageBatch) >= remainingLimit) {
-			insertedCount, err := e.db.InsertMessageBatch(ctx, messageBatch)
-			if err != nil {
-				log.Printf("Failed to insert batch: %v", err)
-			} else {
-				importCount += insertedCount
-			}
-			// Clear batch to free memory
-			messageBatch = messageBatch[:0]
-		}
+	return messages
+}
+
+// convertMemberEvent extracts the membership and profile from an m.room.member event
+func convertMemberEvent(evt *event.Event, roomID string) *MembershipEvent {
+	if evt.StateKey == nil || *evt.StateKey == "" {
+		return nil
 	}
 
-	// Process any remaining messages in the batch
-	if len(messageBatch) > 0 {
-		insertedCount, err := e.db.InsertMessageBatch(ctx, messageBatch)
-		if err != nil {
-			log.Printf("Failed to insert final batch: %v", err)
-		} else {
-			importCount += insertedCount
-		}
+	if err := evt.Content.ParseRaw(evt.Type); err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+		log.Printf("Failed to parse membership event %s: %v", evt.ID, err)
+		return nil
 	}
+	content := evt.Content.AsMember()
 
-	return importCount, nil
+	return &MembershipEvent{
+		EventID:     evt.ID.String(),
+		RoomID:      roomID,
+		UserID:      *evt.StateKey,
+		Membership:  string(content.Membership),
+		DisplayName: content.Displayname,
+		AvatarURL:   string(content.AvatarURL),
+		Timestamp:   time.UnixMilli(evt.Timestamp),
+	}
 }
 
 // isMessageEvent checks if an event type is a supported message event using mautrix constants
@@ -209,6 +478,7 @@ func (e *EnhancedMatrixClient) isMessageEvent(eventType event.Type) bool {
 func (e *EnhancedMatrixClient) convertEventToMessageEnhanced(evt *event.Event, roomID string) (*Message, error) {
 	// Use mautrix built-in content parsing
 	var content map[string]interface{}
+	var decryptErr error // Why an encrypted event is stored as a placeholder
 
 	log.Printf("DEBUG: Processing event %s of type %s", evt.ID, evt.Type)
 	log.Printf("DEBUG: Raw content: %+v", evt.Content.Raw)
@@ -279,6 +549,7 @@ func (e *EnhancedMatrixClient) convertEventToMessageEnhanced(evt *event.Event, r
 			decryptedEvt, err := e.Client.Crypto.Decrypt(context.Background(), evt)
 			if err != nil {
 				log.Printf("DEBUG: Failed to decrypt event %s: %v", evt.ID, err)
+				decryptErr = err
 			} else if decryptedEvt != nil {
 				log.Printf("DEBUG: Successfully decrypted event %s", evt.ID)
 				// Use the decrypted event content
@@ -313,6 +584,7 @@ func (e *EnhancedMatrixClient) convertEventToMessageEnhanced(evt *event.Event, r
 							"session_id": evt.Content.Raw["session_id"],
 						}
 						log.Printf("DEBUG: Decrypted event but couldn't parse content")
+						decryptErr = errors.New("the decrypted content has no body")
 					}
 				}
 			} else {
@@ -324,6 +596,7 @@ func (e *EnhancedMatrixClient) convertEventToMessageEnhanced(evt *event.Event, r
 					"session_id": evt.Content.Raw["session_id"],
 				}
 				log.Printf("DEBUG: Event decryption returned nil")
+				decryptErr = errors.New("decryption returned no event")
 			}
 		} else {
 			// No crypto helper available, use encrypted placeholder
@@ -334,6 +607,7 @@ func (e *EnhancedMatrixClient) convertEventToMessageEnhanced(evt *event.Event, r
 				"session_id": evt.Content.Raw["session_id"],
 			}
 			log.Printf("DEBUG: No crypto helper available for decryption")
+			decryptErr = errors.New("encryption is not available")
 		}
 
 	default:
@@ -344,13 +618,38 @@ func (e *EnhancedMatrixClient) convertEventToMessageEnhanced(evt *event.Event, r
 	// Use content directly - DuckDB JSON storage doesn't need dot replacement
 	processedContent := content
 
+	// Encrypted events are stored under their decrypted type, or as
+	// m.room.encrypted when only a placeholder could be stored
+	eventType := evt.Type.Type
+	if evt.Type == event.EventEncrypted {
+		eventType = inferEventType(processedContent)
+	}
+
 	message := &Message{
 		RoomID:      roomID,
 		EventID:     evt.ID.String(),
 		Sender:      evt.Sender.String(),
-		MessageType: "m.room.message",
+		MessageType: eventType,
+		MsgType:     contentMsgType(processedContent),
 		Timestamp:   time.Unix(evt.Timestamp/1000, (evt.Timestamp%1000)*1000000),
 		Content:     processedContent,
+		Account:     e.UserID.String(),
+
+		Aggregations: NewBundledAggregations(evt.Unsigned.Relations),
+	}
+	message.ForwardedFrom, message.ForwardedPlatform = DetectForward(message.Sender, message.Content)
+	e.attribution.Apply(message)
+	if e.detectLanguage {
+		message.Lang = DetectMessageLanguage(message)
+	}
+	if decryptErr != nil {
+		e.recordFailure(context.Background(), evt, roomID, FailureDecryption, decryptErr)
+	}
+
+	if truncated, err := e.contentLimit.Apply(message); err != nil {
+		return nil, err
+	} else if truncated {
+		log.Printf("Truncated the content of %s to %s", message.EventID, FormatSize(e.contentLimit.MaxSize))
 	}
 
 	return message, nil
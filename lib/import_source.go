@@ -0,0 +1,303 @@
+package archive
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// ImportSource supplies messages to import, a batch at a time. A room's
+// history on the homeserver is one source and a file of archived messages
+// is another; every source is stored through the same ImportPipeline.
+type ImportSource interface {
+	// NextBatch returns the next messages to import, or io.EOF once there
+	// are no more. A batch may be empty.
+	NextBatch(ctx context.Context) ([]*Message, error)
+}
+
+// ImportCheckpointer is implemented by sources that record their position
+// once a batch is stored, so that an interrupted import resumes after it.
+// A batch that fails to store ends the import without a checkpoint, so a
+// resumed import fetches it again.
+type ImportCheckpointer interface {
+	BatchStored(ctx context.Context)
+}
+
+// importBatchSize is the number of messages inserted per database batch
+const importBatchSize = 100
+
+// ImportPipeline stores the messages an ImportSource supplies. It drops
+// messages from filtered-out senders, outside the date range, in sealed
+// rooms or that repeat an event in the same batch, quarantines those that
+// fail validation, and inserts the rest in batches. Events already archived
+// are skipped by the database; those whose event ID is archived in another
+// room are quarantined too.
+type ImportPipeline struct {
+	DB      DatabaseInterface
+	Senders SenderFilter
+
+	// Optional date range; zero values leave that side unbounded
+	Since time.Time
+	Until time.Time
+
+	Limit int // Stop after importing this many messages (0 = no limit)
+
+	Validation string // Validation mode; "" is ValidationStandard
+
+	Source string // What is imported, for hooks: matrix or a file name
+
+	// OnBatch, if set, is called after each batch with the running total
+	OnBatch func(imported int)
+
+	// Hooks' post_batch commands are run after each stored batch
+	Hooks Hooks
+
+	stored []*Message // Messages of the last batch that passed the filters
+
+	Imported    int // Messages imported so far
+	Quarantined int // Messages that failed validation or collided with another room's event ID
+
+	sealed map[string]bool // Rooms whose seal has been looked up
+	rooms  map[string]bool // Rooms messages were imported into
+}
+
+// Run stores batches from source until it runs out or the limit is reached,
+// and returns the number of messages imported. Once it is done, it reconciles
+// the relations in the rooms it imported into (see ReconcileRelations), since
+// pages of history arrive newest first and a reaction or edit is often
+// stored before the message it refers to.
+func (p *ImportPipeline) Run(ctx context.Context, source ImportSource) (int, error) {
+	defer p.reconcileRelations(ctx)
+
+	for !p.limitReached() {
+		messages, err := source.NextBatch(ctx)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return p.Imported, err
+		}
+		if err := p.Store(ctx, messages); err != nil {
+			return p.Imported, fmt.Errorf("failed to insert batch: %w", err)
+		}
+		if checkpointer, ok := source.(ImportCheckpointer); ok {
+			checkpointer.BatchStored(ctx)
+		}
+		if p.OnBatch != nil {
+			p.OnBatch(p.Imported)
+		}
+		if len(p.stored) > 0 {
+			if err := p.Hooks.Run(&HookEvent{Hook: HookPostBatch, Source: p.Source, Imported: p.Imported, Messages: p.stored}); err != nil {
+				return p.Imported, err
+			}
+		}
+	}
+	return p.Imported, nil
+}
+
+// remaining returns how many more messages may be imported, or 0 without a limit
+func (p *ImportPipeline) remaining() int {
+	if p.Limit <= 0 {
+		return 0
+	}
+	return p.Limit - p.Imported
+}
+
+func (p *ImportPipeline) limitReached() bool {
+	return p.Limit > 0 && p.Imported >= p.Limit
+}
+
+// Store filters and inserts one batch of messages
+func (p *ImportPipeline) Store(ctx context.Context, messages []*Message) error {
+	p.stored = nil
+	var batch []*Message
+	seen := make(map[string]bool, len(messages))
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		inserted, err := p.DB.InsertMessageBatch(ctx, batch)
+		var collided *EventIDCollisionError
+		if errors.As(err, &collided) {
+			// Keep the messages that collided where they can be found
+			for _, c := range collided.Collisions {
+				p.quarantine(ctx, c.Message, fmt.Errorf("event ID already archived in room %s (account %q)", c.ExistingRoomID, c.ExistingAccount))
+			}
+		} else if err != nil {
+			return err
+		}
+		if inserted > 0 {
+			if p.rooms == nil {
+				p.rooms = make(map[string]bool)
+			}
+			for _, message := range batch {
+				p.rooms[message.RoomID] = true
+			}
+		}
+		p.Imported += inserted
+		p.stored = append(p.stored, batch...)
+		batch = batch[:0]
+		return nil
+	}
+
+	for _, message := range messages {
+		if p.Limit > 0 && p.Imported+len(batch) >= p.Limit {
+			break
+		}
+		if !p.Senders.Archives(message.Sender) || !p.inDateRange(message.Timestamp) || seen[message.EventID] {
+			continue
+		}
+		if sealed, err := p.isSealed(ctx, message.RoomID); err != nil {
+			return err
+		} else if sealed {
+			continue
+		}
+		if err := message.ValidateWith(p.Validation); err != nil {
+			p.quarantine(ctx, message, err)
+			continue
+		}
+		seen[message.EventID] = true
+		batch = append(batch, message)
+		if len(batch) >= importBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// reconcileRelations records the relations whose targets still aren't
+// archived in each room the pipeline imported into, and reports how many
+// earlier imports left unresolved that are now linked
+func (p *ImportPipeline) reconcileRelations(ctx context.Context) {
+	for roomID := range p.rooms {
+		linked, unresolved, err := reconcileRoomRelations(ctx, p.DB, roomID)
+		if err != nil {
+			log.Printf("Warning: could not reconcile relations in %s: %v", roomID, err)
+			continue
+		}
+		if linked > 0 {
+			fmt.Fprintf(progressWriter(), "  Linked %d reactions, edits and replies to messages imported after them\n", linked)
+		}
+		if unresolved > 0 {
+			fmt.Fprintf(progressWriter(), "  %d reactions, edits and replies refer to messages not archived yet\n", unresolved)
+		}
+	}
+	p.rooms = nil
+}
+
+// inDateRange reports whether a timestamp falls within the pipeline's date range
+func (p *ImportPipeline) inDateRange(ts time.Time) bool {
+	if !p.Since.IsZero() && ts.Before(p.Since) {
+		return false
+	}
+	if !p.Until.IsZero() && !ts.Before(p.Until) {
+		return false
+	}
+	return true
+}
+
+// isSealed reports whether a room is sealed, looking each room up once
+func (p *ImportPipeline) isSealed(ctx context.Context, roomID string) (bool, error) {
+	if sealed, ok := p.sealed[roomID]; ok {
+		return sealed, nil
+	}
+	seal, err := p.DB.GetRoomSeal(ctx, roomID)
+	if err != nil {
+		return false, err
+	}
+	if p.sealed == nil {
+		p.sealed = make(map[string]bool)
+	}
+	p.sealed[roomID] = seal != nil
+	if seal != nil {
+		log.Printf("Skipping messages for sealed room %s", roomID)
+	}
+	return seal != nil, nil
+}
+
+// JSONLinesSource reads archived messages from JSON Lines: one Message
+// object per line, as written by programs iterating over Archiver.Messages
+type JSONLinesSource struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+// NewJSONLinesSource returns a source reading messages from r
+func NewJSONLinesSource(r io.Reader) *JSONLinesSource {
+	scanner := bufio.NewScanner(r)
+	// Messages with large formatted bodies don't fit the default 64 KiB line
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	return &JSONLinesSource{scanner: scanner}
+}
+
+// NextBatch returns up to importBatchSize messages
+func (s *JSONLinesSource) NextBatch(ctx context.Context) ([]*Message, error) {
+	var messages []*Message
+	for len(messages) < importBatchSize && s.scanner.Scan() {
+		s.line++
+		line := s.scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		message := &Message{}
+		if err := json.Unmarshal(line, message); err != nil {
+			return nil, fmt.Errorf("line %d: %w", s.line, err)
+		}
+		messages = append(messages, message)
+	}
+	if err := s.scanner.Err(); err != nil {
+		return nil, fmt.Errorf("line %d: %w", s.line+1, err)
+	}
+	if len(messages) == 0 {
+		return nil, io.EOF
+	}
+	return messages, ctx.Err()
+}
+
+// ImportFile imports the archived messages in a JSON Lines file into the
+// archive, through the same filtering, validation and batching as imports
+// from Matrix
+func ImportFile(filename string, senders SenderFilter, validation string, hooks Hooks) error {
+	if err := CheckValidationMode(validation); err != nil {
+		return err
+	}
+	senders = senders.OrEnv()
+	if err := senders.Validate(); err != nil {
+		return err
+	}
+	if err := hooks.Run(&HookEvent{Hook: HookPreImport, Source: filename}); err != nil {
+		return err
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", filename, err)
+	}
+	defer file.Close()
+
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+	if err := senders.DenyOptedOut(context.Background(), GetDatabase()); err != nil {
+		return err
+	}
+
+	pipeline := &ImportPipeline{DB: GetDatabase(), Senders: senders, Validation: validation, Hooks: hooks, Source: filename}
+	imported, err := pipeline.Run(context.Background(), NewJSONLinesSource(file))
+	if err != nil {
+		return fmt.Errorf("failed to import %s: %w", filename, err)
+	}
+	fmt.Printf("✓ Imported %d messages from %s\n", imported, filename)
+	reportQuarantined(pipeline.Quarantined)
+	return hooks.Run(&HookEvent{Hook: HookPostImport, Source: filename, Imported: imported})
+}
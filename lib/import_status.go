@@ -0,0 +1,58 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// ShowImportStatus prints per-account archive statistics
+func ShowImportStatus() error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	stats, err := GetDatabase().GetAccountStats(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to get account stats: %w", err)
+	}
+
+	if jsonOutput() {
+		if stats == nil {
+			stats = []*AccountStats{}
+		}
+		return writeJSON(stats)
+	}
+
+	if len(stats) == 0 {
+		fmt.Println("The database has no archived messages")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Account\tMessages\tRooms\tFirst Message\tLast Message")
+	fmt.Fprintln(w, "-------\t--------\t-----\t-------------\t------------")
+
+	var totalMessages int64
+	for _, s := range stats {
+		account := s.Account
+		if account == "" {
+			account = "(unknown)"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n",
+			account,
+			s.MessageCount,
+			s.RoomCount,
+			s.FirstMessage.Format(time.RFC3339),
+			s.LastMessage.Format(time.RFC3339))
+		totalMessages += s.MessageCount
+	}
+
+	w.Flush()
+	fmt.Printf("\n%d messages from %d accounts\n", totalMessages, len(stats))
+	return nil
+}
@@ -0,0 +1,187 @@
+package archive
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// InitOptions are the choices init makes when setting up an archive
+type InitOptions struct {
+	Database     string // Archive database file; stored in the configuration as an absolute path
+	BeeperDomain string // Beeper domain to log in to
+	MediaDir     string // Directory to create thumbnails/ and images/ in
+	MediaLayout  string // Layout of the media directories: flat or hashed
+	Force        bool   // Replace a configuration file with different settings
+	Login        bool   // Log in to Beeper once everything else is set up
+}
+
+// DefaultInitOptions returns the settings init proposes: those of the
+// existing configuration and environment, or the defaults
+func DefaultInitOptions() *InitOptions {
+	opts := &InitOptions{
+		Database:     os.Getenv("DUCKDB_URL"),
+		BeeperDomain: os.Getenv("BEEPER_DOMAIN"),
+		MediaDir:     ".",
+		MediaLayout:  MediaLayoutFlat,
+	}
+	if opts.Database == "" {
+		opts.Database = "matrix_archive.duckdb"
+	}
+	if opts.BeeperDomain == "" {
+		opts.BeeperDomain = "beeper.com"
+	}
+	return opts
+}
+
+// PromptInitOptions asks for each setting on out, reading the answers from
+// in. Empty answers keep the settings opts already has.
+func PromptInitOptions(opts *InitOptions, in io.Reader, out io.Writer) error {
+	reader := bufio.NewReader(in)
+	ask := func(question, value string) (string, error) {
+		fmt.Fprintf(out, "%s [%s]: ", question, value)
+		answer, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if answer = strings.TrimSpace(answer); answer != "" {
+			return answer, nil
+		}
+		return value, nil
+	}
+
+	var err error
+	if opts.Database, err = ask("Archive database file", opts.Database); err != nil {
+		return err
+	}
+	if opts.MediaDir, err = ask("Directory for downloaded media", opts.MediaDir); err != nil {
+		return err
+	}
+	for {
+		if opts.MediaLayout, err = ask("Media layout (flat or hashed)", opts.MediaLayout); err != nil {
+			return err
+		}
+		if opts.MediaLayout != "" && IsValidMediaLayout(opts.MediaLayout) {
+			break
+		}
+		fmt.Fprintf(out, "Please answer %s or %s\n", MediaLayoutFlat, MediaLayoutHashed)
+		opts.MediaLayout = MediaLayoutFlat
+	}
+	if opts.BeeperDomain, err = ask("Beeper domain", opts.BeeperDomain); err != nil {
+		return err
+	}
+	login := "n"
+	if opts.Login {
+		login = "y"
+	}
+	if login, err = ask("Log in to Beeper now? (y/n)", login); err != nil {
+		return err
+	}
+	opts.Login = strings.HasPrefix(strings.ToLower(login), "y")
+	return nil
+}
+
+// InitArchive sets up everything the other commands need: it writes the
+// configuration file, creates the archive database with its schema and the
+// media directories, and logs in to Beeper if opts.Login is set. Running it
+// again is safe; whatever already exists is kept, and a configuration file
+// with different settings is only replaced with opts.Force.
+func InitArchive(opts *InitOptions) error {
+	if !IsValidMediaLayout(opts.MediaLayout) || opts.MediaLayout == "" {
+		return fmt.Errorf("unsupported media layout %s, supported layouts: %s, %s", opts.MediaLayout, MediaLayoutFlat, MediaLayoutHashed)
+	}
+	database, err := filepath.Abs(opts.Database)
+	if err != nil {
+		return fmt.Errorf("failed to resolve database path: %w", err)
+	}
+
+	if err := writeInitConfig(&Config{Database: database, BeeperDomain: opts.BeeperDomain}, opts.Force); err != nil {
+		return err
+	}
+
+	_, statErr := os.Stat(database)
+	cfg := DefaultDatabaseConfig()
+	cfg.DatabaseURL = database
+	cfg.IsInMemory = false
+	cfg.MustExist = false
+	if err := InitDatabase(cfg); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	CloseDatabase()
+	if os.IsNotExist(statErr) {
+		fmt.Printf("✓ Created the archive database %s\n", database)
+	} else {
+		fmt.Printf("✓ The archive database %s is up to date\n", database)
+	}
+
+	for _, name := range []string{"thumbnails", "images"} {
+		dir := filepath.Join(opts.MediaDir, name)
+		if err := initMediaDir(dir, opts.MediaLayout); err != nil {
+			return err
+		}
+		fmt.Printf("✓ Media directory %s (%s layout)\n", dir, opts.MediaLayout)
+	}
+
+	if opts.Login {
+		if err := PerformBeeperLogin(opts.BeeperDomain, false, false); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("\nRun 'matrix-archive list' to see your rooms and 'matrix-archive import' to archive them.")
+	if !opts.Login {
+		fmt.Println("Run 'matrix-archive beeper-login' first to log in.")
+	}
+	return nil
+}
+
+// writeInitConfig saves cfg as the configuration file, unless one with
+// different settings exists and force isn't set
+func writeInitConfig(cfg *Config, force bool) error {
+	path, err := ConfigPath()
+	if err != nil {
+		return err
+	}
+	existing, err := LoadConfig()
+	if err != nil && !force {
+		return err
+	}
+	if existing != nil {
+		// Init only writes the database and domain; other settings are kept
+		cfg.ExportTemplates, cfg.Hooks = existing.ExportTemplates, existing.Hooks
+	}
+	if existing != nil && existing.Database == cfg.Database && existing.BeeperDomain == cfg.BeeperDomain {
+		fmt.Printf("✓ Configuration %s is up to date\n", path)
+		return nil
+	}
+	if existing != nil && !force {
+		return fmt.Errorf("%s already exists with different settings (database %s, Beeper domain %s); use --force to replace it",
+			path, existing.Database, existing.BeeperDomain)
+	}
+	if err := cfg.Save(); err != nil {
+		return err
+	}
+	fmt.Printf("✓ Wrote configuration %s\n", path)
+	return nil
+}
+
+// initMediaDir creates a media directory in a layout. A hashed directory
+// gets an empty index, so later downloads keep to that layout.
+func initMediaDir(dir, layout string) error {
+	if _, err := OpenMediaDir(dir, layout); err != nil {
+		return err
+	}
+	if layout != MediaLayoutHashed {
+		return nil
+	}
+	index := filepath.Join(dir, MediaIndexFile)
+	if _, err := os.Stat(index); os.IsNotExist(err) {
+		if err := os.WriteFile(index, nil, 0644); err != nil {
+			return fmt.Errorf("failed to create media index: %w", err)
+		}
+	}
+	return nil
+}
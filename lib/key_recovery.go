@@ -21,7 +21,7 @@ func RecoverKeysFromBackup(recoveryKey string) error {
 	}
 
 	// Initialize crypto manager with client using the same path as import
-	cryptoDbPath := "./crypto_store"
+	cryptoDbPath := cryptoStorePath()
 	cryptoManager, err := NewCryptoManager(client, cryptoDbPath)
 	if err != nil {
 		return fmt.Errorf("failed to initialize crypto manager: %w", err)
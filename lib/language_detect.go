@@ -0,0 +1,357 @@
+package archive
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+)
+
+// DetectLanguageEnv, set to true, detects the language of messages as they
+// are imported; see DetectLanguage
+const DetectLanguageEnv = "MATRIX_ARCHIVE_DETECT_LANGUAGE"
+
+// LanguageUndetermined stands for messages whose language couldn't be told
+// in language counts, as in ISO 639-2
+const LanguageUndetermined = "und"
+
+// minLanguageWords is the number of words of Latin-script text needed to
+// tell its language; shorter messages are too often ambiguous
+const minLanguageWords = 3
+
+// languageProfiles are the most frequent words of the Latin-script languages
+// DetectLanguage tells apart
+var languageProfiles = map[string]string{
+	"en": `the and to of a in is it you that i for on this be with are have not was but they we what
+		can just do so if my me at there about your all will would from he she an or one like think
+		get know what's don't it's i'm there's been were some how when then than them`,
+	"de": `der die das und ist nicht ich es zu ein eine sie wir mit den auf auch sich von für dass aber
+		wie noch nur mal schon hab habe bin kann wenn oder du ja nein gibt dem des im war sind
+		hat mir mich dich dir uns euch was wird werden bei nach einen einem doch jetzt hier`,
+	"fr": `le la les de et est un une je pas que des en il vous pour qui ne dans ce sur mais avec on
+		tu au du ça c'est suis sont plus bien aussi oui non si nous ils elle très j'ai fait être
+		faut cette comme peut tout sa son ses leur aux y`,
+	"es": `el la de que y en los es no un una por se las con para lo pero del está muy como yo
+		también hay esto eso sí tengo bueno gracias qué al si te me mi su sus bien cuando donde
+		porque ya todo más fue ser tiene creo puedo ahora nos hacer`,
+	"it": `il di che e la è non un per una sono mi ho lo ma gli le con si questo anche come ci
+		della perché sì grazie cosa molto se ti del al nel alla io tu hai ha sei siamo hanno
+		fatto bene va più solo tutto ancora sempre dei`,
+	"pt": `o de que e a não é um uma para com os do da em no na se mas eu você isso está muito
+		também obrigado sim tem ao dos das pelo pela foi ser vai já mais quando meu minha
+		como aqui agora só acho estou`,
+	"nl": `de het een en van is dat ik niet je op te zijn met voor maar ook er wat dit hij we
+		naar heb kan nog wel geen als bij om dan zo hebben was wordt jij mij ze moet moeten
+		goed echt even al`,
+}
+
+// languageLetters are letters only some of the Latin-script languages use
+var languageLetters = map[rune][]string{
+	'ß': {"de"}, 'ä': {"de"}, 'ö': {"de"}, 'ü': {"de"},
+	'ñ': {"es"}, '¿': {"es"}, '¡': {"es"},
+	'ç': {"fr", "pt"}, 'œ': {"fr"}, 'è': {"fr", "it"}, 'ê': {"fr", "pt"}, 'ù': {"fr"}, 'û': {"fr"}, 'î': {"fr"},
+	'ã': {"pt"}, 'õ': {"pt"},
+	'á': {"es", "pt"}, 'í': {"es", "pt"}, 'ó': {"es", "pt"}, 'ú': {"es", "pt"},
+	'ò': {"it"}, 'ì': {"it"},
+	'ĳ': {"nl"},
+}
+
+// languageWords indexes languageProfiles by word
+var languageWords = func() map[string][]string {
+	words := make(map[string][]string)
+	for lang, list := range languageProfiles {
+		for _, word := range strings.Fields(list) {
+			words[word] = append(words[word], lang)
+		}
+	}
+	return words
+}()
+
+// DetectedLanguages returns the languages DetectLanguage can return
+func DetectedLanguages() []string {
+	languages := []string{"ar", "el", "fa", "he", "hi", "ja", "ko", "ru", "th", "uk", "zh"}
+	for lang := range languageProfiles {
+		languages = append(languages, lang)
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// DetectLanguage guesses the language of text, returning its ISO 639-1 code,
+// or "" when the text is too short or too mixed to tell. Languages with a
+// script of their own are told by their script; English, German, French,
+// Spanish, Italian, Portuguese and Dutch by their most frequent words and
+// the letters only some of them use. Links and Matrix IDs are ignored.
+func DetectLanguage(text string) string {
+	text = analyzerNoise.ReplaceAllString(text, " ")
+	text = strings.ToLower(strings.ReplaceAll(text, "’", "'"))
+
+	if lang := detectScriptLanguage(text); lang != "" {
+		return lang
+	}
+
+	scores := make(map[string]float64)
+	words := 0
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool {
+		return !isWordRune(r) && r != '\''
+	}) {
+		word = strings.Trim(word, "'")
+		if word == "" || !unicode.IsLetter([]rune(word)[0]) {
+			continue
+		}
+		words++
+		// Words several languages share count for each of them a little
+		if langs := languageWords[word]; len(langs) > 0 {
+			for _, lang := range langs {
+				scores[lang] += 1 / float64(len(langs))
+			}
+		}
+		for _, r := range word {
+			for _, lang := range languageLetters[r] {
+				scores[lang] += 0.5
+			}
+		}
+	}
+	if words < minLanguageWords {
+		return ""
+	}
+
+	best, bestScore, runnerUp := "", 0.0, 0.0
+	for lang, score := range scores {
+		switch {
+		case score > bestScore || score == bestScore && lang < best:
+			runnerUp = bestScore
+			best, bestScore = lang, score
+		case score > runnerUp:
+			runnerUp = score
+		}
+	}
+	if bestScore < 1 || bestScore <= runnerUp*1.2 {
+		return ""
+	}
+	return best
+}
+
+// detectScriptLanguage returns the language of text written mostly in a
+// script one language, or a family of them, uses, or "" for Latin and
+// mixed text
+func detectScriptLanguage(text string) string {
+	counts := make(map[*unicode.RangeTable]int)
+	scripts := []*unicode.RangeTable{unicode.Latin, unicode.Cyrillic, unicode.Greek, unicode.Arabic,
+		unicode.Hebrew, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul, unicode.Thai, unicode.Devanagari}
+	letters := 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		for _, script := range scripts {
+			if unicode.Is(script, r) {
+				counts[script]++
+				break
+			}
+		}
+	}
+	if letters < 2 || counts[unicode.Latin]*2 >= letters {
+		return ""
+	}
+
+	// Japanese mixes kana with kanji, which alone read as Chinese
+	kana := counts[unicode.Hiragana] + counts[unicode.Katakana]
+	switch {
+	case kana > 0 && (kana+counts[unicode.Han])*2 > letters:
+		return "ja"
+	case counts[unicode.Han]*2 > letters:
+		return "zh"
+	case counts[unicode.Hangul]*2 > letters:
+		return "ko"
+	case counts[unicode.Cyrillic]*2 > letters:
+		if strings.ContainsAny(text, "іїєґ") {
+			return "uk"
+		}
+		return "ru"
+	case counts[unicode.Arabic]*2 > letters:
+		if strings.ContainsAny(text, "پچژگ") {
+			return "fa"
+		}
+		return "ar"
+	case counts[unicode.Greek]*2 > letters:
+		return "el"
+	case counts[unicode.Hebrew]*2 > letters:
+		return "he"
+	case counts[unicode.Thai]*2 > letters:
+		return "th"
+	case counts[unicode.Devanagari]*2 > letters:
+		return "hi"
+	}
+	return ""
+}
+
+// DetectMessageLanguage guesses the language of a text, notice or emote
+// message, reading an edit's new text and leaving out the quote of a reply.
+// It returns "" for other events and when the language can't be told.
+func DetectMessageLanguage(msg *Message) string {
+	if msg.MessageType != EventTypeMessage {
+		return ""
+	}
+	content := msg.Content
+	if newContent, ok := content["m.new_content"].(map[string]interface{}); ok && isEdit(msg) {
+		content = newContent
+	}
+	switch contentMsgType(content) {
+	case "m.text", "m.notice", "m.emote":
+	default:
+		return ""
+	}
+	body, _ := content["body"].(string)
+	relatesTo, _ := msg.Content["m.relates_to"].(map[string]interface{})
+	_, isReply := relatesTo["m.in_reply_to"]
+	return DetectLanguage(normalizeBody(body, isReply))
+}
+
+// Language returns the message's language as detected at import, falling
+// back to detecting it for messages imported without detection, and in
+// encrypted archives, which don't store it
+func (m *Message) Language() string {
+	if m.Lang != "" {
+		return m.Lang
+	}
+	return DetectMessageLanguage(m)
+}
+
+// FilterMessagesByLanguage returns the messages in lang, an ISO 639-1 code,
+// with the events that aren't messages, such as reactions, which belong with
+// the messages they relate to
+func FilterMessagesByLanguage(messages []*Message, lang string) []*Message {
+	lang = strings.ToLower(lang)
+	var kept []*Message
+	for _, msg := range messages {
+		if msg.MessageType != EventTypeMessage || msg.Language() == lang {
+			kept = append(kept, msg)
+		}
+	}
+	return kept
+}
+
+// langForStorage returns the message's detected language, or NULL when none
+// was detected and in encrypted archives, where, like the other columns
+// derived from content, it would say something of what messages say
+func (d *DuckDBDatabase) langForStorage(message *Message) sql.NullString {
+	if d.cipher != nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: message.Lang, Valid: message.Lang != ""}
+}
+
+// detectLanguageFromEnv reports whether MATRIX_ARCHIVE_DETECT_LANGUAGE asks
+// for the language of messages to be detected as they are imported
+func detectLanguageFromEnv() bool {
+	detect, _ := strconv.ParseBool(os.Getenv(DetectLanguageEnv))
+	return detect
+}
+
+// LanguageCount counts the messages in one language
+type LanguageCount struct {
+	Lang     string  `json:"lang"`     // ISO 639-1 code, or und when it couldn't be told
+	Messages int     `json:"messages"` // Text messages in the language
+	Senders  int     `json:"senders"`  // Distinct people writing in it
+	Share    float64 `json:"share"`    // Fraction of the text messages counted
+}
+
+// CountLanguages counts the text, notice and emote messages in each language,
+// most used first, with those whose language couldn't be told as und. Edits
+// are skipped so a corrected message isn't counted twice, and so are
+// messages from senders in exclude.
+func CountLanguages(messages []*Message, exclude map[string]bool) []LanguageCount {
+	counts := make(map[string]*LanguageCount)
+	senders := make(map[string]map[string]bool)
+	total := 0
+	for _, msg := range messages {
+		if msg.MessageType != EventTypeMessage || isEdit(msg) || exclude[msg.Sender] {
+			continue
+		}
+		switch contentMsgType(msg.Content) {
+		case "m.text", "m.notice", "m.emote":
+		default:
+			continue
+		}
+		lang := msg.Language()
+		if lang == "" {
+			lang = LanguageUndetermined
+		}
+		lc := counts[lang]
+		if lc == nil {
+			lc = &LanguageCount{Lang: lang}
+			counts[lang] = lc
+			senders[lang] = make(map[string]bool)
+		}
+		lc.Messages++
+		senders[lang][msg.Sender] = true
+		total++
+	}
+
+	languages := make([]LanguageCount, 0, len(counts))
+	for lang, lc := range counts {
+		lc.Senders = len(senders[lang])
+		lc.Share = float64(lc.Messages) / float64(total)
+		languages = append(languages, *lc)
+	}
+	sort.Slice(languages, func(i, j int) bool {
+		if languages[i].Messages != languages[j].Messages {
+			return languages[i].Messages > languages[j].Messages
+		}
+		return languages[i].Lang < languages[j].Lang
+	})
+	return languages
+}
+
+// AnalyzeLanguages prints the languages of the text messages in a room, or
+// in every archived room if roomID is empty. People who opted out of
+// archiving are left out.
+func AnalyzeLanguages(roomID string) error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	ctx := context.Background()
+	if roomID != "" {
+		var err error
+		if roomID, err = resolveExportRoom(roomID); err != nil {
+			return err
+		}
+	}
+	messages, err := GetDatabase().GetMessages(ctx, &MessageFilter{RoomID: roomID, EventType: EventTypeMessage}, 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %w", err)
+	}
+	optedOut, err := optedOutUsers(ctx, GetDatabase())
+	if err != nil {
+		return err
+	}
+	persons, err := loadPersons(ctx, GetDatabase())
+	if err != nil {
+		return err
+	}
+	languages := CountLanguages(persons.Senders(messages), persons.Exclude(optedOut))
+	if jsonOutput() {
+		return writeJSON(languages)
+	}
+
+	if len(languages) == 0 {
+		fmt.Println("No text messages found")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LANGUAGE\tMESSAGES\tSHARE\tPEOPLE")
+	for _, lc := range languages {
+		fmt.Fprintf(w, "%s\t%d\t%.1f%%\t%d\n", lc.Lang, lc.Messages, lc.Share*100, lc.Senders)
+	}
+	return w.Flush()
+}
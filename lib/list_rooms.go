@@ -1,10 +1,14 @@
 package archive
 
 import (
+	"cmp"
 	"context"
 	"fmt"
 	"os"
 	"regexp"
+	"slices"
+	"sort"
+	"strings"
 	"text/tabwriter"
 	"time"
 
@@ -13,13 +17,58 @@ import (
 	"maunium.net/go/mautrix/id"
 )
 
-// listRooms lists all rooms the user has access to, optionally filtered by pattern
-func ListRooms(pattern string) error {
+// RoomInfo describes a joined room in machine-readable output
+type RoomInfo struct {
+	RoomID       string     `json:"room_id"`
+	DisplayName  string     `json:"display_name"`
+	Encrypted    bool       `json:"encrypted"`
+	Network      string     `json:"network,omitempty"`       // Network the room is bridged to, from its m.bridge state
+	MessageCount int64      `json:"message_count"`           // Messages already archived
+	LastArchived *time.Time `json:"last_archived,omitempty"` // Time of the newest archived message
+}
+
+// Orders accepted by ListRooms
+const (
+	SortRoomsByName      = "name"      // Display name, A to Z
+	SortRoomsByMessages  = "messages"  // Most archived messages first
+	SortRoomsByLast      = "last"      // Most recently archived first; rooms never archived last
+	SortRoomsByNetwork   = "network"   // Bridged network, then name; unbridged rooms last
+	SortRoomsByEncrypted = "encrypted" // Encrypted rooms first, then name
+)
+
+// supportedRoomSorts lists the values accepted by SortRooms
+var supportedRoomSorts = []string{SortRoomsByName, SortRoomsByMessages, SortRoomsByLast, SortRoomsByNetwork, SortRoomsByEncrypted}
+
+// ListRooms lists all rooms the user has access to, optionally filtered by
+// pattern, with what the archive already holds from each, in the given order
+func ListRooms(pattern, sortBy string) error {
+	if sortBy == "" {
+		sortBy = SortRoomsByName
+	}
+	if !slices.Contains(supportedRoomSorts, sortBy) {
+		return fmt.Errorf("unsupported sort %s, supported sorts: %v", sortBy, supportedRoomSorts)
+	}
+
 	client, err := GetMatrixClient()
 	if err != nil {
 		return fmt.Errorf("failed to get Matrix client: %w", err)
 	}
 
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	stats, err := GetDatabase().GetRoomStats(context.Background())
+	if err != nil {
+		return err
+	}
+	statsByRoom := make(map[string]*RoomStats, len(stats))
+	for _, s := range stats {
+		statsByRoom[s.RoomID] = s
+	}
+
 	// Get joined rooms
 	resp, err := client.JoinedRooms(context.Background())
 	if err != nil {
@@ -35,38 +84,166 @@ func ListRooms(pattern string) error {
 		}
 	}
 
-	// Create tabwriter for formatted output
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-	fmt.Fprintln(w, "Room ID\tDisplay Name")
-	fmt.Fprintln(w, "-------\t------------")
-
 	// Iterate through rooms
-	fmt.Printf("Found %d joined rooms. Fetching room names...\n", len(resp.JoinedRooms))
+	fmt.Fprintf(progressWriter(), "Found %d joined rooms. Fetching room state...\n", len(resp.JoinedRooms))
+
+	rooms := []RoomInfo{}
 
 	for i, roomID := range resp.JoinedRooms {
-		// Get room state to get the name
-		displayName, err := GetRoomDisplayName(client, string(roomID))
-		if err != nil {
-			displayName = "Unknown"
+		// One state request gives the name, encryption and bridge
+		room := RoomInfo{RoomID: string(roomID), DisplayName: "Unknown"}
+		if state, err := getRoomState(client, roomID); err == nil {
+			room = roomInfoFromState(string(roomID), state)
+		} else if displayName, err := GetRoomDisplayName(client, string(roomID)); err == nil {
+			room.DisplayName = displayName
 		}
 
 		// Apply pattern filter if specified
-		if patternRegex != nil && !patternRegex.MatchString(displayName) {
+		if patternRegex != nil && !patternRegex.MatchString(room.DisplayName) {
 			continue
 		}
 
-		fmt.Fprintf(w, "%s\t%s\n", roomID, displayName)
+		if s := statsByRoom[room.RoomID]; s != nil {
+			room.MessageCount = s.MessageCount
+			last := s.LastMessage
+			room.LastArchived = &last
+		}
+		rooms = append(rooms, room)
 
 		// Show progress for large numbers of rooms
 		if (i+1)%50 == 0 {
-			fmt.Printf("Processed %d/%d rooms...\n", i+1, len(resp.JoinedRooms))
+			fmt.Fprintf(progressWriter(), "Processed %d/%d rooms...\n", i+1, len(resp.JoinedRooms))
 		}
 	}
 
+	if err := SortRooms(rooms, sortBy); err != nil {
+		return err
+	}
+
+	if jsonOutput() {
+		return writeJSON(rooms)
+	}
+
+	// Create tabwriter for formatted output
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Room ID\tDisplay Name\tEncrypted\tNetwork\tMessages\tLast Archived")
+	fmt.Fprintln(w, "-------\t------------\t---------\t-------\t--------\t-------------")
+	for _, room := range rooms {
+		encrypted, network, last := "no", room.Network, "-"
+		if room.Encrypted {
+			encrypted = "yes"
+		}
+		if network == "" {
+			network = "-"
+		}
+		if room.LastArchived != nil {
+			last = room.LastArchived.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", room.RoomID, room.DisplayName, encrypted, network, room.MessageCount, last)
+	}
+
 	w.Flush()
 	return nil
 }
 
+// getRoomState fetches a room's full current state
+func getRoomState(client *mautrix.Client, roomID id.RoomID) (mautrix.RoomStateMap, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return client.State(ctx, roomID)
+}
+
+// roomInfoFromState reads a room's name, encryption and bridged network from its state
+func roomInfoFromState(roomID string, state mautrix.RoomStateMap) RoomInfo {
+	room := RoomInfo{RoomID: roomID, DisplayName: roomID}
+
+	if evt := state[event.StateRoomName][""]; evt != nil {
+		if name, _ := evt.Content.Raw["name"].(string); name != "" {
+			room.DisplayName = name
+		}
+	}
+	if evt := state[event.StateEncryption][""]; evt != nil {
+		algorithm, _ := evt.Content.Raw["algorithm"].(string)
+		room.Encrypted = algorithm != ""
+	}
+
+	// Prefer the spec's m.bridge over the older uk.half-shot.bridge; a room
+	// bridged by several bridges lists their networks together
+	for _, bridgeType := range []event.Type{event.StateBridge, event.StateHalfShotBridge} {
+		var networks []string
+		for _, evt := range state[bridgeType] {
+			protocol, _ := evt.Content.Raw["protocol"].(map[string]interface{})
+			name, _ := protocol["displayname"].(string)
+			if name == "" {
+				name, _ = protocol["id"].(string)
+			}
+			if name != "" && !slices.Contains(networks, name) {
+				networks = append(networks, name)
+			}
+		}
+		if len(networks) > 0 {
+			sort.Strings(networks)
+			room.Network = strings.Join(networks, ", ")
+			break
+		}
+	}
+	return room
+}
+
+// SortRooms orders rooms by one of the SortRoomsBy values, falling back to
+// the display name for rooms that compare equal
+func SortRooms(rooms []RoomInfo, sortBy string) error {
+	var compare func(a, b RoomInfo) int
+	switch sortBy {
+	case SortRoomsByName, "":
+		compare = func(a, b RoomInfo) int { return 0 }
+	case SortRoomsByMessages:
+		compare = func(a, b RoomInfo) int { return cmp.Compare(b.MessageCount, a.MessageCount) }
+	case SortRoomsByLast:
+		compare = func(a, b RoomInfo) int {
+			switch {
+			case a.LastArchived == nil && b.LastArchived == nil:
+				return 0
+			case a.LastArchived == nil:
+				return 1
+			case b.LastArchived == nil:
+				return -1
+			}
+			return b.LastArchived.Compare(*a.LastArchived)
+		}
+	case SortRoomsByNetwork:
+		compare = func(a, b RoomInfo) int {
+			if (a.Network == "") != (b.Network == "") {
+				if a.Network == "" {
+					return 1
+				}
+				return -1
+			}
+			return cmp.Compare(strings.ToLower(a.Network), strings.ToLower(b.Network))
+		}
+	case SortRoomsByEncrypted:
+		compare = func(a, b RoomInfo) int {
+			if a.Encrypted == b.Encrypted {
+				return 0
+			}
+			if a.Encrypted {
+				return -1
+			}
+			return 1
+		}
+	default:
+		return fmt.Errorf("unsupported sort %s, supported sorts: %v", sortBy, supportedRoomSorts)
+	}
+
+	slices.SortStableFunc(rooms, func(a, b RoomInfo) int {
+		if c := compare(a, b); c != 0 {
+			return c
+		}
+		return cmp.Compare(strings.ToLower(a.DisplayName), strings.ToLower(b.DisplayName))
+	})
+	return nil
+}
+
 // GetRoomDisplayName gets the display name for a room
 func GetRoomDisplayName(client *mautrix.Client, roomID string) (string, error) {
 	// Create context with timeout to prevent hanging
@@ -83,3 +260,13 @@ func GetRoomDisplayName(client *mautrix.Client, roomID string) (string, error) {
 	// If that fails, just return the room ID
 	return roomID, nil
 }
+
+// ArchivedRooms returns the IDs of rooms that have messages in the archive
+func ArchivedRooms() ([]string, error) {
+	if err := InitDuckDB(); err != nil {
+		return nil, fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	return GetDatabase().GetRooms(context.Background())
+}
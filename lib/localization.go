@@ -0,0 +1,83 @@
+package archive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultLanguage is the language used when no catalog is requested or a key is missing
+const DefaultLanguage = "en"
+
+// localesDir holds the YAML string catalogs, one file per language (e.g. de.yaml)
+var localesDir = "templates/locales"
+
+// Catalog holds translated template strings for one language
+type Catalog struct {
+	Lang     string
+	strings  map[string]string
+	fallback *Catalog
+}
+
+// LoadCatalog loads the string catalog for a language, falling back to English
+// for any keys the language does not define
+func LoadCatalog(lang string) (*Catalog, error) {
+	if lang == "" {
+		lang = DefaultLanguage
+	}
+
+	strings, err := readCatalogFile(lang)
+	if err != nil {
+		return nil, err
+	}
+
+	catalog := &Catalog{Lang: lang, strings: strings}
+	if lang != DefaultLanguage {
+		if fallback, err := readCatalogFile(DefaultLanguage); err == nil {
+			catalog.fallback = &Catalog{Lang: DefaultLanguage, strings: fallback}
+		}
+	}
+
+	return catalog, nil
+}
+
+// NewCatalog creates a catalog from an in-memory string table
+func NewCatalog(lang string, strings map[string]string) *Catalog {
+	return &Catalog{Lang: lang, strings: strings}
+}
+
+// readCatalogFile reads and parses templates/locales/<lang>.yaml
+func readCatalogFile(lang string) (map[string]string, error) {
+	path := filepath.Join(localesDir, lang+".yaml")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read string catalog for language %q: %w", lang, err)
+	}
+
+	strings := make(map[string]string)
+	if err := yaml.Unmarshal(data, &strings); err != nil {
+		return nil, fmt.Errorf("failed to parse string catalog %s: %w", path, err)
+	}
+
+	return strings, nil
+}
+
+// T returns the translation for key, formatted with args when given.
+// Missing keys fall back to English and finally to the key itself.
+func (c *Catalog) T(key string, args ...interface{}) string {
+	text := key
+	if c != nil {
+		if s, ok := c.strings[key]; ok {
+			text = s
+		} else if c.fallback != nil {
+			text = c.fallback.T(key)
+		}
+	}
+
+	if len(args) > 0 {
+		return fmt.Sprintf(text, args...)
+	}
+	return text
+}
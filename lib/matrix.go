@@ -7,39 +7,134 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 
 	"maunium.net/go/mautrix"
 )
 
+// Account is a Matrix account the archive is read from: its Beeper
+// credentials, kept under the account's profile, and the client connected
+// with them. Each account has its own crypto store, so several can be used
+// at once, e.g. to archive two accounts concurrently with Archiver.Import.
+type Account struct {
+	profile string
+
+	mu     sync.Mutex
+	auth   *BeeperAuth
+	client *mautrix.Client
+}
+
+// NewAccount returns the account of the named profile, which connects when
+// its client is first needed. An empty name is the default account.
+func NewAccount(profile string) *Account {
+	return &Account{profile: profile}
+}
+
+// NewAccountWithClient returns an account using a connected client, such as
+// one logged in by the caller, instead of Beeper credentials
+func NewAccountWithClient(client *mautrix.Client) *Account {
+	return &Account{client: client}
+}
+
+// Profile returns the name of the account's profile
+func (a *Account) Profile() string {
+	return a.profile
+}
+
+// Client returns the account's connected Matrix client, logging in with its
+// Beeper credentials the first time
+func (a *Account) Client() (*mautrix.Client, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.client != nil {
+		return a.client, nil
+	}
+	return a.connect()
+}
+
+// DeviceID returns the device ID of the account's Beeper login, or "" before
+// it has connected
+func (a *Account) DeviceID() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.auth != nil {
+		return a.auth.GetMatrixDeviceID()
+	}
+	return ""
+}
+
+// cryptoStorePath returns the account's crypto store location so each
+// account keeps its own Olm/Megolm sessions
+func (a *Account) cryptoStorePath() string {
+	if a.profile == "" {
+		return "./crypto_store"
+	}
+	return "./crypto_store_" + a.profile
+}
+
+// The account the commands use, selected with SetActiveProfile
 var (
-	matrixClient *mautrix.Client
-	beeperAuth   *BeeperAuth
+	activeAccountMu sync.Mutex
+	activeAccount   = NewAccount("")
 )
 
-// GetMatrixClient returns a connected Matrix client using Beeper authentication
-func GetMatrixClient() (*mautrix.Client, error) {
-	if matrixClient != nil {
-		return matrixClient, nil
+// currentAccount returns the account the commands use
+func currentAccount() *Account {
+	activeAccountMu.Lock()
+	defer activeAccountMu.Unlock()
+	return activeAccount
+}
+
+// SetActiveProfile selects the named account profile used for subsequent Matrix
+// connections. An empty name selects the default account.
+func SetActiveProfile(profile string) {
+	activeAccountMu.Lock()
+	defer activeAccountMu.Unlock()
+	if profile != activeAccount.profile {
+		activeAccount = NewAccount(profile)
 	}
+}
 
-	return GetBeeperMatrixClient()
+// ActiveProfile returns the currently selected account profile name
+func ActiveProfile() string {
+	return currentAccount().profile
+}
+
+// cryptoStorePath returns the crypto store location for the active profile
+func cryptoStorePath() string {
+	return currentAccount().cryptoStorePath()
+}
+
+// GetMatrixClient returns a connected Matrix client using Beeper authentication
+func GetMatrixClient() (*mautrix.Client, error) {
+	return currentAccount().Client()
 }
 
 // GetBeeperMatrixClient creates a Matrix client using Beeper authentication with crypto
 func GetBeeperMatrixClient() (*mautrix.Client, error) {
+	account := currentAccount()
+	account.mu.Lock()
+	defer account.mu.Unlock()
+	return account.connect()
+}
+
+// connect logs in with the account's Beeper credentials and sets up its
+// crypto store. The caller holds a.mu.
+func (a *Account) connect() (*mautrix.Client, error) {
 	baseDomain := os.Getenv("BEEPER_DOMAIN")
 	if baseDomain == "" {
 		baseDomain = "beeper.com"
 	}
 
-	if beeperAuth == nil {
-		beeperAuth = NewBeeperAuth(baseDomain)
+	if a.auth == nil {
+		a.auth = NewBeeperAuthForProfile(baseDomain, a.profile)
 	}
+	beeperAuth := a.auth
 
 	// Try to load existing credentials
 	if !beeperAuth.LoadCredentials() {
 		// If no valid credentials, perform login flow
-		fmt.Println("No valid Beeper credentials found. Starting login process...")
+		fmt.Fprintln(progressWriter(), "No valid Beeper credentials found. Starting login process...")
 		if err := beeperAuth.Login(); err != nil {
 			return nil, fmt.Errorf("Beeper login failed: %w", err)
 		}
@@ -52,7 +147,7 @@ func GetBeeperMatrixClient() (*mautrix.Client, error) {
 	if err != nil {
 		// If this fails due to expired token, clear credentials and try login again
 		if strings.Contains(err.Error(), "expired_token") || strings.Contains(err.Error(), "M_FORBIDDEN") {
-			fmt.Println("Beeper credentials expired. Re-authenticating...")
+			fmt.Fprintln(progressWriter(), "Beeper credentials expired. Re-authenticating...")
 			beeperAuth.ClearCredentials()
 
 			// Perform fresh login
@@ -71,9 +166,8 @@ func GetBeeperMatrixClient() (*mautrix.Client, error) {
 		}
 	}
 
-	// Create crypto manager with database path
-	// Use a default crypto database path
-	cryptoDbPath := "./crypto_store"
+	// Create crypto manager with the profile's crypto database path
+	cryptoDbPath := a.cryptoStorePath()
 	cryptoManager, err := NewCryptoManager(client, cryptoDbPath)
 	if err != nil {
 		log.Printf("Warning: Failed to initialize crypto: %v", err)
@@ -93,9 +187,13 @@ func GetBeeperMatrixClient() (*mautrix.Client, error) {
 	// Always save credentials after successfully getting a Matrix client
 	beeperAuth.SaveCredentials()
 
-	matrixClient = client
-	log.Printf("Logged in via Beeper as %s", beeperAuth.Whoami.UserInfo.Username)
-	return matrixClient, nil
+	a.client = client
+	if beeperAuth.Whoami != nil {
+		log.Printf("Logged in via Beeper as %s", beeperAuth.Whoami.UserInfo.Username)
+	} else {
+		log.Printf("Logged in via Beeper as %s", beeperAuth.MatrixUserID)
+	}
+	return a.client, nil
 }
 
 // GetDownloadURL converts an mxc:// URL to an HTTP download URL
@@ -122,10 +220,5 @@ func GetDownloadURL(mxcURL string) (string, error) {
 
 // GetMatrixDeviceID returns the device ID from the current beeper auth
 func GetMatrixDeviceID() string {
-	if beeperAuth != nil {
-		return beeperAuth.GetMatrixDeviceID()
-	}
-	return ""
+	return currentAccount().DeviceID()
 }
-
-
@@ -0,0 +1,98 @@
+package archive
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ParseBandwidth parses a download rate such as "5MB/s" or "500K/s" into
+// bytes per second. Units are those of ParseSize; the "/s" is optional.
+func ParseBandwidth(s string) (int64, error) {
+	trimmed := strings.TrimSpace(s)
+	if strings.HasSuffix(strings.ToLower(trimmed), "/s") {
+		trimmed = trimmed[:len(trimmed)-2]
+	}
+	rate, err := ParseSize(trimmed)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bandwidth %q, expected e.g. 500KB/s or 5MB/s", s)
+	}
+	if rate <= 0 {
+		return 0, fmt.Errorf("bandwidth %q must be positive", s)
+	}
+	return rate, nil
+}
+
+// tokenBucket limits how many bytes pass per second. It holds at most one
+// second of tokens, so transfers can burst that much after a pause.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSecond int64) *tokenBucket {
+	rate := float64(bytesPerSecond)
+	return &tokenBucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// take spends n bytes of tokens, sleeping until the bucket has refilled if
+// it runs short. Readers sharing the bucket wait their turn, so together
+// they stay under the rate.
+func (b *tokenBucket) take(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = math.Min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens < 0 {
+		time.Sleep(time.Duration(-b.tokens / b.rate * float64(time.Second)))
+	}
+}
+
+// throttledBody reads a response body through a token bucket
+type throttledBody struct {
+	io.ReadCloser
+	bucket *tokenBucket
+}
+
+func (r throttledBody) Read(p []byte) (int, error) {
+	// Read at most one second's worth at a time so the rate stays smooth
+	if burst := max(int(r.bucket.rate), 1); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.bucket.take(n)
+	return n, err
+}
+
+// throttledTransport limits the combined rate of every response body read
+// through it
+type throttledTransport struct {
+	base   http.RoundTripper
+	bucket *tokenBucket
+}
+
+func (t throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = throttledBody{ReadCloser: resp.Body, bucket: t.bucket}
+	return resp, nil
+}
+
+// NewBandwidthLimitedClient returns an HTTP client whose downloads together
+// read at most bytesPerSecond, or an unlimited client if it is 0
+func NewBandwidthLimitedClient(bytesPerSecond int64) *http.Client {
+	if bytesPerSecond <= 0 {
+		return &http.Client{}
+	}
+	return &http.Client{Transport: throttledTransport{base: http.DefaultTransport, bucket: newTokenBucket(bytesPerSecond)}}
+}
@@ -0,0 +1,375 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Kinds of media file planned by PlanMediaDownloads
+const (
+	MediaKindThumbnail = "thumbnail" // An image's thumbnail or a video's poster
+	MediaKindImage     = "image"
+	MediaKindRecording = "recording" // The file of an audio or video message
+)
+
+// MediaItem is one file to download: an image's thumbnail or the full image,
+// or a video's poster or an audio or video file
+type MediaItem struct {
+	EventID   string    `json:"event_id"`
+	Kind      string    `json:"kind"`
+	URL       string    `json:"url"`
+	Stem      string    `json:"-"`
+	Size      int64     `json:"size,omitempty"`     // From the event's info; 0 if unknown
+	MimeType  string    `json:"mimetype,omitempty"` // Of the posted media, for its thumbnail too
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// MediaDownloadFilter selects the files media download fetches, judged by
+// what their events record
+type MediaDownloadFilter struct {
+	IncludeMIME []string  // MIME type patterns such as image/*; all types if empty
+	MaxSize     int64     // Largest file to fetch; no limit if 0
+	Since       time.Time // Only media posted at or after this time, if set
+	AudioVideo  bool      // Also fetch the files of audio and video messages, and video posters
+}
+
+// Validate checks the filter's MIME type patterns
+func (f *MediaDownloadFilter) Validate() error {
+	for _, pattern := range f.IncludeMIME {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid MIME type pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Includes reports whether the filter selects an item. Media whose type
+// isn't recorded is left out when types are given, while files whose size
+// isn't recorded are kept whatever MaxSize is.
+func (f *MediaDownloadFilter) Includes(item MediaItem) bool {
+	if f == nil {
+		return true
+	}
+	if !f.Since.IsZero() && item.Timestamp.Before(f.Since) {
+		return false
+	}
+	if f.MaxSize > 0 && item.Size > f.MaxSize {
+		return false
+	}
+	if len(f.IncludeMIME) == 0 {
+		return true
+	}
+	mimeType, _, _ := strings.Cut(strings.ToLower(item.MimeType), ";")
+	for _, pattern := range f.IncludeMIME {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.TrimSpace(mimeType)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SkippedMedia is a file left out of a budgeted download
+type SkippedMedia struct {
+	MediaItem
+	Reason string `json:"reason"`
+}
+
+// MediaDownloadReport summarizes a budgeted media download
+type MediaDownloadReport struct {
+	Budget          int64          `json:"budget_bytes"`
+	UsedBytes       int64          `json:"used_bytes"`
+	Downloaded      int            `json:"downloaded"`
+	DownloadedBytes int64          `json:"downloaded_bytes"`
+	AlreadyPresent  int            `json:"already_present"`
+	Filtered        int            `json:"filtered"` // Left out by the MediaDownloadFilter
+	Skipped         []SkippedMedia `json:"skipped"`
+}
+
+var sizePattern = regexp.MustCompile(`^([0-9]*\.?[0-9]+)\s*([KMGT]?)(I?B)?$`)
+
+// ParseSize parses a size such as "5GB", "500M" or "1.5 TiB". Units are powers
+// of 1024; a bare number is a count of bytes.
+func ParseSize(s string) (int64, error) {
+	matches := sizePattern.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(s)))
+	if matches == nil {
+		return 0, fmt.Errorf("invalid size %q, expected e.g. 500MB or 5GB", s)
+	}
+	value, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", s, err)
+	}
+	multiplier := map[string]float64{"": 1, "K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}[matches[2]]
+	return int64(value * multiplier), nil
+}
+
+// FormatSize formats a byte count with the largest unit that keeps it above 1
+func FormatSize(bytes int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(bytes)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// PlanMediaDownloads orders the media files to download by priority: every
+// thumbnail (including video posters) before any full image, then audio and
+// video files, which are the largest, and newest first within each kind
+func PlanMediaDownloads(messages []*Message) []MediaItem {
+	var thumbnails, images, recordings []MediaItem
+	for _, msg := range messages {
+		if msg.IsPlayable() {
+			thumbnails, recordings = planPlayableDownloads(msg, thumbnails, recordings)
+			continue
+		}
+		if !msg.IsImage() {
+			continue
+		}
+		info, _ := msg.Content["info"].(map[string]interface{})
+		mimeType, _ := info["mimetype"].(string)
+
+		if url := msg.ThumbnailURL(); url != "" {
+			thumbnailInfo, _ := info["thumbnail_info"].(map[string]interface{})
+			thumbnails = append(thumbnails, MediaItem{
+				EventID:   msg.EventID,
+				Kind:      MediaKindThumbnail,
+				URL:       url,
+				Stem:      GetDownloadStem(*msg, true),
+				Size:      infoSize(thumbnailInfo),
+				MimeType:  mimeType,
+				Timestamp: msg.Timestamp,
+			})
+		}
+		if url := msg.ImageURL(); url != "" {
+			images = append(images, MediaItem{
+				EventID:   msg.EventID,
+				Kind:      MediaKindImage,
+				URL:       url,
+				Stem:      GetDownloadStem(*msg, false),
+				Size:      infoSize(info),
+				MimeType:  mimeType,
+				Timestamp: msg.Timestamp,
+			})
+		}
+	}
+
+	for _, items := range [][]MediaItem{thumbnails, images, recordings} {
+		sort.SliceStable(items, func(i, j int) bool {
+			return items[i].Timestamp.After(items[j].Timestamp)
+		})
+	}
+	return append(append(thumbnails, images...), recordings...)
+}
+
+// planPlayableDownloads adds the poster and file of an audio or video message
+// to the planned thumbnails and recordings
+func planPlayableDownloads(msg *Message, thumbnails, recordings []MediaItem) ([]MediaItem, []MediaItem) {
+	info, _ := msg.Content["info"].(map[string]interface{})
+	mimeType, _ := info["mimetype"].(string)
+	if url := msg.PosterURL(); url != "" {
+		thumbnailInfo, _ := info["thumbnail_info"].(map[string]interface{})
+		thumbnails = append(thumbnails, MediaItem{
+			EventID:   msg.EventID,
+			Kind:      MediaKindThumbnail,
+			URL:       url,
+			Stem:      mxcMediaStem(url),
+			Size:      infoSize(thumbnailInfo),
+			MimeType:  mimeType,
+			Timestamp: msg.Timestamp,
+		})
+	}
+	if url := msg.PlayableURL(); url != "" {
+		recordings = append(recordings, MediaItem{
+			EventID:   msg.EventID,
+			Kind:      MediaKindRecording,
+			URL:       url,
+			Stem:      mxcMediaStem(url),
+			Size:      infoSize(info),
+			MimeType:  mimeType,
+			Timestamp: msg.Timestamp,
+		})
+	}
+	return thumbnails, recordings
+}
+
+// mediaKindDirs names the directory each kind of media file is downloaded to
+var mediaKindDirs = map[string]string{
+	MediaKindThumbnail: "thumbnails",
+	MediaKindImage:     "images",
+	MediaKindRecording: "recordings",
+}
+
+// infoSize reads the size field of an event's info block
+func infoSize(info map[string]interface{}) int64 {
+	switch size := info["size"].(type) {
+	case float64:
+		return int64(size)
+	case int64:
+		return size
+	case int:
+		return int64(size)
+	}
+	return 0
+}
+
+// DownloadMediaWithBudget downloads thumbnails to outputDir/thumbnails and full
+// images to outputDir/images in priority order (see PlanMediaDownloads) until
+// maxTotalSize bytes are used. With filter.AudioVideo, video posters go to
+// outputDir/thumbnails too and audio and video files to outputDir/recordings.
+// Files already downloaded count toward the budget. A maxTotalSize of 0 means
+// no limit. Downloads read at most maxBandwidth bytes per second, or as fast
+// as the connection allows if it is 0. The directories use the given media
+// layout ("" keeps each directory's current layout). Only files the filter
+// includes are downloaded; a nil filter includes every image file. What
+// became of each file is recorded in the media table.
+func DownloadMediaWithBudget(outputDir string, maxTotalSize, maxBandwidth int64, layout string, filter *MediaDownloadFilter) error {
+	if filter != nil {
+		if err := filter.Validate(); err != nil {
+			return err
+		}
+	}
+
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	if outputDir == "" {
+		outputDir = "."
+	}
+	dirs := make(map[string]*MediaDir)
+	for kind, name := range mediaKindDirs {
+		if kind == MediaKindRecording && (filter == nil || !filter.AudioVideo) {
+			continue
+		}
+		dir, err := OpenMediaDir(filepath.Join(outputDir, name), layout)
+		if err != nil {
+			return err
+		}
+		dirs[kind] = dir
+	}
+
+	ctx := context.Background()
+	msgTypes := []string{"m.image"}
+	if filter != nil && filter.AudioVideo {
+		msgTypes = append(msgTypes, "m.video", "m.audio")
+	}
+	var messages []*Message
+	for _, msgType := range msgTypes {
+		found, err := GetDatabase().GetMessages(ctx, &MessageFilter{EventType: EventTypeMessage, MsgType: msgType}, 0, 0)
+		if err != nil {
+			return fmt.Errorf("failed to query messages: %w", err)
+		}
+		messages = append(messages, found...)
+	}
+	items := PlanMediaDownloads(messages)
+	recorded, err := downloadedMedia(ctx)
+	if err != nil {
+		return err
+	}
+
+	report := &MediaDownloadReport{Budget: maxTotalSize, Skipped: []SkippedMedia{}}
+
+	// Existing files are kept and use up budget first
+	var pending []MediaItem
+	for _, item := range items {
+		if path := dirs[item.Kind].Find(item.Stem); path != "" {
+			if info, err := os.Stat(path); err == nil {
+				report.UsedBytes += info.Size()
+			}
+			report.AlreadyPresent++
+			if err := recordStoredMedia(ctx, recorded, item.EventID, item.Kind, item.URL, dirs[item.Kind], item.Stem); err != nil {
+				return err
+			}
+			continue
+		}
+		if !filter.Includes(item) {
+			report.Filtered++
+			continue
+		}
+		pending = append(pending, item)
+	}
+
+	client := NewBandwidthLimitedClient(maxBandwidth)
+	out := progressWriter()
+	for _, item := range pending {
+		var remaining int64
+		if maxTotalSize > 0 {
+			remaining = maxTotalSize - report.UsedBytes
+			if remaining <= 0 || (item.Size > 0 && item.Size > remaining) {
+				report.Skipped = append(report.Skipped, SkippedMedia{MediaItem: item, Reason: "over budget"})
+				if err := recordMedia(ctx, item.EventID, item.Kind, item.URL, nil, errOverBudget); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		file, err := downloadMedia(client, item.URL, dirs[item.Kind], item.Stem, remaining, item.Kind)
+		if recordErr := recordMedia(ctx, item.EventID, item.Kind, item.URL, file, err); recordErr != nil {
+			return recordErr
+		}
+		if err != nil {
+			reason := err.Error()
+			if errors.Is(err, errOverBudget) {
+				reason = "over budget"
+			} else {
+				fmt.Fprintf(out, "Skipping %s: %v\n", item.URL, err)
+			}
+			report.Skipped = append(report.Skipped, SkippedMedia{MediaItem: item, Reason: reason})
+			continue
+		}
+		report.Downloaded++
+		report.DownloadedBytes += file.Size
+		report.UsedBytes += file.Size
+	}
+
+	return printMediaDownloadReport(report)
+}
+
+// printMediaDownloadReport prints the outcome of a budgeted download and lists what was skipped
+func printMediaDownloadReport(report *MediaDownloadReport) error {
+	if jsonOutput() {
+		return writeJSON(report)
+	}
+
+	fmt.Printf("Downloaded %d files (%s), %d already present\n", report.Downloaded, FormatSize(report.DownloadedBytes), report.AlreadyPresent)
+	if report.Filtered > 0 {
+		fmt.Printf("Left out %d files that don't match the filters\n", report.Filtered)
+	}
+	if report.Budget > 0 {
+		fmt.Printf("Using %s of %s budget\n", FormatSize(report.UsedBytes), FormatSize(report.Budget))
+	}
+	if len(report.Skipped) == 0 {
+		return nil
+	}
+
+	fmt.Printf("\nSkipped %d files:\n", len(report.Skipped))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Event ID\tKind\tSize\tSent\tReason")
+	fmt.Fprintln(w, "--------\t----\t----\t----\t------")
+	for _, s := range report.Skipped {
+		size := "?"
+		if s.Size > 0 {
+			size = FormatSize(s.Size)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.EventID, s.Kind, size, s.Timestamp.Format("2006-01-02"), s.Reason)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,75 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+)
+
+// mediaKind returns which of a message's media files a download that
+// prefers thumbnails fetches, as GetDownloadStem does: the thumbnail if the
+// message has one, and the full image otherwise
+func mediaKind(msg *Message, preferThumbnails bool) string {
+	if preferThumbnails && msg.ThumbnailURL() != "" {
+		return MediaKindThumbnail
+	}
+	return MediaKindImage
+}
+
+// mediaURL returns the mxc URL of one kind of a message's media
+func mediaURL(msg *Message, kind string) string {
+	if kind == MediaKindThumbnail {
+		return msg.ThumbnailURL()
+	}
+	return msg.ImageURL()
+}
+
+// downloadedMedia returns the event IDs and kinds of the media recorded as
+// downloaded
+func downloadedMedia(ctx context.Context) (map[[2]string]bool, error) {
+	files, err := GetDatabase().GetMediaFiles(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	downloaded := make(map[[2]string]bool, len(files))
+	for _, f := range files {
+		if f.Status == MediaStatusDownloaded {
+			downloaded[[2]string{f.EventID, f.Kind}] = true
+		}
+	}
+	return downloaded, nil
+}
+
+// recordMedia records the outcome of downloading one of a message's media
+// files: file is what downloadImage saved, or err why it didn't
+func recordMedia(ctx context.Context, eventID, kind, mxc string, file *MediaFile, err error) error {
+	record := &MediaFile{EventID: eventID, Kind: kind, MXC: mxc, Status: MediaStatusDownloaded}
+	switch {
+	case errors.Is(err, errOverBudget):
+		record.Status = MediaStatusSkipped
+		record.Error = "over budget"
+	case err != nil:
+		record.Status = MediaStatusFailed
+		record.Error = err.Error()
+	default:
+		record.Path = filepath.ToSlash(file.Path)
+		record.SHA256 = file.SHA256
+		record.Size = file.Size
+		record.ClaimedType = file.ClaimedType
+		record.DetectedType = file.DetectedType
+	}
+	return GetDatabase().SaveMediaFile(ctx, record)
+}
+
+// recordStoredMedia records media that was downloaded before downloads were
+// recorded, unless it already is
+func recordStoredMedia(ctx context.Context, recorded map[[2]string]bool, eventID, kind, mxc string, dir *MediaDir, stem string) error {
+	if recorded[[2]string{eventID, kind}] {
+		return nil
+	}
+	file, err := dir.stored(stem)
+	if err != nil || file == nil {
+		return err
+	}
+	return recordMedia(ctx, eventID, kind, mxc, file, nil)
+}
@@ -0,0 +1,216 @@
+package archive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// MediaMatch is an archived message that posted a media file
+type MediaMatch struct {
+	EventID   string    `json:"event_id"`
+	RoomID    string    `json:"room_id"`
+	Sender    string    `json:"sender"`
+	Timestamp time.Time `json:"timestamp"`
+	MediaID   string    `json:"media_id"`
+	Path      string    `json:"path"` // The downloaded copy with the file's content
+}
+
+// fileSHA256 returns the hex SHA-256 and size of a file's content
+func fileSHA256(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+// mediaWithHash returns the media IDs in a media directory whose downloaded
+// content has the given SHA-256, mapped to their files. The hashed layout's
+// index records each file's hash; files saved flat are hashed as they are
+// found, skipping those whose size differs from size when it is known (>= 0).
+func mediaWithHash(dir, hash string, size int64) (map[string]string, error) {
+	found := make(map[string]string)
+	index, err := loadMediaIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+	for stem, entry := range index {
+		if entry.SHA256 == hash {
+			found[stem] = filepath.Join(dir, filepath.FromSlash(entry.Path))
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return found, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", dir, err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || name == MediaIndexFile || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if info, err := entry.Info(); err != nil || (size >= 0 && info.Size() != size) {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if fileHash, _, err := fileSHA256(path); err == nil && fileHash == hash {
+			found[strings.TrimSuffix(name, filepath.Ext(name))] = path
+		}
+	}
+	return found, nil
+}
+
+// FindMediaMatches returns the messages that posted media whose downloaded
+// copy in one of mediaDirs has the given SHA-256, oldest first. size is the
+// content's length, or -1 if it isn't known.
+func FindMediaMatches(messages []*Message, hash string, size int64, mediaDirs []string) ([]MediaMatch, error) {
+	files := make(map[string]string)
+	for _, dir := range mediaDirs {
+		found, err := mediaWithHash(dir, hash, size)
+		if err != nil {
+			return nil, err
+		}
+		for stem, path := range found {
+			if files[stem] == "" {
+				files[stem] = path
+			}
+		}
+	}
+
+	matches := []MediaMatch{}
+	if len(files) == 0 {
+		return matches, nil
+	}
+	for _, msg := range messages {
+		// The same event may have its full image in one directory and its
+		// thumbnail in another
+		for _, thumbnails := range []bool{false, true} {
+			stem := GetDownloadStem(*msg, thumbnails)
+			if path, ok := files[stem]; ok && stem != "" {
+				matches = append(matches, MediaMatch{
+					EventID:   msg.EventID,
+					RoomID:    msg.RoomID,
+					Sender:    msg.Sender,
+					Timestamp: msg.Timestamp.UTC(),
+					MediaID:   stem,
+					Path:      path,
+				})
+				break
+			}
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Timestamp.Before(matches[j].Timestamp) })
+	return matches, nil
+}
+
+// RecordedMediaMatches returns the messages whose media the downloaders
+// recorded with the given SHA-256, oldest first. Unlike FindMediaMatches it
+// doesn't need the files to still be where they were downloaded.
+func RecordedMediaMatches(files []*MediaFile, messages []*Message, hash string) []MediaMatch {
+	byEventID := make(map[string]*Message, len(messages))
+	for _, msg := range messages {
+		byEventID[msg.EventID] = msg
+	}
+
+	matches := []MediaMatch{}
+	seen := make(map[string]bool)
+	for _, f := range files {
+		msg := byEventID[f.EventID]
+		if f.Status != MediaStatusDownloaded || f.SHA256 != hash || msg == nil || seen[f.EventID] {
+			continue
+		}
+		seen[f.EventID] = true
+		matches = append(matches, MediaMatch{
+			EventID:   msg.EventID,
+			RoomID:    msg.RoomID,
+			Sender:    msg.Sender,
+			Timestamp: msg.Timestamp.UTC(),
+			MediaID:   GetDownloadStem(*msg, f.Kind == MediaKindThumbnail),
+			Path:      filepath.FromSlash(f.Path),
+		})
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Timestamp.Before(matches[j].Timestamp) })
+	return matches
+}
+
+// FindMedia prints the archived messages where a file was posted. ref is a
+// local file or the hex SHA-256 of its content; mediaDirs are the directories
+// download-images saved media to.
+func FindMedia(ref string, mediaDirs []string) error {
+	hash, size := strings.ToLower(strings.TrimPrefix(ref, "sha256:")), int64(-1)
+	if !sha256Pattern.MatchString(hash) {
+		var err error
+		if hash, size, err = fileSHA256(ref); err != nil {
+			return fmt.Errorf("%q is neither a file nor a SHA-256: %w", ref, err)
+		}
+	}
+
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	messages, err := GetDatabase().GetMessages(context.Background(), nil, 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %w", err)
+	}
+	matches, err := FindMediaMatches(messages, hash, size, mediaDirs)
+	if err != nil {
+		return err
+	}
+
+	// The media table also finds files downloaded to other directories
+	files, err := GetDatabase().GetMediaFiles(context.Background(), "")
+	if err != nil {
+		return err
+	}
+	found := make(map[string]bool, len(matches))
+	for _, m := range matches {
+		found[m.EventID] = true
+	}
+	for _, m := range RecordedMediaMatches(files, messages, hash) {
+		if !found[m.EventID] {
+			matches = append(matches, m)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Timestamp.Before(matches[j].Timestamp) })
+
+	if jsonOutput() {
+		return writeJSON(matches)
+	}
+
+	if len(matches) == 0 {
+		fmt.Printf("No archived message posted media with SHA-256 %s in %s\n", hash, strings.Join(mediaDirs, ", "))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Date\tRoom ID\tSender\tEvent ID\tFile")
+	fmt.Fprintln(w, "----\t-------\t------\t--------\t----")
+	for _, m := range matches {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", m.Timestamp.Format(time.RFC3339), m.RoomID, m.Sender, m.EventID, m.Path)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,299 @@
+package archive
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Media download layouts. The flat layout saves each file as <dir>/<media
+// ID>.<ext>. The hashed layout stores files by the SHA-256 of their content in
+// two levels of subdirectories, as homeservers and matrix-media-repo do
+// (<dir>/ab/cd/abcd….<ext>), so no directory grows past a few hundred
+// entries and identical uploads are stored once. An index maps media IDs to
+// their files.
+const (
+	MediaLayoutFlat   = "flat"
+	MediaLayoutHashed = "hashed"
+)
+
+// MediaIndexFile is the index of a hashed media directory. Each line is a
+// JSON MediaIndexEntry; it is only appended to, so an interrupted download
+// run never leaves it unreadable.
+const MediaIndexFile = "index.ndjson"
+
+// MediaIndexEntry records where a hashed media directory keeps a media ID
+type MediaIndexEntry struct {
+	MediaID      string    `json:"media_id"`
+	Path         string    `json:"path"` // Relative to the media directory, with forward slashes
+	SHA256       string    `json:"sha256"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"content_type,omitempty"`  // As the homeserver served it, which is what the uploader claimed
+	DetectedType string    `json:"detected_type,omitempty"` // As sniffed from the content; empty if it didn't tell
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// IsValidMediaLayout reports whether layout names a media layout; "" selects
+// the layout a directory already uses
+func IsValidMediaLayout(layout string) bool {
+	return layout == "" || layout == MediaLayoutFlat || layout == MediaLayoutHashed
+}
+
+// MediaDir is a media download directory in either layout
+type MediaDir struct {
+	path  string
+	index map[string]MediaIndexEntry // nil for the flat layout
+}
+
+// OpenMediaDir prepares dir for downloads. An empty layout uses the hashed
+// layout if dir already has an index, and the flat layout otherwise. Files
+// saved flat before switching a directory to the hashed layout are still found.
+func OpenMediaDir(dir, layout string) (*MediaDir, error) {
+	if !IsValidMediaLayout(layout) {
+		return nil, fmt.Errorf("unsupported media layout %s, supported layouts: %s, %s", layout, MediaLayoutFlat, MediaLayoutHashed)
+	}
+	index, err := loadMediaIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+	if layout == MediaLayoutFlat && index != nil {
+		return nil, fmt.Errorf("%s uses the %s media layout (it has an %s)", dir, MediaLayoutHashed, MediaIndexFile)
+	}
+	if layout == MediaLayoutHashed && index == nil {
+		index = make(map[string]MediaIndexEntry)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	return &MediaDir{path: dir, index: index}, nil
+}
+
+// Hashed reports whether new files are saved in the hashed layout
+func (d *MediaDir) Hashed() bool {
+	return d.index != nil
+}
+
+// Find returns the file saved for a media ID, or "" if it isn't downloaded
+func (d *MediaDir) Find(stem string) string {
+	if entry, ok := d.index[stem]; ok {
+		return filepath.Join(d.path, filepath.FromSlash(entry.Path))
+	}
+	return findFlatImage(d.path, stem)
+}
+
+// stored returns the path, hash and size of the file saved for a media ID,
+// or nil if it isn't downloaded
+func (d *MediaDir) stored(stem string) (*MediaFile, error) {
+	path := d.Find(stem)
+	if path == "" {
+		return nil, nil
+	}
+	if entry, ok := d.index[stem]; ok {
+		return &MediaFile{Path: path, SHA256: entry.SHA256, Size: entry.Size, ClaimedType: entry.ContentType, DetectedType: entry.DetectedType}, nil
+	}
+	hash, size, err := fileSHA256(path)
+	if err != nil {
+		return nil, err
+	}
+	detected, err := sniffFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &MediaFile{Path: path, SHA256: hash, Size: size, DetectedType: detected}, nil
+}
+
+// sniffFile returns the content type of a file as SniffMediaType tells it
+func sniffFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return SniffMediaType(head[:n]), nil
+}
+
+// Save stores the content of a media ID read from r and returns the file's
+// path and size. If maxBytes is positive, larger content is not kept and
+// errOverBudget is returned. In the hashed layout, content that is already
+// stored is not written again; the media ID is indexed to the existing copy.
+func (d *MediaDir) Save(stem, ext, contentType string, r io.Reader, maxBytes int64) (string, int64, error) {
+	file, err := d.save(stem, ext, contentType, "", r, maxBytes)
+	if err != nil {
+		return "", 0, err
+	}
+	return file.Path, file.Size, nil
+}
+
+// save is Save, also indexing the content type sniffed from the content and
+// returning the content's hex SHA-256
+func (d *MediaDir) save(stem, ext, contentType, detectedType string, r io.Reader, maxBytes int64) (*MediaFile, error) {
+	if maxBytes > 0 {
+		// The server may not send a length, so stop one byte past the budget
+		r = io.LimitReader(r, maxBytes+1)
+	}
+
+	// Write to a temporary file first so an interrupted download never
+	// leaves a partial file under a real name
+	file, err := os.CreateTemp(d.path, ".download-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file in %s: %w", d.path, err)
+	}
+	tempPath := file.Name()
+	hasher := sha256.New()
+	written, err := io.Copy(io.MultiWriter(file, hasher), r)
+	if err == nil {
+		// CreateTemp makes the file private; media is read by whoever serves
+		// the exports, as it was when files were created under their names
+		err = file.Chmod(0644)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && maxBytes > 0 && written > maxBytes {
+		err = errOverBudget
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return nil, err
+	}
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	filename, err := d.place(tempPath, stem, ext, contentType, detectedType, written, hash)
+	if err != nil {
+		os.Remove(tempPath)
+		return nil, err
+	}
+	return &MediaFile{Path: filename, SHA256: hash, Size: written}, nil
+}
+
+// place moves a downloaded file to its final name
+func (d *MediaDir) place(tempPath, stem, ext, contentType, detectedType string, size int64, hash string) (string, error) {
+	if !d.Hashed() {
+		filename := filepath.Join(d.path, stem+ext)
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			return "", fmt.Errorf("failed to create directory for %s: %w", filename, err)
+		}
+		return filename, os.Rename(tempPath, filename)
+	}
+
+	relPath := hashedMediaPath(hash, ext)
+	filename := filepath.Join(d.path, filepath.FromSlash(relPath))
+	if _, err := os.Stat(filename); err == nil {
+		os.Remove(tempPath)
+	} else {
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			return "", fmt.Errorf("failed to create directory for %s: %w", filename, err)
+		}
+		if err := os.Rename(tempPath, filename); err != nil {
+			return "", err
+		}
+	}
+
+	entry := MediaIndexEntry{MediaID: stem, Path: relPath, SHA256: hash, Size: size, ContentType: contentType, DetectedType: detectedType, CreatedAt: time.Now().UTC()}
+	if err := appendMediaIndex(d.path, entry); err != nil {
+		return "", err
+	}
+	d.index[stem] = entry
+	return filename, nil
+}
+
+// hashedMediaPath returns where the hashed layout stores content with the
+// given hex SHA-256
+func hashedMediaPath(hash, ext string) string {
+	return hash[0:2] + "/" + hash[2:4] + "/" + hash + ext
+}
+
+func appendMediaIndex(dir string, entry MediaIndexEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, MediaIndexFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open media index: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to update media index: %w", err)
+	}
+	return nil
+}
+
+// loadMediaIndex reads a hashed media directory's index, or returns nil if
+// dir has none. Later lines override earlier ones for the same media ID.
+func loadMediaIndex(dir string) (map[string]MediaIndexEntry, error) {
+	file, err := os.Open(filepath.Join(dir, MediaIndexFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open media index: %w", err)
+	}
+	defer file.Close()
+
+	index := make(map[string]MediaIndexEntry)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var entry MediaIndexEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", filepath.Join(dir, MediaIndexFile), line, err)
+		}
+		index[entry.MediaID] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read media index: %w", err)
+	}
+	return index, nil
+}
+
+// mediaIndexCache keeps loaded indexes for lookups outside a download run,
+// such as exports and OCR. Entries are reloaded when the index file changes.
+var mediaIndexCache = struct {
+	sync.Mutex
+	entries map[string]cachedMediaIndex
+}{entries: make(map[string]cachedMediaIndex)}
+
+type cachedMediaIndex struct {
+	modTime time.Time
+	size    int64
+	index   map[string]MediaIndexEntry
+}
+
+// lookupMediaIndex returns a media ID's entry in dir's index, if dir uses the
+// hashed layout and has the media
+func lookupMediaIndex(dir, stem string) (MediaIndexEntry, bool) {
+	info, err := os.Stat(filepath.Join(dir, MediaIndexFile))
+	if err != nil {
+		return MediaIndexEntry{}, false
+	}
+
+	mediaIndexCache.Lock()
+	defer mediaIndexCache.Unlock()
+	cached, ok := mediaIndexCache.entries[dir]
+	if !ok || !cached.modTime.Equal(info.ModTime()) || cached.size != info.Size() {
+		index, err := loadMediaIndex(dir)
+		if err != nil {
+			return MediaIndexEntry{}, false
+		}
+		cached = cachedMediaIndex{modTime: info.ModTime(), size: info.Size(), index: index}
+		mediaIndexCache.entries[dir] = cached
+	}
+	entry, ok := cached.index[stem]
+	return entry, ok
+}
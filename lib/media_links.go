@@ -0,0 +1,136 @@
+package archive
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Media link strategies for ExportOptions.MediaLinks
+const (
+	MediaLinksLocal    = "local"    // Paths to media downloaded next to the export
+	MediaLinksDownload = "download" // The homeserver's media download URLs
+	MediaLinksS3       = "s3"       // The local media layout under a bucket or CDN URL (MediaBaseURL)
+	MediaLinksDataURI  = "data"     // Downloaded media embedded as data: URIs, for self-contained files
+)
+
+// supportedMediaLinks lists the values accepted by ExportOptions.MediaLinks
+var supportedMediaLinks = []string{MediaLinksLocal, MediaLinksDownload, MediaLinksS3, MediaLinksDataURI}
+
+// MediaLinkResolver decides what the media URLs in exported content link to.
+// Every export format and template sees content already rewritten by one.
+type MediaLinkResolver interface {
+	// ResolveMediaLink returns the link to use for an mxc:// URL found in
+	// content (the message content or a map nested in it), or false to keep
+	// the URL as archived
+	ResolveMediaLink(mxcURL string, content map[string]interface{}) (string, bool)
+}
+
+// NewMediaLinkResolver returns the resolver for a MediaLinks strategy.
+// baseURL is where the media directories are published, for MediaLinksS3.
+func NewMediaLinkResolver(strategy, baseURL string) (MediaLinkResolver, error) {
+	switch strategy {
+	case MediaLinksLocal:
+		return localMediaLinks{}, nil
+	case MediaLinksDownload:
+		return downloadMediaLinks{}, nil
+	case MediaLinksS3:
+		if baseURL == "" {
+			return nil, fmt.Errorf("media links %s need a base URL (--media-base-url)", strategy)
+		}
+		return baseURLMediaLinks{base: strings.TrimSuffix(baseURL, "/")}, nil
+	case MediaLinksDataURI:
+		return dataURIMediaLinks{}, nil
+	}
+	return nil, fmt.Errorf("unsupported media links %s, supported media links: %v", strategy, supportedMediaLinks)
+}
+
+// mediaLinkResolver returns the resolver the options select. Without an
+// explicit strategy, LocalImages chooses between local paths and download URLs.
+func (opts *ExportOptions) mediaLinkResolver() (MediaLinkResolver, error) {
+	strategy := opts.MediaLinks
+	if strategy == "" {
+		strategy = MediaLinksDownload
+		if opts.LocalImages {
+			strategy = MediaLinksLocal
+		}
+	}
+	return NewMediaLinkResolver(strategy, opts.MediaBaseURL)
+}
+
+// RewriteMediaLinks returns a copy of content with every mxc:// "url",
+// including those in nested maps such as encrypted files' "file", replaced by
+// the resolver's link, and the custom emoji in "formatted_body" pointed at
+// their downloaded images
+func RewriteMediaLinks(content map[string]interface{}, resolver MediaLinkResolver) map[string]interface{} {
+	result := make(map[string]interface{}, len(content))
+	for k, v := range content {
+		if urlStr, ok := v.(string); ok && k == "url" && strings.HasPrefix(urlStr, "mxc://") {
+			if link, ok := resolver.ResolveMediaLink(urlStr, content); ok {
+				result[k] = link
+				continue
+			}
+		}
+		if body, ok := v.(string); ok && k == "formatted_body" {
+			result[k] = rewriteEmoticons(body, resolver)
+			continue
+		}
+		if subMap, ok := v.(map[string]interface{}); ok {
+			result[k] = RewriteMediaLinks(subMap, resolver)
+			continue
+		}
+		result[k] = v
+	}
+	return result
+}
+
+// localMediaLinks links images to their downloaded thumbnails
+type localMediaLinks struct{}
+
+func (localMediaLinks) ResolveMediaLink(mxcURL string, content map[string]interface{}) (string, bool) {
+	if !IsImageContent(content) {
+		return "", false
+	}
+	return convertMXCToLocalPath(mxcURL, content), true
+}
+
+// downloadMediaLinks links media to the homeserver's download endpoint
+type downloadMediaLinks struct{}
+
+func (downloadMediaLinks) ResolveMediaLink(mxcURL string, content map[string]interface{}) (string, bool) {
+	link, err := GetDownloadURL(mxcURL)
+	return link, err == nil
+}
+
+// baseURLMediaLinks links to the local media layout published under a base
+// URL, e.g. the thumbnails directory synced to an S3 bucket
+type baseURLMediaLinks struct {
+	base string
+}
+
+func (r baseURLMediaLinks) ResolveMediaLink(mxcURL string, content map[string]interface{}) (string, bool) {
+	path, ok := localMediaLinks{}.ResolveMediaLink(mxcURL, content)
+	if !ok {
+		return "", false
+	}
+	return r.base + "/" + path, true
+}
+
+// dataURIMediaLinks embeds downloaded images in the export. Images that
+// weren't downloaded keep their local path.
+type dataURIMediaLinks struct{}
+
+func (dataURIMediaLinks) ResolveMediaLink(mxcURL string, content map[string]interface{}) (string, bool) {
+	path, ok := localMediaLinks{}.ResolveMediaLink(mxcURL, content)
+	if !ok {
+		return "", false
+	}
+	data, err := os.ReadFile(filepath.FromSlash(path))
+	if err != nil {
+		return path, true
+	}
+	return "data:" + http.DetectContentType(data) + ";base64," + base64.StdEncoding.EncodeToString(data), true
+}
@@ -0,0 +1,138 @@
+package archive
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MediaPlayer is the downloaded file of an audio or video message, which HTML
+// exports with inline players play in place instead of linking to
+type MediaPlayer struct {
+	Kind     string `json:"kind" yaml:"kind"`                             // audio or video
+	URL      string `json:"url" yaml:"url"`                               // The downloaded file, linked as the export's media links are
+	Poster   string `json:"poster,omitempty" yaml:"poster,omitempty"`     // A video's downloaded thumbnail
+	MimeType string `json:"mimetype,omitempty" yaml:"mimetype,omitempty"` // From the event's info
+}
+
+// mxcMediaStem returns the file stem media downloads save an mxc URL under,
+// as GetDownloadStem does for images
+func mxcMediaStem(mxcURL string) string {
+	u, err := url.Parse(mxcURL)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(u.Path, "/")
+}
+
+// localMediaPath returns the path of media downloaded to dir relative to the
+// export, following the index if dir uses the hashed media layout, or "" if
+// it wasn't downloaded
+func localMediaPath(dir, stem string) string {
+	if stem == "" {
+		return ""
+	}
+	if entry, ok := lookupMediaIndex(dir, stem); ok {
+		return dir + "/" + entry.Path
+	}
+	return filepath.ToSlash(findFlatImage(dir, stem))
+}
+
+// downloadedMediaLink returns what the resolver links a downloaded file to:
+// its path, the path under the published base URL, the file itself as a
+// data: URI, or the homeserver's download URL
+func downloadedMediaLink(resolver MediaLinkResolver, mxcURL, path string) string {
+	switch r := resolver.(type) {
+	case baseURLMediaLinks:
+		return r.base + "/" + path
+	case dataURIMediaLinks:
+		data, err := os.ReadFile(filepath.FromSlash(path))
+		if err != nil {
+			return path
+		}
+		return "data:" + http.DetectContentType(data) + ";base64," + base64.StdEncoding.EncodeToString(data)
+	case downloadMediaLinks:
+		if link, err := GetDownloadURL(mxcURL); err == nil {
+			return link
+		}
+	}
+	return path
+}
+
+// AttachMediaPlayers gives each audio or video message whose file was
+// downloaded to ./recordings (by media download --audio-video) a player,
+// with the video's poster if it was downloaded to ./thumbnails. Messages
+// whose file wasn't downloaded are left to link to it.
+func AttachMediaPlayers(exportMessages []ExportMessage, messages []*Message, resolver MediaLinkResolver) {
+	byID := make(map[string]*Message, len(messages))
+	for _, msg := range messages {
+		if msg.IsPlayable() {
+			byID[msg.EventID] = msg
+		}
+	}
+	for i := range exportMessages {
+		msg, ok := byID[exportMessages[i].EventID]
+		if !ok {
+			continue
+		}
+		mxcURL := msg.PlayableURL()
+		path := localMediaPath(mediaKindDirs[MediaKindRecording], mxcMediaStem(mxcURL))
+		if path == "" {
+			continue
+		}
+		msgtype, _ := msg.Content["msgtype"].(string)
+		info, _ := msg.Content["info"].(map[string]interface{})
+		player := &MediaPlayer{Kind: strings.TrimPrefix(msgtype, "m."), URL: downloadedMediaLink(resolver, mxcURL, path)}
+		player.MimeType, _ = info["mimetype"].(string)
+		if posterURL := msg.PosterURL(); posterURL != "" {
+			if poster := localMediaPath(mediaKindDirs[MediaKindThumbnail], mxcMediaStem(posterURL)); poster != "" {
+				player.Poster = downloadedMediaLink(resolver, posterURL, poster)
+			}
+		}
+		exportMessages[i].Player = player
+	}
+}
+
+// MediaDuration formats the duration an audio or video message's info
+// records, such as 0:42 or 1:02:03, or returns "" if it records none
+func MediaDuration(content map[string]interface{}) string {
+	info, _ := content["info"].(map[string]interface{})
+	var ms int64
+	switch duration := info["duration"].(type) {
+	case float64:
+		ms = int64(duration)
+	case int64:
+		ms = duration
+	case int:
+		ms = int64(duration)
+	}
+	if ms <= 0 {
+		return ""
+	}
+	seconds := (ms + 500) / 1000
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+// trustedMediaURL lets the data: URIs of media an export embeds through
+// html/template, which would otherwise replace them in src and poster
+// attributes. Other links, and SVG, which can carry scripts, are left to be
+// escaped as usual.
+func trustedMediaURL(link string) interface{} {
+	if strings.HasPrefix(link, "data:image/svg") {
+		return link
+	}
+	for _, prefix := range []string{"data:image/", "data:audio/", "data:video/"} {
+		if strings.HasPrefix(link, prefix) {
+			return template.URL(link)
+		}
+	}
+	return link
+}
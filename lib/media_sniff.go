@@ -0,0 +1,131 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// sniffLength is how much of a file SniffMediaType looks at, as much as
+// http.DetectContentType considers
+const sniffLength = 512
+
+// isoBrands are the ISO base media file brands, from a file's ftyp box,
+// that tell formats http.DetectContentType doesn't apart, most specific
+// first: an HEIC photo lists mif1 as well as heic
+var isoBrands = []struct {
+	brands      []string
+	contentType string
+}{
+	{[]string{"avif", "avis"}, "image/avif"},
+	{[]string{"heic", "heix", "heim", "heis"}, "image/heic"},
+	{[]string{"mif1", "msf1"}, "image/heif"},
+	{[]string{"M4A ", "M4B "}, "audio/mp4"},
+	{[]string{"qt  "}, "video/quicktime"},
+	{[]string{"3gp4", "3gp5", "3gp6", "3g2a"}, "video/3gpp"},
+}
+
+// SniffMediaType returns the content type of media from its first bytes,
+// whatever its event or the homeserver claim, or "" if they don't tell.
+// Besides what http.DetectContentType recognizes it knows HEIC, AVIF and
+// other ISO media brands, FLAC, TIFF, SVG, and Ogg audio.
+func SniffMediaType(head []byte) string {
+	if len(head) > sniffLength {
+		head = head[:sniffLength]
+	}
+	if contentType := isoMediaType(head); contentType != "" {
+		return contentType
+	}
+	switch {
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return "audio/flac"
+	case bytes.HasPrefix(head, []byte("II*\x00")), bytes.HasPrefix(head, []byte("MM\x00*")):
+		return "image/tiff"
+	}
+
+	contentType := mediaType(http.DetectContentType(head))
+	switch {
+	case contentType == "application/octet-stream":
+		return ""
+	case contentType == "application/ogg" && bytes.Contains(head, []byte("theora")):
+		return "video/ogg"
+	case contentType == "application/ogg":
+		// Voice messages are Opus in Ogg
+		return "audio/ogg"
+	case contentType == "audio/wave":
+		return "audio/wav"
+	case strings.HasPrefix(contentType, "text/") && bytes.Contains(bytes.ToLower(head), []byte("<svg")):
+		return "image/svg+xml"
+	}
+	return contentType
+}
+
+// isoMediaType returns the content type an ISO base media file's brands
+// name, or "" if head isn't one or its brands are plain MP4, which
+// http.DetectContentType recognizes
+func isoMediaType(head []byte) string {
+	if len(head) < 12 || string(head[4:8]) != "ftyp" {
+		return ""
+	}
+	size := int(binary.BigEndian.Uint32(head[0:4]))
+	if size > len(head) || size < 12 {
+		size = len(head)
+	}
+	// The major brand, then the compatible brands after the minor version
+	brands := []string{string(head[8:12])}
+	for i := 16; i+4 <= size; i += 4 {
+		brands = append(brands, string(head[i:i+4]))
+	}
+	for _, known := range isoBrands {
+		for _, brand := range brands {
+			for _, b := range known.brands {
+				if brand == b {
+					return known.contentType
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// mediaExtensions are the file extensions of content types whose subtype
+// isn't one
+var mediaExtensions = map[string]string{
+	"image/svg+xml":            ".svg",
+	"image/vnd.microsoft.icon": ".ico",
+	"image/x-icon":             ".ico",
+	"audio/mpeg":               ".mp3",
+	"audio/mp4":                ".m4a",
+	"audio/wave":               ".wav",
+	"audio/x-wav":              ".wav",
+	"video/quicktime":          ".mov",
+	"video/x-matroska":         ".mkv",
+	"video/x-msvideo":          ".avi",
+	"application/ogg":          ".ogg",
+}
+
+// MediaExtension returns the file extension media of a content type is
+// saved with: its subtype, as in .png or .webp, unless that isn't an
+// extension, and "" for a content type without a subtype
+func MediaExtension(contentType string) string {
+	contentType = mediaType(contentType)
+	if ext, ok := mediaExtensions[contentType]; ok {
+		return ext
+	}
+	_, subtype, ok := strings.Cut(contentType, "/")
+	if !ok || subtype == "" {
+		return ""
+	}
+	return "." + subtype
+}
+
+// mediaType returns a content type without its parameters, lowercased
+func mediaType(contentType string) string {
+	if parsed, _, err := mime.ParseMediaType(contentType); err == nil {
+		return parsed
+	}
+	contentType, _, _ = strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
@@ -0,0 +1,282 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// pillPattern matches the user links that clients put in formatted bodies
+// for mentions, as matrix.to URLs or matrix: URIs
+var pillPattern = regexp.MustCompile(`href=["'](?:https://matrix\.to/#/|matrix:u/)((?:@|%40)[^"'?/]+)`)
+
+// roomPingPattern matches a legacy @room notification in a message's text
+var roomPingPattern = regexp.MustCompile(`(^|[^\w@])@room\b`)
+
+// MessageMentions returns the users a message mentions, from its m.mentions,
+// the pills in its formatted body and the user IDs written in its text, and
+// whether it notifies the whole room. The quote of a replied-to message
+// doesn't count.
+func MessageMentions(content map[string]interface{}) (userIDs []string, room bool) {
+	seen := make(map[string]bool)
+	add := func(userID string) {
+		if userID != "" && !seen[userID] {
+			seen[userID] = true
+			userIDs = append(userIDs, userID)
+		}
+	}
+
+	if mentions, ok := content["m.mentions"].(map[string]interface{}); ok {
+		ids, _ := mentions["user_ids"].([]interface{})
+		for _, id := range ids {
+			if userID, ok := id.(string); ok {
+				add(userID)
+			}
+		}
+		room, _ = mentions["room"].(bool)
+	}
+
+	if formatted, ok := content["formatted_body"].(string); ok {
+		formatted = replyFallbackPattern.ReplaceAllString(formatted, "")
+		for _, match := range pillPattern.FindAllStringSubmatch(formatted, -1) {
+			if userID, err := url.PathUnescape(match[1]); err == nil {
+				add(userID)
+			}
+		}
+	}
+
+	if body, ok := content["body"].(string); ok {
+		relatesTo, _ := content["m.relates_to"].(map[string]interface{})
+		_, isReply := relatesTo["m.in_reply_to"]
+		body = normalizeBody(body, isReply)
+		for _, userID := range mentionedUserIDs(body) {
+			add(userID)
+		}
+		if roomPingPattern.MatchString(body) {
+			room = true
+		}
+	}
+	return userIDs, room
+}
+
+// MentionEdge counts the messages in which one user mentioned another
+type MentionEdge struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Count int    `json:"count"`
+}
+
+// MentionUser summarizes the mentions one user received and made
+type MentionUser struct {
+	UserID      string `json:"user_id"`
+	Mentioned   int    `json:"mentioned"`    // Messages in which others mentioned them
+	MentionedBy int    `json:"mentioned_by"` // Distinct people who mentioned them
+	Mentions    int    `json:"mentions"`     // Mentions they made of others
+	RoomPings   int    `json:"room_pings"`   // Messages in which they notified the whole room
+}
+
+// MentionNetwork is who mentions whom across a set of messages
+type MentionNetwork struct {
+	Users []MentionUser `json:"users"` // Most mentioned first
+	Edges []MentionEdge `json:"edges"` // Most frequent first
+}
+
+// BuildMentionNetwork counts the mentions in messages. Edits are skipped so
+// a corrected message isn't counted twice, and people mentioning themselves
+// are left out. Users in exclude are left out both as senders and as the
+// people mentioned. Merged users are counted as the person they belong to.
+func BuildMentionNetwork(messages []*Message, exclude map[string]bool, persons Persons) *MentionNetwork {
+	exclude = persons.Exclude(exclude)
+	users := make(map[string]*MentionUser)
+	user := func(userID string) *MentionUser {
+		if users[userID] == nil {
+			users[userID] = &MentionUser{UserID: userID}
+		}
+		return users[userID]
+	}
+	edges := make(map[[2]string]int)
+
+	for _, msg := range messages {
+		sender := persons.Of(msg.Sender)
+		if msg.MessageType != EventTypeMessage || isEdit(msg) || exclude[sender] {
+			continue
+		}
+		mentioned, room := MessageMentions(msg.Content)
+		if room {
+			user(sender).RoomPings++
+		}
+		counted := make(map[string]bool)
+		for _, userID := range mentioned {
+			userID = persons.Of(userID)
+			if userID == sender || exclude[userID] || counted[userID] {
+				continue
+			}
+			counted[userID] = true
+			user(sender).Mentions++
+			target := user(userID)
+			target.Mentioned++
+			key := [2]string{sender, userID}
+			if edges[key] == 0 {
+				target.MentionedBy++
+			}
+			edges[key]++
+		}
+	}
+
+	network := &MentionNetwork{Users: []MentionUser{}, Edges: []MentionEdge{}}
+	for _, u := range users {
+		network.Users = append(network.Users, *u)
+	}
+	sort.Slice(network.Users, func(i, j int) bool {
+		a, b := network.Users[i], network.Users[j]
+		if a.Mentioned != b.Mentioned {
+			return a.Mentioned > b.Mentioned
+		}
+		return a.UserID < b.UserID
+	})
+	for key, count := range edges {
+		network.Edges = append(network.Edges, MentionEdge{From: key[0], To: key[1], Count: count})
+	}
+	sort.Slice(network.Edges, func(i, j int) bool {
+		a, b := network.Edges[i], network.Edges[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		return a.To < b.To
+	})
+	return network
+}
+
+// WriteDOT writes the network as a Graphviz digraph whose edges are labeled
+// and weighted with their mention counts
+func (n *MentionNetwork) WriteDOT(w io.Writer) error {
+	if _, err := fmt.Fprintln(w, "digraph mentions {"); err != nil {
+		return err
+	}
+	for _, u := range n.Users {
+		if u.Mentions == 0 && u.Mentioned == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "  %s;\n", dotQuote(u.UserID))
+	}
+	for _, e := range n.Edges {
+		fmt.Fprintf(w, "  %s -> %s [weight=%d, label=\"%d\"];\n", dotQuote(e.From), dotQuote(e.To), e.Count, e.Count)
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+// dotQuote quotes an ID for the DOT language
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// WriteMentionGraph writes the network's edges to filename: as Graphviz DOT
+// for .dot and .gv files, and as a JSON edge list for .json files
+func WriteMentionGraph(filename string, network *MentionNetwork) error {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext != ".dot" && ext != ".gv" && ext != ".json" {
+		return fmt.Errorf("unsupported mention graph format %s, supported formats: [.dot .gv .json]", ext)
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer file.Close()
+
+	if ext == ".json" {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(network.Edges)
+	}
+	return network.WriteDOT(file)
+}
+
+// AnalyzeMentions prints the most mentioned users and the most frequent
+// mention pairs in a room, or in every archived room if roomID is empty, and
+// writes the mention network to graphPath if it is set. People who opted out
+// of archiving are left out.
+func AnalyzeMentions(roomID string, top int, graphPath string) error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	ctx := context.Background()
+	if roomID != "" {
+		var err error
+		if roomID, err = resolveExportRoom(roomID); err != nil {
+			return err
+		}
+	}
+	messages, err := GetDatabase().GetMessages(ctx, &MessageFilter{RoomID: roomID, EventType: EventTypeMessage}, 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %w", err)
+	}
+	optedOut, err := optedOutUsers(ctx, GetDatabase())
+	if err != nil {
+		return err
+	}
+	persons, err := loadPersons(ctx, GetDatabase())
+	if err != nil {
+		return err
+	}
+	network := BuildMentionNetwork(messages, optedOut, persons)
+
+	if graphPath != "" {
+		if err := WriteMentionGraph(graphPath, network); err != nil {
+			return err
+		}
+		fmt.Fprintf(progressWriter(), "Wrote %d mention edges to %q\n", len(network.Edges), graphPath)
+	}
+	if jsonOutput() {
+		return writeJSON(network)
+	}
+
+	pingers := slices.DeleteFunc(slices.Clone(network.Users), func(u MentionUser) bool { return u.RoomPings == 0 })
+	sort.SliceStable(pingers, func(i, j int) bool { return pingers[i].RoomPings > pingers[j].RoomPings })
+	if len(network.Edges) == 0 && len(pingers) == 0 {
+		fmt.Println("No mentions found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MOST MENTIONED\tMENTIONED\tBY\tMENTIONS MADE")
+	for i, u := range network.Users {
+		if (top > 0 && i == top) || u.Mentioned == 0 {
+			break
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", u.UserID, u.Mentioned, u.MentionedBy, u.Mentions)
+	}
+	fmt.Fprintln(w, "\nWHO\tMENTIONS\tCOUNT")
+	for i, e := range network.Edges {
+		if top > 0 && i == top {
+			break
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\n", e.From, e.To, e.Count)
+	}
+	if len(pingers) > 0 {
+		fmt.Fprintln(w, "\nNOTIFIED THE ROOM\t@ROOM")
+		for i, u := range pingers {
+			if top > 0 && i == top {
+				break
+			}
+			fmt.Fprintf(w, "%s\t%d\n", u.UserID, u.RoomPings)
+		}
+	}
+	return w.Flush()
+}
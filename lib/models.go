@@ -5,6 +5,8 @@ import (
 	"regexp"
 	"strings"
 	"time"
+
+	"maunium.net/go/mautrix/event"
 )
 
 // Message represents a Matrix message stored in the database
@@ -15,8 +17,34 @@ type Message struct {
 	Sender      string                 `json:"sender"`
 	UserID      string                 `json:"user_id,omitempty"`
 	MessageType string                 `json:"type"`
+	MsgType     string                 `json:"msgtype,omitempty"`
 	Timestamp   time.Time              `json:"timestamp"`
 	Content     map[string]interface{} `json:"content"`
+	Account     string                 `json:"account,omitempty"`
+
+	// Provenance of forwarded or relayed content, parsed from bridge hints
+	ForwardedFrom     string `json:"forwarded_from,omitempty"`
+	ForwardedPlatform string `json:"forwarded_platform,omitempty"`
+
+	// NormalizedContentHash as stored at import; empty in encrypted archives
+	ContentHash string `json:"content_hash,omitempty"`
+
+	// Attachment of m.file messages as stored at import; empty in encrypted archives
+	FileName     string `json:"file_name,omitempty"`
+	FileMimeType string `json:"file_mimetype,omitempty"`
+	FileSize     int64  `json:"file_size,omitempty"`
+
+	// Real author of a message a bot or webhook relayed, from attribution rules
+	AuthorName     string `json:"author_name,omitempty"`
+	AuthorPlatform string `json:"author_platform,omitempty"`
+
+	// ISO 639-1 code of the message's language, if it was detected at
+	// import; empty in encrypted archives (see Language)
+	Lang string `json:"lang,omitempty"`
+
+	// The server's reaction counts, edits and thread replies of the event
+	// when it was fetched; empty in encrypted archives
+	Aggregations *BundledAggregations `json:"aggregations,omitempty"`
 }
 
 // ContentJSON returns the content as a JSON string for database storage
@@ -70,6 +98,36 @@ func (m *Message) ThumbnailURL() string {
 	return ""
 }
 
+// IsPlayable returns true if the message is an audio or video message
+func (m *Message) IsPlayable() bool {
+	msgtype, ok := m.Content["msgtype"].(string)
+	return ok && (msgtype == "m.audio" || msgtype == "m.video")
+}
+
+// PlayableURL returns the audio or video URL if this is an audio or video message
+func (m *Message) PlayableURL() string {
+	if !m.IsPlayable() {
+		return ""
+	}
+	if url, ok := m.Content["url"].(string); ok {
+		return url
+	}
+	return ""
+}
+
+// PosterURL returns the thumbnail URL if this is a video message
+func (m *Message) PosterURL() string {
+	if msgtype, _ := m.Content["msgtype"].(string); msgtype != "m.video" {
+		return ""
+	}
+	if info, ok := m.Content["info"].(map[string]interface{}); ok {
+		if thumbURL, ok := info["thumbnail_url"].(string); ok {
+			return thumbURL
+		}
+	}
+	return ""
+}
+
 // ValidateMessage validates a message according to Matrix patterns
 func (m *Message) Validate() error {
 	// Room ID pattern: !.+:.+
@@ -97,14 +155,68 @@ func (m *Message) Validate() error {
 		}
 	}
 
-	// Message type should be m.room.message
-	if m.MessageType != "m.room.message" {
+	// Type should be one of the archived event types
+	if !IsArchivedEventType(m.MessageType) {
 		return &ValidationError{Field: "type", Message: "Invalid message type"}
 	}
 
 	return nil
 }
 
+// Event types stored in the messages table
+const (
+	EventTypeMessage   = "m.room.message"
+	EventTypeReaction  = "m.reaction"
+	EventTypeEncrypted = "m.room.encrypted" // Messages that could not be decrypted
+)
+
+// IsArchivedEventType reports whether eventType is stored in the messages table
+func IsArchivedEventType(eventType string) bool {
+	switch eventType {
+	case EventTypeMessage, EventTypeReaction, EventTypeEncrypted:
+		return true
+	}
+	return false
+}
+
+// contentMsgType returns the msgtype of message content, or "" if it has none
+func contentMsgType(content map[string]interface{}) string {
+	switch msgtype := content["msgtype"].(type) {
+	case string:
+		return msgtype
+	case event.MessageType:
+		return string(msgtype)
+	}
+	return ""
+}
+
+// msgTypeForStorage returns MsgType, falling back to the content's msgtype
+func (m *Message) msgTypeForStorage() string {
+	if m.MsgType != "" {
+		return m.MsgType
+	}
+	return contentMsgType(m.Content)
+}
+
+// inferEventType guesses the event type of content archived before event types
+// were recorded: reactions have an m.annotation relation and no msgtype, and
+// undecryptable messages were stored as placeholders carrying the session ID.
+func inferEventType(content map[string]interface{}) string {
+	if contentMsgType(content) == "" {
+		if relatesTo, ok := content["m.relates_to"].(map[string]interface{}); ok {
+			if relType, _ := relatesTo["rel_type"].(string); relType == "m.annotation" {
+				return EventTypeReaction
+			}
+		}
+	}
+	_, hasSession := content["session_id"]
+	_, hasAlgorithm := content["algorithm"]
+	if hasSession && hasAlgorithm {
+		return EventTypeEncrypted
+	}
+	return EventTypeMessage
+}
+
 // ValidationError represents a validation error
 type ValidationError struct {
 	Field   string
@@ -120,6 +232,9 @@ type MessageFilter struct {
 	RoomID    string
 	EventID   string
 	Sender    string
+	Account   string
+	EventType string // e.g. m.room.message or m.reaction
+	MsgType   string // e.g. m.text or m.image
 	StartTime *time.Time
 	EndTime   *time.Time
 }
@@ -148,6 +263,21 @@ func (f *MessageFilter) ToSQL() (string, []interface{}) {
 		args = append(args, f.Sender)
 	}
 
+	if f.Account != "" {
+		conditions = append(conditions, "account = ?")
+		args = append(args, f.Account)
+	}
+
+	if f.EventType != "" {
+		conditions = append(conditions, "message_type = ?")
+		args = append(args, f.EventType)
+	}
+
+	if f.MsgType != "" {
+		conditions = append(conditions, "msgtype = ?")
+		args = append(args, f.MsgType)
+	}
+
 	if f.StartTime != nil {
 		conditions = append(conditions, "timestamp >= ?")
 		args = append(args, *f.StartTime)
@@ -164,3 +294,296 @@ func (f *MessageFilter) ToSQL() (string, []interface{}) {
 
 	return strings.Join(conditions, " AND "), args
 }
+
+// AccountStats summarizes the messages archived through a single source account
+type AccountStats struct {
+	Account      string    `json:"account"`
+	MessageCount int64     `json:"message_count"`
+	RoomCount    int64     `json:"room_count"`
+	FirstMessage time.Time `json:"first_message"`
+	LastMessage  time.Time `json:"last_message"`
+}
+
+// RoomStats summarizes the messages archived from a single room
+type RoomStats struct {
+	RoomID       string    `json:"room_id"`
+	MessageCount int64     `json:"message_count"`
+	FirstMessage time.Time `json:"first_message"`
+	LastMessage  time.Time `json:"last_message"`
+}
+
+// DailyStats counts the messages one sender posted in a room on one day
+// (UTC), by event type
+type DailyStats struct {
+	RoomID       string    `json:"room_id"`
+	Day          time.Time `json:"day"`
+	Sender       string    `json:"sender"`
+	MessageType  string    `json:"message_type"`
+	MessageCount int64     `json:"message_count"`
+	FirstMessage time.Time `json:"first_message"`
+	LastMessage  time.Time `json:"last_message"`
+}
+
+// Annotation is a curator note attached to an archived message. Notes are kept
+// separate from the message so the original content is never edited.
+type Annotation struct {
+	ID        int64     `json:"id"`
+	EventID   string    `json:"event_id"`
+	Note      string    `json:"note"`
+	Author    string    `json:"author,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Bookmark marks an archived message as worth revisiting. Bookmarks are local
+// to the archive, unlike pins which come from the room's m.room.pinned_events state.
+type Bookmark struct {
+	EventID   string    `json:"event_id"`
+	Label     string    `json:"label,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MembershipEvent is an m.room.member state event seen in a room's timeline.
+// Membership history gives participants' join and leave dates.
+type MembershipEvent struct {
+	EventID     string    `json:"event_id"`
+	RoomID      string    `json:"room_id"`
+	UserID      string    `json:"user_id"`
+	Membership  string    `json:"membership"`
+	DisplayName string    `json:"display_name,omitempty"`
+	AvatarURL   string    `json:"avatar_url,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// ModerationEvent is an invite, knock, kick, ban or unban in a room, kept
+// with who did it and the reason they gave
+type ModerationEvent struct {
+	EventID   string    `json:"event_id"`
+	RoomID    string    `json:"room_id"`
+	Action    string    `json:"action"`
+	Actor     string    `json:"actor"`
+	Target    string    `json:"target"`
+	Reason    string    `json:"reason,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// RoomTag is a tag the archiving user gave a room in their client (m.tag
+// room account data), such as m.favourite or m.lowpriority. Order positions
+// the room among others with the same tag; nil if the client set none.
+type RoomTag struct {
+	RoomID string   `json:"room_id"`
+	Tag    string   `json:"tag"`
+	Order  *float64 `json:"order,omitempty"`
+}
+
+// EmotePack is a pack of custom emoji and stickers (MSC2545): one of a
+// room's im.ponies.room_emotes state events or, with an empty RoomID, the
+// archiving user's im.ponies.user_emotes account data. Content is the event
+// content as archived; the other fields are read from it by NewEmotePack.
+type EmotePack struct {
+	RoomID      string                 `json:"room_id,omitempty"`
+	StateKey    string                 `json:"state_key,omitempty"`
+	DisplayName string                 `json:"display_name,omitempty"`
+	Usage       []string               `json:"usage,omitempty"` // emoticon, sticker or both; both if empty
+	Images      []EmoteImage           `json:"images"`          // By shortcode
+	Content     map[string]interface{} `json:"-"`
+	UpdatedAt   time.Time              `json:"updated_at"`
+}
+
+// Name returns the pack's display name, or its state key if it has none
+func (p *EmotePack) Name() string {
+	switch {
+	case p.DisplayName != "":
+		return p.DisplayName
+	case p.StateKey != "":
+		return p.StateKey
+	}
+	return "(default)"
+}
+
+// RoomVersion records a room's version and its neighbours in a chain of room
+// upgrades. PredecessorID comes from the room's m.room.create event;
+// SuccessorID and UpgradedAt from the m.room.tombstone that replaced it.
+type RoomVersion struct {
+	RoomID        string     `json:"room_id"`
+	RoomVersion   string     `json:"room_version,omitempty"`
+	PredecessorID string     `json:"predecessor_id,omitempty"`
+	SuccessorID   string     `json:"successor_id,omitempty"`
+	UpgradedAt    *time.Time `json:"upgraded_at,omitempty"`
+}
+
+// RoomProfile is what a room's state says about it when it was last
+// imported: its name, topic and canonical alias, from their state events,
+// and when it was created, from its m.room.create event
+type RoomProfile struct {
+	RoomID         string     `json:"room_id"`
+	Name           string     `json:"name,omitempty"`
+	Topic          string     `json:"topic,omitempty"`
+	CanonicalAlias string     `json:"canonical_alias,omitempty"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+}
+
+// RoomSeal marks a room's archive as complete, for rooms that were shut down
+// and must stay as archived. It records the range of messages the room held
+// when it was sealed and a hash of them, and imports refuse to add to it.
+type RoomSeal struct {
+	RoomID         string    `json:"room_id"`
+	SealedAt       time.Time `json:"sealed_at"`
+	FirstEventID   string    `json:"first_event_id"`
+	FirstTimestamp time.Time `json:"first_timestamp"`
+	LastEventID    string    `json:"last_event_id"`
+	LastTimestamp  time.Time `json:"last_timestamp"`
+	MessageCount   int64     `json:"message_count"`
+	Hash           string    `json:"hash"`
+}
+
+// ImportState is a room's position in an import that hasn't finished, saved
+// after every batch so an interrupted import can resume, or in a throttled
+// import that spans several runs. NextBatch is the pagination token to
+// continue backward from; Complete marks rooms whose history was fully
+// imported earlier in a throttled session.
+type ImportState struct {
+	RoomID    string    `json:"room_id"`
+	NextBatch string    `json:"next_batch,omitempty"`
+	Complete  bool      `json:"complete"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// MediaText is text extracted from a downloaded image by OCR, so screenshots
+// can be found by search. Text is empty when OCR found nothing to read.
+type MediaText struct {
+	EventID   string    `json:"event_id"`
+	RoomID    string    `json:"room_id"`
+	Path      string    `json:"path"`
+	Text      string    `json:"text"`
+	Engine    string    `json:"engine"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// UnresolvedRelation is a reaction, edit or reply whose target event isn't
+// archived, such as one imported before the message it refers to. Imports
+// record these after each run and drop them once the target arrives.
+type UnresolvedRelation struct {
+	EventID       string    `json:"event_id"`
+	TargetEventID string    `json:"target_event_id"`
+	RoomID        string    `json:"room_id"`
+	RelType       string    `json:"rel_type"`
+	FirstSeen     time.Time `json:"first_seen"`
+}
+
+// Outcomes of downloading a MediaFile
+const (
+	MediaStatusDownloaded = "downloaded"
+	MediaStatusFailed     = "failed"
+	MediaStatusSkipped    = "skipped" // Left out of a budgeted download
+)
+
+// MediaFile records a media downloader's attempt to keep a local copy of a
+// message's media, so exports and other tools can find the file from the
+// event instead of re-deriving its name from the mxc URL
+type MediaFile struct {
+	EventID      string    `json:"event_id"`
+	RoomID       string    `json:"room_id"` // From the message, when read back
+	Kind         string    `json:"kind"`    // MediaKindThumbnail or MediaKindImage
+	MXC          string    `json:"mxc"`
+	Path         string    `json:"path,omitempty"` // The downloaded copy, with forward slashes
+	Status       string    `json:"status"`
+	SHA256       string    `json:"sha256,omitempty"`
+	Size         int64     `json:"size,omitempty"`
+	ClaimedType  string    `json:"claimed_type,omitempty"`  // The content type the homeserver served, as the uploader claimed it
+	DetectedType string    `json:"detected_type,omitempty"` // The content type sniffed from the file; empty if it didn't tell
+	Error        string    `json:"error,omitempty"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// RoomUser is a room member's profile as last fetched from the homeserver,
+// cached so exports don't look up every sender's display name each time
+type RoomUser struct {
+	RoomID      string    `json:"room_id"`
+	UserID      string    `json:"user_id"`
+	DisplayName string    `json:"display_name,omitempty"`
+	AvatarURL   string    `json:"avatar_url,omitempty"`
+	Deactivated bool      `json:"deactivated,omitempty"` // The account was deactivated, so its profile isn't looked up again
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	// Who a bridged user is on their own network; nil for other users
+	Platform *PlatformIdentity `json:"platform,omitempty"`
+}
+
+// QuarantinedMessage is a message an import rejected as invalid, kept with
+// the reason instead of being dropped, so it can be reviewed and imported
+// once fixed or with a more lenient validation mode
+type QuarantinedMessage struct {
+	Message       *Message  `json:"message"`
+	Reason        string    `json:"reason"`
+	Validation    string    `json:"validation"` // The validation mode it failed
+	QuarantinedAt time.Time `json:"quarantined_at"`
+}
+
+// Stages at which an import can fail to archive an event
+const (
+	FailureConversion = "conversion" // The event couldn't be converted to a message
+	FailureDecryption = "decryption" // The event was stored as an undecryptable placeholder
+	FailureValidation = "validation" // The message was quarantined; see QuarantinedMessage
+)
+
+// FailedEvent is an event an import couldn't convert to a message, or could
+// only store as a placeholder because it couldn't be decrypted. The raw event
+// is kept so the conversion can be retried after a fix, or once its room key
+// has been recovered.
+type FailedEvent struct {
+	EventID  string          `json:"event_id"`
+	RoomID   string          `json:"room_id"`
+	Stage    string          `json:"stage"`
+	Error    string          `json:"error"`
+	Event    json.RawMessage `json:"event"`
+	Attempts int             `json:"attempts"`
+	FailedAt time.Time       `json:"failed_at"`
+}
+
+// RestoredRoom is the room "restore" created on a homeserver for an archived
+// room, so a restore that was interrupted or repeated posts into it again
+type RestoredRoom struct {
+	SourceRoomID string    `json:"source_room_id"`
+	Homeserver   string    `json:"homeserver"`
+	TargetRoomID string    `json:"target_room_id"`
+	RestoredAt   time.Time `json:"restored_at"`
+}
+
+// RestoredEvent maps an archived event to the event "restore" posted for it,
+// so replies, edits and reactions point at the restored copies
+type RestoredEvent struct {
+	SourceEventID string `json:"source_event_id"`
+	SourceRoomID  string `json:"source_room_id"`
+	Homeserver    string `json:"homeserver"`
+	TargetEventID string `json:"target_event_id"`
+}
+
+// OptOut records a person who declined to have their messages archived.
+// Exports always withhold their messages; imports skip them when asked to.
+type OptOut struct {
+	UserID     string    `json:"user_id"`
+	Reason     string    `json:"reason,omitempty"`
+	OptedOutAt time.Time `json:"opted_out_at"`
+}
+
+// PersonAlias assigns a user ID to the person it belongs to, for people who
+// appear under several identities, such as a Matrix account and the ghosts
+// bridges made for them on other networks
+type PersonAlias struct {
+	UserID   string    `json:"user_id"`
+	PersonID string    `json:"person_id"`
+	MergedAt time.Time `json:"merged_at"`
+}
+
+// EventVerification is the result of checking an archived message against
+// the copy its homeserver holds, signed by the server it was sent from
+type EventVerification struct {
+	EventID   string    `json:"event_id"`
+	RoomID    string    `json:"room_id"`
+	Status    string    `json:"status"`           // One of the Verification statuses
+	Source    string    `json:"source,omitempty"` // API the checked copy came from
+	Origin    string    `json:"origin,omitempty"` // Server whose signature was checked
+	KeyID     string    `json:"key_id,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
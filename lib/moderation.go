@@ -0,0 +1,226 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"maunium.net/go/mautrix/event"
+)
+
+// Moderation actions, derived from a membership change and who made it
+const (
+	ModerationInvite       = "invite"
+	ModerationRevokeInvite = "revoke_invite"
+	ModerationKnock        = "knock"
+	ModerationRejectKnock  = "reject_knock"
+	ModerationKick         = "kick"
+	ModerationBan          = "ban"
+	ModerationUnban        = "unban"
+)
+
+// moderationVerbs describe each action in the text moderation log
+var moderationVerbs = map[string]string{
+	ModerationInvite:       "invited",
+	ModerationRevokeInvite: "withdrew the invite for",
+	ModerationKnock:        "knocked",
+	ModerationRejectKnock:  "rejected the knock from",
+	ModerationKick:         "kicked",
+	ModerationBan:          "banned",
+	ModerationUnban:        "unbanned",
+}
+
+// ModerationAction classifies a membership change of target, made by sender,
+// from prevMembership to membership. It returns "" for changes that aren't
+// moderation, such as joins, profile changes and users leaving on their own.
+func ModerationAction(membership, prevMembership, sender, target string) string {
+	switch membership {
+	case "invite":
+		return ModerationInvite
+	case "knock":
+		return ModerationKnock
+	case "ban":
+		return ModerationBan
+	case "leave":
+		if sender == target {
+			return ""
+		}
+		switch prevMembership {
+		case "ban":
+			return ModerationUnban
+		case "invite":
+			return ModerationRevokeInvite
+		case "knock":
+			return ModerationRejectKnock
+		}
+		return ModerationKick
+	}
+	return ""
+}
+
+// convertModerationEvent returns the moderation action in an m.room.member
+// event, or nil if the event isn't one
+func convertModerationEvent(evt *event.Event, roomID string) *ModerationEvent {
+	if evt.StateKey == nil || *evt.StateKey == "" {
+		return nil
+	}
+
+	if err := evt.Content.ParseRaw(evt.Type); err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+		log.Printf("Failed to parse membership event %s: %v", evt.ID, err)
+		return nil
+	}
+	content := evt.Content.AsMember()
+
+	prevMembership := ""
+	if prev := evt.Unsigned.PrevContent; prev != nil {
+		if err := prev.ParseRaw(evt.Type); err == nil || errors.Is(err, event.ErrContentAlreadyParsed) {
+			prevMembership = string(prev.AsMember().Membership)
+		}
+	}
+
+	action := ModerationAction(string(content.Membership), prevMembership, evt.Sender.String(), *evt.StateKey)
+	if action == "" {
+		return nil
+	}
+	return &ModerationEvent{
+		EventID:   evt.ID.String(),
+		RoomID:    roomID,
+		Action:    action,
+		Actor:     evt.Sender.String(),
+		Target:    *evt.StateKey,
+		Reason:    content.Reason,
+		Timestamp: time.UnixMilli(evt.Timestamp),
+	}
+}
+
+// WithholdOptedOutModeration returns moderation events without those made by
+// or concerning people who opted out, whose user IDs and the reasons given
+// would otherwise be exported, and the number withheld
+func WithholdOptedOutModeration(events []*ModerationEvent, optedOut map[string]bool) ([]*ModerationEvent, int) {
+	if len(optedOut) == 0 {
+		return events, 0
+	}
+	kept := make([]*ModerationEvent, 0, len(events))
+	for _, evt := range events {
+		if !optedOut[evt.Actor] && !optedOut[evt.Target] {
+			kept = append(kept, evt)
+		}
+	}
+	return kept, len(events) - len(kept)
+}
+
+// moderationLog is the JSON/YAML layout of a moderation log
+type moderationLog struct {
+	RoomID      string             `json:"room_id" yaml:"room_id"`
+	GeneratedAt time.Time          `json:"generated_at" yaml:"generated_at"`
+	Events      []*ModerationEvent `json:"events" yaml:"events"`
+	OptedOut    int                `json:"opted_out,omitempty" yaml:"opted_out,omitempty"` // Events withheld because people in them opted out
+}
+
+// WriteModerationLog writes a room's moderation events in chronological
+// order, as text or as a JSON or YAML document. optedOut is the number of
+// events withheld because people in them opted out.
+func WriteModerationLog(w io.Writer, ext, roomID string, events []*ModerationEvent, optedOut int) error {
+	if events == nil {
+		events = []*ModerationEvent{}
+	}
+
+	switch ext {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(moderationLog{RoomID: roomID, GeneratedAt: time.Now().UTC(), Events: events, OptedOut: optedOut})
+
+	case "yaml":
+		encoder := yaml.NewEncoder(w)
+		defer encoder.Close()
+		return encoder.Encode(moderationLog{RoomID: roomID, GeneratedAt: time.Now().UTC(), Events: events, OptedOut: optedOut})
+
+	case "txt":
+		fmt.Fprintf(w, "Moderation log for %s\n\n", roomID)
+		if len(events) == 0 && optedOut == 0 {
+			fmt.Fprintln(w, "No moderation events archived.")
+			return nil
+		}
+		for _, evt := range events {
+			line := fmt.Sprintf("%s  %s %s", evt.Timestamp.UTC().Format("2006-01-02 15:04:05"), evt.Actor, moderationVerbs[evt.Action])
+			if evt.Action != ModerationKnock {
+				line += " " + evt.Target
+			}
+			if evt.Reason != "" {
+				line += fmt.Sprintf(" (reason: %s)", evt.Reason)
+			}
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return err
+			}
+		}
+		if optedOut > 0 {
+			if _, err := fmt.Fprintf(w, "\n%d moderation events withheld at the request of people in them\n", optedOut); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported moderation log format %s, supported formats: txt, json, yaml", ext)
+}
+
+// ExportModerationLog writes the moderation history of a room to filename.
+// The extension selects the format: .json, .yaml or text for anything else.
+func ExportModerationLog(filename, roomID string) error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+	switch ext {
+	case "json", "yaml":
+	case "yml":
+		ext = "yaml"
+	default:
+		ext = "txt"
+	}
+
+	roomID, err := resolveExportRoom(roomID)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	events, err := GetDatabase().GetModerationEvents(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	users, err := optedOutUsers(ctx, GetDatabase())
+	if err != nil {
+		return err
+	}
+	events, withheld := WithholdOptedOutModeration(events, users)
+	if withheld > 0 {
+		fmt.Printf("Withheld %d moderation events involving people who opted out of archiving\n", withheld)
+	}
+	if len(events) == 0 && withheld == 0 {
+		fmt.Printf("No moderation events archived for %s; import with --moderation to record them\n", roomID)
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer file.Close()
+
+	if err := WriteModerationLog(file, ext, roomID, events, withheld); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d moderation events to %q\n", len(events), filename)
+	return nil
+}
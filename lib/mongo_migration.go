@@ -0,0 +1,322 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.mongodb.org/mongo-driver/v2/x/mongo/driver/connstring"
+	"maunium.net/go/mautrix/event"
+)
+
+// Where the Python version of matrix-archive kept its messages: the database
+// named in MONGODB_URI, in the collection mongoengine named after its
+// Message document
+const (
+	DefaultMongoDatabase   = "matrix_archive"
+	DefaultMongoCollection = "message"
+)
+
+// maxMigrationErrors caps how many unreadable documents a migration report lists
+const maxMigrationErrors = 20
+
+// MongoMigrationOptions chooses the legacy MongoDB archive to migrate
+type MongoMigrationOptions struct {
+	URI        string // MongoDB connection string, e.g. mongodb://localhost:27017/matrix_archive
+	Database   string // Database holding the messages; empty uses the URI's, or DefaultMongoDatabase
+	Collection string // Collection holding the messages; empty uses DefaultMongoCollection
+	ReportPath string // Where to write the JSON migration report; empty only prints a summary
+
+	Senders    SenderFilter // Whose messages to migrate
+	Validation string       // Validation mode; messages that fail are quarantined
+}
+
+// MongoMigrationReport accounts for every document a migration read
+type MongoMigrationReport struct {
+	Source     string    `json:"source"` // Connection string without its password
+	Database   string    `json:"database"`
+	Collection string    `json:"collection"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+
+	Read        int `json:"read"`        // Documents in the collection
+	Imported    int `json:"imported"`    // Messages added to the archive
+	Duplicates  int `json:"duplicates"`  // Documents repeating an event ID read earlier
+	Invalid     int `json:"invalid"`     // Documents that couldn't be read as messages
+	Quarantined int `json:"quarantined"` // Messages that failed validation
+	Skipped     int `json:"skipped"`     // Messages already archived, from filtered senders or in sealed rooms
+
+	Errors []string `json:"errors,omitempty"` // Why the first invalid documents couldn't be read
+}
+
+// legacyMessage is a message document of the Python version's MongoDB
+// archive. Timestamps were stored as dates, but milliseconds since the epoch
+// and RFC 3339 strings are read too.
+type legacyMessage struct {
+	RoomID    string        `bson:"room_id"`
+	EventID   string        `bson:"event_id"`
+	Sender    string        `bson:"sender"`
+	Type      string        `bson:"type"` // Only stored by some versions; messages were m.room.message
+	Timestamp bson.RawValue `bson:"timestamp"`
+	Content   bson.Raw      `bson:"content"`
+}
+
+// ConvertLegacyDocument maps a message document of a legacy MongoDB archive
+// to a Message
+func ConvertLegacyDocument(doc bson.Raw) (*Message, error) {
+	var legacy legacyMessage
+	if err := bson.Unmarshal(doc, &legacy); err != nil {
+		return nil, fmt.Errorf("document %s: %w", legacyDocumentID(doc), err)
+	}
+	fail := func(format string, args ...interface{}) (*Message, error) {
+		id := legacy.EventID
+		if id == "" {
+			id = legacyDocumentID(doc)
+		}
+		return nil, fmt.Errorf("document %s: %s", id, fmt.Sprintf(format, args...))
+	}
+	if legacy.EventID == "" || legacy.RoomID == "" || legacy.Sender == "" {
+		return fail("missing event_id, room_id or sender")
+	}
+
+	timestamp, err := legacyTimestamp(legacy.Timestamp)
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	content := make(map[string]interface{})
+	if len(legacy.Content) > 0 {
+		// Relaxed extended JSON writes BSON numbers and strings as plain JSON
+		data, err := bson.MarshalExtJSON(legacy.Content, false, false)
+		if err != nil {
+			return fail("unreadable content: %v", err)
+		}
+		if err := json.Unmarshal(data, &content); err != nil {
+			return fail("unreadable content: %v", err)
+		}
+	}
+
+	messageType := legacy.Type
+	if messageType == "" {
+		messageType = event.EventMessage.Type
+	}
+	message := &Message{
+		RoomID:      legacy.RoomID,
+		EventID:     legacy.EventID,
+		Sender:      legacy.Sender,
+		MessageType: messageType,
+		MsgType:     contentMsgType(content),
+		Timestamp:   timestamp,
+		Content:     content,
+	}
+	message.ForwardedFrom, message.ForwardedPlatform = DetectForward(message.Sender, message.Content)
+	return message, nil
+}
+
+// legacyTimestamp reads the timestamp of a legacy document
+func legacyTimestamp(value bson.RawValue) (time.Time, error) {
+	switch value.Type {
+	case bson.TypeDateTime:
+		return value.Time().UTC(), nil
+	case bson.TypeInt64, bson.TypeInt32, bson.TypeDouble:
+		ms, _ := value.AsInt64OK()
+		if value.Type == bson.TypeDouble {
+			ms = int64(value.Double())
+		}
+		return time.UnixMilli(ms).UTC(), nil
+	case bson.TypeString:
+		ts, err := time.Parse(time.RFC3339Nano, value.StringValue())
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unreadable timestamp %q", value.StringValue())
+		}
+		return ts.UTC(), nil
+	case 0:
+		return time.Time{}, fmt.Errorf("missing timestamp")
+	}
+	return time.Time{}, fmt.Errorf("timestamp of unsupported type %s", value.Type)
+}
+
+// legacyDocumentID names a document by its _id, for documents without an event ID
+func legacyDocumentID(doc bson.Raw) string {
+	value, err := doc.LookupErr("_id")
+	if err != nil {
+		return "without _id"
+	}
+	if oid, ok := value.ObjectIDOK(); ok {
+		return oid.Hex()
+	}
+	if s, ok := value.StringValueOK(); ok {
+		return strconv.Quote(s)
+	}
+	return value.String()
+}
+
+// mongoSource supplies the messages of a legacy MongoDB collection to an
+// ImportPipeline, accounting for the documents it can't use in the report
+type mongoSource struct {
+	cursor *mongo.Cursor
+	report *MongoMigrationReport
+	seen   map[string]bool
+}
+
+// NextBatch returns up to importBatchSize messages
+func (s *mongoSource) NextBatch(ctx context.Context) ([]*Message, error) {
+	var messages []*Message
+	for len(messages) < importBatchSize && s.cursor.Next(ctx) {
+		s.report.Read++
+		message, err := ConvertLegacyDocument(s.cursor.Current)
+		switch {
+		case err != nil:
+			s.report.Invalid++
+			if len(s.report.Errors) < maxMigrationErrors {
+				s.report.Errors = append(s.report.Errors, err.Error())
+			}
+		case s.seen[message.EventID]:
+			s.report.Duplicates++
+		default:
+			s.seen[message.EventID] = true
+			messages = append(messages, message)
+		}
+	}
+	if err := s.cursor.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read from MongoDB: %w", err)
+	}
+	if len(messages) == 0 {
+		return nil, io.EOF
+	}
+	return messages, ctx.Err()
+}
+
+// redactURI returns a connection string without its password, for reports
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "(unparseable connection string)"
+	}
+	return u.Redacted()
+}
+
+// MigrateFromMongo copies the messages of a MongoDB archive written by the
+// Python version of matrix-archive into the archive. Messages go through the
+// same pipeline as imports, so events already archived are left alone,
+// sender filters and sealed rooms apply, and invalid messages are
+// quarantined; documents repeating an event ID are only migrated once. Run
+// it again to pick up documents added since, or after fixing unreadable ones.
+func MigrateFromMongo(opts *MongoMigrationOptions) error {
+	if err := CheckValidationMode(opts.Validation); err != nil {
+		return err
+	}
+	senders := opts.Senders.OrEnv()
+	if err := senders.Validate(); err != nil {
+		return err
+	}
+	cs, err := connstring.ParseAndValidate(opts.URI)
+	if err != nil {
+		return fmt.Errorf("invalid MongoDB connection string: %w", err)
+	}
+	report := &MongoMigrationReport{
+		Source:     redactURI(opts.URI),
+		Database:   opts.Database,
+		Collection: opts.Collection,
+		StartedAt:  time.Now().UTC(),
+	}
+	if report.Database == "" {
+		report.Database = cs.Database
+	}
+	if report.Database == "" {
+		report.Database = DefaultMongoDatabase
+	}
+	if report.Collection == "" {
+		report.Collection = DefaultMongoCollection
+	}
+
+	ctx := context.Background()
+	client, err := mongo.Connect(options.Client().ApplyURI(opts.URI))
+	if err != nil {
+		return fmt.Errorf("failed to connect to MongoDB: %w", err)
+	}
+	defer client.Disconnect(ctx)
+	pingCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := client.Ping(pingCtx, nil); err != nil {
+		return fmt.Errorf("failed to connect to MongoDB at %s: %w", report.Source, err)
+	}
+	collection := client.Database(report.Database).Collection(report.Collection)
+	total, err := collection.EstimatedDocumentCount(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to count messages in %s.%s: %w", report.Database, report.Collection, err)
+	}
+	if total == 0 {
+		return fmt.Errorf("%s.%s has no messages; name the collection with --database and --collection", report.Database, report.Collection)
+	}
+
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+	if err := senders.DenyOptedOut(ctx, GetDatabase()); err != nil {
+		return err
+	}
+
+	// Oldest first, so replies and edits usually find what they refer to
+	cursor, err := collection.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}}).SetAllowDiskUse(true))
+	if err != nil {
+		return fmt.Errorf("failed to read %s.%s: %w", report.Database, report.Collection, err)
+	}
+	defer cursor.Close(ctx)
+
+	fmt.Fprintf(progressWriter(), "Migrating about %d messages from %s.%s\n", total, report.Database, report.Collection)
+	pipeline := &ImportPipeline{DB: GetDatabase(), Senders: senders, Validation: opts.Validation}
+	pipeline.OnBatch = func(imported int) {
+		fmt.Fprintf(progressWriter(), "  Read %d of about %d documents, imported %d\n", report.Read, total, imported)
+	}
+	source := &mongoSource{cursor: cursor, report: report, seen: make(map[string]bool)}
+	_, runErr := pipeline.Run(ctx, source)
+	report.Imported = pipeline.Imported
+	report.Quarantined = pipeline.Quarantined
+	report.Skipped = report.Read - report.Invalid - report.Duplicates - report.Quarantined - report.Imported
+	report.FinishedAt = time.Now().UTC()
+
+	if opts.ReportPath != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode migration report: %w", err)
+		}
+		if err := os.WriteFile(opts.ReportPath, append(data, '\n'), 0644); err != nil {
+			return errors.Join(runErr, fmt.Errorf("failed to write migration report: %w", err))
+		}
+	}
+	if runErr != nil {
+		return fmt.Errorf("migration stopped after %d documents: %w", report.Read, runErr)
+	}
+
+	if jsonOutput() {
+		return writeJSON(report)
+	}
+	fmt.Printf("✓ Migrated %s.%s: %d documents read, %d messages imported\n", report.Database, report.Collection, report.Read, report.Imported)
+	if report.Skipped > 0 {
+		fmt.Printf("%d messages were already archived, from filtered senders or in sealed rooms\n", report.Skipped)
+	}
+	if report.Duplicates > 0 {
+		fmt.Printf("%d documents repeated an event ID and were migrated once\n", report.Duplicates)
+	}
+	if report.Invalid > 0 {
+		fmt.Printf("%d documents couldn't be read as messages", report.Invalid)
+		if opts.ReportPath != "" {
+			fmt.Printf("; see %s", opts.ReportPath)
+		}
+		fmt.Println()
+	}
+	reportQuarantined(report.Quarantined)
+	return nil
+}
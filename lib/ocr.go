@@ -0,0 +1,147 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultOCRCommand runs tesseract on an image and prints the text to stdout.
+// {file} is replaced with the image path; if it is absent the path is appended.
+const DefaultOCRCommand = "tesseract {file} stdout"
+
+// OCRCommandEnv overrides DefaultOCRCommand when no command is given explicitly
+const OCRCommandEnv = "MATRIX_ARCHIVE_OCR_CMD"
+
+// resolveOCRCommand picks the explicit command, then the environment, then the default
+func resolveOCRCommand(command string) string {
+	if command != "" {
+		return command
+	}
+	if env := os.Getenv(OCRCommandEnv); env != "" {
+		return env
+	}
+	return DefaultOCRCommand
+}
+
+// ExtractImageText runs an OCR command on an image file and returns the text it printed
+func ExtractImageText(command, path string) (string, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty OCR command")
+	}
+
+	substituted := false
+	for i, field := range fields {
+		if strings.Contains(field, "{file}") {
+			fields[i] = strings.ReplaceAll(field, "{file}", path)
+			substituted = true
+		}
+	}
+	if !substituted {
+		fields = append(fields, path)
+	}
+
+	output, err := exec.Command(fields[0], fields[1:]...).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("%s: %s", fields[0], strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("%s: %w", fields[0], err)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// findDownloadedImage returns the file download-images saved for stem, whatever
+// extension it was given and in either media layout, or "" if it hasn't been
+// downloaded
+func findDownloadedImage(dir, stem string) string {
+	if entry, ok := lookupMediaIndex(dir, stem); ok {
+		return filepath.Join(dir, filepath.FromSlash(entry.Path))
+	}
+	return findFlatImage(dir, stem)
+}
+
+// findFlatImage finds a file saved for stem in the flat media layout
+func findFlatImage(dir, stem string) string {
+	matches, err := filepath.Glob(filepath.Join(dir, stem) + ".*")
+	if err != nil || len(matches) == 0 {
+		return ""
+	}
+	return matches[0]
+}
+
+// OCRImages extracts text from images already fetched by download-images and
+// stores it in the media_text table for search. Images that already have text
+// are skipped, so the command can be rerun after each download.
+func OCRImages(imageDir string, thumbnails bool, command string) error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	// Same default directories as download-images
+	if imageDir == "" {
+		if thumbnails {
+			imageDir = "thumbnails"
+		} else {
+			imageDir = "images"
+		}
+	}
+
+	command = resolveOCRCommand(command)
+	engine := strings.Fields(command)[0]
+
+	ctx := context.Background()
+	messages, err := GetDatabase().GetMessages(ctx, nil, 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %w", err)
+	}
+
+	done, err := GetDatabase().GetMediaTextEventIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	processed, missing := 0, 0
+	for _, msg := range messages {
+		if !msg.IsImage() || done[msg.EventID] {
+			continue
+		}
+
+		stem := GetDownloadStem(*msg, thumbnails)
+		if stem == "" {
+			continue
+		}
+		path := findDownloadedImage(imageDir, stem)
+		if path == "" {
+			missing++
+			continue
+		}
+
+		text, err := ExtractImageText(command, path)
+		if err != nil {
+			fmt.Printf("OCR failed for %s: %v. Skipping...\n", path, err)
+			continue
+		}
+
+		mediaText := &MediaText{EventID: msg.EventID, RoomID: msg.RoomID, Path: path, Text: text, Engine: engine}
+		if err := GetDatabase().SaveMediaText(ctx, mediaText); err != nil {
+			return err
+		}
+		processed++
+	}
+
+	if missing > 0 {
+		fmt.Printf("Skipping %d images not downloaded to %s (run download-images first)\n", missing, imageDir)
+	}
+	fmt.Printf("Extracted text from %d images\n", processed)
+	return nil
+}
@@ -0,0 +1,191 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// replyFallbackPattern matches the quote of the replied-to message that
+// clients put at the start of a reply's formatted body
+var replyFallbackPattern = regexp.MustCompile(`(?s)^<mx-reply>.*?</mx-reply>`)
+
+// WithholdOptedOut returns messages without those from people who opted out
+// of archiving, and the number withheld. Each run of consecutive messages
+// from them is summarized in a notice that takes the first message's place;
+// their reactions, edits and other events are dropped, and replies quoting
+// them lose the quote. The archived messages are left alone.
+func WithholdOptedOut(messages []*Message, optedOut map[string]bool) ([]*Message, int) {
+	if len(optedOut) == 0 {
+		return messages, 0
+	}
+
+	kept := make([]*Message, 0, len(messages))
+	withheldIDs := make(map[string]bool)
+	withheld := 0
+	var summary *Message
+	summarized := 0
+	for _, msg := range messages {
+		if !optedOut[msg.Sender] {
+			summary = nil
+			kept = append(kept, withoutWithheldQuote(msg, withheldIDs))
+			continue
+		}
+
+		withheld++
+		withheldIDs[msg.EventID] = true
+		if msg.MessageType != EventTypeMessage || isEdit(msg) {
+			continue
+		}
+		if summary == nil || summary.RoomID != msg.RoomID {
+			summary = &Message{RoomID: msg.RoomID, EventID: msg.EventID, MessageType: EventTypeMessage, Timestamp: msg.Timestamp}
+			summarized = 0
+			kept = append(kept, summary)
+		}
+		summarized++
+		body := "1 message withheld at its sender's request"
+		if summarized > 1 {
+			body = fmt.Sprintf("%d messages withheld at their senders' request", summarized)
+		}
+		summary.Content = map[string]interface{}{"msgtype": "m.notice", "body": body}
+	}
+	return kept, withheld
+}
+
+// isEdit reports whether a message replaces an earlier one
+func isEdit(msg *Message) bool {
+	relatesTo, _ := msg.Content["m.relates_to"].(map[string]interface{})
+	return relatesTo["rel_type"] == "m.replace"
+}
+
+// withoutWithheldQuote returns a copy of a reply to a withheld message
+// without the quote of it, or the message itself otherwise
+func withoutWithheldQuote(msg *Message, withheldIDs map[string]bool) *Message {
+	relatesTo, _ := msg.Content["m.relates_to"].(map[string]interface{})
+	inReplyTo, _ := relatesTo["m.in_reply_to"].(map[string]interface{})
+	if eventID, _ := inReplyTo["event_id"].(string); !withheldIDs[eventID] {
+		return msg
+	}
+
+	stripped := *msg
+	stripped.Content = make(map[string]interface{}, len(msg.Content))
+	for key, value := range msg.Content {
+		stripped.Content[key] = value
+	}
+	if body, ok := msg.Content["body"].(string); ok {
+		lines := strings.Split(body, "\n")
+		for len(lines) > 0 && strings.HasPrefix(lines[0], ">") {
+			lines = lines[1:]
+		}
+		if len(lines) > 0 && lines[0] == "" {
+			lines = lines[1:]
+		}
+		stripped.Content["body"] = strings.Join(lines, "\n")
+	}
+	if formatted, ok := msg.Content["formatted_body"].(string); ok {
+		stripped.Content["formatted_body"] = replyFallbackPattern.ReplaceAllString(formatted, "")
+	}
+	return &stripped
+}
+
+// optedOutUsers returns the user IDs in the opt-out registry
+func optedOutUsers(ctx context.Context, db DatabaseInterface) (map[string]bool, error) {
+	optOuts, err := db.GetOptOuts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]bool, len(optOuts))
+	for _, o := range optOuts {
+		users[o.UserID] = true
+	}
+	return users, nil
+}
+
+// withholdOptedOut withholds the messages of everyone in the opt-out
+// registry from an export, and says how many were withheld
+func withholdOptedOut(ctx context.Context, messages []*Message) ([]*Message, int, error) {
+	users, err := optedOutUsers(ctx, GetDatabase())
+	if err != nil {
+		return nil, 0, err
+	}
+	kept, withheld := WithholdOptedOut(messages, users)
+	if withheld > 0 {
+		fmt.Printf("Withheld %d messages from people who opted out of archiving\n", withheld)
+	}
+	return kept, withheld, nil
+}
+
+// AddOptOut adds a person to the opt-out registry. Exports withhold their
+// messages from then on, whether or not they were archived before.
+func AddOptOut(userID, reason string) error {
+	if _, _, err := id.UserID(userID).Parse(); err != nil {
+		return fmt.Errorf("%s is not a user ID: %w", userID, err)
+	}
+
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	if err := GetDatabase().SaveOptOut(context.Background(), &OptOut{UserID: userID, Reason: reason}); err != nil {
+		return err
+	}
+	fmt.Printf("✓ %s opted out; exports withhold their messages, and imports with --respect-opt-outs skip them\n", userID)
+	return nil
+}
+
+// RemoveOptOut removes a person from the opt-out registry
+func RemoveOptOut(userID string) error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	if err := GetDatabase().DeleteOptOut(context.Background(), userID); err != nil {
+		return err
+	}
+	fmt.Printf("✓ Removed the opt-out of %s\n", userID)
+	return nil
+}
+
+// ListOptOuts prints the opt-out registry
+func ListOptOuts() error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	optOuts, err := GetDatabase().GetOptOuts(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput() {
+		if optOuts == nil {
+			optOuts = []*OptOut{}
+		}
+		return writeJSON(optOuts)
+	}
+
+	if len(optOuts) == 0 {
+		fmt.Println("Nobody has opted out")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "User ID\tOpted Out\tReason")
+	fmt.Fprintln(w, "-------\t---------\t------")
+	for _, o := range optOuts {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", o.UserID, o.OptedOutAt.Format(time.RFC3339), o.Reason)
+	}
+	return w.Flush()
+}
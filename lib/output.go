@@ -0,0 +1,56 @@
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Output formats for list and status commands
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+// outputFormat selects how list and status commands print their results
+var outputFormat = OutputText
+
+// SetOutputFormat sets the output format used by list and status commands
+func SetOutputFormat(format string) error {
+	switch format {
+	case "", OutputText:
+		outputFormat = OutputText
+	case OutputJSON:
+		outputFormat = OutputJSON
+	default:
+		return fmt.Errorf("unsupported output format %s, supported formats: [%s %s]", format, OutputText, OutputJSON)
+	}
+	return nil
+}
+
+// OutputFormat returns the current output format
+func OutputFormat() string {
+	return outputFormat
+}
+
+// jsonOutput reports whether results should be printed as JSON
+func jsonOutput() bool {
+	return outputFormat == OutputJSON
+}
+
+// progressWriter is where commands print progress messages. In JSON mode
+// these go to stderr so stdout holds only the JSON document.
+func progressWriter() io.Writer {
+	if jsonOutput() {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// writeJSON prints v to stdout as indented JSON
+func writeJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
@@ -0,0 +1,99 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Participant summarizes one sender's activity in an export
+type Participant struct {
+	UserID       string `json:"user_id" yaml:"user_id"`
+	DisplayName  string `json:"display_name" yaml:"display_name"`
+	Platform     string `json:"platform,omitempty" yaml:"platform,omitempty"`
+	MessageCount int    `json:"message_count" yaml:"message_count"`
+	FirstMessage string `json:"first_message" yaml:"first_message"`
+	LastMessage  string `json:"last_message" yaml:"last_message"`
+
+	// From archived membership events; empty when the room was imported
+	// without them or the change happened outside the archived period
+	Joined string `json:"joined,omitempty" yaml:"joined,omitempty"`
+	Left   string `json:"left,omitempty" yaml:"left,omitempty"`
+}
+
+// ParticipantSummary lists everyone who sent a message, most active first.
+// Membership events, oldest first, supply join and leave dates: Joined is the
+// first time the user joined, and Left is set only if their last change was
+// leaving (or being kicked or banned).
+func ParticipantSummary(messages []ExportMessage, memberships []*MembershipEvent) []Participant {
+	byUser := make(map[string]*Participant)
+	var order []string
+	for _, msg := range messages {
+		// Each author a bot relays for is a participant of their own
+		key := msg.UserID
+		if msg.Relayed {
+			key += "\x00" + msg.DisplayName
+		}
+		p, ok := byUser[key]
+		if !ok {
+			p = &Participant{
+				UserID:       msg.UserID,
+				DisplayName:  msg.DisplayName,
+				Platform:     msg.Platform,
+				FirstMessage: msg.Timestamp,
+			}
+			byUser[key] = p
+			order = append(order, key)
+		}
+		p.MessageCount++
+		p.LastMessage = msg.Timestamp
+		// With historical names, list participants under their latest name
+		p.DisplayName = msg.DisplayName
+	}
+
+	previous := make(map[string]string)
+	for _, m := range memberships {
+		p, ok := byUser[m.UserID]
+		if !ok {
+			continue
+		}
+		timestamp := m.Timestamp.Format(time.RFC3339)
+		switch m.Membership {
+		case "join":
+			// Profile changes are also "join" events; only count actual joins
+			if previous[m.UserID] != "join" {
+				if p.Joined == "" {
+					p.Joined = timestamp
+				}
+				p.Left = ""
+			}
+		case "leave", "ban":
+			p.Left = timestamp
+		}
+		previous[m.UserID] = m.Membership
+	}
+
+	participants := make([]Participant, 0, len(order))
+	for _, userID := range order {
+		participants = append(participants, *byUser[userID])
+	}
+	sort.SliceStable(participants, func(i, j int) bool {
+		return participants[i].MessageCount > participants[j].MessageCount
+	})
+	return participants
+}
+
+// loadMemberships loads a room's membership history if the export needs it
+// for the participants section or historical names
+func loadMemberships(ctx context.Context, roomID string, opts *ExportOptions) error {
+	if !opts.Participants && !opts.HistoricalNames {
+		return nil
+	}
+	memberships, err := GetDatabase().GetMembershipEvents(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("failed to load membership events: %w", err)
+	}
+	opts.memberships = memberships
+	return nil
+}
@@ -0,0 +1,41 @@
+package archive
+
+import (
+	"net/url"
+	"strings"
+)
+
+// DefaultPermalinkBase links messages through matrix.to, which lets readers
+// choose their own client
+const DefaultPermalinkBase = "https://matrix.to/#/"
+
+// Permalink returns a link to an event in a room. base is a URL prefix the
+// escaped room and event IDs are appended to, e.g. "https://matrix.to/#/" or a
+// self-hosted client's "https://chat.example.org/#/room/". via names a server
+// that can route the link, such as the sender's homeserver.
+func Permalink(base, roomID, eventID, via string) string {
+	if base == "" {
+		base = DefaultPermalinkBase
+	}
+
+	link := base + url.QueryEscape(roomID) + "/" + url.QueryEscape(eventID)
+	if via != "" {
+		link += "?via=" + url.QueryEscape(via)
+	}
+	return link
+}
+
+// serverName returns the homeserver part of a Matrix ID ("@alice:example.org" -> "example.org")
+func serverName(matrixID string) string {
+	if _, server, ok := strings.Cut(matrixID, ":"); ok {
+		return server
+	}
+	return ""
+}
+
+// AttachPermalinks sets the permalink of each exported message in a room
+func AttachPermalinks(messages []ExportMessage, roomID, base string) {
+	for i := range messages {
+		messages[i].Permalink = Permalink(base, roomID, messages[i].EventID, serverName(messages[i].UserID))
+	}
+}
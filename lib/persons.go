@@ -0,0 +1,221 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// Persons maps the user IDs merged with "users merge" to the person they
+// belong to. Analytics count each person once under their person ID,
+// exports label their messages with it, and subject access packages gather
+// all of their user IDs. The archived messages keep their original senders.
+type Persons map[string]string
+
+// NewPersons returns the persons that aliases merge user IDs into
+func NewPersons(aliases []*PersonAlias) Persons {
+	persons := make(Persons, len(aliases))
+	for _, a := range aliases {
+		persons[a.UserID] = a.PersonID
+	}
+	return persons
+}
+
+// loadPersons returns the persons merged in the archive
+func loadPersons(ctx context.Context, db DatabaseInterface) (Persons, error) {
+	aliases, err := db.GetPersonAliases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewPersons(aliases), nil
+}
+
+// Of returns the person a user ID was merged into, or the user ID itself if
+// it wasn't merged
+func (p Persons) Of(userID string) string {
+	if person, ok := p[userID]; ok {
+		return person
+	}
+	return userID
+}
+
+// UserIDs returns the user IDs merged into a person, sorted, or nil if
+// nothing was merged into it
+func (p Persons) UserIDs(personID string) []string {
+	var userIDs []string
+	for userID, person := range p {
+		if person == personID {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	sort.Strings(userIDs)
+	return userIDs
+}
+
+// Senders returns messages with each merged sender replaced by their person,
+// copying the messages it changes
+func (p Persons) Senders(messages []*Message) []*Message {
+	if len(p) == 0 {
+		return messages
+	}
+	result := make([]*Message, len(messages))
+	for i, msg := range messages {
+		result[i] = msg
+		if person, ok := p[msg.Sender]; ok {
+			merged := *msg
+			merged.Sender = person
+			result[i] = &merged
+		}
+	}
+	return result
+}
+
+// Stats returns daily statistics with each merged sender replaced by their
+// person, copying the rows it changes
+func (p Persons) Stats(stats []*DailyStats) []*DailyStats {
+	if len(p) == 0 {
+		return stats
+	}
+	result := make([]*DailyStats, len(stats))
+	for i, s := range stats {
+		result[i] = s
+		if person, ok := p[s.Sender]; ok {
+			merged := *s
+			merged.Sender = person
+			result[i] = &merged
+		}
+	}
+	return result
+}
+
+// Exclude extends a set of excluded user IDs with the persons they were
+// merged into, so that a person is left out of analytics when any of their
+// identities opted out
+func (p Persons) Exclude(exclude map[string]bool) map[string]bool {
+	if len(p) == 0 || len(exclude) == 0 {
+		return exclude
+	}
+	result := make(map[string]bool, len(exclude))
+	for userID := range exclude {
+		result[userID] = true
+		result[p.Of(userID)] = true
+	}
+	return result
+}
+
+// ApplyPersons labels exported messages from merged senders with the person
+// they belong to. Messages credited to a relayed author are left alone, as
+// their user ID is the relay's.
+func ApplyPersons(messages []ExportMessage, persons Persons) {
+	for i := range messages {
+		if person, ok := persons[messages[i].UserID]; ok && !messages[i].Relayed {
+			messages[i].Person = person
+		}
+	}
+}
+
+// attachPersons labels exported messages with the persons merged in the archive
+func attachPersons(ctx context.Context, messages []ExportMessage) error {
+	persons, err := loadPersons(ctx, GetDatabase())
+	if err != nil {
+		return err
+	}
+	ApplyPersons(messages, persons)
+	return nil
+}
+
+// MergeUsers merges user IDs into one person. The person ID defaults to the
+// person the first user ID already belongs to, or else that user ID. User IDs
+// already merged into another person are moved to this one.
+func MergeUsers(personID string, userIDs []string) error {
+	if len(userIDs) == 0 {
+		return fmt.Errorf("no user IDs to merge")
+	}
+	for _, userID := range userIDs {
+		if _, _, err := id.UserID(userID).Parse(); err != nil {
+			return fmt.Errorf("%s is not a user ID: %w", userID, err)
+		}
+	}
+	personID = strings.TrimSpace(personID)
+
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	ctx := context.Background()
+	db := GetDatabase()
+	persons, err := loadPersons(ctx, db)
+	if err != nil {
+		return err
+	}
+	if personID == "" {
+		personID = persons.Of(userIDs[0])
+	}
+	for _, userID := range userIDs {
+		if err := db.SavePersonAlias(ctx, &PersonAlias{UserID: userID, PersonID: personID}); err != nil {
+			return err
+		}
+		persons[userID] = personID
+	}
+	fmt.Printf("✓ %s is %s\n", personID, strings.Join(persons.UserIDs(personID), ", "))
+	return nil
+}
+
+// UnmergeUsers separates user IDs from the persons they were merged into
+func UnmergeUsers(userIDs []string) error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	for _, userID := range userIDs {
+		if err := GetDatabase().DeletePersonAlias(context.Background(), userID); err != nil {
+			return err
+		}
+		fmt.Printf("✓ %s is no longer merged\n", userID)
+	}
+	return nil
+}
+
+// ListPersons prints the merged persons with their user IDs
+func ListPersons() error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	aliases, err := GetDatabase().GetPersonAliases(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput() {
+		if aliases == nil {
+			aliases = []*PersonAlias{}
+		}
+		return writeJSON(aliases)
+	}
+
+	if len(aliases) == 0 {
+		fmt.Println("No users have been merged")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Person\tUser ID\tMerged")
+	fmt.Fprintln(w, "------\t-------\t------")
+	for _, a := range aliases {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", a.PersonID, a.UserID, a.MergedAt.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,111 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// PlatformIdentity is who a bridged user is on the network they were bridged
+// from, as the bridge describes its ghost users in their profiles and member
+// events (the com.beeper.bridge.* fields)
+type PlatformIdentity struct {
+	Network     string   `json:"network,omitempty"`     // Bridge network, e.g. whatsapp
+	Service     string   `json:"service,omitempty"`     // Service on that network, where it has several
+	RemoteID    string   `json:"remote_id,omitempty"`   // The network's ID for the user
+	Identifiers []string `json:"identifiers,omitempty"` // Handles as URIs, e.g. tel:+15551234567 or telegram:alice
+	Bot         bool     `json:"bot,omitempty"`         // A bot of the bridge or of the network
+}
+
+// ParsePlatformIdentity reads the bridge's description of a ghost user from
+// member event content or profile fields, returning nil for users the bridge
+// doesn't describe, such as native Matrix users
+func ParsePlatformIdentity(fields map[string]interface{}) *PlatformIdentity {
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil
+	}
+	var extra event.BeeperProfileExtra
+	if err := json.Unmarshal(data, &extra); err != nil {
+		return nil
+	}
+	return platformIdentity(&extra)
+}
+
+func platformIdentity(extra *event.BeeperProfileExtra) *PlatformIdentity {
+	if extra.Network == "" && extra.Service == "" && extra.RemoteID == "" && len(extra.Identifiers) == 0 {
+		return nil
+	}
+	return &PlatformIdentity{
+		Network:     extra.Network,
+		Service:     extra.Service,
+		RemoteID:    extra.RemoteID,
+		Identifiers: extra.Identifiers,
+		Bot:         extra.IsBridgeBot || extra.IsNetworkBot,
+	}
+}
+
+// Name returns the platform the user is on: its service, or else its network
+func (p *PlatformIdentity) Name() string {
+	if p.Service != "" {
+		return p.Service
+	}
+	return p.Network
+}
+
+// Handle returns the user's first handle without its scheme, such as a phone
+// number or username, or else their ID on the network
+func (p *PlatformIdentity) Handle() string {
+	for _, identifier := range p.Identifiers {
+		if _, handle, ok := strings.Cut(identifier, ":"); ok && handle != "" {
+			return handle
+		}
+		if identifier != "" {
+			return identifier
+		}
+	}
+	return p.RemoteID
+}
+
+// ApplyPlatformHandles labels exported messages from bridged users with the
+// platform and handle their bridge reported, replacing the sender name
+// guessed from their Matrix ID. Messages credited to a relayed author keep
+// that author's platform.
+func ApplyPlatformHandles(messages []ExportMessage, users []*RoomUser) {
+	identities := make(map[string]*PlatformIdentity, len(users))
+	for _, u := range users {
+		if u.Platform != nil {
+			identities[u.UserID] = u.Platform
+		}
+	}
+	for i := range messages {
+		identity := identities[messages[i].UserID]
+		if identity == nil || messages[i].Relayed {
+			continue
+		}
+		if name := identity.Name(); name != "" {
+			messages[i].Platform = name
+		}
+		if handle := identity.Handle(); handle != "" {
+			messages[i].PlatformHandle = handle
+			messages[i].Sender = handle
+		}
+	}
+}
+
+// attachPlatformHandles applies the platform identities cached for the
+// members of rooms to their exported messages
+func attachPlatformHandles(ctx context.Context, messages []ExportMessage, roomIDs ...string) error {
+	var users []*RoomUser
+	for _, roomID := range roomIDs {
+		roomUsers, err := GetDatabase().GetRoomUsers(ctx, roomID)
+		if err != nil {
+			return err
+		}
+		users = append(users, roomUsers...)
+	}
+	ApplyPlatformHandles(messages, users)
+	return nil
+}
@@ -0,0 +1,74 @@
+package archive
+
+import (
+	"sort"
+	"time"
+)
+
+// profileChange is a user's display name and avatar from a membership event
+type profileChange struct {
+	at          time.Time
+	displayName string
+	avatarURL   string
+}
+
+// ProfileHistory holds each user's display names and avatars over time, as
+// recorded by their membership events
+type ProfileHistory map[string][]profileChange
+
+// NewProfileHistory builds a profile history from membership events, oldest first
+func NewProfileHistory(memberships []*MembershipEvent) ProfileHistory {
+	history := make(ProfileHistory)
+	for _, m := range memberships {
+		// Joins carry the profile; leaves and bans usually don't
+		if m.Membership != "join" || (m.DisplayName == "" && m.AvatarURL == "") {
+			continue
+		}
+		history[m.UserID] = append(history[m.UserID], profileChange{at: m.Timestamp, displayName: m.DisplayName, avatarURL: m.AvatarURL})
+	}
+	for _, changes := range history {
+		sort.SliceStable(changes, func(i, j int) bool {
+			return changes[i].at.Before(changes[j].at)
+		})
+	}
+	return history
+}
+
+// At returns the display name and avatar a user had at a point in time. ok is
+// false if no profile was recorded for them by then.
+func (h ProfileHistory) At(userID string, at time.Time) (displayName, avatarURL string, ok bool) {
+	changes := h[userID]
+	i := sort.Search(len(changes), func(i int) bool {
+		return changes[i].at.After(at)
+	})
+	if i == 0 {
+		return "", "", false
+	}
+	change := changes[i-1]
+	return change.displayName, change.avatarURL, true
+}
+
+// ApplyHistoricalNames labels each message with the display name and avatar
+// its sender had when it was sent, instead of their current profile. Messages
+// from before the first recorded profile keep their current name.
+func ApplyHistoricalNames(messages []ExportMessage, memberships []*MembershipEvent) {
+	history := NewProfileHistory(memberships)
+	for i := range messages {
+		// A relayed message's name is its author's, not the relay's
+		if messages[i].Relayed {
+			continue
+		}
+		sent, err := time.Parse(time.RFC3339, messages[i].Timestamp)
+		if err != nil {
+			continue
+		}
+		displayName, avatarURL, ok := history.At(messages[i].UserID, sent)
+		if !ok {
+			continue
+		}
+		if displayName != "" {
+			messages[i].DisplayName = displayName
+		}
+		messages[i].AvatarURL = avatarURL
+	}
+}
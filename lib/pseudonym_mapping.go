@@ -0,0 +1,183 @@
+package archive
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// MappingPasswordEnv supplies the password that encrypts the pseudonym
+// mapping when --mapping-password isn't given, keeping it out of shell
+// history
+const MappingPasswordEnv = "MATRIX_ARCHIVE_MAPPING_PASSWORD"
+
+// mappingSaltSize is the size of the salt an encrypted mapping's key is
+// derived with
+const mappingSaltSize = 16
+
+// PseudonymEntry pairs a pseudonym with the user it stands for
+type PseudonymEntry struct {
+	Pseudonym string `json:"pseudonym"`
+	UserID    string `json:"user_id"`
+}
+
+// PseudonymMapping is the file that turns the pseudonyms of a published site
+// back into user IDs. It is written apart from the site, so the site stays
+// pseudonymous while the people allowed to read the mapping can still tell
+// who wrote what.
+type PseudonymMapping struct {
+	Version    int              `json:"version"`
+	Pseudonyms []PseudonymEntry `json:"pseudonyms"` // In the order the pseudonyms were given out
+}
+
+// encryptedMapping is the form a mapping is written in with a password: the
+// mapping's JSON sealed with AES-256-GCM, under a key derived from the
+// password and salt with scrypt
+type encryptedMapping struct {
+	Encrypted string `json:"encrypted"` // Format of the payload, v1
+	Salt      string `json:"salt"`
+	Payload   string `json:"payload"`
+}
+
+// Pseudonyms returns the pseudonyms the publisher has given out, in order
+func (p *Publisher) Pseudonyms() *PseudonymMapping {
+	mapping := &PseudonymMapping{Version: 1, Pseudonyms: []PseudonymEntry{}}
+	for _, userID := range p.assigned {
+		mapping.Pseudonyms = append(mapping.Pseudonyms, PseudonymEntry{Pseudonym: p.pseudonyms[userID], UserID: userID})
+	}
+	return mapping
+}
+
+// Lookup returns the user a pseudonym stands for
+func (m *PseudonymMapping) Lookup(pseudonym string) (string, bool) {
+	for _, entry := range m.Pseudonyms {
+		if strings.EqualFold(entry.Pseudonym, pseudonym) {
+			return entry.UserID, true
+		}
+	}
+	return "", false
+}
+
+// checkMappingOutside returns an error if the mapping file would be written
+// inside the site's directory, and so published with it
+func checkMappingOutside(filename, dir string) error {
+	file, err := filepath.Abs(filename)
+	if err != nil {
+		return fmt.Errorf("failed to resolve mapping file path: %w", err)
+	}
+	site, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve site directory: %w", err)
+	}
+	if rel, err := filepath.Rel(site, file); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("mapping file %s is inside the site directory %s, where it would be published; write it elsewhere", filename, dir)
+	}
+	return nil
+}
+
+// WritePseudonymMapping writes a mapping readable only by its owner. With a
+// password the mapping is encrypted, so it can be kept alongside other
+// copies of the archive without revealing who the pseudonyms are.
+func WritePseudonymMapping(filename string, mapping *PseudonymMapping, password string) error {
+	data, err := json.MarshalIndent(mapping, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode pseudonym mapping: %w", err)
+	}
+	if password != "" {
+		salt := make([]byte, mappingSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return fmt.Errorf("failed to generate salt: %w", err)
+		}
+		cipher, err := newContentCipher(password, salt)
+		if err != nil {
+			return err
+		}
+		payload, err := cipher.seal(data)
+		if err != nil {
+			return err
+		}
+		if data, err = json.MarshalIndent(encryptedMapping{
+			Encrypted: "v1",
+			Salt:      base64.StdEncoding.EncodeToString(salt),
+			Payload:   payload,
+		}, "", "  "); err != nil {
+			return fmt.Errorf("failed to encode pseudonym mapping: %w", err)
+		}
+	}
+	if err := os.WriteFile(filename, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write pseudonym mapping: %w", err)
+	}
+	return nil
+}
+
+// LoadPseudonymMapping reads a mapping written by WritePseudonymMapping,
+// decrypting it with password if it is encrypted
+func LoadPseudonymMapping(filename, password string) (*PseudonymMapping, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pseudonym mapping: %w", err)
+	}
+	var sealed encryptedMapping
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		return nil, fmt.Errorf("failed to parse pseudonym mapping in %s: %w", filename, err)
+	}
+	if sealed.Encrypted != "" {
+		if sealed.Encrypted != "v1" {
+			return nil, fmt.Errorf("unsupported pseudonym mapping encryption %q", sealed.Encrypted)
+		}
+		if password == "" {
+			return nil, fmt.Errorf("%s is encrypted; give its password with --password or %s", filename, MappingPasswordEnv)
+		}
+		salt, err := base64.StdEncoding.DecodeString(sealed.Salt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pseudonym mapping salt: %w", err)
+		}
+		cipher, err := newContentCipher(password, salt)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = cipher.open(sealed.Payload); err != nil {
+			return nil, err
+		}
+	}
+	mapping := &PseudonymMapping{}
+	if err := json.Unmarshal(data, mapping); err != nil {
+		return nil, fmt.Errorf("failed to parse pseudonym mapping in %s: %w", filename, err)
+	}
+	return mapping, nil
+}
+
+// ShowPseudonymMapping prints the users that pseudonyms stand for, or every
+// pseudonym in the mapping if none are given
+func ShowPseudonymMapping(filename, password string, pseudonyms []string) error {
+	mapping, err := LoadPseudonymMapping(filename, password)
+	if err != nil {
+		return err
+	}
+	entries := mapping.Pseudonyms
+	if len(pseudonyms) > 0 {
+		entries = nil
+		for _, pseudonym := range pseudonyms {
+			userID, ok := mapping.Lookup(pseudonym)
+			if !ok {
+				return fmt.Errorf("%q isn't in the mapping", pseudonym)
+			}
+			entries = append(entries, PseudonymEntry{Pseudonym: pseudonym, UserID: userID})
+		}
+	}
+	if jsonOutput() {
+		return writeJSON(entries)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PSEUDONYM\tUSER")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s\t%s\n", entry.Pseudonym, entry.UserID)
+	}
+	return w.Flush()
+}
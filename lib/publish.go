@@ -0,0 +1,588 @@
+package archive
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PublishConfig holds the privacy controls applied to an archive before it is
+// published, so that what goes public is what its participants agreed to
+type PublishConfig struct {
+	Rooms      []string `yaml:"rooms,omitempty"`        // Rooms to publish; empty publishes every archived room
+	IncludeDMs bool     `yaml:"include_dms,omitempty"`  // Also publish direct chats, which are left out by default
+	Anonymize  []string `yaml:"anonymize,omitempty"`    // Sender patterns, as in @*:example.org, whose names and IDs are replaced with pseudonyms
+	StripMedia []string `yaml:"strip_media,omitempty"`  // MIME type patterns, as in video/*, of media to remove
+	OptOut     []string `yaml:"opt_out,omitempty"`      // Sender patterns of people who declined publication; their messages are withheld
+	OptOutFile string   `yaml:"opt_out_file,omitempty"` // File with more opted-out user IDs, one per line
+
+	// File the pseudonyms of anonymized senders are written to with the user
+	// IDs they stand for, outside the site so it isn't published. It is
+	// encrypted with MappingPassword, which is never read from the file.
+	MappingFile     string `yaml:"mapping_file,omitempty"`
+	MappingPassword string `yaml:"-"`
+
+	// Command run once the site is written, such as "rsync -a {dir}/
+	// host:/srv/archive"; {dir} is replaced with the site's directory, or
+	// the directory is appended if it is absent
+	UploadCommand string `yaml:"upload_command,omitempty"`
+}
+
+// LoadPublishConfig reads a YAML publish configuration, such as
+//
+//	include_dms: false
+//	anonymize: ["@*:bridge.example.org"]
+//	strip_media: ["video/*", "audio/*"]
+//	opt_out: ["@carol:example.org"]
+//	opt_out_file: opt-out.txt
+//	mapping_file: ../pseudonyms.json
+//
+// A relative opt_out_file or mapping_file is relative to the configuration
+// file's directory.
+func LoadPublishConfig(filename string) (*PublishConfig, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read publish configuration: %w", err)
+	}
+	cfg := &PublishConfig{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse publish configuration in %s: %w", filename, err)
+	}
+	if cfg.OptOutFile != "" && !filepath.IsAbs(cfg.OptOutFile) {
+		cfg.OptOutFile = filepath.Join(filepath.Dir(filename), cfg.OptOutFile)
+	}
+	if cfg.MappingFile != "" && !filepath.IsAbs(cfg.MappingFile) {
+		cfg.MappingFile = filepath.Join(filepath.Dir(filename), cfg.MappingFile)
+	}
+	return cfg, nil
+}
+
+// Validate checks the configuration's patterns and reads its opt-out file
+// into OptOut
+func (cfg *PublishConfig) Validate() error {
+	for _, patterns := range [][]string{cfg.Anonymize, cfg.OptOut, cfg.StripMedia} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	if cfg.OptOutFile == "" {
+		return nil
+	}
+	users, err := readUserList(cfg.OptOutFile)
+	if err != nil {
+		return err
+	}
+	cfg.OptOut = append(cfg.OptOut, users...)
+	cfg.OptOutFile = ""
+	return nil
+}
+
+// readUserList reads user IDs one per line, skipping blank lines and # comments
+func readUserList(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read opt-out list: %w", err)
+	}
+	defer file.Close()
+
+	var users []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			users = append(users, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read opt-out list: %w", err)
+	}
+	return users, nil
+}
+
+// PublishStats counts what the privacy controls changed
+type PublishStats struct {
+	Withheld   int `json:"withheld"`   // Messages from people who opted out
+	Anonymized int `json:"anonymized"` // Messages whose sender was replaced with a pseudonym
+	Stripped   int `json:"stripped"`   // Media removed
+}
+
+// Publisher applies a PublishConfig's privacy controls to exported messages.
+// Pseudonyms are numbered in order of appearance and kept across rooms, so a
+// person has the same pseudonym throughout a published site.
+type Publisher struct {
+	cfg        *PublishConfig
+	pseudonyms map[string]string
+	assigned   []string // Anonymized user IDs, in the order of their pseudonyms
+	Stats      PublishStats
+}
+
+// NewPublisher returns a publisher applying cfg, which must be valid
+func NewPublisher(cfg *PublishConfig) *Publisher {
+	return &Publisher{cfg: cfg, pseudonyms: make(map[string]string)}
+}
+
+// Apply returns messages with the privacy controls applied: messages from
+// people who opted out are withheld, along with their reactions and the text
+// of replies quoting them; anonymized senders are replaced with pseudonyms,
+// in mentions too; and media of stripped types is removed.
+func (p *Publisher) Apply(messages []ExportMessage) []ExportMessage {
+	published := make([]ExportMessage, 0, len(messages))
+	for _, msg := range messages {
+		if matchesSender(p.cfg.OptOut, msg.UserID) {
+			p.Stats.Withheld++
+			continue
+		}
+		if p.anonymized(msg.UserID) {
+			msg.UserID, msg.Sender, msg.DisplayName = p.pseudonym(msg.UserID), p.pseudonym(msg.UserID), p.pseudonym(msg.UserID)
+			msg.AvatarURL, msg.UserAvatar = "", generateUserAvatar(msg.DisplayName)
+			p.Stats.Anonymized++
+		}
+		if p.quotesOptedOut(&msg) {
+			msg.Content = withoutQuote(msg.Content)
+		}
+		msg.Content = p.rewriteMentions(msg.Content)
+		msg.Reactions = p.publishedReactions(msg.Reactions)
+		if msg.RepliesTo != nil {
+			reply := *msg.RepliesTo
+			if matchesSender(p.cfg.OptOut, reply.Sender) {
+				reply.Sender, reply.DisplayName, reply.Content = "", "", ""
+			} else if p.anonymized(reply.Sender) {
+				reply.Sender, reply.DisplayName = p.pseudonym(reply.Sender), p.pseudonym(reply.Sender)
+			}
+			msg.RepliesTo = &reply
+		}
+		if mimeType, ok := p.strippedMedia(&msg); ok {
+			msg.Content = map[string]interface{}{"msgtype": "m.notice", "body": fmt.Sprintf("(%s removed)", mimeType)}
+			msg.File = nil
+			p.Stats.Stripped++
+		}
+		published = append(published, msg)
+	}
+	return published
+}
+
+// anonymized reports whether a user's name and ID are replaced
+func (p *Publisher) anonymized(userID string) bool {
+	return userID != "" && matchesSender(p.cfg.Anonymize, userID)
+}
+
+// pseudonym returns the name an anonymized user is published under
+func (p *Publisher) pseudonym(userID string) string {
+	name, ok := p.pseudonyms[userID]
+	if !ok {
+		name = fmt.Sprintf("Anonymous %d", len(p.pseudonyms)+1)
+		p.pseudonyms[userID] = name
+		p.assigned = append(p.assigned, userID)
+	}
+	return name
+}
+
+// quotesOptedOut reports whether a message is a reply to someone who opted
+// out, whose text its reply fallback would otherwise quote
+func (p *Publisher) quotesOptedOut(msg *ExportMessage) bool {
+	if len(p.cfg.OptOut) == 0 {
+		return false
+	}
+	if msg.RepliesTo != nil && msg.RepliesTo.Sender != "" {
+		return matchesSender(p.cfg.OptOut, msg.RepliesTo.Sender)
+	}
+	body, _ := msg.Content["body"].(string)
+	match := replyQuoteSenderPattern.FindStringSubmatch(body)
+	return match != nil && matchesSender(p.cfg.OptOut, match[1])
+}
+
+// withoutQuote returns a reply's content without the fallback quoting the
+// replied-to message
+func withoutQuote(content map[string]interface{}) map[string]interface{} {
+	relatesTo, _ := content["m.relates_to"].(map[string]interface{})
+	inReplyTo, _ := relatesTo["m.in_reply_to"].(map[string]interface{})
+	eventID, _ := inReplyTo["event_id"].(string)
+	if eventID == "" {
+		return content
+	}
+	return withoutWithheldQuote(&Message{Content: content}, map[string]bool{eventID: true}).Content
+}
+
+// rewriteMentions replaces anonymized users mentioned in a message with their
+// pseudonyms: their IDs in its text and m.mentions, and their pills, whose
+// display names are replaced in the plain body too. The new content of an
+// edit is rewritten the same way.
+func (p *Publisher) rewriteMentions(content map[string]interface{}) map[string]interface{} {
+	if len(p.cfg.Anonymize) == 0 {
+		return content
+	}
+	rewritten := make(map[string]interface{}, len(content))
+	for key, value := range content {
+		rewritten[key] = value
+	}
+
+	// Pills show a display name rather than the user ID
+	names := make(map[string]string)
+	if formatted, ok := content["formatted_body"].(string); ok {
+		rewritten["formatted_body"] = pillLinkPattern.ReplaceAllStringFunc(formatted, func(link string) string {
+			match := pillLinkPattern.FindStringSubmatch(link)
+			userID, err := url.PathUnescape(match[1])
+			if err != nil || !p.anonymized(userID) {
+				return link
+			}
+			if name := strings.TrimSpace(html.UnescapeString(match[2])); name != "" && name != userID {
+				names[name] = p.pseudonym(userID)
+			}
+			return html.EscapeString(p.pseudonym(userID))
+		})
+	}
+	for _, key := range []string{"body", "formatted_body"} {
+		text, ok := rewritten[key].(string)
+		if !ok {
+			continue
+		}
+		for _, userID := range mentionedUserIDs(text) {
+			if p.anonymized(userID) {
+				text = strings.ReplaceAll(text, userID, p.pseudonym(userID))
+			}
+		}
+		rewritten[key] = text
+	}
+	if body, ok := rewritten["body"].(string); ok {
+		for name, pseudonym := range names {
+			body = strings.ReplaceAll(body, name, pseudonym)
+		}
+		rewritten["body"] = body
+	}
+
+	if mentions, ok := content["m.mentions"].(map[string]interface{}); ok {
+		if ids, ok := mentions["user_ids"].([]interface{}); ok {
+			copied := make(map[string]interface{}, len(mentions))
+			for key, value := range mentions {
+				copied[key] = value
+			}
+			userIDs := make([]interface{}, len(ids))
+			for i, id := range ids {
+				if userID, ok := id.(string); ok && p.anonymized(userID) {
+					id = p.pseudonym(userID)
+				}
+				userIDs[i] = id
+			}
+			copied["user_ids"] = userIDs
+			rewritten["m.mentions"] = copied
+		}
+	}
+	if newContent, ok := content["m.new_content"].(map[string]interface{}); ok {
+		rewritten["m.new_content"] = p.rewriteMentions(newContent)
+	}
+	return rewritten
+}
+
+// publishedReactions removes people who opted out from reactions and
+// anonymizes the others as configured
+func (p *Publisher) publishedReactions(reactions []MessageReaction) []MessageReaction {
+	var published []MessageReaction
+	for _, reaction := range reactions {
+		// Reactions the server counted that weren't archived have no names
+		unnamed := reaction.Count - len(reaction.Users)
+		var users []string
+		for _, user := range reaction.Users {
+			switch {
+			case matchesSender(p.cfg.OptOut, user):
+				continue
+			case p.anonymized(user):
+				users = append(users, p.pseudonym(user))
+			default:
+				users = append(users, user)
+			}
+		}
+		if len(users)+unnamed <= 0 {
+			continue
+		}
+		reaction.Users, reaction.Count = users, len(users)+unnamed
+		published = append(published, reaction)
+	}
+	return published
+}
+
+// strippedMedia returns the MIME type of a message's media if it is of a type
+// to strip. Media without a declared type is matched by its message type, as
+// image/*, video/*, audio/* or application/octet-stream.
+func (p *Publisher) strippedMedia(msg *ExportMessage) (string, bool) {
+	if len(p.cfg.StripMedia) == 0 {
+		return "", false
+	}
+	msgtype, _ := msg.Content["msgtype"].(string)
+	mimeType := ""
+	switch msgtype {
+	case "m.image", "m.video", "m.audio":
+		mimeType = strings.TrimPrefix(msgtype, "m.") + "/*"
+	case "m.file":
+		mimeType = "application/octet-stream"
+	default:
+		if msg.MessageType != "m.sticker" {
+			return "", false
+		}
+		mimeType = "image/*"
+	}
+	if info, ok := msg.Content["info"].(map[string]interface{}); ok {
+		if declared, ok := info["mimetype"].(string); ok && declared != "" {
+			mimeType = declared
+		}
+	}
+	for _, pattern := range p.cfg.StripMedia {
+		if matched, _ := path.Match(pattern, mimeType); matched {
+			return mimeType, true
+		}
+	}
+	return "", false
+}
+
+// userIDPattern matches the user IDs in a message's text
+var userIDPattern = regexp.MustCompile(`@[a-z0-9._=/+-]+:[A-Za-z0-9.-]+(?::[0-9]+)?`)
+
+// pillLinkPattern matches a whole user pill, capturing the user ID, which may
+// be percent-encoded, and the text shown for it
+var pillLinkPattern = regexp.MustCompile(`(?s)<a\s[^>]*href=["'](?:https://matrix\.to/#/|matrix:u/)((?:@|%40)[^"'?/]+)[^"']*["'][^>]*>(.*?)</a>`)
+
+// replyQuoteSenderPattern matches the sender of the message a reply's
+// fallback quotes, as in "> <@carol:example.org> text"
+var replyQuoteSenderPattern = regexp.MustCompile(`^> <(@[^>\s]+)>`)
+
+// mentionedUserIDs returns the user IDs in a message's text
+func mentionedUserIDs(text string) []string {
+	return userIDPattern.FindAllString(text, -1)
+}
+
+// PublishedRoom is a room of a published site
+type PublishedRoom struct {
+	RoomID   string
+	Name     string
+	Path     string // Page, relative to the site
+	Messages int
+}
+
+// publishIndexPage is what the site's front page shows
+type publishIndexPage struct {
+	Rooms        []PublishedRoom
+	SearchIndex  string // Search index of every room, relative to the page; empty without search
+	SearchScript template.JS
+}
+
+// publishIndexTemplate is the site's front page
+var publishIndexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Matrix Archive</title>
+</head>
+<body>
+<main>
+<h1>Matrix Archive</h1>
+{{- with .SearchIndex}}
+<div role="search">
+<input type="search" id="archive-search-input" data-index="{{.}}" data-no-results="No matching messages" placeholder="Search every room" aria-label="Search messages" autocomplete="off">
+<ol id="archive-search-results" aria-live="polite"></ol>
+</div>
+<script>{{$.SearchScript}}</script>
+{{- end}}
+<ul>
+{{- range .Rooms}}
+<li><a href="{{.Path}}">{{.Name}}</a> ({{.Messages}} messages)</li>
+{{- end}}
+</ul>
+<p>Machine-readable copies are in <a href="api/rooms.json">api/</a>.</p>
+</main>
+</body>
+</html>
+`))
+
+// PublishArchive writes archived rooms as a read-only static site into dir:
+// an index page, an HTML page per room and the static JSON API under api/,
+// with cfg's privacy controls applied to everything written. If cfg has an
+// upload command, it is run on dir afterwards.
+func PublishArchive(dir string, cfg *PublishConfig, opts *ExportOptions) error {
+	if opts == nil {
+		opts = DefaultExportOptions()
+	}
+	if cfg == nil {
+		cfg = &PublishConfig{}
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if cfg.MappingFile != "" {
+		if err := checkMappingOutside(cfg.MappingFile, dir); err != nil {
+			return err
+		}
+	}
+	mediaLinks, err := opts.mediaLinkResolver()
+	if err != nil {
+		return err
+	}
+
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	ctx := context.Background()
+	roomIDs := cfg.Rooms
+	if len(roomIDs) == 0 {
+		if roomIDs, err = GetDatabase().GetRooms(ctx); err != nil {
+			return fmt.Errorf("failed to get rooms from database: %w", err)
+		}
+	}
+
+	client, err := GetMatrixClient()
+	if err != nil {
+		log.Printf("Warning: Could not get Matrix client for room names: %v", err)
+		client = nil
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "rooms"), 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	publisher := NewPublisher(cfg)
+	var siteSearch *SearchIndex
+	if opts.SearchIndex {
+		siteSearch = BuildSearchIndex(nil, "", nil)
+	}
+	var published []PublishedRoom
+	var apiRooms []StaticAPIRoom
+	skippedDMs := 0
+	for _, roomID := range roomIDs {
+		organization, err := GetRoomOrganization(ctx, GetDatabase(), roomID)
+		if err != nil {
+			return err
+		}
+		if organization != nil && organization.Direct && !cfg.IncludeDMs {
+			skippedDMs++
+			continue
+		}
+
+		messages, err := GetDatabase().GetMessages(ctx, &MessageFilter{RoomID: roomID}, 0, 0)
+		if err != nil {
+			return fmt.Errorf("failed to query messages for room %s: %w", roomID, err)
+		}
+		if messages, _, err = withholdOptedOut(ctx, messages); err != nil {
+			return err
+		}
+		exportMessages, err := convertToExportMessages(messages, roomID, mediaLinks)
+		if err != nil {
+			return fmt.Errorf("failed to convert messages for room %s: %w", roomID, err)
+		}
+		if opts.Permalinks {
+			AttachPermalinks(exportMessages, roomID, opts.PermalinkBase)
+		}
+		exportMessages = publisher.Apply(exportMessages)
+
+		profile, err := GetDatabase().GetRoomProfile(ctx, roomID)
+		if err != nil {
+			return err
+		}
+		name := roomDisplayName(profile, client, roomID)
+
+		page := path.Join("rooms", staticAPIRoomPath(roomID)+".html")
+		roomOpts := *opts.ForRoom(roomID, organization)
+		roomOpts.RoomID = roomID
+		roomOpts.profile = profile
+		if err := writeExportFile(filepath.Join(dir, filepath.FromSlash(page)), "html", exportMessages, &roomOpts); err != nil {
+			return fmt.Errorf("failed to write room %s: %w", roomID, err)
+		}
+		published = append(published, PublishedRoom{RoomID: roomID, Name: name, Path: page, Messages: len(exportMessages)})
+		if siteSearch != nil {
+			// Room pages load the section of a linked message themselves
+			siteSearch.Docs = append(siteSearch.Docs, BuildSearchIndex(exportMessages, page, nil).Docs...)
+		}
+		apiRooms = append(apiRooms, StaticAPIRoom{RoomID: roomID, Name: name, Profile: profile, Messages: exportMessages})
+		fmt.Printf("Published %d messages from %s\n", len(exportMessages), name)
+	}
+
+	if err := WriteStaticAPI(filepath.Join(dir, "api"), apiRooms, opts.PageSize); err != nil {
+		return err
+	}
+	sort.Slice(published, func(i, j int) bool { return published[i].Name < published[j].Name })
+	if err := writePublishIndex(filepath.Join(dir, "index.html"), published, siteSearch); err != nil {
+		return err
+	}
+
+	fmt.Printf("Published %d rooms to %s\n", len(published), dir)
+	if skippedDMs > 0 {
+		fmt.Printf("%d direct chats left out (set include_dms to publish them)\n", skippedDMs)
+	}
+	stats := publisher.Stats
+	fmt.Printf("%d messages withheld for people who opted out, %d anonymized, %d media files removed\n", stats.Withheld, stats.Anonymized, stats.Stripped)
+	if cfg.MappingFile != "" {
+		mapping := publisher.Pseudonyms()
+		if err := WritePseudonymMapping(cfg.MappingFile, mapping, cfg.MappingPassword); err != nil {
+			return err
+		}
+		encrypted := ""
+		if cfg.MappingPassword != "" {
+			encrypted = "encrypted "
+		}
+		fmt.Printf("Wrote the %smapping of %d pseudonyms to %s; keep it private\n", encrypted, len(mapping.Pseudonyms), cfg.MappingFile)
+	}
+
+	if cfg.UploadCommand != "" {
+		return runUploadCommand(cfg.UploadCommand, dir)
+	}
+	return nil
+}
+
+func writePublishIndex(filename string, rooms []PublishedRoom, search *SearchIndex) error {
+	page := publishIndexPage{Rooms: rooms}
+	if search != nil {
+		page.SearchIndex = filepath.Base(exportFilesDir(filename)) + "/" + searchIndexFile
+		page.SearchScript = template.JS(searchScript)
+		if err := writeSearchIndex(filepath.Join(exportFilesDir(filename), searchIndexFile), search); err != nil {
+			return err
+		}
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer file.Close()
+	return publishIndexTemplate.Execute(file, page)
+}
+
+// runUploadCommand runs a publish configuration's upload command on dir
+func runUploadCommand(command, dir string) error {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return fmt.Errorf("empty upload command")
+	}
+	substituted := false
+	for i, field := range fields {
+		if strings.Contains(field, "{dir}") {
+			fields[i] = strings.ReplaceAll(field, "{dir}", dir)
+			substituted = true
+		}
+	}
+	if !substituted {
+		fields = append(fields, dir)
+	}
+
+	fmt.Printf("Uploading with %s\n", strings.Join(fields, " "))
+	cmd := exec.Command(fields[0], fields[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("upload failed: %s: %w", fields[0], err)
+	}
+	return nil
+}
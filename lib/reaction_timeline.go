@@ -0,0 +1,121 @@
+package archive
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReactionEvent is one reaction in a room's reaction timeline
+type ReactionEvent struct {
+	Timestamp     time.Time `json:"timestamp"`
+	RoomID        string    `json:"room_id"`
+	EventID       string    `json:"event_id"`
+	Sender        string    `json:"sender"`
+	Key           string    `json:"key"` // The emoji or text reacted with
+	TargetEventID string    `json:"target_event_id"`
+	TargetSender  string    `json:"target_sender,omitempty"` // Empty when the target isn't archived
+	// Seconds between the target message and the reaction; omitted when the
+	// target isn't archived
+	DelaySeconds *float64 `json:"delay_seconds,omitempty"`
+}
+
+// BuildReactionTimeline returns every reaction among messages, oldest first,
+// with who reacted, with what, and to which message
+func BuildReactionTimeline(messages []*Message) []ReactionEvent {
+	byID := make(map[string]*Message, len(messages))
+	for _, msg := range messages {
+		byID[msg.EventID] = msg
+	}
+
+	timeline := []ReactionEvent{}
+	for _, msg := range messages {
+		relatesTo, _ := msg.Content["m.relates_to"].(map[string]interface{})
+		if relType, _ := relatesTo["rel_type"].(string); relType != "m.annotation" {
+			continue
+		}
+		target, _ := relatesTo["event_id"].(string)
+		key, _ := relatesTo["key"].(string)
+		if target == "" || key == "" {
+			continue
+		}
+		reaction := ReactionEvent{
+			Timestamp:     msg.Timestamp.UTC(),
+			RoomID:        msg.RoomID,
+			EventID:       msg.EventID,
+			Sender:        msg.Sender,
+			Key:           key,
+			TargetEventID: target,
+		}
+		if targetMsg, ok := byID[target]; ok {
+			reaction.TargetSender = targetMsg.Sender
+			delay := msg.Timestamp.Sub(targetMsg.Timestamp).Seconds()
+			reaction.DelaySeconds = &delay
+		}
+		timeline = append(timeline, reaction)
+	}
+	sort.SliceStable(timeline, func(i, j int) bool { return timeline[i].Timestamp.Before(timeline[j].Timestamp) })
+	return timeline
+}
+
+// reactionTimelineColumns are the header of CSV reaction timelines
+var reactionTimelineColumns = []string{"timestamp", "room_id", "event_id", "sender", "key", "target_event_id", "target_sender", "delay_seconds"}
+
+// reactionTimelineFormat returns the format a reaction timeline is written
+// in, "csv" or "json", chosen by the extension of its path
+func reactionTimelineFormat(path string) (string, error) {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".csv":
+		return "csv", nil
+	case ".json":
+		return "json", nil
+	default:
+		return "", fmt.Errorf("unsupported reaction timeline format %q; use a .json or .csv file", ext)
+	}
+}
+
+// WriteReactionTimeline writes a reaction timeline to path, as CSV or JSON
+// depending on its extension
+func WriteReactionTimeline(path string, timeline []ReactionEvent) error {
+	format, err := reactionTimelineFormat(path)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	switch format {
+	case "csv":
+		var buf strings.Builder
+		w := csv.NewWriter(&buf)
+		w.Write(reactionTimelineColumns)
+		for _, r := range timeline {
+			delay := ""
+			if r.DelaySeconds != nil {
+				delay = strconv.FormatFloat(*r.DelaySeconds, 'f', -1, 64)
+			}
+			w.Write([]string{r.Timestamp.Format(time.RFC3339Nano), r.RoomID, r.EventID, r.Sender, r.Key, r.TargetEventID, r.TargetSender, delay})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return fmt.Errorf("failed to encode reaction timeline: %w", err)
+		}
+		data = []byte(buf.String())
+	case "json":
+		encoded, err := json.MarshalIndent(timeline, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode reaction timeline: %w", err)
+		}
+		data = append(encoded, '\n')
+	}
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write reaction timeline: %w", err)
+	}
+	fmt.Printf("Wrote %d reactions to %q\n", len(timeline), path)
+	return nil
+}
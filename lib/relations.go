@@ -0,0 +1,98 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// relation is a reference from a message to another event
+type relation struct {
+	target  string
+	relType string // m.annotation, m.replace, m.thread, m.in_reply_to, ...
+}
+
+// eventRelations returns the events a message replies to, reacts to or
+// edits, each once
+func eventRelations(msg *Message) []relation {
+	relatesTo, ok := msg.Content["m.relates_to"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	var relations []relation
+	if eventID, _ := relatesTo["event_id"].(string); eventID != "" {
+		relType, _ := relatesTo["rel_type"].(string)
+		relations = append(relations, relation{target: eventID, relType: relType})
+	}
+	if reply, ok := relatesTo["m.in_reply_to"].(map[string]interface{}); ok {
+		if eventID, _ := reply["event_id"].(string); eventID != "" && (len(relations) == 0 || relations[0].target != eventID) {
+			relations = append(relations, relation{target: eventID, relType: "m.in_reply_to"})
+		}
+	}
+	return relations
+}
+
+// ReconcileRelations works out which of a room's relations still refer to
+// events that aren't archived. messages are all of the room's messages and
+// previous the relations an earlier pass left unresolved. It returns the
+// relations whose targets are still missing, keeping when each was first
+// seen (now for new ones), and how many of previous are now linked because
+// their targets have been imported since.
+func ReconcileRelations(messages []*Message, previous []*UnresolvedRelation, now time.Time) ([]*UnresolvedRelation, int) {
+	archived := make(map[string]bool, len(messages))
+	for _, msg := range messages {
+		archived[msg.EventID] = true
+	}
+	firstSeen := make(map[[2]string]time.Time, len(previous))
+	for _, r := range previous {
+		firstSeen[[2]string{r.EventID, r.TargetEventID}] = r.FirstSeen
+	}
+
+	unresolved := []*UnresolvedRelation{}
+	for _, msg := range messages {
+		for _, rel := range eventRelations(msg) {
+			if archived[rel.target] {
+				continue
+			}
+			seen, ok := firstSeen[[2]string{msg.EventID, rel.target}]
+			if !ok {
+				seen = now
+			}
+			unresolved = append(unresolved, &UnresolvedRelation{
+				EventID:       msg.EventID,
+				TargetEventID: rel.target,
+				RoomID:        msg.RoomID,
+				RelType:       rel.relType,
+				FirstSeen:     seen,
+			})
+		}
+	}
+
+	linked := 0
+	for _, r := range previous {
+		if archived[r.EventID] && archived[r.TargetEventID] {
+			linked++
+		}
+	}
+	return unresolved, linked
+}
+
+// reconcileRoomRelations records the relations in a room whose targets
+// aren't archived, replacing what the last pass recorded, and returns how
+// many relations recorded earlier are now linked and how many remain
+func reconcileRoomRelations(ctx context.Context, db DatabaseInterface, roomID string) (int, int, error) {
+	messages, err := db.GetMessages(ctx, &MessageFilter{RoomID: roomID}, 0, 0)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to query messages for room %s: %w", roomID, err)
+	}
+	previous, err := db.GetUnresolvedRelations(ctx, roomID)
+	if err != nil {
+		return 0, 0, err
+	}
+	unresolved, linked := ReconcileRelations(messages, previous, time.Now().UTC())
+	if err := db.SaveUnresolvedRelations(ctx, roomID, unresolved); err != nil {
+		return 0, 0, err
+	}
+	return linked, len(unresolved), nil
+}
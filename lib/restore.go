@@ -0,0 +1,547 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Environment variables "restore" reads the new homeserver and its access
+// token from when they aren't given as flags
+const (
+	RestoreHomeserverEnv = "MATRIX_RESTORE_HOMESERVER"
+	RestoreTokenEnv      = "MATRIX_RESTORE_TOKEN"
+)
+
+// RestoredFromField is the content field in which a restored event records
+// the archived event it was posted for
+const RestoredFromField = "com.github.osteele.matrix_archive.restored_from"
+
+// restoreBatchSize is the number of events posted per /batch_send request
+const restoreBatchSize = 100
+
+// RestoreOptions configure restoring an archive to another homeserver
+type RestoreOptions struct {
+	Homeserver  string  // Base URL of the homeserver to restore to
+	AccessToken string  // The archival user's token, or the application service's with AppService
+	RoomID      string  // Archived room to restore; empty restores every archived room
+	UserMap     UserMap // Archived user IDs to their accounts on the new homeserver
+	AppService  bool    // Post each message as its sender's mapped account, at its original time
+	BatchSend   bool    // Post history in bulk with /batch_send; needs AppService
+	MediaDir    string  // Downloaded images to upload to the new homeserver
+}
+
+// RestoreResult summarizes the restore of a room
+type RestoreResult struct {
+	RoomID          string `json:"room_id"`
+	TargetRoomID    string `json:"target_room_id"`
+	Posted          int    `json:"posted"`
+	AlreadyRestored int    `json:"already_restored"` // Posted by an earlier restore
+	Skipped         int    `json:"skipped"`          // Undecrypted, or relating to events that weren't restored
+}
+
+// UserMap maps archived user IDs to user IDs on a new homeserver
+type UserMap map[string]string
+
+// LoadUserMap reads a YAML mapping of archived user IDs to new ones, such as
+//
+//	"@alice:old.example": "@alice:new.example"
+//	"@bob:old.example": "@robert:new.example"
+func LoadUserMap(filename string) (UserMap, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read user map: %w", err)
+	}
+	var users UserMap
+	if err := yaml.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("failed to parse user map in %s: %w", filename, err)
+	}
+	for from, to := range users {
+		for _, userID := range []string{from, to} {
+			if _, _, err := id.UserID(userID).Parse(); err != nil {
+				return nil, fmt.Errorf("%s: %s is not a user ID: %w", filename, userID, err)
+			}
+		}
+	}
+	return users, nil
+}
+
+// RestoreContent returns the content to post on the new homeserver for an
+// archived message. Its relations point at the restored events, given by
+// archived event ID, and it records the original event in RestoredFromField.
+// A non-empty attribution names the original sender at the start of the body,
+// for messages the archival user posts for them. It reports false for
+// messages that can't be restored: undecrypted placeholders, and reactions and
+// edits to events that weren't restored.
+func RestoreContent(msg *Message, restored map[string]string, attribution string) (map[string]interface{}, bool) {
+	if msg.MessageType == EventTypeEncrypted {
+		return nil, false
+	}
+
+	// Work on a copy, since the content is rewritten
+	contentJSON, err := msg.ContentJSON()
+	if err != nil {
+		return nil, false
+	}
+	var content map[string]interface{}
+	if err := json.Unmarshal([]byte(contentJSON), &content); err != nil || content == nil {
+		return nil, false
+	}
+
+	if relatesTo, ok := content["m.relates_to"].(map[string]interface{}); ok {
+		if eventID, ok := relatesTo["event_id"].(string); ok {
+			target, found := restored[eventID]
+			switch {
+			case found:
+				relatesTo["event_id"] = target
+			case msg.MessageType == EventTypeReaction || relatesTo["rel_type"] == "m.replace":
+				return nil, false
+			default:
+				// A thread whose root wasn't restored continues in the room
+				delete(relatesTo, "rel_type")
+				delete(relatesTo, "event_id")
+				delete(relatesTo, "is_falling_back")
+			}
+		}
+		if inReplyTo, ok := relatesTo["m.in_reply_to"].(map[string]interface{}); ok {
+			if target, found := restored[fmt.Sprint(inReplyTo["event_id"])]; found {
+				inReplyTo["event_id"] = target
+			} else {
+				delete(relatesTo, "m.in_reply_to")
+			}
+		}
+		if len(relatesTo) == 0 {
+			delete(content, "m.relates_to")
+		}
+	}
+
+	if attribution != "" && msg.MessageType == EventTypeMessage {
+		prefix := "[" + msg.Timestamp.UTC().Format("2006-01-02 15:04") + "] "
+		attributeContent(content, prefix, attribution)
+		if newContent, ok := content["m.new_content"].(map[string]interface{}); ok {
+			attributeContent(newContent, prefix, attribution)
+		}
+	}
+
+	content[RestoredFromField] = map[string]interface{}{
+		"event_id":         msg.EventID,
+		"room_id":          msg.RoomID,
+		"sender":           msg.Sender,
+		"origin_server_ts": msg.Timestamp.UnixMilli(),
+	}
+	return content, true
+}
+
+// attributeContent starts a message's body with its time and sender's name.
+// Emotes become text, since they would otherwise read as the archival user's.
+func attributeContent(content map[string]interface{}, prefix, name string) {
+	separator := ": "
+	if content["msgtype"] == "m.emote" {
+		content["msgtype"] = "m.text"
+		prefix += "* "
+		separator = " "
+	}
+	if body, ok := content["body"].(string); ok {
+		content["body"] = prefix + name + separator + body
+	}
+	if formatted, ok := content["formatted_body"].(string); ok {
+		content["formatted_body"] = html.EscapeString(prefix) + "<strong>" + html.EscapeString(name) + "</strong>" + html.EscapeString(separator) + formatted
+	}
+}
+
+// reactionKey identifies a reaction by the event it annotates and its key,
+// or returns "" for other messages
+func reactionKey(msg *Message) string {
+	if msg.MessageType != EventTypeReaction {
+		return ""
+	}
+	relatesTo, _ := msg.Content["m.relates_to"].(map[string]interface{})
+	return fmt.Sprint(relatesTo["event_id"]) + " " + fmt.Sprint(relatesTo["key"])
+}
+
+// restorer posts archived rooms to a homeserver
+type restorer struct {
+	opts     RestoreOptions
+	db       DatabaseInterface
+	client   *mautrix.Client
+	senders  map[id.UserID]*mautrix.Client // With AppService, clients acting as mapped users
+	media    *MediaDir
+	uploaded map[string]string // Media stems to their content URIs on the new homeserver
+}
+
+// pendingEvent is an event waiting for the next /batch_send
+type pendingEvent struct {
+	sourceEventID string
+	event         *event.Event
+}
+
+// RestoreArchive recreates archived rooms on another homeserver, for example
+// to move a community off a server that is shutting down. Each room is
+// created by the account the access token belongs to, which invites the
+// mapped users and re-posts the history in order. Without AppService the
+// account posts every message itself, naming the original sender; with it,
+// messages from mapped users are posted as those users, at their original
+// times. Rooms and events already restored to the homeserver are not posted
+// again, so an interrupted restore can be run again to finish.
+func RestoreArchive(opts RestoreOptions) error {
+	if opts.Homeserver == "" {
+		opts.Homeserver = os.Getenv(RestoreHomeserverEnv)
+	}
+	if opts.AccessToken == "" {
+		opts.AccessToken = os.Getenv(RestoreTokenEnv)
+	}
+	if opts.Homeserver == "" || opts.AccessToken == "" {
+		return fmt.Errorf("restore needs a homeserver and an access token (--homeserver and --token, or %s and %s)", RestoreHomeserverEnv, RestoreTokenEnv)
+	}
+	if opts.BatchSend && !opts.AppService {
+		return fmt.Errorf("/batch_send is only available to application services; use --appservice with an application service token")
+	}
+
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	ctx := context.Background()
+	client, err := mautrix.NewClient(opts.Homeserver, "", opts.AccessToken)
+	if err != nil {
+		return fmt.Errorf("failed to create client for %s: %w", opts.Homeserver, err)
+	}
+	whoami, err := client.Whoami(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to authenticate to %s: %w", opts.Homeserver, err)
+	}
+	client.UserID = whoami.UserID
+
+	r := &restorer{opts: opts, db: GetDatabase(), client: client, senders: make(map[id.UserID]*mautrix.Client), uploaded: make(map[string]string)}
+	if opts.MediaDir != "" {
+		if r.media, err = OpenMediaDir(opts.MediaDir, ""); err != nil {
+			return err
+		}
+	}
+
+	rooms := []string{opts.RoomID}
+	if opts.RoomID == "" {
+		if rooms, err = r.db.GetRooms(ctx); err != nil {
+			return fmt.Errorf("failed to list rooms: %w", err)
+		}
+	}
+
+	var results []*RestoreResult
+	for _, roomID := range rooms {
+		result, err := r.restoreRoom(ctx, roomID)
+		if err != nil {
+			return fmt.Errorf("failed to restore room %s: %w", roomID, err)
+		}
+		results = append(results, result)
+		if !jsonOutput() {
+			fmt.Printf("✓ Restored %s to %s: %d messages posted, %d already restored, %d skipped\n",
+				roomID, result.TargetRoomID, result.Posted, result.AlreadyRestored, result.Skipped)
+		}
+	}
+
+	if jsonOutput() {
+		if results == nil {
+			results = []*RestoreResult{}
+		}
+		return writeJSON(results)
+	}
+	return nil
+}
+
+// restoreRoom posts the history of an archived room that hasn't been restored yet
+func (r *restorer) restoreRoom(ctx context.Context, roomID string) (*RestoreResult, error) {
+	messages, err := r.db.GetMessages(ctx, &MessageFilter{RoomID: roomID}, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read messages: %w", err)
+	}
+	restored, err := r.db.GetRestoredEvents(ctx, r.opts.Homeserver, roomID)
+	if err != nil {
+		return nil, err
+	}
+	names := r.senderNames(ctx, roomID)
+
+	target, err := r.targetRoom(ctx, roomID, messages)
+	if err != nil {
+		return nil, err
+	}
+	result := &RestoreResult{RoomID: roomID, TargetRoomID: target.String()}
+
+	var pending []pendingEvent
+	pendingIDs := make(map[string]bool)
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		if err := r.batchSend(ctx, roomID, target, pending, restored); err != nil {
+			return err
+		}
+		result.Posted += len(pending)
+		pending = nil
+		pendingIDs = make(map[string]bool)
+		return nil
+	}
+
+	// The archival user can react with each key only once
+	reacted := make(map[string]bool)
+	for _, msg := range messages {
+		sender := r.senderFor(msg.Sender)
+		key := reactionKey(msg)
+		if _, ok := restored[msg.EventID]; ok {
+			result.AlreadyRestored++
+			if key != "" && sender == "" {
+				reacted[key] = true
+			}
+			continue
+		}
+		if key != "" && sender == "" && reacted[key] {
+			result.Skipped++
+			continue
+		}
+
+		// Relations can only point at events that have been posted
+		for _, related := range relatedEventIDs(msg) {
+			if pendingIDs[related] {
+				if err := flush(); err != nil {
+					return result, err
+				}
+				break
+			}
+		}
+
+		attribution := ""
+		if sender == "" {
+			if attribution = names[msg.Sender]; attribution == "" {
+				attribution = msg.Sender
+			}
+		}
+		content, ok := RestoreContent(msg, restored, attribution)
+		if !ok {
+			result.Skipped++
+			continue
+		}
+		if key != "" && sender == "" {
+			reacted[key] = true
+		}
+		if err := r.uploadMedia(ctx, msg, content); err != nil {
+			return result, err
+		}
+
+		eventType := event.Type{Type: msg.MessageType, Class: event.MessageEventType}
+		if r.opts.BatchSend {
+			if sender == "" {
+				sender = r.client.UserID
+			}
+			pending = append(pending, pendingEvent{msg.EventID, &event.Event{
+				Sender:    sender,
+				Type:      eventType,
+				Timestamp: msg.Timestamp.UnixMilli(),
+				Content:   event.Content{Raw: content},
+			}})
+			pendingIDs[msg.EventID] = true
+			if len(pending) >= restoreBatchSize {
+				if err := flush(); err != nil {
+					return result, err
+				}
+			}
+			continue
+		}
+
+		client := r.client
+		var req mautrix.ReqSendEvent
+		if sender != "" {
+			client = r.senders[sender]
+			req.Timestamp = msg.Timestamp.UnixMilli()
+		}
+		resp, err := client.SendMessageEvent(ctx, target, eventType, content, req)
+		if err != nil {
+			return result, fmt.Errorf("failed to post %s: %w", msg.EventID, err)
+		}
+		restored[msg.EventID] = resp.EventID.String()
+		posted := &RestoredEvent{SourceEventID: msg.EventID, SourceRoomID: roomID, Homeserver: r.opts.Homeserver, TargetEventID: resp.EventID.String()}
+		if err := r.db.SaveRestoredEvents(ctx, []*RestoredEvent{posted}); err != nil {
+			return result, err
+		}
+		result.Posted++
+	}
+
+	return result, flush()
+}
+
+// batchSend posts events in one /batch_send request and records them
+func (r *restorer) batchSend(ctx context.Context, roomID string, target id.RoomID, pending []pendingEvent, restored map[string]string) error {
+	req := &mautrix.ReqBeeperBatchSend{Forward: true}
+	for _, p := range pending {
+		req.Events = append(req.Events, p.event)
+	}
+	resp, err := r.client.BeeperBatchSend(ctx, target, req)
+	if err != nil {
+		return fmt.Errorf("failed to batch send %d events: %w", len(pending), err)
+	}
+	if len(resp.EventIDs) != len(pending) {
+		return fmt.Errorf("batch send returned %d event IDs for %d events", len(resp.EventIDs), len(pending))
+	}
+
+	events := make([]*RestoredEvent, len(pending))
+	for i, p := range pending {
+		restored[p.sourceEventID] = resp.EventIDs[i].String()
+		events[i] = &RestoredEvent{SourceEventID: p.sourceEventID, SourceRoomID: roomID, Homeserver: r.opts.Homeserver, TargetEventID: resp.EventIDs[i].String()}
+	}
+	return r.db.SaveRestoredEvents(ctx, events)
+}
+
+// targetRoom returns the room an archived room is restored into, creating it
+// and bringing in the mapped users on the first restore
+func (r *restorer) targetRoom(ctx context.Context, roomID string, messages []*Message) (id.RoomID, error) {
+	existing, err := r.db.GetRestoredRoom(ctx, r.opts.Homeserver, roomID)
+	if err != nil {
+		return "", err
+	}
+
+	var members []id.UserID
+	seen := make(map[string]bool)
+	for _, msg := range messages {
+		if mapped, ok := r.opts.UserMap[msg.Sender]; ok && !seen[mapped] && id.UserID(mapped) != r.client.UserID {
+			seen[mapped] = true
+			members = append(members, id.UserID(mapped))
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i] < members[j] })
+
+	var target id.RoomID
+	if existing != nil {
+		target = id.RoomID(existing.TargetRoomID)
+	} else {
+		req := &mautrix.ReqCreateRoom{
+			Preset: "private_chat",
+			Topic:  fmt.Sprintf("History of %s, restored from an archive", roomID),
+		}
+		if !r.opts.AppService {
+			req.Invite = members
+		}
+		resp, err := r.client.CreateRoom(ctx, req)
+		if err != nil {
+			return "", fmt.Errorf("failed to create room: %w", err)
+		}
+		target = resp.RoomID
+		if err := r.db.SaveRestoredRoom(ctx, &RestoredRoom{SourceRoomID: roomID, Homeserver: r.opts.Homeserver, TargetRoomID: target.String()}); err != nil {
+			return "", err
+		}
+	}
+
+	if r.opts.AppService {
+		for _, userID := range members {
+			if err := r.join(ctx, target, userID); err != nil {
+				return "", err
+			}
+		}
+	}
+	return target, nil
+}
+
+// join brings a mapped user into a restored room, registering them with the
+// application service first if they are on the new homeserver
+func (r *restorer) join(ctx context.Context, target id.RoomID, userID id.UserID) error {
+	sender, ok := r.senders[userID]
+	if !ok {
+		localpart, server, _ := userID.Parse()
+		if server == r.client.UserID.Homeserver() {
+			_, _, err := r.client.Register(ctx, &mautrix.ReqRegister{Username: localpart, Type: mautrix.AuthTypeAppservice, InhibitLogin: true})
+			if err != nil && !errors.Is(err, mautrix.MUserInUse) {
+				return fmt.Errorf("failed to register %s: %w", userID, err)
+			}
+		}
+		var err error
+		if sender, err = mautrix.NewClient(r.opts.Homeserver, userID, r.opts.AccessToken); err != nil {
+			return err
+		}
+		sender.SetAppServiceUserID = true
+		r.senders[userID] = sender
+	}
+
+	// Inviting a member again fails, and so is harmless
+	_, _ = r.client.InviteUser(ctx, target, &mautrix.ReqInviteUser{UserID: userID})
+	if _, err := sender.JoinRoomByID(ctx, target); err != nil {
+		return fmt.Errorf("failed to join %s to the restored room: %w", userID, err)
+	}
+	return nil
+}
+
+// senderFor returns the account that posts a sender's messages itself, or ""
+// if the archival user posts them on the sender's behalf
+func (r *restorer) senderFor(sender string) id.UserID {
+	if !r.opts.AppService {
+		return ""
+	}
+	mapped, ok := r.opts.UserMap[sender]
+	if !ok || id.UserID(mapped) == r.client.UserID {
+		return ""
+	}
+	return id.UserID(mapped)
+}
+
+// senderNames returns the names the archival user attributes messages to:
+// the display names cached for the room, or else the user IDs
+func (r *restorer) senderNames(ctx context.Context, roomID string) map[string]string {
+	names := make(map[string]string)
+	users, _ := r.db.GetRoomUsers(ctx, roomID)
+	for _, user := range users {
+		if user.DisplayName != "" {
+			names[user.UserID] = user.DisplayName
+		}
+	}
+	return names
+}
+
+// uploadMedia uploads a downloaded image to the new homeserver and points the
+// content at it, so it outlives the old homeserver
+func (r *restorer) uploadMedia(ctx context.Context, msg *Message, content map[string]interface{}) error {
+	if r.media == nil {
+		return nil
+	}
+	stem := GetDownloadStem(*msg, false)
+	if stem == "" {
+		return nil
+	}
+	if uri, ok := r.uploaded[stem]; ok {
+		content["url"] = uri
+		return nil
+	}
+	path := r.media.Find(stem)
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	contentType := msg.FileMimeType
+	if info, ok := msg.Content["info"].(map[string]interface{}); ok && contentType == "" {
+		contentType, _ = info["mimetype"].(string)
+	}
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(path))
+	}
+	name, _ := msg.Content["body"].(string)
+	resp, err := r.client.UploadBytesWithName(ctx, data, contentType, strings.TrimSpace(name))
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", path, err)
+	}
+	r.uploaded[stem] = resp.ContentURI.String()
+	content["url"] = r.uploaded[stem]
+	return nil
+}
@@ -0,0 +1,115 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// How an import reads a room the account isn't in (see RejoinRoom)
+const (
+	RoomAccessPeek     = "peek"     // The room is world-readable, so its history is read without joining
+	RoomAccessRejoined = "rejoined" // The account joined the room again
+)
+
+// RoomAccessError is an import being unable to read a room the account
+// isn't in, with the reason in terms of the room rather than the request
+type RoomAccessError struct {
+	RoomID string
+	Reason string
+	Err    error
+}
+
+func (e *RoomAccessError) Error() string {
+	return fmt.Sprintf("cannot read room %s: %s (%v)", e.RoomID, e.Reason, e.Err)
+}
+
+func (e *RoomAccessError) Unwrap() error {
+	return e.Err
+}
+
+// RejoinRoom gets an account back into a room it has left, so that the
+// room's history can be fetched. World-readable rooms are read without
+// joining, as a guest previewing them would; other rooms are joined again,
+// through the server in the room ID. It returns RoomAccessPeek or
+// RoomAccessRejoined, or a RoomAccessError saying why the room can't be
+// read, e.g. because it is invite-only or the account was banned.
+func RejoinRoom(ctx context.Context, client *mautrix.Client, roomID string) (string, error) {
+	if readable, _ := worldReadable(ctx, client, roomID); readable {
+		return RoomAccessPeek, nil
+	}
+
+	req := &mautrix.ReqJoinRoom{Reason: "Archiving the room's history"}
+	if _, server, found := strings.Cut(roomID, ":"); found {
+		req.Via = []string{server}
+	}
+	if _, err := client.JoinRoom(ctx, roomID, req); err != nil {
+		return "", roomAccessError(roomID, err, true)
+	}
+	return RoomAccessRejoined, nil
+}
+
+// PeekRoom checks that a room the account isn't in can be read without
+// joining it, which needs the room's history to be world-readable
+func PeekRoom(ctx context.Context, client *mautrix.Client, roomID string) error {
+	readable, err := worldReadable(ctx, client, roomID)
+	if err == nil && !readable {
+		err = errNotWorldReadable
+	}
+	if errors.Is(err, mautrix.MForbidden) || errors.Is(err, errNotWorldReadable) {
+		// Servers refuse to show the state of rooms that aren't world-readable
+		return &RoomAccessError{RoomID: roomID, Reason: "the room's history isn't world-readable, so it can only be read by joining it", Err: err}
+	}
+	if err != nil {
+		return roomAccessError(roomID, err, false)
+	}
+	return nil
+}
+
+var errNotWorldReadable = errors.New("history visibility is not world_readable")
+
+// worldReadable reports whether anyone can read a room's history, as its
+// m.room.history_visibility state says
+func worldReadable(ctx context.Context, client *mautrix.Client, roomID string) (bool, error) {
+	var visibility event.HistoryVisibilityEventContent
+	if err := client.StateEvent(ctx, id.RoomID(roomID), event.StateHistoryVisibility, "", &visibility); err != nil {
+		return false, err
+	}
+	return visibility.HistoryVisibility == event.HistoryVisibilityWorldReadable, nil
+}
+
+// resolveRoom returns the room ID of a room ID or alias such as
+// #announcements:example.org
+func resolveRoom(ctx context.Context, client *mautrix.Client, room string) (string, error) {
+	if !strings.HasPrefix(room, "#") {
+		return room, nil
+	}
+	resp, err := client.ResolveAlias(ctx, id.RoomAlias(room))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve room alias %s: %w", room, err)
+	}
+	return string(resp.RoomID), nil
+}
+
+// roomAccessError explains an error reading a room the account isn't in,
+// returning other errors as they are. rejoin says whether joining the room
+// again was already tried.
+func roomAccessError(roomID string, err error, rejoin bool) error {
+	var reason string
+	switch {
+	case errors.Is(err, mautrix.MForbidden) && rejoin:
+		reason = "the room is invite-only or the account is banned from it; a member has to invite the account back"
+	case errors.Is(err, mautrix.MForbidden):
+		reason = "the account isn't in the room; import with --rejoin to join it, or with --peek if it is world-readable"
+	case errors.Is(err, mautrix.MNotFound):
+		reason = "the homeserver no longer knows the room, e.g. because everyone on it has left"
+	default:
+		return err
+	}
+	return &RoomAccessError{RoomID: roomID, Reason: reason, Err: err}
+}
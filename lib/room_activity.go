@@ -0,0 +1,53 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// RoomActivity summarizes everything archived from a room, whatever part of
+// it an export covers
+type RoomActivity struct {
+	Messages     int64
+	Senders      int
+	ActiveDays   int
+	FirstMessage time.Time
+	LastMessage  time.Time
+}
+
+// SummarizeDailyStats totals a room's daily statistics, or returns nil if it
+// has none
+func SummarizeDailyStats(stats []*DailyStats) *RoomActivity {
+	if len(stats) == 0 {
+		return nil
+	}
+	activity := &RoomActivity{}
+	senders := make(map[string]bool)
+	days := make(map[time.Time]bool)
+	for _, s := range stats {
+		activity.Messages += s.MessageCount
+		senders[s.Sender] = true
+		days[s.Day] = true
+		if activity.FirstMessage.IsZero() || s.FirstMessage.Before(activity.FirstMessage) {
+			activity.FirstMessage = s.FirstMessage
+		}
+		if s.LastMessage.After(activity.LastMessage) {
+			activity.LastMessage = s.LastMessage
+		}
+	}
+	activity.Senders = len(senders)
+	activity.ActiveDays = len(days)
+	return activity
+}
+
+// loadRoomActivity reads the room's totals for the HTML header from the
+// daily statistics rather than counting its messages
+func loadRoomActivity(ctx context.Context, roomID string, opts *ExportOptions) error {
+	stats, err := GetDatabase().GetDailyStats(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("failed to load room statistics: %w", err)
+	}
+	opts.activity = SummarizeDailyStats(stats)
+	return nil
+}
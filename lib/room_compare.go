@@ -0,0 +1,308 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// responseWindow is the longest gap between one sender's message and the
+// next sender's that counts as a response rather than a new conversation
+const responseWindow = 12 * time.Hour
+
+// Period is a window of time to compare, from Start up to but not including End
+type Period struct {
+	Label string    `json:"label"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// periodLayouts are the granularities ParsePeriod accepts, with the length
+// of the window each one names
+var periodLayouts = []struct {
+	layout              string
+	years, months, days int
+}{
+	{"2006", 1, 0, 0},
+	{"2006-01", 0, 1, 0},
+	{"2006-01-02", 0, 0, 1},
+}
+
+// ParsePeriod parses a year (2024), month (2024-03) or day (2024-03-15), or
+// an inclusive range of them such as 2024-01..2024-06
+func ParsePeriod(s string) (Period, error) {
+	s = strings.TrimSpace(s)
+	from, to, isRange := strings.Cut(s, "..")
+	start, end, err := parsePeriodBound(from)
+	if err == nil && isRange {
+		_, end, err = parsePeriodBound(to)
+	}
+	if err != nil {
+		return Period{}, fmt.Errorf("invalid period %q, expected YYYY, YYYY-MM, YYYY-MM-DD or a range FROM..TO", s)
+	}
+	if !start.Before(end) {
+		return Period{}, fmt.Errorf("invalid period %q: it ends before it starts", s)
+	}
+	return Period{Label: s, Start: start, End: end}, nil
+}
+
+// parsePeriodBound returns the start and end of the year, month or day s names
+func parsePeriodBound(s string) (time.Time, time.Time, error) {
+	for _, l := range periodLayouts {
+		if len(s) != len(l.layout) {
+			continue
+		}
+		if t, err := time.ParseInLocation(l.layout, s, time.Local); err == nil {
+			return t, t.AddDate(l.years, l.months, l.days), nil
+		}
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("invalid period %q", s)
+}
+
+// Contains reports whether t falls in the period
+func (p Period) Contains(t time.Time) bool {
+	return !t.Before(p.Start) && t.Before(p.End)
+}
+
+// PeriodStats summarizes a room's activity in one period
+type PeriodStats struct {
+	Period         Period        `json:"period"`
+	Messages       int           `json:"messages"`
+	ActiveUsers    int           `json:"active_users"`
+	MediaMessages  int           `json:"media_messages"`
+	MediaShare     float64       `json:"media_share"` // Fraction of messages that are images, video, audio or files
+	MedianResponse time.Duration `json:"-"`           // Median gap before a different sender replies; 0 if nobody did
+
+	// MedianResponse in seconds, for JSON output
+	MedianResponseSeconds float64 `json:"median_response_seconds"`
+}
+
+// SummarizePeriod computes the statistics of the messages in period.
+// Reactions aren't counted; undecryptable messages are.
+func SummarizePeriod(messages []*Message, period Period) PeriodStats {
+	stats := PeriodStats{Period: period}
+	var inPeriod []*Message
+	for _, msg := range messages {
+		if msg.MessageType == EventTypeReaction || !period.Contains(msg.Timestamp) {
+			continue
+		}
+		inPeriod = append(inPeriod, msg)
+	}
+	sort.SliceStable(inPeriod, func(i, j int) bool { return inPeriod[i].Timestamp.Before(inPeriod[j].Timestamp) })
+
+	senders := make(map[string]bool)
+	var responses []time.Duration
+	for i, msg := range inPeriod {
+		senders[msg.Sender] = true
+		switch contentMsgType(msg.Content) {
+		case "m.image", "m.video", "m.audio", "m.file":
+			stats.MediaMessages++
+		}
+		if i > 0 && inPeriod[i-1].Sender != msg.Sender {
+			if gap := msg.Timestamp.Sub(inPeriod[i-1].Timestamp); gap <= responseWindow {
+				responses = append(responses, gap)
+			}
+		}
+	}
+	stats.Messages = len(inPeriod)
+	stats.ActiveUsers = len(senders)
+	if stats.Messages > 0 {
+		stats.MediaShare = float64(stats.MediaMessages) / float64(stats.Messages)
+	}
+	if len(responses) > 0 {
+		sort.Slice(responses, func(i, j int) bool { return responses[i] < responses[j] })
+		mid := len(responses) / 2
+		stats.MedianResponse = responses[mid]
+		if len(responses)%2 == 0 {
+			stats.MedianResponse = (responses[mid-1] + responses[mid]) / 2
+		}
+		stats.MedianResponseSeconds = stats.MedianResponse.Seconds()
+	}
+	return stats
+}
+
+// RoomComparison compares a room's activity in two periods
+type RoomComparison struct {
+	RoomID  string      `json:"room_id"`
+	Period1 PeriodStats `json:"period1"`
+	Period2 PeriodStats `json:"period2"`
+}
+
+// ComparisonRow is one metric of a comparison, formatted for a table
+type ComparisonRow struct {
+	Metric  string
+	Period1 string
+	Period2 string
+	Change  string
+}
+
+// CompareRoomPeriods summarizes messages in each of two periods
+func CompareRoomPeriods(roomID string, messages []*Message, period1, period2 Period) *RoomComparison {
+	return &RoomComparison{
+		RoomID:  roomID,
+		Period1: SummarizePeriod(messages, period1),
+		Period2: SummarizePeriod(messages, period2),
+	}
+}
+
+// Rows formats the comparison's metrics with the change from the first
+// period to the second
+func (c *RoomComparison) Rows() []ComparisonRow {
+	a, b := c.Period1, c.Period2
+	response := func(d time.Duration) string {
+		if d == 0 {
+			return "-"
+		}
+		return d.Round(time.Second).String()
+	}
+	responseChange := "-"
+	if a.MedianResponse > 0 && b.MedianResponse > 0 {
+		diff := (b.MedianResponse - a.MedianResponse).Round(time.Second)
+		sign := "+"
+		if diff < 0 {
+			sign = ""
+		}
+		responseChange = sign + diff.String() + percentChange(float64(a.MedianResponse), float64(b.MedianResponse))
+	}
+	return []ComparisonRow{
+		{"Messages", fmt.Sprint(a.Messages), fmt.Sprint(b.Messages), countChange(a.Messages, b.Messages)},
+		{"Active users", fmt.Sprint(a.ActiveUsers), fmt.Sprint(b.ActiveUsers), countChange(a.ActiveUsers, b.ActiveUsers)},
+		{"Median response", response(a.MedianResponse), response(b.MedianResponse), responseChange},
+		{"Media share", formatShare(a.MediaShare), formatShare(b.MediaShare), fmt.Sprintf("%+.1f pts", 100*(b.MediaShare-a.MediaShare))},
+	}
+}
+
+// countChange formats the difference between two counts, e.g. "+300 (+25.0%)"
+func countChange(a, b int) string {
+	return fmt.Sprintf("%+d", b-a) + percentChange(float64(a), float64(b))
+}
+
+// percentChange formats the relative change from a to b, or nothing if a is 0
+func percentChange(a, b float64) string {
+	if a == 0 {
+		return ""
+	}
+	change := 100 * (b - a) / a
+	if math.Abs(change) < 0.05 {
+		change = 0
+	}
+	return fmt.Sprintf(" (%+.1f%%)", change)
+}
+
+// formatShare formats a fraction as a percentage
+func formatShare(share float64) string {
+	return fmt.Sprintf("%.1f%%", 100*share)
+}
+
+// comparisonReportTemplate is the HTML mini-report written by --html
+var comparisonReportTemplate = template.Must(template.New("compare").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Name}}: {{.Comparison.Period1.Period.Label}} vs {{.Comparison.Period2.Period.Label}}</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2rem; color: #222; }
+table { border-collapse: collapse; }
+th, td { padding: 0.4rem 1rem; border-bottom: 1px solid #ddd; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+</style>
+</head>
+<body>
+<main>
+<h1>{{.Name}}</h1>
+<p>{{.Comparison.Period1.Period.Label}} compared with {{.Comparison.Period2.Period.Label}}</p>
+<table>
+<thead><tr><th scope="col">Metric</th><th scope="col">{{.Comparison.Period1.Period.Label}}</th><th scope="col">{{.Comparison.Period2.Period.Label}}</th><th scope="col">Change</th></tr></thead>
+<tbody>
+{{- range .Rows}}
+<tr><th scope="row">{{.Metric}}</th><td>{{.Period1}}</td><td>{{.Period2}}</td><td>{{.Change}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+<p>Median response is the median gap before a different sender posts, counting gaps of up to {{.WindowHours}} hours.</p>
+</main>
+</body>
+</html>
+`))
+
+// WriteComparisonReport writes a comparison as a standalone HTML page
+func WriteComparisonReport(filename, name string, comparison *RoomComparison) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer file.Close()
+	return comparisonReportTemplate.Execute(file, struct {
+		Name        string
+		Comparison  *RoomComparison
+		Rows        []ComparisonRow
+		WindowHours int
+	}{name, comparison, comparison.Rows(), int(responseWindow.Hours())})
+}
+
+// CompareRoom compares a room's volume, active users, response times and
+// media share in two periods, printing a table (or JSON) and, if htmlPath is
+// set, writing an HTML report
+func CompareRoom(roomID, period1, period2, htmlPath string) error {
+	p1, err := ParsePeriod(period1)
+	if err != nil {
+		return err
+	}
+	p2, err := ParsePeriod(period2)
+	if err != nil {
+		return err
+	}
+
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	if roomID, err = resolveExportRoom(roomID); err != nil {
+		return err
+	}
+
+	// One query covers both periods, even if they overlap
+	start, end := p1.Start, p1.End
+	if p2.Start.Before(start) {
+		start = p2.Start
+	}
+	if p2.End.After(end) {
+		end = p2.End
+	}
+	messages, err := GetDatabase().GetMessages(context.Background(), &MessageFilter{RoomID: roomID, StartTime: &start, EndTime: &end}, 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %w", err)
+	}
+	persons, err := loadPersons(context.Background(), GetDatabase())
+	if err != nil {
+		return err
+	}
+	comparison := CompareRoomPeriods(roomID, persons.Senders(messages), p1, p2)
+
+	if htmlPath != "" {
+		if err := WriteComparisonReport(htmlPath, roomID, comparison); err != nil {
+			return err
+		}
+		fmt.Fprintf(progressWriter(), "Wrote comparison report to %q\n", htmlPath)
+	}
+	if jsonOutput() {
+		return writeJSON(comparison)
+	}
+
+	fmt.Printf("Room %s\n\n", roomID)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "METRIC\t%s\t%s\tCHANGE\n", p1.Label, p2.Label)
+	for _, row := range comparison.Rows() {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", row.Metric, row.Period1, row.Period2, row.Change)
+	}
+	return w.Flush()
+}
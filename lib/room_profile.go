@@ -0,0 +1,110 @@
+package archive
+
+import (
+	"context"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// RoomProfileFromState reads a room's name, topic, canonical alias and
+// creation time from its state events
+func RoomProfileFromState(roomID string, state []*event.Event) *RoomProfile {
+	profile := &RoomProfile{RoomID: roomID}
+	for _, evt := range state {
+		if evt.StateKey == nil || *evt.StateKey != "" {
+			continue
+		}
+		switch evt.Type.Type {
+		case event.StateRoomName.Type:
+			profile.Name, _ = evt.Content.Raw["name"].(string)
+		case event.StateTopic.Type:
+			profile.Topic, _ = evt.Content.Raw["topic"].(string)
+		case event.StateCanonicalAlias.Type:
+			profile.CanonicalAlias, _ = evt.Content.Raw["alias"].(string)
+		case event.StateCreate.Type:
+			if evt.Timestamp > 0 {
+				createdAt := time.UnixMilli(evt.Timestamp).UTC()
+				profile.CreatedAt = &createdAt
+			}
+		}
+	}
+	return profile
+}
+
+// archiveRoomProfile records the room's current name, topic, canonical
+// alias and creation time, so exports can show them without asking the
+// homeserver
+func (e *EnhancedMatrixClient) archiveRoomProfile(ctx context.Context, roomID id.RoomID) error {
+	state, err := e.StateAsArray(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	return e.db.SaveRoomProfile(ctx, RoomProfileFromState(roomID.String(), state))
+}
+
+// loadRoomProfile reads the room's recorded profile for the export header
+func loadRoomProfile(ctx context.Context, roomID string, opts *ExportOptions) error {
+	profile, err := GetDatabase().GetRoomProfile(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	opts.profile = profile
+	return nil
+}
+
+// roomDisplayName returns the name in the room's recorded profile, falling
+// back to asking the homeserver, through client if it isn't nil, for rooms
+// archived before names were recorded, and then to the room ID
+func roomDisplayName(profile *RoomProfile, client *mautrix.Client, roomID string) string {
+	if profile != nil && profile.Name != "" {
+		return profile.Name
+	}
+	if client != nil {
+		if name, err := GetRoomDisplayName(client, roomID); err == nil {
+			return name
+		}
+	}
+	return roomID
+}
+
+// ExportRoom is the room in the header of JSON and YAML exports: what its
+// state said when it was last imported, and how the archiving user
+// organised it in their client
+type ExportRoom struct {
+	RoomID         string   `json:"room_id" yaml:"room_id"`
+	Name           string   `json:"name,omitempty" yaml:"name,omitempty"`
+	Topic          string   `json:"topic,omitempty" yaml:"topic,omitempty"`
+	CanonicalAlias string   `json:"canonical_alias,omitempty" yaml:"canonical_alias,omitempty"`
+	CreatedAt      string   `json:"created_at,omitempty" yaml:"created_at,omitempty"` // RFC 3339
+	Tags           []string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Direct         bool     `json:"direct,omitempty" yaml:"direct,omitempty"`
+	DirectWith     []string `json:"direct_with,omitempty" yaml:"direct_with,omitempty"`
+}
+
+// newExportRoom combines a room's profile and organization, either of which
+// may be nil, or returns nil if both are
+func newExportRoom(profile *RoomProfile, organization *RoomOrganization) *ExportRoom {
+	if profile == nil && organization == nil {
+		return nil
+	}
+	room := &ExportRoom{}
+	if profile != nil {
+		room.RoomID = profile.RoomID
+		room.Name = profile.Name
+		room.Topic = profile.Topic
+		room.CanonicalAlias = profile.CanonicalAlias
+		if profile.CreatedAt != nil {
+			room.CreatedAt = profile.CreatedAt.UTC().Format(time.RFC3339)
+		}
+	}
+	if organization != nil {
+		room.RoomID = organization.RoomID
+		room.Tags = organization.Tags
+		room.Direct = organization.Direct
+		room.DirectWith = organization.DirectWith
+	}
+	return room
+}
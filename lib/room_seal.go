@@ -0,0 +1,183 @@
+package archive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// SealHash returns a hash of a room's archived messages: their event IDs,
+// senders, types, timestamps and content, in chronological order. It is
+// computed from decrypted content, so encrypting the archive doesn't change it.
+func SealHash(messages []*Message) string {
+	sorted := append([]*Message(nil), messages...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if !sorted[i].Timestamp.Equal(sorted[j].Timestamp) {
+			return sorted[i].Timestamp.Before(sorted[j].Timestamp)
+		}
+		return sorted[i].EventID < sorted[j].EventID
+	})
+
+	h := sha256.New()
+	for _, msg := range sorted {
+		// json.Marshal sorts map keys, so equal content always serializes the same way
+		content, _ := json.Marshal(msg.Content)
+		fmt.Fprintf(h, "%s\x00%s\x00%s\x00%d\x00", msg.EventID, msg.Sender, msg.MessageType, msg.Timestamp.UnixMilli())
+		h.Write(content)
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// BuildRoomSeal returns the seal of a room holding messages
+func BuildRoomSeal(roomID string, messages []*Message) (*RoomSeal, error) {
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("room %s has no archived messages to seal", roomID)
+	}
+	seal := &RoomSeal{
+		RoomID:       roomID,
+		SealedAt:     time.Now().UTC(),
+		MessageCount: int64(len(messages)),
+		Hash:         SealHash(messages),
+	}
+	for _, msg := range messages {
+		if seal.FirstEventID == "" || msg.Timestamp.Before(seal.FirstTimestamp) {
+			seal.FirstEventID, seal.FirstTimestamp = msg.EventID, msg.Timestamp.UTC()
+		}
+		if seal.LastEventID == "" || !msg.Timestamp.Before(seal.LastTimestamp) {
+			seal.LastEventID, seal.LastTimestamp = msg.EventID, msg.Timestamp.UTC()
+		}
+	}
+	return seal, nil
+}
+
+// sealedRoomError explains that a room can't be imported because it is sealed
+func sealedRoomError(seal *RoomSeal) error {
+	return fmt.Errorf("room %s was sealed on %s; run seal --room-id %s --unseal to import it again",
+		seal.RoomID, seal.SealedAt.Format(time.RFC3339), seal.RoomID)
+}
+
+// SealRoom marks a room's archive as complete, recording the range and hash
+// of its messages. Imports of a sealed room are refused until it is unsealed.
+func SealRoom(roomID string) error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	ctx := context.Background()
+	db := GetDatabase()
+	if seal, err := db.GetRoomSeal(ctx, roomID); err != nil {
+		return err
+	} else if seal != nil {
+		return fmt.Errorf("room %s is already sealed, since %s", roomID, seal.SealedAt.Format(time.RFC3339))
+	}
+
+	messages, err := db.GetMessages(ctx, &MessageFilter{RoomID: roomID}, 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %w", err)
+	}
+	seal, err := BuildRoomSeal(roomID, messages)
+	if err != nil {
+		return err
+	}
+	if err := db.SealRoom(ctx, seal); err != nil {
+		return err
+	}
+	// A sealed room won't be imported again, so its resume position is moot
+	if err := db.ClearImportState(ctx, roomID); err != nil {
+		return err
+	}
+
+	if jsonOutput() {
+		return writeJSON(seal)
+	}
+	fmt.Printf("Sealed %s: %d messages from %s (%s) to %s (%s)\nHash: %s\n", roomID, seal.MessageCount,
+		seal.FirstEventID, seal.FirstTimestamp.Format(time.RFC3339), seal.LastEventID, seal.LastTimestamp.Format(time.RFC3339), seal.Hash)
+	return nil
+}
+
+// UnsealRoom removes a room's seal so it can be imported again
+func UnsealRoom(roomID string) error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	if err := GetDatabase().UnsealRoom(context.Background(), roomID); err != nil {
+		return err
+	}
+	fmt.Printf("Unsealed %s\n", roomID)
+	return nil
+}
+
+// VerifyRoomSeal checks that a sealed room still holds exactly the messages
+// it held when it was sealed
+func VerifyRoomSeal(roomID string) error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	ctx := context.Background()
+	seal, err := GetDatabase().GetRoomSeal(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	if seal == nil {
+		return fmt.Errorf("room is not sealed: %s", roomID)
+	}
+	messages, err := GetDatabase().GetMessages(ctx, &MessageFilter{RoomID: roomID}, 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %w", err)
+	}
+	if hash := SealHash(messages); hash != seal.Hash {
+		return fmt.Errorf("room %s has changed since it was sealed: it holds %d messages, %d when sealed, and its hash is %s, not %s",
+			roomID, len(messages), seal.MessageCount, hash, seal.Hash)
+	}
+	fmt.Printf("Room %s matches its seal: %d messages, hash %s\n", roomID, seal.MessageCount, seal.Hash)
+	return nil
+}
+
+// ListRoomSeals prints every sealed room
+func ListRoomSeals() error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	seals, err := GetDatabase().GetRoomSeals(context.Background(), "")
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput() {
+		if seals == nil {
+			seals = []*RoomSeal{}
+		}
+		return writeJSON(seals)
+	}
+
+	if len(seals) == 0 {
+		fmt.Println("No rooms are sealed")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Room ID\tSealed\tMessages\tLast Message\tHash")
+	fmt.Fprintln(w, "-------\t------\t--------\t------------\t----")
+	for _, s := range seals {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", s.RoomID, s.SealedAt.Format(time.RFC3339), s.MessageCount, s.LastTimestamp.Format(time.RFC3339), s.Hash[:16])
+	}
+	return w.Flush()
+}
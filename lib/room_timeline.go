@@ -0,0 +1,387 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Timeline chart formats
+const (
+	TimelineSVG  = "svg"
+	TimelineHTML = "html"
+)
+
+// DefaultTimelineSenders is how many of the most active senders a stacked
+// timeline shows separately; everyone else is stacked together
+const DefaultTimelineSenders = 8
+
+// timelinePalette colors the stacked senders, most active first. Everyone
+// else is drawn in timelineOthersColor.
+var timelinePalette = []string{
+	"#4e79a7", "#f28e2b", "#e15759", "#76b7b2", "#59a14f",
+	"#edc948", "#b07aa1", "#ff9da7", "#9c755f", "#86bcb6",
+}
+
+const (
+	timelineColor       = "#4e79a7"
+	timelineOthersColor = "#bab0ac"
+)
+
+// TimelineDay is the number of messages posted in a room on one UTC day
+type TimelineDay struct {
+	Day      time.Time `json:"day"`
+	Messages int64     `json:"messages"`
+	BySender []int64   `json:"by_sender,omitempty"` // Counts for the timeline's Senders, in order, then for everyone else
+}
+
+// RoomTimeline is a room's message volume per day, from its first archived
+// day to its last. Days without messages are included with a count of 0.
+type RoomTimeline struct {
+	RoomID  string        `json:"room_id"`
+	Senders []string      `json:"senders,omitempty"` // Senders stacked separately, most active first
+	Days    []TimelineDay `json:"days"`
+}
+
+// BuildRoomTimeline buckets a room's daily statistics into days. Reactions
+// aren't counted. If stackSenders is positive, each day's count is also
+// split between the stackSenders most active senders and everyone else;
+// senders in exclude are never named and are counted with everyone else.
+func BuildRoomTimeline(roomID string, stats []*DailyStats, stackSenders int, exclude map[string]bool) *RoomTimeline {
+	timeline := &RoomTimeline{RoomID: roomID, Days: []TimelineDay{}}
+
+	totals := make(map[string]int64)
+	byDay := make(map[time.Time]map[string]int64)
+	var first, last time.Time
+	for _, s := range stats {
+		if s.MessageType == EventTypeReaction || s.MessageCount <= 0 {
+			continue
+		}
+		day := time.Date(s.Day.Year(), s.Day.Month(), s.Day.Day(), 0, 0, 0, 0, time.UTC)
+		if byDay[day] == nil {
+			byDay[day] = make(map[string]int64)
+		}
+		byDay[day][s.Sender] += s.MessageCount
+		if !exclude[s.Sender] {
+			totals[s.Sender] += s.MessageCount
+		}
+		if first.IsZero() || day.Before(first) {
+			first = day
+		}
+		if day.After(last) {
+			last = day
+		}
+	}
+	if first.IsZero() {
+		return timeline
+	}
+
+	if stackSenders > 0 {
+		for sender := range totals {
+			timeline.Senders = append(timeline.Senders, sender)
+		}
+		sort.Slice(timeline.Senders, func(i, j int) bool {
+			a, b := timeline.Senders[i], timeline.Senders[j]
+			if totals[a] != totals[b] {
+				return totals[a] > totals[b]
+			}
+			return a < b
+		})
+		if len(timeline.Senders) > stackSenders {
+			timeline.Senders = timeline.Senders[:stackSenders]
+		}
+	}
+	index := make(map[string]int, len(timeline.Senders))
+	for i, sender := range timeline.Senders {
+		index[sender] = i
+	}
+
+	for day := first; !day.After(last); day = day.AddDate(0, 0, 1) {
+		td := TimelineDay{Day: day}
+		if stackSenders > 0 {
+			td.BySender = make([]int64, len(timeline.Senders)+1)
+		}
+		for sender, count := range byDay[day] {
+			td.Messages += count
+			if td.BySender == nil {
+				continue
+			}
+			if i, ok := index[sender]; ok {
+				td.BySender[i] += count
+			} else {
+				td.BySender[len(timeline.Senders)] += count
+			}
+		}
+		timeline.Days = append(timeline.Days, td)
+	}
+	return timeline
+}
+
+// Stacked reports whether the timeline splits each day's count by sender
+func (t *RoomTimeline) Stacked() bool {
+	return len(t.Days) > 0 && t.Days[0].BySender != nil
+}
+
+// maxMessages returns the largest number of messages posted on one day
+func (t *RoomTimeline) maxMessages() int64 {
+	var most int64
+	for _, day := range t.Days {
+		if day.Messages > most {
+			most = day.Messages
+		}
+	}
+	return most
+}
+
+// timelineTickStep returns a round step (1, 2 or 5 times a power of ten)
+// that divides 0..most into at most five intervals
+func timelineTickStep(most int64) int64 {
+	step := int64(1)
+	for {
+		for _, m := range []int64{1, 2, 5} {
+			if most <= 5*m*step {
+				return m * step
+			}
+		}
+		step *= 10
+	}
+}
+
+// Chart geometry, in SVG user units
+const (
+	timelineWidth       = 960
+	timelinePlotHeight  = 260
+	timelineMarginLeft  = 56
+	timelineMarginRight = 16
+	timelineMarginTop   = 16
+	timelineAxisHeight  = 36
+	timelineLegendRow   = 18
+	timelineMaxXLabels  = 10
+)
+
+// WriteSVG draws the timeline as a bar chart with one bar per day, stacked
+// by sender if the timeline is. Each bar has a tooltip with its day and count.
+func (t *RoomTimeline) WriteSVG(w io.Writer) error {
+	series := 0
+	if t.Stacked() {
+		series = len(t.Senders) + 1
+	}
+	height := timelineMarginTop + timelinePlotHeight + timelineAxisHeight + series*timelineLegendRow
+	plotWidth := float64(timelineWidth - timelineMarginLeft - timelineMarginRight)
+	baseline := float64(timelineMarginTop + timelinePlotHeight)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="%d" height="%d" font-family="sans-serif" font-size="11" role="img">`+"\n",
+		timelineWidth, height, timelineWidth, height)
+	fmt.Fprintf(&b, "<title>Messages per day in %s</title>\n", template.HTMLEscapeString(t.RoomID))
+
+	most := t.maxMessages()
+	step := timelineTickStep(most)
+	top := step * ((most + step - 1) / step)
+	if top == 0 {
+		top = step
+	}
+	scale := timelinePlotHeight / float64(top)
+
+	// Horizontal grid lines with the counts they mark
+	for v := int64(0); v <= top; v += step {
+		y := baseline - float64(v)*scale
+		fmt.Fprintf(&b, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#ddd"/>`+"\n",
+			timelineMarginLeft, y, timelineWidth-timelineMarginRight, y)
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" text-anchor="end" dominant-baseline="middle" fill="#555">%d</text>`+"\n",
+			timelineMarginLeft-6, y, v)
+	}
+
+	if len(t.Days) > 0 {
+		barWidth := plotWidth / float64(len(t.Days))
+		gap := 0.0
+		if barWidth > 3 {
+			gap = 1
+		}
+		labelEvery := (len(t.Days) + timelineMaxXLabels - 1) / timelineMaxXLabels
+		for i, day := range t.Days {
+			x := float64(timelineMarginLeft) + float64(i)*barWidth
+			label := day.Day.Format("2006-01-02")
+			if day.Messages > 0 {
+				if t.Stacked() {
+					y := baseline
+					for s, count := range day.BySender {
+						if count == 0 {
+							continue
+						}
+						h := float64(count) * scale
+						y -= h
+						fmt.Fprintf(&b, `<rect x="%.2f" y="%.2f" width="%.2f" height="%.2f" fill="%s"><title>%s, %s: %d</title></rect>`+"\n",
+							x, y, barWidth-gap, h, t.seriesColor(s), label, template.HTMLEscapeString(t.seriesName(s)), count)
+					}
+				} else {
+					h := float64(day.Messages) * scale
+					fmt.Fprintf(&b, `<rect x="%.2f" y="%.2f" width="%.2f" height="%.2f" fill="%s"><title>%s: %d</title></rect>`+"\n",
+						x, baseline-h, barWidth-gap, h, timelineColor, label, day.Messages)
+				}
+			}
+			if i%labelEvery == 0 {
+				fmt.Fprintf(&b, `<text x="%.2f" y="%.1f" text-anchor="middle" fill="#555">%s</text>`+"\n",
+					x+barWidth/2, baseline+16, label)
+			}
+		}
+	}
+	fmt.Fprintf(&b, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#888"/>`+"\n",
+		timelineMarginLeft, baseline, timelineWidth-timelineMarginRight, baseline)
+
+	// Legend, one row per sender
+	for s := 0; s < series; s++ {
+		y := int(baseline) + timelineAxisHeight + s*timelineLegendRow
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="12" height="12" fill="%s"/>`+"\n", timelineMarginLeft, y, t.seriesColor(s))
+		fmt.Fprintf(&b, `<text x="%d" y="%d" dominant-baseline="middle">%s</text>`+"\n",
+			timelineMarginLeft+18, y+6, template.HTMLEscapeString(t.seriesName(s)))
+	}
+	b.WriteString("</svg>\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// seriesName returns the legend label of a stacked series
+func (t *RoomTimeline) seriesName(s int) string {
+	if s < len(t.Senders) {
+		return t.Senders[s]
+	}
+	return "Everyone else"
+}
+
+// seriesColor returns the color of a stacked series
+func (t *RoomTimeline) seriesColor(s int) string {
+	if s < len(t.Senders) {
+		return timelinePalette[s%len(timelinePalette)]
+	}
+	return timelineOthersColor
+}
+
+// timelinePageTemplate is the standalone page written for HTML timelines
+var timelinePageTemplate = template.Must(template.New("timeline").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Name}}: messages per day</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2rem; color: #222; }
+svg { max-width: 100%; height: auto; }
+</style>
+</head>
+<body>
+<main>
+<h1>{{.Name}}</h1>
+<p>{{.Total}} messages over {{.Days}} days{{if .First}}, {{.First}} to {{.Last}} (UTC){{end}}. The busiest day had {{.Busiest}} messages.</p>
+{{.Chart}}
+</main>
+</body>
+</html>
+`))
+
+// WriteHTML writes the timeline as a standalone page with the chart inline
+func (t *RoomTimeline) WriteHTML(w io.Writer, name string) error {
+	var chart strings.Builder
+	if err := t.WriteSVG(&chart); err != nil {
+		return err
+	}
+	var total int64
+	for _, day := range t.Days {
+		total += day.Messages
+	}
+	data := struct {
+		Name        string
+		Total       int64
+		Days        int
+		First, Last string
+		Busiest     int64
+		Chart       template.HTML
+	}{Name: name, Total: total, Days: len(t.Days), Busiest: t.maxMessages(), Chart: template.HTML(chart.String())}
+	if len(t.Days) > 0 {
+		data.First = t.Days[0].Day.Format("2006-01-02")
+		data.Last = t.Days[len(t.Days)-1].Day.Format("2006-01-02")
+	}
+	return timelinePageTemplate.Execute(w, data)
+}
+
+// timelineFormat returns the chart format to write filename in: format if
+// it is set, otherwise the one its extension names
+func timelineFormat(filename, format string) (string, error) {
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(filename)) {
+		case ".svg":
+			format = TimelineSVG
+		case ".html", ".htm":
+			format = TimelineHTML
+		default:
+			return "", fmt.Errorf("cannot tell the chart format of %q, use --format svg or --format html", filename)
+		}
+	}
+	if format != TimelineSVG && format != TimelineHTML {
+		return "", fmt.Errorf("unsupported timeline format %q, supported formats: [svg html]", format)
+	}
+	return format, nil
+}
+
+// ExportRoomTimeline writes a chart of a room's messages per day to
+// filename, as SVG or as an HTML page, with each day's bar split between the
+// stackSenders most active senders if stackSenders is positive. The counts
+// come from the daily statistics, so large rooms are charted without reading
+// their messages. People who opted out of archiving are never named.
+func ExportRoomTimeline(roomID, filename, format string, stackSenders int) error {
+	format, err := timelineFormat(filename, format)
+	if err != nil {
+		return err
+	}
+
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	ctx := context.Background()
+	if roomID, err = resolveExportRoom(roomID); err != nil {
+		return err
+	}
+	stats, err := GetDatabase().GetDailyStats(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("failed to load room statistics: %w", err)
+	}
+	optedOut, err := optedOutUsers(ctx, GetDatabase())
+	if err != nil {
+		return err
+	}
+	persons, err := loadPersons(ctx, GetDatabase())
+	if err != nil {
+		return err
+	}
+	timeline := BuildRoomTimeline(roomID, persons.Stats(stats), stackSenders, persons.Exclude(optedOut))
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer file.Close()
+	if format == TimelineHTML {
+		err = timeline.WriteHTML(file, roomID)
+	} else {
+		err = timeline.WriteSVG(file)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(progressWriter(), "Wrote a timeline of %d days to %q\n", len(timeline.Days), filename)
+	if jsonOutput() {
+		return writeJSON(timeline)
+	}
+	return nil
+}
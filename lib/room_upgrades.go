@@ -0,0 +1,144 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// archiveRoomVersion records a room's version, the room it replaced (from its
+// m.room.create event) and the room that replaced it (from its current
+// m.room.tombstone, if any)
+func (e *EnhancedMatrixClient) archiveRoomVersion(ctx context.Context, roomID id.RoomID) (*RoomVersion, error) {
+	var create event.CreateEventContent
+	if err := e.StateEvent(ctx, roomID, event.StateCreate, "", &create); err != nil {
+		return nil, err
+	}
+	version := &RoomVersion{RoomID: roomID.String(), RoomVersion: string(create.RoomVersion)}
+	if create.Predecessor != nil {
+		version.PredecessorID = create.Predecessor.RoomID.String()
+	}
+
+	var tombstone event.TombstoneEventContent
+	err := e.StateEvent(ctx, roomID, event.StateTombstone, "", &tombstone)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return nil, err
+	}
+	version.SuccessorID = tombstone.ReplacementRoom.String()
+
+	if err := e.db.SaveRoomVersion(ctx, version); err != nil {
+		return nil, err
+	}
+
+	// The predecessor may not be readable, for instance if the user never
+	// joined it; recording its successor still links it into the chain
+	if version.PredecessorID != "" {
+		predecessor := &RoomVersion{RoomID: version.PredecessorID, SuccessorID: version.RoomID}
+		if err := e.db.SaveRoomVersion(ctx, predecessor); err != nil {
+			return nil, err
+		}
+	}
+	return version, nil
+}
+
+// convertTombstoneEvent returns the upgrade recorded by an m.room.tombstone
+// event in a room's timeline, or nil if the event doesn't name a replacement
+func convertTombstoneEvent(evt *event.Event, roomID string) *RoomVersion {
+	if err := evt.Content.ParseRaw(evt.Type); err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+		log.Printf("Failed to parse tombstone event %s: %v", evt.ID, err)
+		return nil
+	}
+	replacement := evt.Content.AsTombstone().ReplacementRoom
+	if replacement == "" {
+		return nil
+	}
+	upgradedAt := time.UnixMilli(evt.Timestamp)
+	return &RoomVersion{RoomID: roomID, SuccessorID: replacement.String(), UpgradedAt: &upgradedAt}
+}
+
+// GetRoomChain returns the rooms linked to roomID by upgrades, oldest first.
+// A room that was never upgraded is a chain of one.
+func GetRoomChain(ctx context.Context, db DatabaseInterface, roomID string) ([]*RoomVersion, error) {
+	lookup := func(roomID string) (*RoomVersion, error) {
+		version, err := db.GetRoomVersion(ctx, roomID)
+		if version == nil && err == nil {
+			version = &RoomVersion{RoomID: roomID}
+		}
+		return version, err
+	}
+
+	current, err := lookup(roomID)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{roomID: true}
+
+	// Walk back to the oldest room, guarding against a malformed cycle
+	var predecessors []*RoomVersion
+	for room := current; room.PredecessorID != "" && !seen[room.PredecessorID]; {
+		seen[room.PredecessorID] = true
+		if room, err = lookup(room.PredecessorID); err != nil {
+			return nil, err
+		}
+		predecessors = append(predecessors, room)
+	}
+
+	chain := make([]*RoomVersion, 0, len(predecessors)+1)
+	for i := len(predecessors) - 1; i >= 0; i-- {
+		chain = append(chain, predecessors[i])
+	}
+	chain = append(chain, current)
+
+	for room := current; room.SuccessorID != "" && !seen[room.SuccessorID]; {
+		seen[room.SuccessorID] = true
+		if room, err = lookup(room.SuccessorID); err != nil {
+			return nil, err
+		}
+		chain = append(chain, room)
+	}
+	return chain, nil
+}
+
+// getRoomChainMessages returns the messages of every room in roomID's upgrade
+// chain, oldest room first, as one logical room's history
+func getRoomChainMessages(ctx context.Context, db DatabaseInterface, roomID string) ([]*Message, []*RoomVersion, error) {
+	chain, err := GetRoomChain(ctx, db, roomID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var messages []*Message
+	for _, room := range chain {
+		roomMessages, err := db.GetMessages(ctx, &MessageFilter{RoomID: room.RoomID}, 0, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		messages = append(messages, roomMessages...)
+	}
+	return messages, chain, nil
+}
+
+// MarkRoomUpgrades sets RoomUpgrade on the first exported message from each
+// room after the first in an upgrade chain. roomOf maps event IDs to rooms.
+func MarkRoomUpgrades(messages []ExportMessage, roomOf map[string]string, chain []*RoomVersion) {
+	versions := make(map[string]string, len(chain))
+	for _, room := range chain {
+		versions[room.RoomID] = room.RoomVersion
+	}
+
+	previous := ""
+	for i := range messages {
+		roomID, ok := roomOf[messages[i].EventID]
+		if !ok || roomID == previous {
+			continue
+		}
+		if previous != "" {
+			messages[i].RoomUpgrade = &RoomUpgradeInfo{RoomID: roomID, RoomVersion: versions[roomID], PreviousRoomID: previous}
+		}
+		previous = roomID
+	}
+}
@@ -0,0 +1,155 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Where a search match was found
+const (
+	SearchSourceMessage = "message"
+	SearchSourceImage   = "image"
+)
+
+// SearchResult is an archived message matching a search query, either by its
+// body or by the OCR text of its image
+type SearchResult struct {
+	EventID   string    `json:"event_id"`
+	RoomID    string    `json:"room_id"`
+	Sender    string    `json:"sender"`
+	Timestamp time.Time `json:"timestamp"`
+	Source    string    `json:"source"`
+	Text      string    `json:"text"`
+}
+
+// MatchMessages returns the messages whose body contains query, ignoring
+// case and Unicode compatibility forms (see SearchNormalization)
+func MatchMessages(messages []*Message, query string) []SearchResult {
+	return SearchNormalization{}.MatchMessages(messages, query)
+}
+
+// MatchMessages returns the messages whose body contains query once both
+// are normalized
+func (n SearchNormalization) MatchMessages(messages []*Message, query string) []SearchResult {
+	needle := n.Normalize(query)
+	var results []SearchResult
+	for _, msg := range messages {
+		body, _ := msg.Content["body"].(string)
+		if body == "" || !strings.Contains(n.Normalize(body), needle) {
+			continue
+		}
+		results = append(results, SearchResult{
+			EventID:   msg.EventID,
+			RoomID:    msg.RoomID,
+			Sender:    msg.Sender,
+			Timestamp: msg.Timestamp,
+			Source:    SearchSourceMessage,
+			Text:      body,
+		})
+	}
+	return results
+}
+
+// SearchMessages finds archived messages whose body or image text contains
+// query, normalized as the archive's search settings say, oldest first.
+// roomID limits the search to one room, and lang to messages in that
+// language (see DetectLanguage).
+func SearchMessages(ctx context.Context, query, roomID, lang string) ([]SearchResult, error) {
+	normalization, err := GetDatabase().GetSearchNormalization(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var filter *MessageFilter
+	if roomID != "" {
+		filter = &MessageFilter{RoomID: roomID}
+	}
+
+	// Bodies are matched after loading so encrypted content is searchable too
+	messages, err := GetDatabase().GetMessages(ctx, filter, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %w", err)
+	}
+	matched := messages
+	if lang = strings.ToLower(lang); lang != "" {
+		matched = FilterMessagesByLanguage(messages, lang)
+	}
+	results := normalization.MatchMessages(matched, query)
+
+	// Image text is matched after loading too, so that it is normalized the
+	// same way; an empty query matches all of it. Its language is told from
+	// the text itself.
+	mediaTexts, err := GetDatabase().SearchMediaText(ctx, "", roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	byEvent := make(map[string]*Message, len(messages))
+	for _, msg := range messages {
+		byEvent[msg.EventID] = msg
+	}
+	for _, m := range mediaTexts {
+		if !normalization.Contains(m.Text, query) || lang != "" && DetectLanguage(m.Text) != lang {
+			continue
+		}
+		result := SearchResult{EventID: m.EventID, RoomID: m.RoomID, Source: SearchSourceImage, Text: m.Text}
+		if msg, ok := byEvent[m.EventID]; ok {
+			result.Sender = msg.Sender
+			result.Timestamp = msg.Timestamp
+		}
+		results = append(results, result)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Timestamp.Before(results[j].Timestamp)
+	})
+	return results, nil
+}
+
+// SearchArchive prints the archived messages matching query
+func SearchArchive(query, roomID, lang string) error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	results, err := SearchMessages(context.Background(), query, roomID, lang)
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput() {
+		if results == nil {
+			results = []SearchResult{}
+		}
+		return writeJSON(results)
+	}
+
+	if len(results) == 0 {
+		fmt.Println("No matches found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Time\tSender\tSource\tEvent ID\tText")
+	fmt.Fprintln(w, "----\t------\t------\t--------\t----")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.Timestamp.Format(time.RFC3339), r.Sender, r.Source, r.EventID, searchSnippet(r.Text))
+	}
+	return w.Flush()
+}
+
+// searchSnippet flattens text onto one line and shortens it for the results table
+func searchSnippet(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if runes := []rune(text); len(runes) > 80 {
+		return string(runes[:77]) + "..."
+	}
+	return text
+}
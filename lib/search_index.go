@@ -0,0 +1,189 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SearchIndexVersion is the version of the search index format
+const SearchIndexVersion = 1
+
+// searchIndexFile is the name of the search index in an HTML export's _files directory
+const searchIndexFile = "search.js"
+
+// searchIndexFields names the columns of each search index document
+var searchIndexFields = []string{"text", "sender", "date", "url", "section"}
+
+// SearchIndex is the compact index an HTML export's search box searches in
+// the browser. Each document is a row of Fields: the message text, its
+// sender's name, its date (YYYY-MM-DD), the URL of the message, and the lazy
+// section it is rendered in, if it isn't in the page. Normalization is the
+// archive's search normalization, which the search box applies to the
+// documents and the query; without it they are put in NFKC form and
+// lowercased.
+type SearchIndex struct {
+	Version       int                       `json:"version"`
+	Fields        []string                  `json:"fields"`
+	Docs          [][]string                `json:"docs"`
+	Normalization *searchIndexNormalization `json:"normalization,omitempty"`
+}
+
+// MessageAnchor returns the id of a message's element in HTML exports, which
+// search results and other pages link to
+func MessageAnchor(eventID string) string {
+	return "msg-" + strings.TrimPrefix(eventID, "$")
+}
+
+// exportFilesDir returns the directory next to an HTML export for the files
+// it loads, named after the page with a _files suffix
+func exportFilesDir(filename string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + "_files"
+}
+
+// BuildSearchIndex indexes the text of messages rendered on a page at
+// pagePath ("" for links within the page). sections are the page's lazy
+// sections, if it has them, so search results can load the right one.
+// Messages without text, such as images without a caption, are left out.
+// The open archive's search normalization goes with the index.
+func BuildSearchIndex(messages []ExportMessage, pagePath string, sections []LazySection) *SearchIndex {
+	index := &SearchIndex{Version: SearchIndexVersion, Fields: searchIndexFields, Docs: [][]string{}}
+	index.Normalization = archiveSearchNormalization(context.Background()).forIndex()
+	sectionOf := make([]string, len(messages))
+	start := 0
+	for i, section := range sections {
+		for j := start; j < start+section.Count && j < len(messages); j++ {
+			if i > 0 {
+				sectionOf[j] = section.ID
+			}
+		}
+		start += section.Count
+	}
+	for i, msg := range messages {
+		body, _ := msg.Content["body"].(string)
+		text := strings.Join(strings.Fields(body), " ")
+		if text == "" || msg.EventID == "" {
+			continue
+		}
+		date := msg.Timestamp
+		if len(date) > len("2006-01-02") {
+			date = date[:len("2006-01-02")]
+		}
+		index.Docs = append(index.Docs, []string{text, msg.DisplayName, date, pagePath + "#" + MessageAnchor(msg.EventID), sectionOf[i]})
+	}
+	return index
+}
+
+// writeSearchIndex writes an index as a script calling archiveSearchIndex,
+// so that the export's search works when opened from disk, where pages
+// can't fetch JSON
+func writeSearchIndex(filename string, index *SearchIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("failed to encode search index: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(filename), err)
+	}
+	// JSON string escaping also escapes <, > and &, so the index can't close
+	// its script
+	script := "archiveSearchIndex(" + string(data) + ");\n"
+	if err := os.WriteFile(filename, []byte(script), 0644); err != nil {
+		return fmt.Errorf("failed to write search index: %w", err)
+	}
+	return nil
+}
+
+// searchScript runs an export's search box. The index is loaded when the box
+// is first used. Results in lazy sections load their section before
+// scrolling to the message, as do links from other pages to such messages.
+const searchScript = `(function () {
+  var input = document.getElementById("archive-search-input");
+  var results = document.getElementById("archive-search-results");
+  if (!input || !results) return;
+  var docs = null, loading = false, pending = null;
+  var norm = {};
+  function normalize(s) {
+    s = s.normalize("NFKC");
+    s = norm.language ? s.toLocaleLowerCase(norm.language) : s.toLowerCase();
+    if (!norm.fold_diacritics) return s;
+    return s.replace(/[\s\S]/gu, function (ch) {
+      if (norm.keep && norm.keep.indexOf(ch) >= 0) return ch;
+      return ch.normalize("NFD").replace(/\p{Mn}/gu, "").replace(/[\s\S]/gu, function (base) {
+        return (norm.fold && norm.fold[base]) || base;
+      });
+    });
+  }
+  window.archiveSearchIndex = function (index) {
+    var f = {};
+    index.fields.forEach(function (name, i) { f[name] = i; });
+    norm = index.normalization || {};
+    docs = index.docs.map(function (doc) {
+      return { text: doc[f.text], sender: doc[f.sender], date: doc[f.date], url: doc[f.url], section: doc[f.section] || "",
+        haystack: normalize(doc[f.text] + " " + doc[f.sender]) };
+    });
+    if (pending) pending();
+    search();
+  };
+  function load(then) {
+    if (then) pending = then;
+    if (docs || loading) { if (docs && then) then(); return; }
+    loading = true;
+    var script = document.createElement("script");
+    script.src = input.dataset.index;
+    document.body.appendChild(script);
+  }
+  function reveal(doc) {
+    var id = doc.url.slice(doc.url.indexOf("#") + 1);
+    var target = document.getElementById(id);
+    if (target) { target.scrollIntoView(); target.classList.add("search-target"); return; }
+    var section = doc.section && document.getElementById(doc.section);
+    if (!section) return;
+    new MutationObserver(function (changes, observer) {
+      if (document.getElementById(id)) { observer.disconnect(); reveal(doc); }
+    }).observe(section, { childList: true });
+    var button = section.querySelector("button");
+    if (button) button.click();
+  }
+  function search() {
+    results.innerHTML = "";
+    var terms = normalize(input.value).split(/\s+/).filter(Boolean);
+    if (!terms.length) return;
+    if (!docs) { load(); return; }
+    var matches = docs.filter(function (doc) {
+      return terms.every(function (term) { return doc.haystack.indexOf(term) >= 0; });
+    });
+    if (!matches.length) {
+      var none = document.createElement("li");
+      none.textContent = input.dataset.noResults;
+      results.appendChild(none);
+    }
+    matches.slice(0, 100).forEach(function (doc) {
+      var item = document.createElement("li");
+      var link = document.createElement("a");
+      link.href = doc.url;
+      link.textContent = doc.date + " " + doc.sender + ": " + (doc.text.length > 160 ? doc.text.slice(0, 160) + "…" : doc.text);
+      if (doc.url.charAt(0) === "#") {
+        link.addEventListener("click", function (event) {
+          event.preventDefault();
+          history.replaceState(null, "", doc.url);
+          reveal(doc);
+        });
+      }
+      item.appendChild(link);
+      results.appendChild(item);
+    });
+  }
+  input.addEventListener("focus", function () { load(); });
+  input.addEventListener("input", search);
+  window.addEventListener("DOMContentLoaded", function () {
+    var id = decodeURIComponent(location.hash.slice(1));
+    if (id.indexOf("msg-") !== 0 || document.getElementById(id)) return;
+    load(function () {
+      docs.forEach(function (doc) { if (doc.url.slice(doc.url.indexOf("#") + 1) === id) reveal(doc); });
+    });
+  });
+})();`
@@ -0,0 +1,216 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
+)
+
+// archive_settings keys of the search normalization
+const (
+	settingSearchLanguage       = "search_language"
+	settingSearchFoldDiacritics = "search_fold_diacritics"
+)
+
+// SearchNormalization is how message text and search queries are
+// normalized before they are compared, set per archive with "db
+// search-settings". Text is always put in Unicode NFKC form, so ligatures
+// and full-width letters match their plain forms, and lowercased.
+type SearchNormalization struct {
+	Language       string `json:"language,omitempty"`        // Language of the archive's messages, for its case rules and the letters folding keeps
+	FoldDiacritics bool   `json:"fold_diacritics,omitempty"` // Match letters with and without accents, so "uber" finds "Über"
+}
+
+// diacriticFolds are the letters folding replaces that don't decompose into
+// a base letter and accents
+var diacriticFolds = map[rune]string{
+	'æ': "ae", 'œ': "oe", 'ø': "o", 'ß': "ss", 'ł': "l", 'đ': "d", 'ð': "d", 'þ': "th", 'ı': "i",
+}
+
+// distinctLetters are the letters with accents that languages count as
+// letters of their own, which folding leaves alone so that searching a
+// Swedish archive for "har" doesn't find "hår"
+var distinctLetters = map[string]string{
+	"sv": "åäö",
+	"fi": "åäö",
+	"da": "æøå",
+	"nb": "æøå",
+	"nn": "æøå",
+	"no": "æøå",
+	"et": "äöõü",
+	"tr": "çğıöşü",
+	"es": "ñ",
+}
+
+// ParseSearchLanguage checks a language tag for SearchNormalization,
+// returning its language, e.g. "de" for de-AT; "" is no language
+func ParseSearchLanguage(tag string) (string, error) {
+	if tag == "" {
+		return "", nil
+	}
+	parsed, err := language.Parse(tag)
+	if err != nil {
+		return "", fmt.Errorf("invalid search language %q: %w", tag, err)
+	}
+	base, _ := parsed.Base()
+	return base.String(), nil
+}
+
+// keep returns the letters folding leaves alone
+func (n SearchNormalization) keep() string {
+	return distinctLetters[n.Language]
+}
+
+// Normalize returns s as searches compare it
+func (n SearchNormalization) Normalize(s string) string {
+	s = norm.NFKC.String(s)
+	if n.Language == "tr" || n.Language == "az" {
+		s = strings.ToLowerSpecial(unicode.TurkishCase, s)
+	} else {
+		s = strings.ToLower(s)
+	}
+	if !n.FoldDiacritics {
+		return s
+	}
+
+	keep := n.keep()
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(keep, r) {
+			b.WriteRune(r)
+			continue
+		}
+		for _, d := range norm.NFD.String(string(r)) {
+			if unicode.Is(unicode.Mn, d) {
+				continue
+			}
+			if fold, ok := diacriticFolds[d]; ok {
+				b.WriteString(fold)
+			} else {
+				b.WriteRune(d)
+			}
+		}
+	}
+	return b.String()
+}
+
+// Contains reports whether text contains query once both are normalized
+func (n SearchNormalization) Contains(text, query string) bool {
+	return strings.Contains(n.Normalize(text), n.Normalize(query))
+}
+
+// searchIndexNormalization is a search normalization as an HTML export's
+// search script applies it to the index and the query, with the letters to
+// keep and fold spelled out so the script needs no tables of its own
+type searchIndexNormalization struct {
+	Language       string            `json:"language,omitempty"`
+	FoldDiacritics bool              `json:"fold_diacritics,omitempty"`
+	Keep           string            `json:"keep,omitempty"`
+	Fold           map[string]string `json:"fold,omitempty"`
+}
+
+// forIndex returns the normalization for a search index, or nil for the
+// default, which the search script applies without being told
+func (n SearchNormalization) forIndex() *searchIndexNormalization {
+	if n == (SearchNormalization{}) {
+		return nil
+	}
+	index := &searchIndexNormalization{Language: n.Language, FoldDiacritics: n.FoldDiacritics}
+	if n.FoldDiacritics {
+		index.Keep = n.keep()
+		index.Fold = make(map[string]string, len(diacriticFolds))
+		for r, fold := range diacriticFolds {
+			if !strings.ContainsRune(index.Keep, r) {
+				index.Fold[string(r)] = fold
+			}
+		}
+	}
+	return index
+}
+
+// GetSearchNormalization returns the archive's search normalization
+func (d *DuckDBDatabase) GetSearchNormalization(ctx context.Context) (*SearchNormalization, error) {
+	lang, err := d.getSetting(ctx, settingSearchLanguage)
+	if err != nil {
+		return nil, err
+	}
+	fold, err := d.getSetting(ctx, settingSearchFoldDiacritics)
+	if err != nil {
+		return nil, err
+	}
+	n := &SearchNormalization{Language: lang}
+	n.FoldDiacritics, _ = strconv.ParseBool(fold)
+	return n, nil
+}
+
+// SaveSearchNormalization sets the archive's search normalization
+func (d *DuckDBDatabase) SaveSearchNormalization(ctx context.Context, n *SearchNormalization) error {
+	if err := d.setSetting(ctx, settingSearchLanguage, n.Language); err != nil {
+		return err
+	}
+	return d.setSetting(ctx, settingSearchFoldDiacritics, strconv.FormatBool(n.FoldDiacritics))
+}
+
+// archiveSearchNormalization returns the open archive's search
+// normalization, or the default if no archive is open
+func archiveSearchNormalization(ctx context.Context) SearchNormalization {
+	db := GetDatabase()
+	if db == nil {
+		return SearchNormalization{}
+	}
+	n, err := db.GetSearchNormalization(ctx)
+	if err != nil {
+		log.Printf("Warning: could not read the archive's search settings: %v", err)
+		return SearchNormalization{}
+	}
+	return *n
+}
+
+// ConfigureSearch changes the archive's search normalization: lang and
+// fold are the settings to change, or nil to keep them. It prints the
+// settings that apply afterwards.
+func ConfigureSearch(lang *string, fold *bool) error {
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	ctx := context.Background()
+	n, err := GetDatabase().GetSearchNormalization(ctx)
+	if err != nil {
+		return err
+	}
+	if lang != nil {
+		if n.Language, err = ParseSearchLanguage(*lang); err != nil {
+			return err
+		}
+	}
+	if fold != nil {
+		n.FoldDiacritics = *fold
+	}
+	if lang != nil || fold != nil {
+		if err := GetDatabase().SaveSearchNormalization(ctx, n); err != nil {
+			return err
+		}
+	}
+
+	if jsonOutput() {
+		return writeJSON(n)
+	}
+	language := n.Language
+	if language == "" {
+		language = "(none)"
+	}
+	fmt.Printf("Language:        %s\n", language)
+	fmt.Printf("Fold diacritics: %t\n", n.FoldDiacritics)
+	if keep := n.keep(); n.FoldDiacritics && keep != "" {
+		fmt.Printf("Letters kept:    %s\n", strings.Join(strings.Split(keep, ""), " "))
+	}
+	return nil
+}
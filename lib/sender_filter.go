@@ -0,0 +1,125 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Environment variables holding comma-separated sender patterns, used when
+// import and watch aren't given any
+const (
+	AllowSendersEnv = "MATRIX_ARCHIVE_ALLOW_SENDERS"
+	DenySendersEnv  = "MATRIX_ARCHIVE_DENY_SENDERS"
+)
+
+// RespectOptOutsEnv, set to true, makes imports skip the messages of everyone
+// in the opt-out registry, as with --respect-opt-outs
+const RespectOptOutsEnv = "MATRIX_ARCHIVE_RESPECT_OPT_OUTS"
+
+// SenderFilter decides whose messages are archived. Patterns match whole
+// user IDs, with * matching any run of characters, as in @*bot:example.org
+// or @telegram_*:beeper.local. A sender matching a Deny pattern is skipped;
+// otherwise, if there are Allow patterns, only senders matching one of them
+// are archived.
+type SenderFilter struct {
+	Allow []string
+	Deny  []string
+
+	// Also skip everyone in the opt-out registry; see DenyOptedOut
+	RespectOptOuts bool
+}
+
+// SenderFilterFromEnv reads the sender patterns in MATRIX_ARCHIVE_ALLOW_SENDERS
+// and MATRIX_ARCHIVE_DENY_SENDERS, and MATRIX_ARCHIVE_RESPECT_OPT_OUTS
+func SenderFilterFromEnv() SenderFilter {
+	respect, _ := strconv.ParseBool(os.Getenv(RespectOptOutsEnv))
+	return SenderFilter{Allow: splitPatterns(os.Getenv(AllowSendersEnv)), Deny: splitPatterns(os.Getenv(DenySendersEnv)), RespectOptOuts: respect}
+}
+
+// OrEnv returns the filter, with the patterns in the environment if it has
+// none. Opt-outs are respected if either the filter or the environment asks.
+func (f SenderFilter) OrEnv() SenderFilter {
+	env := SenderFilterFromEnv()
+	if f.IsEmpty() {
+		f.Allow, f.Deny = env.Allow, env.Deny
+	}
+	f.RespectOptOuts = f.RespectOptOuts || env.RespectOptOuts
+	return f
+}
+
+// DenyOptedOut adds everyone in the opt-out registry to the Deny patterns, if
+// the filter respects opt-outs
+func (f *SenderFilter) DenyOptedOut(ctx context.Context, db DatabaseInterface) error {
+	if !f.RespectOptOuts {
+		return nil
+	}
+	optOuts, err := db.GetOptOuts(ctx)
+	if err != nil {
+		return err
+	}
+	deny := append([]string{}, f.Deny...)
+	for _, o := range optOuts {
+		deny = append(deny, literalPattern(o.UserID))
+	}
+	f.Deny = deny
+	return nil
+}
+
+// literalPattern returns a pattern matching only s
+func literalPattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func splitPatterns(s string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(s, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// IsEmpty reports whether the filter has no sender patterns
+func (f SenderFilter) IsEmpty() bool {
+	return len(f.Allow) == 0 && len(f.Deny) == 0
+}
+
+// Validate checks that every pattern is well formed
+func (f SenderFilter) Validate() error {
+	for _, pattern := range append(append([]string{}, f.Allow...), f.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid sender pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Archives reports whether messages from sender are archived
+func (f SenderFilter) Archives(sender string) bool {
+	if matchesSender(f.Deny, sender) {
+		return false
+	}
+	return len(f.Allow) == 0 || matchesSender(f.Allow, sender)
+}
+
+func matchesSender(patterns []string, sender string) bool {
+	for _, pattern := range patterns {
+		// User IDs have no slashes, so path.Match's * matches any run of characters
+		if matched, _ := path.Match(pattern, sender); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,414 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SubjectAccessPackage is everything an archive holds about one user, as
+// gathered for a data subject access request (GDPR Article 15)
+type SubjectAccessPackage struct {
+	UserID      string
+	PersonID    string   // Person the user was merged into, if they were
+	UserIDs     []string // Every user ID of the person, when merged
+	GeneratedAt time.Time
+	Rooms       []SubjectAccessRoom
+	Reactions   []SubjectAccessReaction
+	Memberships []*MembershipEvent
+	Moderation  []*ModerationEvent
+	Media       []SubjectAccessMedia
+}
+
+// SubjectAccessRoom holds the user's messages in one room
+type SubjectAccessRoom struct {
+	RoomID   string
+	Messages []ExportMessage
+}
+
+// SubjectAccessReaction is a reaction the user made to a message
+type SubjectAccessReaction struct {
+	EventID   string    `json:"event_id"`
+	RoomID    string    `json:"room_id"`
+	ReactedTo string    `json:"reacted_to"`
+	Key       string    `json:"key"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// SubjectAccessMedia is a file the user posted. Path is the copy in the
+// package, relative to it; empty if the file was never downloaded.
+type SubjectAccessMedia struct {
+	EventID     string    `json:"event_id"`
+	RoomID      string    `json:"room_id"`
+	MXC         string    `json:"mxc"`
+	Filename    string    `json:"filename,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+	Path        string    `json:"path,omitempty"`
+
+	// SourcePath is the downloaded file copied into the package
+	SourcePath string `json:"-"`
+}
+
+// subjectAccessManifest is the content of manifest.json
+type subjectAccessManifest struct {
+	UserID        string                      `json:"user_id"`
+	PersonID      string                      `json:"person_id,omitempty"`
+	UserIDs       []string                    `json:"user_ids,omitempty"`
+	GeneratedAt   time.Time                   `json:"generated_at"`
+	FormatVersion int                         `json:"format_version"`
+	Rooms         []subjectAccessManifestRoom `json:"rooms"`
+	Totals        map[string]int              `json:"totals"`
+}
+
+type subjectAccessManifestRoom struct {
+	RoomID      string `json:"room_id"`
+	Path        string `json:"path,omitempty"`
+	Messages    int    `json:"messages"`
+	Reactions   int    `json:"reactions"`
+	Memberships int    `json:"memberships"`
+}
+
+// subjectAccessReadme documents the package for the person receiving it
+const subjectAccessReadme = `Data held about %s
+Generated %s by matrix-archive
+
+This package contains everything in the archive that was sent by or concerns
+this user. All files are UTF-8 JSON; times are in UTC (RFC 3339).
+
+manifest.json
+    The user, when the package was generated, and for each room how many
+    messages, reactions and membership events it holds.
+
+rooms/<room>/messages.json
+    The user's messages in each room, in the archive's export format
+    (format_version %d): sender, time, event ID and the full message content.
+
+reactions.json
+    Reactions the user made: the reaction, the message reacted to and when.
+
+memberships.json
+    The user's joins, leaves, invites and profile changes (display name and
+    avatar) in each room.
+
+moderation.json
+    Invites, kicks, bans and similar actions made by or against the user, with
+    the reason given.
+
+media.json, media/
+    Files the user posted. media.json lists each file with its Matrix content
+    URI (mxc://), name, type and size, whether or not it was downloaded; files
+    that were downloaded to the archive are copied into media/ and their
+    "path" names the copy.
+`
+
+// subjectAccessPersonReadme documents the user IDs of a merged person
+const subjectAccessPersonReadme = `
+The person %s appears under several user IDs, and this package
+covers all of them:
+    %s
+`
+
+// SubjectReactions returns the reactions among messages with the event they
+// react to and their key
+func SubjectReactions(messages []*Message) []SubjectAccessReaction {
+	reactions := []SubjectAccessReaction{}
+	for _, msg := range messages {
+		if msg.MessageType != EventTypeReaction {
+			continue
+		}
+		relatesTo, _ := msg.Content["m.relates_to"].(map[string]interface{})
+		reactedTo, _ := relatesTo["event_id"].(string)
+		key, _ := relatesTo["key"].(string)
+		reactions = append(reactions, SubjectAccessReaction{
+			EventID:   msg.EventID,
+			RoomID:    msg.RoomID,
+			ReactedTo: reactedTo,
+			Key:       key,
+			Timestamp: msg.Timestamp.UTC(),
+		})
+	}
+	return reactions
+}
+
+// subjectMedia lists the files among messages, with the downloaded copy from
+// the first of mediaDirs that has one
+func subjectMedia(messages []*Message, mediaDirs []string) []SubjectAccessMedia {
+	media := []SubjectAccessMedia{}
+	for _, msg := range messages {
+		mxc, _ := msg.Content["url"].(string)
+		if file, ok := msg.Content["file"].(map[string]interface{}); ok && mxc == "" {
+			mxc, _ = file["url"].(string)
+		}
+		if !strings.HasPrefix(mxc, "mxc://") {
+			continue
+		}
+
+		item := SubjectAccessMedia{
+			EventID:   msg.EventID,
+			RoomID:    msg.RoomID,
+			MXC:       mxc,
+			Timestamp: msg.Timestamp.UTC(),
+		}
+		if file := msg.File(); file != nil {
+			item.Filename, item.ContentType, item.Size = file.Name, file.MimeType, file.Size
+		} else {
+			item.Filename, _ = msg.Content["body"].(string)
+			if info, ok := msg.Content["info"].(map[string]interface{}); ok {
+				item.ContentType, _ = info["mimetype"].(string)
+			}
+		}
+	search:
+		for _, dir := range mediaDirs {
+			for _, thumbnails := range []bool{false, true} {
+				if stem := GetDownloadStem(*msg, thumbnails); stem != "" {
+					if found := findDownloadedImage(dir, stem); found != "" {
+						item.SourcePath = found
+						break search
+					}
+				}
+			}
+		}
+		media = append(media, item)
+	}
+	return media
+}
+
+// WriteSubjectAccessPackage writes pkg into dir as documented JSON files and
+// copies the user's downloaded media into dir/media
+func WriteSubjectAccessPackage(dir string, pkg *SubjectAccessPackage) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+
+	rooms := make(map[string]*subjectAccessManifestRoom)
+	roomEntry := func(roomID string) *subjectAccessManifestRoom {
+		if rooms[roomID] == nil {
+			rooms[roomID] = &subjectAccessManifestRoom{RoomID: roomID}
+		}
+		return rooms[roomID]
+	}
+
+	messageCount := 0
+	for _, room := range pkg.Rooms {
+		messages := room.Messages
+		if messages == nil {
+			messages = []ExportMessage{}
+		}
+		relPath := path.Join("rooms", staticAPIRoomPath(room.RoomID), "messages.json")
+		if err := writeJSONFile(filepath.Join(dir, filepath.FromSlash(relPath)), exportDocument{FormatVersion: ExportFormatVersion, Messages: messages}); err != nil {
+			return err
+		}
+		entry := roomEntry(room.RoomID)
+		entry.Path = relPath
+		entry.Messages = len(messages)
+		messageCount += len(messages)
+	}
+	for _, reaction := range pkg.Reactions {
+		roomEntry(reaction.RoomID).Reactions++
+	}
+	for _, membership := range pkg.Memberships {
+		roomEntry(membership.RoomID).Memberships++
+	}
+
+	// Copy downloaded media, naming each copy after its media ID
+	media := make([]SubjectAccessMedia, len(pkg.Media))
+	included := 0
+	for i, item := range pkg.Media {
+		if item.SourcePath != "" {
+			name := staticAPIRoomPath(path.Base(item.MXC)) + filepath.Ext(item.SourcePath)
+			if err := copyFile(item.SourcePath, filepath.Join(dir, "media", name)); err != nil {
+				return err
+			}
+			item.Path = path.Join("media", name)
+			included++
+		}
+		media[i] = item
+	}
+
+	reactions, memberships, moderation := pkg.Reactions, pkg.Memberships, pkg.Moderation
+	if reactions == nil {
+		reactions = []SubjectAccessReaction{}
+	}
+	if memberships == nil {
+		memberships = []*MembershipEvent{}
+	}
+	if moderation == nil {
+		moderation = []*ModerationEvent{}
+	}
+	for name, v := range map[string]interface{}{
+		"reactions.json":   reactions,
+		"memberships.json": memberships,
+		"moderation.json":  moderation,
+		"media.json":       media,
+	} {
+		if err := writeJSONFile(filepath.Join(dir, name), v); err != nil {
+			return err
+		}
+	}
+
+	manifest := subjectAccessManifest{
+		UserID:        pkg.UserID,
+		PersonID:      pkg.PersonID,
+		UserIDs:       pkg.UserIDs,
+		GeneratedAt:   pkg.GeneratedAt.UTC(),
+		FormatVersion: ExportFormatVersion,
+		Rooms:         []subjectAccessManifestRoom{},
+		Totals: map[string]int{
+			"messages":       messageCount,
+			"reactions":      len(reactions),
+			"memberships":    len(memberships),
+			"moderation":     len(moderation),
+			"media":          len(media),
+			"media_included": included,
+		},
+	}
+	for _, entry := range rooms {
+		manifest.Rooms = append(manifest.Rooms, *entry)
+	}
+	sort.Slice(manifest.Rooms, func(i, j int) bool { return manifest.Rooms[i].RoomID < manifest.Rooms[j].RoomID })
+	if err := writeJSONFile(filepath.Join(dir, "manifest.json"), manifest); err != nil {
+		return err
+	}
+
+	readme := fmt.Sprintf(subjectAccessReadme, pkg.UserID, manifest.GeneratedAt.Format(time.RFC3339), ExportFormatVersion)
+	if len(pkg.UserIDs) > 0 {
+		readme += fmt.Sprintf(subjectAccessPersonReadme, pkg.PersonID, strings.Join(pkg.UserIDs, "\n    "))
+	}
+	return os.WriteFile(filepath.Join(dir, "README.txt"), []byte(readme), 0644)
+}
+
+// copyFile copies src to dst, creating dst's directory
+func copyFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", dst, err)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", src, err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", dst, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	return out.Close()
+}
+
+// ExportSubjectAccess gathers a user's messages, reactions, membership and
+// moderation events across all archived rooms, and the media they posted
+// from mediaDirs, into a documented package in outputDir. For a user merged
+// into a person, or a person ID, the package covers all of the person's
+// user IDs.
+func ExportSubjectAccess(outputDir, userID string, mediaDirs []string) error {
+	if userID == "" {
+		return fmt.Errorf("no user given; name one with --user @alice:example.org")
+	}
+
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	ctx := context.Background()
+	db := GetDatabase()
+	pkg := &SubjectAccessPackage{UserID: userID, GeneratedAt: time.Now()}
+
+	persons, err := loadPersons(ctx, db)
+	if err != nil {
+		return err
+	}
+	userIDs := []string{userID}
+	if merged := persons.UserIDs(persons.Of(userID)); len(merged) > 0 {
+		pkg.PersonID, pkg.UserIDs, userIDs = persons.Of(userID), merged, merged
+	} else if !strings.HasPrefix(userID, "@") || !strings.Contains(userID, ":") {
+		return fmt.Errorf("%q is not a Matrix user ID (@user:server)", userID)
+	}
+	isSubject := make(map[string]bool, len(userIDs))
+	for _, u := range userIDs {
+		isSubject[u] = true
+	}
+
+	var sent []*Message
+	for _, u := range userIDs {
+		messages, err := db.GetMessages(ctx, &MessageFilter{Sender: u}, 0, 0)
+		if err != nil {
+			return fmt.Errorf("failed to query messages: %w", err)
+		}
+		sent = append(sent, messages...)
+	}
+	sort.SliceStable(sent, func(i, j int) bool { return sent[i].Timestamp.Before(sent[j].Timestamp) })
+	pkg.Reactions = SubjectReactions(sent)
+	pkg.Media = subjectMedia(sent, mediaDirs)
+
+	byRoom := make(map[string][]*Message)
+	for _, msg := range sent {
+		if msg.MessageType != EventTypeReaction {
+			byRoom[msg.RoomID] = append(byRoom[msg.RoomID], msg)
+		}
+	}
+
+	roomIDs, err := db.GetRooms(ctx)
+	if err != nil {
+		return err
+	}
+	for _, roomID := range roomIDs {
+		if messages := byRoom[roomID]; len(messages) > 0 {
+			exportMessages, err := convertToExportMessages(messages, roomID, downloadMediaLinks{})
+			if err != nil {
+				return fmt.Errorf("failed to convert messages: %w", err)
+			}
+			pkg.Rooms = append(pkg.Rooms, SubjectAccessRoom{RoomID: roomID, Messages: exportMessages})
+		}
+
+		memberships, err := db.GetMembershipEvents(ctx, roomID)
+		if err != nil {
+			return err
+		}
+		for _, membership := range memberships {
+			if isSubject[membership.UserID] {
+				pkg.Memberships = append(pkg.Memberships, membership)
+			}
+		}
+
+		moderation, err := db.GetModerationEvents(ctx, roomID)
+		if err != nil {
+			return err
+		}
+		for _, evt := range moderation {
+			if isSubject[evt.Actor] || isSubject[evt.Target] {
+				pkg.Moderation = append(pkg.Moderation, evt)
+			}
+		}
+	}
+
+	if len(sent) == 0 && len(pkg.Memberships) == 0 && len(pkg.Moderation) == 0 {
+		fmt.Printf("The archive holds nothing about %s\n", userID)
+	}
+	if err := WriteSubjectAccessPackage(outputDir, pkg); err != nil {
+		return err
+	}
+
+	included := 0
+	for _, item := range pkg.Media {
+		if item.SourcePath != "" {
+			included++
+		}
+	}
+	fmt.Printf("Wrote %d messages in %d rooms, %d reactions, %d membership events and %d of %d media files for %s to %q\n",
+		len(sent)-len(pkg.Reactions), len(pkg.Rooms), len(pkg.Reactions), len(pkg.Memberships), included, len(pkg.Media), userID, outputDir)
+	return nil
+}
@@ -0,0 +1,302 @@
+package archive
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"text/template/parse"
+	"time"
+)
+
+// TemplateContext is what export templates render: "." at the top of a
+// template. The "messages" block of lazily loaded HTML exports is given
+// the messages of one section instead. Print the fields with "templates
+// schema".
+type TemplateContext struct {
+	Archive      TemplateArchive
+	Room         TemplateRoom
+	Messages     []ExportMessage
+	Stats        TemplateStats
+	Participants []Participant // Each sender's summary, with --participants; nil otherwise
+}
+
+// TemplateArchive describes the export being rendered
+type TemplateArchive struct {
+	Generator     string // Always "matrix-archive"
+	FormatVersion int    // ExportFormatVersion, the version of the message fields
+	ExportedAt    string // When the export was written, in RFC 3339 format
+	Lang          string // Language of the template strings
+	Theme         string // HTML color theme: light, dark or auto
+	HighContrast  bool   // --high-contrast was given
+	SearchIndex   string // Path of the search index from the page, with --search-index; empty otherwise
+}
+
+// TemplateRoom describes the exported room
+type TemplateRoom struct {
+	ID             string
+	Name           string        // The room's name when it was last imported; empty if it has none or wasn't recorded
+	Topic          string        // The room's topic when it was last imported
+	CanonicalAlias string        // The room's canonical alias, such as #room:example.org
+	CreatedAt      string        // When the room was created, in RFC 3339 format; empty if not recorded
+	Labels         []string      // The room's tags and direct chat status, translated
+	Tags           []string      // The room's tags, such as m.favourite or u.work
+	Direct         bool          // The room is a direct chat
+	DirectWith     []string      // Who a direct chat is with
+	Activity       *RoomActivity // Totals over the room's whole archive; nil without daily statistics
+}
+
+// TemplateStats counts the exported messages
+type TemplateStats struct {
+	Messages     int
+	Users        int    // Senders, by display name
+	Platforms    int    // Bridged platforms the senders are on
+	Reactions    int    // Distinct reactions to the messages
+	FirstMessage string // Timestamp of the first message; empty without messages
+	LastMessage  string // Timestamp of the last message
+}
+
+// newTemplateContext gathers what a template renders of an export
+func newTemplateContext(messages []ExportMessage, opts *ExportOptions, catalog *Catalog, theme string) *TemplateContext {
+	context := &TemplateContext{
+		Archive: TemplateArchive{
+			Generator:     "matrix-archive",
+			FormatVersion: ExportFormatVersion,
+			ExportedAt:    time.Now().UTC().Format(time.RFC3339),
+			Lang:          catalog.Lang,
+			Theme:         theme,
+			HighContrast:  opts.HighContrast,
+			SearchIndex:   opts.searchIndex,
+		},
+		Room:     TemplateRoom{ID: opts.RoomID, Activity: opts.activity},
+		Messages: messages,
+		Stats: TemplateStats{
+			Messages:  len(messages),
+			Users:     countUniqueUsers(messages),
+			Platforms: countPlatforms(messages),
+			Reactions: countReactions(messages),
+		},
+	}
+	for _, label := range opts.room.Labels() {
+		context.Room.Labels = append(context.Room.Labels, catalog.T(label))
+	}
+	if room := opts.room; room != nil {
+		if context.Room.ID == "" {
+			context.Room.ID = room.RoomID
+		}
+		context.Room.Tags = room.Tags
+		context.Room.Direct = room.Direct
+		context.Room.DirectWith = room.DirectWith
+	}
+	if room := newExportRoom(opts.profile, nil); room != nil {
+		context.Room.Name = room.Name
+		context.Room.Topic = room.Topic
+		context.Room.CanonicalAlias = room.CanonicalAlias
+		context.Room.CreatedAt = room.CreatedAt
+		if context.Room.ID == "" {
+			context.Room.ID = room.RoomID
+		}
+	}
+	if len(messages) > 0 {
+		context.Stats.FirstMessage = messages[0].Timestamp
+		context.Stats.LastMessage = messages[len(messages)-1].Timestamp
+	}
+	if opts.Participants {
+		context.Participants = ParticipantSummary(messages, opts.memberships)
+	}
+	return context
+}
+
+// countUniqueUsers counts the display names messages were sent under
+func countUniqueUsers(messages []ExportMessage) int {
+	users := make(map[string]bool)
+	for _, msg := range messages {
+		users[msg.DisplayName] = true
+	}
+	return len(users)
+}
+
+// countPlatforms counts the bridged platforms messages came from
+func countPlatforms(messages []ExportMessage) int {
+	platforms := make(map[string]bool)
+	for _, msg := range messages {
+		if msg.Platform != "" {
+			platforms[msg.Platform] = true
+		}
+	}
+	return len(platforms)
+}
+
+// countReactions counts the distinct reactions to messages
+func countReactions(messages []ExportMessage) int {
+	total := 0
+	for _, msg := range messages {
+		total += len(msg.Reactions)
+	}
+	return total
+}
+
+// messageListFuncs are the template functions that take a list of messages,
+// which templates written before TemplateContext pass "." to
+var messageListFuncs = map[string]bool{
+	"len": true, "countUniqueUsers": true, "countPlatforms": true, "countReactions": true, "countBridgeUsers": true, "hasAnnotations": true,
+}
+
+// rangesOverMessages reports whether a template was written for the
+// messages as ".", as templates were before TemplateContext: at its top
+// level, where "." is the data, it ranges over "." or passes it to a
+// function taking a list of messages. Neither works with a TemplateContext.
+func rangesOverMessages(tree *parse.Tree) bool {
+	if tree == nil || tree.Root == nil {
+		return false
+	}
+	return listUsesDotAsMessages(tree.Root)
+}
+
+// listUsesDotAsMessages looks through the nodes where "." is still the
+// template's data, which excludes the bodies of range and with
+func listUsesDotAsMessages(list *parse.ListNode) bool {
+	if list == nil {
+		return false
+	}
+	for _, node := range list.Nodes {
+		switch node := node.(type) {
+		case *parse.ActionNode:
+			if pipeUsesDotAsMessages(node.Pipe) {
+				return true
+			}
+		case *parse.IfNode:
+			if pipeUsesDotAsMessages(node.Pipe) || listUsesDotAsMessages(node.List) || listUsesDotAsMessages(node.ElseList) {
+				return true
+			}
+		case *parse.RangeNode:
+			if isDot(node.Pipe) || pipeUsesDotAsMessages(node.Pipe) || listUsesDotAsMessages(node.ElseList) {
+				return true
+			}
+		case *parse.WithNode:
+			if pipeUsesDotAsMessages(node.Pipe) || listUsesDotAsMessages(node.ElseList) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pipeUsesDotAsMessages reports whether a pipeline passes "." to a function
+// taking a list of messages
+func pipeUsesDotAsMessages(pipe *parse.PipeNode) bool {
+	if pipe == nil {
+		return false
+	}
+	for _, cmd := range pipe.Cmds {
+		if len(cmd.Args) < 2 {
+			continue
+		}
+		name, ok := cmd.Args[0].(*parse.IdentifierNode)
+		if !ok || !messageListFuncs[name.Ident] {
+			continue
+		}
+		for _, arg := range cmd.Args[1:] {
+			if _, dot := arg.(*parse.DotNode); dot {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isDot reports whether a pipeline is just "."
+func isDot(pipe *parse.PipeNode) bool {
+	if pipe == nil || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return false
+	}
+	_, dot := pipe.Cmds[0].Args[0].(*parse.DotNode)
+	return dot
+}
+
+// TemplateField is a field templates can use, as "templates schema" lists it
+type TemplateField struct {
+	Path string `json:"path"` // As written in a template, e.g. .Messages[].Sender for {{range .Messages}}{{.Sender}}{{end}}
+	Type string `json:"type"`
+}
+
+// TemplateSchema returns the fields of TemplateContext and everything they
+// hold, in declaration order
+func TemplateSchema() []TemplateField {
+	var fields []TemplateField
+	templateFields(reflect.TypeOf(TemplateContext{}), "", map[reflect.Type]bool{}, &fields)
+	return fields
+}
+
+// templateFields appends the exported fields of struct type t under prefix
+func templateFields(t reflect.Type, prefix string, seen map[reflect.Type]bool, fields *[]TemplateField) {
+	if seen[t] {
+		return
+	}
+	seen[t] = true
+	defer delete(seen, t)
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		path := prefix + "." + field.Name
+		*fields = append(*fields, TemplateField{Path: path, Type: templateTypeName(field.Type)})
+
+		inner := field.Type
+		for inner.Kind() == reflect.Pointer || inner.Kind() == reflect.Slice {
+			if inner.Kind() == reflect.Slice {
+				path += "[]"
+			}
+			inner = inner.Elem()
+		}
+		if inner.Kind() == reflect.Struct && inner != reflect.TypeOf(time.Time{}) {
+			templateFields(inner, path, seen, fields)
+		}
+	}
+}
+
+// templateTypeName names a type without its package
+func templateTypeName(t reflect.Type) string {
+	return strings.ReplaceAll(t.String(), "archive.", "")
+}
+
+// TemplateFunctions returns the names and signatures of the functions
+// export templates can call, sorted by name
+func TemplateFunctions() []TemplateField {
+	funcs := exportTemplateFuncs(&TemplateContext{}, DefaultExportOptions(), &Catalog{}, "", nil)
+	var result []TemplateField
+	for name, fn := range funcs {
+		result = append(result, TemplateField{Path: name, Type: templateTypeName(reflect.TypeOf(fn))})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	return result
+}
+
+// PrintTemplateSchema prints the fields and functions templates can use
+func PrintTemplateSchema() error {
+	fields, funcs := TemplateSchema(), TemplateFunctions()
+	if jsonOutput() {
+		return writeJSON(struct {
+			Fields    []TemplateField `json:"fields"`
+			Functions []TemplateField `json:"functions"`
+		}{fields, funcs})
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Field\tType")
+	fmt.Fprintln(w, "-----\t----")
+	for _, field := range fields {
+		fmt.Fprintf(w, "%s\t%s\n", field.Path, field.Type)
+	}
+	fmt.Fprintln(w, "\t")
+	fmt.Fprintln(w, "Function\tSignature")
+	fmt.Fprintln(w, "--------\t---------")
+	for _, fn := range funcs {
+		fmt.Fprintf(w, "%s\t%s\n", fn.Path, fn.Type)
+	}
+	return w.Flush()
+}
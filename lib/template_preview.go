@@ -0,0 +1,157 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// DefaultPreviewSample is how many messages templates preview renders
+const DefaultPreviewSample = 20
+
+// SelectRecent returns the last n messages that aren't reactions or edits,
+// with the reactions and edits made to them, in chronological order
+func SelectRecent(messages []ExportMessage, n int) []ExportMessage {
+	keep := make(map[string]bool, n)
+	for i := len(messages) - 1; i >= 0 && len(keep) < n; i-- {
+		msg := messages[i]
+		relatesTo, _ := msg.Content["m.relates_to"].(map[string]interface{})
+		relType, _ := relatesTo["rel_type"].(string)
+		if msg.MessageType == EventTypeReaction || relType == "m.annotation" || relType == "m.replace" {
+			continue
+		}
+		keep[msg.EventID] = true
+	}
+
+	// Reactions and edits relate to the messages they change
+	for _, msg := range messages {
+		relatesTo, _ := msg.Content["m.relates_to"].(map[string]interface{})
+		relType, _ := relatesTo["rel_type"].(string)
+		target, _ := relatesTo["event_id"].(string)
+		if (relType == "m.annotation" || relType == "m.replace") && keep[target] {
+			keep[msg.EventID] = true
+		}
+	}
+
+	selected := []ExportMessage{}
+	for _, msg := range messages {
+		if keep[msg.EventID] {
+			selected = append(selected, msg)
+		}
+	}
+	return selected
+}
+
+// templateOutputFormat returns the format a template renders, from the
+// extension before .tpl (as in my.html.tpl), or html if it has none
+func templateOutputFormat(templatePath string) string {
+	ext := strings.TrimPrefix(filepath.Ext(strings.TrimSuffix(filepath.Base(templatePath), ".tpl")), ".")
+	if ext == "" {
+		return "html"
+	}
+	return strings.ToLower(ext)
+}
+
+// PreviewTemplate renders a template against the last sample messages of a
+// room, with their reactions and edits, and returns the temporary file it
+// wrote. templateName is a template file or the name of a bundled template.
+// Unless opts chooses otherwise, media is embedded as data: URIs so the
+// preview shows downloaded images wherever the file is.
+func PreviewTemplate(templateName string, sample int, opts *ExportOptions) (string, error) {
+	if opts == nil {
+		opts = DefaultExportOptions()
+	}
+	if sample <= 0 {
+		return "", fmt.Errorf("sample size must be positive, got %d", sample)
+	}
+	templatePath := ResolveTemplatePath(templateName, "html")
+	if _, err := os.Stat(templatePath); err != nil {
+		return "", fmt.Errorf("template %s not found: %w", templatePath, err)
+	}
+	format := templateOutputFormat(templatePath)
+	if opts.MediaLinks == "" {
+		opts.MediaLinks = MediaLinksDataURI
+	}
+	mediaLinks, err := opts.mediaLinkResolver()
+	if err != nil {
+		return "", err
+	}
+
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return "", fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	ctx := context.Background()
+	roomID, err := resolveExportRoom(opts.RoomID)
+	if err != nil {
+		return "", err
+	}
+	messages, err := GetDatabase().GetMessages(ctx, &MessageFilter{RoomID: roomID}, 0, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to query messages: %w", err)
+	}
+	if messages, _, err = withholdOptedOut(ctx, messages); err != nil {
+		return "", err
+	}
+	exportMessages, err := convertToExportMessages(messages, roomID, mediaLinks)
+	if err != nil {
+		return "", fmt.Errorf("failed to convert messages: %w", err)
+	}
+
+	selected := SelectRecent(exportMessages, sample)
+	if len(selected) == 0 {
+		return "", fmt.Errorf("room %s has no archived messages to preview", roomID)
+	}
+	ResolveRelations(selected)
+	if opts.Permalinks {
+		AttachPermalinks(selected, roomID, opts.PermalinkBase)
+	}
+	if err := loadMemberships(ctx, roomID, opts); err != nil {
+		return "", err
+	}
+	if opts.HistoricalNames {
+		ApplyHistoricalNames(selected, opts.memberships)
+	}
+	if opts.room, err = GetRoomOrganization(ctx, GetDatabase(), roomID); err != nil {
+		return "", err
+	}
+	if err := loadRoomProfile(ctx, roomID, opts); err != nil {
+		return "", err
+	}
+	if err := loadRoomActivity(ctx, roomID, opts); err != nil {
+		return "", err
+	}
+
+	file, err := os.CreateTemp("", "matrix-archive-preview-*."+format)
+	if err != nil {
+		return "", fmt.Errorf("failed to create preview file: %w", err)
+	}
+	defer file.Close()
+	if err := ExportWithTemplateOptions(file, templatePath, selected, opts); err != nil {
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// OpenInBrowser opens a file with the system's default application for it
+func OpenInBrowser(path string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", path)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", path)
+	default:
+		cmd = exec.Command("xdg-open", path)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package archive
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AnalyzersEnv names an analyzer configuration used when word analytics
+// isn't given one
+const AnalyzersEnv = "MATRIX_ARCHIVE_ANALYZERS"
+
+// DefaultAnalyzerLanguage is the language of rooms no configuration names
+const DefaultAnalyzerLanguage = "en"
+
+// AnalyzerNone tokenizes without removing stopwords
+const AnalyzerNone = "none"
+
+// stopwordLists are the common words each language's analyzer leaves out
+var stopwordLists = map[string]string{
+	"en": `a about above after again against all am an and any are aren't as at be because been before being below
+		between both but by can can't cannot could couldn't did didn't do does doesn't doing don't down during each few for
+		from further get got had hadn't has hasn't have haven't having he he'd he'll he's her here here's hers herself him
+		himself his how how's i i'd i'll i'm i've if in into is isn't it it's its itself just let's like me more most
+		mustn't my myself no nor not now of off on once only or other ought our ours ourselves out over own same shan't
+		she she'd she'll she's should shouldn't so some such than that that's the their theirs them themselves then there
+		there's these they they'd they'll they're they've this those through to too under until up us very was wasn't we
+		we'd we'll we're we've were weren't what what's when when's where where's which while who who's whom why why's
+		will with won't would wouldn't yeah yes you you'd you'll you're you've your yours yourself yourselves`,
+	"de": `aber alle allem allen aller alles als also am an ander andere anderem anderen anderer anderes auch auf aus bei
+		bin bis bist da damit dann das dass dasselbe dazu dein deine deinem deinen deiner dem den denn der des dessen die
+		dies diese diesem diesen dieser dieses doch dort du durch ein eine einem einen einer eines einig einige er es
+		etwas euch euer eure für gegen gewesen hab habe haben hat hatte hatten hier hin hinter ich ihm ihn ihnen ihr ihre
+		ihrem ihren ihrer im in indem ins ist ja jede jedem jeden jeder jedes jene jenem jenen jener jenes jetzt kann kein
+		keine keinem keinen keiner man manche mein meine meinem meinen meiner mich mir mit muss musste nach nicht nichts
+		noch nun nur ob oder ohne schon sehr sein seine seinem seinen seiner selbst sich sie sind so solche soll sollte
+		sondern sonst um und uns unser unsere unter viel vom von vor war waren warst was weg weil weiter welche welchem
+		welchen welcher wenn werde werden wie wieder will wir wird wirst wo wollen wollte würde würden zu zum zur zwar
+		zwischen`,
+	"fr": `a ai aie aient aies ait alors as au aucun aura aurai auraient aurais aurait aux avaient avais avait avec avez
+		aviez avions avoir avons ayant bien c ce ceci cela celle celui ces cet cette ceux chaque comme d dans de des
+		donc du elle elles en encore es est et étaient étais était étant été êtes être eu eux fait il ils j je jusqu l
+		la le les leur leurs lui m ma mais me même mes moi mon n ne ni nos notre nous on ont ou où par pas peu peut
+		plus pour pourquoi qu quand que quel quelle quelles quels qui s sa sans se sera serait ses si son sont sous
+		suis sur t ta te tes toi ton tous tout toute toutes très tu un une vos votre vous y`,
+	"es": `a al algo algunas algunos ante antes como con contra cual cuando de del desde donde durante e el él ella
+		ellas ellos en entre era eran es esa esas ese eso esos esta está estaba estaban estamos están estar estas este
+		esto estos estoy fue fueron fui ha había habían han has hasta hay la las le les lo los más me mi mis mucho muy
+		nada ni no nos nosotros o os otra otras otro otros para pero poco por porque que qué quien se sea ser si sí
+		sido sin sobre son su sus también tan tanto te tengo ti tiene tienen todo todos tu tú tus un una uno unos vosotros
+		y ya yo`,
+}
+
+// frenchElision matches the elided articles and pronouns French attaches to
+// the next word, as in l'archive and qu'il
+var frenchElision = regexp.MustCompile(`^(?:l|d|j|m|n|s|t|c|qu|jusqu|lorsqu|puisqu)'`)
+
+// analyzerNoise matches what isn't prose: links and Matrix user, room and
+// event IDs
+var analyzerNoise = regexp.MustCompile(`(?i)\b(?:https?|mxc)://\S+|[@#!$+][^\s:]+:[A-Za-z0-9.\-]+(?::\d+)?`)
+
+// Analyzer splits message text into the words counted by word analytics:
+// lowercased, without links, Matrix IDs, numbers and the language's
+// stopwords. Chinese, Japanese and Korean text, which isn't written with
+// spaces between words, is split into overlapping pairs of characters.
+type Analyzer struct {
+	Language  string
+	stopwords map[string]bool
+}
+
+// AnalyzerLanguages returns the languages NewAnalyzer accepts
+func AnalyzerLanguages() []string {
+	languages := []string{AnalyzerNone}
+	for lang := range stopwordLists {
+		languages = append(languages, lang)
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// NewAnalyzer returns the analyzer for a language: en, de, fr, es, or none to
+// keep stopwords. extraStopwords are left out as well.
+func NewAnalyzer(language string, extraStopwords ...string) (*Analyzer, error) {
+	language = strings.ToLower(strings.TrimSpace(language))
+	list, ok := stopwordLists[language]
+	if !ok && language != AnalyzerNone {
+		return nil, fmt.Errorf("unsupported analyzer language %q, supported languages: %v", language, AnalyzerLanguages())
+	}
+	a := &Analyzer{Language: language, stopwords: make(map[string]bool)}
+	for _, word := range append(strings.Fields(list), extraStopwords...) {
+		a.stopwords[strings.ToLower(word)] = true
+	}
+	return a, nil
+}
+
+// isCJK reports whether r is written without spaces between words
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// isWordRune reports whether r can be part of a word
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsMark(r)
+}
+
+// Tokens returns the words of text, in order, with repeats
+func (a *Analyzer) Tokens(text string) []string {
+	text = analyzerNoise.ReplaceAllString(text, " ")
+	text = strings.ToLower(strings.ReplaceAll(text, "’", "'"))
+
+	var tokens []string
+	emit := func(word []rune) {
+		if len(word) == 0 {
+			return
+		}
+		if isCJK(word[0]) {
+			// Overlapping pairs of characters stand in for words
+			if len(word) == 1 {
+				tokens = append(tokens, string(word))
+			}
+			for i := 0; i+1 < len(word); i++ {
+				tokens = append(tokens, string(word[i:i+2]))
+			}
+			return
+		}
+		tokens = append(tokens, a.normalize(string(word))...)
+	}
+
+	runes := []rune(text)
+	var word []rune
+	for i, r := range runes {
+		switch {
+		case isWordRune(r) && len(word) > 0 && isCJK(r) != isCJK(word[0]):
+			emit(word)
+			word = []rune{r}
+		case isWordRune(r):
+			word = append(word, r)
+		case r == '\'' && len(word) > 0 && !isCJK(word[0]) && i+1 < len(runes) && isWordRune(runes[i+1]) && !isCJK(runes[i+1]):
+			// Apostrophes inside words, as in don't and l'archive
+			word = append(word, r)
+		default:
+			emit(word)
+			word = nil
+		}
+	}
+	emit(word)
+	return tokens
+}
+
+// normalize applies the language's rules to a word and returns what is left
+// of it to count: nothing for stopwords, numbers and single letters
+func (a *Analyzer) normalize(word string) []string {
+	if a.stopwords[word] {
+		return nil
+	}
+	switch a.Language {
+	case "en":
+		word = strings.TrimSuffix(word, "'s")
+	case "fr":
+		word = frenchElision.ReplaceAllString(word, "")
+	}
+	if a.stopwords[word] || len([]rune(word)) < 2 || strings.IndexFunc(word, unicode.IsLetter) < 0 {
+		return nil
+	}
+	return []string{word}
+}
+
+// AnalyzerConfig chooses the analyzer for each room's messages
+type AnalyzerConfig struct {
+	Language  string              `yaml:"language,omitempty"`  // Language of rooms no rule names; empty is English
+	Rooms     []RoomAnalyzer      `yaml:"rooms,omitempty"`     // Per-room languages; the first matching rule applies
+	Stopwords map[string][]string `yaml:"stopwords,omitempty"` // More stopwords for each language
+
+	analyzers map[string]*Analyzer
+}
+
+// RoomAnalyzer sets the language of the rooms matching Room
+type RoomAnalyzer struct {
+	Room     string `yaml:"room"`     // Room ID, or a pattern with * such as !*:example.de
+	Language string `yaml:"language"` // en, de, fr, es or none
+}
+
+// LoadAnalyzerConfig reads a YAML analyzer configuration, such as
+//
+//	language: en
+//	rooms:
+//	  - room: "!abc123:example.org"
+//	    language: de
+//	  - room: "!*:example.fr"
+//	    language: fr
+//	stopwords:
+//	  en: [lol, thanks]
+func LoadAnalyzerConfig(filename string) (*AnalyzerConfig, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read analyzer configuration: %w", err)
+	}
+	cfg := &AnalyzerConfig{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse analyzer configuration in %s: %w", filename, err)
+	}
+	if err := cfg.Compile(); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return cfg, nil
+}
+
+// LoadAnalyzerConfigOrEnv loads the configuration in filename, or in the file
+// named by MATRIX_ARCHIVE_ANALYZERS if filename is empty. Without either,
+// every room is analyzed as English.
+func LoadAnalyzerConfigOrEnv(filename string) (*AnalyzerConfig, error) {
+	if filename == "" {
+		filename = os.Getenv(AnalyzersEnv)
+	}
+	if filename == "" {
+		cfg := &AnalyzerConfig{}
+		return cfg, cfg.Compile()
+	}
+	return LoadAnalyzerConfig(filename)
+}
+
+// Compile checks the configuration's room patterns and builds the analyzer
+// of each language it uses
+func (cfg *AnalyzerConfig) Compile() error {
+	if cfg.Language == "" {
+		cfg.Language = DefaultAnalyzerLanguage
+	}
+	cfg.analyzers = make(map[string]*Analyzer)
+	languages := []string{cfg.Language}
+	for i, rule := range cfg.Rooms {
+		if _, err := path.Match(rule.Room, ""); err != nil || rule.Room == "" {
+			return fmt.Errorf("analyzer rule %d: invalid room pattern %q", i+1, rule.Room)
+		}
+		languages = append(languages, rule.Language)
+	}
+	for _, lang := range languages {
+		key := strings.ToLower(strings.TrimSpace(lang))
+		if cfg.analyzers[key] != nil {
+			continue
+		}
+		analyzer, err := NewAnalyzer(key, cfg.Stopwords[key]...)
+		if err != nil {
+			return err
+		}
+		cfg.analyzers[key] = analyzer
+	}
+	return nil
+}
+
+// AnalyzerFor returns the analyzer for a room's messages. The configuration
+// must have been compiled.
+func (cfg *AnalyzerConfig) AnalyzerFor(roomID string) *Analyzer {
+	lang := cfg.Language
+	for _, rule := range cfg.Rooms {
+		if matched, _ := path.Match(rule.Room, roomID); matched {
+			lang = rule.Language
+			break
+		}
+	}
+	return cfg.analyzers[strings.ToLower(strings.TrimSpace(lang))]
+}
@@ -0,0 +1,115 @@
+package archive
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rivo/uniseg"
+)
+
+// DefaultWrapWidth is the width text exports are wrapped to with --wrap
+const DefaultWrapWidth = 80
+
+// lineMarker matches the indentation and list or quote marker a line
+// starts with, which its continuation lines are indented past
+var lineMarker = regexp.MustCompile(`^[ \t]*(?:(?:[-*+•]|\d{1,3}[.)])[ \t]+|(?:>[ \t]?)+)?`)
+
+// WrapText wraps each line of text to width display columns. Lines break
+// where Unicode allows (between words, and between ideographs in CJK text),
+// wide characters such as CJK and emoji count as two columns, and combining
+// marks as none. Continuation lines are indented to line up with the text
+// after the line's indentation and list marker, and quoted lines keep their
+// "> " on every line. Words longer than the width, such as URLs, are left
+// whole. A width of 0 or less leaves text as it is.
+func WrapText(text string, width int) string {
+	return WrapTextHanging("", text, width)
+}
+
+// WrapTextHanging wraps text like WrapText, starting its first line with
+// prefix, such as a "Caption: " label, and indenting the continuation lines
+// of that first line to line up after it
+func WrapTextHanging(prefix, text string, width int) string {
+	if width <= 0 {
+		return prefix + text
+	}
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if i == 0 {
+			line = prefix + line
+		}
+		lines[i] = wrapLine(line, width, continuationIndent(line, i == 0 && prefix != "", prefix))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// continuationIndent returns what the continuation lines of a line start with
+func continuationIndent(line string, hanging bool, prefix string) string {
+	if hanging {
+		return strings.Repeat(" ", uniseg.StringWidth(prefix))
+	}
+	marker := lineMarker.FindString(line)
+	if strings.Contains(marker, ">") {
+		return marker
+	}
+	indent := strings.TrimLeft(marker, " \t")
+	return marker[:len(marker)-len(indent)] + strings.Repeat(" ", uniseg.StringWidth(indent))
+}
+
+// wrapLine breaks a line without newlines into lines of at most width
+// columns, starting the continuation lines with indent
+func wrapLine(line string, width int, indent string) string {
+	if uniseg.StringWidth(line) <= width {
+		return line
+	}
+	indentWidth := uniseg.StringWidth(indent)
+	if indentWidth*2 > width {
+		// Leave room for the text when the indent is most of the width
+		indent, indentWidth = "", 0
+	}
+
+	var b strings.Builder
+	current, currentWidth := "", 0
+	for _, word := range wrapWords(line) {
+		wordWidth := uniseg.StringWidth(strings.TrimRight(word, " \t"))
+		if currentWidth+wordWidth > width && strings.TrimSpace(current) != strings.TrimSpace(indent) {
+			b.WriteString(strings.TrimRight(current, " \t"))
+			b.WriteByte('\n')
+			current, currentWidth = indent, indentWidth
+		}
+		current += word
+		currentWidth += uniseg.StringWidth(word)
+	}
+	b.WriteString(strings.TrimRight(current, " \t"))
+	return b.String()
+}
+
+// wrapWords splits a line where it may be wrapped: after spaces, and where
+// Unicode allows a break next to a wide character, as between CJK
+// ideographs. Other breaks Unicode allows, such as after the slashes of a
+// URL, are left out so that links and paths stay whole.
+func wrapWords(line string) []string {
+	var words []string
+	word := ""
+	state := -1
+	for rest := line; rest != ""; {
+		var segment string
+		segment, rest, _, state = uniseg.FirstLineSegmentInString(rest, state)
+		word += segment
+		last, _ := utf8.DecodeLastRuneInString(strings.TrimRight(segment, " \t"))
+		next, _ := utf8.DecodeRuneInString(rest)
+		if strings.TrimRight(segment, " \t") != segment || isWide(last) || isWide(next) {
+			words = append(words, word)
+			word = ""
+		}
+	}
+	if word != "" {
+		words = append(words, word)
+	}
+	return words
+}
+
+// isWide reports whether a character takes two columns
+func isWide(r rune) bool {
+	return r != utf8.RuneError && uniseg.StringWidth(string(r)) > 1
+}
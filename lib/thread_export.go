@@ -0,0 +1,136 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// SelectThread returns the root of a thread with its replies and the
+// reactions and edits made to them, in chronological order. eventID may be
+// the root or any reply in the thread.
+func SelectThread(messages []ExportMessage, eventID string) ([]ExportMessage, error) {
+	byID := make(map[string]int, len(messages))
+	for i, msg := range messages {
+		byID[msg.EventID] = i
+	}
+	i, ok := byID[eventID]
+	if !ok {
+		return nil, fmt.Errorf("event %s is not in the archive", eventID)
+	}
+	root := eventID
+	if _, threadRoot := messageRelations(messages[i].Content); threadRoot != "" {
+		root = threadRoot
+	}
+	if _, ok := byID[root]; !ok {
+		return nil, fmt.Errorf("the root %s of the thread is not in the archive", root)
+	}
+
+	keep := map[string]bool{root: true}
+	replies := 0
+	for _, msg := range messages {
+		if _, threadRoot := messageRelations(msg.Content); threadRoot == root {
+			keep[msg.EventID] = true
+			replies++
+		}
+	}
+	if replies == 0 {
+		return nil, fmt.Errorf("event %s has no thread replies", root)
+	}
+
+	// Reactions and edits relate to the messages they change, which come first
+	for _, msg := range messages {
+		relatesTo, _ := msg.Content["m.relates_to"].(map[string]interface{})
+		relType, _ := relatesTo["rel_type"].(string)
+		target, _ := relatesTo["event_id"].(string)
+		if (relType == "m.annotation" || relType == "m.replace") && keep[target] {
+			keep[msg.EventID] = true
+		}
+	}
+
+	selected := []ExportMessage{}
+	for _, msg := range messages {
+		if keep[msg.EventID] {
+			selected = append(selected, msg)
+		}
+	}
+	return selected, nil
+}
+
+// ExportThread writes a single thread to filename in the format its extension
+// selects. ref is the thread's root, one of its replies, or a permalink to either.
+func ExportThread(ref, filename string, opts *ExportOptions) error {
+	if opts == nil {
+		opts = DefaultExportOptions()
+	}
+
+	linkedRoom, eventID, err := ParseEventReference(ref)
+	if err != nil {
+		return err
+	}
+
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	ext, err := exportFormat(filename, opts)
+	if err != nil {
+		return err
+	}
+	if ext == FormatStaticAPI {
+		return fmt.Errorf("a thread can't be written as a static API")
+	}
+
+	ctx := context.Background()
+	msg, err := GetDatabase().GetMessage(ctx, eventID)
+	if err != nil {
+		return fmt.Errorf("event %s is not in the archive: %w", eventID, err)
+	}
+	roomID := msg.RoomID
+	if strings.HasPrefix(linkedRoom, "!") && linkedRoom != roomID {
+		return fmt.Errorf("event %s is archived in %s, not %s", eventID, roomID, linkedRoom)
+	}
+
+	messages, err := GetDatabase().GetMessages(ctx, &MessageFilter{RoomID: roomID}, 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %w", err)
+	}
+	if messages, _, err = withholdOptedOut(ctx, messages); err != nil {
+		return err
+	}
+	mediaLinks, err := opts.mediaLinkResolver()
+	if err != nil {
+		return err
+	}
+	exportMessages, err := convertToExportMessages(messages, roomID, mediaLinks)
+	if err != nil {
+		return fmt.Errorf("failed to convert messages: %w", err)
+	}
+
+	thread, err := SelectThread(exportMessages, eventID)
+	if err != nil {
+		return err
+	}
+	ResolveRelations(thread)
+
+	if opts.Permalinks {
+		AttachPermalinks(thread, roomID, opts.PermalinkBase)
+	}
+	if err := loadMemberships(ctx, roomID, opts); err != nil {
+		return err
+	}
+	if opts.HistoricalNames {
+		ApplyHistoricalNames(thread, opts.memberships)
+	}
+	if opts.room, err = GetRoomOrganization(ctx, GetDatabase(), roomID); err != nil {
+		return err
+	}
+	if err := loadRoomProfile(ctx, roomID, opts); err != nil {
+		return err
+	}
+
+	fmt.Printf("Writing the thread of %s (%d messages) to %q\n", thread[0].EventID, len(thread), filename)
+	return writeExportFile(filename, ext, thread, opts)
+}
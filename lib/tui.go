@@ -0,0 +1,485 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"maunium.net/go/mautrix"
+)
+
+// tuiDateLayout is the date format accepted by the TUI's date range fields
+const tuiDateLayout = "2006-01-02"
+
+var (
+	tuiTitleStyle   = lipgloss.NewStyle().Bold(true)
+	tuiCursorStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("12")).Bold(true)
+	tuiMutedStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("8"))
+	tuiSuccessStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("10"))
+	tuiErrorStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("9"))
+)
+
+// ParseImportDateRange parses optional YYYY-MM-DD bounds. The until date is
+// inclusive, so the returned upper bound is the start of the following day.
+func ParseImportDateRange(since, until string) (time.Time, time.Time, error) {
+	var start, end time.Time
+	var err error
+
+	if strings.TrimSpace(since) != "" {
+		start, err = time.ParseInLocation(tuiDateLayout, strings.TrimSpace(since), time.Local)
+		if err != nil {
+			return start, end, fmt.Errorf("invalid since date %q, expected YYYY-MM-DD", since)
+		}
+	}
+	if strings.TrimSpace(until) != "" {
+		end, err = time.ParseInLocation(tuiDateLayout, strings.TrimSpace(until), time.Local)
+		if err != nil {
+			return start, end, fmt.Errorf("invalid until date %q, expected YYYY-MM-DD", until)
+		}
+		end = end.AddDate(0, 0, 1)
+	}
+	if !start.IsZero() && !end.IsZero() && !start.Before(end) {
+		return start, end, fmt.Errorf("since date must be before until date")
+	}
+
+	return start, end, nil
+}
+
+// RunTUI starts the interactive room selection and import interface
+func RunTUI() error {
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	client, err := GetMatrixClient()
+	if err != nil {
+		return fmt.Errorf("failed to get Matrix client: %w", err)
+	}
+
+	// The importer reports progress on stdout and through the log package;
+	// silence both while the TUI owns the terminal
+	stdout := os.Stdout
+	if devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+		os.Stdout = devNull
+		defer func() {
+			os.Stdout = stdout
+			devNull.Close()
+		}()
+	}
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	model := newTUIModel(client)
+	program := tea.NewProgram(model, tea.WithAltScreen(), tea.WithOutput(stdout))
+	model.send = program.Send
+
+	if _, err := program.Run(); err != nil {
+		return fmt.Errorf("TUI failed: %w", err)
+	}
+	if model.err != nil {
+		return model.err
+	}
+
+	if model.state == tuiStateDone {
+		fmt.Fprintf(stdout, "Imported %d messages from %d rooms\n", model.totalImported(), len(model.selectedRooms()))
+	}
+	return nil
+}
+
+type tuiState int
+
+const (
+	tuiStateLoading tuiState = iota
+	tuiStateSelecting
+	tuiStateOptions
+	tuiStateImporting
+	tuiStateDone
+)
+
+// tuiRoom is a joined room as shown in the TUI
+type tuiRoom struct {
+	ID           string
+	Name         string
+	MessageCount int64
+	Selected     bool
+
+	// Import progress
+	Status   string // "", "importing", "done" or "error"
+	Imported int
+	Err      error
+}
+
+// Messages sent to the TUI model
+type (
+	tuiRoomsLoadedMsg struct {
+		rooms []*tuiRoom
+		err   error
+	}
+	tuiRoomStartedMsg  struct{ index int }
+	tuiRoomProgressMsg struct {
+		index    int
+		imported int
+	}
+	tuiRoomDoneMsg struct {
+		index    int
+		imported int
+		err      error
+	}
+	tuiImportFinishedMsg struct{}
+)
+
+// Option fields on the options screen
+const (
+	tuiFieldLimit = iota
+	tuiFieldSince
+	tuiFieldUntil
+	tuiFieldCount
+)
+
+var tuiFieldLabels = [tuiFieldCount]string{"Message limit per room (0 = no limit)", "Since (YYYY-MM-DD)", "Until (YYYY-MM-DD)"}
+
+// tuiModel is the bubbletea model for the room selection and import TUI
+type tuiModel struct {
+	client *mautrix.Client
+	send   func(tea.Msg)
+
+	state  tuiState
+	rooms  []*tuiRoom
+	cursor int
+	height int
+	err    error
+
+	fields     [tuiFieldCount]string
+	fieldFocus int
+	formErr    error
+}
+
+func newTUIModel(client *mautrix.Client) *tuiModel {
+	m := &tuiModel{client: client, height: 24}
+	m.fields[tuiFieldLimit] = "0"
+	return m
+}
+
+func (m *tuiModel) Init() tea.Cmd {
+	return m.loadRooms
+}
+
+// loadRooms fetches joined rooms with their names and archived message counts
+func (m *tuiModel) loadRooms() tea.Msg {
+	resp, err := m.client.JoinedRooms(context.Background())
+	if err != nil {
+		return tuiRoomsLoadedMsg{err: fmt.Errorf("failed to get joined rooms: %w", err)}
+	}
+
+	rooms := make([]*tuiRoom, 0, len(resp.JoinedRooms))
+	for _, roomID := range resp.JoinedRooms {
+		name, err := GetRoomDisplayName(m.client, string(roomID))
+		if err != nil {
+			name = string(roomID)
+		}
+		count, err := GetDatabase().GetRoomMessageCount(context.Background(), string(roomID))
+		if err != nil {
+			count = 0
+		}
+		rooms = append(rooms, &tuiRoom{ID: string(roomID), Name: name, MessageCount: count})
+	}
+
+	sort.Slice(rooms, func(i, j int) bool {
+		return strings.ToLower(rooms[i].Name) < strings.ToLower(rooms[j].Name)
+	})
+
+	return tuiRoomsLoadedMsg{rooms: rooms}
+}
+
+func (m *tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.height = msg.Height
+		return m, nil
+
+	case tuiRoomsLoadedMsg:
+		if msg.err != nil {
+			m.err = msg.err
+			return m, tea.Quit
+		}
+		m.rooms = msg.rooms
+		m.state = tuiStateSelecting
+		return m, nil
+
+	case tuiRoomStartedMsg:
+		m.rooms[msg.index].Status = "importing"
+		return m, nil
+
+	case tuiRoomProgressMsg:
+		m.rooms[msg.index].Imported = msg.imported
+		return m, nil
+
+	case tuiRoomDoneMsg:
+		room := m.rooms[msg.index]
+		room.Imported = msg.imported
+		room.Err = msg.err
+		if msg.err != nil {
+			room.Status = "error"
+		} else {
+			room.Status = "done"
+			room.MessageCount += int64(msg.imported)
+		}
+		return m, nil
+
+	case tuiImportFinishedMsg:
+		m.state = tuiStateDone
+		return m, nil
+
+	case tea.KeyMsg:
+		if msg.String() == "ctrl+c" {
+			return m, tea.Quit
+		}
+		switch m.state {
+		case tuiStateSelecting:
+			return m.updateSelecting(msg)
+		case tuiStateOptions:
+			return m.updateOptions(msg)
+		case tuiStateDone:
+			if msg.String() == "q" || msg.String() == "enter" || msg.String() == "esc" {
+				return m, tea.Quit
+			}
+		}
+	}
+
+	return m, nil
+}
+
+func (m *tuiModel) updateSelecting(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "q", "esc":
+		return m, tea.Quit
+	case "up", "k":
+		if m.cursor > 0 {
+			m.cursor--
+		}
+	case "down", "j":
+		if m.cursor < len(m.rooms)-1 {
+			m.cursor++
+		}
+	case " ", "x":
+		if len(m.rooms) > 0 {
+			m.rooms[m.cursor].Selected = !m.rooms[m.cursor].Selected
+		}
+	case "a":
+		selectAll := len(m.selectedRooms()) < len(m.rooms)
+		for _, room := range m.rooms {
+			room.Selected = selectAll
+		}
+	case "enter":
+		if len(m.selectedRooms()) > 0 {
+			m.state = tuiStateOptions
+		}
+	}
+	return m, nil
+}
+
+func (m *tuiModel) updateOptions(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyEsc:
+		m.state = tuiStateSelecting
+		m.formErr = nil
+	case tea.KeyTab, tea.KeyDown:
+		m.fieldFocus = (m.fieldFocus + 1) % tuiFieldCount
+	case tea.KeyShiftTab, tea.KeyUp:
+		m.fieldFocus = (m.fieldFocus + tuiFieldCount - 1) % tuiFieldCount
+	case tea.KeyBackspace:
+		field := m.fields[m.fieldFocus]
+		if len(field) > 0 {
+			m.fields[m.fieldFocus] = field[:len(field)-1]
+		}
+	case tea.KeyRunes:
+		m.fields[m.fieldFocus] += string(msg.Runes)
+	case tea.KeyEnter:
+		limit, err := strconv.Atoi(strings.TrimSpace(m.fields[tuiFieldLimit]))
+		if err != nil || limit < 0 {
+			m.formErr = fmt.Errorf("limit must be a non-negative number")
+			return m, nil
+		}
+		since, until, err := ParseImportDateRange(m.fields[tuiFieldSince], m.fields[tuiFieldUntil])
+		if err != nil {
+			m.formErr = err
+			return m, nil
+		}
+		m.formErr = nil
+		m.state = tuiStateImporting
+
+		// Snapshot the selection so the import goroutine never reads model state
+		roomIDs := make(map[int]string)
+		for i, room := range m.rooms {
+			if room.Selected {
+				roomIDs[i] = room.ID
+			}
+		}
+		go m.runImport(roomIDs, limit, since, until)
+	}
+	return m, nil
+}
+
+// runImport imports the selected rooms one at a time, reporting progress to the TUI
+func (m *tuiModel) runImport(roomIDs map[int]string, limit int, since, until time.Time) {
+	defer m.send(tuiImportFinishedMsg{})
+
+	indexes := make([]int, 0, len(roomIDs))
+	for index := range roomIDs {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	enhanced, err := NewEnhancedMatrixClient(m.client, GetDatabase())
+	if err != nil {
+		for _, index := range indexes {
+			m.send(tuiRoomDoneMsg{index: index, err: err})
+		}
+		return
+	}
+	enhanced.since = since
+	enhanced.until = until
+
+	for _, index := range indexes {
+		index := index
+		enhanced.onProgress = func(_ string, imported int) {
+			m.send(tuiRoomProgressMsg{index: index, imported: imported})
+		}
+
+		m.send(tuiRoomStartedMsg{index: index})
+		count, err := enhanced.importEventsFromRoom(roomIDs[index], limit)
+		m.send(tuiRoomDoneMsg{index: index, imported: count, err: err})
+	}
+}
+
+func (m *tuiModel) selectedRooms() []*tuiRoom {
+	var selected []*tuiRoom
+	for _, room := range m.rooms {
+		if room.Selected {
+			selected = append(selected, room)
+		}
+	}
+	return selected
+}
+
+func (m *tuiModel) totalImported() int {
+	total := 0
+	for _, room := range m.selectedRooms() {
+		total += room.Imported
+	}
+	return total
+}
+
+func (m *tuiModel) View() string {
+	var b strings.Builder
+	b.WriteString(tuiTitleStyle.Render("Matrix Archive") + "\n\n")
+
+	switch m.state {
+	case tuiStateLoading:
+		b.WriteString("Loading joined rooms...\n")
+
+	case tuiStateSelecting:
+		m.viewRoomList(&b)
+		b.WriteString("\n" + tuiMutedStyle.Render("↑/↓ move • space select • a select all • enter continue • q quit") + "\n")
+
+	case tuiStateOptions:
+		fmt.Fprintf(&b, "Import %d rooms\n\n", len(m.selectedRooms()))
+		for i, label := range tuiFieldLabels {
+			prefix := "  "
+			value := m.fields[i]
+			if i == m.fieldFocus {
+				prefix = tuiCursorStyle.Render("> ")
+				value += "█"
+			}
+			fmt.Fprintf(&b, "%s%s: %s\n", prefix, label, value)
+		}
+		if m.formErr != nil {
+			b.WriteString("\n" + tuiErrorStyle.Render(m.formErr.Error()) + "\n")
+		}
+		b.WriteString("\n" + tuiMutedStyle.Render("tab next field • enter start import • esc back") + "\n")
+
+	case tuiStateImporting, tuiStateDone:
+		m.viewProgress(&b)
+		if m.state == tuiStateDone {
+			b.WriteString("\n" + tuiSuccessStyle.Render(fmt.Sprintf("Done: imported %d messages", m.totalImported())) + "\n")
+			b.WriteString(tuiMutedStyle.Render("enter/q quit") + "\n")
+		} else {
+			b.WriteString("\n" + tuiMutedStyle.Render("ctrl+c abort") + "\n")
+		}
+	}
+
+	return b.String()
+}
+
+// viewRoomList renders the scrolling room list around the cursor
+func (m *tuiModel) viewRoomList(b *strings.Builder) {
+	if len(m.rooms) == 0 {
+		b.WriteString("No joined rooms found\n")
+		return
+	}
+
+	visible := m.height - 6
+	if visible < 5 {
+		visible = 5
+	}
+	start := 0
+	if m.cursor >= visible {
+		start = m.cursor - visible + 1
+	}
+	end := start + visible
+	if end > len(m.rooms) {
+		end = len(m.rooms)
+	}
+
+	fmt.Fprintf(b, "%d joined rooms, %d selected\n", len(m.rooms), len(m.selectedRooms()))
+	for i := start; i < end; i++ {
+		room := m.rooms[i]
+		check := "[ ]"
+		if room.Selected {
+			check = "[x]"
+		}
+		line := fmt.Sprintf("%s %s %s", check, room.Name, tuiMutedStyle.Render(fmt.Sprintf("(%d archived)", room.MessageCount)))
+		if i == m.cursor {
+			b.WriteString(tuiCursorStyle.Render("> ") + line + "\n")
+		} else {
+			b.WriteString("  " + line + "\n")
+		}
+	}
+}
+
+// viewProgress renders per-room import status and an overall progress bar
+func (m *tuiModel) viewProgress(b *strings.Builder) {
+	selected := m.selectedRooms()
+	finished := 0
+	for _, room := range selected {
+		status := tuiMutedStyle.Render("waiting")
+		switch room.Status {
+		case "importing":
+			status = fmt.Sprintf("importing… %d messages", room.Imported)
+		case "done":
+			finished++
+			status = tuiSuccessStyle.Render(fmt.Sprintf("✓ %d messages", room.Imported))
+		case "error":
+			finished++
+			status = tuiErrorStyle.Render(fmt.Sprintf("✗ %v", room.Err))
+		}
+		fmt.Fprintf(b, "  %s  %s\n", room.Name, status)
+	}
+
+	const barWidth = 30
+	filled := 0
+	if len(selected) > 0 {
+		filled = barWidth * finished / len(selected)
+	}
+	fmt.Fprintf(b, "\n[%s%s] %d/%d rooms\n", strings.Repeat("█", filled), strings.Repeat("░", barWidth-filled), finished, len(selected))
+}
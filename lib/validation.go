@@ -0,0 +1,157 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+	"unicode/utf8"
+)
+
+// Validation modes, from the least to the most demanding. Imports check
+// every message against one before storing it, and quarantine the messages
+// that fail instead of dropping them.
+const (
+	// Well-formed room, event and sender IDs and an archived event type
+	ValidationLenient = "lenient"
+	// Also valid UTF-8 text and a timestamp that isn't zero or in the future
+	ValidationStandard = "standard"
+	// Also event IDs in a room version's format, content within the
+	// homeserver's event size limit and a timestamp after Matrix began
+	ValidationStrict = "strict"
+)
+
+// MaxEventContentSize is the largest content strict validation accepts: a
+// whole event may be no larger than 64 KiB, so content can't be either
+const MaxEventContentSize = 65536
+
+// Clock skew tolerated between the homeserver that stamped an event and this machine
+const maxTimestampSkew = 24 * time.Hour
+
+// matrixEpoch precedes every event a homeserver could have stamped itself;
+// earlier timestamps come from bridged or imported history
+var matrixEpoch = time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Event IDs are $localpart:server in room versions 1 and 2, and the
+// unpadded base64 reference hash of the event (43 characters) from version 3
+var strictEventIDPattern = regexp.MustCompile(`^\$([A-Za-z0-9+/_-]{43}|[^:\s]+:[^\s]+)$`)
+
+// CheckValidationMode returns an error unless mode is a validation mode or
+// empty, which selects ValidationStandard
+func CheckValidationMode(mode string) error {
+	switch mode {
+	case "", ValidationLenient, ValidationStandard, ValidationStrict:
+		return nil
+	}
+	return fmt.Errorf("unsupported validation mode %s, supported modes: [%s %s %s]", mode, ValidationLenient, ValidationStandard, ValidationStrict)
+}
+
+// ValidateWith checks a message as strictly as mode asks; "" is ValidationStandard
+func (m *Message) ValidateWith(mode string) error {
+	if err := m.Validate(); err != nil || mode == ValidationLenient {
+		return err
+	}
+
+	now := time.Now()
+	switch {
+	case m.Timestamp.IsZero() || m.Timestamp.Unix() <= 0:
+		return &ValidationError{Field: "timestamp", Message: "Missing timestamp"}
+	case m.Timestamp.After(now.Add(maxTimestampSkew)):
+		return &ValidationError{Field: "timestamp", Message: fmt.Sprintf("Timestamp %s is in the future", m.Timestamp.UTC().Format(time.RFC3339))}
+	}
+	if field, ok := invalidUTF8Field(m); ok {
+		return &ValidationError{Field: field, Message: "Invalid UTF-8"}
+	}
+	if mode != ValidationStrict {
+		return nil
+	}
+
+	if !strictEventIDPattern.MatchString(m.EventID) {
+		return &ValidationError{Field: "event_id", Message: "Event ID doesn't match any room version's format"}
+	}
+	if m.Timestamp.Before(matrixEpoch) {
+		return &ValidationError{Field: "timestamp", Message: fmt.Sprintf("Timestamp %s predates Matrix", m.Timestamp.UTC().Format(time.RFC3339))}
+	}
+	contentJSON, err := m.ContentJSON()
+	if err != nil {
+		return &ValidationError{Field: "content", Message: err.Error()}
+	}
+	if len(contentJSON) > MaxEventContentSize {
+		return &ValidationError{Field: "content", Message: fmt.Sprintf("Content is %s, more than an event may hold", FormatSize(int64(len(contentJSON))))}
+	}
+	return nil
+}
+
+// invalidUTF8Field returns the first field of a message holding a string
+// that isn't valid UTF-8
+func invalidUTF8Field(m *Message) (string, bool) {
+	for field, value := range map[string]string{"room_id": m.RoomID, "event_id": m.EventID, "sender": m.Sender} {
+		if !utf8.ValidString(value) {
+			return field, true
+		}
+	}
+	if !validUTF8Value(m.Content) {
+		return "content", true
+	}
+	return "", false
+}
+
+// validUTF8Value reports whether every string in decoded JSON, keys
+// included, is valid UTF-8
+func validUTF8Value(value interface{}) bool {
+	switch v := value.(type) {
+	case string:
+		return utf8.ValidString(v)
+	case map[string]interface{}:
+		for key, item := range v {
+			if !utf8.ValidString(key) || !validUTF8Value(item) {
+				return false
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if !validUTF8Value(item) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// quarantine keeps a message that failed validation for review
+func (p *ImportPipeline) quarantine(ctx context.Context, message *Message, reason error) {
+	log.Printf("Quarantining message %s: %v", message.EventID, reason)
+	q := &QuarantinedMessage{Message: message, Reason: reason.Error(), Validation: p.validation()}
+	if err := p.DB.QuarantineMessage(ctx, q); err != nil {
+		log.Printf("Warning: could not quarantine %s: %v", message.EventID, err)
+		return
+	}
+	p.Quarantined++
+}
+
+// reportQuarantined tells the user how many messages an import quarantined
+func reportQuarantined(count int) {
+	if count > 0 {
+		fmt.Printf("%d messages failed validation or collided with another room's event IDs and were quarantined; see \"failed list\"\n", count)
+	}
+}
+
+// validation returns the pipeline's validation mode
+func (p *ImportPipeline) validation() string {
+	if p.Validation == "" {
+		return ValidationStandard
+	}
+	return p.Validation
+}
+
+// quarantineJSON is how a quarantined message is stored: the message whole,
+// since a message may have failed validation for any of its fields
+func quarantineJSON(message *Message) (string, error) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
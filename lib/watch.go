@@ -0,0 +1,258 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// WatchOptions configure a live archiving session
+type WatchOptions struct {
+	RoomID     string // Only archive this room; empty archives every joined room
+	Moderation bool   // Also archive invites, knocks, kicks and bans with their reasons
+
+	ContentLimit ContentLimit // Truncates messages with oversized content
+	Senders      SenderFilter // Whose messages to archive; empty uses the patterns in the environment
+	Validation   string       // Validation mode; messages that fail are quarantined
+
+	// YAML file of rules attributing relayed messages to their real authors;
+	// empty uses the file named by MATRIX_ARCHIVE_ATTRIBUTION_RULES
+	AttributionRules string
+
+	// Backs up the archive while watching and when watch stops; nil doesn't
+	Backup *BackupOptions
+}
+
+// liveArchiver stores timeline events from /sync as they arrive. Encrypted
+// events whose room key hasn't arrived yet are stored as placeholders and
+// kept in memory until the key arrives, when they are decrypted and replaced.
+type liveArchiver struct {
+	enhanced *EnhancedMatrixClient
+	roomID   string
+	sealed   map[string]bool // Sealed rooms, whose events aren't archived
+
+	mu       sync.Mutex
+	waiting  map[id.SessionID][]*event.Event
+	received []id.SessionID // Sessions received while handling the current sync
+	archived int
+	late     int // Messages decrypted after their key arrived
+}
+
+// Watch archives new events as they arrive until interrupted. With
+// encryption available, room keys sent to this device are processed as they
+// arrive and Olm sessions and the sync position are kept in the crypto store,
+// so encrypted messages are stored decrypted without a later key recovery.
+func Watch(opts *WatchOptions) error {
+	if opts == nil {
+		opts = &WatchOptions{}
+	}
+	if err := opts.ContentLimit.Validate(); err != nil {
+		return err
+	}
+	if err := CheckValidationMode(opts.Validation); err != nil {
+		return err
+	}
+	opts.Senders = opts.Senders.OrEnv()
+	if err := opts.Senders.Validate(); err != nil {
+		return err
+	}
+	attribution, err := LoadAttributionRulesOrEnv(opts.AttributionRules)
+	if err != nil {
+		return err
+	}
+
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+	if err := opts.Senders.DenyOptedOut(context.Background(), GetDatabase()); err != nil {
+		return err
+	}
+
+	client, err := GetMatrixClient()
+	if err != nil {
+		return fmt.Errorf("failed to get Matrix client: %w", err)
+	}
+	enhanced, err := NewEnhancedMatrixClient(client, GetDatabase())
+	if err != nil {
+		return fmt.Errorf("failed to create enhanced client: %w", err)
+	}
+	enhanced.archiveModeration = opts.Moderation
+	enhanced.contentLimit = &opts.ContentLimit
+	enhanced.senders = opts.Senders
+	enhanced.validation = opts.Validation
+	enhanced.attribution = attribution
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	w := &liveArchiver{enhanced: enhanced, roomID: opts.RoomID, sealed: make(map[string]bool), waiting: make(map[id.SessionID][]*event.Event)}
+	seals, err := GetDatabase().GetRoomSeals(ctx, "")
+	if err != nil {
+		return err
+	}
+	for _, seal := range seals {
+		if seal.RoomID == opts.RoomID {
+			return sealedRoomError(seal)
+		}
+		w.sealed[seal.RoomID] = true
+	}
+	syncer := mautrix.NewDefaultSyncer()
+	syncer.FilterJSON = syncFilter()
+	if cm, ok := client.Crypto.(*CryptoManager); ok {
+		mach := cm.GetOlmMachine()
+		// The sync position is saved with the Olm sessions, so room keys sent
+		// while the archive wasn't watching are received on the next run
+		client.Store = cm.cryptoStore
+		if err := mach.ShareKeys(ctx, -1); err != nil {
+			log.Printf("Warning: could not upload encryption keys: %v", err)
+		}
+		mach.SessionReceived = w.sessionReceived
+		syncer.OnSync(func(ctx context.Context, resp *mautrix.RespSync, since string) bool {
+			// To-device events carry the room keys, so handle them before the
+			// timeline events they decrypt
+			mach.ProcessSyncResponse(ctx, resp, since)
+			w.decryptWaiting(ctx)
+			return true
+		})
+	} else {
+		log.Printf("Warning: encryption is not available; encrypted messages will be stored as placeholders")
+	}
+	syncer.OnEvent(w.handleEvent)
+	client.Syncer = syncer
+	// Upload the filter afresh, since stores that saved the ID of one
+	// uploaded by an earlier version would otherwise keep using it
+	if err := client.Store.SaveFilterID(ctx, client.UserID, ""); err != nil {
+		log.Printf("Warning: could not reset the sync filter: %v", err)
+	}
+
+	if opts.RoomID != "" {
+		fmt.Printf("Watching %s for new events (Ctrl-C to stop)\n", opts.RoomID)
+	} else {
+		fmt.Println("Watching all joined rooms for new events (Ctrl-C to stop)")
+	}
+	if opts.Backup != nil {
+		go runBackups(ctx, opts.Backup)
+	}
+	err = client.SyncWithContext(ctx)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		return fmt.Errorf("sync failed: %w", err)
+	}
+
+	fmt.Printf("\nArchived %d events", w.archived)
+	if w.late > 0 {
+		fmt.Printf(", %d decrypted once their room key arrived", w.late)
+	}
+	fmt.Println()
+	enhanced.reportFailures()
+	if pending := w.waitingCount(); pending > 0 {
+		fmt.Printf("%d encrypted messages are still waiting for their room key; recover their keys with key-recovery and import the room again\n", pending)
+	}
+	if opts.Backup != nil {
+		path, err := backupArchive(context.Background(), opts.Backup)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("✓ Backed up the archive to %s\n", path)
+	}
+	return nil
+}
+
+// handleEvent archives a timeline event from /sync
+func (w *liveArchiver) handleEvent(ctx context.Context, evt *event.Event) {
+	if evt.Mautrix.EventSource&event.SourceTimeline == 0 {
+		return
+	}
+	if (w.roomID != "" && evt.RoomID.String() != w.roomID) || w.sealed[evt.RoomID.String()] {
+		return
+	}
+
+	stored := w.archive(ctx, evt)
+	w.archived += stored
+	if stored > 0 && evt.Type == event.EventEncrypted && w.isPlaceholder(ctx, evt) {
+		if content, ok := evt.Content.Parsed.(*event.EncryptedEventContent); ok {
+			w.mu.Lock()
+			w.waiting[content.SessionID] = append(w.waiting[content.SessionID], evt)
+			w.mu.Unlock()
+		}
+	}
+}
+
+// archive stores a single event, returning the number of messages stored
+func (w *liveArchiver) archive(ctx context.Context, evt *event.Event) int {
+	count, err := w.enhanced.processEventBatchEnhanced([]*event.Event{evt}, evt.RoomID.String(), 0)
+	if err != nil {
+		log.Printf("Failed to archive event %s: %v", evt.ID, err)
+	}
+	return count
+}
+
+// isPlaceholder reports whether an encrypted event was stored without its
+// content because it couldn't be decrypted
+func (w *liveArchiver) isPlaceholder(ctx context.Context, evt *event.Event) bool {
+	message, err := w.enhanced.db.GetMessage(ctx, evt.ID.String())
+	return err == nil && message.MessageType == EventTypeEncrypted
+}
+
+// sessionReceived notes a Megolm session that arrived while handling a sync
+func (w *liveArchiver) sessionReceived(ctx context.Context, roomID id.RoomID, sessionID id.SessionID, firstKnownIndex uint32) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.received = append(w.received, sessionID)
+}
+
+// decryptWaiting replaces the placeholders of events whose session has just
+// arrived with their decrypted content
+func (w *liveArchiver) decryptWaiting(ctx context.Context) {
+	w.mu.Lock()
+	var ready []*event.Event
+	for _, sessionID := range w.received {
+		ready = append(ready, w.waiting[sessionID]...)
+		delete(w.waiting, sessionID)
+	}
+	w.received = nil
+	w.mu.Unlock()
+
+	for _, evt := range ready {
+		// The decrypted message takes the placeholder's event ID, so the
+		// placeholder goes first, and is put back if the message isn't stored
+		placeholder, err := w.enhanced.db.GetMessage(ctx, evt.ID.String())
+		if err != nil {
+			log.Printf("Failed to replace placeholder for %s: %v", evt.ID, err)
+			continue
+		}
+		if err := w.enhanced.db.DeleteMessage(ctx, evt.ID.String()); err != nil {
+			log.Printf("Failed to replace placeholder for %s: %v", evt.ID, err)
+			continue
+		}
+		if w.archive(ctx, evt) == 0 {
+			if err := w.enhanced.db.InsertMessage(ctx, placeholder); err != nil {
+				log.Printf("Failed to restore placeholder for %s: %v", evt.ID, err)
+			}
+			continue
+		}
+		if !w.isPlaceholder(ctx, evt) {
+			w.late++
+		}
+	}
+}
+
+// waitingCount returns the number of placeholders still waiting for a key
+func (w *liveArchiver) waitingCount() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	count := 0
+	for _, events := range w.waiting {
+		count += len(events)
+	}
+	return count
+}
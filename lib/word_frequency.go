@@ -0,0 +1,129 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// WordFrequency counts the uses of one word
+type WordFrequency struct {
+	Word     string `json:"word"`
+	Count    int    `json:"count"`    // Times it was used
+	Messages int    `json:"messages"` // Messages it appears in
+	Senders  int    `json:"senders"`  // Distinct people who used it
+}
+
+// CountWords counts the words in the text of messages, splitting each room's
+// messages with the analyzer analyzerFor returns for it. Only text, notice
+// and emote messages are read, edits are skipped so a corrected message isn't
+// counted twice, and so are messages from senders in exclude. Words are
+// returned most used first.
+func CountWords(messages []*Message, analyzerFor func(roomID string) *Analyzer, exclude map[string]bool) []WordFrequency {
+	counts := make(map[string]*WordFrequency)
+	senders := make(map[string]map[string]bool)
+	for _, msg := range messages {
+		if msg.MessageType != EventTypeMessage || isEdit(msg) || exclude[msg.Sender] {
+			continue
+		}
+		switch contentMsgType(msg.Content) {
+		case "m.text", "m.notice", "m.emote":
+		default:
+			continue
+		}
+		body, _ := msg.Content["body"].(string)
+		relatesTo, _ := msg.Content["m.relates_to"].(map[string]interface{})
+		_, isReply := relatesTo["m.in_reply_to"]
+
+		seen := make(map[string]bool)
+		for _, word := range analyzerFor(msg.RoomID).Tokens(normalizeBody(body, isReply)) {
+			wf := counts[word]
+			if wf == nil {
+				wf = &WordFrequency{Word: word}
+				counts[word] = wf
+				senders[word] = make(map[string]bool)
+			}
+			wf.Count++
+			if !seen[word] {
+				seen[word] = true
+				wf.Messages++
+			}
+			senders[word][msg.Sender] = true
+		}
+	}
+
+	words := make([]WordFrequency, 0, len(counts))
+	for word, wf := range counts {
+		wf.Senders = len(senders[word])
+		words = append(words, *wf)
+	}
+	sort.Slice(words, func(i, j int) bool {
+		if words[i].Count != words[j].Count {
+			return words[i].Count > words[j].Count
+		}
+		return words[i].Word < words[j].Word
+	})
+	return words
+}
+
+// AnalyzeWords prints the most used words in a room, or in every archived
+// room if roomID is empty. Each room is analyzed in the language cfg gives
+// it, unless language is set, which applies to every room. People who opted
+// out of archiving are left out.
+func AnalyzeWords(roomID string, top int, cfg *AnalyzerConfig, language string) error {
+	analyzerFor := cfg.AnalyzerFor
+	if language != "" {
+		analyzer, err := NewAnalyzer(language, cfg.Stopwords[strings.ToLower(language)]...)
+		if err != nil {
+			return err
+		}
+		analyzerFor = func(string) *Analyzer { return analyzer }
+	}
+
+	// Initialize database connection with DuckDB
+	if err := InitDuckDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer CloseDatabase()
+
+	ctx := context.Background()
+	if roomID != "" {
+		var err error
+		if roomID, err = resolveExportRoom(roomID); err != nil {
+			return err
+		}
+	}
+	messages, err := GetDatabase().GetMessages(ctx, &MessageFilter{RoomID: roomID, EventType: EventTypeMessage}, 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %w", err)
+	}
+	optedOut, err := optedOutUsers(ctx, GetDatabase())
+	if err != nil {
+		return err
+	}
+	persons, err := loadPersons(ctx, GetDatabase())
+	if err != nil {
+		return err
+	}
+	words := CountWords(persons.Senders(messages), analyzerFor, persons.Exclude(optedOut))
+	if top > 0 && len(words) > top {
+		words = words[:top]
+	}
+	if jsonOutput() {
+		return writeJSON(words)
+	}
+
+	if len(words) == 0 {
+		fmt.Println("No words found")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "WORD\tCOUNT\tMESSAGES\tPEOPLE")
+	for _, wf := range words {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", wf.Word, wf.Count, wf.Messages, wf.Senders)
+	}
+	return w.Flush()
+}
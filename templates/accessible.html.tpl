@@ -0,0 +1,414 @@
+<!DOCTYPE html>
+<html lang="{{lang}}" data-theme="{{theme}}">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>{{with .Room.Name}}{{.}} – {{end}}{{t "archive.title"}}</title>
+    <style>
+        body {
+            font-family: system-ui, -apple-system, 'Segoe UI', Roboto, Arial, sans-serif;
+            font-size: 1rem;
+            line-height: 1.6;
+            color: #1a1a1a;
+            background: #ffffff;
+            margin: 0;
+        }
+
+        .skip-link {
+            position: absolute;
+            left: -999px;
+            top: 0;
+            padding: 8px 16px;
+            background: #1a1a1a;
+            color: #ffffff;
+        }
+
+        .skip-link:focus {
+            left: 8px;
+            top: 8px;
+        }
+
+        header, main, footer {
+            max-width: 60rem;
+            margin: 0 auto;
+            padding: 1rem;
+        }
+
+        h1 {
+            font-size: 2rem;
+            margin: 0 0 0.5rem 0;
+        }
+
+        .stats {
+            display: flex;
+            flex-wrap: wrap;
+            gap: 1.5rem;
+            margin: 0;
+            padding: 0;
+        }
+
+        .stats div {
+            display: flex;
+            gap: 0.4rem;
+        }
+
+        .stats dt {
+            font-weight: bold;
+        }
+
+        .stats dd {
+            margin: 0;
+        }
+
+        .room-details {
+            margin-bottom: 1rem;
+        }
+
+        article.message {
+            border-bottom: 1px solid #6b6b6b;
+            padding: 1rem 0;
+        }
+
+        article.message:focus {
+            outline: 3px solid #0b5fff;
+            outline-offset: 4px;
+        }
+
+        article.message h3 {
+            font-size: 1.05rem;
+            margin: 0 0 0.25rem 0;
+        }
+
+        .sender-id, time {
+            color: #404040;
+            font-size: 0.9rem;
+        }
+
+        .message-body img {
+            max-width: 100%;
+            height: auto;
+        }
+
+        .message-body img[data-mx-emoticon], .reaction-emote {
+            height: 1.5em;
+            width: auto;
+            vertical-align: middle;
+        }
+
+        .notice {
+            font-style: italic;
+        }
+
+        a {
+            color: #0b4fcc;
+        }
+
+        .archive-search input {
+            width: 100%;
+            padding: 0.5rem;
+            font-size: 1rem;
+            border: 2px solid #404040;
+        }
+
+        article.message.search-target {
+            outline: 3px solid #0b5fff;
+        }
+
+        a:focus, audio:focus, video:focus {
+            outline: 3px solid #0b5fff;
+            outline-offset: 2px;
+        }
+
+        /* High-contrast palette, applied on request or when the reader's system asks for it */
+        {{if highContrast}}body,{{end}}
+        body.high-contrast {
+            color: #ffffff;
+            background: #000000;
+        }
+
+        {{if highContrast}}body a,{{end}}
+        body.high-contrast a {
+            color: #ffff00;
+        }
+
+        {{if highContrast}}body .sender-id, body time,{{end}}
+        body.high-contrast .sender-id, body.high-contrast time {
+            color: #ffffff;
+        }
+
+        {{if highContrast}}body article.message,{{end}}
+        body.high-contrast article.message {
+            border-bottom-color: #ffffff;
+        }
+
+        .highlights {
+            font-weight: bold;
+        }
+
+        .context-break {
+            font-style: italic;
+            text-align: center;
+        }
+
+        @media (prefers-contrast: more) {
+            body {
+                color: #000000;
+            }
+
+            article.message {
+                border-bottom: 2px solid #000000;
+            }
+        }
+
+        @media (prefers-reduced-motion: reduce) {
+            * {
+                transition: none !important;
+            }
+        }
+    </style>
+    {{if highContrast}}
+    {{else if eq theme "dark"}}
+    <style>{{template "dark-theme"}}</style>
+    {{else if eq theme "auto"}}
+    <style>@media (prefers-color-scheme: dark) { {{template "dark-theme"}} }</style>
+    {{end}}
+    {{with customCSS}}
+    <style>{{.}}</style>
+    {{end}}
+</head>
+<body>
+    <a class="skip-link" href="#messages">{{t "a11y.skip_to_messages"}}</a>
+
+    <header role="banner">
+        <h1>{{t "archive.title"}}</h1>
+        <p>{{t "archive.subtitle"}}</p>
+        {{with .Room.Name}}<p class="room-name">{{.}}</p>{{end}}
+        {{if or .Room.CanonicalAlias .Room.Topic .Room.CreatedAt}}
+        <dl class="stats room-details" aria-label="{{t "room.details"}}">
+            {{with .Room.CanonicalAlias}}<div><dt>{{t "room.alias"}}</dt><dd>{{.}}</dd></div>{{end}}
+            {{with .Room.Topic}}<div><dt>{{t "room.topic"}}</dt><dd>{{.}}</dd></div>{{end}}
+            {{with .Room.CreatedAt}}<div><dt>{{t "room.created"}}</dt><dd><time datetime="{{.}}">{{formatTime .}}</time></dd></div>{{end}}
+        </dl>
+        {{end}}
+        {{with .Room.Labels}}
+        <ul class="room-labels" aria-label="{{t "room.labels"}}">
+            {{range .}}<li>{{.}}</li>{{end}}
+        </ul>
+        {{end}}
+        <dl class="stats" aria-label="{{t "a11y.archive_statistics"}}">
+            <div><dt>{{t "stats.messages"}}</dt><dd>{{.Stats.Messages}}</dd></div>
+            <div><dt>{{t "stats.users"}}</dt><dd>{{.Stats.Users}}</dd></div>
+            <div><dt>{{t "stats.reactions"}}</dt><dd>{{.Stats.Reactions}}</dd></div>
+        </dl>
+        {{with .Room.Activity}}
+        <p>{{t "stats.archive_summary" .Messages .Senders .ActiveDays (.FirstMessage.Format "January 2, 2006") (.LastMessage.Format "January 2, 2006")}}</p>
+        {{end}}
+    </header>
+
+    <main id="messages" role="main" tabindex="-1">
+        {{with .Archive.SearchIndex}}
+        <section class="archive-search" role="search">
+            <label for="archive-search-input">{{t "search.label"}}</label>
+            <input type="search" id="archive-search-input" data-index="{{.}}" data-no-results="{{t "search.no_results"}}" placeholder="{{t "search.placeholder"}}" autocomplete="off">
+            <ol id="archive-search-results" aria-live="polite"></ol>
+        </section>
+        <script>{{searchScript}}</script>
+        {{end}}
+        {{with .Participants}}
+        <section aria-labelledby="participants-heading">
+            <h2 id="participants-heading">{{t "participants.title"}}</h2>
+            <table>
+                <thead>
+                    <tr>
+                        <th scope="col">{{t "participants.name"}}</th>
+                        <th scope="col">{{t "participants.platform"}}</th>
+                        <th scope="col">{{t "stats.messages"}}</th>
+                        <th scope="col">{{t "participants.joined"}}</th>
+                        <th scope="col">{{t "participants.left"}}</th>
+                    </tr>
+                </thead>
+                <tbody>
+                {{range .}}
+                    <tr>
+                        <th scope="row">{{.DisplayName}} <span class="sender-id">({{.UserID}})</span></th>
+                        <td>{{.Platform}}</td>
+                        <td>{{.MessageCount}}</td>
+                        <td>{{with .Joined}}<time datetime="{{.}}">{{formatTime .}}</time>{{end}}</td>
+                        <td>{{with .Left}}<time datetime="{{.}}">{{formatTime .}}</time>{{end}}</td>
+                    </tr>
+                {{end}}
+                </tbody>
+            </table>
+        </section>
+        {{end}}
+        {{with lazySections}}
+        <nav class="month-index" aria-label="{{t "lazy.months"}}">
+            <ul>{{range .}}{{if .Month}}<li><a href="#{{.Month}}">{{.Label}}</a></li>{{end}}{{end}}</ul>
+        </nav>
+        {{end}}
+        <h2>{{t "stats.messages"}}</h2>
+        <div role="feed" aria-busy="false" aria-label="{{t "stats.messages"}}">
+        {{with lazySections}}
+        {{range .}}
+        {{with .Month}}<a id="{{.}}" class="month-anchor"></a>{{end}}
+        <div class="lazy-section" id="{{.ID}}"{{with .Src}} data-src="{{.}}"{{end}}>
+            {{if .Messages}}{{template "messages" .Messages}}{{else}}<button type="button" class="load-more">{{t "lazy.load_more" .Count .Label}}</button>{{end}}
+        </div>
+        {{end}}
+        <script>{{lazyLoadScript}}</script>
+        {{else}}
+        {{template "messages" .Messages}}
+        {{end}}
+        </div>
+
+        {{if hasAnnotations .Messages}}
+        <section aria-labelledby="footnotes-heading">
+            <h2 id="footnotes-heading">{{t "annotations.title"}}</h2>
+            <ol>
+            {{range .Messages}}{{range .Annotations}}
+                <li id="note-{{.Number}}" value="{{.Number}}">
+                    {{.Note}}{{if .Author}} — {{.Author}}{{end}}
+                    <a href="#ref-{{.Number}}" aria-label="{{t "annotations.back"}}">↩</a>
+                </li>
+            {{end}}{{end}}
+            </ol>
+        </section>
+        {{end}}
+    </main>
+
+    <footer role="contentinfo">
+        <p>{{t "footer.generated_by"}} • <time datetime="{{now}}">{{formatTime now}}</time></p>
+    </footer>
+</body>
+</html>
+
+{{define "dark-theme"}}
+        body {
+            color: #f0f0f0;
+            background: #121212;
+        }
+
+        a {
+            color: #8ab4ff;
+        }
+
+        .sender-id, time {
+            color: #c8c8c8;
+        }
+
+        article.message {
+            border-bottom-color: #8a8a8a;
+        }
+{{end}}
+
+{{define "messages"}}
+        {{range $index, $message := .}}
+            {{$msgtype := index .Content "msgtype"}}
+            {{$body := index .Content "body"}}
+            {{$formattedBody := index .Content "formatted_body"}}
+            {{$url := index .Content "url"}}
+            {{with .RoomUpgrade}}
+            <p class="context-break room-upgrade" role="separator">{{if .RoomVersion}}{{t "room.upgraded_version" .RoomVersion}}{{else}}{{t "room.upgraded"}}{{end}}</p>
+            {{end}}
+            {{if .ContextBreak}}
+            <p class="context-break" role="separator">{{t "highlights.omitted"}}</p>
+            {{end}}
+            {{if .ConversationStart}}
+            <p class="context-break conversation-break" role="separator" id="conversation-{{.ConversationID}}">{{t "conversation.start" .ConversationID}}</p>
+            {{end}}
+            <article class="message"{{with .EventID}} id="{{messageAnchor .}}"{{end}} tabindex="0" aria-labelledby="msg-{{$index}}-heading" aria-posinset="{{inc $index}}" aria-setsize="{{len $}}">
+                <h3 id="msg-{{$index}}-heading">
+                    {{.DisplayName}}
+                    <span class="sender-id">({{.UserID}}{{with .PlatformHandle}}, {{.}}{{end}})</span>
+                </h3>
+                <time datetime="{{.Timestamp}}">{{formatTime .Timestamp}}</time>
+                {{with .Permalink}}
+                    <a class="permalink" href="{{.}}" aria-label="{{t "meta.permalink"}}: {{$message.DisplayName}}, {{formatTime $message.Timestamp}}">{{t "meta.permalink"}}</a>
+                {{end}}
+                {{if .Highlights}}
+                    <p class="highlights">{{t "highlights.title"}}: {{range $i, $reason := .Highlights}}{{if $i}}, {{end}}{{t (printf "highlights.%s" $reason)}}{{end}}</p>
+                {{end}}
+
+                {{with .ForwardedFrom}}
+                    <p><em>{{t "message.forwarded_from" .}}{{with $message.ForwardedPlatform}} ({{.}}){{end}}</em></p>
+                {{end}}
+                {{with .Truncated}}
+                    <p><em>{{t "message.truncated" (formatSize .OriginalSize)}}</em></p>
+                {{end}}
+                {{if .RepliesTo}}
+                    <p><em>{{t "message.replying_to" .RepliesTo.DisplayName}}</em></p>
+                {{end}}
+
+                <div class="message-body">
+                {{if eq $msgtype "m.image"}}
+                    {{if $url}}
+                        <figure>
+                            <img src="{{$url}}" alt="{{if $body}}{{$body}}{{else}}{{t "a11y.image_from" .DisplayName}}{{end}}" loading="lazy" />
+                            {{if $body}}<figcaption>{{$body}}</figcaption>{{end}}
+                        </figure>
+                    {{else if $body}}
+                        <p>{{$body}}</p>
+                    {{end}}
+                {{else if eq $msgtype "m.video"}}
+                    {{if $body}}<p>{{$body}}</p>{{end}}
+                    {{$duration := mediaDuration .Content}}
+                    {{if .Player}}
+                        <video controls preload="metadata" {{with .Player.Poster}}poster="{{mediaURL .}}"{{end}} aria-label="{{if $body}}{{$body}}{{else}}{{t "a11y.video_from" .DisplayName}}{{end}}">
+                            <source src="{{mediaURL .Player.URL}}"{{with .Player.MimeType}} type="{{.}}"{{end}}>
+                            <a href="{{mediaURL .Player.URL}}">{{t "message.video_url"}}</a>
+                        </video>
+                        {{if $duration}}<p>{{$duration}}</p>{{end}}
+                    {{else if $url}}
+                        <p><a href="{{$url}}">{{t "message.video_url"}}</a>{{if $duration}} ({{$duration}}){{end}}</p>
+                    {{end}}
+                {{else if eq $msgtype "m.audio"}}
+                    {{if $body}}<p>{{$body}}</p>{{end}}
+                    {{$duration := mediaDuration .Content}}
+                    {{if .Player}}
+                        <audio controls preload="metadata" aria-label="{{if $body}}{{$body}}{{else}}{{t "a11y.audio_from" .DisplayName}}{{end}}">
+                            <source src="{{mediaURL .Player.URL}}"{{with .Player.MimeType}} type="{{.}}"{{end}}>
+                            <a href="{{mediaURL .Player.URL}}">{{t "message.audio_url"}}</a>
+                        </audio>
+                        {{if $duration}}<p>{{$duration}}</p>{{end}}
+                    {{else if $url}}
+                        <p><a href="{{$url}}">{{t "message.audio_url"}}</a>{{if $duration}} ({{$duration}}){{end}}</p>
+                    {{end}}
+                {{else if eq $msgtype "m.file"}}
+                    {{if .File}}{{$file := .File}}
+                        <p>{{if $url}}<a href="{{$url}}" download="{{$file.Name}}">{{if $file.Name}}{{$file.Name}}{{else}}{{t "message.download_file"}}{{end}}</a>{{else}}{{$file.Name}}{{end}}
+                        {{if or $file.MimeType $file.Size}}({{$file.MimeType}}{{if and $file.MimeType $file.Size}}, {{end}}{{if $file.Size}}{{formatSize $file.Size}}{{end}}){{end}}</p>
+                    {{else if $url}}
+                        <p><a href="{{$url}}" download>{{if $body}}{{$body}}{{else}}{{t "message.download_file"}}{{end}}</a></p>
+                    {{else if $body}}
+                        <p>{{$body}}</p>
+                    {{end}}
+                {{else if eq $msgtype "m.notice"}}
+                    <p class="notice"><span class="sr-label">{{t "message.notice"}}:</span>
+                    {{if $formattedBody}}{{$formattedBody | safeHTML}}{{else}}{{$body}}{{end}}</p>
+                {{else if $formattedBody}}
+                    <div>{{$formattedBody | safeHTML}}</div>
+                {{else if $body}}
+                    <p>{{$body}}</p>
+                {{else}}
+                    <p><em>{{t "message.no_content"}}</em></p>
+                {{end}}
+                </div>
+
+                {{if .Annotations}}
+                    <p class="footnote-refs">{{t "annotations.title"}}:
+                    {{range .Annotations}}
+                        <a href="#note-{{.Number}}" id="ref-{{.Number}}" aria-label="{{t "annotations.note" .Number}}">[{{.Number}}]</a>
+                    {{end}}
+                    </p>
+                {{end}}
+
+                {{if .Reactions}}
+                    <ul aria-label="{{t "stats.reactions"}}">
+                    {{range .Reactions}}
+                        <li>{{if .Image}}<img class="reaction-emote" src="{{mediaURL .Image}}" alt="{{with .Shortcode}}:{{.}}:{{else}}{{t "message.custom_emoji"}}{{end}}">{{else}}{{.Emoji}}{{end}} {{.Count}}</li>
+                    {{end}}
+                    </ul>
+                {{end}}
+            </article>
+        {{end}}
+{{end}}
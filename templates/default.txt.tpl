@@ -1,72 +1,130 @@
-{{range .messages -}}
+{{with .Room.Name -}}
+{{.}}
+{{end -}}
+{{with .Room.CanonicalAlias -}}
+{{t "room.alias"}}: {{.}}
+{{end -}}
+{{with .Room.Topic -}}
+{{t "room.topic"}}: {{.}}
+{{end -}}
+{{with .Room.CreatedAt -}}
+{{t "room.created"}}: {{formatTime .}}
+{{end -}}
+{{if or .Room.Name .Room.CanonicalAlias .Room.Topic .Room.CreatedAt}}
+{{end -}}
+{{with .Room.Labels -}}
+{{t "room.labels"}}: {{range $i, $label := .}}{{if $i}}, {{end}}{{$label}}{{end}}
+
+{{end -}}
+{{with .Participants -}}
+{{t "participants.title"}}
+{{range . -}}
+- {{.DisplayName}} ({{.UserID}}){{if .Platform}} [{{.Platform}}]{{end}}: {{.MessageCount}} {{t "stats.messages"}}{{with .Joined}}, {{t "participants.joined"}} {{formatTime .}}{{end}}{{with .Left}}, {{t "participants.left"}} {{formatTime .}}{{end}}
+{{end}}
+{{end -}}
+{{range .Messages -}}
+{{with .RoomUpgrade -}}
+[... {{if .RoomVersion}}{{t "room.upgraded_version" .RoomVersion}}{{else}}{{t "room.upgraded"}}{{end}} ...]
+
+{{end -}}
+{{if .ContextBreak -}}
+[... {{t "highlights.omitted"}} ...]
+
+{{end -}}
+{{if .ConversationStart -}}
+[--- {{t "conversation.start" .ConversationID}} ---]
+
+{{end -}}
 ================================================================================
-From: {{.Sender}}
-Date: {{formatTime .Timestamp}}
+{{t "message.from"}}: {{if .Relayed}}{{.DisplayName}}{{with .Platform}} ({{.}}){{end}}, {{t "message.relayed_by" .Sender}}{{else}}{{.Sender}}{{end}}
+{{t "message.date"}}: {{formatTime .Timestamp}}
+{{if .ForwardedFrom -}}
+{{t "message.forwarded_from" .ForwardedFrom}}{{with .ForwardedPlatform}} ({{.}}){{end}}
+{{end -}}
+{{with .Truncated -}}
+{{t "message.truncated" (formatSize .OriginalSize)}}
+{{end -}}
+{{with .Permalink -}}
+{{t "meta.permalink"}}: {{.}}
+{{end -}}
+{{with .RepliesTo -}}
+↳ {{t "message.replying_to" .DisplayName}}: {{.Content | truncate 100}}
+{{end -}}
+{{if .Highlights -}}
+{{t "highlights.title"}}: {{range $i, $reason := .Highlights}}{{if $i}}, {{end}}{{t (printf "highlights.%s" $reason)}}{{end}}
+{{end -}}
 {{$msgtype := index .Content "msgtype" -}}
 {{if $msgtype -}}
-Type: {{$msgtype}}
+{{t "message.type"}}: {{$msgtype}}
 
 {{if eq $msgtype "m.text" -}}
 {{$body := index .Content "body" -}}
 {{if $body -}}
-{{$body}}
+{{wrap $body}}
 {{end -}}
 {{else if eq $msgtype "m.image" -}}
 {{$body := index .Content "body" -}}
 {{$url := index .Content "url" -}}
 {{if $body -}}
-Caption: {{$body}}
+{{wrapHanging (printf "%s: " (t "message.caption")) $body}}
 {{end -}}
 {{if $url -}}
-Image URL: {{$url}}
+{{t "message.image_url"}}: {{$url}}
 {{end -}}
 {{else if eq $msgtype "m.video" -}}
 {{$body := index .Content "body" -}}
 {{$url := index .Content "url" -}}
 {{if $body -}}
-Caption: {{$body}}
+{{wrapHanging (printf "%s: " (t "message.caption")) $body}}
 {{end -}}
 {{if $url -}}
-Video URL: {{$url}}
+{{t "message.video_url"}}: {{$url}}
 {{end -}}
 {{else if eq $msgtype "m.file" -}}
 {{$body := index .Content "body" -}}
 {{$url := index .Content "url" -}}
 {{if $body -}}
-Filename: {{$body}}
+{{t "message.filename"}}: {{$body}}
 {{end -}}
+{{with .File}}{{if .Size -}}
+{{t "message.file_size"}}: {{formatSize .Size}}
+{{end}}{{end -}}
 {{if $url -}}
-File URL: {{$url}}
+{{t "message.file_url"}}: {{$url}}
 {{end -}}
 {{else if eq $msgtype "m.audio" -}}
 {{$body := index .Content "body" -}}
 {{$url := index .Content "url" -}}
 {{if $body -}}
-Caption: {{$body}}
+{{wrapHanging (printf "%s: " (t "message.caption")) $body}}
 {{end -}}
 {{if $url -}}
-Audio URL: {{$url}}
+{{t "message.audio_url"}}: {{$url}}
 {{end -}}
 {{else if eq $msgtype "m.notice" -}}
 {{$body := index .Content "body" -}}
 {{if $body -}}
-Notice: {{$body}}
+{{wrapHanging (printf "%s: " (t "message.notice")) $body}}
 {{end -}}
 {{else -}}
 {{$body := index .Content "body" -}}
 {{if $body -}}
-{{$body}}
+{{wrap $body}}
 {{else -}}
-[Unknown message type: {{$msgtype}}]
+[{{t "message.unknown_type" $msgtype}}]
 {{end -}}
 {{end -}}
 {{else -}}
 {{$body := index .Content "body" -}}
 {{if $body -}}
-{{$body}}
+{{wrap $body}}
 {{else -}}
-[No message content]
+[{{t "message.no_content"}}]
+{{end -}}
 {{end -}}
+{{range .Annotations -}}
+{{$note := .Note}}{{if .Author}}{{$note = printf "%s — %s" .Note .Author}}{{end -}}
+{{wrapHanging (printf "[%s] " (t "annotations.note" .Number)) $note}}
 {{end -}}
 
 {{end}}
@@ -1,9 +1,9 @@
 <!DOCTYPE html>
-<html lang="en">
+<html lang="{{lang}}" data-theme="{{theme}}">
 <head>
     <meta charset="UTF-8">
     <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>Matrix Chat Archive - Enhanced</title>
+    <title>{{with .Room.Name}}{{.}} – {{end}}{{t "archive.title"}}</title>
     <style>
         * {
             box-sizing: border-box;
@@ -44,6 +44,38 @@
             opacity: 0.9;
         }
 
+        .room-info {
+            margin-top: 12px;
+        }
+
+        .room-info .room-name {
+            font-size: 1.4rem;
+        }
+
+        .room-info .room-alias,
+        .room-info .room-created {
+            font-size: 0.9rem;
+            opacity: 0.85;
+        }
+
+        .room-info .room-topic {
+            margin: 6px 0;
+            white-space: pre-line;
+        }
+
+        .room-labels {
+            margin-top: 12px;
+        }
+
+        .room-label {
+            display: inline-block;
+            background: rgba(255, 255, 255, 0.2);
+            border-radius: 12px;
+            padding: 2px 10px;
+            margin: 0 4px;
+            font-size: 0.85rem;
+        }
+
         .stats-bar {
             background: rgba(255, 255, 255, 0.15);
             border-radius: 8px;
@@ -59,6 +91,64 @@
             flex: 1;
         }
 
+        .month-index {
+            display: flex;
+            flex-wrap: wrap;
+            gap: 6px 12px;
+            margin: 0 0 16px;
+            font-size: 0.9rem;
+        }
+
+        .month-index a {
+            color: white;
+        }
+
+        .archive-search {
+            margin: 0 0 20px;
+        }
+
+        .archive-search input {
+            width: 100%;
+            padding: 10px 14px;
+            border: none;
+            border-radius: 8px;
+            font-size: 1rem;
+        }
+
+        .search-results {
+            margin: 8px 0 0;
+            padding: 0 0 0 1.5em;
+            max-height: 50vh;
+            overflow-y: auto;
+            color: white;
+        }
+
+        .search-results a {
+            color: white;
+        }
+
+        .message.search-target {
+            outline: 3px solid #667eea;
+        }
+
+        .load-more {
+            display: block;
+            width: 100%;
+            padding: 12px;
+            margin: 8px 0;
+            border: 1px dashed #cbd5e0;
+            border-radius: 8px;
+            background: transparent;
+            color: #4a5568;
+            cursor: pointer;
+        }
+
+        .archive-summary {
+            font-size: 0.9rem;
+            opacity: 0.8;
+            text-align: center;
+        }
+
         .stat-number {
             font-size: 1.5rem;
             font-weight: bold;
@@ -189,6 +279,12 @@
             font-size: 14px;
         }
 
+        .reaction-emoji img, .message-body img[data-mx-emoticon] {
+            height: 1.5em;
+            width: auto;
+            vertical-align: middle;
+        }
+
         .reaction-count {
             color: #4a5568;
             font-weight: 500;
@@ -329,6 +425,18 @@
             background: #3182ce;
         }
 
+        .file-row {
+            display: flex;
+            flex-wrap: wrap;
+            align-items: center;
+            gap: 12px;
+        }
+
+        .file-meta {
+            color: #718096;
+            font-size: 13px;
+        }
+
         @media (max-width: 768px) {
             .container {
                 padding: 10px;
@@ -361,37 +469,297 @@
                 flex: none;
             }
         }
+
+        .participants {
+            background: white;
+            border-radius: 12px;
+            padding: 20px 30px;
+            margin-bottom: 30px;
+        }
+
+        .participants h2 {
+            font-size: 1.2rem;
+            margin-top: 0;
+        }
+
+        .participants table {
+            width: 100%;
+            border-collapse: collapse;
+            font-size: 14px;
+        }
+
+        .participants th,
+        .participants td {
+            text-align: left;
+            padding: 6px 8px;
+            border-bottom: 1px solid #f1f5f9;
+        }
+
+        .participants .user-id {
+            display: block;
+        }
+
+        .permalink {
+            color: #4299e1;
+            text-decoration: none;
+        }
+
+        .footnote-ref a {
+            color: #4299e1;
+            text-decoration: none;
+        }
+
+        .footnotes {
+            background: white;
+            border-radius: 12px;
+            margin-top: 20px;
+            padding: 20px 30px;
+        }
+
+        .footnotes h2 {
+            font-size: 1.2rem;
+            margin-top: 0;
+        }
+
+        .footnote-author {
+            color: #718096;
+        }
+
+        .message.highlighted {
+            border-left: 4px solid #ecc94b;
+            background-color: #fffbeb;
+        }
+
+        .highlight-badge {
+            background: #ecc94b;
+            color: #1a202c;
+            padding: 2px 8px;
+            border-radius: 12px;
+            font-size: 10px;
+            font-weight: 500;
+            text-transform: uppercase;
+        }
+
+        .context-break {
+            text-align: center;
+            color: #a0aec0;
+            font-size: 12px;
+            padding: 8px;
+            background: #f7fafc;
+            border-bottom: 1px solid #f1f5f9;
+        }
     </style>
+    {{if eq theme "dark"}}
+    <style>{{template "dark-theme"}}</style>
+    {{else if eq theme "auto"}}
+    <style>@media (prefers-color-scheme: dark) { {{template "dark-theme"}} }</style>
+    {{end}}
+    {{with customCSS}}
+    <style>{{.}}</style>
+    {{end}}
 </head>
 <body>
     <div class="container">
         <div class="header">
-            <h1>💬 Matrix Chat Archive - Enhanced</h1>
-            <div class="subtitle">Comprehensive message history with real usernames</div>
+            <h1>💬 {{t "archive.title"}}</h1>
+            <div class="subtitle">{{t "archive.subtitle"}}</div>
+            {{if or .Room.Name .Room.CanonicalAlias .Room.Topic .Room.CreatedAt}}
+            <div class="room-info">
+                {{with .Room.Name}}<div class="room-name">{{.}}</div>{{end}}
+                {{with .Room.CanonicalAlias}}<div class="room-alias">{{.}}</div>{{end}}
+                {{with .Room.Topic}}<div class="room-topic">{{.}}</div>{{end}}
+                {{with .Room.CreatedAt}}<div class="room-created">{{t "room.created"}} {{formatTime .}}</div>{{end}}
+            </div>
+            {{end}}
+            {{with .Room.Labels}}
+            <div class="room-labels">
+                {{range .}}<span class="room-label">{{.}}</span>{{end}}
+            </div>
+            {{end}}
             
             <div class="stats-bar">
                 <div class="stat-item">
-                    <span class="stat-number">{{len .}}</span>
-                    <span>Messages</span>
+                    <span class="stat-number">{{.Stats.Messages}}</span>
+                    <span>{{t "stats.messages"}}</span>
                 </div>
                 <div class="stat-item">
-                    <span class="stat-number">{{countUniqueUsers .}}</span>
-                    <span>Users</span>
+                    <span class="stat-number">{{.Stats.Users}}</span>
+                    <span>{{t "stats.users"}}</span>
                 </div>
                 <div class="stat-item">
-                    <span class="stat-number">{{countPlatforms .}}</span>
-                    <span>Platforms</span>
+                    <span class="stat-number">{{.Stats.Platforms}}</span>
+                    <span>{{t "stats.platforms"}}</span>
                 </div>
                 <div class="stat-item">
-                    <span class="stat-number">{{countReactions .}}</span>
-                    <span>Reactions</span>
+                    <span class="stat-number">{{.Stats.Reactions}}</span>
+                    <span>{{t "stats.reactions"}}</span>
                 </div>
             </div>
+            {{with .Room.Activity}}
+            <div class="archive-summary">{{t "stats.archive_summary" .Messages .Senders .ActiveDays (.FirstMessage.Format "January 2, 2006") (.LastMessage.Format "January 2, 2006")}}</div>
+            {{end}}
+        </div>
+
+        {{with .Archive.SearchIndex}}
+        <div class="archive-search" role="search">
+            <input type="search" id="archive-search-input" data-index="{{.}}" data-no-results="{{t "search.no_results"}}" placeholder="{{t "search.placeholder"}}" aria-label="{{t "search.label"}}" autocomplete="off">
+            <ol id="archive-search-results" class="search-results" aria-live="polite"></ol>
         </div>
+        <script>{{searchScript}}</script>
+        {{end}}
+
+        {{with .Participants}}
+        <section class="participants">
+            <h2>{{t "participants.title"}}</h2>
+            <table>
+                <thead>
+                    <tr>
+                        <th>{{t "participants.name"}}</th>
+                        <th>{{t "participants.platform"}}</th>
+                        <th>{{t "stats.messages"}}</th>
+                        <th>{{t "participants.active"}}</th>
+                        <th>{{t "participants.joined"}}</th>
+                        <th>{{t "participants.left"}}</th>
+                    </tr>
+                </thead>
+                <tbody>
+                {{range .}}
+                    <tr>
+                        <td>{{.DisplayName}} <span class="user-id">{{.UserID}}</span></td>
+                        <td>{{.Platform}}</td>
+                        <td>{{.MessageCount}}</td>
+                        <td>{{formatTime .FirstMessage}} – {{formatTime .LastMessage}}</td>
+                        <td>{{formatTime .Joined}}</td>
+                        <td>{{formatTime .Left}}</td>
+                    </tr>
+                {{end}}
+                </tbody>
+            </table>
+        </section>
+        {{end}}
+
+        {{with lazySections}}
+        <nav class="month-index" aria-label="{{t "lazy.months"}}">
+            {{range .}}{{if .Month}}<a href="#{{.Month}}">{{.Label}}</a>{{end}}{{end}}
+        </nav>
+        {{end}}
 
         <div class="chat-container">
+            {{with lazySections}}
+            {{range .}}
+            {{with .Month}}<a id="{{.}}" class="month-anchor"></a>{{end}}
+            <div class="lazy-section" id="{{.ID}}"{{with .Src}} data-src="{{.}}"{{end}}>
+                {{if .Messages}}{{template "messages" .Messages}}{{else}}<button type="button" class="load-more">{{t "lazy.load_more" .Count .Label}}</button>{{end}}
+            </div>
+            {{end}}
+            <script>{{lazyLoadScript}}</script>
+            {{else}}
+            {{template "messages" .Messages}}
+            {{end}}
+        </div>
+
+        {{if hasAnnotations .Messages}}
+        <section class="footnotes">
+            <h2>{{t "annotations.title"}}</h2>
+            <ol>
+            {{range .Messages}}{{range .Annotations}}
+                <li id="note-{{.Number}}" value="{{.Number}}">
+                    {{.Note}}{{if .Author}} <span class="footnote-author">— {{.Author}}</span>{{end}}
+                    <a href="#ref-{{.Number}}" aria-label="{{t "annotations.back"}}">↩</a>
+                </li>
+            {{end}}{{end}}
+            </ol>
+        </section>
+        {{end}}
+
+        <div class="footer">
+            Generated by Matrix Archive with enhanced bridge mapping<br>
+            <small>{{countBridgeUsers .Messages}} Discord users mapped • {{.Stats.Messages}} total messages</small>
+        </div>
+    </div>
+</body>
+</html>
+
+{{define "dark-theme"}}
+        body {
+            color: #e2e8f0;
+            background: linear-gradient(135deg, #1a202c 0%, #2d1f3d 100%);
+        }
+
+        .chat-container {
+            background: #1e2533;
+        }
+
+        .message {
+            border-bottom-color: #2d3748;
+        }
+
+        .message:hover {
+            background-color: #252d3d;
+        }
+
+        .display-name, .message-body {
+            color: #e2e8f0;
+        }
+
+        .user-id, .edit-indicator, .reaction-count {
+            color: #a0aec0;
+        }
+
+        .reaction, .file-attachment, .event-id, .reply-indicator, .formatted-content code {
+            background: #2d3748;
+            border-color: #4a5568;
+            color: #e2e8f0;
+        }
+
+        .reaction:hover, .file-attachment:hover, .event-id:hover {
+            background: #4a5568;
+        }
+
+        .message-type-badge {
+            background: #2d3748;
+            color: #cbd5e0;
+        }
+
+        .formatted-content pre {
+            background: #111827;
+        }
+
+        .footnotes {
+            background: #1e2533;
+        }
+
+        .message.highlighted {
+            background-color: #3a3320;
+        }
+
+        .context-break {
+            background: #171c27;
+            border-bottom-color: #2d3748;
+        }
+
+        .participants {
+            background: #1e2533;
+        }
+
+        .participants th,
+        .participants td {
+            border-bottom-color: #2d3748;
+        }
+{{end}}
+
+{{define "messages"}}
             {{range $index, $message := .}}
-            <div class="message">
+            {{with .RoomUpgrade}}
+            <div class="context-break room-upgrade" role="separator">{{if .RoomVersion}}{{t "room.upgraded_version" .RoomVersion}}{{else}}{{t "room.upgraded"}}{{end}}</div>
+            {{end}}
+            {{if .ContextBreak}}
+            <div class="context-break" role="separator">{{t "highlights.omitted"}}</div>
+            {{end}}
+            {{if .ConversationStart}}
+            <div class="context-break conversation-break" role="separator" id="conversation-{{.ConversationID}}">{{t "conversation.start" .ConversationID}}</div>
+            {{end}}
+            <div class="message{{if .Highlights}} highlighted{{end}}"{{with .EventID}} id="{{messageAnchor .}}"{{end}}>
                 <div class="message-header">
                     <div class="user-avatar">
                         {{if .UserAvatar}}{{.UserAvatar}}{{else}}{{if .DisplayName}}{{substr .DisplayName 0 1 | upper}}{{else}}?{{end}}{{end}}
@@ -402,8 +770,11 @@
                             {{if .Platform}}
                                 <span class="platform-badge {{.Platform | lower}}">{{.Platform}}</span>
                             {{end}}
+                            {{range .Highlights}}
+                                <span class="highlight-badge">{{t (printf "highlights.%s" .)}}</span>
+                            {{end}}
                         </div>
-                        <div class="user-id">{{.UserID}}</div>
+                        <div class="user-id">{{.UserID}}{{with .PlatformHandle}} · {{.}}{{end}}</div>
                     </div>
                     <div class="timestamp">{{formatTime .Timestamp}}</div>
                     {{$msgtype := index .Content "msgtype"}}
@@ -413,9 +784,19 @@
                 </div>
 
                 <div class="message-content">
+                    {{with .ForwardedFrom}}
+                        <div class="reply-indicator forward-indicator">
+                            ↪ {{t "message.forwarded_from" .}}{{with $message.ForwardedPlatform}} ({{.}}){{end}}
+                        </div>
+                    {{end}}
+                    {{with .Truncated}}
+                        <div class="reply-indicator truncated-indicator">
+                            ✂ {{t "message.truncated" (formatSize .OriginalSize)}}
+                        </div>
+                    {{end}}
                     {{if .RepliesTo}}
                         <div class="reply-indicator">
-                            ↳ Replying to {{.RepliesTo.DisplayName}}: {{.RepliesTo.Content | truncate 100}}
+                            ↳ {{t "message.replying_to" .RepliesTo.DisplayName}}: {{.RepliesTo.Content | truncate 100}}
                         </div>
                     {{end}}
                     
@@ -435,24 +816,43 @@
                         <div class="message-body">
                             {{if $body}}<p>{{$body}}</p>{{end}}
                             {{if $url}}
-                                <img src="{{$url}}" alt="{{if $body}}{{$body}}{{else}}Image{{end}}" loading="lazy" />
+                                <img src="{{$url}}" alt="{{if $body}}{{$body}}{{else}}{{t "message.image"}}{{end}}" loading="lazy" />
                             {{end}}
                         </div>
                     {{else if eq $msgtype "m.video"}}
                         <div class="message-body">
                             {{if $body}}<p>{{$body}}</p>{{end}}
-                            {{if $url}}
-                                <video controls preload="metadata">
-                                    <source src="{{$url}}" type="video/mp4">
-                                    Your browser does not support the video tag.
+                            {{$duration := mediaDuration .Content}}
+                            {{if .Player}}
+                                <video controls preload="metadata" {{with .Player.Poster}}poster="{{mediaURL .}}"{{end}}>
+                                    <source src="{{mediaURL .Player.URL}}"{{with .Player.MimeType}} type="{{.}}"{{end}}>
+                                    {{t "message.video_unsupported"}}
                                 </video>
+                                {{if $duration}}<div class="file-row"><span class="file-meta">{{$duration}}</span></div>{{end}}
+                            {{else if $url}}
+                                <div class="file-row">
+                                    <a href="{{$url}}" class="file-attachment">{{t "message.video_url"}}</a>
+                                    {{if $duration}}<span class="file-meta">{{$duration}}</span>{{end}}
+                                </div>
                             {{end}}
                         </div>
                     {{else if eq $msgtype "m.file"}}
                         <div class="message-body">
-                            {{if $url}}
+                            {{if .File}}{{$file := .File}}
+                                <div class="file-row">
+                                    {{if $url}}
+                                        <a href="{{$url}}" class="file-attachment" download="{{$file.Name}}">
+                                            {{if $file.Name}}{{$file.Name}}{{else}}{{t "message.download_file"}}{{end}}
+                                        </a>
+                                    {{else}}
+                                        <span class="file-name">{{$file.Name}}</span>
+                                    {{end}}
+                                    {{if $file.MimeType}}<span class="file-meta">{{$file.MimeType}}</span>{{end}}
+                                    {{if $file.Size}}<span class="file-meta">{{formatSize $file.Size}}</span>{{end}}
+                                </div>
+                            {{else if $url}}
                                 <a href="{{$url}}" class="file-attachment" download>
-                                    {{if $body}}{{$body}}{{else}}Download File{{end}}
+                                    {{if $body}}{{$body}}{{else}}{{t "message.download_file"}}{{end}}
                                 </a>
                             {{else}}
                                 {{$body}}
@@ -461,11 +861,18 @@
                     {{else if eq $msgtype "m.audio"}}
                         <div class="message-body">
                             {{if $body}}<p>{{$body}}</p>{{end}}
-                            {{if $url}}
+                            {{$duration := mediaDuration .Content}}
+                            {{if .Player}}
                                 <audio controls preload="metadata">
-                                    <source src="{{$url}}" type="audio/mpeg">
-                                    Your browser does not support the audio element.
+                                    <source src="{{mediaURL .Player.URL}}"{{with .Player.MimeType}} type="{{.}}"{{end}}>
+                                    {{t "message.audio_unsupported"}}
                                 </audio>
+                                {{if $duration}}<div class="file-row"><span class="file-meta">{{$duration}}</span></div>{{end}}
+                            {{else if $url}}
+                                <div class="file-row">
+                                    <a href="{{$url}}" class="file-attachment">{{t "message.audio_url"}}</a>
+                                    {{if $duration}}<span class="file-meta">{{$duration}}</span>{{end}}
+                                </div>
                             {{end}}
                         </div>
                     {{else if eq $msgtype "m.notice"}}
@@ -481,22 +888,29 @@
                             {{if $body}}
                                 {{$body}}
                             {{else}}
-                                <em style="color: #a0aec0;">Unknown message type: {{$msgtype}}</em>
+                                <em style="color: #a0aec0;">{{t "message.unknown_type" $msgtype}}</em>
                             {{end}}
                         </div>
                     {{end}}
 
                     <div class="meta-info">
-                        <span class="event-id" title="Event ID">{{.EventID}}</span>
+                        <span class="event-id" title="{{t "meta.event_id"}}">{{.EventID}}</span>
                         <span>•</span>
-                        <span title="Message Type">{{.MessageType}}</span>
+                        <span title="{{t "meta.message_type"}}">{{.MessageType}}</span>
+                        {{with .Permalink}}
+                            <span>•</span>
+                            <a class="permalink" href="{{.}}" target="_blank" rel="noopener">{{t "meta.permalink"}}</a>
+                        {{end}}
+                        {{range .Annotations}}
+                            <sup class="footnote-ref"><a href="#note-{{.Number}}" id="ref-{{.Number}}" title="{{.Note}}">[{{.Number}}]</a></sup>
+                        {{end}}
                     </div>
                     
                     {{if .Reactions}}
                         <div class="reactions-container">
                             {{range .Reactions}}
                                 <div class="reaction" title="{{range $i, $user := .Users}}{{if $i}}, {{end}}{{$user}}{{end}}">
-                                    <span class="reaction-emoji">{{.Emoji}}</span>
+                                    <span class="reaction-emoji">{{if .Image}}<img src="{{mediaURL .Image}}" alt="{{with .Shortcode}}:{{.}}:{{else}}{{t "message.custom_emoji"}}{{end}}" title="{{with .Shortcode}}:{{.}}:{{else}}{{t "message.custom_emoji"}}{{end}}">{{else}}{{.Emoji}}{{end}}</span>
                                     <span class="reaction-count">{{.Count}}</span>
                                 </div>
                             {{end}}
@@ -511,12 +925,4 @@
                 </div>
             </div>
             {{end}}
-        </div>
-
-        <div class="footer">
-            Generated by Matrix Archive with enhanced bridge mapping<br>
-            <small>{{countBridgeUsers .}} Discord users mapped • {{len .}} total messages</small>
-        </div>
-    </div>
-</body>
-</html>
\ No newline at end of file
+{{end}}
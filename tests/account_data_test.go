@@ -0,0 +1,51 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoomOrganizationLabels(t *testing.T) {
+	var none *archive.RoomOrganization
+	assert.Empty(t, none.Labels())
+
+	room := &archive.RoomOrganization{
+		Tags:   []string{"m.favourite", "u.Work", "m.lowpriority", "m.server_notice", "u."},
+		Direct: true,
+	}
+	assert.Equal(t, []string{"room.direct", "room.favourite", "Work", "room.low_priority"}, room.Labels())
+}
+
+func TestGetRoomOrganization(t *testing.T) {
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 5})
+	ctx := context.Background()
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	require.NoError(t, db.SetRoomTags(ctx, "!team:example.com", []*archive.RoomTag{{RoomID: "!team:example.com", Tag: "m.favourite"}}))
+	require.NoError(t, db.SetDirectRooms(ctx, map[string][]string{
+		"@bob:example.com":   {"!dm:example.com"},
+		"@alice:example.com": {"!dm:example.com", "!other:example.com"},
+	}))
+
+	room, err := archive.GetRoomOrganization(ctx, db, "!team:example.com")
+	require.NoError(t, err)
+	require.NotNil(t, room)
+	assert.Equal(t, []string{"m.favourite"}, room.Tags)
+	assert.False(t, room.Direct)
+
+	room, err = archive.GetRoomOrganization(ctx, db, "!dm:example.com")
+	require.NoError(t, err)
+	require.NotNil(t, room)
+	assert.True(t, room.Direct)
+	assert.Equal(t, []string{"@alice:example.com", "@bob:example.com"}, room.DirectWith)
+
+	room, err = archive.GetRoomOrganization(ctx, db, "!plain:example.com")
+	require.NoError(t, err)
+	assert.Nil(t, room)
+}
@@ -0,0 +1,103 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestNewBundledAggregations(t *testing.T) {
+	var relations event.Relations
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"m.annotation": {"chunk": [{"type": "m.reaction", "key": "👍", "count": 3}, {"type": "m.reaction", "key": "🎉", "count": 1}]},
+		"m.replace": {"chunk": [{"type": "m.room.message", "event_id": "$edit"}]},
+		"m.thread": {"count": 4}
+	}`), &relations))
+
+	agg := archive.NewBundledAggregations(&relations)
+	require.NotNil(t, agg)
+	assert.Equal(t, map[string]int{"👍": 3, "🎉": 1}, agg.Reactions)
+	assert.Equal(t, []string{"$edit"}, agg.Edits)
+	assert.Equal(t, 4, agg.ThreadReplies)
+
+	assert.Nil(t, archive.NewBundledAggregations(nil))
+	assert.Nil(t, archive.NewBundledAggregations(&event.Relations{}), "events without relations have no aggregations")
+}
+
+func TestApplyAggregations(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	reaction := func(eventID, sender, target, key string, minutes int) *archive.Message {
+		return &archive.Message{EventID: eventID, Sender: sender, MessageType: archive.EventTypeReaction, Timestamp: start.Add(time.Duration(minutes) * time.Minute),
+			Content: map[string]interface{}{"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": target, "key": key}}}
+	}
+	messages := []*archive.Message{
+		{EventID: "$1", Sender: "@alice:example.org", Timestamp: start, Content: map[string]interface{}{"msgtype": "m.text", "body": "hello"},
+			Aggregations: &archive.BundledAggregations{Reactions: map[string]int{"👍": 3, "🎉": 1}, ThreadReplies: 2}},
+		reaction("$r1", "@bob:example.org", "$1", "👍", 1),
+		reaction("$r2", "@carol:example.org", "$1", "👍", 2),
+		{EventID: "$2", Sender: "@bob:example.org", Timestamp: start.Add(3 * time.Minute), Content: map[string]interface{}{"msgtype": "m.text", "body": "typo"}},
+		{EventID: "$e2", Sender: "@bob:example.org", Timestamp: start.Add(5 * time.Minute), Content: map[string]interface{}{"msgtype": "m.text", "body": "* fixed",
+			"m.new_content": map[string]interface{}{"msgtype": "m.text", "body": "fixed"},
+			"m.relates_to":  map[string]interface{}{"rel_type": "m.replace", "event_id": "$2"}}},
+		{EventID: "$3", Sender: "@carol:example.org", Timestamp: start.Add(6 * time.Minute), Content: map[string]interface{}{"msgtype": "m.text", "body": "later"},
+			Aggregations: &archive.BundledAggregations{Edits: []string{"$unarchived"}}},
+	}
+	exported := []archive.ExportMessage{{EventID: "$1"}, {EventID: "$2"}, {EventID: "$3"}}
+	archive.ApplyAggregations(exported, messages)
+
+	require.Len(t, exported[0].Reactions, 2)
+	thumbs := exported[0].Reactions[0]
+	assert.Equal(t, "👍", thumbs.Emoji)
+	assert.Equal(t, 3, thumbs.Count, "the server's count covers reactions that weren't archived")
+	assert.Equal(t, []string{"@bob:example.org", "@carol:example.org"}, thumbs.Users)
+	assert.Equal(t, archive.MessageReaction{Emoji: "🎉", Users: []string{}, Count: 1}, exported[0].Reactions[1], "reactions known only from the server")
+	require.NotNil(t, exported[0].ThreadInfo)
+	assert.Equal(t, 2, exported[0].ThreadInfo.ReplyCount)
+	assert.False(t, exported[0].IsEdited)
+
+	assert.True(t, exported[1].IsEdited)
+	require.Len(t, exported[1].EditHistory, 1)
+	assert.Equal(t, "fixed", exported[1].EditHistory[0].NewContent)
+	assert.Empty(t, exported[1].Reactions)
+
+	assert.True(t, exported[2].IsEdited, "edits the server bundled mark a message edited")
+	assert.Empty(t, exported[2].EditHistory)
+}
+
+func TestPublishedBundledReactions(t *testing.T) {
+	messages := []archive.ExportMessage{{EventID: "$1", UserID: "@alice:example.org", Reactions: []archive.MessageReaction{
+		{Emoji: "👍", Users: []string{"@carol:example.org", "@bob:example.org"}, Count: 4},
+		{Emoji: "🎉", Users: []string{}, Count: 2},
+		{Emoji: "👀", Users: []string{"@carol:example.org"}, Count: 1},
+	}}}
+	published := archive.NewPublisher(&archive.PublishConfig{OptOut: []string{"@carol:example.org"}}).Apply(messages)
+	require.Len(t, published, 1)
+	assert.Equal(t, []archive.MessageReaction{
+		{Emoji: "👍", Users: []string{"@bob:example.org"}, Count: 3},
+		{Emoji: "🎉", Count: 2},
+	}, published[0].Reactions, "reactions the server counted keep their count without names")
+}
+
+func TestDuckDBBundledAggregations(t *testing.T) {
+	ctx := context.Background()
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	msg := &archive.Message{RoomID: "!room:example.org", EventID: "$1", Sender: "@alice:example.org", MessageType: archive.EventTypeMessage,
+		Timestamp: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC), Content: map[string]interface{}{"msgtype": "m.text", "body": "hello"},
+		Aggregations: &archive.BundledAggregations{Reactions: map[string]int{"👍": 3}}}
+	_, err := db.InsertMessageBatch(ctx, []*archive.Message{msg})
+	require.NoError(t, err)
+
+	stored, err := db.GetMessage(ctx, "$1")
+	require.NoError(t, err)
+	assert.Equal(t, msg.Aggregations, stored.Aggregations)
+}
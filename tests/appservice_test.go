@@ -0,0 +1,102 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix"
+)
+
+func TestNewAppServiceRegistration(t *testing.T) {
+	reg, err := archive.NewAppServiceRegistration("http://localhost:29340", "", []string{"!room:example.org", "#lobby:example.org", `^!.*:chat\.example\.org$`})
+	require.NoError(t, err)
+	assert.Equal(t, archive.DefaultAppServiceSender, reg.SenderLocalpart)
+	assert.Len(t, reg.AppToken, 64)
+	assert.Len(t, reg.ServerToken, 64)
+	assert.NotEqual(t, reg.AppToken, reg.ServerToken)
+	assert.Equal(t, []archive.AppServiceNamespace{{Regex: `^!room:example\.org$`}, {Regex: `^!.*:chat\.example\.org$`}}, reg.Namespaces.Rooms)
+	assert.Equal(t, []archive.AppServiceNamespace{{Regex: `^#lobby:example\.org$`}}, reg.Namespaces.Aliases)
+
+	path := filepath.Join(t.TempDir(), "registration.yaml")
+	require.NoError(t, reg.Save(path))
+	loaded, err := archive.LoadAppServiceRegistration(path)
+	require.NoError(t, err)
+	assert.Equal(t, reg, loaded)
+
+	_, err = archive.NewAppServiceRegistration("http://localhost:29340", "", nil)
+	assert.Error(t, err, "a registration needs rooms")
+	_, err = archive.NewAppServiceRegistration("http://localhost:29340", "", []string{"^!(:example.org"})
+	assert.Error(t, err, "room patterns must compile")
+}
+
+func newAppServiceHandler(t *testing.T, db archive.DatabaseInterface) (*archive.AppServiceHandler, *archive.AppServiceRegistration) {
+	reg, err := archive.NewAppServiceRegistration("http://localhost:29340", "", []string{"!room:example.org"})
+	require.NoError(t, err)
+	client, err := mautrix.NewClient("https://example.org", "", reg.AppToken)
+	require.NoError(t, err)
+	enhanced, err := archive.NewEnhancedMatrixClient(client, db)
+	require.NoError(t, err)
+	return archive.NewAppServiceHandler(reg, enhanced, nil), reg
+}
+
+func TestAppServiceHandlerAuthorization(t *testing.T) {
+	handler, reg := newAppServiceHandler(t, nil)
+	request := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/app/v1/ping", strings.NewReader("{}"))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, request(reg.ServerToken).Code)
+	assert.Equal(t, http.StatusUnauthorized, request("").Code)
+	rec := request(reg.AppToken)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "the homeserver proves itself with hs_token")
+	assert.Contains(t, rec.Body.String(), "M_FORBIDDEN")
+
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/app/v1/users/@someone:example.org?access_token="+reg.ServerToken, nil)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code, "older homeservers send the token as a query parameter")
+}
+
+func TestAppServiceTransaction(t *testing.T) {
+	ctx := context.Background()
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	handler, reg := newAppServiceHandler(t, db)
+	body := `{"events": [{
+		"type": "m.room.message",
+		"event_id": "$Rqnc-F-dvnEYJTyHq_iKxU2bZ1CI92-kuZq3a5lr5Zg",
+		"room_id": "!room:example.org",
+		"sender": "@alice:example.org",
+		"origin_server_ts": 1717236000000,
+		"content": {"msgtype": "m.text", "body": "hello"}
+	}]}`
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/1", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+reg.ServerToken)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	messages, err := db.GetMessages(ctx, &archive.MessageFilter{RoomID: "!room:example.org"}, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, messages, 1, "a transaction sent again is archived once")
+	assert.Equal(t, "hello", messages[0].Content["body"])
+	assert.Equal(t, 1, handler.Archived())
+}
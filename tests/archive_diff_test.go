@@ -0,0 +1,129 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func diffTestMessage(eventID, body string, ts time.Time) *archive.Message {
+	return &archive.Message{
+		RoomID:      "!room:example.com",
+		EventID:     eventID,
+		Sender:      "@alice:example.com",
+		MessageType: "m.room.message",
+		Timestamp:   ts,
+		Content:     map[string]interface{}{"msgtype": "m.text", "body": body},
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	a := diffTestMessage("$a", "hello", ts)
+	b := diffTestMessage("$b", "hello", ts.Add(300*time.Microsecond))
+	c := diffTestMessage("$a", "goodbye", ts)
+
+	// Event IDs and sub-millisecond precision don't affect the hash
+	assert.Equal(t, archive.ContentHash(a), archive.ContentHash(b))
+	assert.NotEqual(t, archive.ContentHash(a), archive.ContentHash(c))
+}
+
+func TestNormalizedContentHash(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	original := diffTestMessage("$a", "see you  tomorrow", ts)
+	original.Content["m.relates_to"] = map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": "$parent-a"}}
+
+	// Re-bridged: new room and event ID, HTML formatting, a reply fallback
+	// quoting the parent and the timestamp rounded differently
+	rebridged := diffTestMessage("$b", "> <@bob:example.com> are you coming?\n\nsee you tomorrow", ts.Add(400*time.Millisecond))
+	rebridged.RoomID = "!portal:example.com"
+	rebridged.Content["format"] = "org.matrix.custom.html"
+	rebridged.Content["formatted_body"] = "<mx-reply>...</mx-reply>see you tomorrow"
+	rebridged.Content["m.relates_to"] = map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": "$parent-a"}}
+
+	assert.Equal(t, archive.NormalizedContentHash(original), archive.NormalizedContentHash(rebridged))
+	assert.NotEqual(t, archive.ContentHash(original), archive.ContentHash(rebridged))
+
+	// The same reply or reaction to another event in the same second is another message
+	otherParent := diffTestMessage("$b2", "see you tomorrow", ts)
+	otherParent.Content["m.relates_to"] = map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": "$parent-b"}}
+	assert.NotEqual(t, archive.NormalizedContentHash(original), archive.NormalizedContentHash(otherParent))
+	reaction := func(eventID, target string) *archive.Message {
+		msg := diffTestMessage(eventID, "", ts)
+		msg.MessageType = "m.reaction"
+		msg.Content = map[string]interface{}{"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": target, "key": "👍"}}
+		return msg
+	}
+	assert.Equal(t, archive.NormalizedContentHash(reaction("$r1", "$x")), archive.NormalizedContentHash(reaction("$r2", "$x")))
+	assert.NotEqual(t, archive.NormalizedContentHash(reaction("$r1", "$x")), archive.NormalizedContentHash(reaction("$r2", "$y")))
+
+	other := diffTestMessage("$c", "see you on friday", ts)
+	assert.NotEqual(t, archive.NormalizedContentHash(original), archive.NormalizedContentHash(other))
+
+	later := diffTestMessage("$d", "see you tomorrow", ts.Add(time.Minute))
+	assert.NotEqual(t, archive.NormalizedContentHash(original), archive.NormalizedContentHash(later))
+
+	// Media matches on what was uploaded, not where it is stored
+	image := func(eventID, url string) *archive.Message {
+		msg := diffTestMessage(eventID, "cat.png", ts)
+		msg.Content["msgtype"] = "m.image"
+		msg.Content["url"] = url
+		msg.Content["info"] = map[string]interface{}{"mimetype": "image/png", "size": 1234}
+		return msg
+	}
+	assert.Equal(t, archive.NormalizedContentHash(image("$e", "mxc://a/1")), archive.NormalizedContentHash(image("$f", "mxc://b/2")))
+}
+
+func TestDedupeMessages(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	messages := []*archive.Message{
+		diffTestMessage("$a", "hello", ts),
+		diffTestMessage("$b", "world", ts.Add(time.Minute)),
+		diffTestMessage("$a-rebridged", "hello", ts),
+	}
+	messages[2].RoomID = "!portal:example.com"
+
+	deduped := archive.DedupeMessages(messages)
+	require.Len(t, deduped, 2)
+	assert.Equal(t, "$a", deduped[0].EventID)
+	assert.Equal(t, "$b", deduped[1].EventID)
+}
+
+func TestDiffMessages(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	a := []*archive.Message{
+		diffTestMessage("$common", "same", ts),
+		diffTestMessage("$edited", "before", ts.Add(time.Minute)),
+		diffTestMessage("$reimported-a", "moved", ts.Add(2*time.Minute)),
+		diffTestMessage("$only-a", "lost", ts.Add(3*time.Minute)),
+	}
+	b := []*archive.Message{
+		diffTestMessage("$common", "same", ts),
+		diffTestMessage("$edited", "after", ts.Add(time.Minute)),
+		diffTestMessage("$reimported-b", "moved", ts.Add(2*time.Minute)),
+		diffTestMessage("$only-b", "new", ts.Add(4*time.Minute)),
+	}
+
+	diff := archive.DiffMessages(a, b)
+	assert.False(t, diff.Identical())
+	assert.Equal(t, 2, diff.CommonCount)
+
+	require.Len(t, diff.Changed, 1)
+	assert.Equal(t, "$edited", diff.Changed[0].A.EventID)
+
+	require.Len(t, diff.ContentMatches, 1)
+	assert.Equal(t, "$reimported-a", diff.ContentMatches[0].A.EventID)
+	assert.Equal(t, "$reimported-b", diff.ContentMatches[0].B.EventID)
+
+	require.Len(t, diff.OnlyInA, 1)
+	assert.Equal(t, "$only-a", diff.OnlyInA[0].EventID)
+	require.Len(t, diff.OnlyInB, 1)
+	assert.Equal(t, "$only-b", diff.OnlyInB[0].EventID)
+
+	assert.True(t, archive.DiffMessages(a, a).Identical())
+}
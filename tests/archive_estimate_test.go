@@ -0,0 +1,83 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// estimateTestEvents returns n events a minute apart from start, every other
+// one an image of 1000 bytes
+func estimateTestEvents(start time.Time, n int) []*event.Event {
+	events := make([]*event.Event, n)
+	for i := range events {
+		content := map[string]interface{}{"msgtype": "m.text", "body": "hello"}
+		if i%2 == 1 {
+			content = map[string]interface{}{"msgtype": "m.image", "body": "cat.png", "url": "mxc://example.org/cat",
+				"info": map[string]interface{}{"size": float64(1000)}}
+		}
+		events[i] = &event.Event{
+			ID:        id.EventID(fmt.Sprintf("$%d-%d", start.Unix(), i)),
+			Type:      event.EventMessage,
+			Timestamp: start.Add(time.Duration(i) * time.Minute).UnixMilli(),
+			Content:   event.Content{Raw: content},
+		}
+	}
+	return events
+}
+
+func TestNewEstimateWindow(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := estimateTestEvents(start, 4)
+	events[0].Type = event.EventEncrypted
+	events[0].Content.Raw = map[string]interface{}{"algorithm": "m.megolm.v1.aes-sha2", "ciphertext": "abc"}
+	events[3].Content.Raw["info"] = map[string]interface{}{}
+
+	window := archive.NewEstimateWindow(events)
+	assert.Equal(t, start, window.From.UTC())
+	assert.Equal(t, start.Add(3*time.Minute), window.To.UTC())
+	assert.Equal(t, 4, window.Events)
+	assert.Equal(t, 1, window.Encrypted)
+	assert.Equal(t, 2, window.Media)
+	assert.Equal(t, 1, window.SizedMedia, "media without a size isn't sized")
+	assert.Equal(t, int64(1000), window.MediaBytes)
+	assert.Positive(t, window.ContentBytes)
+}
+
+func TestExtrapolateEstimate(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Three windows of 101 events spanning 100 minutes each, over 1000 minutes
+	first := archive.NewEstimateWindow(estimateTestEvents(start, 101))
+	middle := archive.NewEstimateWindow(estimateTestEvents(start.Add(450*time.Minute), 101))
+	last := archive.NewEstimateWindow(estimateTestEvents(start.Add(900*time.Minute), 101))
+	windows := []archive.EstimateWindow{last, first, middle}
+
+	estimate := archive.ExtrapolateEstimate(windows, first.From, last.To, false, 200*time.Millisecond)
+	assert.Equal(t, 303, estimate.SampledEvents)
+	assert.Equal(t, 3, estimate.Windows)
+	assert.False(t, estimate.Complete)
+	assert.InDelta(t, 1010, estimate.EstimatedEvents, 2, "about one event a minute")
+	assert.InDelta(t, 500, estimate.EstimatedMedia, 2)
+	assert.Equal(t, estimate.EstimatedMedia*1000, estimate.EstimatedMediaBytes)
+	assert.Zero(t, estimate.EncryptedShare)
+	assert.InDelta(t, 11*0.2, estimate.ImportSeconds, 0.001, "one request per 100 events")
+
+	quiet := archive.NewEstimateWindow(estimateTestEvents(start.Add(450*time.Minute), 11))
+	quiet.To = quiet.From.Add(100 * time.Minute)
+	sparse := archive.ExtrapolateEstimate([]archive.EstimateWindow{first, quiet, last}, first.From, last.To, false, 0)
+	assert.Less(t, sparse.EstimatedEvents, estimate.EstimatedEvents, "quieter windows extrapolate to fewer events")
+
+	complete := archive.ExtrapolateEstimate([]archive.EstimateWindow{first}, first.From, first.To, true, time.Second)
+	assert.Equal(t, int64(101), complete.EstimatedEvents)
+	assert.Equal(t, int64(50), complete.EstimatedMedia)
+	assert.True(t, complete.Complete)
+
+	empty := archive.ExtrapolateEstimate(nil, start, start, false, 0)
+	assert.Zero(t, empty.EstimatedEvents)
+}
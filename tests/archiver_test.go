@@ -0,0 +1,193 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiverMessages(t *testing.T) {
+	ctx := context.Background()
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	start := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	var messages []*archive.Message
+	for i := 0; i < 5; i++ {
+		roomID := "!a:example.org"
+		if i%2 == 1 {
+			roomID = "!b:example.org"
+		}
+		messages = append(messages, &archive.Message{
+			RoomID: roomID, EventID: fmt.Sprintf("$%d", i), Sender: "@alice:example.org", MessageType: "m.room.message",
+			// Inserted newest first, so order comes from the query
+			Timestamp: start.Add(time.Duration(5-i) * time.Minute),
+			Content:   map[string]interface{}{"msgtype": "m.text", "body": fmt.Sprintf("message %d", i)},
+		})
+	}
+	_, err := db.InsertMessageBatch(ctx, messages)
+	require.NoError(t, err)
+
+	a := archive.NewArchiver(db)
+
+	t.Run("every message, oldest first", func(t *testing.T) {
+		var ids []string
+		for msg, err := range a.Messages(ctx, nil) {
+			require.NoError(t, err)
+			ids = append(ids, msg.EventID)
+		}
+		assert.Equal(t, []string{"$4", "$3", "$2", "$1", "$0"}, ids)
+	})
+
+	t.Run("filtered", func(t *testing.T) {
+		var bodies []interface{}
+		for msg, err := range a.Messages(ctx, &archive.MessageFilter{RoomID: "!b:example.org"}) {
+			require.NoError(t, err)
+			bodies = append(bodies, msg.Content["body"])
+		}
+		assert.Equal(t, []interface{}{"message 3", "message 1"}, bodies)
+	})
+
+	t.Run("stopping early", func(t *testing.T) {
+		count := 0
+		for _, err := range a.Messages(ctx, nil) {
+			require.NoError(t, err)
+			count++
+			if count == 2 {
+				break
+			}
+		}
+		assert.Equal(t, 2, count)
+
+		// The connection is free again once the loop ends
+		rooms, err := a.Rooms(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"!a:example.org", "!b:example.org"}, rooms)
+		n, err := a.MessageCount(ctx, &archive.MessageFilter{RoomID: "!a:example.org"})
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), n)
+	})
+
+	t.Run("query errors are yielded", func(t *testing.T) {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		var errs []error
+		for msg, err := range a.Messages(canceled, nil) {
+			assert.Nil(t, msg)
+			errs = append(errs, err)
+		}
+		require.Len(t, errs, 1)
+		assert.True(t, errors.Is(errs[0], context.Canceled), errs[0])
+	})
+}
+
+func TestOpenArchiver(t *testing.T) {
+	ctx := context.Background()
+	a, err := archive.OpenArchiver(ctx, &archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, err)
+	defer a.Close()
+
+	count := 0
+	for _, err := range a.Messages(ctx, nil) {
+		require.NoError(t, err)
+		count++
+	}
+	assert.Zero(t, count)
+}
+
+// accountServer fakes the homeserver of an account in one room, serving
+// the room's history as a single page of messages with the given bodies
+func accountServer(t *testing.T, userID, roomID string, bodies ...string) *mautrix.Client {
+	var chunk []map[string]interface{}
+	for i, body := range bodies {
+		chunk = append(chunk, map[string]interface{}{
+			"type": "m.room.message", "event_id": fmt.Sprintf("$%s-%d", strings.Trim(roomID, "!"), i), "sender": userID, "room_id": roomID,
+			// Newest first, as backward pagination returns them
+			"origin_server_ts": time.Date(2024, 5, 1, 9, len(bodies)-i, 0, 0, time.UTC).UnixMilli(),
+			"content":          map[string]interface{}{"msgtype": "m.text", "body": body},
+		})
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/joined_rooms"):
+			json.NewEncoder(w).Encode(map[string]interface{}{"joined_rooms": []string{roomID}})
+		case strings.HasSuffix(r.URL.Path, "/messages"):
+			json.NewEncoder(w).Encode(map[string]interface{}{"chunk": chunk, "start": "s1"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"not found"}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	client, err := mautrix.NewClient(server.URL, "", "token")
+	require.NoError(t, err)
+	client.UserID = id.UserID(userID)
+	return client
+}
+
+func TestArchiverImportConcurrently(t *testing.T) {
+	ctx := context.Background()
+	accounts := []struct {
+		userID, roomID string
+		bodies         []string
+	}{
+		{"@alice:a.example.org", "!alice:a.example.org", []string{"a1", "a2", "a3"}},
+		{"@bob:b.example.org", "!bob:b.example.org", []string{"b1", "b2"}},
+	}
+
+	archivers := make([]*archive.Archiver, len(accounts))
+	for i, account := range accounts {
+		a, err := archive.OpenArchiver(ctx, &archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+		require.NoError(t, err)
+		defer a.Close()
+		a.SetAccount(archive.NewAccountWithClient(accountServer(t, account.userID, account.roomID, account.bodies...)))
+		archivers[i] = a
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(archivers))
+	for i, a := range archivers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = a.Import(ctx, &archive.ImportOptions{})
+		}()
+	}
+	wg.Wait()
+
+	// Each archive holds its own account's messages and no others
+	for i, account := range accounts {
+		require.NoError(t, errs[i])
+		rooms, err := archivers[i].Rooms(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []string{account.roomID}, rooms)
+		var bodies []string
+		for msg, err := range archivers[i].Messages(ctx, nil) {
+			require.NoError(t, err)
+			assert.Equal(t, account.userID, msg.Sender)
+			bodies = append(bodies, msg.Content["body"].(string))
+		}
+		assert.ElementsMatch(t, account.bodies, bodies)
+	}
+}
+
+func TestArchiverImportNeedsAccount(t *testing.T) {
+	a := archive.NewArchiver(nil)
+	assert.ErrorContains(t, a.Import(context.Background(), nil), "no Matrix account")
+}
@@ -0,0 +1,155 @@
+package tests
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const relayRulesYAML = `
+- room: "!discord*:example.org"
+  sender: "^@relaybot:example.org$"
+  body: '^\*\*(?P<name>[^*]+)\*\*: '
+  formatted_body: '^<strong>[^<]+</strong>: '
+  platform: Discord
+  strip: true
+- sender: "^@(?P<platform>irc)_(?P<name>[a-z]+):example.org$"
+`
+
+func loadRelayRules(t *testing.T) archive.AttributionRules {
+	path := filepath.Join(t.TempDir(), "attribution.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(relayRulesYAML), 0644))
+	rules, err := archive.LoadAttributionRules(path)
+	require.NoError(t, err)
+	return rules
+}
+
+func relayedMessage(roomID, sender, body string) *archive.Message {
+	return &archive.Message{
+		RoomID:      roomID,
+		EventID:     "$" + body,
+		Sender:      sender,
+		MessageType: "m.room.message",
+		Timestamp:   time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		Content:     map[string]interface{}{"msgtype": "m.text", "body": body},
+	}
+}
+
+func TestAttributionRules(t *testing.T) {
+	rules := loadRelayRules(t)
+
+	t.Run("body prefix", func(t *testing.T) {
+		msg := relayedMessage("!discord-general:example.org", "@relaybot:example.org", "**alice**: hello there")
+		msg.Content["format"] = "org.matrix.custom.html"
+		msg.Content["formatted_body"] = "<strong>alice</strong>: hello <em>there</em>"
+		require.True(t, rules.Apply(msg))
+		assert.Equal(t, "alice", msg.AuthorName)
+		assert.Equal(t, "Discord", msg.AuthorPlatform)
+		assert.Equal(t, "hello there", msg.Content["body"])
+		assert.Equal(t, "hello <em>there</em>", msg.Content["formatted_body"])
+	})
+
+	t.Run("formatted body without a matching prefix is dropped", func(t *testing.T) {
+		msg := relayedMessage("!discord-general:example.org", "@relaybot:example.org", "**bob**: hi")
+		msg.Content["format"] = "org.matrix.custom.html"
+		msg.Content["formatted_body"] = "<b>bob</b>: hi"
+		require.True(t, rules.Apply(msg))
+		assert.Equal(t, "hi", msg.Content["body"])
+		assert.NotContains(t, msg.Content, "formatted_body")
+		assert.NotContains(t, msg.Content, "format")
+	})
+
+	t.Run("rule limited to rooms", func(t *testing.T) {
+		msg := relayedMessage("!other:example.org", "@relaybot:example.org", "**alice**: hello")
+		assert.False(t, rules.Apply(msg))
+		assert.Empty(t, msg.AuthorName)
+		assert.Equal(t, "**alice**: hello", msg.Content["body"])
+	})
+
+	t.Run("prefix must start the body", func(t *testing.T) {
+		msg := relayedMessage("!discord-general:example.org", "@relaybot:example.org", "quoting **alice**: hello")
+		assert.False(t, rules.Apply(msg))
+	})
+
+	t.Run("name and platform from the sender", func(t *testing.T) {
+		msg := relayedMessage("!any:example.org", "@irc_carol:example.org", "hey")
+		require.True(t, rules.Apply(msg))
+		assert.Equal(t, "carol", msg.AuthorName)
+		assert.Equal(t, "irc", msg.AuthorPlatform)
+		assert.Equal(t, "hey", msg.Content["body"], "rules without strip leave the content alone")
+	})
+
+	t.Run("invalid rules", func(t *testing.T) {
+		assert.Error(t, archive.AttributionRules{{Body: `^(\w+): `}}.Compile(), "no name group")
+		assert.Error(t, archive.AttributionRules{{Body: `^(?P<name>[`}}.Compile())
+		assert.Error(t, archive.AttributionRules{{Platform: "Discord"}}.Compile(), "no patterns")
+		assert.NoError(t, archive.AttributionRules{{Sender: `^@(?P<name>\w+)_bridge:`}}.Compile())
+	})
+
+	t.Run("from the environment", func(t *testing.T) {
+		t.Setenv(archive.AttributionRulesEnv, "")
+		none, err := archive.LoadAttributionRulesOrEnv("")
+		require.NoError(t, err)
+		assert.Empty(t, none)
+
+		t.Setenv(archive.AttributionRulesEnv, filepath.Join(t.TempDir(), "missing.yaml"))
+		_, err = archive.LoadAttributionRulesOrEnv("")
+		assert.Error(t, err)
+	})
+}
+
+func TestAttributedMessagesRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	msg := relayedMessage("!discord-general:example.org", "@relaybot:example.org", "**alice**: hello")
+	require.True(t, loadRelayRules(t).Apply(msg))
+	require.NoError(t, db.InsertMessage(ctx, msg))
+
+	stored, err := db.GetMessage(ctx, msg.EventID)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", stored.AuthorName)
+	assert.Equal(t, "Discord", stored.AuthorPlatform)
+	assert.Equal(t, "hello", stored.Content["body"])
+}
+
+func TestAttributedMessagesInExports(t *testing.T) {
+	t.Chdir("..")
+
+	messages := []archive.ExportMessage{
+		{EventID: "$1", UserID: "@relaybot:example.org", Sender: "relaybot", DisplayName: "alice", Platform: "Discord", Relayed: true, Timestamp: "2024-01-02T15:04:05Z", Content: map[string]interface{}{"msgtype": "m.text", "body": "hello"}},
+		{EventID: "$2", UserID: "@relaybot:example.org", Sender: "relaybot", DisplayName: "Relay Bot", Timestamp: "2024-01-02T15:05:00Z", Content: map[string]interface{}{"msgtype": "m.text", "body": "beep"}},
+	}
+
+	memberships := []*archive.MembershipEvent{
+		{EventID: "$join", UserID: "@relaybot:example.org", Membership: "join", DisplayName: "Relay Bot v2", Timestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	archive.ApplyHistoricalNames(messages, memberships)
+	assert.Equal(t, "alice", messages[0].DisplayName, "relayed messages keep their author's name")
+	assert.Equal(t, "Relay Bot v2", messages[1].DisplayName)
+
+	participants := archive.ParticipantSummary(messages, memberships)
+	require.Len(t, participants, 2, "the relayed author is a participant of their own")
+	assert.Equal(t, "alice", participants[0].DisplayName)
+	assert.Equal(t, "Discord", participants[0].Platform)
+	assert.Empty(t, participants[0].Joined)
+	assert.NotEmpty(t, participants[1].Joined)
+
+	base := filepath.Join(t.TempDir(), "archive")
+	require.NoError(t, archive.WriteExportFiles(base, []string{"html", "txt"}, messages, archive.DefaultExportOptions()))
+	txt, err := os.ReadFile(base + ".txt")
+	require.NoError(t, err)
+	assert.Contains(t, string(txt), "alice (Discord), Relayed by relaybot")
+	html, err := os.ReadFile(base + ".html")
+	require.NoError(t, err)
+	assert.Contains(t, string(html), "platform-badge discord")
+}
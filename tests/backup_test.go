@@ -0,0 +1,59 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupName(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 30, 45, 0, time.UTC)
+	assert.Equal(t, "matrix_archive-20240301-123045.duckdb", archive.BackupName("/data/matrix_archive.duckdb", at))
+	assert.Equal(t, "work-20240301-123045.duckdb", archive.BackupName("work", at.In(time.FixedZone("EST", -5*3600))))
+}
+
+func TestRotateBackups(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for day := 0; day < 5; day++ {
+		name := archive.BackupName("archive.duckdb", start.AddDate(0, 0, day))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0600))
+	}
+	others := []string{
+		archive.BackupName("other.duckdb", start), // A backup of another archive
+		"archive-20240301-000000.duckdb.partial",  // An unfinished backup
+		"archive-notes.duckdb",                    // Not a backup
+	}
+	for _, name := range others {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0600))
+	}
+
+	deleted, err := archive.RotateBackups(dir, "archive.duckdb", 3)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "archive-20240301-000000.duckdb"),
+		filepath.Join(dir, "archive-20240302-000000.duckdb"),
+	}, deleted, "the oldest backups are deleted")
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var remaining []string
+	for _, entry := range entries {
+		remaining = append(remaining, entry.Name())
+	}
+	assert.ElementsMatch(t, append([]string{
+		"archive-20240303-000000.duckdb",
+		"archive-20240304-000000.duckdb",
+		"archive-20240305-000000.duckdb",
+	}, others...), remaining)
+
+	deleted, err = archive.RotateBackups(dir, "archive.duckdb", 0)
+	require.NoError(t, err)
+	assert.Empty(t, deleted, "keep 0 keeps every backup")
+}
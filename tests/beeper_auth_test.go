@@ -242,3 +242,114 @@ func TestBeeperCredentials_JSON(t *testing.T) {
 	assert.Equal(t, creds.Email, newCreds.Email)
 	assert.Equal(t, creds.Token, newCreds.Token)
 }
+
+func TestBeeperAuth_ProfileCredentials(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "matrix-archive-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	originalHome := os.Getenv("HOME")
+	os.Setenv("HOME", tempDir)
+	defer os.Setenv("HOME", originalHome)
+
+	work := archive.NewBeeperAuthForProfile("test.com", "work")
+	work.Email = "work@example.com"
+	work.Token = "work-token"
+	assert.NoError(t, work.SaveCredentialsToFile())
+
+	path, err := work.GetCredentialsFilePath()
+	assert.NoError(t, err)
+	assert.Contains(t, path, "beeper-credentials-test.com-work.json")
+
+	// The default profile must not pick up another profile's credentials
+	defaultAuth := archive.NewBeeperAuth("test.com")
+	assert.False(t, defaultAuth.LoadCredentialsFromFile())
+
+	reloaded := archive.NewBeeperAuthForProfile("test.com", "work")
+	assert.True(t, reloaded.LoadCredentialsFromFile())
+	assert.Equal(t, "work-token", reloaded.Token)
+}
+
+func TestBeeperAuth_LoginWithTokenValidation(t *testing.T) {
+	auth := archive.NewBeeperAuth("test.com")
+
+	err := auth.LoginWithToken("  ")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "empty")
+
+	err = auth.LoginWithMatrixToken("", "@test:beeper.com")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "empty")
+
+	err = auth.LoginWithMatrixToken("matrix-token", "test")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid user ID")
+	assert.Empty(t, auth.MatrixToken)
+}
+
+func TestBeeperAuth_MatrixTokenCredentials(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "matrix-archive-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	originalHome := os.Getenv("HOME")
+	os.Setenv("HOME", tempDir)
+	defer os.Setenv("HOME", originalHome)
+	originalToken, hadToken := os.LookupEnv("BEEPER_TOKEN")
+	os.Unsetenv("BEEPER_TOKEN")
+	defer func() {
+		if hadToken {
+			os.Setenv("BEEPER_TOKEN", originalToken)
+		}
+	}()
+
+	// Credentials saved by a Matrix token login have no Beeper token
+	saved := archive.NewBeeperAuth("test.com")
+	saved.MatrixToken = "matrix-token"
+	saved.MatrixUserID = "@test:beeper.com"
+	saved.MatrixDeviceID = "MATRIXARCH"
+	assert.NoError(t, saved.SaveCredentialsToFile())
+
+	auth := archive.NewBeeperAuth("test.com")
+	assert.True(t, auth.LoadCredentials())
+
+	client, err := auth.GetMatrixClient()
+	assert.NoError(t, err)
+	assert.Equal(t, "matrix-token", client.AccessToken)
+	assert.Equal(t, "@test:beeper.com", client.UserID.String())
+	assert.Equal(t, "MATRIXARCH", client.DeviceID.String())
+}
+
+func TestBeeperAuth_DeviceID(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "matrix-archive-test-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	originalHome := os.Getenv("HOME")
+	os.Setenv("HOME", tempDir)
+	defer os.Setenv("HOME", originalHome)
+
+	auth := archive.NewBeeperAuthForProfile("test.com", "work")
+	assert.Equal(t, "MATRIXARCH", auth.DeviceID().String())
+
+	auth.MatrixToken = "old-device-token"
+	auth.NewDevice()
+	deviceID := auth.DeviceID().String()
+	assert.Regexp(t, `^ARCHIVE[A-Z0-9]{8}$`, deviceID)
+	assert.Empty(t, auth.MatrixToken, "the old device's token must not be reused")
+
+	// The device is kept with the credentials and forgotten on logout
+	auth.Token = "work-token"
+	assert.NoError(t, auth.SaveCredentialsToFile())
+	reloaded := archive.NewBeeperAuthForProfile("test.com", "work")
+	assert.True(t, reloaded.LoadCredentialsFromFile())
+	assert.Equal(t, deviceID, reloaded.DeviceID().String())
+
+	assert.NoError(t, reloaded.ClearCredentials())
+	assert.Equal(t, "MATRIXARCH", reloaded.DeviceID().String())
+}
+
+func TestDeviceDisplayName(t *testing.T) {
+	assert.Equal(t, "matrix-archive", archive.DeviceDisplayName(""))
+	assert.Equal(t, "matrix-archive (work)", archive.DeviceDisplayName("work"))
+}
@@ -0,0 +1,85 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactFormattedBody(t *testing.T) {
+	for _, formatted := range []string{
+		"a &lt;b&gt; &amp; c<br>second line",
+		"a &lt;b&gt; &amp; c<br/>second line",
+		"<p>a &lt;b&gt; &amp; c<br>second line</p>",
+	} {
+		content := map[string]interface{}{"msgtype": "m.text", "body": "a <b> & c\nsecond line", "format": "org.matrix.custom.html", "formatted_body": formatted}
+		compacted, ok := archive.CompactFormattedBody(content)
+		require.True(t, ok, formatted)
+		assert.NotContains(t, compacted, "formatted_body")
+		assert.Equal(t, formatted, content["formatted_body"], "the original content is left alone")
+
+		archive.ExpandFormattedBody(compacted)
+		assert.Equal(t, content, compacted, "expanding rebuilds the formatted body exactly")
+	}
+
+	meaningful := map[string]interface{}{"body": "see example", "formatted_body": `see <a href="https://example.org">example</a>`}
+	_, ok := archive.CompactFormattedBody(meaningful)
+	assert.False(t, ok, "formatted bodies with markup are kept")
+
+	edit := map[string]interface{}{
+		"body":           " * fixed",
+		"formatted_body": ` * <em>fixed</em>`,
+		"m.new_content":  map[string]interface{}{"body": "fixed", "formatted_body": "fixed"},
+		"m.relates_to":   map[string]interface{}{"rel_type": "m.replace", "event_id": "$1"},
+	}
+	compacted, ok := archive.CompactFormattedBody(edit)
+	require.True(t, ok, "the new content of an edit is compacted")
+	assert.Equal(t, ` * <em>fixed</em>`, compacted["formatted_body"])
+	assert.NotContains(t, compacted["m.new_content"], "formatted_body")
+	archive.ExpandFormattedBody(compacted)
+	assert.Equal(t, edit, compacted)
+
+	short := map[string]interface{}{"msgtype": "m.text", "body": "ok", "format": "org.matrix.custom.html", "formatted_body": "ok"}
+	compacted, ok = archive.CompactFormattedBody(short)
+	require.True(t, ok)
+	assert.Less(t, len(mustJSON(t, compacted)), len(mustJSON(t, short)), "compacting makes short messages smaller too")
+
+	legacy := map[string]interface{}{"body": "a\nb", "com.github.osteele.matrix_archive.formatted_body": "escaped-br/"}
+	archive.ExpandFormattedBody(legacy)
+	assert.Equal(t, map[string]interface{}{"body": "a\nb", "formatted_body": "a<br/>b"}, legacy, "messages compacted by earlier versions are expanded")
+}
+
+func mustJSON(t *testing.T, value interface{}) []byte {
+	data, err := json.Marshal(value)
+	require.NoError(t, err)
+	return data
+}
+
+func TestDuckDBCompactContent(t *testing.T) {
+	ctx := context.Background()
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	content := map[string]interface{}{"msgtype": "m.text", "body": "one\ntwo", "format": "org.matrix.custom.html", "formatted_body": "one<br>two"}
+	require.NoError(t, db.InsertMessage(ctx, &archive.Message{
+		RoomID: "!room:example.org", EventID: "$1", Sender: "@alice:example.org", UserID: "@alice:example.org",
+		MessageType: "m.room.message", Timestamp: time.Unix(1717236000, 0), Content: content,
+	}))
+
+	count, saved, err := db.CompactExistingContent(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Positive(t, saved)
+
+	messages, err := db.GetMessages(ctx, &archive.MessageFilter{RoomID: "!room:example.org"}, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	assert.Equal(t, content, messages[0].Content, "compacted messages read back as they were archived")
+}
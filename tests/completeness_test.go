@@ -0,0 +1,58 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildCompletenessReport(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	imageDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(imageDir, "downloaded.png"), nil, 0644))
+
+	messages := []*archive.Message{
+		{EventID: "$1", Timestamp: start, Content: map[string]interface{}{"msgtype": "m.text", "body": "hello"}},
+		{EventID: "$2", Timestamp: start.Add(time.Minute), Content: map[string]interface{}{"msgtype": "m.image", "url": "mxc://example.org/downloaded"}},
+		{EventID: "$3", Timestamp: start.Add(2 * time.Minute), Content: map[string]interface{}{"msgtype": "m.image", "url": "mxc://example.org/missing"}},
+		{EventID: "$4", Timestamp: start.Add(3 * time.Minute), Content: map[string]interface{}{"msgtype": "m.text", "body": "[Encrypted message - decryption not available]", "algorithm": "m.megolm.v1.aes-sha2", "session_id": "abc"}},
+		{EventID: "$5", Timestamp: start.Add(4 * time.Minute), Content: map[string]interface{}{"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": "$1", "key": "👍"}}},
+		{EventID: "$6", Timestamp: start.Add(5 * time.Minute), Content: map[string]interface{}{"msgtype": "m.text", "body": "re", "m.relates_to": map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": "$gone"}}}},
+	}
+
+	report := archive.BuildCompletenessReport("!room:example.org", messages, []string{imageDir}, nil)
+	assert.Equal(t, 6, report.EventCount)
+	assert.Equal(t, "$1", report.FirstEvent.EventID)
+	assert.Equal(t, "$6", report.LastEvent.EventID)
+	assert.Equal(t, map[string]int{"m.text": 2, "m.image": 2, "m.reaction": 1, "m.room.encrypted": 1}, report.CountsByType)
+	assert.Equal(t, 1, report.Undecryptable)
+	assert.Equal(t, 2, report.MediaCount)
+	assert.Equal(t, 1, report.MediaMissing)
+	require.Len(t, report.Gaps, 1)
+	assert.Equal(t, archive.GapMissingEvent, report.Gaps[0].Kind)
+	assert.Equal(t, "$gone", report.Gaps[0].EventID)
+	assert.Equal(t, "m.in_reply_to", report.Gaps[0].RelType)
+	assert.Nil(t, report.Gaps[0].UnresolvedSince)
+	assert.False(t, report.Complete)
+
+	firstSeen := start.Add(-time.Hour)
+	report.AddUnresolvedSince([]*archive.UnresolvedRelation{{EventID: "$6", TargetEventID: "$gone", RelType: "m.in_reply_to", FirstSeen: firstSeen}})
+	require.NotNil(t, report.Gaps[0].UnresolvedSince)
+	assert.Equal(t, firstSeen, *report.Gaps[0].UnresolvedSince)
+
+	// A throttled import that hasn't reached the start of the room is a gap
+	state := &archive.ImportState{RoomID: "!room:example.org", NextBatch: "t42"}
+	report = archive.BuildCompletenessReport("!room:example.org", messages[:2], []string{imageDir}, state)
+	require.Len(t, report.Gaps, 1)
+	assert.Equal(t, archive.GapUnimportedHistory, report.Gaps[0].Kind)
+
+	report = archive.BuildCompletenessReport("!room:example.org", messages[:2], []string{imageDir}, nil)
+	assert.True(t, report.Complete)
+	assert.NotNil(t, report.Gaps)
+}
@@ -0,0 +1,58 @@
+package tests
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	cfg, err := archive.LoadConfig()
+	require.NoError(t, err)
+	assert.Nil(t, cfg, "there is no configuration until init writes one")
+
+	require.NoError(t, (&archive.Config{Database: "/archives/work.duckdb", BeeperDomain: "beeper.example"}).Save())
+	path, err := archive.ConfigPath()
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(home, ".matrix-archive", "config.yaml"), path)
+	cfg, err = archive.LoadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, &archive.Config{Database: "/archives/work.duckdb", BeeperDomain: "beeper.example"}, cfg)
+
+	t.Setenv("DUCKDB_URL", "")
+	os.Unsetenv("DUCKDB_URL")
+	t.Setenv("BEEPER_DOMAIN", "beeper.com")
+	require.NoError(t, archive.ApplyConfig())
+	assert.Equal(t, "/archives/work.duckdb", os.Getenv("DUCKDB_URL"))
+	assert.Equal(t, "beeper.com", os.Getenv("BEEPER_DOMAIN"), "the environment wins over the file")
+}
+
+func TestPromptInitOptions(t *testing.T) {
+	opts := &archive.InitOptions{Database: "matrix_archive.duckdb", BeeperDomain: "beeper.com", MediaDir: ".", MediaLayout: archive.MediaLayoutFlat}
+	var out bytes.Buffer
+	answers := "work.duckdb\n\nsideways\nhashed\n\ny\n"
+	require.NoError(t, archive.PromptInitOptions(opts, strings.NewReader(answers), &out))
+	assert.Equal(t, &archive.InitOptions{
+		Database:     "work.duckdb",
+		BeeperDomain: "beeper.com",
+		MediaDir:     ".",
+		MediaLayout:  archive.MediaLayoutHashed,
+		Login:        true,
+	}, opts)
+	assert.Contains(t, out.String(), "Please answer flat or hashed")
+
+	// Without answers, the proposed settings are kept
+	require.NoError(t, archive.PromptInitOptions(opts, strings.NewReader(""), &out))
+	assert.Equal(t, "work.duckdb", opts.Database)
+	assert.True(t, opts.Login)
+}
@@ -0,0 +1,164 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func contentSize(t *testing.T, content map[string]interface{}) int64 {
+	data, err := json.Marshal(content)
+	require.NoError(t, err)
+	return int64(len(data))
+}
+
+func TestTruncateContent(t *testing.T) {
+	truncation := archive.ContentTruncation{OriginalSize: 1 << 20}
+
+	t.Run("drops the formatted body first", func(t *testing.T) {
+		content := map[string]interface{}{
+			"msgtype":        "m.text",
+			"body":           "hello",
+			"format":         "org.matrix.custom.html",
+			"formatted_body": strings.Repeat("<b>hello</b>", 1000),
+		}
+		truncated := archive.TruncateContent(content, 1024, truncation)
+		assert.Equal(t, "hello", truncated["body"])
+		assert.NotContains(t, truncated, "formatted_body")
+		assert.NotContains(t, truncated, "format")
+		assert.Equal(t, truncation, truncated[archive.ContentTruncatedKey])
+		assert.LessOrEqual(t, contentSize(t, truncated), int64(1024))
+		assert.Contains(t, content, "formatted_body", "the original content is unchanged")
+	})
+
+	t.Run("shortens the body at a character boundary", func(t *testing.T) {
+		content := map[string]interface{}{"msgtype": "m.text", "body": strings.Repeat("é", 5000)}
+		truncated := archive.TruncateContent(content, 1024, truncation)
+		body := truncated["body"].(string)
+		assert.True(t, strings.HasSuffix(body, "…"))
+		assert.True(t, strings.HasPrefix(body, "éé"))
+		assert.LessOrEqual(t, contentSize(t, truncated), int64(1024))
+	})
+
+	t.Run("keeps only the essentials when other fields are too large", func(t *testing.T) {
+		content := map[string]interface{}{
+			"msgtype":       "m.text",
+			"body":          "hi",
+			"m.relates_to":  map[string]interface{}{"rel_type": "m.thread", "event_id": "$root"},
+			"bridge.extras": strings.Repeat("x", 5000),
+		}
+		truncated := archive.TruncateContent(content, 1024, truncation)
+		assert.Equal(t, "hi", truncated["body"])
+		assert.Contains(t, truncated, "m.relates_to")
+		assert.NotContains(t, truncated, "bridge.extras")
+	})
+}
+
+func TestContentLimit(t *testing.T) {
+	big := func() *archive.Message {
+		return &archive.Message{EventID: "$big", Content: map[string]interface{}{
+			"msgtype": "m.text", "body": "summary", "formatted_body": strings.Repeat("<p>x</p>", 1000),
+		}}
+	}
+
+	t.Run("leaves small content alone", func(t *testing.T) {
+		limit := &archive.ContentLimit{MaxSize: 64 << 10}
+		require.NoError(t, limit.Validate())
+		msg := big()
+		truncated, err := limit.Apply(msg)
+		require.NoError(t, err)
+		assert.False(t, truncated)
+		assert.Contains(t, msg.Content, "formatted_body")
+	})
+
+	t.Run("no limit by default", func(t *testing.T) {
+		truncated, err := (&archive.ContentLimit{}).Apply(big())
+		require.NoError(t, err)
+		assert.False(t, truncated)
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		limit := &archive.ContentLimit{MaxSize: 1024}
+		require.NoError(t, limit.Validate())
+		assert.Equal(t, archive.OversizeTruncate, limit.Policy)
+		msg := big()
+		truncated, err := limit.Apply(msg)
+		require.NoError(t, err)
+		assert.True(t, truncated)
+		assert.NotContains(t, msg.Content, "formatted_body")
+	})
+
+	t.Run("external", func(t *testing.T) {
+		t.Setenv("MATRIX_ARCHIVE_PASSPHRASE", "")
+		dir := t.TempDir()
+		limit := &archive.ContentLimit{MaxSize: 1024, Policy: archive.OversizeExternal, Dir: dir}
+		require.NoError(t, limit.Validate())
+		msg := big()
+		original := msg.Content
+		truncated, err := limit.Apply(msg)
+		require.NoError(t, err)
+		assert.True(t, truncated)
+
+		marker := msg.Content[archive.ContentTruncatedKey].(archive.ContentTruncation)
+		assert.Equal(t, filepath.Join(dir, "_big-7e56da10.json"), marker.Path)
+		data, err := os.ReadFile(marker.Path)
+		require.NoError(t, err)
+		var full map[string]interface{}
+		require.NoError(t, json.Unmarshal(data, &full))
+		assert.Equal(t, original, full)
+		assert.Equal(t, int64(len(data)), marker.OriginalSize)
+	})
+
+	t.Run("external refuses encrypted archives", func(t *testing.T) {
+		t.Setenv("MATRIX_ARCHIVE_PASSPHRASE", "secret")
+		limit := &archive.ContentLimit{MaxSize: 1024, Policy: archive.OversizeExternal}
+		assert.Error(t, limit.Validate())
+	})
+
+	t.Run("unknown policy", func(t *testing.T) {
+		assert.Error(t, (&archive.ContentLimit{Policy: "drop"}).Validate())
+	})
+}
+
+func TestTruncatedMessagesInExports(t *testing.T) {
+	t.Chdir("..")
+
+	ctx := context.Background()
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	msg := &archive.Message{RoomID: "!room:example.com", EventID: "$big", Sender: "@bridge:example.com",
+		MessageType: "m.room.message", Timestamp: time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC),
+		Content: map[string]interface{}{"msgtype": "m.text", "body": strings.Repeat("x", 3<<20)}}
+	truncated, err := (&archive.ContentLimit{MaxSize: 4096}).Apply(msg)
+	require.NoError(t, err)
+	require.True(t, truncated)
+	require.NoError(t, db.InsertMessage(ctx, msg))
+
+	stored, err := db.GetMessage(ctx, "$big")
+	require.NoError(t, err)
+	marker, ok := stored.Content[archive.ContentTruncatedKey].(map[string]interface{})
+	require.True(t, ok, "the truncation is stored with the content")
+	assert.Equal(t, float64(3<<20+len(`{"body":"","msgtype":"m.text"}`)), marker["original_size"])
+
+	exported := []archive.ExportMessage{{EventID: "$big", UserID: stored.Sender, Sender: "bridge",
+		Timestamp: "2024-01-02T15:04:05Z", Content: stored.Content,
+		Truncated: &archive.ContentTruncation{OriginalSize: 3 << 20}}}
+	base := filepath.Join(t.TempDir(), "archive")
+	require.NoError(t, archive.WriteExportFiles(base, []string{"html", "txt"}, exported, archive.DefaultExportOptions()))
+	for _, ext := range []string{".html", ".txt"} {
+		data, err := os.ReadFile(base + ext)
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "Message truncated; the original was 3.0 MB", ext)
+	}
+}
@@ -0,0 +1,80 @@
+package tests
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func conversationTestMessages() []archive.ExportMessage {
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	at := func(minutes int) string {
+		return start.Add(time.Duration(minutes) * time.Minute).Format(time.RFC3339)
+	}
+	text := func(body string) map[string]interface{} {
+		return map[string]interface{}{"msgtype": "m.text", "body": body}
+	}
+	return []archive.ExportMessage{
+		{EventID: "$a", Sender: "@alice:example.org", Timestamp: at(0), Content: text("standup?")},
+		{EventID: "$b", Sender: "@bob:example.org", Timestamp: at(5), Content: text("yes")},
+		{EventID: "$c", Sender: "@carol:example.org", Timestamp: at(120), Content: text("lunch?")},
+		// A late reply goes back to the conversation it answers
+		{EventID: "$d", Sender: "@dave:example.org", Timestamp: at(300), Content: text("sorry, missed it"), RepliesTo: &archive.ReplyInfo{EventID: "$a"}},
+		{EventID: "$e", Sender: "@alice:example.org", Timestamp: at(305), Content: text("no worries")},
+		{EventID: "$f", Sender: "@bob:example.org", Timestamp: at(400), Content: text("in thread"), ThreadInfo: &archive.ThreadInfo{RootEventID: "$c"}},
+	}
+}
+
+func TestSegmentConversations(t *testing.T) {
+	messages := conversationTestMessages()
+	archive.SegmentConversations(messages, 30*time.Minute)
+
+	var ids []int
+	var starts []bool
+	for _, msg := range messages {
+		ids = append(ids, msg.ConversationID)
+		starts = append(starts, msg.ConversationStart)
+	}
+	assert.Equal(t, []int{1, 1, 2, 1, 1, 2}, ids)
+	assert.Equal(t, []bool{true, false, true, false, false, false}, starts)
+
+	messages = conversationTestMessages()
+	archive.SegmentConversations(messages, 3*time.Hour)
+	assert.Equal(t, 1, messages[2].ConversationID, "a longer gap keeps messages together")
+
+	messages = conversationTestMessages()
+	archive.SegmentConversations(messages, 30*time.Minute)
+	second, err := archive.FilterConversation(messages, 2)
+	require.NoError(t, err)
+	require.Len(t, second, 2)
+	assert.Equal(t, "$c", second[0].EventID)
+	assert.Equal(t, "$f", second[1].EventID)
+	_, err = archive.FilterConversation(messages, 3)
+	assert.Error(t, err)
+}
+
+func TestConversationSeparators(t *testing.T) {
+	t.Chdir("..")
+
+	messages := conversationTestMessages()
+	archive.SegmentConversations(messages, 30*time.Minute)
+
+	for _, templatePath := range []string{"templates/default.html.tpl", "templates/enhanced.html.tpl", "templates/accessible.html.tpl"} {
+		var buf bytes.Buffer
+		require.NoError(t, archive.ExportWithTemplateOptions(&buf, templatePath, messages, archive.DefaultExportOptions()))
+		assert.Contains(t, buf.String(), `id="conversation-2">Conversation 2<`, templatePath)
+		assert.Equal(t, 2, bytes.Count(buf.Bytes(), []byte("conversation-break")), templatePath)
+	}
+
+	var buf bytes.Buffer
+	opts := archive.DefaultExportOptions()
+	opts.Lang = "de"
+	require.NoError(t, archive.ExportWithTemplateOptions(&buf, "templates/default.txt.tpl", messages, opts))
+	assert.Contains(t, buf.String(), "[--- Unterhaltung 1 ---]")
+	assert.Contains(t, buf.String(), "[--- Unterhaltung 2 ---]")
+}
@@ -1,8 +1,13 @@
 package tests
 
 import (
-	archive "github.com/osteele/matrix-archive/lib"
+	"path/filepath"
 	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDatabasePlaceholder(t *testing.T) {
@@ -12,3 +17,24 @@ func TestDatabasePlaceholder(t *testing.T) {
 	_ = archive.CloseDatabase
 	_ = archive.GetDatabase
 }
+
+func TestDatabasePathOverride(t *testing.T) {
+	t.Setenv("DUCKDB_URL", "from-env.duckdb")
+	assert.Equal(t, "from-env.duckdb", archive.DefaultDatabaseConfig().DatabaseURL)
+
+	missing := filepath.Join(t.TempDir(), "missing.duckdb")
+	archive.SetDatabasePath(missing)
+	archive.SetCreateDatabase(false)
+	t.Cleanup(func() {
+		archive.SetDatabasePath("")
+		archive.SetCreateDatabase(true)
+	})
+
+	cfg := archive.DefaultDatabaseConfig()
+	assert.Equal(t, missing, cfg.DatabaseURL, "the path set on the command line wins")
+	assert.True(t, cfg.MustExist)
+	err := archive.InitDuckDB()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not found")
+	assert.NoFileExists(t, missing, "a missing archive isn't created")
+}
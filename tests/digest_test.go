@@ -0,0 +1,133 @@
+package tests
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDigestPeriod(t *testing.T) {
+	date := time.Date(2024, 1, 10, 15, 30, 0, 0, time.UTC) // A Wednesday
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC) }
+
+	start, end, err := archive.DigestPeriod(archive.DigestWeek, date)
+	require.NoError(t, err)
+	assert.Equal(t, day(8), start, "weeks start on Monday")
+	assert.Equal(t, day(15), end)
+
+	start, end, err = archive.DigestPeriod(archive.DigestWeek, day(14))
+	require.NoError(t, err)
+	assert.Equal(t, day(8), start, "Sunday ends the week")
+	assert.Equal(t, day(15), end)
+
+	start, end, err = archive.DigestPeriod(archive.DigestDay, date)
+	require.NoError(t, err)
+	assert.Equal(t, day(10), start)
+	assert.Equal(t, day(11), end)
+
+	start, end, err = archive.DigestPeriod(archive.DigestMonth, date)
+	require.NoError(t, err)
+	assert.Equal(t, day(1), start)
+	assert.Equal(t, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), end)
+
+	start, end, err = archive.DigestPeriod(archive.DigestWeek, time.Time{})
+	require.NoError(t, err)
+	assert.False(t, end.After(time.Now()), "the last week to have ended")
+	assert.Equal(t, start.AddDate(0, 0, 7), end)
+
+	_, _, err = archive.DigestPeriod("year", date)
+	assert.Error(t, err)
+}
+
+func TestRankDigestMessages(t *testing.T) {
+	start := time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC)
+	at := func(hours int) time.Time { return start.Add(time.Duration(hours) * time.Hour) }
+	text := func(eventID string, ts time.Time, relatesTo map[string]interface{}) *archive.Message {
+		content := map[string]interface{}{"msgtype": "m.text", "body": eventID}
+		if relatesTo != nil {
+			content["m.relates_to"] = relatesTo
+		}
+		return &archive.Message{EventID: eventID, Sender: "@alice:example.org", MessageType: archive.EventTypeMessage, Timestamp: ts, Content: content}
+	}
+	reaction := func(eventID, target string, ts time.Time) *archive.Message {
+		return &archive.Message{EventID: eventID, MessageType: archive.EventTypeReaction, Timestamp: ts,
+			Content: map[string]interface{}{"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": target, "key": "👍"}}}
+	}
+	messages := []*archive.Message{
+		text("$quiet", at(1), nil),
+		text("$liked", at(2), nil),
+		text("$root", at(3), nil),
+		text("$t1", at(4), map[string]interface{}{"rel_type": "m.thread", "event_id": "$root", "is_falling_back": true,
+			"m.in_reply_to": map[string]interface{}{"event_id": "$root"}}),
+		text("$t2", at(5), map[string]interface{}{"rel_type": "m.thread", "event_id": "$root", "is_falling_back": true,
+			"m.in_reply_to": map[string]interface{}{"event_id": "$t1"}}),
+		reaction("$r1", "$liked", at(6)),
+		text("$reply", at(7), map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": "$liked"}}),
+		{EventID: "$bundled", MessageType: archive.EventTypeMessage, Timestamp: at(8), Content: map[string]interface{}{"msgtype": "m.text", "body": "popular"},
+			Aggregations: &archive.BundledAggregations{Reactions: map[string]int{"🎉": 4, "👍": 1}}},
+		text("$edit", at(9), map[string]interface{}{"rel_type": "m.replace", "event_id": "$liked"}),
+		text("$later", start.AddDate(0, 0, 7), nil),
+		reaction("$r2", "$later", start.AddDate(0, 0, 7).Add(time.Hour)),
+		reaction("$r3", "$root", start.AddDate(0, 0, 8)),
+	}
+
+	ranked := archive.RankDigestMessages(messages, start, start.AddDate(0, 0, 7))
+	var order []string
+	for _, score := range ranked {
+		order = append(order, score.Message.EventID)
+	}
+	assert.Equal(t, []string{"$bundled", "$root", "$liked"}, order,
+		"messages without reactions or replies, edits, messages after the period, and thread messages whose only reply is a fallback are left out")
+	assert.Equal(t, 5, ranked[0].Reactions, "the server's counts cover reactions that weren't archived")
+	assert.Equal(t, 1, ranked[1].Reactions, "reactions after the period count")
+	assert.Equal(t, 2, ranked[1].Replies, "a thread's messages count as replies to its root")
+	assert.Equal(t, 1, ranked[2].Reactions)
+	assert.Equal(t, 1, ranked[2].Replies)
+}
+
+func TestWriteDigest(t *testing.T) {
+	digest := &archive.Digest{
+		RoomID: "!room:example.org", Period: archive.DigestWeek, Messages: 12, Senders: 3,
+		Start: time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC), End: time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC),
+		Top: []archive.DigestEntry{{
+			Message: archive.ExportMessage{
+				EventID: "$1", DisplayName: "Alice", Timestamp: "2024-01-09T10:30:00Z", Permalink: "https://matrix.to/#/!room:example.org/$1",
+				Content:   map[string]interface{}{"msgtype": "m.text", "body": "We shipped!\nThanks all"},
+				Reactions: []archive.MessageReaction{{Emoji: "🎉", Count: 3}, {Emoji: "mxc://example.org/meow", Shortcode: "meow", Count: 1}},
+			},
+			Reactions: 4, Replies: 1,
+		}},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, archive.WriteDigest(&buf, digest, archive.DigestMarkdown))
+	assert.Equal(t, `# Digest of !room:example.org, week of 2024-01-08
+
+12 messages from 3 people, 2024-01-08 to 2024-01-14.
+
+## 1. Alice, Tue 2024-01-09 10:30
+
+> We shipped!
+> Thanks all
+
+🎉 3 · :meow: 1 · 1 reply · [link](https://matrix.to/#/!room:example.org/$1)
+`, buf.String())
+
+	buf.Reset()
+	require.NoError(t, archive.WriteDigest(&buf, &archive.Digest{RoomID: "!room:example.org", Period: archive.DigestDay,
+		Start: time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC), End: time.Date(2024, 1, 9, 0, 0, 0, 0, time.UTC)}, archive.DigestText))
+	assert.Equal(t, `Digest of !room:example.org, Monday 2024-01-08
+==============================================
+
+0 messages from 0 people, 2024-01-08 to 2024-01-08.
+
+No message got a reaction or a reply.
+`, buf.String())
+
+	assert.Error(t, archive.WriteDigest(&buf, digest, "pdf"))
+}
@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeUserFetcher serves member profiles from memory and counts requests
+type fakeUserFetcher struct {
+	mu          sync.Mutex
+	members     []*archive.RoomUser
+	profiles    map[string]string
+	deactivated map[string]bool
+	memberCalls int
+	userCalls   int
+}
+
+func (f *fakeUserFetcher) FetchRoomUsers(ctx context.Context, roomID string) ([]*archive.RoomUser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.memberCalls++
+	return f.members, nil
+}
+
+func (f *fakeUserFetcher) FetchRoomUser(ctx context.Context, roomID, userID string) (*archive.RoomUser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.userCalls++
+	if f.deactivated[userID] {
+		return &archive.RoomUser{RoomID: roomID, UserID: userID, Deactivated: true}, nil
+	}
+	name, ok := f.profiles[userID]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return &archive.RoomUser{RoomID: roomID, UserID: userID, DisplayName: name}, nil
+}
+
+func TestResolveDisplayNames(t *testing.T) {
+	require.NoError(t, archive.InitDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 5}))
+	defer archive.CloseDatabase()
+
+	roomID := "!room:example.org"
+	fetcher := &fakeUserFetcher{
+		members: []*archive.RoomUser{
+			{RoomID: roomID, UserID: "@alice:example.org", DisplayName: "Alice"},
+			{RoomID: roomID, UserID: "@bob:example.org"},
+		},
+		profiles: map[string]string{"@carol:example.org": "Carol", "@erin:example.org": "Erin"},
+	}
+	senders := []string{"@alice:example.org", "@bob:example.org", "@carol:example.org", "@alice:example.org", "@dave:example.org", "@erin:example.org"}
+
+	names := archive.ResolveDisplayNames(context.Background(), fetcher, roomID, senders)
+	assert.Equal(t, map[string]string{"@alice:example.org": "Alice", "@carol:example.org": "Carol", "@erin:example.org": "Erin"}, names)
+	assert.Equal(t, 1, fetcher.memberCalls)
+	assert.Equal(t, 3, fetcher.userCalls, "only senders missing from the member list are looked up, once each")
+
+	users, err := archive.GetDatabase().GetRoomUsers(context.Background(), roomID)
+	require.NoError(t, err)
+	assert.Len(t, users, 4)
+
+	// Cached users are reused without contacting the homeserver
+	names = archive.ResolveDisplayNames(context.Background(), fetcher, roomID, []string{"@alice:example.org", "@bob:example.org", "@carol:example.org"})
+	assert.Equal(t, "Carol", names["@carol:example.org"])
+	assert.Equal(t, 1, fetcher.memberCalls)
+	assert.Equal(t, 3, fetcher.userCalls)
+}
+
+func TestResolveDisplayNamesDeactivated(t *testing.T) {
+	require.NoError(t, archive.InitDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 5}))
+	defer archive.CloseDatabase()
+
+	ctx := context.Background()
+	roomID := "!room:example.org"
+	require.NoError(t, archive.GetDatabase().SaveRoomUsers(ctx, []*archive.RoomUser{{RoomID: roomID, UserID: "@carol:example.org", DisplayName: "Carol"}}))
+	_, err := archive.GetDatabase().ExecuteQuery(ctx, "UPDATE users SET updated_at = TIMESTAMP '2020-01-01 00:00:00'")
+	require.NoError(t, err)
+
+	fetcher := &fakeUserFetcher{deactivated: map[string]bool{"@carol:example.org": true, "@dave:example.org": true}}
+	names := archive.ResolveDisplayNames(ctx, fetcher, roomID, []string{"@carol:example.org", "@dave:example.org"})
+	assert.Equal(t, map[string]string{"@carol:example.org": "Carol (deactivated)", "@dave:example.org": "dave (deactivated)"}, names,
+		"deactivated users keep the name they had")
+	assert.Equal(t, 2, fetcher.userCalls)
+
+	_, err = archive.GetDatabase().ExecuteQuery(ctx, "UPDATE users SET updated_at = TIMESTAMP '2020-01-01 00:00:00'")
+	require.NoError(t, err)
+	names = archive.ResolveDisplayNames(ctx, fetcher, roomID, []string{"@carol:example.org", "@dave:example.org"})
+	assert.Equal(t, "dave (deactivated)", names["@dave:example.org"])
+	assert.Equal(t, 1, fetcher.memberCalls, "deactivated users aren't looked up again")
+	assert.Equal(t, 2, fetcher.userCalls)
+}
@@ -3,6 +3,7 @@ package tests
 import (
 	"context"
 	"fmt"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -96,6 +97,23 @@ func TestDuckDBMessageOperations(t *testing.T) {
 	assert.Equal(t, "m.text", retrievedMessage.Content["msgtype"])
 	assert.Equal(t, "Test message", retrievedMessage.Content["body"])
 
+	// Test forwarding provenance round trip
+	forwarded := &archive.Message{
+		RoomID:            "!testroom:example.com",
+		EventID:           "$forwarded:example.com",
+		Sender:            "@telegram_1:example.com",
+		MessageType:       "m.room.message",
+		Timestamp:         time.Now(),
+		Content:           map[string]interface{}{"msgtype": "m.text", "body": "hi"},
+		ForwardedFrom:     "Jane Doe",
+		ForwardedPlatform: "Telegram",
+	}
+	require.NoError(t, db.InsertMessage(ctx, forwarded))
+	retrievedMessage, err = db.GetMessage(ctx, forwarded.EventID)
+	require.NoError(t, err)
+	assert.Equal(t, "Jane Doe", retrievedMessage.ForwardedFrom)
+	assert.Equal(t, "Telegram", retrievedMessage.ForwardedPlatform)
+
 	// Test message not found
 	_, err = db.GetMessage(ctx, "$nonexistent:example.com")
 	assert.Error(t, err)
@@ -341,6 +359,182 @@ func TestDuckDBRoomOperations(t *testing.T) {
 	assert.Equal(t, int64(1), room2Count)
 }
 
+// TestDuckDBAccountOperations tests per-account attribution and stats
+func TestDuckDBAccountOperations(t *testing.T) {
+	config := &archive.DatabaseConfig{
+		DatabaseURL: ":memory:",
+		IsInMemory:  true,
+		MaxConns:    5,
+		Debug:       false,
+	}
+
+	db := archive.NewDuckDBDatabase(config)
+	require.NotNil(t, db)
+
+	ctx := context.Background()
+	err := db.Connect(ctx)
+	require.NoError(t, err)
+	defer db.Close()
+
+	baseTime := time.Now()
+	messages := []*archive.Message{
+		{
+			RoomID:      "!room1:example.com",
+			EventID:     "$event1:example.com",
+			Sender:      "@user1:example.com",
+			MessageType: "m.room.message",
+			Timestamp:   baseTime,
+			Content:     map[string]interface{}{"msgtype": "m.text", "body": "Message 1"},
+			Account:     "@alice:example.com",
+		},
+		{
+			RoomID:      "!room2:other.org",
+			EventID:     "$event2:other.org",
+			Sender:      "@user2:other.org",
+			MessageType: "m.room.message",
+			Timestamp:   baseTime.Add(time.Minute),
+			Content:     map[string]interface{}{"msgtype": "m.text", "body": "Message 2"},
+			Account:     "@bob:other.org",
+		},
+	}
+
+	insertedCount, err := db.InsertMessageBatch(ctx, messages)
+	require.NoError(t, err)
+	require.Equal(t, 2, insertedCount)
+
+	// The same event seen through a second account is archived only once
+	duplicate := *messages[0]
+	duplicate.Account = "@bob:other.org"
+	insertedCount, err = db.InsertMessageBatch(ctx, []*archive.Message{&duplicate})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, insertedCount)
+
+	retrieved, err := db.GetMessage(ctx, "$event1:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "@alice:example.com", retrieved.Account)
+
+	accountMessages, err := db.GetMessages(ctx, &archive.MessageFilter{Account: "@bob:other.org"}, 0, 0)
+	assert.NoError(t, err)
+	assert.Len(t, accountMessages, 1)
+
+	stats, err := db.GetAccountStats(ctx)
+	require.NoError(t, err)
+	require.Len(t, stats, 2)
+	assert.Equal(t, "@alice:example.com", stats[0].Account)
+	assert.Equal(t, int64(1), stats[0].MessageCount)
+	assert.Equal(t, int64(1), stats[1].RoomCount)
+}
+
+func TestDuckDBEventIDCollision(t *testing.T) {
+	ctx := context.Background()
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	message := func(roomID, eventID, body string) *archive.Message {
+		return &archive.Message{RoomID: roomID, EventID: eventID, Sender: "@a:example.com", MessageType: "m.room.message",
+			Timestamp: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), Content: map[string]interface{}{"msgtype": "m.text", "body": body}}
+	}
+	_, err := db.InsertMessageBatch(ctx, []*archive.Message{message("!a:example.com", "$same", "first")})
+	require.NoError(t, err)
+
+	inserted, err := db.InsertMessageBatch(ctx, []*archive.Message{message("!b:other.org", "$same", "unrelated"), message("!b:other.org", "$new", "stored")})
+	assert.Equal(t, 1, inserted, "the rest of the batch is stored")
+	var collided *archive.EventIDCollisionError
+	require.ErrorAs(t, err, &collided, "collisions are reported, not dropped silently")
+	require.Len(t, collided.Collisions, 1)
+	assert.Equal(t, "!b:other.org", collided.Collisions[0].Message.RoomID)
+	assert.Equal(t, "!a:example.com", collided.Collisions[0].ExistingRoomID)
+
+	// An import keeps them in quarantine
+	pipeline := &archive.ImportPipeline{DB: db}
+	imported, err := pipeline.Run(ctx, &sliceSource{batches: [][]*archive.Message{{message("!b:other.org", "$same", "unrelated")}}})
+	require.NoError(t, err)
+	assert.Zero(t, imported)
+	assert.Equal(t, 1, pipeline.Quarantined)
+	quarantined, err := db.GetQuarantinedMessages(ctx, "!b:other.org")
+	require.NoError(t, err)
+	require.Len(t, quarantined, 1)
+	assert.Equal(t, "unrelated", quarantined[0].Message.Content["body"])
+	assert.Contains(t, quarantined[0].Reason, "!a:example.com")
+
+	// The same event again in its own room isn't a collision
+	_, err = db.InsertMessageBatch(ctx, []*archive.Message{message("!a:example.com", "$same", "first")})
+	assert.NoError(t, err)
+}
+
+func TestDuckDBRoomStats(t *testing.T) {
+	ctx := context.Background()
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	baseTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	_, err := db.InsertMessageBatch(ctx, []*archive.Message{
+		{RoomID: "!a:example.com", EventID: "$1", Sender: "@a:example.com", MessageType: "m.room.message", Timestamp: baseTime, Content: map[string]interface{}{"body": "first"}},
+		{RoomID: "!a:example.com", EventID: "$2", Sender: "@a:example.com", MessageType: "m.room.message", Timestamp: baseTime.Add(time.Hour), Content: map[string]interface{}{"body": "second"}},
+		{RoomID: "!b:example.com", EventID: "$3", Sender: "@a:example.com", MessageType: "m.room.message", Timestamp: baseTime, Content: map[string]interface{}{"body": "other"}},
+	})
+	require.NoError(t, err)
+
+	stats, err := db.GetRoomStats(ctx)
+	require.NoError(t, err)
+	require.Len(t, stats, 2)
+	assert.Equal(t, "!a:example.com", stats[0].RoomID)
+	assert.Equal(t, int64(2), stats[0].MessageCount)
+	assert.True(t, stats[0].LastMessage.Equal(baseTime.Add(time.Hour)))
+	assert.Equal(t, int64(1), stats[1].MessageCount)
+}
+
+func TestDuckDBDailyStats(t *testing.T) {
+	ctx := context.Background()
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	day := time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC)
+	_, err := db.InsertMessageBatch(ctx, []*archive.Message{
+		{RoomID: "!a:example.com", EventID: "$1", Sender: "@a:example.com", MessageType: "m.room.message", Timestamp: day, Content: map[string]interface{}{"body": "first"}},
+		{RoomID: "!a:example.com", EventID: "$2", Sender: "@a:example.com", MessageType: "m.room.message", Timestamp: day.Add(2 * time.Hour), Content: map[string]interface{}{"body": "second"}},
+		{RoomID: "!a:example.com", EventID: "$3", Sender: "@b:example.com", MessageType: "m.reaction", Timestamp: day.Add(time.Hour), Content: map[string]interface{}{}},
+		{RoomID: "!b:example.com", EventID: "$4", Sender: "@a:example.com", MessageType: "m.room.message", Timestamp: day, Content: map[string]interface{}{"body": "other"}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.InsertMessage(ctx, &archive.Message{RoomID: "!a:example.com", EventID: "$5", Sender: "@a:example.com", MessageType: "m.room.message", Timestamp: day.Add(24 * time.Hour), Content: map[string]interface{}{"body": "next day"}}))
+
+	stats, err := db.GetDailyStats(ctx, "!a:example.com")
+	require.NoError(t, err)
+	require.Len(t, stats, 3)
+	assert.Equal(t, "@a:example.com", stats[0].Sender)
+	assert.Equal(t, int64(2), stats[0].MessageCount)
+	assert.True(t, stats[0].FirstMessage.Equal(day))
+	assert.True(t, stats[0].LastMessage.Equal(day.Add(2*time.Hour)))
+	assert.Equal(t, "m.reaction", stats[1].MessageType)
+	assert.Equal(t, time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC), stats[2].Day.UTC())
+
+	count, err := db.GetRoomMessageCount(ctx, "!a:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), count)
+
+	// Deleting a message uncounts it, dropping statistics that reach zero
+	require.NoError(t, db.DeleteMessage(ctx, "$3"))
+	stats, err = db.GetDailyStats(ctx, "!a:example.com")
+	require.NoError(t, err)
+	assert.Len(t, stats, 2)
+
+	// Rebuilding from the messages gives the same statistics
+	require.NoError(t, db.RebuildDailyStats(ctx))
+	rebuilt, err := db.GetDailyStats(ctx, "!a:example.com")
+	require.NoError(t, err)
+	require.Len(t, rebuilt, 2)
+	assert.Equal(t, stats[0].MessageCount, rebuilt[0].MessageCount)
+	assert.True(t, stats[0].LastMessage.Equal(rebuilt[0].LastMessage))
+
+	all, err := db.GetDailyStats(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, all, 3)
+}
+
 // TestDuckDBDeleteOperations tests delete operations
 func TestDuckDBDeleteOperations(t *testing.T) {
 	config := &archive.DatabaseConfig{
@@ -559,3 +753,858 @@ func TestInitDatabase(t *testing.T) {
 	err = archive.CloseDatabase()
 	assert.NoError(t, err)
 }
+
+func TestDuckDBContentEncryption(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "encrypted.duckdb")
+	ctx := context.Background()
+
+	plainDB := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: dbPath, MaxConns: 1})
+	require.NoError(t, plainDB.Connect(ctx))
+	require.NoError(t, plainDB.InsertMessage(ctx, &archive.Message{
+		RoomID:      "!room:example.com",
+		EventID:     "$plain:example.com",
+		Sender:      "@alice:example.com",
+		MessageType: "m.room.message",
+		Timestamp:   time.Now(),
+		Content:     map[string]interface{}{"msgtype": "m.text", "body": "archived before encryption"},
+		Lang:        "en",
+	}))
+	require.NoError(t, plainDB.InsertMessage(ctx, &archive.Message{
+		RoomID:         "!room:example.com",
+		EventID:        "$relayed:example.com",
+		Sender:         "@relaybot:example.com",
+		MessageType:    "m.room.message",
+		Timestamp:      time.Now(),
+		Content:        map[string]interface{}{"msgtype": "m.text", "body": "relayed before encryption"},
+		AuthorName:     "Dana",
+		AuthorPlatform: "Discord",
+	}))
+	require.NoError(t, plainDB.SaveMediaText(ctx, &archive.MediaText{EventID: "$plain:example.com", RoomID: "!room:example.com", Path: "images/a.png", Text: "screenshot before encryption"}))
+	require.NoError(t, plainDB.Close())
+
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: dbPath, MaxConns: 1, Passphrase: "correct horse"})
+	require.NoError(t, db.Connect(ctx))
+
+	count, err := db.EncryptExistingContent(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	rows, err := db.ExecuteQuery(ctx, "SELECT author_name, author_platform FROM messages WHERE event_id = '$relayed:example.com'")
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Nil(t, rows[0]["author_name"], "db encrypt moves attributed authors into the encrypted content")
+	assert.Nil(t, rows[0]["author_platform"])
+	rows, err = db.ExecuteQuery(ctx, "SELECT lang FROM messages WHERE event_id = '$plain:example.com'")
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Nil(t, rows[0]["lang"], "db encrypt clears detected languages")
+	relayed, err := db.GetMessage(ctx, "$relayed:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "Dana", relayed.AuthorName)
+	assert.Equal(t, "Discord", relayed.AuthorPlatform)
+	assert.Equal(t, map[string]interface{}{"msgtype": "m.text", "body": "relayed before encryption"}, relayed.Content)
+
+	require.NoError(t, db.InsertMessage(ctx, &archive.Message{
+		RoomID:      "!room:example.com",
+		EventID:     "$secret:example.com",
+		Sender:      "@alice:example.com",
+		MessageType: "m.room.message",
+		Timestamp:   time.Now(),
+		Content:     map[string]interface{}{"msgtype": "m.text", "body": "top secret"},
+	}))
+
+	rows, err = db.ExecuteQuery(ctx, "SELECT content::VARCHAR AS content FROM messages")
+	require.NoError(t, err)
+	for _, row := range rows {
+		raw := fmt.Sprint(row["content"])
+		assert.True(t, archive.IsEncryptedContent(raw))
+		assert.NotContains(t, raw, "secret")
+	}
+
+	require.NoError(t, db.InsertMessage(ctx, &archive.Message{
+		RoomID:            "!room:example.com",
+		EventID:           "$forwarded:example.com",
+		Sender:            "@telegram_1:example.com",
+		MessageType:       "m.room.message",
+		Timestamp:         time.Now(),
+		Content:           map[string]interface{}{"msgtype": "m.text", "body": "Forwarded from Jane Doe:\nsecret plans"},
+		ForwardedFrom:     "Jane Doe",
+		ForwardedPlatform: "Telegram",
+	}))
+	rows, err = db.ExecuteQuery(ctx, "SELECT forwarded_from, forwarded_platform FROM messages WHERE event_id = '$forwarded:example.com'")
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Nil(t, rows[0]["forwarded_from"], "provenance says who wrote the content")
+	assert.Nil(t, rows[0]["forwarded_platform"])
+	forwarded, err := db.GetMessage(ctx, "$forwarded:example.com")
+	require.NoError(t, err)
+	from, _ := forwarded.Forwarding()
+	assert.Equal(t, "Jane Doe", from, "provenance is read from the decrypted content")
+
+	require.NoError(t, db.InsertMessage(ctx, &archive.Message{
+		RoomID:         "!room:example.com",
+		EventID:        "$attributed:example.com",
+		Sender:         "@relaybot:example.com",
+		MessageType:    "m.room.message",
+		Timestamp:      time.Now(),
+		Content:        map[string]interface{}{"msgtype": "m.text", "body": "the author was stripped from this body"},
+		AuthorName:     "Erin",
+		AuthorPlatform: "Discord",
+	}))
+	rows, err = db.ExecuteQuery(ctx, "SELECT author_name, author_platform FROM messages WHERE event_id = '$attributed:example.com'")
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Nil(t, rows[0]["author_name"], "attributed authors aren't stored in plaintext")
+	assert.Nil(t, rows[0]["author_platform"])
+	attributed, err := db.GetMessage(ctx, "$attributed:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "Erin", attributed.AuthorName, "the author is read from the decrypted content")
+	assert.Equal(t, "Discord", attributed.AuthorPlatform)
+	assert.NotContains(t, attributed.Content, "mxa.author")
+
+	require.NoError(t, db.SaveMediaText(ctx, &archive.MediaText{EventID: "$secret:example.com", RoomID: "!room:example.com", Path: "images/b.png", Text: "secret screenshot"}))
+	rows, err = db.ExecuteQuery(ctx, "SELECT text FROM media_text")
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	for _, row := range rows {
+		raw := fmt.Sprint(row["text"])
+		assert.True(t, archive.IsEncryptedContent(raw))
+		assert.NotContains(t, raw, "screenshot")
+	}
+
+	mediaTexts, err := db.SearchMediaText(ctx, "SCREENSHOT", "")
+	require.NoError(t, err)
+	assert.Len(t, mediaTexts, 2)
+	mediaTexts, err = db.SearchMediaText(ctx, "secret", "")
+	require.NoError(t, err)
+	require.Len(t, mediaTexts, 1)
+	assert.Equal(t, "secret screenshot", mediaTexts[0].Text)
+
+	message, err := db.GetMessage(ctx, "$secret:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "top secret", message.Content["body"])
+	require.NoError(t, db.Close())
+
+	wrongDB := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: dbPath, MaxConns: 1, Passphrase: "wrong"})
+	assert.Error(t, wrongDB.Connect(ctx))
+	wrongDB.Close()
+
+	lockedDB := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: dbPath, MaxConns: 1})
+	require.NoError(t, lockedDB.Connect(ctx))
+	defer lockedDB.Close()
+	_, err = lockedDB.GetMessage(ctx, "$plain:example.com")
+	assert.ErrorIs(t, err, archive.ErrContentEncrypted)
+
+	// Without the passphrase, new content would be stored in plaintext
+	unencrypted := &archive.Message{RoomID: "!room:example.com", EventID: "$later:example.com", Sender: "@alice:example.com",
+		MessageType: "m.room.message", Timestamp: time.Now(), Content: map[string]interface{}{"msgtype": "m.text", "body": "written without the passphrase"}}
+	assert.ErrorIs(t, lockedDB.InsertMessage(ctx, unencrypted), archive.ErrPassphraseRequired)
+	_, err = lockedDB.InsertMessageBatch(ctx, []*archive.Message{unencrypted})
+	assert.ErrorIs(t, err, archive.ErrPassphraseRequired)
+	assert.ErrorIs(t, lockedDB.SaveMediaText(ctx, &archive.MediaText{EventID: "$later:example.com", RoomID: "!room:example.com", Path: "images/c.png", Text: "plain"}), archive.ErrPassphraseRequired)
+	rows, err = lockedDB.ExecuteQuery(ctx, "SELECT event_id FROM messages WHERE event_id = '$later:example.com'")
+	require.NoError(t, err)
+	assert.Empty(t, rows)
+}
+
+func TestMergeMessages(t *testing.T) {
+	ctx := context.Background()
+	newDB := func() *archive.DuckDBDatabase {
+		db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+		require.NoError(t, db.Connect(ctx))
+		return db
+	}
+	message := func(eventID, body string) *archive.Message {
+		return &archive.Message{
+			RoomID:      "!room:example.com",
+			EventID:     eventID,
+			Sender:      "@alice:example.com",
+			MessageType: "m.room.message",
+			Timestamp:   time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			Content:     map[string]interface{}{"msgtype": "m.text", "body": body},
+		}
+	}
+
+	dst := newDB()
+	defer dst.Close()
+	src := newDB()
+	defer src.Close()
+
+	_, err := dst.InsertMessageBatch(ctx, []*archive.Message{message("$same", "hello"), message("$conflict", "original")})
+	require.NoError(t, err)
+	_, err = src.InsertMessageBatch(ctx, []*archive.Message{message("$same", "hello"), message("$conflict", "edited"), message("$new", "welcome")})
+	require.NoError(t, err)
+
+	result, err := archive.MergeMessages(ctx, dst, src, archive.MergeKeepExisting)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Added)
+	assert.Equal(t, 1, result.Unchanged)
+	assert.Equal(t, 1, result.Conflicts)
+	assert.Equal(t, 0, result.Replaced)
+
+	kept, err := dst.GetMessage(ctx, "$conflict")
+	require.NoError(t, err)
+	assert.Equal(t, "original", kept.Content["body"])
+
+	result, err = archive.MergeMessages(ctx, dst, src, archive.MergeReplace)
+	require.NoError(t, err)
+	assert.Equal(t, 0, result.Added)
+	assert.Equal(t, 1, result.Replaced)
+
+	replaced, err := dst.GetMessage(ctx, "$conflict")
+	require.NoError(t, err)
+	assert.Equal(t, "edited", replaced.Content["body"])
+
+	count, err := dst.GetMessageCount(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), count)
+
+	_, err = archive.MergeMessages(ctx, dst, src, "newest")
+	assert.Error(t, err)
+
+	// The same message re-bridged into a new portal room under a new event ID
+	rebridged := message("$rebridged", "welcome")
+	rebridged.RoomID = "!portal:example.com"
+	_, err = src.InsertMessageBatch(ctx, []*archive.Message{rebridged})
+	require.NoError(t, err)
+
+	result, err = archive.MergeMessages(ctx, dst, src, archive.MergeKeepExisting)
+	require.NoError(t, err)
+	assert.Equal(t, 0, result.Added)
+	assert.Equal(t, 1, result.Duplicates)
+}
+
+func TestDuckDBContentHash(t *testing.T) {
+	ctx := context.Background()
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	message := &archive.Message{
+		RoomID:      "!room:example.com",
+		EventID:     "$hashed",
+		Sender:      "@alice:example.com",
+		MessageType: "m.room.message",
+		Timestamp:   time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Content:     map[string]interface{}{"msgtype": "m.text", "body": "hello"},
+	}
+	require.NoError(t, db.InsertMessage(ctx, message))
+
+	stored, err := db.GetMessage(ctx, "$hashed")
+	require.NoError(t, err)
+	assert.Equal(t, archive.NormalizedContentHash(message), stored.ContentHash)
+
+	hashes, err := db.GetContentHashes(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "$hashed", hashes[stored.ContentHash])
+}
+
+func TestDuckDBMessageLanguage(t *testing.T) {
+	ctx := context.Background()
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	message := func(eventID, lang string) *archive.Message {
+		return &archive.Message{
+			RoomID:      "!room:example.com",
+			EventID:     eventID,
+			Sender:      "@alice:example.com",
+			MessageType: "m.room.message",
+			Timestamp:   time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			Content:     map[string]interface{}{"msgtype": "m.text", "body": "Ich komme am Samstag"},
+			Lang:        lang,
+		}
+	}
+	require.NoError(t, db.InsertMessage(ctx, message("$detected", "de")))
+	_, err := db.InsertMessageBatch(ctx, []*archive.Message{message("$undetected", "")})
+	require.NoError(t, err)
+
+	stored, err := db.GetMessage(ctx, "$detected")
+	require.NoError(t, err)
+	assert.Equal(t, "de", stored.Lang)
+
+	messages, err := db.GetMessages(ctx, &archive.MessageFilter{EventID: "$undetected"}, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	assert.Equal(t, "", messages[0].Lang)
+}
+
+func TestDuckDBAnnotationOperations(t *testing.T) {
+	config := &archive.DatabaseConfig{
+		DatabaseURL: ":memory:",
+		IsInMemory:  true,
+		MaxConns:    5,
+		Debug:       false,
+	}
+
+	db := archive.NewDuckDBDatabase(config)
+	require.NotNil(t, db)
+
+	ctx := context.Background()
+	err := db.Connect(ctx)
+	require.NoError(t, err)
+	defer db.Close()
+
+	baseTime := time.Now()
+	_, err = db.InsertMessageBatch(ctx, []*archive.Message{
+		{RoomID: "!room1:example.com", EventID: "$later", Sender: "@a:example.com", MessageType: "m.room.message", Timestamp: baseTime.Add(time.Minute), Content: map[string]interface{}{"body": "later"}},
+		{RoomID: "!room1:example.com", EventID: "$earlier", Sender: "@a:example.com", MessageType: "m.room.message", Timestamp: baseTime, Content: map[string]interface{}{"body": "earlier"}},
+		{RoomID: "!room2:example.com", EventID: "$other", Sender: "@a:example.com", MessageType: "m.room.message", Timestamp: baseTime, Content: map[string]interface{}{"body": "other"}},
+	})
+	require.NoError(t, err)
+
+	first := &archive.Annotation{EventID: "$later", Note: "Announcement of the outage", Author: "archivist"}
+	require.NoError(t, db.AddAnnotation(ctx, first))
+	assert.NotZero(t, first.ID)
+	assert.False(t, first.CreatedAt.IsZero())
+
+	require.NoError(t, db.AddAnnotation(ctx, &archive.Annotation{EventID: "$earlier", Note: "First report"}))
+	require.NoError(t, db.AddAnnotation(ctx, &archive.Annotation{EventID: "$other", Note: "Unrelated"}))
+
+	notes, err := db.GetAnnotations(ctx, "$later")
+	require.NoError(t, err)
+	require.Len(t, notes, 1)
+	assert.Equal(t, "archivist", notes[0].Author)
+
+	all, err := db.GetAnnotations(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, all, 3)
+
+	// Room annotations follow message order, not creation order
+	roomNotes, err := db.GetRoomAnnotations(ctx, "!room1:example.com")
+	require.NoError(t, err)
+	require.Len(t, roomNotes, 2)
+	assert.Equal(t, "$earlier", roomNotes[0].EventID)
+	assert.Equal(t, "$later", roomNotes[1].EventID)
+
+	require.NoError(t, db.DeleteAnnotation(ctx, first.ID))
+	assert.Error(t, db.DeleteAnnotation(ctx, first.ID))
+}
+
+func TestDuckDBHighlightOperations(t *testing.T) {
+	config := &archive.DatabaseConfig{
+		DatabaseURL: ":memory:",
+		IsInMemory:  true,
+		MaxConns:    5,
+		Debug:       false,
+	}
+
+	db := archive.NewDuckDBDatabase(config)
+	require.NotNil(t, db)
+
+	ctx := context.Background()
+	err := db.Connect(ctx)
+	require.NoError(t, err)
+	defer db.Close()
+
+	baseTime := time.Now()
+	_, err = db.InsertMessageBatch(ctx, []*archive.Message{
+		{RoomID: "!room1:example.com", EventID: "$later", Sender: "@a:example.com", MessageType: "m.room.message", Timestamp: baseTime.Add(time.Minute), Content: map[string]interface{}{"body": "later"}},
+		{RoomID: "!room1:example.com", EventID: "$earlier", Sender: "@a:example.com", MessageType: "m.room.message", Timestamp: baseTime, Content: map[string]interface{}{"body": "earlier"}},
+		{RoomID: "!room2:example.com", EventID: "$other", Sender: "@a:example.com", MessageType: "m.room.message", Timestamp: baseTime, Content: map[string]interface{}{"body": "other"}},
+	})
+	require.NoError(t, err)
+
+	// Pins are replaced wholesale and keep the room's pin order
+	require.NoError(t, db.SetPinnedEvents(ctx, "!room1:example.com", []string{"$earlier", "$later"}))
+	require.NoError(t, db.SetPinnedEvents(ctx, "!room1:example.com", []string{"$later", "$earlier"}))
+	pinned, err := db.GetPinnedEvents(ctx, "!room1:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"$later", "$earlier"}, pinned)
+
+	require.NoError(t, db.SetPinnedEvents(ctx, "!room1:example.com", nil))
+	pinned, err = db.GetPinnedEvents(ctx, "!room1:example.com")
+	require.NoError(t, err)
+	assert.Empty(t, pinned)
+
+	require.NoError(t, db.AddBookmark(ctx, &archive.Bookmark{EventID: "$later", Label: "draft"}))
+	require.NoError(t, db.AddBookmark(ctx, &archive.Bookmark{EventID: "$later", Label: "decision"}))
+	require.NoError(t, db.AddBookmark(ctx, &archive.Bookmark{EventID: "$earlier"}))
+	require.NoError(t, db.AddBookmark(ctx, &archive.Bookmark{EventID: "$other"}))
+
+	// Room bookmarks follow message order
+	bookmarks, err := db.GetBookmarks(ctx, "!room1:example.com")
+	require.NoError(t, err)
+	require.Len(t, bookmarks, 2)
+	assert.Equal(t, "$earlier", bookmarks[0].EventID)
+	assert.Equal(t, "$later", bookmarks[1].EventID)
+	assert.Equal(t, "decision", bookmarks[1].Label)
+
+	all, err := db.GetBookmarks(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, all, 3)
+
+	require.NoError(t, db.DeleteBookmark(ctx, "$later"))
+	assert.Error(t, db.DeleteBookmark(ctx, "$later"))
+}
+
+func TestDuckDBMembershipEvents(t *testing.T) {
+	config := &archive.DatabaseConfig{
+		DatabaseURL: ":memory:",
+		IsInMemory:  true,
+		MaxConns:    5,
+		Debug:       false,
+	}
+
+	db := archive.NewDuckDBDatabase(config)
+	require.NotNil(t, db)
+
+	ctx := context.Background()
+	err := db.Connect(ctx)
+	require.NoError(t, err)
+	defer db.Close()
+
+	baseTime := time.Now().Truncate(time.Second)
+	events := []*archive.MembershipEvent{
+		{EventID: "$leave", RoomID: "!room1:example.com", UserID: "@a:example.com", Membership: "leave", Timestamp: baseTime.Add(time.Hour)},
+		{EventID: "$join", RoomID: "!room1:example.com", UserID: "@a:example.com", Membership: "join", DisplayName: "A", Timestamp: baseTime},
+		{EventID: "$other", RoomID: "!room2:example.com", UserID: "@a:example.com", Membership: "join", Timestamp: baseTime},
+	}
+
+	inserted, err := db.InsertMembershipEvents(ctx, events)
+	require.NoError(t, err)
+	assert.Equal(t, 3, inserted)
+
+	// Re-importing the same events is a no-op
+	inserted, err = db.InsertMembershipEvents(ctx, events[:1])
+	require.NoError(t, err)
+	assert.Equal(t, 0, inserted)
+
+	stored, err := db.GetMembershipEvents(ctx, "!room1:example.com")
+	require.NoError(t, err)
+	require.Len(t, stored, 2)
+	assert.Equal(t, "$join", stored[0].EventID)
+	assert.Equal(t, "A", stored[0].DisplayName)
+	assert.Equal(t, "leave", stored[1].Membership)
+}
+
+func TestDuckDBModerationEvents(t *testing.T) {
+	config := &archive.DatabaseConfig{
+		DatabaseURL: ":memory:",
+		IsInMemory:  true,
+		MaxConns:    5,
+		Debug:       false,
+	}
+
+	db := archive.NewDuckDBDatabase(config)
+	require.NotNil(t, db)
+
+	ctx := context.Background()
+	err := db.Connect(ctx)
+	require.NoError(t, err)
+	defer db.Close()
+
+	baseTime := time.Now().Truncate(time.Second)
+	events := []*archive.ModerationEvent{
+		{EventID: "$ban", RoomID: "!room1:example.com", Action: archive.ModerationBan, Actor: "@mod:example.com", Target: "@spam:example.com", Reason: "spam", Timestamp: baseTime.Add(time.Hour)},
+		{EventID: "$invite", RoomID: "!room1:example.com", Action: archive.ModerationInvite, Actor: "@mod:example.com", Target: "@spam:example.com", Timestamp: baseTime},
+		{EventID: "$other", RoomID: "!room2:example.com", Action: archive.ModerationKick, Actor: "@mod:example.com", Target: "@a:example.com", Timestamp: baseTime},
+	}
+
+	inserted, err := db.InsertModerationEvents(ctx, events)
+	require.NoError(t, err)
+	assert.Equal(t, 3, inserted)
+
+	inserted, err = db.InsertModerationEvents(ctx, events[:1])
+	require.NoError(t, err)
+	assert.Equal(t, 0, inserted)
+
+	stored, err := db.GetModerationEvents(ctx, "!room1:example.com")
+	require.NoError(t, err)
+	require.Len(t, stored, 2)
+	assert.Equal(t, "$invite", stored[0].EventID)
+	assert.Empty(t, stored[0].Reason)
+	assert.Equal(t, archive.ModerationBan, stored[1].Action)
+	assert.Equal(t, "spam", stored[1].Reason)
+}
+
+func TestDuckDBImportState(t *testing.T) {
+	config := &archive.DatabaseConfig{
+		DatabaseURL: ":memory:",
+		IsInMemory:  true,
+		MaxConns:    5,
+		Debug:       false,
+	}
+
+	db := archive.NewDuckDBDatabase(config)
+	require.NotNil(t, db)
+
+	ctx := context.Background()
+	err := db.Connect(ctx)
+	require.NoError(t, err)
+	defer db.Close()
+
+	state, err := db.GetImportState(ctx, "!room1:example.com")
+	require.NoError(t, err)
+	assert.Nil(t, state)
+
+	require.NoError(t, db.SaveImportState(ctx, &archive.ImportState{RoomID: "!room1:example.com", NextBatch: "t1"}))
+	require.NoError(t, db.SaveImportState(ctx, &archive.ImportState{RoomID: "!room1:example.com", NextBatch: "t2"}))
+	require.NoError(t, db.SaveImportState(ctx, &archive.ImportState{RoomID: "!room2:example.com", Complete: true}))
+
+	state, err = db.GetImportState(ctx, "!room1:example.com")
+	require.NoError(t, err)
+	require.NotNil(t, state)
+	assert.Equal(t, "t2", state.NextBatch)
+	assert.False(t, state.Complete)
+	assert.False(t, state.UpdatedAt.IsZero())
+
+	require.NoError(t, db.ClearImportState(ctx, "!room1:example.com"))
+	state, err = db.GetImportState(ctx, "!room1:example.com")
+	require.NoError(t, err)
+	assert.Nil(t, state)
+
+	require.NoError(t, db.ClearImportState(ctx, ""))
+	state, err = db.GetImportState(ctx, "!room2:example.com")
+	require.NoError(t, err)
+	assert.Nil(t, state)
+}
+
+func TestDuckDBMediaText(t *testing.T) {
+	config := &archive.DatabaseConfig{
+		DatabaseURL: ":memory:",
+		IsInMemory:  true,
+		MaxConns:    5,
+		Debug:       false,
+	}
+
+	db := archive.NewDuckDBDatabase(config)
+	require.NotNil(t, db)
+
+	ctx := context.Background()
+	err := db.Connect(ctx)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SaveMediaText(ctx, &archive.MediaText{EventID: "$img1", RoomID: "!room1:example.com", Path: "images/a.png", Text: "old text", Engine: "tesseract"}))
+	require.NoError(t, db.SaveMediaText(ctx, &archive.MediaText{EventID: "$img1", RoomID: "!room1:example.com", Path: "images/a.png", Text: "Build FAILED on main", Engine: "tesseract"}))
+	require.NoError(t, db.SaveMediaText(ctx, &archive.MediaText{EventID: "$img2", RoomID: "!room2:example.com", Path: "images/b.png", Text: "build passed"}))
+
+	eventIDs, err := db.GetMediaTextEventIDs(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"$img1": true, "$img2": true}, eventIDs)
+
+	results, err := db.SearchMediaText(ctx, "build", "")
+	require.NoError(t, err)
+	assert.Len(t, results, 2)
+
+	results, err = db.SearchMediaText(ctx, "failed", "!room1:example.com")
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "$img1", results[0].EventID)
+	assert.Equal(t, "Build FAILED on main", results[0].Text)
+
+	results, err = db.SearchMediaText(ctx, "old text", "")
+	require.NoError(t, err)
+	assert.Empty(t, results)
+}
+
+func TestDuckDBMediaFiles(t *testing.T) {
+	ctx := context.Background()
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	for i, roomID := range []string{"!room1:example.com", "!room2:example.com"} {
+		require.NoError(t, db.InsertMessage(ctx, &archive.Message{
+			RoomID: roomID, EventID: fmt.Sprintf("$img%d", i+1), Sender: "@alice:example.com", UserID: "@alice:example.com",
+			MessageType: "m.room.message", Timestamp: time.Unix(1717236000+int64(i), 0),
+			Content: map[string]interface{}{"msgtype": "m.image", "body": "a.png", "url": "mxc://example.com/a"},
+		}))
+	}
+
+	require.NoError(t, db.SaveMediaFile(ctx, &archive.MediaFile{EventID: "$img1", Kind: archive.MediaKindImage, MXC: "mxc://example.com/a", Status: archive.MediaStatusFailed, Error: "HTTP 502"}))
+	require.NoError(t, db.SaveMediaFile(ctx, &archive.MediaFile{EventID: "$img1", Kind: archive.MediaKindImage, MXC: "mxc://example.com/a", Status: archive.MediaStatusDownloaded, Path: "images/a.png", SHA256: "cafe", Size: 3,
+		ClaimedType: "application/octet-stream", DetectedType: "image/png"}))
+	require.NoError(t, db.SaveMediaFile(ctx, &archive.MediaFile{EventID: "$img1", Kind: archive.MediaKindThumbnail, MXC: "mxc://example.com/t", Status: archive.MediaStatusSkipped, Error: "over budget"}))
+	require.NoError(t, db.SaveMediaFile(ctx, &archive.MediaFile{EventID: "$img2", Kind: archive.MediaKindImage, MXC: "mxc://example.com/a", Status: archive.MediaStatusDownloaded, Path: "images/a.png", SHA256: "cafe", Size: 3}))
+
+	files, err := db.GetMediaFiles(ctx, "!room1:example.com")
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	assert.Equal(t, archive.MediaKindImage, files[0].Kind)
+	assert.Equal(t, archive.MediaStatusDownloaded, files[0].Status)
+	assert.Equal(t, "images/a.png", files[0].Path)
+	assert.Empty(t, files[0].Error, "a later download replaces the failure")
+	assert.Equal(t, "application/octet-stream", files[0].ClaimedType)
+	assert.Equal(t, "image/png", files[0].DetectedType)
+	assert.Equal(t, "!room1:example.com", files[0].RoomID)
+	assert.Equal(t, "over budget", files[1].Error)
+
+	require.NoError(t, db.DeleteMessage(ctx, "$img1"))
+	files, err = db.GetMediaFiles(ctx, "")
+	require.NoError(t, err)
+	require.Len(t, files, 1, "deleting a message deletes its media records")
+	assert.Equal(t, "$img2", files[0].EventID)
+}
+
+func TestDuckDBUnresolvedRelations(t *testing.T) {
+	ctx := context.Background()
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	firstSeen := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, db.SaveUnresolvedRelations(ctx, "!room1:example.com", []*archive.UnresolvedRelation{
+		{EventID: "$reaction", TargetEventID: "$original", RelType: "m.annotation", FirstSeen: firstSeen},
+		{EventID: "$reply", TargetEventID: "$older", RelType: "m.in_reply_to", FirstSeen: firstSeen.Add(time.Hour)},
+	}))
+	require.NoError(t, db.SaveUnresolvedRelations(ctx, "!room2:example.com", []*archive.UnresolvedRelation{
+		{EventID: "$edit", TargetEventID: "$other", RelType: "m.replace", FirstSeen: firstSeen},
+	}))
+
+	relations, err := db.GetUnresolvedRelations(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, relations, 3)
+
+	// A later pass replaces the room's relations
+	require.NoError(t, db.SaveUnresolvedRelations(ctx, "!room1:example.com", []*archive.UnresolvedRelation{
+		{EventID: "$reply", TargetEventID: "$older", RelType: "m.in_reply_to", FirstSeen: firstSeen.Add(time.Hour)},
+	}))
+	relations, err = db.GetUnresolvedRelations(ctx, "!room1:example.com")
+	require.NoError(t, err)
+	require.Len(t, relations, 1)
+	assert.Equal(t, "$older", relations[0].TargetEventID)
+	assert.Equal(t, "!room1:example.com", relations[0].RoomID)
+	assert.True(t, firstSeen.Add(time.Hour).Equal(relations[0].FirstSeen))
+
+	// Saving the same relations again keeps them
+	for i := 0; i < 2; i++ {
+		require.NoError(t, db.SaveUnresolvedRelations(ctx, "!room1:example.com", []*archive.UnresolvedRelation{
+			{EventID: "$reply", TargetEventID: "$older", RelType: "m.in_reply_to", FirstSeen: firstSeen.Add(time.Hour)},
+			{EventID: "$reaction", TargetEventID: "$original", RelType: "m.annotation", FirstSeen: firstSeen},
+		}))
+	}
+	relations, err = db.GetUnresolvedRelations(ctx, "!room1:example.com")
+	require.NoError(t, err)
+	require.Len(t, relations, 2)
+	assert.Equal(t, "$original", relations[0].TargetEventID)
+	assert.Equal(t, "$older", relations[1].TargetEventID)
+	relations, err = db.GetUnresolvedRelations(ctx, "!room2:example.com")
+	require.NoError(t, err)
+	assert.Len(t, relations, 1, "other rooms' relations are left alone")
+}
+
+func TestDuckDBEventTypeMigration(t *testing.T) {
+	config := &archive.DatabaseConfig{
+		DatabaseURL: filepath.Join(t.TempDir(), "archive.duckdb"),
+		MaxConns:    5,
+	}
+
+	db := archive.NewDuckDBDatabase(config)
+	ctx := context.Background()
+	require.NoError(t, db.Connect(ctx))
+
+	messages := []*archive.Message{
+		{RoomID: "!room:example.com", EventID: "$text", Sender: "@a:example.com", MessageType: "m.room.message", Timestamp: time.Now(),
+			Content: map[string]interface{}{"msgtype": "m.image", "body": "cat.png"}},
+		{RoomID: "!room:example.com", EventID: "$reaction", Sender: "@a:example.com", MessageType: "m.room.message", Timestamp: time.Now(),
+			Content: map[string]interface{}{"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": "$text", "key": "👍"}}},
+		{RoomID: "!room:example.com", EventID: "$encrypted", Sender: "@a:example.com", MessageType: "m.room.message", Timestamp: time.Now(),
+			Content: map[string]interface{}{"msgtype": "m.text", "body": "[Encrypted message - decryption not available]", "algorithm": "m.megolm.v1.aes-sha2", "session_id": "s1"}},
+	}
+	_, err := db.InsertMessageBatch(ctx, messages)
+	require.NoError(t, err)
+
+	// Simulate rows written before event types were recorded
+	_, err = db.ExecuteQuery(ctx, "UPDATE messages SET message_type = 'm.room.message', msgtype = NULL")
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	db = archive.NewDuckDBDatabase(config)
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	want := map[string][2]string{
+		"$text":      {"m.room.message", "m.image"},
+		"$reaction":  {"m.reaction", ""},
+		"$encrypted": {"m.room.encrypted", "m.text"},
+	}
+	for eventID, types := range want {
+		msg, err := db.GetMessage(ctx, eventID)
+		require.NoError(t, err)
+		assert.Equal(t, types[0], msg.MessageType, eventID)
+		assert.Equal(t, types[1], msg.MsgType, eventID)
+	}
+
+	count, err := db.GetMessageCount(ctx, &archive.MessageFilter{EventType: "m.room.message", MsgType: "m.image"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestDuckDBExportState(t *testing.T) {
+	config := &archive.DatabaseConfig{
+		DatabaseURL: ":memory:",
+		IsInMemory:  true,
+		MaxConns:    5,
+		Debug:       false,
+	}
+
+	db := archive.NewDuckDBDatabase(config)
+	require.NotNil(t, db)
+
+	ctx := context.Background()
+	err := db.Connect(ctx)
+	require.NoError(t, err)
+	defer db.Close()
+
+	hash, err := db.GetExportHash(ctx, "/exports/archive.html")
+	require.NoError(t, err)
+	assert.Empty(t, hash)
+
+	require.NoError(t, db.SaveExportHash(ctx, "/exports/archive.html", "abc"))
+	require.NoError(t, db.SaveExportHash(ctx, "/exports/archive.html", "def"))
+
+	hash, err = db.GetExportHash(ctx, "/exports/archive.html")
+	require.NoError(t, err)
+	assert.Equal(t, "def", hash)
+}
+
+func TestDuckDBAccountData(t *testing.T) {
+	config := &archive.DatabaseConfig{
+		DatabaseURL: ":memory:",
+		IsInMemory:  true,
+		MaxConns:    5,
+		Debug:       false,
+	}
+
+	db := archive.NewDuckDBDatabase(config)
+	require.NotNil(t, db)
+
+	ctx := context.Background()
+	err := db.Connect(ctx)
+	require.NoError(t, err)
+	defer db.Close()
+
+	order := 0.25
+	err = db.SetRoomTags(ctx, "!room1:example.com", []*archive.RoomTag{
+		{RoomID: "!room1:example.com", Tag: "u.work"},
+		{RoomID: "!room1:example.com", Tag: "m.favourite", Order: &order},
+	})
+	require.NoError(t, err)
+
+	tags, err := db.GetRoomTags(ctx, "!room1:example.com")
+	require.NoError(t, err)
+	require.Len(t, tags, 2)
+	assert.Equal(t, "m.favourite", tags[0].Tag)
+	require.NotNil(t, tags[0].Order)
+	assert.Equal(t, 0.25, *tags[0].Order)
+	assert.Equal(t, "u.work", tags[1].Tag)
+	assert.Nil(t, tags[1].Order)
+
+	// Saving the same tags again, as every re-import does, keeps them
+	newOrder := 0.5
+	require.NoError(t, db.SetRoomTags(ctx, "!room1:example.com", []*archive.RoomTag{
+		{RoomID: "!room1:example.com", Tag: "u.work"},
+		{RoomID: "!room1:example.com", Tag: "m.favourite", Order: &newOrder},
+	}))
+	tags, err = db.GetRoomTags(ctx, "!room1:example.com")
+	require.NoError(t, err)
+	require.Len(t, tags, 2)
+	require.NotNil(t, tags[0].Order)
+	assert.Equal(t, 0.5, *tags[0].Order)
+	assert.Equal(t, "u.work", tags[1].Tag)
+
+	// Setting a room's tags replaces them
+	require.NoError(t, db.SetRoomTags(ctx, "!room1:example.com", nil))
+	tags, err = db.GetRoomTags(ctx, "!room1:example.com")
+	require.NoError(t, err)
+	assert.Empty(t, tags)
+
+	require.NoError(t, db.SetDirectRooms(ctx, map[string][]string{
+		"@alice:example.com": {"!dm1:example.com", "!dm2:example.com"},
+	}))
+	require.NoError(t, db.SetDirectRooms(ctx, map[string][]string{
+		"@alice:example.com": {"!dm1:example.com", "!dm2:example.com"},
+	}))
+	direct, err := db.GetDirectRooms(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"@alice:example.com": {"!dm1:example.com", "!dm2:example.com"}}, direct, "saving the same direct chats again keeps them")
+
+	require.NoError(t, db.SetDirectRooms(ctx, map[string][]string{
+		"@alice:example.com": {"!dm1:example.com"},
+		"@bob:example.com":   {"!dm3:example.com"},
+	}))
+	direct, err = db.GetDirectRooms(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"@alice:example.com": {"!dm1:example.com"}, "@bob:example.com": {"!dm3:example.com"}}, direct)
+
+	require.NoError(t, db.SetDirectRooms(ctx, map[string][]string{
+		"@bob:example.com": {"!dm3:example.com"},
+	}))
+	direct, err = db.GetDirectRooms(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"@bob:example.com": {"!dm3:example.com"}}, direct)
+}
+
+func TestDuckDBEmotePacks(t *testing.T) {
+	config := &archive.DatabaseConfig{
+		DatabaseURL: ":memory:",
+		IsInMemory:  true,
+		MaxConns:    5,
+		Debug:       false,
+	}
+
+	db := archive.NewDuckDBDatabase(config)
+	require.NotNil(t, db)
+
+	ctx := context.Background()
+	err := db.Connect(ctx)
+	require.NoError(t, err)
+	defer db.Close()
+
+	pack := func(roomID, url string) *archive.EmotePack {
+		return archive.NewEmotePack(roomID, "", map[string]interface{}{
+			"images": map[string]interface{}{"meow": map[string]interface{}{"url": url}},
+		})
+	}
+	require.NoError(t, db.SaveEmotePack(ctx, pack("!room:example.com", "mxc://example.com/old")))
+	require.NoError(t, db.SaveEmotePack(ctx, pack("!room:example.com", "mxc://example.com/new")))
+	require.NoError(t, db.SaveEmotePack(ctx, pack("", "mxc://example.com/mine")))
+
+	packs, err := db.GetEmotePacks(ctx)
+	require.NoError(t, err)
+	require.Len(t, packs, 2)
+	assert.Equal(t, "", packs[0].RoomID, "the user's pack comes first")
+	assert.Equal(t, "!room:example.com", packs[1].RoomID)
+	require.Len(t, packs[1].Images, 1)
+	assert.Equal(t, "mxc://example.com/new", packs[1].Images[0].URL, "saving a pack replaces it")
+}
+
+func TestDuckDBRoomProfile(t *testing.T) {
+	config := &archive.DatabaseConfig{
+		DatabaseURL: ":memory:",
+		IsInMemory:  true,
+		MaxConns:    5,
+		Debug:       false,
+	}
+
+	db := archive.NewDuckDBDatabase(config)
+	require.NotNil(t, db)
+
+	ctx := context.Background()
+	err := db.Connect(ctx)
+	require.NoError(t, err)
+	defer db.Close()
+
+	profile, err := db.GetRoomProfile(ctx, "!room:example.com")
+	require.NoError(t, err)
+	assert.Nil(t, profile, "rooms imported before profiles were recorded have none")
+
+	created := time.Date(2021, 3, 14, 15, 9, 26, 0, time.UTC)
+	require.NoError(t, db.SaveRoomProfile(ctx, &archive.RoomProfile{
+		RoomID: "!room:example.com", Name: "Book Club", Topic: "Novels", CreatedAt: &created,
+	}))
+	require.NoError(t, db.SaveRoomProfile(ctx, &archive.RoomProfile{
+		RoomID: "!room:example.com", Name: "Reading Group", CanonicalAlias: "#reading:example.com",
+	}))
+
+	profile, err = db.GetRoomProfile(ctx, "!room:example.com")
+	require.NoError(t, err)
+	require.NotNil(t, profile)
+	assert.Equal(t, "Reading Group", profile.Name)
+	assert.Equal(t, "", profile.Topic, "a removed topic is cleared")
+	assert.Equal(t, "#reading:example.com", profile.CanonicalAlias)
+	require.NotNil(t, profile.CreatedAt, "the creation time is kept when state no longer has it")
+	assert.True(t, created.Equal(*profile.CreatedAt))
+}
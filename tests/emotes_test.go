@@ -0,0 +1,95 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewEmotePack(t *testing.T) {
+	pack := archive.NewEmotePack("!room:example.org", "cats", map[string]interface{}{
+		"pack": map[string]interface{}{"display_name": "Cats", "usage": []interface{}{"emoticon"}},
+		"images": map[string]interface{}{
+			"meow":   map[string]interface{}{"url": "mxc://example.org/meow", "body": "a cat"},
+			"blep":   map[string]interface{}{"url": "mxc://example.org/blep", "usage": []interface{}{"sticker"}},
+			"broken": map[string]interface{}{"url": "https://example.org/broken.png"},
+		},
+	})
+	assert.Equal(t, "Cats", pack.Name())
+	assert.Equal(t, []string{"emoticon"}, pack.Usage)
+	assert.Equal(t, []archive.EmoteImage{
+		{Shortcode: "blep", URL: "mxc://example.org/blep", Usage: []string{"sticker"}},
+		{Shortcode: "meow", URL: "mxc://example.org/meow", Body: "a cat"},
+	}, pack.Images)
+
+	// The older format maps :shortcode: to an mxc URL
+	legacy := archive.NewEmotePack("", "", map[string]interface{}{
+		"short": map[string]interface{}{":wave:": "mxc://example.org/wave"},
+	})
+	assert.Equal(t, "(default)", legacy.Name())
+	assert.Equal(t, []archive.EmoteImage{{Shortcode: "wave", URL: "mxc://example.org/wave"}}, legacy.Images)
+}
+
+func TestRewriteMediaLinks_Emoticons(t *testing.T) {
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.MkdirAll(archive.EmotesDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(archive.EmotesDir, "meow.png"), []byte("\x89PNG\r\n\x1a\n"), 0644))
+
+	resolver, err := archive.NewMediaLinkResolver(archive.MediaLinksS3, "https://cdn.example.org/")
+	require.NoError(t, err)
+	content := archive.RewriteMediaLinks(map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    "hi :meow: :gone:",
+		"formatted_body": `hi <img data-mx-emoticon src="mxc://example.org/meow" alt=":meow:" height="32"> ` +
+			`<img data-mx-emoticon src="mxc://example.org/gone" alt=":gone:"> <img src="mxc://example.org/photo">`,
+	}, resolver)
+	assert.Equal(t, `hi <img data-mx-emoticon src="https://cdn.example.org/emotes/meow.png" alt=":meow:" height="32"> `+
+		`<img data-mx-emoticon src="mxc://example.org/gone" alt=":gone:"> <img src="mxc://example.org/photo">`,
+		content["formatted_body"], "emoji that weren't downloaded, and images that aren't emoji, are left alone")
+}
+
+func TestAttachEmotes(t *testing.T) {
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.MkdirAll(archive.EmotesDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(archive.EmotesDir, "meow.png"), []byte("\x89PNG\r\n\x1a\n"), 0644))
+
+	packs := []*archive.EmotePack{archive.NewEmotePack("!room:example.org", "", map[string]interface{}{
+		"images": map[string]interface{}{"meow": map[string]interface{}{"url": "mxc://example.org/meow"}},
+	})}
+	messages := []archive.ExportMessage{{EventID: "$1", Reactions: []archive.MessageReaction{
+		{Emoji: "👍", Count: 2},
+		{Emoji: "mxc://example.org/meow", Count: 1},
+		{Emoji: "mxc://example.org/blep", Shortcode: "blep", Count: 1},
+	}}}
+	resolver, err := archive.NewMediaLinkResolver(archive.MediaLinksLocal, "")
+	require.NoError(t, err)
+
+	archive.AttachEmotes(messages, packs, resolver)
+	reactions := messages[0].Reactions
+	assert.Empty(t, reactions[0].Image)
+	assert.Equal(t, "emotes/meow.png", reactions[1].Image)
+	assert.Equal(t, "meow", reactions[1].Shortcode, "named by the pack")
+	assert.Empty(t, reactions[2].Image, "not downloaded")
+	assert.Equal(t, "blep", reactions[2].Shortcode)
+}
+
+func TestApplyAggregations_CustomEmojiShortcode(t *testing.T) {
+	messages := []*archive.Message{
+		{EventID: "$1", Content: map[string]interface{}{"msgtype": "m.text", "body": "hello"}},
+		{EventID: "$r1", MessageType: archive.EventTypeReaction, Content: map[string]interface{}{
+			"shortcode":    ":meow:",
+			"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": "$1", "key": "mxc://example.org/meow"},
+		}},
+	}
+	exported := []archive.ExportMessage{{EventID: "$1"}}
+	archive.ApplyAggregations(exported, messages)
+
+	require.Len(t, exported[0].Reactions, 1)
+	assert.Equal(t, "mxc://example.org/meow", exported[0].Reactions[0].Emoji)
+	assert.Equal(t, "meow", exported[0].Reactions[0].Shortcode)
+}
@@ -0,0 +1,108 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEventReference(t *testing.T) {
+	tests := []struct {
+		ref     string
+		roomID  string
+		eventID string
+		err     bool
+	}{
+		{"$abc", "", "$abc", false},
+		{"https://matrix.to/#/!room:example.org/$abc?via=example.org", "!room:example.org", "$abc", false},
+		{"https://matrix.to/#/%21room%3Aexample.org/%24abc", "!room:example.org", "$abc", false},
+		{"https://chat.example.org/#/room/#general:example.org/$abc", "#general:example.org", "$abc", false},
+		{"matrix:roomid/room:example.org/e/abc?via=example.org", "!room:example.org", "$abc", false},
+		{"matrix:r/general:example.org/e/abc", "#general:example.org", "$abc", false},
+		{"https://matrix.to/#/!room:example.org", "", "", true},
+		{"matrix:u/alice:example.org", "", "", true},
+		{"abc", "", "", true},
+	}
+	for _, tt := range tests {
+		roomID, eventID, err := archive.ParseEventReference(tt.ref)
+		if tt.err {
+			assert.Error(t, err, tt.ref)
+			continue
+		}
+		require.NoError(t, err, tt.ref)
+		assert.Equal(t, tt.roomID, roomID, tt.ref)
+		assert.Equal(t, tt.eventID, eventID, tt.ref)
+	}
+}
+
+func contextMessage(eventID, body string, relatesTo map[string]interface{}) archive.ExportMessage {
+	content := map[string]interface{}{"msgtype": "m.text", "body": body}
+	if relatesTo != nil {
+		content["m.relates_to"] = relatesTo
+	}
+	return archive.ExportMessage{EventID: eventID, DisplayName: "Alice " + eventID, Content: content}
+}
+
+func TestSelectEventContext(t *testing.T) {
+	var messages []archive.ExportMessage
+	for i := 0; i < 20; i++ {
+		messages = append(messages, contextMessage(fmt.Sprintf("$%d", i), fmt.Sprintf("message %d", i), nil))
+	}
+	// $15 replies to $12, which replies to $1; $3 is a thread root with a reply at $18
+	messages[12] = contextMessage("$12", "message 12", map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": "$1"}})
+	messages[15] = contextMessage("$15", "message 15", map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": "$12"}})
+	messages[18] = contextMessage("$18", "message 18", map[string]interface{}{"rel_type": "m.thread", "event_id": "$3"})
+
+	selected, err := archive.SelectEventContext(messages, "$15", 1, 1)
+	require.NoError(t, err)
+	var ids []string
+	for _, msg := range selected {
+		ids = append(ids, msg.EventID)
+	}
+	assert.Equal(t, []string{"$1", "$12", "$14", "$15", "$16"}, ids)
+	assert.Equal(t, []string{archive.ContextRepliedTo}, selected[0].Highlights)
+	assert.True(t, selected[1].ContextBreak)
+	assert.Equal(t, []string{archive.ContextTarget}, selected[3].Highlights)
+	assert.True(t, selected[2].ContextBreak)
+	assert.False(t, selected[3].ContextBreak)
+
+	// A thread reply brings in its root
+	selected, err = archive.SelectEventContext(messages, "$18", 0, 0)
+	require.NoError(t, err)
+	require.Len(t, selected, 2)
+	assert.Equal(t, "$3", selected[0].EventID)
+	assert.Equal(t, []string{archive.ContextThread}, selected[0].Highlights)
+
+	// A thread root brings in its replies
+	selected, err = archive.SelectEventContext(messages, "$3", 0, 0)
+	require.NoError(t, err)
+	require.Len(t, selected, 2)
+	assert.Equal(t, "$18", selected[1].EventID)
+
+	_, err = archive.SelectEventContext(messages, "$missing", 1, 1)
+	assert.Error(t, err)
+}
+
+func TestResolveRelations(t *testing.T) {
+	messages := []archive.ExportMessage{
+		contextMessage("$1", "question", nil),
+		contextMessage("$2", "answer", map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": "$1"}}),
+		contextMessage("$3", "in thread", map[string]interface{}{"rel_type": "m.thread", "event_id": "$1"}),
+		contextMessage("$4", "lost reply", map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": "$gone"}}),
+	}
+	archive.ResolveRelations(messages)
+
+	require.NotNil(t, messages[1].RepliesTo)
+	assert.Equal(t, "question", messages[1].RepliesTo.Content)
+	assert.Equal(t, "Alice $1", messages[1].RepliesTo.DisplayName)
+	require.NotNil(t, messages[0].ThreadInfo)
+	assert.True(t, messages[0].ThreadInfo.IsRoot)
+	assert.Equal(t, 1, messages[0].ThreadInfo.ReplyCount)
+	require.NotNil(t, messages[2].ThreadInfo)
+	assert.Equal(t, "$1", messages[2].ThreadInfo.RootEventID)
+	assert.Nil(t, messages[3].RepliesTo)
+}
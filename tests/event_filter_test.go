@@ -0,0 +1,45 @@
+package tests
+
+import (
+	"encoding/json"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventFilter(t *testing.T) {
+	t.Run("lazy-loads members by default", func(t *testing.T) {
+		data, err := json.Marshal(archive.EventFilter(nil, nil))
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"lazy_load_members": true}`, string(data))
+	})
+
+	t.Run("includes and excludes event types", func(t *testing.T) {
+		data, err := json.Marshal(archive.EventFilter([]string{"m.room.message", "m.reaction"}, []string{"m.call.*"}))
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"lazy_load_members": true, "types": ["m.room.message", "m.reaction", "m.room.encrypted"], "not_types": ["m.call.*"]}`, string(data))
+	})
+
+	t.Run("leaves encrypted events out when excluded", func(t *testing.T) {
+		data, err := json.Marshal(archive.EventFilter([]string{"m.room.message"}, []string{"m.room.encrypted"}))
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"lazy_load_members": true, "types": ["m.room.message"], "not_types": ["m.room.encrypted"]}`, string(data))
+	})
+}
+
+func TestEventFilterIncludes(t *testing.T) {
+	assert.True(t, archive.EventFilterIncludes(nil, "m.reaction"))
+
+	filter := archive.EventFilter([]string{"m.room.message", "m.call.*"}, []string{"m.call.candidates"})
+	assert.True(t, archive.EventFilterIncludes(filter, "m.room.message"))
+	assert.True(t, archive.EventFilterIncludes(filter, "m.call.invite"))
+	assert.False(t, archive.EventFilterIncludes(filter, "m.call.candidates"))
+	assert.False(t, archive.EventFilterIncludes(filter, "m.reaction"), "decrypted reactions weren't asked for")
+
+	all := archive.EventFilter(nil, []string{"m.*.candidates"})
+	assert.True(t, archive.EventFilterIncludes(all, "m.reaction"))
+	assert.False(t, archive.EventFilterIncludes(all, "m.call.candidates"))
+}
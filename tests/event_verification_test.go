@@ -0,0 +1,99 @@
+package tests
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signedEvent is the signed event example of the Matrix specification's
+// appendices, signed by "domain" with the key of its example seed
+const signedEvent = `{"auth_events":[],"content":{},"depth":3,"hashes":{"sha256":"5jM4wQpv6lnBo7CLIghJuHdW+s2CMBJPUOGOC89ncos"},` +
+	`"origin":"domain","origin_server_ts":1000000,"prev_events":[],"room_id":"!x:domain","sender":"@a:domain",` +
+	`"signatures":{"domain":{"ed25519:1":"KxwGjPSDEtvnFgU00fwFz+l6d2pJM6XBIaMEn81SXPTRl16AqLAYqfIReFGZlHi5KLjAWbOoMszkwsQma+lYAg"}},` +
+	`"type":"X","unsigned":{"age_ts":1000000}}`
+
+func signedEventMessage() *archive.Message {
+	return &archive.Message{EventID: "$0:domain", RoomID: "!x:domain", Sender: "@a:domain", MessageType: "X",
+		Timestamp: time.UnixMilli(1000000), Content: map[string]interface{}{}}
+}
+
+func specSigningKey(serverName string, keyID id.KeyID) (id.SigningKey, error) {
+	if serverName != "domain" || keyID != "ed25519:1" {
+		return "", fmt.Errorf("no key %s of %s", keyID, serverName)
+	}
+	seed, _ := base64.RawStdEncoding.DecodeString("YJDBA9Xnr2sVqXD9Vj7XVUnmFZcZrlw8Md7kMW+3XA1")
+	publicKey := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	return id.SigningKey(base64.RawStdEncoding.EncodeToString(publicKey)), nil
+}
+
+func TestVerifyEventJSON(t *testing.T) {
+	result := archive.VerifyEventJSON([]byte(signedEvent), signedEventMessage(), "1", specSigningKey)
+	assert.Equal(t, archive.VerificationVerified, result.Status, result.Detail)
+	assert.Equal(t, "domain", result.Origin)
+	assert.Equal(t, "ed25519:1", result.KeyID)
+
+	tampered := strings.Replace(signedEvent, `"content":{}`, `"content":{"body":"forged"}`, 1)
+	msg := signedEventMessage()
+	msg.Content = map[string]interface{}{"body": "forged"}
+	result = archive.VerifyEventJSON([]byte(tampered), msg, "1", specSigningKey)
+	assert.Equal(t, archive.VerificationInvalid, result.Status, "the content hash no longer matches")
+
+	msg = signedEventMessage()
+	msg.Content = map[string]interface{}{"body": "edited in the archive"}
+	result = archive.VerifyEventJSON([]byte(signedEvent), msg, "1", specSigningKey)
+	assert.Equal(t, archive.VerificationMismatch, result.Status)
+
+	msg = signedEventMessage()
+	msg.Timestamp = msg.Timestamp.Add(time.Minute)
+	result = archive.VerifyEventJSON([]byte(signedEvent), msg, "1", specSigningKey)
+	assert.Equal(t, archive.VerificationMismatch, result.Status)
+
+	result = archive.VerifyEventJSON([]byte(signedEvent), signedEventMessage(), "10", specSigningKey)
+	assert.Equal(t, archive.VerificationInvalid, result.Status, "room version 10 event IDs are hashes of the event")
+
+	result = archive.VerifyEventJSON([]byte(signedEvent), signedEventMessage(), "", specSigningKey)
+	assert.Equal(t, archive.VerificationUnsigned, result.Status, "events of rooms of unknown versions aren't checked under the wrong rules")
+
+	unsigned := `{"content":{},"origin_server_ts":1000000,"sender":"@a:domain","type":"X","event_id":"$0:domain"}`
+	result = archive.VerifyEventJSON([]byte(unsigned), signedEventMessage(), "1", specSigningKey)
+	assert.Equal(t, archive.VerificationUnsigned, result.Status)
+
+	result = archive.VerifyEventJSON([]byte(signedEvent), signedEventMessage(), "1",
+		func(string, id.KeyID) (id.SigningKey, error) { return "", fmt.Errorf("unreachable") })
+	assert.Equal(t, archive.VerificationUnsigned, result.Status, "a missing key leaves the signature unchecked")
+}
+
+func TestDuckDBEventVerifications(t *testing.T) {
+	ctx := context.Background()
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	checkedAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, db.SaveEventVerification(ctx, &archive.EventVerification{EventID: "$1", RoomID: "!room:example.com",
+		Status: archive.VerificationUnavailable, CheckedAt: checkedAt}))
+	require.NoError(t, db.SaveEventVerification(ctx, &archive.EventVerification{EventID: "$1", RoomID: "!room:example.com",
+		Status: archive.VerificationVerified, Source: archive.VerificationSourceFederation, Origin: "example.com",
+		KeyID: "ed25519:a", CheckedAt: checkedAt.Add(time.Hour)}))
+
+	verifications, err := db.GetEventVerifications(ctx, "!room:example.com")
+	require.NoError(t, err)
+	require.Len(t, verifications, 1)
+	assert.Equal(t, archive.VerificationVerified, verifications["$1"].Status, "a later check replaces an earlier one")
+	assert.Equal(t, "ed25519:a", verifications["$1"].KeyID)
+
+	verifications, err = db.GetEventVerifications(ctx, "!other:example.com")
+	require.NoError(t, err)
+	assert.Empty(t, verifications)
+}
@@ -0,0 +1,149 @@
+package tests
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+type upgradedExport struct {
+	FormatVersion int                     `json:"format_version" yaml:"format_version"`
+	Participants  []archive.Participant   `json:"participants" yaml:"participants"`
+	Messages      []archive.ExportMessage `json:"messages" yaml:"messages"`
+}
+
+func TestExportFormatVersionOf(t *testing.T) {
+	tests := []struct {
+		document string
+		version  int
+		err      bool
+	}{
+		{`[]`, 1, false},
+		{`{"participants": [], "messages": []}`, 1, false},
+		{`{"format_version": 2, "messages": []}`, 2, false},
+		{`{"format_version": "x", "messages": []}`, 0, true},
+		{`{"rooms": []}`, 0, true},
+		{`"hello"`, 0, true},
+	}
+	for _, tt := range tests {
+		var document interface{}
+		require.NoError(t, json.Unmarshal([]byte(tt.document), &document))
+		version, err := archive.ExportFormatVersionOf(document)
+		if tt.err {
+			assert.Error(t, err, tt.document)
+			continue
+		}
+		require.NoError(t, err, tt.document)
+		assert.Equal(t, tt.version, version, tt.document)
+	}
+}
+
+func TestUpgradeExport(t *testing.T) {
+	t.Chdir("..")
+	dir := t.TempDir()
+
+	// A version 1 array, with fields that early exports left out
+	old := `[
+  {"sender": "@alice:example.org", "timestamp": 1704207845000, "event_id": "$1",
+   "content": {"msgtype": "m.text", "body": "hello"}},
+  {"sender": "bob", "display_name": "Bob", "user_id": "@bob:example.org", "timestamp": "2024-01-02T15:06:05Z",
+   "content": {"msgtype": "m.image", "body": "cat.png"}, "event_id": "$2", "message_type": "m.image"}
+]`
+	path := filepath.Join(dir, "old.json")
+	require.NoError(t, os.WriteFile(path, []byte(old), 0644))
+
+	version, err := archive.UpgradeExport(path, "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, version)
+
+	backup, err := os.ReadFile(path + ".bak")
+	require.NoError(t, err)
+	assert.Equal(t, old, string(backup))
+
+	var upgraded upgradedExport
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &upgraded))
+	assert.Equal(t, archive.ExportFormatVersion, upgraded.FormatVersion)
+	require.Len(t, upgraded.Messages, 2)
+	assert.Equal(t, "2024-01-02T15:04:05Z", upgraded.Messages[0].Timestamp)
+	assert.Equal(t, "@alice:example.org", upgraded.Messages[0].UserID)
+	assert.Equal(t, "m.text", upgraded.Messages[0].MessageType)
+	assert.Equal(t, "Bob", upgraded.Messages[1].DisplayName)
+
+	count, problems, err := archive.ValidateExportFile(path)
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+	assert.Equal(t, 2, count)
+
+	// Upgrading again leaves the file alone
+	version, err = archive.UpgradeExport(path, "")
+	require.NoError(t, err)
+	assert.Equal(t, archive.ExportFormatVersion, version)
+	unchanged, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, string(data), string(unchanged))
+
+	// A version 1 YAML document with participants, written to a new file
+	oldYAML := `participants:
+  - user_id: "@alice:example.org"
+    display_name: Alice
+    message_count: 1
+    first_message: "2024-01-02T15:04:05Z"
+    last_message: "2024-01-02T15:04:05Z"
+messages:
+  - sender: alice
+    display_name: Alice
+    user_id: "@alice:example.org"
+    timestamp: "2024-01-02T15:04:05Z"
+    content: {msgtype: m.text, body: hello}
+    event_id: $1
+    message_type: m.text
+`
+	path = filepath.Join(dir, "old.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(oldYAML), 0644))
+	output := filepath.Join(dir, "new.yaml")
+	version, err = archive.UpgradeExport(path, output)
+	require.NoError(t, err)
+	assert.Equal(t, 1, version)
+	assert.NoFileExists(t, path+".bak")
+
+	upgraded = upgradedExport{}
+	data, err = os.ReadFile(output)
+	require.NoError(t, err)
+	require.NoError(t, yaml.Unmarshal(data, &upgraded))
+	assert.Equal(t, archive.ExportFormatVersion, upgraded.FormatVersion)
+	require.Len(t, upgraded.Participants, 1)
+	assert.Equal(t, "Alice", upgraded.Participants[0].DisplayName)
+	require.Len(t, upgraded.Messages, 1)
+	assert.Equal(t, "hello", upgraded.Messages[0].Content["body"])
+}
+
+func TestUpgradeExportRejects(t *testing.T) {
+	t.Chdir("..")
+	dir := t.TempDir()
+
+	newer := filepath.Join(dir, "newer.json")
+	require.NoError(t, os.WriteFile(newer, []byte(`{"format_version": 99, "messages": []}`), 0644))
+	_, err := archive.UpgradeExport(newer, "")
+	assert.ErrorContains(t, err, "newer than this tool supports")
+
+	// Fields the migration doesn't know about are reported, not dropped
+	unknown := filepath.Join(dir, "unknown.json")
+	require.NoError(t, os.WriteFile(unknown, []byte(`[{"sender": "alice", "timestamp": "2024-01-02T15:04:05Z", "colour": "red"}]`), 0644))
+	_, err = archive.UpgradeExport(unknown, "")
+	assert.ErrorContains(t, err, "colour")
+	assert.NoFileExists(t, unknown+".bak")
+
+	html := filepath.Join(dir, "archive.html")
+	require.NoError(t, os.WriteFile(html, []byte("<html></html>"), 0644))
+	_, err = archive.UpgradeExport(html, "")
+	assert.ErrorContains(t, err, "only JSON and YAML")
+}
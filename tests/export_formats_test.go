@@ -0,0 +1,49 @@
+package tests
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteExportFiles(t *testing.T) {
+	t.Chdir("..")
+
+	messages := []archive.ExportMessage{
+		{EventID: "$1", UserID: "@alice:example.org", Sender: "alice", Timestamp: "2024-01-02T15:04:05Z", Content: map[string]interface{}{"msgtype": "m.text", "body": "hello"}},
+	}
+	base := filepath.Join(t.TempDir(), "archive")
+
+	err := archive.WriteExportFiles(base, []string{"html", "json", "txt", "yaml"}, messages, archive.DefaultExportOptions())
+	require.NoError(t, err)
+
+	for _, ext := range []string{"html", "json", "txt", "yaml"} {
+		data, err := os.ReadFile(base + "." + ext)
+		require.NoError(t, err, ext)
+		assert.Contains(t, string(data), "hello", ext)
+	}
+
+	data, err := os.ReadFile(base + ".json")
+	require.NoError(t, err)
+	var decoded struct {
+		FormatVersion int                     `json:"format_version"`
+		Messages      []archive.ExportMessage `json:"messages"`
+	}
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, archive.ExportFormatVersion, decoded.FormatVersion)
+	assert.Len(t, decoded.Messages, 1)
+
+	// A failing format is reported without stopping the others
+	opts := archive.DefaultExportOptions()
+	opts.Template = "missing"
+	other := filepath.Join(t.TempDir(), "archive")
+	err = archive.WriteExportFiles(other, []string{"html", "json"}, messages, opts)
+	assert.ErrorContains(t, err, "archive.html")
+	assert.FileExists(t, other+".json")
+}
@@ -0,0 +1,79 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func lazyTestMessages() []archive.ExportMessage {
+	var messages []archive.ExportMessage
+	for i, ts := range []string{"2024-01-05T10:00:00Z", "2024-01-06T10:00:00Z", "2024-01-07T10:00:00Z", "2024-02-01T10:00:00Z", "2024-03-01T10:00:00Z"} {
+		messages = append(messages, archive.ExportMessage{
+			EventID:   "$" + string(rune('a'+i)),
+			UserID:    "@alice:example.com",
+			Sender:    "alice",
+			Timestamp: ts,
+			Content:   map[string]interface{}{"msgtype": "m.text", "body": "message " + string(rune('a'+i))},
+		})
+	}
+	return messages
+}
+
+func TestLazySections(t *testing.T) {
+	sections := archive.LazySections(lazyTestMessages(), 2, "archive_files")
+	require.Len(t, sections, 4)
+
+	// January is split in two, and only its first part starts the month
+	assert.Equal(t, "month-2024-01", sections[0].Month)
+	assert.Equal(t, "January 2024", sections[0].Label)
+	assert.Len(t, sections[0].Messages, 2)
+	assert.Empty(t, sections[0].Src)
+	assert.Empty(t, sections[1].Month)
+	assert.Equal(t, 1, sections[1].Count)
+	assert.Nil(t, sections[1].Messages)
+	assert.Equal(t, "archive_files/section-2.js", sections[1].Src)
+	assert.Equal(t, "month-2024-02", sections[2].Month)
+	assert.Equal(t, "month-2024-03", sections[3].Month)
+}
+
+func TestLazyHTMLExport(t *testing.T) {
+	t.Chdir("..")
+
+	opts := archive.DefaultExportOptions()
+	opts.LazyLoad = 2
+	base := filepath.Join(t.TempDir(), "archive")
+	for _, name := range []string{"default", "enhanced", "accessible"} {
+		opts.Template = name
+		require.NoError(t, archive.WriteExportFiles(base, []string{"html"}, lazyTestMessages(), opts), name)
+
+		page, err := os.ReadFile(base + ".html")
+		require.NoError(t, err)
+		assert.Contains(t, string(page), "message a", name)
+		assert.NotContains(t, string(page), "message e", name)
+		assert.Contains(t, string(page), `href="#month-2024-03"`, name)
+		assert.Contains(t, string(page), `data-src="archive_files/section-4.js"`, name)
+		assert.Contains(t, string(page), "Load 1 messages from March 2024", name)
+
+		fragment, err := os.ReadFile(filepath.Join(base+"_files", "section-4.js"))
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(string(fragment), `archiveFragment("section-4", "`), name)
+		assert.Contains(t, string(fragment), "message e", name)
+		assert.NotContains(t, string(fragment), "<", "markup must be escaped inside the script")
+	}
+	opts.Template = ""
+
+	// Below the threshold the export is a single page
+	opts.LazyLoad = archive.DefaultLazyLoad
+	require.NoError(t, archive.WriteExportFiles(base, []string{"html"}, lazyTestMessages(), opts))
+	page, err := os.ReadFile(base + ".html")
+	require.NoError(t, err)
+	assert.Contains(t, string(page), "message e")
+	assert.NotContains(t, string(page), "lazy-section")
+}
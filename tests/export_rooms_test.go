@@ -0,0 +1,61 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportTemplatesConfig(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	require.NoError(t, os.MkdirAll(filepath.Join(home, ".matrix-archive"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(home, ".matrix-archive", "config.yaml"), []byte(`database: archive.duckdb
+export_templates:
+  - tag: u.announcements
+    template: accessible
+  - room: "!*:social.example.org"
+    template: enhanced
+    theme: dark
+  - room: "!*:example.org"
+    theme: auto
+`), 0600))
+
+	cfg, err := archive.LoadConfig()
+	require.NoError(t, err)
+	require.Len(t, cfg.ExportTemplates, 3)
+	require.NoError(t, archive.ValidateRoomTemplates(cfg.ExportTemplates))
+
+	opts := archive.DefaultExportOptions()
+	opts.Template = "default"
+	opts.RoomTemplates = cfg.ExportTemplates
+
+	news := opts.ForRoom("!news:social.example.org", &archive.RoomOrganization{Tags: []string{"u.announcements"}})
+	assert.Equal(t, "accessible", news.Template, "the first matching rule applies")
+	assert.Equal(t, archive.ThemeLight, news.Theme, "a rule without a theme keeps the export's")
+
+	social := opts.ForRoom("!chat:social.example.org", nil)
+	assert.Equal(t, "enhanced", social.Template)
+	assert.Equal(t, archive.ThemeDark, social.Theme)
+	assert.Equal(t, "default", opts.Template, "the options are copied, not changed")
+
+	other := opts.ForRoom("!other:example.com", nil)
+	assert.Same(t, opts, other, "rooms no rule matches keep the options")
+}
+
+func TestValidateRoomTemplates(t *testing.T) {
+	assert.Error(t, archive.ValidateRoomTemplates([]archive.RoomTemplate{{Template: "enhanced"}}), "a rule needs a room or tag")
+	assert.Error(t, archive.ValidateRoomTemplates([]archive.RoomTemplate{{Room: "[", Template: "enhanced"}}))
+	assert.Error(t, archive.ValidateRoomTemplates([]archive.RoomTemplate{{Room: "*", Theme: "sepia"}}))
+	assert.NoError(t, archive.ValidateRoomTemplates(nil))
+
+	rule := archive.RoomTemplate{Room: "!*:example.org", Tag: "m.favourite"}
+	assert.True(t, rule.Matches("!a:example.org", []string{"m.favourite"}))
+	assert.False(t, rule.Matches("!a:example.org", nil), "a rule with both needs both")
+	assert.False(t, rule.Matches("!a:example.com", []string{"m.favourite"}))
+}
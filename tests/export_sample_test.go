@@ -0,0 +1,105 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sampleTestMessages(roomID string, day time.Time, n int) []*archive.Message {
+	messages := make([]*archive.Message, n)
+	for i := range messages {
+		messages[i] = &archive.Message{
+			RoomID:      roomID,
+			EventID:     fmt.Sprintf("$%s-%s-%d", roomID, day.Format("0102"), i),
+			Sender:      "@alice:example.org",
+			MessageType: archive.EventTypeMessage,
+			Timestamp:   day.Add(time.Duration(i) * time.Minute),
+			Content:     map[string]interface{}{"msgtype": "m.text", "body": fmt.Sprint(i)},
+		}
+	}
+	return messages
+}
+
+func sampledIDs(messages []*archive.Message) []string {
+	var ids []string
+	for _, msg := range messages {
+		ids = append(ids, msg.EventID)
+	}
+	return ids
+}
+
+func TestSampleMessages(t *testing.T) {
+	day1 := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+	var messages []*archive.Message
+	messages = append(messages, sampleTestMessages("!a", day1, 50)...)
+	messages = append(messages, sampleTestMessages("!b", day1, 3)...)
+	messages = append(messages, sampleTestMessages("!a", day2, 20)...)
+
+	sample := archive.SampleMessages(messages, 10, 42)
+	counts := make(map[string]int)
+	for _, msg := range sample {
+		counts[msg.RoomID+" "+msg.Timestamp.Format("2006-01-02")]++
+	}
+	assert.Equal(t, map[string]int{"!a 2024-03-01": 10, "!b 2024-03-01": 3, "!a 2024-03-02": 10}, counts)
+	assert.True(t, slices.IsSortedFunc(sample, func(a, b *archive.Message) int { return a.Timestamp.Compare(b.Timestamp) }))
+
+	shuffled := slices.Clone(messages)
+	slices.Reverse(shuffled)
+	assert.Equal(t, sampledIDs(sample), sampledIDs(archive.SampleMessages(shuffled, 10, 42)), "the same seed picks the same sample")
+	assert.NotEqual(t, sampledIDs(sample), sampledIDs(archive.SampleMessages(messages, 10, 7)), "another seed picks another sample")
+
+	// More history on one day leaves the other days' samples as they were
+	grown := append(slices.Clone(messages), sampleTestMessages("!a", day2.Add(12*time.Hour), 30)...)
+	var day1IDs, grownDay1IDs []string
+	for _, msg := range sample {
+		if msg.Timestamp.Before(day2) {
+			day1IDs = append(day1IDs, msg.EventID)
+		}
+	}
+	for _, msg := range archive.SampleMessages(grown, 10, 42) {
+		if msg.Timestamp.Before(day2) {
+			grownDay1IDs = append(grownDay1IDs, msg.EventID)
+		}
+	}
+	assert.Equal(t, day1IDs, grownDay1IDs)
+}
+
+func TestNDJSONExporter(t *testing.T) {
+	exporter := archive.LookupExporter("ndjson")
+	require.NotNil(t, exporter)
+
+	messages := []archive.ExportMessage{
+		{EventID: "$1", RoomID: "!a:example.org", Sender: "@alice:example.org", Timestamp: "2024-03-01T08:00:00Z", Content: map[string]interface{}{"body": "one"}},
+		{EventID: "$2", RoomID: "!b:example.org", Sender: "@bob:example.org", Timestamp: "2024-03-01T09:00:00Z", Content: map[string]interface{}{"body": "two"}},
+	}
+	var buf bytes.Buffer
+	require.NoError(t, exporter.Export(context.Background(), &buf, slices.Values(messages), archive.DefaultExportOptions()))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	var decoded archive.ExportMessage
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &decoded))
+	assert.Equal(t, "$2", decoded.EventID)
+	assert.Equal(t, "!b:example.org", decoded.RoomID)
+
+	path := filepath.Join(t.TempDir(), "sample.ndjson")
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0644))
+	count, problems, err := archive.ValidateExportFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Empty(t, problems)
+}
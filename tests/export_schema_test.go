@@ -0,0 +1,131 @@
+package tests
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func schemaTestMessages() []archive.ExportMessage {
+	return []archive.ExportMessage{
+		{
+			EventID: "$1", UserID: "@alice:example.org", Sender: "alice", DisplayName: "Alice",
+			Timestamp: "2024-01-02T15:04:05Z", MessageType: "m.text",
+			Content:   map[string]interface{}{"msgtype": "m.text", "body": "hello"},
+			Reactions: []archive.MessageReaction{{Emoji: "👍", Users: []string{"@bob:example.org"}, Count: 1, EventID: "$r", Timestamp: time.Date(2024, 1, 2, 15, 5, 0, 0, time.UTC)}},
+		},
+		{
+			EventID: "$2", UserID: "@bob:example.org", Sender: "bob", Timestamp: "2024-01-02T15:06:05Z",
+			Content:   map[string]interface{}{"msgtype": "m.text", "body": "hi"},
+			RepliesTo: &archive.ReplyInfo{EventID: "$1", Sender: "@alice:example.org"},
+		},
+	}
+}
+
+func TestExportSchemaPublished(t *testing.T) {
+	t.Chdir("..")
+
+	published, err := os.ReadFile(archive.ExportSchemaFile)
+	require.NoError(t, err)
+	generated, err := archive.ExportSchemaJSON()
+	require.NoError(t, err)
+	assert.Equal(t, string(generated), string(published),
+		"%s is out of date; regenerate it with: matrix-archive export schema > %s", archive.ExportSchemaFile, archive.ExportSchemaFile)
+}
+
+func TestValidateExportFile(t *testing.T) {
+	t.Chdir("..")
+	dir := t.TempDir()
+
+	// The exporter's own output conforms, in both document layouts
+	base := filepath.Join(dir, "archive")
+	require.NoError(t, archive.WriteExportFiles(base, []string{"json"}, schemaTestMessages(), archive.DefaultExportOptions()))
+	count, problems, err := archive.ValidateExportFile(base + ".json")
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+	assert.Equal(t, 2, count)
+
+	opts := archive.DefaultExportOptions()
+	opts.Participants = true
+	require.NoError(t, archive.WriteExportFiles(base, []string{"json"}, schemaTestMessages(), opts))
+	count, problems, err = archive.ValidateExportFile(base + ".json")
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+	assert.Equal(t, 2, count)
+
+	// An export in an older layout is reported as such
+	data, err := json.Marshal(schemaTestMessages())
+	require.NoError(t, err)
+	path := filepath.Join(dir, "old.json")
+	require.NoError(t, os.WriteFile(path, data, 0644))
+	_, problems, err = archive.ValidateExportFile(path)
+	require.NoError(t, err)
+	require.Len(t, problems, 1)
+	assert.Contains(t, problems[0].Message, "export upgrade")
+
+	// NDJSON is checked one message per line
+	var lines []string
+	for _, message := range schemaTestMessages() {
+		line, err := json.Marshal(message)
+		require.NoError(t, err)
+		lines = append(lines, string(line))
+	}
+	lines = append(lines, `{"event_id": "$3", "sender": "carol"}`)
+	path = filepath.Join(dir, "archive.ndjson")
+	require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644))
+	count, problems, err = archive.ValidateExportFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+	require.NotEmpty(t, problems)
+	assert.Equal(t, "line 3", problems[0].Path)
+	assert.Contains(t, problems[0].Message, "missing required property")
+}
+
+func TestValidateExportRejects(t *testing.T) {
+	schema := archive.ExportSchema()
+	valid, err := json.Marshal(schemaTestMessages())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		mutate func(messages []map[string]interface{})
+		path   string
+	}{
+		{"wrong type", func(m []map[string]interface{}) { m[0]["sender"] = 42 }, "$.messages[0].sender"},
+		{"missing field", func(m []map[string]interface{}) { delete(m[1], "event_id") }, "$.messages[1]"},
+		{"unknown field", func(m []map[string]interface{}) { m[0]["color"] = "red" }, "$.messages[0].color"},
+		{"nested", func(m []map[string]interface{}) {
+			m[0]["reactions"].([]interface{})[0].(map[string]interface{})["count"] = 1.5
+		}, "$.messages[0].reactions[0].count"},
+		{"date-time", func(m []map[string]interface{}) {
+			m[0]["reactions"].([]interface{})[0].(map[string]interface{})["timestamp"] = "yesterday"
+		}, "$.messages[0].reactions[0].timestamp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var messages []map[string]interface{}
+			require.NoError(t, json.Unmarshal(valid, &messages))
+			tt.mutate(messages)
+			var document interface{}
+			data, err := json.Marshal(map[string]interface{}{"format_version": archive.ExportFormatVersion, "messages": messages})
+			require.NoError(t, err)
+			require.NoError(t, json.Unmarshal(data, &document))
+
+			problems := archive.ValidateExport(schema, document)
+			require.Len(t, problems, 1, "%v", problems)
+			assert.Equal(t, tt.path, problems[0].Path)
+		})
+	}
+
+	problems := archive.ValidateExport(schema, map[string]interface{}{"format_version": 1, "messages": []interface{}{}})
+	require.Len(t, problems, 1)
+	assert.Equal(t, "$.format_version", problems[0].Path)
+}
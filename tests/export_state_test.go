@@ -0,0 +1,49 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportInputHash(t *testing.T) {
+	t.Chdir("..")
+
+	messages := []*archive.Message{
+		{EventID: "$1", RoomID: "!room:example.org", Sender: "@alice:example.org", MessageType: "m.room.message", Timestamp: time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC), Content: map[string]interface{}{"msgtype": "m.text", "body": "hello"}},
+	}
+	templatePath := filepath.Join(t.TempDir(), "custom.html.tpl")
+	require.NoError(t, os.WriteFile(templatePath, []byte("{{range .}}{{.Sender}}{{end}}"), 0644))
+	opts := archive.DefaultExportOptions()
+	opts.Template = templatePath
+
+	hash := func() string {
+		h, err := archive.ExportInputHash(messages, []string{"html"}, opts)
+		require.NoError(t, err)
+		return h
+	}
+	original := hash()
+	assert.Equal(t, original, hash())
+
+	// Flags that don't affect the output don't change the hash
+	opts.IfChanged = true
+	opts.ReportPath = "report.json"
+	assert.Equal(t, original, hash())
+
+	require.NoError(t, os.WriteFile(templatePath, []byte("{{range .}}{{.DisplayName}}{{end}}"), 0644))
+	templateChanged := hash()
+	assert.NotEqual(t, original, templateChanged)
+
+	opts.Theme = archive.ThemeDark
+	optionsChanged := hash()
+	assert.NotEqual(t, templateChanged, optionsChanged)
+
+	messages[0].Content["body"] = "hello, edited"
+	assert.NotEqual(t, optionsChanged, hash())
+}
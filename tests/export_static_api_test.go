@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readJSONFile(t *testing.T, filename string, v interface{}) {
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, v))
+}
+
+func TestWriteStaticAPI(t *testing.T) {
+	dir := t.TempDir()
+
+	var messages []archive.ExportMessage
+	for i := 0; i < 5; i++ {
+		user := "@alice:example.com"
+		if i%2 == 1 {
+			user = "@bob:example.com"
+		}
+		messages = append(messages, archive.ExportMessage{
+			UserID:      user,
+			DisplayName: user[1:4],
+			EventID:     fmt.Sprintf("$event%d", i),
+			Timestamp:   fmt.Sprintf("2024-01-0%dT00:00:00Z", i+1),
+			Content:     map[string]interface{}{"body": fmt.Sprintf("message %d", i)},
+		})
+	}
+
+	rooms := []archive.StaticAPIRoom{
+		{RoomID: "!abc:example.com", Name: "General", Messages: messages},
+		{RoomID: "!empty:example.com", Name: "Empty"},
+	}
+	require.NoError(t, archive.WriteStaticAPI(dir, rooms, 2))
+
+	var roomIndex []map[string]interface{}
+	readJSONFile(t, filepath.Join(dir, "rooms.json"), &roomIndex)
+	require.Len(t, roomIndex, 2)
+	assert.Equal(t, "!abc:example.com", roomIndex[0]["room_id"])
+	assert.Equal(t, "rooms/abc_example.com-be411d95/messages/page-1.json", roomIndex[0]["messages_url"])
+	assert.Equal(t, float64(3), roomIndex[0]["page_count"])
+	assert.Equal(t, "2024-01-05T00:00:00Z", roomIndex[0]["last_message"])
+
+	var page map[string]interface{}
+	readJSONFile(t, filepath.Join(dir, "rooms", "abc_example.com-be411d95", "messages", "page-2.json"), &page)
+	assert.Equal(t, "page-1.json", page["prev"])
+	assert.Equal(t, "page-3.json", page["next"])
+	assert.Len(t, page["messages"], 2)
+
+	readJSONFile(t, filepath.Join(dir, "rooms", "abc_example.com-be411d95", "messages", "page-3.json"), &page)
+	assert.Nil(t, page["next"])
+	assert.Len(t, page["messages"], 1)
+
+	// Empty rooms still get a first page so viewers can follow messages_url
+	readJSONFile(t, filepath.Join(dir, "rooms", "empty_example.com-91cee758", "messages", "page-1.json"), &page)
+	assert.Len(t, page["messages"], 0)
+
+	var users []map[string]interface{}
+	readJSONFile(t, filepath.Join(dir, "users.json"), &users)
+	require.Len(t, users, 2)
+	assert.Equal(t, "@alice:example.com", users[0]["user_id"])
+	assert.Equal(t, float64(3), users[0]["message_count"])
+	assert.Equal(t, []interface{}{"!abc:example.com"}, users[0]["rooms"])
+}
+
+func TestWriteStaticAPIRoomPaths(t *testing.T) {
+	dir := t.TempDir()
+	rooms := []archive.StaticAPIRoom{
+		{RoomID: "!abc_def:x", Name: "One", Messages: []archive.ExportMessage{{EventID: "$1", Content: map[string]interface{}{"body": "one"}}}},
+		{RoomID: "!abc:def_x", Name: "Two", Messages: []archive.ExportMessage{{EventID: "$2", Content: map[string]interface{}{"body": "two"}}}},
+	}
+	require.NoError(t, archive.WriteStaticAPI(dir, rooms, 10))
+
+	var roomIndex []map[string]interface{}
+	readJSONFile(t, filepath.Join(dir, "rooms.json"), &roomIndex)
+	require.Len(t, roomIndex, 2)
+	assert.NotEqual(t, roomIndex[0]["messages_url"], roomIndex[1]["messages_url"], "room IDs that sanitize alike get their own directories")
+	for _, entry := range roomIndex {
+		var page map[string]interface{}
+		readJSONFile(t, filepath.Join(dir, filepath.FromSlash(entry["messages_url"].(string))), &page)
+		require.Len(t, page["messages"], 1)
+		want := "one"
+		if entry["room_id"] == "!abc:def_x" {
+			want = "two"
+		}
+		assert.Equal(t, want, page["messages"].([]interface{})[0].(map[string]interface{})["content"].(map[string]interface{})["body"])
+	}
+}
@@ -0,0 +1,53 @@
+package tests
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildExportStats(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	imageDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(imageDir, "downloaded.png"), nil, 0644))
+
+	messages := []*archive.Message{
+		{EventID: "$2", Sender: "@bob:example.org", Timestamp: start.Add(time.Minute), Content: map[string]interface{}{"msgtype": "m.image", "url": "mxc://example.org/downloaded"}},
+		{EventID: "$1", Sender: "@alice:example.org", Timestamp: start, Content: map[string]interface{}{"msgtype": "m.text", "body": "hello"}},
+		{EventID: "$3", Sender: "@alice:example.org", Timestamp: start.Add(2 * time.Minute), Content: map[string]interface{}{"msgtype": "m.image", "url": "mxc://example.org/missing"}},
+		{EventID: "$4", Sender: "@carol:example.org", Timestamp: start.Add(3 * time.Minute), Content: map[string]interface{}{"msgtype": "m.text", "body": "[Encrypted message - decryption not available]", "algorithm": "m.megolm.v1.aes-sha2", "session_id": "abc"}},
+	}
+
+	stats := archive.BuildExportStats("!room:example.org", messages, []string{imageDir})
+	assert.Equal(t, archive.ExportStatsVersion, stats.Version)
+	assert.Equal(t, 4, stats.Messages)
+	assert.Equal(t, map[string]int{"m.text": 1, "m.image": 2, "m.room.encrypted": 1}, stats.CountsByType)
+	assert.Equal(t, 3, stats.Senders)
+	require.NotNil(t, stats.FirstMessage)
+	assert.Equal(t, start, *stats.FirstMessage, "messages needn't be in order")
+	assert.Equal(t, start.Add(3*time.Minute), *stats.LastMessage)
+	assert.Equal(t, 1, stats.DecryptFailures)
+	assert.Equal(t, 1, stats.MediaResolved)
+	assert.Equal(t, 1, stats.MediaMissing)
+
+	empty := archive.BuildExportStats("!room:example.org", nil, nil)
+	assert.Nil(t, empty.FirstMessage)
+	data, err := json.Marshal(empty)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"outputs":[]`)
+	assert.Contains(t, string(data), `"counts_by_type":{}`)
+	assert.NotContains(t, string(data), "first_message")
+}
+
+func TestExportStatsPath(t *testing.T) {
+	assert.Equal(t, "archive.stats.json", archive.ExportStatsPath("archive.html"))
+	assert.Equal(t, filepath.Join("out", "room.stats.json"), archive.ExportStatsPath(filepath.Join("out", "room.json")))
+	assert.Equal(t, "archive.stats.json", archive.ExportStatsPath("archive"), "--formats exports are named by a base name")
+}
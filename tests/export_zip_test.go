@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// decryptZipAES opens a WinZip AES-256 entry the way unzip tools do
+func decryptZipAES(t *testing.T, f *zip.File, password string) ([]byte, bool) {
+	raw, err := f.OpenRaw()
+	require.NoError(t, err)
+	data, err := io.ReadAll(raw)
+	require.NoError(t, err)
+
+	salt, verifier := data[:16], data[16:18]
+	encrypted, auth := data[18:len(data)-10], data[len(data)-10:]
+	keys, err := pbkdf2.Key(sha1.New, password, salt, 1000, 66)
+	require.NoError(t, err)
+	if !bytes.Equal(keys[64:], verifier) {
+		return nil, false
+	}
+	mac := hmac.New(sha1.New, keys[32:64])
+	mac.Write(encrypted)
+	require.Equal(t, mac.Sum(nil)[:10], auth, "authentication code")
+
+	block, err := aes.NewCipher(keys[:32])
+	require.NoError(t, err)
+	compressed := make([]byte, len(encrypted))
+	var counter, stream [16]byte
+	for i := 0; i < len(encrypted); i += 16 {
+		binary.LittleEndian.PutUint64(counter[:], uint64(i/16+1))
+		block.Encrypt(stream[:], counter[:])
+		for j := i; j < len(encrypted) && j < i+16; j++ {
+			compressed[j] = encrypted[j] ^ stream[j-i]
+		}
+	}
+	plain, err := io.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	require.NoError(t, err)
+	return plain, true
+}
+
+func TestWriteZip(t *testing.T) {
+	dir := t.TempDir()
+	page := filepath.Join(dir, "room.html")
+	// Longer than one AES block, so the counter has to advance
+	content := bytes.Repeat([]byte("<p>hello, zip</p>\n"), 20)
+	require.NoError(t, os.WriteFile(page, content, 0644))
+	files := []archive.ZipFile{{Name: "room.html", Path: page}}
+
+	plainPath := filepath.Join(dir, "plain.zip")
+	require.NoError(t, archive.WriteZip(plainPath, files, ""))
+	plain, err := zip.OpenReader(plainPath)
+	require.NoError(t, err)
+	defer plain.Close()
+	require.Len(t, plain.File, 1)
+	r, err := plain.File[0].Open()
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	encryptedPath := filepath.Join(dir, "encrypted.zip")
+	require.NoError(t, archive.WriteZip(encryptedPath, files, "s3cret"))
+	raw, err := os.ReadFile(encryptedPath)
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "hello, zip")
+
+	encrypted, err := zip.OpenReader(encryptedPath)
+	require.NoError(t, err)
+	defer encrypted.Close()
+	require.Len(t, encrypted.File, 1)
+	f := encrypted.File[0]
+	assert.Equal(t, "room.html", f.Name)
+	assert.Equal(t, uint16(99), f.Method, "WinZip AES")
+	assert.NotZero(t, f.Flags&0x1, "marked encrypted")
+	assert.Equal(t, []byte{0x01, 0x99, 7, 0, 2, 0, 'A', 'E', 3, 8, 0}, f.Extra, "AE-2, AES-256, deflated")
+	assert.Equal(t, uint64(len(content)), f.UncompressedSize64)
+
+	_, ok := decryptZipAES(t, f, "wrong")
+	assert.False(t, ok, "a wrong password fails the verifier")
+	decrypted, ok := decryptZipAES(t, f, "s3cret")
+	require.True(t, ok)
+	assert.Equal(t, content, decrypted)
+}
+
+func TestExportedMediaFiles(t *testing.T) {
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.MkdirAll("thumbnails", 0755))
+	require.NoError(t, os.WriteFile(filepath.Join("thumbnails", "abc.jpg"), []byte("jpeg"), 0644))
+
+	messages := []archive.ExportMessage{
+		{Content: map[string]interface{}{"msgtype": "m.image", "url": "thumbnails/abc.jpg"}},
+		{Content: map[string]interface{}{"msgtype": "m.image", "url": "thumbnails/abc.jpg"}},
+		{Content: map[string]interface{}{"msgtype": "m.image", "url": "thumbnails/missing.jpg"}},
+		{Content: map[string]interface{}{"msgtype": "m.image", "url": "https://example.org/_matrix/media/v3/download/x"}},
+		{Content: map[string]interface{}{"msgtype": "m.image", "url": "../secret.jpg"}},
+	}
+	files := archive.ExportedMediaFiles(messages)
+	assert.Equal(t, []archive.ZipFile{{Name: "thumbnails/abc.jpg", Path: filepath.Join("thumbnails", "abc.jpg")}}, files)
+}
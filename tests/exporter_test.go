@@ -0,0 +1,66 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bodyListExporter writes one "sender: body" line per message
+type bodyListExporter struct{}
+
+func (bodyListExporter) Name() string         { return "bodylist" }
+func (bodyListExporter) Extensions() []string { return []string{"bodies", "bl"} }
+
+func (bodyListExporter) Export(ctx context.Context, w io.Writer, messages iter.Seq[archive.ExportMessage], opts *archive.ExportOptions) error {
+	for msg := range messages {
+		if _, err := fmt.Fprintf(w, "%s: %v\n", msg.Sender, msg.Content["body"]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestExporterRegistry(t *testing.T) {
+	t.Chdir("..")
+
+	assert.Equal(t, []string{"txt", "html", "json", "yaml"}, archive.ExportFormats()[:4], "built-in formats come first")
+	assert.NotNil(t, archive.LookupExporter("json"))
+	assert.Nil(t, archive.LookupExporter("bodylist"))
+
+	archive.RegisterExporter(bodyListExporter{})
+	assert.True(t, archive.IsValidFormat("bodylist"))
+	assert.Equal(t, "bodylist", archive.ExportFormats()[len(archive.ExportFormats())-1])
+	assert.Contains(t, archive.ExportExtensions(), "bl")
+
+	messages := []archive.ExportMessage{
+		{EventID: "$1", Sender: "alice", Timestamp: "2024-01-02T15:04:05Z", Content: map[string]interface{}{"msgtype": "m.text", "body": "hello"}},
+		{EventID: "$2", Sender: "bob", Timestamp: "2024-01-02T15:05:00Z", Content: map[string]interface{}{"msgtype": "m.text", "body": "hi"}},
+	}
+	base := filepath.Join(t.TempDir(), "archive")
+	require.NoError(t, archive.WriteExportFiles(base, []string{"bodylist", "yaml"}, messages, archive.DefaultExportOptions()))
+	data, err := os.ReadFile(base + ".bodies")
+	require.NoError(t, err, "files are named with the format's first extension")
+	assert.Equal(t, "alice: hello\nbob: hi\n", string(data))
+	assert.FileExists(t, base+".yaml")
+
+	assert.Error(t, archive.WriteExportFiles(base, []string{"csv"}, messages, archive.DefaultExportOptions()))
+
+	assert.Panics(t, func() { archive.RegisterExporter(bodyListExporter{}) }, "names are unique")
+	assert.Panics(t, func() { archive.RegisterExporter(extensionThief{}) }, "extensions are unique")
+}
+
+// extensionThief claims an extension the built-in YAML exporter uses
+type extensionThief struct{ bodyListExporter }
+
+func (extensionThief) Name() string         { return "thief" }
+func (extensionThief) Extensions() []string { return []string{"yml"} }
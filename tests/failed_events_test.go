@@ -0,0 +1,77 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/event"
+)
+
+const rawEncryptedEvent = `{
+	"type": "m.room.encrypted",
+	"event_id": "$encrypted:example.org",
+	"room_id": "!room:example.org",
+	"sender": "@alice:example.org",
+	"origin_server_ts": 1717236000000,
+	"content": {
+		"algorithm": "m.megolm.v1.aes-sha2",
+		"ciphertext": "AwgAEpABm6",
+		"session_id": "session",
+		"sender_key": "key",
+		"device_id": "DEVICE"
+	}
+}`
+
+func TestParseFailedEvent(t *testing.T) {
+	evt, err := archive.ParseFailedEvent(&archive.FailedEvent{EventID: "$encrypted:example.org", Event: json.RawMessage(rawEncryptedEvent)})
+	require.NoError(t, err)
+	assert.Equal(t, event.EventEncrypted, evt.Type, "the event class is restored")
+	assert.Equal(t, "!room:example.org", evt.RoomID.String())
+	assert.Equal(t, int64(1717236000000), evt.Timestamp)
+	content, ok := evt.Content.Parsed.(*event.EncryptedEventContent)
+	require.True(t, ok, "the content is parsed for decryption")
+	assert.Equal(t, "session", string(content.SessionID))
+
+	_, err = archive.ParseFailedEvent(&archive.FailedEvent{EventID: "$bad", Event: json.RawMessage(`[1]`)})
+	assert.Error(t, err)
+}
+
+func TestDuckDBFailedEvents(t *testing.T) {
+	ctx := context.Background()
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	failed := &archive.FailedEvent{
+		EventID: "$encrypted:example.org",
+		RoomID:  "!room:example.org",
+		Stage:   archive.FailureDecryption,
+		Error:   "no session with given ID found",
+		Event:   json.RawMessage(rawEncryptedEvent),
+	}
+	require.NoError(t, db.SaveFailedEvent(ctx, failed))
+	require.NoError(t, db.SaveFailedEvent(ctx, &archive.FailedEvent{
+		EventID: "$other:example.org", RoomID: "!other:example.org", Stage: archive.FailureConversion, Error: "bad content", Event: json.RawMessage(`{}`),
+	}))
+
+	failed.Error = "still no session"
+	require.NoError(t, db.SaveFailedEvent(ctx, failed))
+
+	events, err := db.GetFailedEvents(ctx, "!room:example.org")
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, 2, events[0].Attempts, "failing again counts another attempt")
+	assert.Equal(t, "still no session", events[0].Error)
+	assert.JSONEq(t, rawEncryptedEvent, string(events[0].Event))
+
+	require.NoError(t, db.DeleteFailedEvent(ctx, "$encrypted:example.org"))
+	events, err = db.GetFailedEvents(ctx, "")
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "$other:example.org", events[0].EventID)
+}
@@ -0,0 +1,85 @@
+package tests
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileMetadataFromContent(t *testing.T) {
+	file := archive.FileMetadataFromContent(map[string]interface{}{
+		"msgtype": "m.file",
+		"body":    "report.pdf",
+		"url":     "mxc://example.com/abc",
+		"info":    map[string]interface{}{"mimetype": "application/pdf", "size": float64(1536)},
+	})
+	require.NotNil(t, file)
+	assert.Equal(t, archive.FileMetadata{Name: "report.pdf", MimeType: "application/pdf", Size: 1536}, *file)
+
+	// With a filename, the body is a caption
+	file = archive.FileMetadataFromContent(map[string]interface{}{"msgtype": "m.file", "body": "the quarterly numbers", "filename": "q3.xlsx"})
+	require.NotNil(t, file)
+	assert.Equal(t, "q3.xlsx", file.Name)
+	assert.Zero(t, file.Size)
+
+	assert.Nil(t, archive.FileMetadataFromContent(map[string]interface{}{"msgtype": "m.image", "body": "photo.jpg"}))
+}
+
+func TestDuckDBFileMetadata(t *testing.T) {
+	ctx := context.Background()
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	_, err := db.InsertMessageBatch(ctx, []*archive.Message{
+		{RoomID: "!room:example.com", EventID: "$file", Sender: "@alice:example.com", MessageType: "m.room.message", Timestamp: time.Now(),
+			Content: map[string]interface{}{"msgtype": "m.file", "body": "notes.txt", "info": map[string]interface{}{"mimetype": "text/plain", "size": 2048}}},
+		{RoomID: "!room:example.com", EventID: "$text", Sender: "@alice:example.com", MessageType: "m.room.message", Timestamp: time.Now(),
+			Content: map[string]interface{}{"msgtype": "m.text", "body": "hello"}},
+	})
+	require.NoError(t, err)
+
+	stored, err := db.GetMessage(ctx, "$file")
+	require.NoError(t, err)
+	assert.Equal(t, "notes.txt", stored.FileName)
+	assert.Equal(t, "text/plain", stored.FileMimeType)
+	assert.Equal(t, int64(2048), stored.FileSize)
+
+	rows, err := db.ExecuteQuery(ctx, "SELECT event_id FROM messages WHERE file_size > 1024")
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, "$file", rows[0]["event_id"])
+
+	stored, err = db.GetMessage(ctx, "$text")
+	require.NoError(t, err)
+	assert.Nil(t, stored.File())
+}
+
+func TestFileDownloadRowsInExports(t *testing.T) {
+	t.Chdir("..")
+
+	messages := []archive.ExportMessage{
+		{EventID: "$1", UserID: "@alice:example.com", Sender: "alice", Timestamp: "2024-01-02T15:04:05Z",
+			Content: map[string]interface{}{"msgtype": "m.file", "body": "slides.pdf", "url": "https://example.com/slides.pdf"},
+			File:    &archive.FileMetadata{Name: "slides.pdf", MimeType: "application/pdf", Size: 3 << 20}},
+	}
+	base := filepath.Join(t.TempDir(), "archive")
+	require.NoError(t, archive.WriteExportFiles(base, []string{"html", "txt"}, messages, archive.DefaultExportOptions()))
+
+	html, err := os.ReadFile(base + ".html")
+	require.NoError(t, err)
+	assert.Contains(t, string(html), `download="slides.pdf"`)
+	assert.Contains(t, string(html), "application/pdf")
+	assert.Contains(t, string(html), "3.0 MB")
+
+	txt, err := os.ReadFile(base + ".txt")
+	require.NoError(t, err)
+	assert.Contains(t, string(txt), "Size: 3.0 MB")
+}
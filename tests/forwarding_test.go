@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectForward(t *testing.T) {
+	tests := []struct {
+		name         string
+		sender       string
+		content      map[string]interface{}
+		wantFrom     string
+		wantPlatform string
+	}{
+		{
+			name:   "telegram forward",
+			sender: "@telegram_123:beeper.local",
+			content: map[string]interface{}{
+				"body":           "Forwarded from Jane Doe:\n> the original text",
+				"formatted_body": `Forwarded from <a href="https://matrix.to/#/@telegram_9:beeper.local">Jane Doe</a>:<tg-forward><blockquote>the original text</blockquote></tg-forward>`,
+			},
+			wantFrom:     "Jane Doe",
+			wantPlatform: "Telegram",
+		},
+		{
+			name:   "discord webhook",
+			sender: "@discordgo_42:beeper.local",
+			content: map[string]interface{}{
+				"body":                           "deploy finished",
+				"com.beeper.per_message_profile": map[string]interface{}{"id": "99", "displayname": "CI Bot"},
+			},
+			wantFrom:     "CI Bot",
+			wantPlatform: "Discord",
+		},
+		{
+			name:    "plain message",
+			sender:  "@alice:matrix.org",
+			content: map[string]interface{}{"body": "I forwarded from my phone: it works"},
+		},
+		{
+			name:    "typed mention of forwarding",
+			sender:  "@alice:matrix.org",
+			content: map[string]interface{}{"body": "Forwarded from my phone"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, platform := archive.DetectForward(tt.sender, tt.content)
+			assert.Equal(t, tt.wantFrom, from)
+			assert.Equal(t, tt.wantPlatform, platform)
+		})
+	}
+}
+
+func TestMessageForwardingPrefersStoredProvenance(t *testing.T) {
+	msg := &archive.Message{
+		Sender:            "@telegram_123:beeper.local",
+		Content:           map[string]interface{}{"body": "Forwarded from Someone Else:\n> hi"},
+		ForwardedFrom:     "Jane Doe",
+		ForwardedPlatform: "Telegram",
+	}
+	from, platform := msg.Forwarding()
+	assert.Equal(t, "Jane Doe", from)
+	assert.Equal(t, "Telegram", platform)
+
+	// Messages archived before provenance was stored fall back to their content
+	msg.ForwardedFrom, msg.ForwardedPlatform = "", ""
+	from, _ = msg.Forwarding()
+	assert.Equal(t, "Someone Else", from)
+}
+
+func TestForwardedFromInExports(t *testing.T) {
+	t.Chdir("..")
+
+	messages := []archive.ExportMessage{
+		{EventID: "$1", UserID: "@telegram_123:beeper.local", Sender: "bob", Timestamp: "2024-01-02T15:04:05Z", Content: map[string]interface{}{"msgtype": "m.text", "body": "hello"}, ForwardedFrom: "Jane Doe", ForwardedPlatform: "Telegram"},
+	}
+	base := filepath.Join(t.TempDir(), "archive")
+	require.NoError(t, archive.WriteExportFiles(base, []string{"html", "txt"}, messages, archive.DefaultExportOptions()))
+
+	for _, ext := range []string{"html", "txt"} {
+		data, err := os.ReadFile(base + "." + ext)
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "Forwarded from Jane Doe (Telegram)", ext)
+	}
+}
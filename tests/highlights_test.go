@@ -0,0 +1,85 @@
+package tests
+
+import (
+	"bytes"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func highlightTestMessages(n int) []archive.ExportMessage {
+	messages := make([]archive.ExportMessage, n)
+	for i := range messages {
+		messages[i] = archive.ExportMessage{
+			EventID:   string(rune('a' + i)),
+			Sender:    "alice",
+			Timestamp: "2024-01-02T15:04:05Z",
+			Content:   map[string]interface{}{"msgtype": "m.text", "body": "message " + string(rune('a'+i))},
+		}
+	}
+	return messages
+}
+
+func eventIDs(messages []archive.ExportMessage) string {
+	ids := ""
+	for _, msg := range messages {
+		ids += msg.EventID
+	}
+	return ids
+}
+
+func TestSelectHighlights(t *testing.T) {
+	messages := highlightTestMessages(10)
+	reasons := map[string][]string{
+		"c": {archive.HighlightPinned},
+		"e": {archive.HighlightBookmarked, archive.HighlightAnnotated},
+		"j": {archive.HighlightAnnotated},
+	}
+
+	selected := archive.SelectHighlights(messages, reasons, 1)
+	// Windows around c and e overlap and merge; j's window is cut off at the end
+	assert.Equal(t, "bcdefij", eventIDs(selected))
+	assert.True(t, selected[0].ContextBreak, "messages before the first window were skipped")
+	assert.False(t, selected[1].ContextBreak)
+	assert.True(t, selected[5].ContextBreak, "messages between windows were skipped")
+	assert.Equal(t, []string{archive.HighlightPinned}, selected[1].Highlights)
+	assert.Empty(t, selected[0].Highlights)
+
+	// The source messages are left untouched
+	assert.Empty(t, messages[2].Highlights)
+
+	assert.Equal(t, "cej", eventIDs(archive.SelectHighlights(messages, reasons, 0)))
+	assert.Empty(t, archive.SelectHighlights(messages, nil, 2))
+}
+
+func TestExportWithTemplateOptions_Highlights(t *testing.T) {
+	t.Chdir("..")
+
+	selected := archive.SelectHighlights(highlightTestMessages(5), map[string][]string{
+		"d": {archive.HighlightPinned, archive.HighlightBookmarked},
+	}, 0)
+	require.Len(t, selected, 1)
+
+	var buf bytes.Buffer
+	err := archive.ExportWithTemplateOptions(&buf, "templates/default.html.tpl", selected, archive.DefaultExportOptions())
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), `class="message highlighted"`)
+	assert.Contains(t, buf.String(), "Messages omitted")
+	assert.Contains(t, buf.String(), `<span class="highlight-badge">Bookmarked</span>`)
+
+	buf.Reset()
+	opts := archive.DefaultExportOptions()
+	opts.Lang = "de"
+	err = archive.ExportWithTemplateOptions(&buf, "templates/default.txt.tpl", selected, opts)
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), "[... Nachrichten ausgelassen ...]")
+	assert.Contains(t, buf.String(), "Hervorgehoben: Angeheftet, Lesezeichen")
+
+	buf.Reset()
+	err = archive.ExportWithTemplateOptions(&buf, "templates/accessible.html.tpl", selected, archive.DefaultExportOptions())
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), "Highlighted: Pinned, Bookmarked")
+}
@@ -0,0 +1,85 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// hookScript writes a shell script that saves its stdin and hook name to out
+func hookScript(t *testing.T, out string, status int) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook scripts are shell scripts")
+	}
+	script := filepath.Join(t.TempDir(), "hook.sh")
+	body := fmt.Sprintf("#!/bin/sh\ncat > %s\necho \"$MATRIX_ARCHIVE_HOOK\" > %s.name\nexit %d\n", out, out, status)
+	require.NoError(t, os.WriteFile(script, []byte(body), 0755))
+	return script
+}
+
+func TestHooksRun(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "event.json")
+	hooks := archive.Hooks{PostBatch: []string{hookScript(t, out, 0)}}
+
+	require.NoError(t, hooks.Run(&archive.HookEvent{Hook: archive.HookPostImport}), "hooks without commands do nothing")
+	assert.NoFileExists(t, out)
+
+	messages := []*archive.Message{{RoomID: "!room:example.org", EventID: "$1", Sender: "@alice:example.org", Content: map[string]interface{}{"msgtype": "m.image", "url": "mxc://example.org/abc"}}}
+	require.NoError(t, hooks.Run(&archive.HookEvent{Hook: archive.HookPostBatch, Source: "matrix", Imported: 1, Messages: messages}))
+
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	var evt archive.HookEvent
+	require.NoError(t, json.Unmarshal(data, &evt))
+	assert.Equal(t, archive.HookPostBatch, evt.Hook)
+	assert.Equal(t, "matrix", evt.Source)
+	assert.False(t, evt.Time.IsZero())
+	require.Len(t, evt.Messages, 1)
+	assert.Equal(t, "mxc://example.org/abc", evt.Messages[0].Content["url"])
+
+	name, err := os.ReadFile(out + ".name")
+	require.NoError(t, err)
+	assert.Equal(t, "post_batch\n", string(name))
+}
+
+func TestHooksRunFailure(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.json")
+	second := filepath.Join(dir, "second.json")
+	hooks := archive.Hooks{PreImport: []string{hookScript(t, first, 1), hookScript(t, second, 0)}}
+
+	err := hooks.Run(&archive.HookEvent{Hook: archive.HookPreImport})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pre_import hook failed")
+	var hookErr *archive.HookError
+	require.ErrorAs(t, err, &hookErr)
+	assert.Equal(t, archive.HookPreImport, hookErr.Hook)
+	assert.FileExists(t, first)
+	assert.NoFileExists(t, second, "a failing command stops the hook")
+}
+
+func TestHooksConfig(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	require.NoError(t, os.MkdirAll(filepath.Join(home, ".matrix-archive"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(home, ".matrix-archive", "config.yaml"), []byte(`hooks:
+  post_batch:
+    - clamscan-media --quiet
+  post_export:
+    - ./notify-export.sh
+`), 0600))
+
+	cfg, err := archive.LoadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"clamscan-media --quiet"}, cfg.Hooks.PostBatch)
+	assert.Len(t, cfg.Hooks.PostExport, 1)
+	assert.Empty(t, cfg.Hooks.PreImport)
+}
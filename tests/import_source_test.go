@@ -0,0 +1,188 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sliceSource returns fixed batches, recording which were checkpointed
+type sliceSource struct {
+	batches [][]*archive.Message
+	next    int
+	stored  int
+}
+
+func (s *sliceSource) NextBatch(ctx context.Context) ([]*archive.Message, error) {
+	if s.next == len(s.batches) {
+		return nil, io.EOF
+	}
+	s.next++
+	return s.batches[s.next-1], nil
+}
+
+func (s *sliceSource) BatchStored(ctx context.Context) { s.stored++ }
+
+func sourceMessage(roomID, eventID, sender string, minutes int) *archive.Message {
+	return &archive.Message{
+		RoomID: roomID, EventID: eventID, Sender: sender, MessageType: "m.room.message",
+		Timestamp: time.Date(2024, 6, 1, 10, minutes, 0, 0, time.UTC),
+		Content:   map[string]interface{}{"msgtype": "m.text", "body": eventID},
+	}
+}
+
+func TestImportPipeline(t *testing.T) {
+	ctx := context.Background()
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	seal, err := archive.BuildRoomSeal("!sealed:example.org", []*archive.Message{sourceMessage("!sealed:example.org", "$old", "@alice:example.org", 0)})
+	require.NoError(t, err)
+	require.NoError(t, db.SealRoom(ctx, seal))
+
+	source := &sliceSource{batches: [][]*archive.Message{
+		{
+			sourceMessage("!room:example.org", "$1", "@alice:example.org", 1),
+			sourceMessage("!room:example.org", "$1", "@alice:example.org", 1), // Repeated in the batch
+			sourceMessage("!room:example.org", "$bot", "@spambot:example.org", 2),
+			sourceMessage("!sealed:example.org", "$late", "@alice:example.org", 3),
+			sourceMessage("!room:example.org", "not-an-event-id", "@alice:example.org", 4),
+		},
+		{},
+		{
+			sourceMessage("!room:example.org", "$early", "@alice:example.org", -30),
+			sourceMessage("!room:example.org", "$2", "@bob:example.org", 5),
+		},
+	}}
+	var progress []int
+	pipeline := &archive.ImportPipeline{
+		DB:      db,
+		Senders: archive.SenderFilter{Deny: []string{"@*bot:*"}},
+		Since:   time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC),
+		OnBatch: func(imported int) { progress = append(progress, imported) },
+	}
+	imported, err := pipeline.Run(ctx, source)
+	require.NoError(t, err)
+	assert.Equal(t, 2, imported)
+	assert.Equal(t, []int{1, 1, 2}, progress)
+	assert.Equal(t, 3, source.stored, "each stored batch is checkpointed")
+
+	messages, err := db.GetMessages(ctx, nil, 0, 0)
+	require.NoError(t, err)
+	var ids []string
+	for _, msg := range messages {
+		ids = append(ids, msg.EventID)
+	}
+	assert.Equal(t, []string{"$1", "$2"}, ids)
+
+	t.Run("already archived events are skipped", func(t *testing.T) {
+		again := &archive.ImportPipeline{DB: db}
+		imported, err := again.Run(ctx, &sliceSource{batches: [][]*archive.Message{{sourceMessage("!room:example.org", "$1", "@alice:example.org", 1)}}})
+		require.NoError(t, err)
+		assert.Zero(t, imported)
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		var batch []*archive.Message
+		for i := 0; i < 10; i++ {
+			batch = append(batch, sourceMessage("!limited:example.org", fmt.Sprintf("$limited%d", i), "@alice:example.org", i))
+		}
+		source := &sliceSource{batches: [][]*archive.Message{batch, batch}}
+		limited := &archive.ImportPipeline{DB: db, Limit: 4}
+		imported, err := limited.Run(ctx, source)
+		require.NoError(t, err)
+		assert.Equal(t, 4, imported)
+		assert.Equal(t, 1, source.next, "no batch is fetched once the limit is reached")
+	})
+
+	t.Run("source errors end the import", func(t *testing.T) {
+		failing := &archive.ImportPipeline{DB: db}
+		_, err := failing.Run(ctx, archive.NewJSONLinesSource(strings.NewReader("{not json}\n")))
+		assert.Error(t, err)
+	})
+}
+
+// failingInsertDB fails the failAt'th batch insert
+type failingInsertDB struct {
+	archive.DatabaseInterface
+	failAt, calls int
+}
+
+func (db *failingInsertDB) InsertMessageBatch(ctx context.Context, messages []*archive.Message) (int, error) {
+	db.calls++
+	if db.calls == db.failAt {
+		return 0, errors.New("disk full")
+	}
+	return db.DatabaseInterface.InsertMessageBatch(ctx, messages)
+}
+
+func TestImportPipelineStoreFailure(t *testing.T) {
+	ctx := context.Background()
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	batches := [][]*archive.Message{
+		{sourceMessage("!room:example.org", "$1", "@alice:example.org", 1)},
+		{sourceMessage("!room:example.org", "$2", "@alice:example.org", 2)},
+		{sourceMessage("!room:example.org", "$3", "@alice:example.org", 3)},
+	}
+	source := &sliceSource{batches: batches}
+	pipeline := &archive.ImportPipeline{DB: &failingInsertDB{DatabaseInterface: db, failAt: 2}}
+	imported, err := pipeline.Run(ctx, source)
+	assert.ErrorContains(t, err, "disk full")
+	assert.Equal(t, 1, imported)
+	assert.Equal(t, 1, source.stored, "the failed batch isn't checkpointed")
+	assert.Equal(t, 2, source.next, "no batch is fetched after the failed one")
+
+	// Resuming from the checkpoint fetches the failed batch again
+	resumed := &sliceSource{batches: batches[source.stored:]}
+	imported, err = (&archive.ImportPipeline{DB: db}).Run(ctx, resumed)
+	require.NoError(t, err)
+	assert.Equal(t, 2, imported)
+	messages, err := db.GetMessages(ctx, nil, 0, 0)
+	require.NoError(t, err)
+	assert.Len(t, messages, 3)
+}
+
+func TestJSONLinesSource(t *testing.T) {
+	ctx := context.Background()
+	var lines []string
+	for i := 0; i < 150; i++ {
+		data, err := json.Marshal(sourceMessage("!room:example.org", fmt.Sprintf("$%d", i), "@alice:example.org", 0))
+		require.NoError(t, err)
+		lines = append(lines, string(data))
+		if i == 10 {
+			lines = append(lines, "")
+		}
+	}
+	source := archive.NewJSONLinesSource(strings.NewReader(strings.Join(lines, "\n")))
+
+	first, err := source.NextBatch(ctx)
+	require.NoError(t, err)
+	assert.Len(t, first, 100)
+	assert.Equal(t, "$0", first[0].EventID)
+	assert.Equal(t, "!room:example.org", first[0].RoomID)
+	assert.Equal(t, "$0", first[0].Content["body"])
+
+	second, err := source.NextBatch(ctx)
+	require.NoError(t, err)
+	assert.Len(t, second, 50)
+
+	_, err = source.NextBatch(ctx)
+	assert.True(t, errors.Is(err, io.EOF))
+
+	_, err = archive.NewJSONLinesSource(strings.NewReader("{}\n[1]\n")).NextBatch(ctx)
+	assert.ErrorContains(t, err, "line 2")
+}
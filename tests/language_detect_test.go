@@ -0,0 +1,127 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	for name, tc := range map[string]struct {
+		text string
+		want string
+	}{
+		"english":    {"I think we should move the meeting to Thursday if that works for you", "en"},
+		"german":     {"Ich glaube, wir sollten das Treffen auf Donnerstag verschieben, wenn das für dich passt", "de"},
+		"french":     {"Je pense qu'il faut déplacer la réunion à jeudi si ça vous convient", "fr"},
+		"spanish":    {"Creo que deberíamos mover la reunión al jueves si te parece bien", "es"},
+		"italian":    {"Penso che dovremmo spostare la riunione a giovedì se per te va bene", "it"},
+		"portuguese": {"Eu acho que a reunião deveria ser na quinta, se isso não for um problema para você", "pt"},
+		"dutch":      {"Ik denk dat we de vergadering naar donderdag moeten verplaatsen als dat voor jou kan", "nl"},
+		"russian":    {"Давайте перенесём встречу на четверг", "ru"},
+		"ukrainian":  {"Давайте перенесемо зустріч на четвер, якщо це зручно", "uk"},
+		"japanese":   {"会議を木曜日に移しましょう", "ja"},
+		"chinese":    {"我们把会议改到星期四吧", "zh"},
+		"korean":     {"회의를 목요일로 옮깁시다", "ko"},
+		"greek":      {"Ας μεταφέρουμε τη συνάντηση την Πέμπτη", "el"},
+		"arabic":     {"لننقل الاجتماع إلى يوم الخميس", "ar"},
+		"hebrew":     {"בואו נעביר את הפגישה ליום חמישי", "he"},
+		"too short":  {"ok thanks", ""},
+		"only links": {"https://example.org/some/page @alice:example.org", ""},
+		"no words":   {"👍 123", ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, archive.DetectLanguage(tc.text))
+		})
+	}
+}
+
+func TestDetectMessageLanguage(t *testing.T) {
+	text := &archive.Message{MessageType: "m.room.message", Content: map[string]interface{}{
+		"msgtype": "m.text", "body": "Wir sehen uns morgen, ich bin dann auch da",
+	}}
+	assert.Equal(t, "de", archive.DetectMessageLanguage(text))
+
+	// The quote of the replied-to message isn't read
+	reply := &archive.Message{MessageType: "m.room.message", Content: map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    "> <@alice:example.org> Wir sehen uns morgen, ich bin dann auch da\n\nSounds good, see you there and thanks for the reminder",
+		"m.relates_to": map[string]interface{}{
+			"m.in_reply_to": map[string]interface{}{"event_id": "$parent"},
+		},
+	}}
+	assert.Equal(t, "en", archive.DetectMessageLanguage(reply))
+
+	// Edits are read from their new content
+	edit := &archive.Message{MessageType: "m.room.message", Content: map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    " * Je ne sais pas si je peux venir",
+		"m.new_content": map[string]interface{}{
+			"msgtype": "m.text", "body": "Je ne sais pas si je peux venir",
+		},
+		"m.relates_to": map[string]interface{}{"rel_type": "m.replace", "event_id": "$original"},
+	}}
+	assert.Equal(t, "fr", archive.DetectMessageLanguage(edit))
+
+	image := &archive.Message{MessageType: "m.room.message", Content: map[string]interface{}{
+		"msgtype": "m.image", "body": "a picture of the whole team at the meetup",
+	}}
+	assert.Equal(t, "", archive.DetectMessageLanguage(image))
+
+	reaction := &archive.Message{MessageType: "m.reaction", Content: map[string]interface{}{
+		"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "key": "👍"},
+	}}
+	assert.Equal(t, "", archive.DetectMessageLanguage(reaction))
+
+	// A stored language wins over the text
+	stored := &archive.Message{MessageType: "m.room.message", Lang: "es", Content: map[string]interface{}{
+		"msgtype": "m.text", "body": "no",
+	}}
+	assert.Equal(t, "es", stored.Language())
+}
+
+func TestFilterMessagesByLanguage(t *testing.T) {
+	textMessage := func(eventID, body string) *archive.Message {
+		return &archive.Message{EventID: eventID, MessageType: "m.room.message", Timestamp: time.Now(),
+			Content: map[string]interface{}{"msgtype": "m.text", "body": body}}
+	}
+	messages := []*archive.Message{
+		textMessage("$en", "Is anyone coming to the meetup this weekend?"),
+		textMessage("$de", "Ich komme am Samstag, aber nicht am Sonntag"),
+		{EventID: "$reaction", MessageType: "m.reaction", Content: map[string]interface{}{
+			"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": "$de", "key": "👍"},
+		}},
+		textMessage("$short", "ok"),
+	}
+
+	var eventIDs []string
+	for _, msg := range archive.FilterMessagesByLanguage(messages, "DE") {
+		eventIDs = append(eventIDs, msg.EventID)
+	}
+	assert.Equal(t, []string{"$de", "$reaction"}, eventIDs)
+}
+
+func TestCountLanguages(t *testing.T) {
+	textMessage := func(sender, body string) *archive.Message {
+		return &archive.Message{Sender: sender, MessageType: "m.room.message",
+			Content: map[string]interface{}{"msgtype": "m.text", "body": body}}
+	}
+	messages := []*archive.Message{
+		textMessage("@alice:example.org", "Is anyone coming to the meetup this weekend?"),
+		textMessage("@bob:example.org", "I will be there on Saturday but not on Sunday"),
+		textMessage("@carol:example.org", "Ich komme am Samstag, aber nicht am Sonntag"),
+		textMessage("@bob:example.org", "ok"),
+		textMessage("@mallory:example.org", "This is what I was going to say"),
+	}
+
+	languages := archive.CountLanguages(messages, map[string]bool{"@mallory:example.org": true})
+	require.Len(t, languages, 3)
+	assert.Equal(t, archive.LanguageCount{Lang: "en", Messages: 2, Senders: 2, Share: 0.5}, languages[0])
+	assert.Equal(t, "de", languages[1].Lang)
+	assert.Equal(t, archive.LanguageUndetermined, languages[2].Lang)
+	assert.Equal(t, 0.25, languages[2].Share)
+}
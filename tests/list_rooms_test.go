@@ -0,0 +1,45 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSortRooms(t *testing.T) {
+	older := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(24 * time.Hour)
+	rooms := func() []archive.RoomInfo {
+		return []archive.RoomInfo{
+			{RoomID: "!c", DisplayName: "charlie", MessageCount: 5, LastArchived: &older, Network: "Telegram"},
+			{RoomID: "!a", DisplayName: "Alpha", Encrypted: true},
+			{RoomID: "!b", DisplayName: "bravo", MessageCount: 50, LastArchived: &newer, Encrypted: true, Network: "Discord"},
+		}
+	}
+	order := func(rooms []archive.RoomInfo) []string {
+		var ids []string
+		for _, room := range rooms {
+			ids = append(ids, room.RoomID)
+		}
+		return ids
+	}
+
+	cases := map[string][]string{
+		archive.SortRoomsByName:      {"!a", "!b", "!c"},
+		archive.SortRoomsByMessages:  {"!b", "!c", "!a"},
+		archive.SortRoomsByLast:      {"!b", "!c", "!a"},
+		archive.SortRoomsByNetwork:   {"!b", "!c", "!a"},
+		archive.SortRoomsByEncrypted: {"!a", "!b", "!c"},
+	}
+	for sortBy, want := range cases {
+		sorted := rooms()
+		require.NoError(t, archive.SortRooms(sorted, sortBy))
+		assert.Equal(t, want, order(sorted), sortBy)
+	}
+
+	assert.Error(t, archive.SortRooms(rooms(), "size"))
+}
@@ -0,0 +1,162 @@
+package tests
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatalog_T(t *testing.T) {
+	catalog := archive.NewCatalog("de", map[string]string{
+		"message.from":        "Von",
+		"message.replying_to": "Antwort an %s",
+	})
+
+	assert.Equal(t, "Von", catalog.T("message.from"))
+	assert.Equal(t, "Antwort an Alice", catalog.T("message.replying_to", "Alice"))
+	assert.Equal(t, "missing.key", catalog.T("missing.key"))
+
+	var nilCatalog *archive.Catalog
+	assert.Equal(t, "message.from", nilCatalog.T("message.from"))
+}
+
+func TestLoadCatalog_FallsBackToEnglish(t *testing.T) {
+	t.Chdir("..")
+
+	catalog, err := archive.LoadCatalog("de")
+	require.NoError(t, err)
+	assert.Equal(t, "Von", catalog.T("message.from"))
+
+	english, err := archive.LoadCatalog("")
+	require.NoError(t, err)
+	assert.Equal(t, "en", english.Lang)
+	assert.Equal(t, "From", english.T("message.from"))
+
+	_, err = archive.LoadCatalog("xx")
+	assert.Error(t, err)
+}
+
+func TestExportWithTemplateOptions_Localized(t *testing.T) {
+	t.Chdir("..")
+
+	messages := []archive.ExportMessage{
+		{
+			Sender:    "alice",
+			Timestamp: "2024-01-02T15:04:05Z",
+			Content:   map[string]interface{}{"msgtype": "m.text", "body": "Hallo"},
+		},
+	}
+
+	opts := archive.DefaultExportOptions()
+	opts.Lang = "de"
+
+	var buf bytes.Buffer
+	err := archive.ExportWithTemplateOptions(&buf, "templates/default.txt.tpl", messages, opts)
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), "Von: alice")
+	assert.Contains(t, buf.String(), "Datum:")
+	assert.Contains(t, buf.String(), "Hallo")
+}
+
+func TestResolveTemplatePath(t *testing.T) {
+	assert.Equal(t, "templates/default.html.tpl", archive.ResolveTemplatePath("", "html"))
+	assert.Equal(t, "templates/accessible.html.tpl", archive.ResolveTemplatePath("accessible", "html"))
+	assert.Equal(t, "templates/default.txt.tpl", archive.ResolveTemplatePath("default", "txt"))
+	assert.Equal(t, "custom/mine.html.tpl", archive.ResolveTemplatePath("custom/mine.html.tpl", "html"))
+}
+
+func TestAccessibleTemplate(t *testing.T) {
+	t.Chdir("..")
+
+	messages := []archive.ExportMessage{
+		{
+			Sender:      "@alice:example.com",
+			UserID:      "@alice:example.com",
+			DisplayName: "Alice",
+			Timestamp:   "2024-01-02T15:04:05Z",
+			Content: map[string]interface{}{
+				"msgtype": "m.image",
+				"body":    "sunset.jpg",
+				"url":     "images/sunset.jpg",
+			},
+		},
+	}
+
+	opts := archive.DefaultExportOptions()
+	opts.HighContrast = true
+
+	var buf bytes.Buffer
+	err := archive.ExportWithTemplateOptions(&buf, archive.ResolveTemplatePath("accessible", "html"), messages, opts)
+	require.NoError(t, err)
+
+	html := buf.String()
+	assert.Contains(t, html, `<html lang="en"`)
+	assert.Contains(t, html, `role="main"`)
+	assert.Contains(t, html, `href="#messages"`)
+	assert.Contains(t, html, `alt="sunset.jpg"`)
+	assert.Contains(t, html, `aria-posinset="1"`)
+}
+
+func TestExportWithTemplateOptions_ThemeAndCustomCSS(t *testing.T) {
+	t.Chdir("..")
+
+	messages := []archive.ExportMessage{
+		{
+			Sender:    "alice",
+			Timestamp: "2024-01-02T15:04:05Z",
+			Content:   map[string]interface{}{"msgtype": "m.text", "body": "Hello"},
+		},
+	}
+
+	cssPath := filepath.Join(t.TempDir(), "brand.css")
+	require.NoError(t, os.WriteFile(cssPath, []byte(".header h1 { color: #ff6600; }"), 0644))
+
+	opts := archive.DefaultExportOptions()
+	opts.Theme = archive.ThemeAuto
+	opts.CSSPath = cssPath
+
+	var buf bytes.Buffer
+	err := archive.ExportWithTemplateOptions(&buf, "templates/default.html.tpl", messages, opts)
+	require.NoError(t, err)
+
+	html := buf.String()
+	assert.Contains(t, html, `data-theme="auto"`)
+	assert.Contains(t, html, "prefers-color-scheme: dark")
+	assert.Contains(t, html, ".header h1 { color: #ff6600; }")
+
+	opts.Theme = "sepia"
+	err = archive.ExportWithTemplateOptions(&buf, "templates/default.html.tpl", messages, opts)
+	assert.Error(t, err)
+}
+
+func TestExportWithTemplateOptions_AnnotationFootnotes(t *testing.T) {
+	t.Chdir("..")
+
+	messages := []archive.ExportMessage{
+		{EventID: "$1", Sender: "alice", Timestamp: "2024-01-02T15:04:05Z", Content: map[string]interface{}{"msgtype": "m.text", "body": "first"}},
+		{EventID: "$2", Sender: "bob", Timestamp: "2024-01-02T15:05:05Z", Content: map[string]interface{}{"msgtype": "m.text", "body": "second"}},
+	}
+	archive.AttachAnnotations(messages, []*archive.Annotation{
+		{EventID: "$2", Note: "Context for the reply", Author: "curator"},
+	})
+	require.Len(t, messages[1].Annotations, 1)
+	assert.Equal(t, 1, messages[1].Annotations[0].Number)
+
+	var buf bytes.Buffer
+	err := archive.ExportWithTemplateOptions(&buf, "templates/default.html.tpl", messages, archive.DefaultExportOptions())
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), `href="#note-1"`)
+	assert.Contains(t, buf.String(), "Curator notes")
+	assert.Contains(t, buf.String(), "Context for the reply")
+
+	buf.Reset()
+	err = archive.ExportWithTemplateOptions(&buf, "templates/default.txt.tpl", messages, archive.DefaultExportOptions())
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), "[Note 1] Context for the reply — curator")
+}
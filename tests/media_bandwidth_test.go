@@ -0,0 +1,60 @@
+package tests
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	for input, expected := range map[string]int64{
+		"5MB/s":   5 << 20,
+		"500kb/s": 500 << 10,
+		"1.5 MiB": 3 << 19,
+		"2048":    2048,
+	} {
+		rate, err := archive.ParseBandwidth(input)
+		require.NoError(t, err, input)
+		assert.Equal(t, expected, rate, input)
+	}
+
+	for _, input := range []string{"", "fast", "0MB/s", "5MB/h"} {
+		_, err := archive.ParseBandwidth(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestBandwidthLimitedClient(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 150<<10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	// The first second's worth arrives at once; the other 50 KB has to wait
+	client := archive.NewBandwidthLimitedClient(100 << 10)
+	start := time.Now()
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, body, data)
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+
+	start = time.Now()
+	resp, err = archive.NewBandwidthLimitedClient(0).Get(server.URL)
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), 400*time.Millisecond, "0 means no limit")
+}
@@ -0,0 +1,96 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{
+		"1024":    1024,
+		"5GB":     5 << 30,
+		"500M":    500 << 20,
+		"1.5 TiB": 3 << 39,
+		"64kb":    64 << 10,
+	}
+	for input, want := range tests {
+		got, err := archive.ParseSize(input)
+		require.NoError(t, err, input)
+		assert.Equal(t, want, got, input)
+	}
+
+	for _, input := range []string{"", "GB", "5 parsecs", "-1GB"} {
+		_, err := archive.ParseSize(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	assert.Equal(t, "512 B", archive.FormatSize(512))
+	assert.Equal(t, "1.5 KB", archive.FormatSize(1536))
+	assert.Equal(t, "5.0 GB", archive.FormatSize(5<<30))
+}
+
+func TestPlanMediaDownloads(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	image := func(eventID string, age time.Duration, thumbnail bool) *archive.Message {
+		info := map[string]interface{}{"size": float64(1000), "mimetype": "image/png"}
+		if thumbnail {
+			info["thumbnail_url"] = "mxc://example.org/thumb-" + eventID
+			info["thumbnail_info"] = map[string]interface{}{"size": float64(10)}
+		}
+		return &archive.Message{
+			EventID:   eventID,
+			Timestamp: start.Add(-age),
+			Content:   map[string]interface{}{"msgtype": "m.image", "url": "mxc://example.org/full-" + eventID, "info": info},
+		}
+	}
+	messages := []*archive.Message{
+		image("old", 48*time.Hour, true),
+		image("new", 0, true),
+		image("nothumb", 24*time.Hour, false),
+		{EventID: "text", Content: map[string]interface{}{"msgtype": "m.text", "body": "hi"}},
+	}
+
+	items := archive.PlanMediaDownloads(messages)
+	var order []string
+	for _, item := range items {
+		order = append(order, item.Kind+":"+item.EventID)
+	}
+	assert.Equal(t, []string{
+		"thumbnail:new", "thumbnail:old",
+		"image:new", "image:nothumb", "image:old",
+	}, order)
+
+	assert.Equal(t, int64(10), items[0].Size)
+	assert.Equal(t, "thumb-new", items[0].Stem)
+	assert.Equal(t, int64(1000), items[2].Size)
+	assert.Equal(t, "image/png", items[0].MimeType, "thumbnails have the type of the image")
+}
+
+func TestMediaDownloadFilter(t *testing.T) {
+	day := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	item := func(mimeType string, size int64, timestamp time.Time) archive.MediaItem {
+		return archive.MediaItem{Kind: archive.MediaKindImage, MimeType: mimeType, Size: size, Timestamp: timestamp}
+	}
+
+	var none *archive.MediaDownloadFilter
+	assert.True(t, none.Includes(item("", 0, day)), "a nil filter includes everything")
+
+	filter := &archive.MediaDownloadFilter{IncludeMIME: []string{"image/*", "video/mp4"}, MaxSize: 50 << 20, Since: day}
+	require.NoError(t, filter.Validate())
+	assert.True(t, filter.Includes(item("image/png", 1000, day)))
+	assert.True(t, filter.Includes(item("Image/JPEG; charset=binary", 1000, day)))
+	assert.True(t, filter.Includes(item("video/mp4", 0, day)), "files of unknown size are kept")
+	assert.False(t, filter.Includes(item("video/webm", 1000, day)))
+	assert.False(t, filter.Includes(item("", 1000, day)), "media of unknown type is left out")
+	assert.False(t, filter.Includes(item("image/png", 51<<20, day)))
+	assert.False(t, filter.Includes(item("image/png", 1000, day.Add(-time.Second))))
+
+	assert.Error(t, (&archive.MediaDownloadFilter{IncludeMIME: []string{"image/["}}).Validate())
+}
@@ -0,0 +1,88 @@
+package tests
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindMediaMatches(t *testing.T) {
+	content := []byte("a photo of a cat")
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+
+	flatDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(flatDir, "flatcat.jpg"), content, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(flatDir, "dog.jpg"), []byte("a photo of a dog"), 0644))
+
+	hashedDir := t.TempDir()
+	dir, err := archive.OpenMediaDir(hashedDir, archive.MediaLayoutHashed)
+	require.NoError(t, err)
+	_, _, err = dir.Save("hashedcat", ".jpg", "image/jpeg", strings.NewReader(string(content)), 0)
+	require.NoError(t, err)
+
+	image := func(eventID, mediaID string, day int) *archive.Message {
+		return &archive.Message{RoomID: "!pets:example.com", EventID: eventID, Sender: "@alice:example.com",
+			MessageType: "m.room.message", Timestamp: time.Date(2024, 5, day, 9, 0, 0, 0, time.UTC),
+			Content: map[string]interface{}{"msgtype": "m.image", "body": "pet.jpg", "url": "mxc://example.com/" + mediaID}}
+	}
+	messages := []*archive.Message{
+		image("$repost", "hashedcat", 3),
+		image("$first", "flatcat", 1),
+		image("$dog", "dog", 2),
+		{RoomID: "!pets:example.com", EventID: "$text", Sender: "@bob:example.com", MessageType: "m.room.message",
+			Timestamp: time.Date(2024, 5, 4, 9, 0, 0, 0, time.UTC), Content: map[string]interface{}{"msgtype": "m.text", "body": "cute"}},
+	}
+
+	matches, err := archive.FindMediaMatches(messages, hash, -1, []string{flatDir, hashedDir})
+	require.NoError(t, err)
+	require.Len(t, matches, 2)
+	assert.Equal(t, "$first", matches[0].EventID, "oldest first")
+	assert.Equal(t, filepath.Join(flatDir, "flatcat.jpg"), matches[0].Path)
+	assert.Equal(t, "$repost", matches[1].EventID)
+	assert.Equal(t, "hashedcat", matches[1].MediaID)
+	assert.Equal(t, "@alice:example.com", matches[1].Sender)
+
+	matches, err = archive.FindMediaMatches(messages, hash, int64(len(content)), []string{flatDir})
+	require.NoError(t, err)
+	assert.Len(t, matches, 1, "with a known size")
+
+	matches, err = archive.FindMediaMatches(messages, strings.Repeat("0", 64), -1, []string{flatDir, hashedDir, filepath.Join(flatDir, "missing")})
+	require.NoError(t, err)
+	assert.Empty(t, matches)
+}
+
+func TestRecordedMediaMatches(t *testing.T) {
+	image := func(eventID string, day int) *archive.Message {
+		return &archive.Message{RoomID: "!pets:example.com", EventID: eventID, Sender: "@alice:example.com",
+			MessageType: "m.room.message", Timestamp: time.Date(2024, 5, day, 9, 0, 0, 0, time.UTC),
+			Content: map[string]interface{}{"msgtype": "m.image", "body": "cat.jpg", "url": "mxc://example.com/" + eventID[1:]}}
+	}
+	messages := []*archive.Message{image("$repost", 3), image("$first", 1), image("$failed", 2)}
+	files := []*archive.MediaFile{
+		{EventID: "$repost", Kind: archive.MediaKindImage, Status: archive.MediaStatusDownloaded, SHA256: "cafe", Path: "archive/images/repost.jpg"},
+		{EventID: "$first", Kind: archive.MediaKindThumbnail, Status: archive.MediaStatusDownloaded, SHA256: "cafe", Path: "thumbnails/first.jpg"},
+		{EventID: "$first", Kind: archive.MediaKindImage, Status: archive.MediaStatusDownloaded, SHA256: "cafe", Path: "images/first.jpg"},
+		{EventID: "$failed", Kind: archive.MediaKindImage, Status: archive.MediaStatusFailed, SHA256: "cafe"},
+		{EventID: "$gone", Kind: archive.MediaKindImage, Status: archive.MediaStatusDownloaded, SHA256: "cafe", Path: "images/gone.jpg"},
+	}
+
+	matches := archive.RecordedMediaMatches(files, messages, "cafe")
+	require.Len(t, matches, 2)
+	assert.Equal(t, "$first", matches[0].EventID, "oldest first, once per message")
+	assert.Equal(t, filepath.FromSlash("thumbnails/first.jpg"), matches[0].Path)
+	assert.Equal(t, "$repost", matches[1].EventID)
+	assert.Equal(t, "repost", matches[1].MediaID)
+	assert.Equal(t, filepath.FromSlash("archive/images/repost.jpg"), matches[1].Path)
+
+	assert.Empty(t, archive.RecordedMediaMatches(files, messages, "beef"))
+}
@@ -0,0 +1,90 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMediaDirHashedLayout(t *testing.T) {
+	root := t.TempDir()
+	dir, err := archive.OpenMediaDir(root, archive.MediaLayoutHashed)
+	require.NoError(t, err)
+	assert.True(t, dir.Hashed())
+
+	// Content is stored under two levels of its SHA-256
+	path, size, err := dir.Save("abc", ".png", "image/png", strings.NewReader("cat"), 0)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), size)
+	const catHash = "77af778b51abd4a3c51c5ddd97204a9c3ae614ebccb75a606c3b6865aed6744e"
+	assert.Equal(t, filepath.Join(root, "77", "af", catHash+".png"), path)
+	assert.Equal(t, path, dir.Find("abc"))
+	assert.Empty(t, dir.Find("missing"))
+
+	// Identical content under another media ID is stored once
+	dupPath, _, err := dir.Save("def", ".png", "image/png", strings.NewReader("cat"), 0)
+	require.NoError(t, err)
+	assert.Equal(t, path, dupPath)
+	entries, err := os.ReadDir(filepath.Join(root, "77", "af"))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// Content over budget isn't kept or indexed
+	_, _, err = dir.Save("big", ".png", "image/png", strings.NewReader("much too large"), 4)
+	assert.Error(t, err)
+	assert.Empty(t, dir.Find("big"))
+
+	// A reopened directory keeps the layout and finds media through the index
+	reopened, err := archive.OpenMediaDir(root, "")
+	require.NoError(t, err)
+	assert.True(t, reopened.Hashed())
+	assert.Equal(t, path, reopened.Find("def"))
+
+	existing, err := archive.GetExistingFilesMap(root)
+	require.NoError(t, err)
+	assert.True(t, existing["abc"])
+	assert.True(t, existing["def"])
+	assert.False(t, existing["big"])
+
+	_, err = archive.OpenMediaDir(root, archive.MediaLayoutFlat)
+	assert.ErrorContains(t, err, "hashed")
+
+	files := 0
+	require.NoError(t, filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && !strings.HasSuffix(path, archive.MediaIndexFile) {
+			files++
+		}
+		return err
+	}))
+	assert.Equal(t, 1, files, "no temporary files are left behind")
+}
+
+func TestMediaDirFlatLayout(t *testing.T) {
+	root := t.TempDir()
+	dir, err := archive.OpenMediaDir(root, "")
+	require.NoError(t, err)
+	assert.False(t, dir.Hashed())
+
+	path, _, err := dir.Save("abc", ".jpeg", "image/jpeg", strings.NewReader("dog"), 0)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, "abc.jpeg"), path)
+	assert.Equal(t, path, dir.Find("abc"))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm(), "media is readable by whoever serves the export")
+	assert.NoFileExists(t, filepath.Join(root, archive.MediaIndexFile))
+
+	// Switching a directory to the hashed layout still finds flat files
+	hashed, err := archive.OpenMediaDir(root, archive.MediaLayoutHashed)
+	require.NoError(t, err)
+	assert.Equal(t, path, hashed.Find("abc"))
+
+	_, err = archive.OpenMediaDir(root, "nested")
+	assert.Error(t, err)
+}
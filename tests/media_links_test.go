@@ -0,0 +1,60 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mediaLinksTestContent() map[string]interface{} {
+	return map[string]interface{}{
+		"msgtype": "m.image",
+		"body":    "cat.png",
+		"url":     "mxc://example.org/abc123",
+		"info":    map[string]interface{}{"mimetype": "image/png"},
+	}
+}
+
+func TestRewriteMediaLinks(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	local, err := archive.NewMediaLinkResolver(archive.MediaLinksLocal, "")
+	require.NoError(t, err)
+	content := mediaLinksTestContent()
+	rewritten := archive.RewriteMediaLinks(content, local)
+	assert.Equal(t, "thumbnails/abc123.png", rewritten["url"])
+	assert.Equal(t, "mxc://example.org/abc123", content["url"], "the archived content is left unchanged")
+
+	// Only images have local copies
+	file := map[string]interface{}{"msgtype": "m.file", "body": "notes.pdf", "url": "mxc://example.org/pdf"}
+	assert.Equal(t, "mxc://example.org/pdf", archive.RewriteMediaLinks(file, local)["url"])
+
+	s3, err := archive.NewMediaLinkResolver(archive.MediaLinksS3, "https://bucket.s3.amazonaws.com/archive/")
+	require.NoError(t, err)
+	assert.Equal(t, "https://bucket.s3.amazonaws.com/archive/thumbnails/abc123.png", archive.RewriteMediaLinks(mediaLinksTestContent(), s3)["url"])
+
+	// Images that weren't downloaded keep their local path; downloaded ones are embedded
+	data, err := archive.NewMediaLinkResolver(archive.MediaLinksDataURI, "")
+	require.NoError(t, err)
+	assert.Equal(t, "thumbnails/abc123.png", archive.RewriteMediaLinks(mediaLinksTestContent(), data)["url"])
+
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	require.NoError(t, os.MkdirAll("thumbnails", 0755))
+	require.NoError(t, os.WriteFile(filepath.Join("thumbnails", "abc123.png"), png, 0644))
+	link, _ := archive.RewriteMediaLinks(mediaLinksTestContent(), data)["url"].(string)
+	assert.True(t, strings.HasPrefix(link, "data:image/png;base64,"), link)
+}
+
+func TestNewMediaLinkResolver(t *testing.T) {
+	_, err := archive.NewMediaLinkResolver(archive.MediaLinksS3, "")
+	assert.Error(t, err, "s3 links need a base URL")
+
+	_, err = archive.NewMediaLinkResolver("ipfs", "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,116 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func playableTestMessage(eventID, msgtype string) *archive.Message {
+	info := map[string]interface{}{"mimetype": "video/mp4", "duration": float64(65400), "size": float64(5000)}
+	if msgtype == "m.video" {
+		info["thumbnail_url"] = "mxc://example.org/poster-" + eventID
+		info["thumbnail_info"] = map[string]interface{}{"size": float64(20)}
+	} else {
+		info["mimetype"] = "audio/ogg"
+	}
+	return &archive.Message{
+		EventID:   eventID,
+		Timestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Content:   map[string]interface{}{"msgtype": msgtype, "body": eventID, "url": "mxc://example.org/file-" + eventID, "info": info},
+	}
+}
+
+func TestMediaDuration(t *testing.T) {
+	duration := func(ms interface{}) string {
+		return archive.MediaDuration(map[string]interface{}{"info": map[string]interface{}{"duration": ms}})
+	}
+	assert.Equal(t, "0:42", duration(float64(42000)))
+	assert.Equal(t, "1:05", duration(float64(65400)))
+	assert.Equal(t, "1:02:03", duration(int64(3723000)))
+	assert.Equal(t, "", duration(nil))
+	assert.Equal(t, "", archive.MediaDuration(map[string]interface{}{"msgtype": "m.audio"}))
+}
+
+func TestPlanMediaDownloadsAudioVideo(t *testing.T) {
+	image := &archive.Message{
+		EventID: "image",
+		Content: map[string]interface{}{"msgtype": "m.image", "url": "mxc://example.org/full-image"},
+	}
+	items := archive.PlanMediaDownloads([]*archive.Message{playableTestMessage("video", "m.video"), image, playableTestMessage("voice", "m.audio")})
+	var order []string
+	for _, item := range items {
+		order = append(order, item.Kind+":"+item.EventID)
+	}
+	assert.Equal(t, []string{"thumbnail:video", "image:image", "recording:video", "recording:voice"}, order,
+		"posters come with the thumbnails, and audio and video after every image")
+	assert.Equal(t, "poster-video", items[0].Stem)
+	assert.Equal(t, "file-video", items[2].Stem)
+	assert.Equal(t, int64(5000), items[2].Size)
+}
+
+func TestAttachMediaPlayers(t *testing.T) {
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.MkdirAll("recordings", 0755))
+	require.NoError(t, os.MkdirAll("thumbnails", 0755))
+	require.NoError(t, os.WriteFile(filepath.Join("recordings", "file-video.mp4"), []byte("mp4"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join("thumbnails", "poster-video.jpeg"), []byte("jpeg"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join("recordings", "file-voice.ogg"), []byte("ogg"), 0644))
+
+	messages := []*archive.Message{
+		playableTestMessage("video", "m.video"),
+		playableTestMessage("voice", "m.audio"),
+		playableTestMessage("missing", "m.video"),
+	}
+	exported := make([]archive.ExportMessage, len(messages))
+	for i, msg := range messages {
+		exported[i] = archive.ExportMessage{EventID: msg.EventID, Content: msg.Content}
+	}
+
+	local, err := archive.NewMediaLinkResolver(archive.MediaLinksLocal, "")
+	require.NoError(t, err)
+	archive.AttachMediaPlayers(exported, messages, local)
+	assert.Equal(t, &archive.MediaPlayer{Kind: "video", URL: "recordings/file-video.mp4", Poster: "thumbnails/poster-video.jpeg", MimeType: "video/mp4"}, exported[0].Player)
+	assert.Equal(t, &archive.MediaPlayer{Kind: "audio", URL: "recordings/file-voice.ogg", MimeType: "audio/ogg"}, exported[1].Player)
+	assert.Nil(t, exported[2].Player, "media that wasn't downloaded keeps its link")
+
+	files := archive.ExportedMediaFiles(exported)
+	assert.Len(t, files, 3, "zipped exports take the players' files and posters")
+
+	s3, err := archive.NewMediaLinkResolver(archive.MediaLinksS3, "https://cdn.example.org")
+	require.NoError(t, err)
+	archive.AttachMediaPlayers(exported, messages, s3)
+	assert.Equal(t, "https://cdn.example.org/recordings/file-video.mp4", exported[0].Player.URL)
+}
+
+func TestInlinePlayersHTML(t *testing.T) {
+	t.Chdir("..")
+	video := playableTestMessage("video", "m.video")
+	audio := playableTestMessage("voice", "m.audio")
+	audio.Content["url"] = "https://example.org/_matrix/media/v3/download/example.org/file-voice"
+	messages := []archive.ExportMessage{
+		{EventID: "$video", Sender: "alice", DisplayName: "alice", Timestamp: "2024-01-01T00:00:00Z", Content: video.Content,
+			Player: &archive.MediaPlayer{Kind: "video", URL: "recordings/file-video.mp4", Poster: "thumbnails/poster-video.jpeg", MimeType: "video/mp4"}},
+		{EventID: "$voice", Sender: "alice", DisplayName: "alice", Timestamp: "2024-01-01T00:01:00Z", Content: audio.Content},
+	}
+	for _, template := range []string{"default", "enhanced", "accessible"} {
+		base := filepath.Join(t.TempDir(), "archive")
+		opts := archive.DefaultExportOptions()
+		opts.Template = template
+		require.NoError(t, archive.WriteExportFiles(base, []string{"html"}, messages, opts), template)
+		data, err := os.ReadFile(base + ".html")
+		require.NoError(t, err)
+		html := string(data)
+		assert.Contains(t, html, `poster="thumbnails/poster-video.jpeg"`, template)
+		assert.Contains(t, html, `src="recordings/file-video.mp4" type="video/mp4"`, template)
+		assert.Contains(t, html, "1:05", template)
+		assert.NotContains(t, html, "<audio", "%s: audio without a player is linked", template)
+		assert.Contains(t, html, `href="https://example.org/_matrix/media/v3/download/example.org/file-voice"`, template)
+	}
+}
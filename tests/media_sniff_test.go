@@ -0,0 +1,60 @@
+package tests
+
+import (
+	"encoding/binary"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ftyp returns the start of an ISO base media file with the given major
+// and compatible brands
+func ftyp(major string, compatible ...string) []byte {
+	box := binary.BigEndian.AppendUint32(nil, uint32(16+4*len(compatible)))
+	box = append(box, "ftyp"+major+"\x00\x00\x00\x00"...)
+	for _, brand := range compatible {
+		box = append(box, brand...)
+	}
+	return append(box, "\x00\x00\x00\x08mdat"...)
+}
+
+func TestSniffMediaType(t *testing.T) {
+	for name, tc := range map[string]struct {
+		head []byte
+		want string
+	}{
+		"jpeg":         {[]byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00"), "image/jpeg"},
+		"png":          {[]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), "image/png"},
+		"webp":         {[]byte("RIFF\x24\x00\x00\x00WEBPVP8 "), "image/webp"},
+		"heic":         {ftyp("heic", "mif1", "heic"), "image/heic"},
+		"heif in mif1": {ftyp("mif1", "mif1", "heic"), "image/heic"},
+		"avif":         {ftyp("avif", "avif", "mif1", "miaf"), "image/avif"},
+		"mp4":          {ftyp("isom", "isom", "iso2", "avc1", "mp41"), "video/mp4"},
+		"m4a":          {ftyp("M4A ", "M4A ", "mp42", "isom"), "audio/mp4"},
+		"quicktime":    {ftyp("qt  ", "qt  "), "video/quicktime"},
+		"ogg opus":     {[]byte("OggS\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00\x01\x02\x03\x04\x00\x00\x00\x00\x00\x00\x00\x00\x01\x13OpusHead"), "audio/ogg"},
+		"flac":         {[]byte("fLaC\x00\x00\x00\x22"), "audio/flac"},
+		"tiff":         {[]byte("II*\x00\x08\x00\x00\x00"), "image/tiff"},
+		"svg":          {[]byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"></svg>`), "image/svg+xml"},
+		"html":         {[]byte("<!DOCTYPE html><html><body>Not found</body></html>"), "text/html"},
+		"unknown":      {[]byte("\x00\x01\x02\x03\x04\x05"), ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, archive.SniffMediaType(tc.head))
+		})
+	}
+}
+
+func TestMediaExtension(t *testing.T) {
+	assert.Equal(t, ".png", archive.MediaExtension("image/png"))
+	assert.Equal(t, ".jpeg", archive.MediaExtension("image/jpeg"))
+	assert.Equal(t, ".webp", archive.MediaExtension("image/webp; charset=binary"))
+	assert.Equal(t, ".svg", archive.MediaExtension("image/svg+xml"))
+	assert.Equal(t, ".mp3", archive.MediaExtension("audio/mpeg"))
+	assert.Equal(t, ".m4a", archive.MediaExtension("audio/mp4"))
+	assert.Equal(t, ".mov", archive.MediaExtension("video/quicktime"))
+	assert.Equal(t, ".heic", archive.MediaExtension("image/heic"))
+	assert.Equal(t, "", archive.MediaExtension(""))
+}
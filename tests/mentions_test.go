@@ -0,0 +1,91 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageMentions(t *testing.T) {
+	userIDs, room := archive.MessageMentions(map[string]interface{}{
+		"msgtype":        "m.text",
+		"body":           "Bob: see @carol:example.org's note",
+		"formatted_body": `<a href="https://matrix.to/#/%40bob%3Aexample.org">Bob</a>: see note`,
+		"m.mentions":     map[string]interface{}{"user_ids": []interface{}{"@bob:example.org"}},
+	})
+	assert.Equal(t, []string{"@bob:example.org", "@carol:example.org"}, userIDs)
+	assert.False(t, room)
+
+	_, room = archive.MessageMentions(map[string]interface{}{"body": "@room meeting in 5"})
+	assert.True(t, room, "legacy @room pings count")
+	_, room = archive.MessageMentions(map[string]interface{}{"body": "hi", "m.mentions": map[string]interface{}{"room": true}})
+	assert.True(t, room)
+
+	userIDs, _ = archive.MessageMentions(map[string]interface{}{
+		"body":           "> <@alice:example.org> original\n\nthanks",
+		"formatted_body": `<mx-reply><blockquote><a href="https://matrix.to/#/@alice:example.org">Alice</a> original</blockquote></mx-reply>thanks`,
+		"m.relates_to":   map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": "$1"}},
+	})
+	assert.Empty(t, userIDs, "the reply quote isn't a mention")
+}
+
+func TestBuildMentionNetwork(t *testing.T) {
+	mention := func(sender string, userIDs ...interface{}) *archive.Message {
+		return &archive.Message{Sender: sender, MessageType: archive.EventTypeMessage, Content: map[string]interface{}{
+			"body": "hi", "m.mentions": map[string]interface{}{"user_ids": userIDs},
+		}}
+	}
+	edit := mention("@alice:example.org", "@bob:example.org")
+	edit.Content["m.relates_to"] = map[string]interface{}{"rel_type": "m.replace", "event_id": "$1"}
+	ping := &archive.Message{Sender: "@carol:example.org", MessageType: archive.EventTypeMessage, Content: map[string]interface{}{"body": "@room release is out"}}
+
+	messages := []*archive.Message{
+		mention("@alice:example.org", "@bob:example.org"),
+		mention("@alice:example.org", "@bob:example.org", "@alice:example.org"),
+		mention("@carol:example.org", "@bob:example.org"),
+		mention("@bob:example.org", "@alice:example.org"),
+		mention("@dave:example.org", "@bob:example.org"),
+		mention("@alice:example.org", "@dave:example.org"),
+		edit,
+		ping,
+	}
+	network := archive.BuildMentionNetwork(messages, map[string]bool{"@dave:example.org": true}, nil)
+
+	require.NotEmpty(t, network.Users)
+	bob := network.Users[0]
+	assert.Equal(t, archive.MentionUser{UserID: "@bob:example.org", Mentioned: 3, MentionedBy: 2, Mentions: 1}, bob)
+	for _, u := range network.Users {
+		assert.NotEqual(t, "@dave:example.org", u.UserID, "excluded users are left out")
+		if u.UserID == "@carol:example.org" {
+			assert.Equal(t, 1, u.RoomPings)
+		}
+	}
+	assert.Equal(t, []archive.MentionEdge{
+		{From: "@alice:example.org", To: "@bob:example.org", Count: 2},
+		{From: "@bob:example.org", To: "@alice:example.org", Count: 1},
+		{From: "@carol:example.org", To: "@bob:example.org", Count: 1},
+	}, network.Edges)
+
+	var dot bytes.Buffer
+	require.NoError(t, network.WriteDOT(&dot))
+	assert.Contains(t, dot.String(), "digraph mentions {")
+	assert.Contains(t, dot.String(), `"@alice:example.org" -> "@bob:example.org" [weight=2, label="2"];`)
+
+	dir := t.TempDir()
+	edgesPath := filepath.Join(dir, "mentions.json")
+	require.NoError(t, archive.WriteMentionGraph(edgesPath, network))
+	data, err := os.ReadFile(edgesPath)
+	require.NoError(t, err)
+	var edges []archive.MentionEdge
+	require.NoError(t, json.Unmarshal(data, &edges))
+	assert.Equal(t, network.Edges, edges)
+
+	assert.Error(t, archive.WriteMentionGraph(filepath.Join(dir, "mentions.png"), network))
+}
@@ -66,6 +66,15 @@ func TestMessage_Validate(t *testing.T) {
 		MessageType: "m.room.message",
 	}
 	assert.Error(t, invalidRoomID.Validate())
+
+	// Reactions and undecryptable messages keep their own event types
+	reaction := validMsg
+	reaction.MessageType = "m.reaction"
+	assert.NoError(t, reaction.Validate())
+
+	member := validMsg
+	member.MessageType = "m.room.member"
+	assert.Error(t, member.Validate())
 }
 
 func TestMessageFilter_ToSQL(t *testing.T) {
@@ -0,0 +1,97 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModerationAction(t *testing.T) {
+	tests := []struct {
+		membership, prev, sender, target string
+		action                           string
+	}{
+		{"invite", "", "@mod:x", "@a:x", archive.ModerationInvite},
+		{"knock", "", "@a:x", "@a:x", archive.ModerationKnock},
+		{"ban", "join", "@mod:x", "@a:x", archive.ModerationBan},
+		{"leave", "join", "@mod:x", "@a:x", archive.ModerationKick},
+		{"leave", "ban", "@mod:x", "@a:x", archive.ModerationUnban},
+		{"leave", "invite", "@mod:x", "@a:x", archive.ModerationRevokeInvite},
+		{"leave", "knock", "@mod:x", "@a:x", archive.ModerationRejectKnock},
+		{"leave", "join", "@a:x", "@a:x", ""},
+		{"leave", "invite", "@a:x", "@a:x", ""},
+		{"join", "invite", "@a:x", "@a:x", ""},
+		{"join", "join", "@a:x", "@a:x", ""},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.action, archive.ModerationAction(tt.membership, tt.prev, tt.sender, tt.target),
+			"%s -> %s by %s", tt.prev, tt.membership, tt.sender)
+	}
+}
+
+func TestWriteModerationLog(t *testing.T) {
+	baseTime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	events := []*archive.ModerationEvent{
+		{EventID: "$1", Action: archive.ModerationKnock, Actor: "@a:x", Target: "@a:x", Reason: "let me in", Timestamp: baseTime},
+		{EventID: "$2", Action: archive.ModerationBan, Actor: "@mod:x", Target: "@a:x", Reason: "spam", Timestamp: baseTime.Add(time.Minute)},
+		{EventID: "$3", Action: archive.ModerationUnban, Actor: "@mod:x", Target: "@a:x", Timestamp: baseTime.Add(time.Hour)},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, archive.WriteModerationLog(&buf, "txt", "!room:x", events, 0))
+	assert.Equal(t, `Moderation log for !room:x
+
+2024-03-01 12:00:00  @a:x knocked (reason: let me in)
+2024-03-01 12:01:00  @mod:x banned @a:x (reason: spam)
+2024-03-01 13:00:00  @mod:x unbanned @a:x
+`, buf.String())
+
+	buf.Reset()
+	require.NoError(t, archive.WriteModerationLog(&buf, "json", "!room:x", events, 0))
+	var decoded struct {
+		RoomID string                     `json:"room_id"`
+		Events []*archive.ModerationEvent `json:"events"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, "!room:x", decoded.RoomID)
+	require.Len(t, decoded.Events, 3)
+	assert.Equal(t, "spam", decoded.Events[1].Reason)
+
+	buf.Reset()
+	require.NoError(t, archive.WriteModerationLog(&buf, "txt", "!room:x", nil, 0))
+	assert.Contains(t, buf.String(), "No moderation events archived.")
+
+	assert.Error(t, archive.WriteModerationLog(&buf, "html", "!room:x", events, 0))
+}
+
+func TestWithholdOptedOutModeration(t *testing.T) {
+	baseTime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	events := []*archive.ModerationEvent{
+		{EventID: "$1", Action: archive.ModerationBan, Actor: "@mod:x", Target: "@carol:x", Reason: "doxxing", Timestamp: baseTime},
+		{EventID: "$2", Action: archive.ModerationKick, Actor: "@carol:x", Target: "@spam:x", Reason: "spam", Timestamp: baseTime.Add(time.Minute)},
+		{EventID: "$3", Action: archive.ModerationInvite, Actor: "@mod:x", Target: "@dave:x", Timestamp: baseTime.Add(time.Hour)},
+	}
+	kept, withheld := archive.WithholdOptedOutModeration(events, map[string]bool{"@carol:x": true})
+	assert.Equal(t, 2, withheld, "events made by or concerning people who opted out are withheld")
+	require.Len(t, kept, 1)
+	assert.Equal(t, "$3", kept[0].EventID)
+
+	var buf bytes.Buffer
+	require.NoError(t, archive.WriteModerationLog(&buf, "txt", "!room:x", kept, withheld))
+	assert.NotContains(t, buf.String(), "carol")
+	assert.Contains(t, buf.String(), "2 moderation events withheld")
+
+	buf.Reset()
+	require.NoError(t, archive.WriteModerationLog(&buf, "json", "!room:x", kept, withheld))
+	var decoded struct {
+		OptedOut int `json:"opted_out"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, 2, decoded.OptedOut)
+}
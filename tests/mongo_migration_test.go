@@ -0,0 +1,89 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func legacyDocument(t *testing.T, doc bson.D) bson.Raw {
+	data, err := bson.Marshal(doc)
+	require.NoError(t, err)
+	return data
+}
+
+func TestConvertLegacyDocument(t *testing.T) {
+	at := time.Date(2019, 5, 4, 12, 0, 0, 0, time.UTC)
+	message, err := archive.ConvertLegacyDocument(legacyDocument(t, bson.D{
+		{Key: "_id", Value: bson.NewObjectID()},
+		{Key: "room_id", Value: "!room:example.org"},
+		{Key: "event_id", Value: "$event"},
+		{Key: "sender", Value: "@alice:example.org"},
+		{Key: "timestamp", Value: at},
+		{Key: "content", Value: bson.D{
+			{Key: "msgtype", Value: "m.image"},
+			{Key: "body", Value: "cat.png"},
+			{Key: "url", Value: "mxc://example.org/cat"},
+			{Key: "info", Value: bson.D{{Key: "w", Value: int32(640)}, {Key: "size", Value: int64(31337)}}},
+		}},
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "!room:example.org", message.RoomID)
+	assert.Equal(t, "$event", message.EventID)
+	assert.Equal(t, "@alice:example.org", message.Sender)
+	assert.Equal(t, "m.room.message", message.MessageType, "legacy documents are room messages")
+	assert.Equal(t, "m.image", message.MsgType)
+	assert.True(t, at.Equal(message.Timestamp))
+	assert.Equal(t, "mxc://example.org/cat", message.Content["url"])
+	assert.Equal(t, map[string]interface{}{"w": float64(640), "size": float64(31337)}, message.Content["info"],
+		"BSON numbers become plain JSON numbers")
+}
+
+func TestConvertLegacyDocumentTimestamps(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 6e6, time.UTC)
+	for name, timestamp := range map[string]interface{}{
+		"date":         at,
+		"milliseconds": at.UnixMilli(),
+		"double":       float64(at.UnixMilli()),
+		"RFC 3339":     at.Format(time.RFC3339Nano),
+	} {
+		t.Run(name, func(t *testing.T) {
+			message, err := archive.ConvertLegacyDocument(legacyDocument(t, bson.D{
+				{Key: "room_id", Value: "!room:example.org"},
+				{Key: "event_id", Value: "$event"},
+				{Key: "sender", Value: "@alice:example.org"},
+				{Key: "timestamp", Value: timestamp},
+				{Key: "content", Value: bson.D{{Key: "msgtype", Value: "m.text"}, {Key: "body", Value: "hi"}}},
+			}))
+			require.NoError(t, err)
+			assert.True(t, at.Equal(message.Timestamp), "got %v", message.Timestamp)
+		})
+	}
+}
+
+func TestConvertLegacyDocumentInvalid(t *testing.T) {
+	id := bson.NewObjectID()
+	_, err := archive.ConvertLegacyDocument(legacyDocument(t, bson.D{
+		{Key: "_id", Value: id},
+		{Key: "room_id", Value: "!room:example.org"},
+		{Key: "sender", Value: "@alice:example.org"},
+		{Key: "timestamp", Value: time.Now()},
+	}))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), id.Hex(), "documents without an event ID are named by _id")
+
+	_, err = archive.ConvertLegacyDocument(legacyDocument(t, bson.D{
+		{Key: "room_id", Value: "!room:example.org"},
+		{Key: "event_id", Value: "$event"},
+		{Key: "sender", Value: "@alice:example.org"},
+		{Key: "timestamp", Value: "yesterday"},
+	}))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "$event")
+	assert.Contains(t, err.Error(), "timestamp")
+}
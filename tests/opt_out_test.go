@@ -0,0 +1,76 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithholdOptedOut(t *testing.T) {
+	start := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	message := func(eventID, sender string, content map[string]interface{}) *archive.Message {
+		start = start.Add(time.Minute)
+		return &archive.Message{RoomID: "!room:example.org", EventID: eventID, Sender: sender, MessageType: archive.EventTypeMessage, Timestamp: start, Content: content}
+	}
+	reaction := message("$r", "@carol:example.org", map[string]interface{}{
+		"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": "$1", "key": "👍"},
+	})
+	reaction.MessageType = archive.EventTypeReaction
+	reply := message("$5", "@alice:example.org", map[string]interface{}{
+		"msgtype": "m.text", "body": "> <@carol:example.org> first\n> second\n\nfair point",
+		"format": "org.matrix.custom.html", "formatted_body": "<mx-reply><blockquote>first</blockquote></mx-reply>fair point",
+		"m.relates_to": map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": "$2"}},
+	})
+	messages := []*archive.Message{
+		message("$1", "@alice:example.org", map[string]interface{}{"msgtype": "m.text", "body": "hello"}),
+		message("$2", "@carol:example.org", map[string]interface{}{"msgtype": "m.text", "body": "first"}),
+		message("$3", "@carol:example.org", map[string]interface{}{"msgtype": "m.text", "body": "second"}),
+		reaction,
+		message("$4", "@dave:example.org", map[string]interface{}{"msgtype": "m.text", "body": "third"}),
+		reply,
+	}
+
+	kept, withheld := archive.WithholdOptedOut(messages, map[string]bool{"@carol:example.org": true, "@dave:example.org": true})
+	assert.Equal(t, 4, withheld)
+	require.Len(t, kept, 3)
+
+	summary := kept[1]
+	assert.Equal(t, "$2", summary.EventID, "the summary takes the first withheld message's place")
+	assert.Empty(t, summary.Sender)
+	assert.Equal(t, map[string]interface{}{"msgtype": "m.notice", "body": "3 messages withheld at their senders' request"}, summary.Content)
+
+	assert.Equal(t, "fair point", kept[2].Content["body"], "quotes of withheld messages are removed")
+	assert.Equal(t, "fair point", kept[2].Content["formatted_body"])
+	assert.Contains(t, reply.Content["body"], "first", "the archived message is left alone")
+
+	kept, withheld = archive.WithholdOptedOut(messages, nil)
+	assert.Equal(t, 0, withheld)
+	assert.Equal(t, messages, kept)
+}
+
+func TestDuckDBOptOuts(t *testing.T) {
+	ctx := context.Background()
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	require.NoError(t, db.SaveOptOut(ctx, &archive.OptOut{UserID: "@carol:example.org", Reason: "asked by email"}))
+	require.NoError(t, db.SaveOptOut(ctx, &archive.OptOut{UserID: "@carol:example.org", Reason: "asked again"}))
+	optOuts, err := db.GetOptOuts(ctx)
+	require.NoError(t, err)
+	require.Len(t, optOuts, 1)
+	assert.Equal(t, "asked again", optOuts[0].Reason)
+
+	filter := archive.SenderFilter{RespectOptOuts: true}
+	require.NoError(t, filter.DenyOptedOut(ctx, db))
+	assert.False(t, filter.Archives("@carol:example.org"))
+	assert.True(t, filter.Archives("@alice:example.org"))
+
+	require.NoError(t, db.DeleteOptOut(ctx, "@carol:example.org"))
+	assert.Error(t, db.DeleteOptOut(ctx, "@carol:example.org"), "removing an opt-out twice")
+}
@@ -0,0 +1,22 @@
+package tests
+
+import (
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetOutputFormat(t *testing.T) {
+	defer archive.SetOutputFormat(archive.OutputText)
+
+	assert.NoError(t, archive.SetOutputFormat(archive.OutputJSON))
+	assert.Equal(t, archive.OutputJSON, archive.OutputFormat())
+
+	assert.NoError(t, archive.SetOutputFormat(""))
+	assert.Equal(t, archive.OutputText, archive.OutputFormat())
+
+	assert.Error(t, archive.SetOutputFormat("xml"))
+	assert.Equal(t, archive.OutputText, archive.OutputFormat())
+}
@@ -0,0 +1,74 @@
+package tests
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParticipantSummary(t *testing.T) {
+	messages := []archive.ExportMessage{
+		{UserID: "@alice:example.org", DisplayName: "Alice", Timestamp: "2024-01-02T10:00:00Z"},
+		{UserID: "@bob_discordgo_1:example.org", DisplayName: "Bob", Platform: "Discord", Timestamp: "2024-01-02T11:00:00Z"},
+		{UserID: "@bob_discordgo_1:example.org", DisplayName: "Bob", Platform: "Discord", Timestamp: "2024-01-03T09:00:00Z"},
+	}
+
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 8, 0, 0, 0, time.UTC) }
+	memberships := []*archive.MembershipEvent{
+		{UserID: "@alice:example.org", Membership: "join", Timestamp: day(1)},
+		{UserID: "@alice:example.org", Membership: "join", DisplayName: "Alice B.", Timestamp: day(2)}, // profile change
+		{UserID: "@alice:example.org", Membership: "leave", Timestamp: day(4)},
+		{UserID: "@bob_discordgo_1:example.org", Membership: "join", Timestamp: day(1)},
+		{UserID: "@bob_discordgo_1:example.org", Membership: "leave", Timestamp: day(2)},
+		{UserID: "@bob_discordgo_1:example.org", Membership: "join", Timestamp: day(3)},
+		{UserID: "@lurker:example.org", Membership: "join", Timestamp: day(1)},
+	}
+
+	participants := archive.ParticipantSummary(messages, memberships)
+	require.Len(t, participants, 2, "only senders are listed")
+
+	bob := participants[0]
+	assert.Equal(t, "@bob_discordgo_1:example.org", bob.UserID)
+	assert.Equal(t, 2, bob.MessageCount)
+	assert.Equal(t, "Discord", bob.Platform)
+	assert.Equal(t, "2024-01-02T11:00:00Z", bob.FirstMessage)
+	assert.Equal(t, "2024-01-03T09:00:00Z", bob.LastMessage)
+	assert.Equal(t, "2024-01-01T08:00:00Z", bob.Joined)
+	assert.Empty(t, bob.Left, "rejoined after leaving")
+
+	alice := participants[1]
+	assert.Equal(t, 1, alice.MessageCount)
+	assert.Equal(t, "2024-01-01T08:00:00Z", alice.Joined)
+	assert.Equal(t, "2024-01-04T08:00:00Z", alice.Left)
+}
+
+func TestExportWithTemplateOptions_Participants(t *testing.T) {
+	t.Chdir("..")
+
+	messages := []archive.ExportMessage{
+		{UserID: "@alice:example.org", DisplayName: "Alice", Sender: "alice", Timestamp: "2024-01-02T10:00:00Z", Content: map[string]interface{}{"msgtype": "m.text", "body": "hi"}},
+	}
+
+	var buf bytes.Buffer
+	err := archive.ExportWithTemplateOptions(&buf, "templates/default.html.tpl", messages, archive.DefaultExportOptions())
+	require.NoError(t, err)
+	assert.NotContains(t, buf.String(), `<section class="participants">`)
+
+	opts := archive.DefaultExportOptions()
+	opts.Participants = true
+	buf.Reset()
+	err = archive.ExportWithTemplateOptions(&buf, "templates/default.html.tpl", messages, opts)
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), `<section class="participants">`)
+	assert.Contains(t, buf.String(), "<td>1</td>")
+
+	buf.Reset()
+	err = archive.ExportWithTemplateOptions(&buf, "templates/default.txt.tpl", messages, opts)
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), "Participants\n- Alice (@alice:example.org): 1 Messages\n")
+}
@@ -0,0 +1,41 @@
+package tests
+
+import (
+	"bytes"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPermalink(t *testing.T) {
+	assert.Equal(t,
+		"https://matrix.to/#/%21abc%3Aexample.org/%24event123?via=example.org",
+		archive.Permalink("", "!abc:example.org", "$event123", "example.org"))
+
+	assert.Equal(t,
+		"https://chat.example.org/#/room/%21abc%3Aexample.org/%24event123",
+		archive.Permalink("https://chat.example.org/#/room/", "!abc:example.org", "$event123", ""))
+}
+
+func TestAttachPermalinks(t *testing.T) {
+	t.Chdir("..")
+
+	messages := []archive.ExportMessage{
+		{EventID: "$1", UserID: "@alice:matrix.org", Sender: "alice", Timestamp: "2024-01-02T15:04:05Z", Content: map[string]interface{}{"msgtype": "m.text", "body": "hello"}},
+	}
+	archive.AttachPermalinks(messages, "!room:example.org", "")
+	assert.Equal(t, "https://matrix.to/#/%21room%3Aexample.org/%241?via=matrix.org", messages[0].Permalink)
+
+	var buf bytes.Buffer
+	err := archive.ExportWithTemplateOptions(&buf, "templates/default.html.tpl", messages, archive.DefaultExportOptions())
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), `href="https://matrix.to/#/%21room%3Aexample.org/%241?via=matrix.org"`)
+
+	buf.Reset()
+	err = archive.ExportWithTemplateOptions(&buf, "templates/default.txt.tpl", messages, archive.DefaultExportOptions())
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), "Permalink: https://matrix.to/#/%21room%3Aexample.org/%241?via=matrix.org")
+}
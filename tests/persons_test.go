@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testPersons() archive.Persons {
+	return archive.NewPersons([]*archive.PersonAlias{
+		{UserID: "@alice:example.org", PersonID: "alice"},
+		{UserID: "@discord_123:example.org", PersonID: "alice"},
+		{UserID: "@telegram_456:example.org", PersonID: "alice"},
+	})
+}
+
+func TestPersons(t *testing.T) {
+	persons := testPersons()
+	assert.Equal(t, "alice", persons.Of("@discord_123:example.org"))
+	assert.Equal(t, "@bob:example.org", persons.Of("@bob:example.org"), "users who weren't merged are themselves")
+	assert.Equal(t, []string{"@alice:example.org", "@discord_123:example.org", "@telegram_456:example.org"}, persons.UserIDs("alice"))
+	assert.Nil(t, persons.UserIDs("@bob:example.org"))
+
+	original := &archive.Message{EventID: "$1", Sender: "@telegram_456:example.org"}
+	messages := persons.Senders([]*archive.Message{original, {EventID: "$2", Sender: "@bob:example.org"}})
+	assert.Equal(t, "alice", messages[0].Sender)
+	assert.Equal(t, "@bob:example.org", messages[1].Sender)
+	assert.Equal(t, "@telegram_456:example.org", original.Sender, "the archived message keeps its sender")
+
+	stats := persons.Stats([]*archive.DailyStats{{Sender: "@discord_123:example.org", MessageCount: 3}})
+	assert.Equal(t, "alice", stats[0].Sender)
+
+	exclude := persons.Exclude(map[string]bool{"@discord_123:example.org": true})
+	assert.True(t, exclude["alice"], "a person is excluded when any of their identities opted out")
+	assert.True(t, exclude["@discord_123:example.org"])
+	assert.False(t, exclude["@bob:example.org"])
+}
+
+func TestMentionNetworkPersons(t *testing.T) {
+	mention := func(sender string, userIDs ...interface{}) *archive.Message {
+		return &archive.Message{Sender: sender, MessageType: archive.EventTypeMessage, Content: map[string]interface{}{
+			"body": "hi", "m.mentions": map[string]interface{}{"user_ids": userIDs},
+		}}
+	}
+	messages := []*archive.Message{
+		mention("@bob:example.org", "@alice:example.org", "@discord_123:example.org"),
+		mention("@bob:example.org", "@telegram_456:example.org"),
+		mention("@discord_123:example.org", "@alice:example.org"),
+		mention("@telegram_456:example.org", "@bob:example.org"),
+	}
+	network := archive.BuildMentionNetwork(messages, nil, testPersons())
+	require.Len(t, network.Users, 2)
+	assert.Equal(t, archive.MentionUser{UserID: "alice", Mentioned: 2, MentionedBy: 1, Mentions: 1}, network.Users[0],
+		"mentions of one person under two IDs count once, and mentions of oneself not at all")
+	assert.Equal(t, []archive.MentionEdge{{From: "@bob:example.org", To: "alice", Count: 2}, {From: "alice", To: "@bob:example.org", Count: 1}}, network.Edges)
+}
+
+func TestApplyPersons(t *testing.T) {
+	messages := []archive.ExportMessage{
+		{UserID: "@discord_123:example.org", Sender: "discord_123"},
+		{UserID: "@bob:example.org", Sender: "bob"},
+		{UserID: "@telegram_456:example.org", Sender: "Carol", Relayed: true},
+	}
+	archive.ApplyPersons(messages, testPersons())
+	assert.Equal(t, "alice", messages[0].Person)
+	assert.Equal(t, "@discord_123:example.org", messages[0].UserID, "the original user ID is kept")
+	assert.Empty(t, messages[1].Person)
+	assert.Empty(t, messages[2].Person, "relayed messages belong to their real author")
+}
+
+func TestSubjectAccessPackagePerson(t *testing.T) {
+	dir := t.TempDir()
+	pkg := &archive.SubjectAccessPackage{
+		UserID:      "@alice:example.org",
+		PersonID:    "alice",
+		UserIDs:     testPersons().UserIDs("alice"),
+		GeneratedAt: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC),
+	}
+	require.NoError(t, archive.WriteSubjectAccessPackage(dir, pkg))
+
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	require.NoError(t, err)
+	var manifest struct {
+		PersonID string   `json:"person_id"`
+		UserIDs  []string `json:"user_ids"`
+	}
+	require.NoError(t, json.Unmarshal(data, &manifest))
+	assert.Equal(t, "alice", manifest.PersonID)
+	assert.Len(t, manifest.UserIDs, 3)
+
+	readme, err := os.ReadFile(filepath.Join(dir, "README.txt"))
+	require.NoError(t, err)
+	assert.Contains(t, string(readme), "@telegram_456:example.org")
+}
+
+func TestDuckDBPersonAliases(t *testing.T) {
+	ctx := context.Background()
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	require.NoError(t, db.SavePersonAlias(ctx, &archive.PersonAlias{UserID: "@discord_123:example.org", PersonID: "someone"}))
+	require.NoError(t, db.SavePersonAlias(ctx, &archive.PersonAlias{UserID: "@discord_123:example.org", PersonID: "alice"}))
+	require.NoError(t, db.SavePersonAlias(ctx, &archive.PersonAlias{UserID: "@alice:example.org", PersonID: "alice"}))
+	aliases, err := db.GetPersonAliases(ctx)
+	require.NoError(t, err)
+	require.Len(t, aliases, 2, "merging again moves the user ID")
+	assert.Equal(t, "alice", archive.NewPersons(aliases).Of("@discord_123:example.org"))
+
+	require.NoError(t, db.DeletePersonAlias(ctx, "@discord_123:example.org"))
+	assert.Error(t, db.DeletePersonAlias(ctx, "@discord_123:example.org"), "unmerging twice")
+}
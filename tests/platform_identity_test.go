@@ -0,0 +1,64 @@
+package tests
+
+import (
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePlatformIdentity(t *testing.T) {
+	identity := archive.ParsePlatformIdentity(map[string]interface{}{
+		"membership":                    "join",
+		"displayname":                   "Alice",
+		"com.beeper.bridge.network":     "whatsapp",
+		"com.beeper.bridge.remote_id":   "15551234567",
+		"com.beeper.bridge.identifiers": []interface{}{"tel:+15551234567"},
+	})
+	require.NotNil(t, identity)
+	assert.Equal(t, "whatsapp", identity.Name())
+	assert.Equal(t, "+15551234567", identity.Handle())
+	assert.False(t, identity.Bot)
+
+	bot := archive.ParsePlatformIdentity(map[string]interface{}{
+		"com.beeper.bridge.network":        "telegram",
+		"com.beeper.bridge.service":        "telegram-bots",
+		"com.beeper.bridge.remote_id":      "12345",
+		"com.beeper.bridge.is_network_bot": true,
+	})
+	require.NotNil(t, bot)
+	assert.Equal(t, "telegram-bots", bot.Name())
+	assert.Equal(t, "12345", bot.Handle(), "without identifiers, the network's ID is the handle")
+	assert.True(t, bot.Bot)
+
+	assert.Nil(t, archive.ParsePlatformIdentity(map[string]interface{}{"membership": "join", "displayname": "Bob"}))
+	assert.Nil(t, archive.ParsePlatformIdentity(nil))
+}
+
+func TestApplyPlatformHandles(t *testing.T) {
+	messages := []archive.ExportMessage{
+		{UserID: "@whatsapp_15551234567:beeper.local", Sender: "whatsapp_15551234567", DisplayName: "Alice"},
+		{UserID: "@bob:example.com", Sender: "bob", DisplayName: "Bob"},
+		{UserID: "@whatsapp_15551234567:beeper.local", Sender: "whatsapp_15551234567", DisplayName: "Carol",
+			Platform: "Discord", Relayed: true},
+	}
+	users := []*archive.RoomUser{
+		{UserID: "@whatsapp_15551234567:beeper.local", Platform: &archive.PlatformIdentity{
+			Network: "whatsapp", Identifiers: []string{"tel:+15551234567"}}},
+		{UserID: "@bob:example.com"},
+	}
+	archive.ApplyPlatformHandles(messages, users)
+
+	assert.Equal(t, "+15551234567", messages[0].Sender)
+	assert.Equal(t, "+15551234567", messages[0].PlatformHandle)
+	assert.Equal(t, "whatsapp", messages[0].Platform)
+	assert.Equal(t, "Alice", messages[0].DisplayName)
+
+	assert.Equal(t, "bob", messages[1].Sender, "native Matrix users keep their localpart")
+	assert.Empty(t, messages[1].PlatformHandle)
+
+	assert.Equal(t, "Discord", messages[2].Platform, "relayed authors keep their own platform")
+	assert.Empty(t, messages[2].PlatformHandle)
+}
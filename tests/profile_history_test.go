@@ -0,0 +1,42 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyHistoricalNames(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 8, 0, 0, 0, time.UTC) }
+	memberships := []*archive.MembershipEvent{
+		{UserID: "@alice:example.org", Membership: "join", DisplayName: "alice", AvatarURL: "mxc://example.org/old", Timestamp: day(2)},
+		{UserID: "@alice:example.org", Membership: "join", DisplayName: "Alice Smith", AvatarURL: "mxc://example.org/new", Timestamp: day(4)},
+		{UserID: "@alice:example.org", Membership: "leave", Timestamp: day(6)},
+	}
+
+	messages := []archive.ExportMessage{
+		{UserID: "@alice:example.org", DisplayName: "Alice Jones", Timestamp: "2024-01-01T12:00:00Z"},
+		{UserID: "@alice:example.org", DisplayName: "Alice Jones", Timestamp: "2024-01-03T12:00:00Z"},
+		{UserID: "@alice:example.org", DisplayName: "Alice Jones", Timestamp: "2024-01-04T08:00:00Z"},
+		{UserID: "@alice:example.org", DisplayName: "Alice Jones", Timestamp: "2024-01-07T12:00:00Z"},
+		{UserID: "@bob:example.org", DisplayName: "Bob", Timestamp: "2024-01-03T12:00:00Z"},
+	}
+	archive.ApplyHistoricalNames(messages, memberships)
+
+	assert.Equal(t, "Alice Jones", messages[0].DisplayName, "no profile recorded yet")
+	assert.Empty(t, messages[0].AvatarURL)
+	assert.Equal(t, "alice", messages[1].DisplayName)
+	assert.Equal(t, "mxc://example.org/old", messages[1].AvatarURL)
+	assert.Equal(t, "Alice Smith", messages[2].DisplayName, "changes apply from the moment they happen")
+	assert.Equal(t, "Alice Smith", messages[3].DisplayName, "leaving doesn't clear the name")
+	assert.Equal(t, "Bob", messages[4].DisplayName)
+
+	history := archive.NewProfileHistory(memberships)
+	name, avatar, ok := history.At("@alice:example.org", day(5))
+	assert.True(t, ok)
+	assert.Equal(t, "Alice Smith", name)
+	assert.Equal(t, "mxc://example.org/new", avatar)
+}
@@ -0,0 +1,152 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadPublishConfig(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "opt-out.txt"), []byte("# asked on 2024-06-01\n@dave:example.org\n\n"), 0644))
+	path := filepath.Join(dir, "publish.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`anonymize: ["@*:bridge.example.org"]
+strip_media: ["video/*"]
+opt_out: ["@carol:example.org"]
+opt_out_file: opt-out.txt
+`), 0644))
+
+	cfg, err := archive.LoadPublishConfig(path)
+	require.NoError(t, err)
+	assert.False(t, cfg.IncludeDMs, "direct chats are left out by default")
+	require.NoError(t, cfg.Validate())
+	assert.Equal(t, []string{"@carol:example.org", "@dave:example.org"}, cfg.OptOut, "the opt-out file is read next to the configuration")
+
+	assert.Error(t, (&archive.PublishConfig{StripMedia: []string{"video/["}}).Validate())
+}
+
+func TestPublisherApply(t *testing.T) {
+	messages := []archive.ExportMessage{
+		{EventID: "$1", UserID: "@alice:example.org", Sender: "@alice:example.org", DisplayName: "Alice", MessageType: "m.room.message",
+			Content: map[string]interface{}{"msgtype": "m.text", "body": "hi @carol:example.org and @bot:bridge.example.org"}},
+		{EventID: "$2", UserID: "@carol:example.org", Sender: "@carol:example.org", DisplayName: "Carol", MessageType: "m.room.message",
+			Content: map[string]interface{}{"msgtype": "m.text", "body": "please leave me out"}},
+		{EventID: "$3", UserID: "@bot:bridge.example.org", Sender: "@bot:bridge.example.org", DisplayName: "Bridged Bob", AvatarURL: "mxc://example.org/bob", MessageType: "m.room.message",
+			Content: map[string]interface{}{"msgtype": "m.video", "body": "clip.mp4", "info": map[string]interface{}{"mimetype": "video/mp4"}},
+			Reactions: []archive.MessageReaction{
+				{Emoji: "👍", Users: []string{"@carol:example.org", "@alice:example.org"}, Count: 2},
+				{Emoji: "🎉", Users: []string{"@carol:example.org"}, Count: 1},
+			},
+			RepliesTo: &archive.ReplyInfo{EventID: "$2", Sender: "@carol:example.org", DisplayName: "Carol", Content: "please leave me out"}},
+		{EventID: "$4", UserID: "@bot:bridge.example.org", Sender: "@bot:bridge.example.org", DisplayName: "Bridged Bob", MessageType: "m.room.message",
+			Content: map[string]interface{}{"msgtype": "m.image", "body": "cat.png"}},
+	}
+	publisher := archive.NewPublisher(&archive.PublishConfig{
+		Anonymize:  []string{"@*:bridge.example.org"},
+		StripMedia: []string{"video/*"},
+		OptOut:     []string{"@carol:example.org"},
+	})
+	published := publisher.Apply(messages)
+
+	require.Len(t, published, 3, "messages from people who opted out are withheld")
+	assert.Equal(t, "hi @carol:example.org and Anonymous 1", published[0].Content["body"], "mentions of anonymized senders are replaced")
+	assert.Equal(t, "hi @carol:example.org and @bot:bridge.example.org", messages[0].Content["body"], "the archived messages are left alone")
+
+	bob := published[1]
+	assert.Equal(t, "Anonymous 1", bob.UserID)
+	assert.Equal(t, "Anonymous 1", bob.DisplayName)
+	assert.Empty(t, bob.AvatarURL)
+	assert.Equal(t, map[string]interface{}{"msgtype": "m.notice", "body": "(video/mp4 removed)"}, bob.Content)
+	assert.Equal(t, []archive.MessageReaction{{Emoji: "👍", Users: []string{"@alice:example.org"}, Count: 1}}, bob.Reactions)
+	assert.Empty(t, bob.RepliesTo.Content, "quotes of withheld messages are removed")
+
+	assert.Equal(t, "Anonymous 1", published[2].DisplayName, "a sender keeps one pseudonym")
+	assert.Equal(t, "cat.png", published[2].Content["body"], "images aren't stripped by a video pattern")
+
+	assert.Equal(t, archive.PublishStats{Withheld: 1, Anonymized: 2, Stripped: 1}, publisher.Stats)
+}
+
+func TestPublisherApplyReplyFallback(t *testing.T) {
+	messages := []archive.ExportMessage{
+		{EventID: "$5", UserID: "@alice:example.org", Sender: "@alice:example.org", DisplayName: "Alice", MessageType: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "> <@carol:example.org> please leave me out\n> my address is 1 Main St\n\nsure thing",
+				"format":  "org.matrix.custom.html",
+				"formatted_body": `<mx-reply><blockquote><a href="https://matrix.to/#/!room:example.org/$2">In reply to</a> ` +
+					`<a href="https://matrix.to/#/@carol:example.org">@carol:example.org</a><br>please leave me out<br>my address is 1 Main St</blockquote></mx-reply>sure thing`,
+				"m.relates_to": map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": "$2"}},
+			},
+			RepliesTo: &archive.ReplyInfo{EventID: "$2", Sender: "@carol:example.org", DisplayName: "Carol", Content: "please leave me out"}},
+		{EventID: "$6", UserID: "@alice:example.org", Sender: "@alice:example.org", DisplayName: "Alice", MessageType: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype":        "m.text",
+				"body":           "Bridged Bob: thanks",
+				"format":         "org.matrix.custom.html",
+				"formatted_body": `<a href="https://matrix.to/#/%40bot%3Abridge.example.org">Bridged Bob</a>: thanks`,
+				"m.mentions":     map[string]interface{}{"user_ids": []interface{}{"@bot:bridge.example.org"}},
+			}},
+	}
+	publisher := archive.NewPublisher(&archive.PublishConfig{
+		Anonymize: []string{"@*:bridge.example.org"},
+		OptOut:    []string{"@carol:example.org"},
+	})
+	published := publisher.Apply(messages)
+	require.Len(t, published, 2)
+
+	reply := published[0]
+	assert.Equal(t, "sure thing", reply.Content["body"], "the quote of someone who opted out is removed")
+	assert.Equal(t, "sure thing", reply.Content["formatted_body"])
+	assert.Empty(t, reply.RepliesTo.Sender)
+	assert.Contains(t, messages[0].Content["body"], "1 Main St", "the archived messages are left alone")
+
+	mention := published[1]
+	assert.Equal(t, "Anonymous 1: thanks", mention.Content["body"], "the display names of anonymized pills are replaced")
+	assert.Equal(t, "Anonymous 1: thanks", mention.Content["formatted_body"], "percent-encoded pills are replaced")
+	assert.Equal(t, map[string]interface{}{"user_ids": []interface{}{"Anonymous 1"}}, mention.Content["m.mentions"])
+	assert.Equal(t, []interface{}{"@bot:bridge.example.org"}, messages[1].Content["m.mentions"].(map[string]interface{})["user_ids"])
+}
+
+func TestPseudonymMapping(t *testing.T) {
+	publisher := archive.NewPublisher(&archive.PublishConfig{Anonymize: []string{"@*:bridge.example.org"}})
+	publisher.Apply([]archive.ExportMessage{
+		{EventID: "$1", UserID: "@zed:bridge.example.org", MessageType: "m.room.message", Content: map[string]interface{}{"msgtype": "m.text", "body": "hi"}},
+		{EventID: "$2", UserID: "@alice:example.org", MessageType: "m.room.message", Content: map[string]interface{}{"msgtype": "m.text", "body": "hi @amy:bridge.example.org"}},
+		{EventID: "$3", UserID: "@zed:bridge.example.org", MessageType: "m.room.message", Content: map[string]interface{}{"msgtype": "m.text", "body": "again"}},
+	})
+	mapping := publisher.Pseudonyms()
+	assert.Equal(t, []archive.PseudonymEntry{
+		{Pseudonym: "Anonymous 1", UserID: "@zed:bridge.example.org"},
+		{Pseudonym: "Anonymous 2", UserID: "@amy:bridge.example.org"},
+	}, mapping.Pseudonyms, "pseudonyms are listed in the order they were given out")
+
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "plain.json")
+	require.NoError(t, archive.WritePseudonymMapping(plain, mapping, ""))
+	info, err := os.Stat(plain)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	loaded, err := archive.LoadPseudonymMapping(plain, "")
+	require.NoError(t, err)
+	assert.Equal(t, mapping, loaded)
+
+	encrypted := filepath.Join(dir, "encrypted.json")
+	require.NoError(t, archive.WritePseudonymMapping(encrypted, mapping, "s3cret"))
+	data, err := os.ReadFile(encrypted)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "@zed:bridge.example.org")
+	_, err = archive.LoadPseudonymMapping(encrypted, "")
+	assert.ErrorContains(t, err, "encrypted")
+	_, err = archive.LoadPseudonymMapping(encrypted, "wrong")
+	assert.Error(t, err)
+	loaded, err = archive.LoadPseudonymMapping(encrypted, "s3cret")
+	require.NoError(t, err)
+	userID, ok := loaded.Lookup("anonymous 2")
+	assert.True(t, ok)
+	assert.Equal(t, "@amy:bridge.example.org", userID)
+}
@@ -0,0 +1,41 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"maunium.net/go/mautrix"
+)
+
+func TestRateLimitDelay(t *testing.T) {
+	limited := func(extra map[string]any) error {
+		extra["errcode"] = "M_LIMIT_EXCEEDED"
+		return mautrix.HTTPError{RespError: &mautrix.RespError{ErrCode: "M_LIMIT_EXCEEDED", StatusCode: 429, ExtraData: extra}}
+	}
+
+	t.Run("honors retry_after_ms", func(t *testing.T) {
+		delay, ok := archive.RateLimitDelay(limited(map[string]any{"retry_after_ms": float64(1500)}), time.Second)
+		assert.True(t, ok)
+		assert.Equal(t, 1500*time.Millisecond, delay)
+	})
+
+	t.Run("falls back without retry_after_ms", func(t *testing.T) {
+		delay, ok := archive.RateLimitDelay(fmt.Errorf("failed to fetch messages: %w", limited(map[string]any{})), 4*time.Second)
+		assert.True(t, ok)
+		assert.Equal(t, 4*time.Second, delay)
+	})
+
+	t.Run("ignores other errors", func(t *testing.T) {
+		_, ok := archive.RateLimitDelay(mautrix.HTTPError{RespError: &mautrix.RespError{ErrCode: "M_FORBIDDEN", StatusCode: 403}}, time.Second)
+		assert.False(t, ok)
+		_, ok = archive.RateLimitDelay(errors.New("connection reset"), time.Second)
+		assert.False(t, ok)
+		_, ok = archive.RateLimitDelay(nil, time.Second)
+		assert.False(t, ok)
+	})
+}
@@ -0,0 +1,88 @@
+package tests
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func reactionTimelineMessages() []*archive.Message {
+	at := func(minutes int) time.Time { return time.Date(2024, 3, 1, 12, minutes, 0, 0, time.UTC) }
+	reaction := func(eventID, sender, target, key string, minutes int) *archive.Message {
+		return &archive.Message{
+			RoomID: "!room:example.org", EventID: eventID, Sender: sender, MessageType: "m.reaction", Timestamp: at(minutes),
+			Content: map[string]interface{}{"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": target, "key": key}},
+		}
+	}
+	return []*archive.Message{
+		{RoomID: "!room:example.org", EventID: "$post", Sender: "@alice:example.org", MessageType: "m.room.message", Timestamp: at(0), Content: map[string]interface{}{"msgtype": "m.text", "body": "launch day"}},
+		reaction("$r2", "@carol:example.org", "$post", "🎉", 5),
+		reaction("$r1", "@bob:example.org", "$post", "👍", 1),
+		reaction("$r3", "@bob:example.org", "$missing", "👀", 7),
+		{RoomID: "!room:example.org", EventID: "$reply", Sender: "@bob:example.org", MessageType: "m.room.message", Timestamp: at(2), Content: map[string]interface{}{"msgtype": "m.text", "body": "congrats"}},
+	}
+}
+
+func TestBuildReactionTimeline(t *testing.T) {
+	timeline := archive.BuildReactionTimeline(reactionTimelineMessages())
+	require.Len(t, timeline, 3)
+
+	assert.Equal(t, "$r1", timeline[0].EventID, "oldest first")
+	assert.Equal(t, "@bob:example.org", timeline[0].Sender)
+	assert.Equal(t, "👍", timeline[0].Key)
+	assert.Equal(t, "$post", timeline[0].TargetEventID)
+	assert.Equal(t, "@alice:example.org", timeline[0].TargetSender)
+	require.NotNil(t, timeline[0].DelaySeconds)
+	assert.Equal(t, 60.0, *timeline[0].DelaySeconds)
+
+	assert.Equal(t, "$r2", timeline[1].EventID)
+	assert.Equal(t, "$missing", timeline[2].TargetEventID)
+	assert.Empty(t, timeline[2].TargetSender)
+	assert.Nil(t, timeline[2].DelaySeconds)
+
+	assert.Empty(t, archive.BuildReactionTimeline(nil))
+}
+
+func TestWriteReactionTimeline(t *testing.T) {
+	timeline := archive.BuildReactionTimeline(reactionTimelineMessages())
+	dir := t.TempDir()
+
+	t.Run("csv", func(t *testing.T) {
+		path := filepath.Join(dir, "reactions.csv")
+		require.NoError(t, archive.WriteReactionTimeline(path, timeline))
+		file, err := os.Open(path)
+		require.NoError(t, err)
+		defer file.Close()
+		rows, err := csv.NewReader(file).ReadAll()
+		require.NoError(t, err)
+		require.Len(t, rows, 4)
+		assert.Equal(t, []string{"timestamp", "room_id", "event_id", "sender", "key", "target_event_id", "target_sender", "delay_seconds"}, rows[0])
+		assert.Equal(t, []string{"2024-03-01T12:01:00Z", "!room:example.org", "$r1", "@bob:example.org", "👍", "$post", "@alice:example.org", "60"}, rows[1])
+		assert.Equal(t, "", rows[3][7])
+	})
+
+	t.Run("json", func(t *testing.T) {
+		path := filepath.Join(dir, "reactions.json")
+		require.NoError(t, archive.WriteReactionTimeline(path, timeline))
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		var decoded []map[string]interface{}
+		require.NoError(t, json.Unmarshal(data, &decoded))
+		require.Len(t, decoded, 3)
+		assert.Equal(t, "🎉", decoded[1]["key"])
+		assert.Equal(t, 300.0, decoded[1]["delay_seconds"])
+		assert.NotContains(t, decoded[2], "delay_seconds")
+	})
+
+	t.Run("unsupported extension", func(t *testing.T) {
+		assert.Error(t, archive.WriteReactionTimeline(filepath.Join(dir, "reactions.txt"), timeline))
+	})
+}
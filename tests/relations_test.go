@@ -0,0 +1,44 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconcileRelations(t *testing.T) {
+	earlier := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := earlier.Add(24 * time.Hour)
+	relating := func(eventID string, relatesTo map[string]interface{}) *archive.Message {
+		return &archive.Message{RoomID: "!room:example.org", EventID: eventID, Content: map[string]interface{}{"m.relates_to": relatesTo}}
+	}
+
+	// History arrives newest first, so a page can hold a reaction and an
+	// edit without the message they refer to
+	messages := []*archive.Message{
+		relating("$reaction", map[string]interface{}{"rel_type": "m.annotation", "event_id": "$original", "key": "👍"}),
+		relating("$edit", map[string]interface{}{"rel_type": "m.replace", "event_id": "$original"}),
+		relating("$reply", map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": "$older"}}),
+		relating("$thread", map[string]interface{}{"rel_type": "m.thread", "event_id": "$older", "m.in_reply_to": map[string]interface{}{"event_id": "$older"}}),
+	}
+	unresolved, linked := archive.ReconcileRelations(messages, nil, earlier)
+	assert.Equal(t, 0, linked)
+	require.Len(t, unresolved, 4, "a thread reply's fallback reply to the root counts once")
+	assert.Equal(t, "$original", unresolved[0].TargetEventID)
+	assert.Equal(t, "m.annotation", unresolved[0].RelType)
+	assert.Equal(t, "m.in_reply_to", unresolved[2].RelType)
+	assert.Equal(t, "m.thread", unresolved[3].RelType)
+	assert.Equal(t, earlier, unresolved[0].FirstSeen)
+
+	// A later page brings the original message
+	messages = append(messages, &archive.Message{RoomID: "!room:example.org", EventID: "$original", Content: map[string]interface{}{"body": "hi"}})
+	unresolved, linked = archive.ReconcileRelations(messages, unresolved, now)
+	assert.Equal(t, 2, linked)
+	require.Len(t, unresolved, 2)
+	assert.Equal(t, "$older", unresolved[0].TargetEventID)
+	assert.Equal(t, earlier, unresolved[0].FirstSeen, "relations keep when they were first found unresolved")
+}
@@ -0,0 +1,128 @@
+package tests
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadUserMap(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`"@alice:old.example": "@alice:new.example"
+"@bob:old.example": "@robert:new.example"
+`), 0644))
+
+	users, err := archive.LoadUserMap(path)
+	require.NoError(t, err)
+	assert.Equal(t, archive.UserMap{"@alice:old.example": "@alice:new.example", "@bob:old.example": "@robert:new.example"}, users)
+
+	require.NoError(t, os.WriteFile(path, []byte(`"@alice:old.example": "alice"`), 0644))
+	_, err = archive.LoadUserMap(path)
+	assert.ErrorContains(t, err, "not a user ID")
+}
+
+func TestRestoreContent(t *testing.T) {
+	timestamp := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	message := func(eventType string, content map[string]interface{}) *archive.Message {
+		return &archive.Message{RoomID: "!room:old.example", EventID: "$event", Sender: "@alice:old.example", MessageType: eventType, Timestamp: timestamp, Content: content}
+	}
+	restored := map[string]string{"$original": "$restored"}
+
+	t.Run("records the original event", func(t *testing.T) {
+		msg := message(archive.EventTypeMessage, map[string]interface{}{"msgtype": "m.text", "body": "hello"})
+		content, ok := archive.RestoreContent(msg, restored, "")
+		require.True(t, ok)
+		assert.Equal(t, "hello", content["body"])
+		assert.Equal(t, map[string]interface{}{
+			"event_id": "$event", "room_id": "!room:old.example", "sender": "@alice:old.example", "origin_server_ts": timestamp.UnixMilli(),
+		}, content[archive.RestoredFromField])
+		_, changed := msg.Content[archive.RestoredFromField]
+		assert.False(t, changed, "the archived message is left alone")
+	})
+
+	t.Run("attribution names the sender", func(t *testing.T) {
+		content, ok := archive.RestoreContent(message(archive.EventTypeMessage, map[string]interface{}{
+			"msgtype": "m.text", "body": "hello", "format": "org.matrix.custom.html", "formatted_body": "<em>hello</em>",
+		}), restored, "Alice <3")
+		require.True(t, ok)
+		assert.Equal(t, "[2024-06-01 10:00] Alice <3: hello", content["body"])
+		assert.Equal(t, "[2024-06-01 10:00] <strong>Alice &lt;3</strong>: <em>hello</em>", content["formatted_body"])
+
+		content, ok = archive.RestoreContent(message(archive.EventTypeMessage, map[string]interface{}{"msgtype": "m.emote", "body": "waves"}), restored, "Alice")
+		require.True(t, ok)
+		assert.Equal(t, "m.text", content["msgtype"])
+		assert.Equal(t, "[2024-06-01 10:00] * Alice waves", content["body"])
+	})
+
+	t.Run("relations point at restored events", func(t *testing.T) {
+		content, ok := archive.RestoreContent(message(archive.EventTypeReaction, map[string]interface{}{
+			"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": "$original", "key": "👍"},
+		}), restored, "Alice")
+		require.True(t, ok)
+		assert.Equal(t, map[string]interface{}{"rel_type": "m.annotation", "event_id": "$restored", "key": "👍"}, content["m.relates_to"])
+		assert.Nil(t, content["body"], "reactions aren't attributed")
+
+		content, ok = archive.RestoreContent(message(archive.EventTypeMessage, map[string]interface{}{
+			"msgtype": "m.text", "body": "reply",
+			"m.relates_to": map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": "$missing"}},
+		}), restored, "")
+		require.True(t, ok)
+		assert.NotContains(t, content, "m.relates_to", "replies to events that weren't restored become plain messages")
+
+		content, ok = archive.RestoreContent(message(archive.EventTypeMessage, map[string]interface{}{
+			"msgtype": "m.text", "body": "in thread",
+			"m.relates_to": map[string]interface{}{"rel_type": "m.thread", "event_id": "$missing", "m.in_reply_to": map[string]interface{}{"event_id": "$original"}},
+		}), restored, "")
+		require.True(t, ok)
+		assert.Equal(t, map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": "$restored"}}, content["m.relates_to"])
+	})
+
+	t.Run("unrestorable messages", func(t *testing.T) {
+		_, ok := archive.RestoreContent(message(archive.EventTypeReaction, map[string]interface{}{
+			"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": "$missing", "key": "👍"},
+		}), restored, "")
+		assert.False(t, ok, "reactions to events that weren't restored")
+
+		_, ok = archive.RestoreContent(message(archive.EventTypeMessage, map[string]interface{}{
+			"msgtype": "m.text", "body": "* fixed",
+			"m.relates_to": map[string]interface{}{"rel_type": "m.replace", "event_id": "$missing"},
+		}), restored, "")
+		assert.False(t, ok, "edits of events that weren't restored")
+
+		_, ok = archive.RestoreContent(message(archive.EventTypeEncrypted, map[string]interface{}{"algorithm": "m.megolm.v1.aes-sha2"}), restored, "")
+		assert.False(t, ok, "undecrypted placeholders")
+	})
+}
+
+func TestDuckDBRestoreState(t *testing.T) {
+	ctx := context.Background()
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	room, err := db.GetRestoredRoom(ctx, "https://new.example", "!room:old.example")
+	require.NoError(t, err)
+	assert.Nil(t, room)
+
+	require.NoError(t, db.SaveRestoredRoom(ctx, &archive.RestoredRoom{SourceRoomID: "!room:old.example", Homeserver: "https://new.example", TargetRoomID: "!new:new.example"}))
+	room, err = db.GetRestoredRoom(ctx, "https://new.example", "!room:old.example")
+	require.NoError(t, err)
+	require.NotNil(t, room)
+	assert.Equal(t, "!new:new.example", room.TargetRoomID)
+
+	require.NoError(t, db.SaveRestoredEvents(ctx, []*archive.RestoredEvent{
+		{SourceEventID: "$a", SourceRoomID: "!room:old.example", Homeserver: "https://new.example", TargetEventID: "$a2"},
+		{SourceEventID: "$a", SourceRoomID: "!room:old.example", Homeserver: "https://other.example", TargetEventID: "$a3"},
+	}))
+	restored, err := db.GetRestoredEvents(ctx, "https://new.example", "!room:old.example")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"$a": "$a2"}, restored, "restores to each homeserver are kept apart")
+}
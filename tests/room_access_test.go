@@ -0,0 +1,85 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+	"maunium.net/go/mautrix"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// roomAccessServer fakes a homeserver's history visibility and join
+// endpoints; visibility is the rooms' history visibility, and join the
+// status and body of join requests
+func roomAccessServer(t *testing.T, visibility string, joinStatus int, joinBody string) (*mautrix.Client, *[]string) {
+	var joins []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.Contains(r.URL.Path, "/state/m.room.history_visibility"):
+			w.Write([]byte(`{"history_visibility":"` + visibility + `"}`))
+		case strings.Contains(r.URL.Path, "/join/"):
+			joins = append(joins, r.URL.Path+"?"+r.URL.RawQuery)
+			w.WriteHeader(joinStatus)
+			w.Write([]byte(joinBody))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errcode":"M_UNRECOGNIZED","error":"unrecognized"}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	client, err := mautrix.NewClient(server.URL, "@archiver:example.org", "token")
+	require.NoError(t, err)
+	return client, &joins
+}
+
+func TestRejoinRoom(t *testing.T) {
+	ctx := context.Background()
+
+	client, joins := roomAccessServer(t, "world_readable", http.StatusOK, `{}`)
+	access, err := archive.RejoinRoom(ctx, client, "!public:example.org")
+	require.NoError(t, err)
+	assert.Equal(t, archive.RoomAccessPeek, access)
+	assert.Empty(t, *joins, "world-readable rooms are read without joining")
+
+	client, joins = roomAccessServer(t, "shared", http.StatusOK, `{"room_id":"!team:example.org"}`)
+	access, err = archive.RejoinRoom(ctx, client, "!team:example.org")
+	require.NoError(t, err)
+	assert.Equal(t, archive.RoomAccessRejoined, access)
+	require.Len(t, *joins, 1)
+	assert.Contains(t, (*joins)[0], "via=example.org", "rooms are joined through the server in their ID")
+
+	client, _ = roomAccessServer(t, "shared", http.StatusForbidden, `{"errcode":"M_FORBIDDEN","error":"You are banned from the room"}`)
+	_, err = archive.RejoinRoom(ctx, client, "!private:example.org")
+	var accessErr *archive.RoomAccessError
+	require.ErrorAs(t, err, &accessErr)
+	assert.Equal(t, "!private:example.org", accessErr.RoomID)
+	assert.Contains(t, accessErr.Reason, "invite-only or the account is banned")
+	assert.ErrorIs(t, err, mautrix.MForbidden)
+
+	client, _ = roomAccessServer(t, "shared", http.StatusNotFound, `{"errcode":"M_NOT_FOUND","error":"No known servers"}`)
+	_, err = archive.RejoinRoom(ctx, client, "!gone:example.org")
+	require.ErrorAs(t, err, &accessErr)
+	assert.Contains(t, accessErr.Reason, "no longer knows the room")
+}
+
+func TestPeekRoom(t *testing.T) {
+	ctx := context.Background()
+
+	client, joins := roomAccessServer(t, "world_readable", http.StatusOK, `{}`)
+	require.NoError(t, archive.PeekRoom(ctx, client, "!announcements:example.org"))
+	assert.Empty(t, *joins, "peeking never joins")
+
+	client, joins = roomAccessServer(t, "shared", http.StatusOK, `{}`)
+	err := archive.PeekRoom(ctx, client, "!team:example.org")
+	var accessErr *archive.RoomAccessError
+	require.ErrorAs(t, err, &accessErr)
+	assert.Contains(t, accessErr.Reason, "isn't world-readable")
+	assert.Empty(t, *joins)
+}
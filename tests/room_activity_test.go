@@ -0,0 +1,28 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummarizeDailyStats(t *testing.T) {
+	assert.Nil(t, archive.SummarizeDailyStats(nil))
+
+	day := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	activity := archive.SummarizeDailyStats([]*archive.DailyStats{
+		{Day: day, Sender: "@a:example.com", MessageType: "m.room.message", MessageCount: 3, FirstMessage: day.Add(9 * time.Hour), LastMessage: day.Add(17 * time.Hour)},
+		{Day: day, Sender: "@b:example.com", MessageType: "m.reaction", MessageCount: 1, FirstMessage: day.Add(8 * time.Hour), LastMessage: day.Add(8 * time.Hour)},
+		{Day: day.AddDate(0, 0, 5), Sender: "@a:example.com", MessageType: "m.room.message", MessageCount: 2, FirstMessage: day.AddDate(0, 0, 5), LastMessage: day.AddDate(0, 0, 5).Add(time.Hour)},
+	})
+	require.NotNil(t, activity)
+	assert.Equal(t, int64(6), activity.Messages)
+	assert.Equal(t, 2, activity.Senders)
+	assert.Equal(t, 2, activity.ActiveDays)
+	assert.Equal(t, day.Add(8*time.Hour), activity.FirstMessage)
+	assert.Equal(t, day.AddDate(0, 0, 5).Add(time.Hour), activity.LastMessage)
+}
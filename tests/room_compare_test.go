@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePeriod(t *testing.T) {
+	year, err := archive.ParsePeriod("2023")
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2023, 1, 1, 0, 0, 0, 0, time.Local), year.Start)
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local), year.End)
+
+	month, err := archive.ParsePeriod("2024-02")
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local), month.End)
+
+	span, err := archive.ParsePeriod("2024-01..2024-06-15")
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local), span.Start)
+	assert.Equal(t, time.Date(2024, 6, 16, 0, 0, 0, 0, time.Local), span.End, "the end of a range is inclusive")
+	assert.Equal(t, "2024-01..2024-06-15", span.Label)
+
+	for _, invalid := range []string{"", "23", "2024-13", "last year", "2024..2023"} {
+		_, err := archive.ParsePeriod(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestCompareRoomPeriods(t *testing.T) {
+	at := func(year int, minutes int) time.Time {
+		return time.Date(year, 5, 1, 10, 0, 0, 0, time.Local).Add(time.Duration(minutes) * time.Minute)
+	}
+	text := map[string]interface{}{"msgtype": "m.text", "body": "hi"}
+	image := map[string]interface{}{"msgtype": "m.image", "body": "photo.jpg"}
+	messages := []*archive.Message{
+		{Sender: "@alice:example.org", MessageType: archive.EventTypeMessage, Timestamp: at(2023, 0), Content: text},
+		{Sender: "@bob:example.org", MessageType: archive.EventTypeMessage, Timestamp: at(2023, 10), Content: text},
+		{Sender: "@bob:example.org", MessageType: archive.EventTypeReaction, Timestamp: at(2023, 11), Content: map[string]interface{}{}},
+
+		{Sender: "@alice:example.org", MessageType: archive.EventTypeMessage, Timestamp: at(2024, 0), Content: text},
+		{Sender: "@bob:example.org", MessageType: archive.EventTypeMessage, Timestamp: at(2024, 2), Content: image},
+		{Sender: "@carol:example.org", MessageType: archive.EventTypeMessage, Timestamp: at(2024, 6), Content: text},
+		{Sender: "@carol:example.org", MessageType: archive.EventTypeMessage, Timestamp: at(2024, 7), Content: text},
+		// A reply the next day starts a new conversation rather than counting as a slow response
+		{Sender: "@alice:example.org", MessageType: archive.EventTypeMessage, Timestamp: at(2024, 24*60), Content: text},
+	}
+	period1, err := archive.ParsePeriod("2023")
+	require.NoError(t, err)
+	period2, err := archive.ParsePeriod("2024")
+	require.NoError(t, err)
+
+	comparison := archive.CompareRoomPeriods("!room:example.org", messages, period1, period2)
+	assert.Equal(t, 2, comparison.Period1.Messages, "reactions aren't messages")
+	assert.Equal(t, 2, comparison.Period1.ActiveUsers)
+	assert.Equal(t, 10*time.Minute, comparison.Period1.MedianResponse)
+	assert.Zero(t, comparison.Period1.MediaShare)
+
+	assert.Equal(t, 5, comparison.Period2.Messages)
+	assert.Equal(t, 3, comparison.Period2.ActiveUsers)
+	assert.Equal(t, 3*time.Minute, comparison.Period2.MedianResponse)
+	assert.Equal(t, 1, comparison.Period2.MediaMessages)
+	assert.InDelta(t, 0.2, comparison.Period2.MediaShare, 1e-9)
+
+	rows := comparison.Rows()
+	require.Len(t, rows, 4)
+	assert.Equal(t, archive.ComparisonRow{Metric: "Messages", Period1: "2", Period2: "5", Change: "+3 (+150.0%)"}, rows[0])
+	assert.Equal(t, "-7m0s (-70.0%)", rows[2].Change)
+	assert.Equal(t, "+20.0 pts", rows[3].Change)
+
+	report := filepath.Join(t.TempDir(), "compare.html")
+	require.NoError(t, archive.WriteComparisonReport(report, "Project <Chat>", comparison))
+	html, err := os.ReadFile(report)
+	require.NoError(t, err)
+	assert.Contains(t, string(html), "Project &lt;Chat&gt;")
+	assert.Contains(t, string(html), "150.0%")
+}
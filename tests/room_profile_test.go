@@ -0,0 +1,47 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/event"
+)
+
+func stateEvent(evtType event.Type, stateKey string, timestamp int64, content map[string]interface{}) *event.Event {
+	return &event.Event{
+		Type:      evtType,
+		StateKey:  &stateKey,
+		Timestamp: timestamp,
+		Content:   event.Content{Raw: content},
+	}
+}
+
+func TestRoomProfileFromState(t *testing.T) {
+	created := time.Date(2021, 3, 14, 15, 9, 26, 0, time.UTC)
+	profile := archive.RoomProfileFromState("!room:example.com", []*event.Event{
+		stateEvent(event.StateCreate, "", created.UnixMilli(), map[string]interface{}{"room_version": "10"}),
+		stateEvent(event.StateRoomName, "", 0, map[string]interface{}{"name": "Book Club"}),
+		stateEvent(event.StateTopic, "", 0, map[string]interface{}{"topic": "What we're reading"}),
+		stateEvent(event.StateCanonicalAlias, "", 0, map[string]interface{}{"alias": "#books:example.com"}),
+		stateEvent(event.StateRoomName, "@bob:example.com", 0, map[string]interface{}{"name": "Not the room name"}),
+		stateEvent(event.StateMember, "@bob:example.com", 0, map[string]interface{}{"membership": "join"}),
+	})
+
+	assert.Equal(t, "!room:example.com", profile.RoomID)
+	assert.Equal(t, "Book Club", profile.Name)
+	assert.Equal(t, "What we're reading", profile.Topic)
+	assert.Equal(t, "#books:example.com", profile.CanonicalAlias)
+	require.NotNil(t, profile.CreatedAt)
+	assert.True(t, created.Equal(*profile.CreatedAt))
+}
+
+func TestRoomProfileFromStateWithoutState(t *testing.T) {
+	profile := archive.RoomProfileFromState("!room:example.com", nil)
+	assert.Equal(t, "!room:example.com", profile.RoomID)
+	assert.Empty(t, profile.Name)
+	assert.Nil(t, profile.CreatedAt)
+}
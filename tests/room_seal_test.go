@@ -0,0 +1,86 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sealMessages() []*archive.Message {
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	return []*archive.Message{
+		{RoomID: "!closed:example.com", EventID: "$2", Sender: "@bob:example.com", MessageType: "m.room.message",
+			Timestamp: base.Add(time.Hour), Content: map[string]interface{}{"msgtype": "m.text", "body": "goodbye"}},
+		{RoomID: "!closed:example.com", EventID: "$1", Sender: "@alice:example.com", MessageType: "m.room.message",
+			Timestamp: base, Content: map[string]interface{}{"msgtype": "m.text", "body": "hello"}},
+	}
+}
+
+func TestSealHash(t *testing.T) {
+	messages := sealMessages()
+	hash := archive.SealHash(messages)
+	assert.Len(t, hash, 64)
+	assert.Equal(t, hash, archive.SealHash([]*archive.Message{messages[1], messages[0]}), "order doesn't matter")
+
+	edited := sealMessages()
+	edited[0].Content["body"] = "farewell"
+	assert.NotEqual(t, hash, archive.SealHash(edited))
+	assert.NotEqual(t, hash, archive.SealHash(messages[:1]))
+}
+
+func TestBuildRoomSeal(t *testing.T) {
+	seal, err := archive.BuildRoomSeal("!closed:example.com", sealMessages())
+	require.NoError(t, err)
+	assert.Equal(t, "$1", seal.FirstEventID)
+	assert.Equal(t, "$2", seal.LastEventID)
+	assert.Equal(t, int64(2), seal.MessageCount)
+	assert.Equal(t, archive.SealHash(sealMessages()), seal.Hash)
+
+	_, err = archive.BuildRoomSeal("!empty:example.com", nil)
+	assert.Error(t, err)
+}
+
+func TestDuckDBRoomSeals(t *testing.T) {
+	ctx := context.Background()
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	_, err := db.InsertMessageBatch(ctx, sealMessages())
+	require.NoError(t, err)
+
+	seal, err := db.GetRoomSeal(ctx, "!closed:example.com")
+	require.NoError(t, err)
+	assert.Nil(t, seal)
+
+	messages, err := db.GetMessages(ctx, &archive.MessageFilter{RoomID: "!closed:example.com"}, 0, 0)
+	require.NoError(t, err)
+	seal, err = archive.BuildRoomSeal("!closed:example.com", messages)
+	require.NoError(t, err)
+	assert.Equal(t, archive.SealHash(sealMessages()), seal.Hash, "stored messages hash as they were archived")
+	require.NoError(t, db.SealRoom(ctx, seal))
+	assert.Error(t, db.SealRoom(ctx, seal), "a room can only be sealed once")
+
+	stored, err := db.GetRoomSeal(ctx, "!closed:example.com")
+	require.NoError(t, err)
+	require.NotNil(t, stored)
+	assert.Equal(t, seal.Hash, stored.Hash)
+	assert.Equal(t, "$1", stored.FirstEventID)
+	assert.Equal(t, "$2", stored.LastEventID)
+	assert.True(t, seal.LastTimestamp.Equal(stored.LastTimestamp))
+
+	seals, err := db.GetRoomSeals(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, seals, 1)
+
+	require.NoError(t, db.UnsealRoom(ctx, "!closed:example.com"))
+	assert.Error(t, db.UnsealRoom(ctx, "!closed:example.com"))
+	seal, err = db.GetRoomSeal(ctx, "!closed:example.com")
+	require.NoError(t, err)
+	assert.Nil(t, seal)
+}
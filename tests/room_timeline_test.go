@@ -0,0 +1,54 @@
+package tests
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildRoomTimeline(t *testing.T) {
+	day := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	stats := []*archive.DailyStats{
+		{Day: day, Sender: "@alice:example.org", MessageType: archive.EventTypeMessage, MessageCount: 5},
+		{Day: day, Sender: "@bob:example.org", MessageType: archive.EventTypeMessage, MessageCount: 2},
+		{Day: day, Sender: "@bob:example.org", MessageType: archive.EventTypeReaction, MessageCount: 9},
+		{Day: day.AddDate(0, 0, 3), Sender: "@carol:example.org", MessageType: archive.EventTypeEncrypted, MessageCount: 1},
+		{Day: day.AddDate(0, 0, 3), Sender: "@dave:example.org", MessageType: archive.EventTypeMessage, MessageCount: 20},
+	}
+
+	timeline := archive.BuildRoomTimeline("!room:example.org", stats, 0, nil)
+	require.Len(t, timeline.Days, 4, "empty days between the first and last are filled in")
+	assert.Equal(t, int64(7), timeline.Days[0].Messages, "reactions aren't counted")
+	assert.Equal(t, int64(0), timeline.Days[1].Messages)
+	assert.Equal(t, int64(21), timeline.Days[3].Messages)
+	assert.False(t, timeline.Stacked())
+
+	timeline = archive.BuildRoomTimeline("!room:example.org", stats, 2, map[string]bool{"@dave:example.org": true})
+	assert.True(t, timeline.Stacked())
+	assert.Equal(t, []string{"@alice:example.org", "@bob:example.org"}, timeline.Senders, "opted-out senders aren't named")
+	assert.Equal(t, []int64{5, 2, 0}, timeline.Days[0].BySender)
+	assert.Equal(t, []int64{0, 0, 21}, timeline.Days[3].BySender)
+
+	var svg bytes.Buffer
+	require.NoError(t, timeline.WriteSVG(&svg))
+	assert.True(t, strings.HasPrefix(svg.String(), "<svg "))
+	assert.Contains(t, svg.String(), "<title>2024-01-02, @alice:example.org: 5</title>")
+	assert.Contains(t, svg.String(), ">Everyone else</text>")
+	assert.NotContains(t, svg.String(), "@dave:example.org")
+
+	var page bytes.Buffer
+	require.NoError(t, timeline.WriteHTML(&page, "Project <Chat>"))
+	assert.Contains(t, page.String(), "<h1>Project &lt;Chat&gt;</h1>")
+	assert.Contains(t, page.String(), "28 messages over 4 days, 2024-01-02 to 2024-01-05")
+	assert.Contains(t, page.String(), "<svg ")
+
+	empty := archive.BuildRoomTimeline("!room:example.org", nil, 0, nil)
+	assert.Empty(t, empty.Days)
+	require.NoError(t, empty.WriteSVG(&svg))
+}
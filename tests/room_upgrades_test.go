@@ -0,0 +1,100 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoomVersionsUpsert(t *testing.T) {
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 5})
+	ctx := context.Background()
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	version, err := db.GetRoomVersion(ctx, "!old:example.com")
+	require.NoError(t, err)
+	assert.Nil(t, version)
+
+	// Seen first as a predecessor, then filled in from its own state and tombstone
+	require.NoError(t, db.SaveRoomVersion(ctx, &archive.RoomVersion{RoomID: "!old:example.com", SuccessorID: "!new:example.com"}))
+	require.NoError(t, db.SaveRoomVersion(ctx, &archive.RoomVersion{RoomID: "!old:example.com", RoomVersion: "6"}))
+	upgradedAt := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	require.NoError(t, db.SaveRoomVersion(ctx, &archive.RoomVersion{RoomID: "!old:example.com", SuccessorID: "!new:example.com", UpgradedAt: &upgradedAt}))
+
+	version, err = db.GetRoomVersion(ctx, "!old:example.com")
+	require.NoError(t, err)
+	require.NotNil(t, version)
+	assert.Equal(t, "6", version.RoomVersion)
+	assert.Equal(t, "!new:example.com", version.SuccessorID)
+	assert.Empty(t, version.PredecessorID)
+	require.NotNil(t, version.UpgradedAt)
+	assert.True(t, upgradedAt.Equal(*version.UpgradedAt))
+}
+
+func TestGetRoomChain(t *testing.T) {
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 5})
+	ctx := context.Background()
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	for _, version := range []*archive.RoomVersion{
+		{RoomID: "!v1:example.com", RoomVersion: "1", SuccessorID: "!v6:example.com"},
+		{RoomID: "!v6:example.com", RoomVersion: "6", PredecessorID: "!v1:example.com", SuccessorID: "!v10:example.com"},
+		{RoomID: "!v10:example.com", RoomVersion: "10", PredecessorID: "!v6:example.com"},
+		// A malformed cycle
+		{RoomID: "!a:example.com", PredecessorID: "!b:example.com"},
+		{RoomID: "!b:example.com", PredecessorID: "!a:example.com"},
+	} {
+		require.NoError(t, db.SaveRoomVersion(ctx, version))
+	}
+
+	roomIDs := func(chain []*archive.RoomVersion) []string {
+		var ids []string
+		for _, room := range chain {
+			ids = append(ids, room.RoomID)
+		}
+		return ids
+	}
+
+	// The whole chain is found from any room in it
+	for _, roomID := range []string{"!v1:example.com", "!v6:example.com", "!v10:example.com"} {
+		chain, err := archive.GetRoomChain(ctx, db, roomID)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"!v1:example.com", "!v6:example.com", "!v10:example.com"}, roomIDs(chain), roomID)
+	}
+
+	chain, err := archive.GetRoomChain(ctx, db, "!plain:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"!plain:example.com"}, roomIDs(chain))
+
+	chain, err = archive.GetRoomChain(ctx, db, "!a:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"!b:example.com", "!a:example.com"}, roomIDs(chain))
+}
+
+func TestMarkRoomUpgrades(t *testing.T) {
+	chain := []*archive.RoomVersion{
+		{RoomID: "!v1:example.com", RoomVersion: "1"},
+		{RoomID: "!v10:example.com", RoomVersion: "10"},
+	}
+	roomOf := map[string]string{
+		"$1": "!v1:example.com",
+		"$2": "!v1:example.com",
+		"$3": "!v10:example.com",
+		"$4": "!v10:example.com",
+	}
+	messages := []archive.ExportMessage{{EventID: "$1"}, {EventID: "$2"}, {EventID: "$3"}, {EventID: "$4"}}
+
+	archive.MarkRoomUpgrades(messages, roomOf, chain)
+	assert.Nil(t, messages[0].RoomUpgrade)
+	assert.Nil(t, messages[1].RoomUpgrade)
+	require.NotNil(t, messages[2].RoomUpgrade)
+	assert.Equal(t, archive.RoomUpgradeInfo{RoomID: "!v10:example.com", RoomVersion: "10", PreviousRoomID: "!v1:example.com"}, *messages[2].RoomUpgrade)
+	assert.Nil(t, messages[3].RoomUpgrade)
+}
@@ -0,0 +1,70 @@
+package tests
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildSearchIndex(t *testing.T) {
+	messages := lazyTestMessages()
+	messages[0].DisplayName = "Alice"
+	messages[0].Content["body"] = "  hello\n  world "
+	messages[1].Content = map[string]interface{}{"msgtype": "m.image", "url": "mxc://example.org/x"}
+
+	index := archive.BuildSearchIndex(messages, "", archive.LazySections(messages, 2, "archive_files"))
+	assert.Equal(t, archive.SearchIndexVersion, index.Version)
+	assert.Equal(t, []string{"text", "sender", "date", "url", "section"}, index.Fields)
+	require.Len(t, index.Docs, 4, "messages without text are left out")
+	assert.Equal(t, []string{"hello world", "Alice", "2024-01-05", "#msg-a", ""}, index.Docs[0],
+		"messages rendered in the page have no section")
+	assert.Equal(t, "section-2", index.Docs[1][4])
+	assert.Equal(t, "section-4", index.Docs[3][4])
+
+	site := archive.BuildSearchIndex(messages, "rooms/general.html", nil)
+	assert.Equal(t, "rooms/general.html#msg-a", site.Docs[0][3])
+	assert.Equal(t, "", site.Docs[3][4])
+}
+
+func TestSearchIndexHTMLExport(t *testing.T) {
+	t.Chdir("..")
+
+	opts := archive.DefaultExportOptions()
+	opts.SearchIndex = true
+	base := filepath.Join(t.TempDir(), "archive")
+	for _, lazyLoad := range []int{archive.DefaultLazyLoad, 2} {
+		opts.LazyLoad = lazyLoad
+		for _, name := range []string{"default", "enhanced", "accessible"} {
+			opts.Template = name
+			require.NoError(t, archive.WriteExportFiles(base, []string{"html", "json"}, lazyTestMessages(), opts), name)
+
+			page, err := os.ReadFile(base + ".html")
+			require.NoError(t, err)
+			assert.Contains(t, string(page), `data-index="archive_files/search.js"`, name)
+			assert.Contains(t, string(page), `id="msg-a"`, name)
+			assert.Contains(t, string(page), "archiveSearchIndex", name)
+
+			script, err := os.ReadFile(filepath.Join(base+"_files", "search.js"))
+			require.NoError(t, err)
+			data, ok := strings.CutPrefix(strings.TrimSpace(string(script)), "archiveSearchIndex(")
+			require.True(t, ok, name)
+			var index archive.SearchIndex
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimSuffix(data, ");")), &index), name)
+			assert.Len(t, index.Docs, 5, name)
+			if lazyLoad == 2 {
+				assert.Equal(t, "section-4", index.Docs[4][4], name)
+			}
+		}
+	}
+
+	exported, err := os.ReadFile(base + ".json")
+	require.NoError(t, err)
+	assert.NotContains(t, string(exported), "search", "only HTML exports are indexed")
+}
@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchNormalization(t *testing.T) {
+	plain := archive.SearchNormalization{}
+	assert.Equal(t, "über file abc", plain.Normalize("Über ﬁle ＡＢＣ"), "NFKC and lowercase by default")
+	assert.False(t, plain.Contains("Über den Wolken", "uber"))
+
+	folded := archive.SearchNormalization{FoldDiacritics: true}
+	assert.True(t, folded.Contains("Über den Wolken", "uber"))
+	assert.True(t, folded.Contains("un café", "CAFE"))
+	assert.True(t, folded.Contains("Straße", "strasse"))
+	assert.Equal(t, "lodz oresund", folded.Normalize("Łódź Øresund"))
+
+	swedish := archive.SearchNormalization{FoldDiacritics: true, Language: "sv"}
+	assert.False(t, swedish.Contains("Hår", "har"), "Swedish keeps å as a letter of its own")
+	assert.True(t, swedish.Contains("Hår", "HÅR"))
+	assert.True(t, swedish.Contains("café", "cafe"))
+
+	turkish := archive.SearchNormalization{Language: "tr"}
+	assert.Equal(t, "istanbul ılık", turkish.Normalize("İSTANBUL ILIK"))
+
+	lang, err := archive.ParseSearchLanguage("de-AT")
+	require.NoError(t, err)
+	assert.Equal(t, "de", lang)
+	_, err = archive.ParseSearchLanguage("not a language")
+	assert.Error(t, err)
+}
+
+func TestMatchMessagesNormalized(t *testing.T) {
+	ts := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	messages := []*archive.Message{
+		{EventID: "$1", RoomID: "!room:example.com", Sender: "@alice:example.com", Timestamp: ts, Content: map[string]interface{}{"msgtype": "m.text", "body": "Über alles"}},
+		{EventID: "$2", RoomID: "!room:example.com", Sender: "@bob:example.com", Timestamp: ts, Content: map[string]interface{}{"msgtype": "m.text", "body": "uber eats"}},
+	}
+	assert.Len(t, archive.MatchMessages(messages, "uber"), 1)
+	assert.Len(t, archive.SearchNormalization{FoldDiacritics: true}.MatchMessages(messages, "uber"), 2)
+	assert.Len(t, archive.SearchNormalization{FoldDiacritics: true}.MatchMessages(messages, "Über"), 2)
+}
+
+func TestDuckDBSearchNormalization(t *testing.T) {
+	ctx := context.Background()
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	n, err := db.GetSearchNormalization(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, archive.SearchNormalization{}, *n, "archives start with the default")
+
+	require.NoError(t, db.SaveSearchNormalization(ctx, &archive.SearchNormalization{Language: "sv", FoldDiacritics: true}))
+	n, err = db.GetSearchNormalization(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, archive.SearchNormalization{Language: "sv", FoldDiacritics: true}, *n)
+}
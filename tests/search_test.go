@@ -0,0 +1,51 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractImageText(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screenshot.png")
+	require.NoError(t, os.WriteFile(path, []byte("  Error: disk full\n"), 0644))
+
+	text, err := archive.ExtractImageText("cat {file}", path)
+	require.NoError(t, err)
+	assert.Equal(t, "Error: disk full", text)
+
+	// Without {file} the path is appended
+	text, err = archive.ExtractImageText("cat", path)
+	require.NoError(t, err)
+	assert.Equal(t, "Error: disk full", text)
+
+	_, err = archive.ExtractImageText("cat {file}", filepath.Join(t.TempDir(), "missing.png"))
+	assert.Error(t, err)
+
+	_, err = archive.ExtractImageText("  ", path)
+	assert.Error(t, err)
+}
+
+func TestMatchMessages(t *testing.T) {
+	ts := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	messages := []*archive.Message{
+		{EventID: "$1", RoomID: "!room:example.com", Sender: "@alice:example.com", Timestamp: ts, Content: map[string]interface{}{"msgtype": "m.text", "body": "The Deploy is done"}},
+		{EventID: "$2", RoomID: "!room:example.com", Sender: "@bob:example.com", Timestamp: ts, Content: map[string]interface{}{"msgtype": "m.text", "body": "lunch?"}},
+		{EventID: "$3", RoomID: "!room:example.com", Sender: "@bob:example.com", Timestamp: ts, Content: map[string]interface{}{"msgtype": "m.image"}},
+	}
+
+	results := archive.MatchMessages(messages, "deploy")
+	require.Len(t, results, 1)
+	assert.Equal(t, "$1", results[0].EventID)
+	assert.Equal(t, "@alice:example.com", results[0].Sender)
+	assert.Equal(t, archive.SearchSourceMessage, results[0].Source)
+	assert.Equal(t, "The Deploy is done", results[0].Text)
+
+	assert.Empty(t, archive.MatchMessages(messages, "dinner"))
+}
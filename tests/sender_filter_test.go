@@ -0,0 +1,56 @@
+package tests
+
+import (
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSenderFilter(t *testing.T) {
+	t.Run("archives everyone by default", func(t *testing.T) {
+		var filter archive.SenderFilter
+		assert.True(t, filter.IsEmpty())
+		assert.True(t, filter.Archives("@alice:example.org"))
+	})
+
+	t.Run("deny list", func(t *testing.T) {
+		filter := archive.SenderFilter{Deny: []string{"@*bot:*", "@telegram_*:beeper.local"}}
+		assert.False(t, filter.Archives("@githubbot:example.org"))
+		assert.False(t, filter.Archives("@telegram_1234:beeper.local"))
+		assert.True(t, filter.Archives("@alice:example.org"))
+		assert.True(t, filter.Archives("@telegram_1234:example.org"))
+	})
+
+	t.Run("allow list", func(t *testing.T) {
+		filter := archive.SenderFilter{Allow: []string{"@*:example.org"}, Deny: []string{"@spambot:example.org"}}
+		assert.True(t, filter.Archives("@alice:example.org"))
+		assert.False(t, filter.Archives("@mallory:elsewhere.net"))
+		assert.False(t, filter.Archives("@spambot:example.org"), "deny wins over allow")
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		assert.NoError(t, archive.SenderFilter{Allow: []string{"@*:example.org"}}.Validate())
+		assert.Error(t, archive.SenderFilter{Deny: []string{"@[bot:example.org"}}.Validate())
+	})
+
+	t.Run("from the environment", func(t *testing.T) {
+		t.Setenv(archive.AllowSendersEnv, "")
+		t.Setenv(archive.DenySendersEnv, " @*bot:* , @noisy:example.org,")
+		filter := archive.SenderFilterFromEnv()
+		assert.Empty(t, filter.Allow)
+		assert.Equal(t, []string{"@*bot:*", "@noisy:example.org"}, filter.Deny)
+	})
+	t.Run("flags win over the environment", func(t *testing.T) {
+		t.Setenv(archive.DenySendersEnv, "@*bot:*")
+		t.Setenv(archive.RespectOptOutsEnv, "true")
+		filter := archive.SenderFilter{Allow: []string{"@*:example.org"}}.OrEnv()
+		assert.Equal(t, []string{"@*:example.org"}, filter.Allow)
+		assert.Empty(t, filter.Deny)
+		assert.True(t, filter.RespectOptOuts, "opt-outs are respected if either asks")
+
+		filter = archive.SenderFilter{RespectOptOuts: true}.OrEnv()
+		assert.Equal(t, []string{"@*bot:*"}, filter.Deny)
+	})
+}
@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubjectReactions(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	messages := []*archive.Message{
+		{EventID: "$msg", RoomID: "!room:example.org", MessageType: archive.EventTypeMessage, Timestamp: ts,
+			Content: map[string]interface{}{"msgtype": "m.text", "body": "hi"}},
+		{EventID: "$react", RoomID: "!room:example.org", MessageType: archive.EventTypeReaction, Timestamp: ts,
+			Content: map[string]interface{}{"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": "$other", "key": "👍"}}},
+	}
+
+	reactions := archive.SubjectReactions(messages)
+	require.Len(t, reactions, 1)
+	assert.Equal(t, archive.SubjectAccessReaction{EventID: "$react", RoomID: "!room:example.org", ReactedTo: "$other", Key: "👍", Timestamp: ts}, reactions[0])
+}
+
+func TestWriteSubjectAccessPackage(t *testing.T) {
+	t.Chdir("..")
+	source := filepath.Join(t.TempDir(), "abc.png")
+	require.NoError(t, os.WriteFile(source, []byte("png"), 0644))
+
+	ts := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	pkg := &archive.SubjectAccessPackage{
+		UserID:      "@alice:example.org",
+		GeneratedAt: ts,
+		Rooms: []archive.SubjectAccessRoom{
+			{RoomID: "!room:example.org", Messages: []archive.ExportMessage{{EventID: "$1", UserID: "@alice:example.org", Sender: "alice", Timestamp: "2024-01-02T15:04:05Z", Content: map[string]interface{}{"body": "hi"}}}},
+		},
+		Reactions:   []archive.SubjectAccessReaction{{EventID: "$2", RoomID: "!other:example.org", ReactedTo: "$9", Key: "👍", Timestamp: ts}},
+		Memberships: []*archive.MembershipEvent{{EventID: "$3", RoomID: "!room:example.org", UserID: "@alice:example.org", Membership: "join", Timestamp: ts}},
+		Media: []archive.SubjectAccessMedia{
+			{EventID: "$4", RoomID: "!room:example.org", MXC: "mxc://example.org/abc", SourcePath: source},
+			{EventID: "$5", RoomID: "!room:example.org", MXC: "mxc://example.org/missing"},
+		},
+	}
+
+	dir := filepath.Join(t.TempDir(), "package")
+	require.NoError(t, archive.WriteSubjectAccessPackage(dir, pkg))
+
+	for _, name := range []string{"README.txt", "manifest.json", "reactions.json", "memberships.json", "moderation.json", "media.json", "rooms/room_example.org-03cbb71e/messages.json", "media/abc.png"} {
+		assert.FileExists(t, filepath.Join(dir, filepath.FromSlash(name)))
+	}
+
+	var manifest struct {
+		UserID string `json:"user_id"`
+		Rooms  []struct {
+			RoomID      string `json:"room_id"`
+			Path        string `json:"path"`
+			Messages    int    `json:"messages"`
+			Reactions   int    `json:"reactions"`
+			Memberships int    `json:"memberships"`
+		} `json:"rooms"`
+		Totals map[string]int `json:"totals"`
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &manifest))
+	assert.Equal(t, "@alice:example.org", manifest.UserID)
+	require.Len(t, manifest.Rooms, 2)
+	assert.Equal(t, "!other:example.org", manifest.Rooms[0].RoomID)
+	assert.Equal(t, 1, manifest.Rooms[0].Reactions)
+	assert.Equal(t, "rooms/room_example.org-03cbb71e/messages.json", manifest.Rooms[1].Path)
+	assert.Equal(t, 1, manifest.Rooms[1].Messages)
+	assert.Equal(t, 1, manifest.Rooms[1].Memberships)
+	assert.Equal(t, 2, manifest.Totals["media"])
+	assert.Equal(t, 1, manifest.Totals["media_included"])
+
+	var media []archive.SubjectAccessMedia
+	data, err = os.ReadFile(filepath.Join(dir, "media.json"))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &media))
+	require.Len(t, media, 2)
+	assert.Equal(t, "media/abc.png", media[0].Path)
+	assert.Empty(t, media[1].Path)
+
+	// The messages file is a regular export document
+	count, problems, err := archive.ValidateExportFile(filepath.Join(dir, "rooms", "room_example.org-03cbb71e", "messages.json"))
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+	assert.Equal(t, 1, count)
+}
@@ -0,0 +1,66 @@
+package tests
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func templateContextMessages() []archive.ExportMessage {
+	return []archive.ExportMessage{
+		{EventID: "$1", UserID: "@alice:example.org", Sender: "alice", DisplayName: "Alice", Timestamp: "2024-01-02T15:04:05Z", Content: map[string]interface{}{"msgtype": "m.text", "body": "hello"}},
+		{EventID: "$2", UserID: "@bob:example.org", Sender: "bob", DisplayName: "Bob", Timestamp: "2024-01-02T15:05:00Z", Content: map[string]interface{}{"msgtype": "m.text", "body": "hi"}},
+	}
+}
+
+func TestExportWithTemplateOptions_TemplateContext(t *testing.T) {
+	t.Chdir("..")
+
+	templatePath := filepath.Join(t.TempDir(), "context.txt.tpl")
+	require.NoError(t, os.WriteFile(templatePath, []byte(
+		`{{.Archive.Generator}} {{.Room.ID}}: {{.Stats.Messages}} from {{.Stats.Users}}, {{.Stats.FirstMessage}}`+
+			`{{range .Messages}} {{.Sender}}{{end}}`), 0644))
+	opts := archive.DefaultExportOptions()
+	opts.RoomID = "!room:example.org"
+
+	var buf bytes.Buffer
+	require.NoError(t, archive.ExportWithTemplateOptions(&buf, templatePath, templateContextMessages(), opts))
+	assert.Equal(t, "matrix-archive !room:example.org: 2 from 2, 2024-01-02T15:04:05Z alice bob", buf.String())
+}
+
+func TestExportWithTemplateOptions_LegacyTemplate(t *testing.T) {
+	t.Chdir("..")
+
+	// Templates written for the messages as "." still render them
+	templatePath := filepath.Join(t.TempDir(), "legacy.txt.tpl")
+	require.NoError(t, os.WriteFile(templatePath, []byte(`{{len .}}:{{range .}} {{.DisplayName}}{{end}}`), 0644))
+
+	var buf bytes.Buffer
+	require.NoError(t, archive.ExportWithTemplateOptions(&buf, templatePath, templateContextMessages(), archive.DefaultExportOptions()))
+	assert.Equal(t, "2: Alice Bob", buf.String())
+}
+
+func TestTemplateSchema(t *testing.T) {
+	paths := map[string]string{}
+	for _, field := range archive.TemplateSchema() {
+		paths[field.Path] = field.Type
+	}
+	assert.Equal(t, "[]ExportMessage", paths[".Messages"])
+	assert.Equal(t, "string", paths[".Messages[].Sender"])
+	assert.Equal(t, "int", paths[".Stats.Messages"])
+	assert.Equal(t, "string", paths[".Room.ID"])
+	assert.Contains(t, paths, ".Participants[].UserID")
+
+	var names []string
+	for _, fn := range archive.TemplateFunctions() {
+		names = append(names, fn.Path)
+	}
+	assert.Contains(t, names, "t")
+	assert.IsIncreasing(t, names)
+}
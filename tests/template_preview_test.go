@@ -0,0 +1,34 @@
+package tests
+
+import (
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectRecent(t *testing.T) {
+	text := func(id string) archive.ExportMessage {
+		return archive.ExportMessage{EventID: id, MessageType: archive.EventTypeMessage, Content: map[string]interface{}{"msgtype": "m.text", "body": id}}
+	}
+	reaction := func(id, target string) archive.ExportMessage {
+		return archive.ExportMessage{EventID: id, MessageType: archive.EventTypeReaction, Content: map[string]interface{}{
+			"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": target, "key": "👍"},
+		}}
+	}
+	edit := text("$edit")
+	edit.Content["m.relates_to"] = map[string]interface{}{"rel_type": "m.replace", "event_id": "$b"}
+
+	messages := []archive.ExportMessage{
+		text("$a"), reaction("$ra", "$a"), text("$b"), text("$c"), edit, reaction("$rc", "$c"),
+	}
+	var ids []string
+	for _, msg := range archive.SelectRecent(messages, 2) {
+		ids = append(ids, msg.EventID)
+	}
+	assert.Equal(t, []string{"$b", "$c", "$edit", "$rc"}, ids, "reactions and edits of the sample come with it")
+
+	assert.Len(t, archive.SelectRecent(messages, 10), len(messages))
+	assert.Empty(t, archive.SelectRecent(nil, 5))
+}
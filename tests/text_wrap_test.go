@@ -0,0 +1,62 @@
+package tests
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+	"github.com/rivo/uniseg"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrapText(t *testing.T) {
+	text := "The quick brown fox jumps over the lazy dog"
+	assert.Equal(t, "The quick brown\nfox jumps over\nthe lazy dog", archive.WrapText(text, 15))
+	assert.Equal(t, text, archive.WrapText(text, 0), "width 0 doesn't wrap")
+	assert.Equal(t, "short\n\nlines", archive.WrapText("short\n\nlines", 15), "existing line breaks are kept")
+
+	assert.Equal(t, "- first item\n  wraps under\n  its text", archive.WrapText("- first item wraps under its text", 13))
+	assert.Equal(t, "12. one two\n    three", archive.WrapText("12. one two three", 11))
+	assert.Equal(t, "> quoted text\n> continues", archive.WrapText("> quoted text continues", 14))
+	assert.Equal(t, "    indented\n    code", archive.WrapText("    indented code", 14))
+
+	url := "https://example.org/a/very/long/path/that/cannot/be/broken"
+	assert.Equal(t, "see\n"+url+"\nfor more", archive.WrapText("see "+url+" for more", 20), "long words are kept whole")
+
+	wrapped := archive.WrapText("日本語のテキストはスペースなしで折り返されます", 10)
+	for _, line := range strings.Split(wrapped, "\n") {
+		assert.LessOrEqual(t, uniseg.StringWidth(line), 10, "wide characters count as two columns: %q", line)
+	}
+	assert.Equal(t, "日本語のテキストはスペースなしで折り返されます", strings.ReplaceAll(wrapped, "\n", ""))
+
+	assert.Equal(t, "café café", archive.WrapText("café café", 9), "combining marks take no columns")
+	assert.Equal(t, "Caption: a photo\n         of a cat", archive.WrapTextHanging("Caption: ", "a photo of a cat", 18))
+}
+
+func TestExportWrapsText(t *testing.T) {
+	t.Chdir("..")
+
+	long := strings.Repeat("lorem ipsum ", 20)
+	messages := []archive.ExportMessage{
+		{EventID: "$a", Sender: "@alice:example.org", Timestamp: "2024-03-01T09:00:00Z", Content: map[string]interface{}{"msgtype": "m.text", "body": long}},
+		{EventID: "$b", Sender: "@bob:example.org", Timestamp: "2024-03-01T09:01:00Z", Content: map[string]interface{}{"msgtype": "m.image", "body": long, "url": "mxc://example.org/cat"}},
+	}
+
+	var plain bytes.Buffer
+	require.NoError(t, archive.ExportWithTemplateOptions(&plain, "templates/default.txt.tpl", messages, archive.DefaultExportOptions()))
+	assert.Contains(t, plain.String(), strings.TrimSpace(long), "text isn't wrapped by default")
+
+	var buf bytes.Buffer
+	opts := archive.DefaultExportOptions()
+	opts.Width = 40
+	require.NoError(t, archive.ExportWithTemplateOptions(&buf, "templates/default.txt.tpl", messages, opts))
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if !strings.HasPrefix(line, "=====") {
+			assert.LessOrEqual(t, uniseg.StringWidth(line), 40, "%q", line)
+		}
+	}
+	assert.Contains(t, buf.String(), "Caption: lorem ipsum lorem ipsum lorem\n         ipsum")
+}
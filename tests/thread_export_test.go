@@ -0,0 +1,38 @@
+package tests
+
+import (
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectThread(t *testing.T) {
+	messages := []archive.ExportMessage{
+		contextMessage("$root", "should we ship on friday?", nil),
+		contextMessage("$other", "unrelated", nil),
+		contextMessage("$reply1", "no", map[string]interface{}{"rel_type": "m.thread", "event_id": "$root"}),
+		contextMessage("$reaction", "", map[string]interface{}{"rel_type": "m.annotation", "event_id": "$reply1", "key": "👍"}),
+		contextMessage("$elsewhere", "", map[string]interface{}{"rel_type": "m.annotation", "event_id": "$other", "key": "👍"}),
+		contextMessage("$reply2", "monday then", map[string]interface{}{"rel_type": "m.thread", "event_id": "$root"}),
+		contextMessage("$edit", "* monday it is", map[string]interface{}{"rel_type": "m.replace", "event_id": "$reply2"}),
+		contextMessage("$other-thread", "elsewhere", map[string]interface{}{"rel_type": "m.thread", "event_id": "$other"}),
+	}
+
+	for _, eventID := range []string{"$root", "$reply2"} {
+		thread, err := archive.SelectThread(messages, eventID)
+		require.NoError(t, err, eventID)
+		var ids []string
+		for _, msg := range thread {
+			ids = append(ids, msg.EventID)
+		}
+		assert.Equal(t, []string{"$root", "$reply1", "$reaction", "$reply2", "$edit"}, ids, eventID)
+	}
+
+	_, err := archive.SelectThread(messages, "$reaction")
+	assert.Error(t, err, "a message without thread replies isn't a thread")
+	_, err = archive.SelectThread(messages, "$missing")
+	assert.Error(t, err)
+}
@@ -0,0 +1,30 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseImportDateRange(t *testing.T) {
+	since, until, err := archive.ParseImportDateRange("", "")
+	require.NoError(t, err)
+	assert.True(t, since.IsZero())
+	assert.True(t, until.IsZero())
+
+	since, until, err = archive.ParseImportDateRange("2024-01-01", "2024-01-31")
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local), since)
+	// The until date is inclusive
+	assert.Equal(t, time.Date(2024, 2, 1, 0, 0, 0, 0, time.Local), until)
+
+	_, _, err = archive.ParseImportDateRange("01/02/2024", "")
+	assert.Error(t, err)
+
+	_, _, err = archive.ParseImportDateRange("2024-02-01", "2024-01-01")
+	assert.Error(t, err)
+}
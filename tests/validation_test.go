@@ -0,0 +1,122 @@
+package tests
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateWith(t *testing.T) {
+	valid := func() *archive.Message {
+		return &archive.Message{
+			RoomID:      "!room:example.org",
+			EventID:     "$Rqnc-F-dvnEYJTyHq_iKxU2bZ1CI92-kuZq3a5lr5Zg",
+			Sender:      "@alice:example.org",
+			MessageType: "m.room.message",
+			Timestamp:   time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC),
+			Content:     map[string]interface{}{"msgtype": "m.text", "body": "hello"},
+		}
+	}
+	for _, mode := range []string{"", archive.ValidationLenient, archive.ValidationStandard, archive.ValidationStrict} {
+		assert.NoError(t, valid().ValidateWith(mode), mode)
+	}
+
+	tests := []struct {
+		name     string
+		change   func(*archive.Message)
+		field    string
+		failMode string // The most lenient mode that rejects the message
+	}{
+		{"malformed sender", func(m *archive.Message) { m.Sender = "alice" }, "sender", archive.ValidationLenient},
+		{"zero timestamp", func(m *archive.Message) { m.Timestamp = time.Time{} }, "timestamp", archive.ValidationStandard},
+		{"future timestamp", func(m *archive.Message) { m.Timestamp = time.Now().Add(72 * time.Hour) }, "timestamp", archive.ValidationStandard},
+		{"invalid UTF-8 in content", func(m *archive.Message) {
+			m.Content["body"] = "caf\xe9"
+		}, "content", archive.ValidationStandard},
+		{"invalid UTF-8 in a nested key", func(m *archive.Message) {
+			m.Content["info"] = map[string]interface{}{"\xff": []interface{}{"x"}}
+		}, "content", archive.ValidationStandard},
+		{"event ID in no room version's format", func(m *archive.Message) { m.EventID = "$tooshort" }, "event_id", archive.ValidationStrict},
+		{"timestamp before Matrix", func(m *archive.Message) { m.Timestamp = time.Date(2009, 1, 1, 0, 0, 0, 0, time.UTC) }, "timestamp", archive.ValidationStrict},
+		{"oversized content", func(m *archive.Message) {
+			m.Content["body"] = strings.Repeat("x", archive.MaxEventContentSize)
+		}, "content", archive.ValidationStrict},
+	}
+	modes := []string{archive.ValidationLenient, archive.ValidationStandard, archive.ValidationStrict}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rejected := false
+			for _, mode := range modes {
+				rejected = rejected || mode == tt.failMode
+				msg := valid()
+				tt.change(msg)
+				err := msg.ValidateWith(mode)
+				if !rejected {
+					assert.NoError(t, err, mode)
+					continue
+				}
+				var validationErr *archive.ValidationError
+				require.ErrorAs(t, err, &validationErr, mode)
+				assert.Equal(t, tt.field, validationErr.Field, mode)
+			}
+		})
+	}
+
+	t.Run("room version 1 event IDs are accepted", func(t *testing.T) {
+		msg := valid()
+		msg.EventID = "$1234567890abcdef:example.org"
+		assert.NoError(t, msg.ValidateWith(archive.ValidationStrict))
+	})
+
+	assert.NoError(t, archive.CheckValidationMode(""))
+	assert.Error(t, archive.CheckValidationMode("paranoid"))
+}
+
+func TestImportPipelineQuarantine(t *testing.T) {
+	ctx := context.Background()
+	db := archive.NewDuckDBDatabase(&archive.DatabaseConfig{DatabaseURL: ":memory:", IsInMemory: true, MaxConns: 1})
+	require.NoError(t, db.Connect(ctx))
+	defer db.Close()
+
+	future := sourceMessage("!room:example.org", "$future", "@alice:example.org", 0)
+	future.Timestamp = time.Now().Add(72 * time.Hour)
+	batch := []*archive.Message{
+		sourceMessage("!room:example.org", "$ok", "@alice:example.org", 1),
+		sourceMessage("!room:example.org", "not-an-event-id", "@alice:example.org", 2),
+		future,
+	}
+
+	pipeline := &archive.ImportPipeline{DB: db}
+	require.NoError(t, pipeline.Store(ctx, batch))
+	assert.Equal(t, 1, pipeline.Imported)
+	assert.Equal(t, 2, pipeline.Quarantined)
+
+	quarantined, err := db.GetQuarantinedMessages(ctx, "!room:example.org")
+	require.NoError(t, err)
+	require.Len(t, quarantined, 2)
+	reasons := map[string]string{}
+	for _, q := range quarantined {
+		assert.Equal(t, archive.ValidationStandard, q.Validation)
+		assert.Equal(t, "@alice:example.org", q.Message.Sender)
+		reasons[q.Message.EventID] = q.Reason
+	}
+	assert.Contains(t, reasons["not-an-event-id"], "event_id")
+	assert.Contains(t, reasons["$future"], "future")
+
+	t.Run("lenient validation stores what standard quarantines", func(t *testing.T) {
+		lenient := &archive.ImportPipeline{DB: db, Validation: archive.ValidationLenient}
+		require.NoError(t, lenient.Store(ctx, []*archive.Message{future}))
+		assert.Equal(t, 1, lenient.Imported)
+	})
+
+	require.NoError(t, db.DeleteQuarantinedMessage(ctx, "$future"))
+	quarantined, err = db.GetQuarantinedMessages(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, quarantined, 1)
+}
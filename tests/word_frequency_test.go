@@ -0,0 +1,101 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	archive "github.com/osteele/matrix-archive/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalyzerTokens(t *testing.T) {
+	en, err := archive.NewAnalyzer("en")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alice", "archive", "ready", "see"},
+		en.Tokens("Alice's archive is ready, see https://example.org/x and @bob:example.org 2024 x"))
+	assert.Equal(t, []string{"archive", "ready", "o'clock"}, en.Tokens("The archive isn’t ready until 5 o’clock"), "the apostrophe stays inside words")
+
+	de, err := archive.NewAnalyzer("de")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"archiv", "größer", "gestern"}, de.Tokens("Das Archiv ist größer als gestern"))
+
+	fr, err := archive.NewAnalyzer("fr")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"archive", "prête", "aujourd'hui"}, fr.Tokens("L'archive est prête aujourd'hui"), "elided articles are dropped")
+
+	es, err := archive.NewAnalyzer("es")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"archivo", "listo"}, es.Tokens("¿El archivo está listo?"))
+
+	none, err := archive.NewAnalyzer("none")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"the", "archive"}, none.Tokens("the archive"))
+
+	assert.Equal(t, []string{"東京", "京大", "大学", "matrix"}, en.Tokens("東京大学 Matrix"), "CJK text is split into pairs of characters")
+	assert.Equal(t, []string{"猫"}, en.Tokens("猫"))
+
+	_, err = archive.NewAnalyzer("xx")
+	assert.Error(t, err)
+}
+
+func TestAnalyzerConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "analyzers.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+rooms:
+  - room: "!berlin:example.org"
+    language: de
+  - room: "!*:example.fr"
+    language: fr
+stopwords:
+  en: [lol]
+`), 0o644))
+	cfg, err := archive.LoadAnalyzerConfig(path)
+	require.NoError(t, err)
+	assert.Equal(t, "de", cfg.AnalyzerFor("!berlin:example.org").Language)
+	assert.Equal(t, "fr", cfg.AnalyzerFor("!paris:example.fr").Language)
+	assert.Equal(t, "en", cfg.AnalyzerFor("!other:example.org").Language)
+	assert.Empty(t, cfg.AnalyzerFor("!other:example.org").Tokens("lol"), "extra stopwords apply")
+
+	require.NoError(t, os.WriteFile(path, []byte("rooms:\n  - room: \"!a:example.org\"\n    language: klingon\n"), 0o644))
+	_, err = archive.LoadAnalyzerConfig(path)
+	assert.Error(t, err)
+
+	t.Setenv(archive.AnalyzersEnv, "")
+	cfg, err = archive.LoadAnalyzerConfigOrEnv("")
+	require.NoError(t, err)
+	assert.Equal(t, "en", cfg.AnalyzerFor("!any:example.org").Language)
+}
+
+func TestCountWords(t *testing.T) {
+	text := func(room, sender, body string) *archive.Message {
+		return &archive.Message{RoomID: room, Sender: sender, MessageType: archive.EventTypeMessage,
+			Content: map[string]interface{}{"msgtype": "m.text", "body": body}}
+	}
+	edit := text("!en:example.org", "@alice:example.org", "* deploy")
+	edit.Content["m.relates_to"] = map[string]interface{}{"rel_type": "m.replace", "event_id": "$1"}
+	image := text("!en:example.org", "@alice:example.org", "deploy.png")
+	image.Content["msgtype"] = "m.image"
+	reply := text("!en:example.org", "@bob:example.org", "> <@alice:example.org> the deploy failed\n\nretry the deploy")
+	reply.Content["m.relates_to"] = map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": "$1"}}
+
+	messages := []*archive.Message{
+		text("!en:example.org", "@alice:example.org", "the deploy failed, deploy again"),
+		reply,
+		text("!de:example.org", "@carol:example.org", "Der Deploy ist fertig"),
+		text("!en:example.org", "@dave:example.org", "deploy deploy deploy"),
+		edit,
+		image,
+	}
+	cfg := &archive.AnalyzerConfig{Rooms: []archive.RoomAnalyzer{{Room: "!de:*", Language: "de"}}}
+	require.NoError(t, cfg.Compile())
+	words := archive.CountWords(messages, cfg.AnalyzerFor, map[string]bool{"@dave:example.org": true})
+
+	require.NotEmpty(t, words)
+	assert.Equal(t, archive.WordFrequency{Word: "deploy", Count: 4, Messages: 3, Senders: 3}, words[0])
+	for _, wf := range words {
+		assert.NotContains(t, []string{"the", "der", "ist", "png"}, wf.Word)
+	}
+}